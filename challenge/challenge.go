@@ -3,7 +3,6 @@ package challenge
 
 import (
 	"crypto/x509"
-	"errors"
 
 	"github.com/micromdm/scep/v2/scep"
 	scepserver "github.com/micromdm/scep/v2/server"
@@ -15,16 +14,43 @@ type Store interface {
 	HasChallenge(pw string) (bool, error)
 }
 
-// Middleware wraps next in a CSRSigner that verifies and invalidates the challenge
+// Verifier is implemented by stores which bind challenges to the CSR they
+// were minted for. Middleware prefers VerifyChallenge over HasChallenge.
+type Verifier interface {
+	// VerifyChallenge reports whether pw is a valid challenge for csr and
+	// invalidates it.
+	VerifyChallenge(pw string, csr *x509.CertificateRequest) (bool, error)
+}
+
+// MetadataVerifier is implemented by stores whose challenges carry
+// metadata, like HMACStore. Middleware prefers VerifyChallengeMetadata over
+// VerifyChallenge.
+type MetadataVerifier interface {
+	// VerifyChallengeMetadata reports whether pw is a valid challenge for
+	// csr, returns its metadata and invalidates it.
+	VerifyChallengeMetadata(pw string, csr *x509.CertificateRequest) (map[string]string, bool, error)
+}
+
+// Middleware wraps next in a CSRSigner that verifies and invalidates the
+// challenge. The metadata of the challenge of a MetadataVerifier is set as
+// the ChallengeMetadata of the message.
 func Middleware(store Store, next scepserver.CSRSigner) scepserver.CSRSignerFunc {
 	return func(m *scep.CSRReqMessage) (*x509.Certificate, error) {
 		// TODO: compare challenge only for PKCSReq?
-		valid, err := store.HasChallenge(m.ChallengePassword)
+		var valid bool
+		var err error
+		if v, ok := store.(MetadataVerifier); ok {
+			m.ChallengeMetadata, valid, err = v.VerifyChallengeMetadata(m.ChallengePassword, m.CSR)
+		} else if v, ok := store.(Verifier); ok {
+			valid, err = v.VerifyChallenge(m.ChallengePassword, m.CSR)
+		} else {
+			valid, err = store.HasChallenge(m.ChallengePassword)
+		}
 		if err != nil {
 			return nil, err
 		}
 		if !valid {
-			return nil, errors.New("invalid challenge")
+			return nil, scepserver.ErrInvalidChallenge
 		}
 		return next.SignCSR(m)
 	}
@@ -0,0 +1,294 @@
+package challenge
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+	scepserver "github.com/micromdm/scep/v2/server"
+)
+
+func TestHMACStore(t *testing.T) {
+	store, err := NewHMACStore([]byte("0123456789abcdef"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr := func(cn string) *x509.CertificateRequest {
+		return &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}}
+	}
+
+	// unbound challenges are valid once for any subject
+	pw, err := store.SCEPChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.ContainsAny(pw, "_-=") {
+		t.Errorf("challenge %q is not a PrintableString", pw)
+	}
+	signer := Middleware(store, scepserver.NopCSRSigner())
+	if _, err := signer.SignCSR(&scep.CSRReqMessage{ChallengePassword: pw, CSR: csr("any")}); err != nil {
+		t.Error(err)
+	}
+	if _, err := signer.SignCSR(&scep.CSRReqMessage{ChallengePassword: pw, CSR: csr("any")}); err == nil {
+		t.Error("challenge should not be valid twice")
+	}
+
+	// used challenges are forgotten once expired
+	store.expires[0].expiry = time.Now().Add(-time.Second)
+	next, err := store.SCEPChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid, _ := store.HasChallenge(next); !valid || len(store.used) != 1 || len(store.expires) != 1 {
+		t.Errorf("have %d used challenges after one expired, want 1", len(store.used))
+	}
+
+	// bound challenges are only valid for their subject
+	pw, err = store.SubjectChallenge("device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid, _ := store.HasChallenge(pw); valid {
+		t.Error("subject challenge valid without subject")
+	}
+	if valid, _ := store.VerifyChallenge(pw, csr("device-2")); valid {
+		t.Error("subject challenge valid for other subject")
+	}
+	if valid, _ := store.VerifyChallenge(pw, csr("device-1")); !valid {
+		t.Error("subject challenge not valid for its subject")
+	}
+
+	// the bound common name cannot be moved into the metadata
+	pw, err = store.SubjectChallenge("device-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid, _ := store.VerifyChallenge(forge(t, pw, []byte("device-1")), csr("attacker")); valid {
+		t.Error("forged unbound challenge is valid")
+	}
+
+	// expired and forged challenges
+	expired, err := NewHMACStore([]byte("0123456789abcdef"), -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw, err = expired.SCEPChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid, _ := store.HasChallenge(pw); valid {
+		t.Error("expired challenge is valid")
+	}
+	other, err := NewHMACStore([]byte("fedcba9876543210"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw, err = other.SCEPChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid, _ := store.HasChallenge(pw); valid {
+		t.Error("challenge of other key is valid")
+	}
+}
+
+// forge returns the challenge pw with binding moved into its metadata,
+// keeping its MAC.
+func forge(t *testing.T, pw string, binding []byte) string {
+	token, err := base64.RawStdEncoding.DecodeString(pw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := len(token) - sha256.Size
+	forged := append(append(append([]byte{}, token[:n]...), binding...), token[n:]...)
+	return base64.RawStdEncoding.EncodeToString(forged)
+}
+
+func TestHMACStoreIdentity(t *testing.T) {
+	store, err := NewHMACStore([]byte("0123456789abcdef"), time.Hour, RequireIdentity())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SCEPChallenge(); err != ErrIdentityRequired {
+		t.Errorf("have error %v, want %v", err, ErrIdentityRequired)
+	}
+	id := Identity{
+		Subject:     "CN=device-1,O=Example",
+		DNSNames:    []string{"device-1.example.com", "device-1.example.net"},
+		IPAddresses: []net.IP{net.ParseIP("192.0.2.1")},
+	}
+	csr := func(cn string, dnsNames ...string) *x509.CertificateRequest {
+		return &x509.CertificateRequest{
+			Subject:     pkix.Name{CommonName: cn, Organization: []string{"Example"}},
+			DNSNames:    dnsNames,
+			IPAddresses: []net.IP{net.ParseIP("192.0.2.1").To4()},
+		}
+	}
+
+	for _, tc := range []struct {
+		name string
+		csr  *x509.CertificateRequest
+	}{
+		{"other subject", csr("device-2", "device-1.example.com", "device-1.example.net")},
+		{"missing SAN", csr("device-1", "device-1.example.com")},
+		{"extra SAN", csr("device-1", "device-1.example.com", "device-1.example.net", "evil.example.com")},
+		{"other SAN", csr("device-1", "device-1.example.com", "device-2.example.net")},
+	} {
+		pw, err := store.IdentityChallenge(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if valid, _ := store.VerifyChallenge(pw, tc.csr); valid {
+			t.Errorf("%s: identity challenge is valid", tc.name)
+		}
+	}
+
+	// the order of the SANs does not matter
+	pw, err := store.IdentityChallenge(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid, _ := store.HasChallenge(pw); valid {
+		t.Error("identity challenge valid without CSR")
+	}
+	if valid, _ := store.VerifyChallenge(pw, csr("device-1", "device-1.example.net", "device-1.example.com")); !valid {
+		t.Error("identity challenge not valid for its identity")
+	}
+
+	// the encoding of an identity does not pass as a common name
+	unbound, err := NewHMACStore([]byte("0123456789abcdef"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw, err = unbound.IdentityChallenge(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid, _ := unbound.VerifyChallenge(pw, csr(string(id.canonical()), "evil.example.com")); valid {
+		t.Error("identity challenge valid for its encoding as common name")
+	}
+
+	// the bound identity cannot be moved into the metadata
+	pw, err = unbound.IdentityChallenge(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid, _ := unbound.VerifyChallenge(forge(t, pw, id.canonical()), csr("attacker")); valid {
+		t.Error("forged unbound challenge is valid")
+	}
+}
+
+func TestHMACStoreMetadata(t *testing.T) {
+	store, err := NewHMACStore([]byte("0123456789abcdef"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw, err := store.SubjectChallenge("device-1", WithMetadata(map[string]string{"serial": "C02XYZ", "site": "Tokyo Office"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.ContainsAny(pw, "_-=") {
+		t.Errorf("challenge %q is not a PrintableString", pw)
+	}
+	var metadata map[string]string
+	signer := Middleware(store, scepserver.CSRSignerFunc(func(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+		metadata = m.ChallengeMetadata
+		return nil, nil
+	}))
+	csr := &x509.CertificateRequest{Subject: pkix.Name{CommonName: "device-1"}}
+	if _, err := signer.SignCSR(&scep.CSRReqMessage{ChallengePassword: pw, CSR: csr}); err != nil {
+		t.Fatal(err)
+	}
+	if metadata["serial"] != "C02XYZ" || metadata["site"] != "Tokyo Office" {
+		t.Errorf("have metadata %v, want the minted one", metadata)
+	}
+
+	// the metadata is authenticated
+	token, err := base64.RawStdEncoding.DecodeString(pw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token[8+hmacNonceSize+len("serial=C02")]++
+	if valid, _ := store.VerifyChallenge(base64.RawStdEncoding.EncodeToString(token), csr); valid {
+		t.Error("challenge with modified metadata is valid")
+	}
+	if _, err := store.SCEPChallenge(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.SubjectChallenge("", WithMetadata(map[string]string{"note": strings.Repeat("x", 200)})); err == nil {
+		t.Error("expected an error for too long metadata")
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	store, err := NewHMACStore([]byte("0123456789abcdef"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewAdminHandler(store, "secret"))
+	defer srv.Close()
+
+	post := func(apiKey string, form url.Values) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest("POST", srv.URL, strings.NewReader(form.Encode()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := post("wrong", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("have status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	resp = post("secret", url.Values{"cn": {"device-1"}})
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("have status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	var body struct{ Challenge string }
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	csr := &x509.CertificateRequest{Subject: pkix.Name{CommonName: "device-1"}}
+	if valid, _ := store.VerifyChallenge(body.Challenge, csr); !valid {
+		t.Error("minted challenge is not valid")
+	}
+
+	resp = post("secret", url.Values{"subject": {"CN=device-2"}, "dns": {"device-2.example.com"}})
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("have status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	csr = &x509.CertificateRequest{Subject: pkix.Name{CommonName: "device-2"}, DNSNames: []string{"device-2.example.com"}}
+	if valid, _ := store.VerifyChallenge(body.Challenge, csr); !valid {
+		t.Error("minted identity challenge is not valid")
+	}
+
+	resp = post("secret", url.Values{"ip": {"not an IP"}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("have status %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
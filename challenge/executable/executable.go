@@ -0,0 +1,91 @@
+// Package executablechallenge defines the Validator
+// scepserver.ChallengeValidator running a script to validate a challenge.
+package executablechallenge
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	userExecute os.FileMode = 1 << (6 - 3*iota)
+	groupExecute
+	otherExecute
+)
+
+// Option configures a Validator.
+type Option func(*Validator)
+
+// WithTimeout sets the time the executable may run before it is killed
+// and the validation fails with an error, 30 seconds by default.
+func WithTimeout(d time.Duration) Option {
+	return func(v *Validator) {
+		v.timeout = d
+	}
+}
+
+// New creates a Validator running the executable at path.
+func New(path string, logger log.Logger, opts ...Option) (*Validator, error) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	fileMode := fileInfo.Mode()
+	if fileMode.IsDir() {
+		return nil, errors.New("challenge validator executable is a directory")
+	}
+	if fileMode.Perm()&(userExecute|groupExecute|otherExecute) == 0 {
+		return nil, errors.New("challenge validator executable is not executable")
+	}
+	v := &Validator{executable: path, timeout: 30 * time.Second, logger: logger}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v, nil
+}
+
+// Validator implements a scepserver.ChallengeValidator.
+// It runs an executable with the PEM encoded CSR on stdin and the
+// challenge password and subject in the SCEP_CHALLENGE_PASSWORD and
+// SCEP_CSR_SUBJECT environment variables, so the challenge is not visible
+// in the process list. If the exit code is 0 the challenge is valid, any
+// other exit code rejects it. An executable that cannot be run or times
+// out is an error.
+type Validator struct {
+	executable string
+	timeout    time.Duration
+	logger     log.Logger
+}
+
+// ValidateChallenge runs the executable for challenge and csr.
+func (v *Validator) ValidateChallenge(challenge string, csr *x509.CertificateRequest) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), v.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, v.executable)
+	cmd.Env = append(os.Environ(),
+		"SCEP_CHALLENGE_PASSWORD="+challenge,
+		"SCEP_CSR_SUBJECT="+csr.Subject.String(),
+	)
+	cmd.Stdin = bytes.NewReader(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw}))
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() != nil:
+		return false, fmt.Errorf("challenge validator executable: %w", ctx.Err())
+	case errors.As(err, &exitErr):
+		v.logger.Log("msg", "challenge rejected by executable", "exit_code", exitErr.ExitCode(), "output", string(out))
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("challenge validator executable: %w", err)
+	}
+	return true, nil
+}
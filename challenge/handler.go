@@ -0,0 +1,125 @@
+package challenge
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// SubjectStore is implemented by stores which mint challenges bound to a
+// subject common name, like HMACStore.
+type SubjectStore interface {
+	SubjectChallenge(cn string, opts ...MintOption) (string, error)
+}
+
+// IdentityStore is implemented by stores which mint challenges bound to the
+// exact subject and SANs of a CSR, like HMACStore.
+type IdentityStore interface {
+	IdentityChallenge(id Identity, opts ...MintOption) (string, error)
+}
+
+// NewAdminHandler returns an http.Handler minting challenges from store, for
+// e.g. an MDM server to hand out with enrollment profiles. Requests must be
+// POSTs with the "Authorization: Bearer <apiKey>" header. The optional cn
+// form value binds the challenge to that subject if store implements
+// SubjectStore. The subject form value, e.g. "CN=device-1,O=Example", and
+// the repeatable dns, email, ip and uri form values instead bind it to
+// exactly that identity if store implements IdentityStore. The repeatable
+// metadata form value of key=value pairs makes the challenge carry them,
+// see WithMetadata. The response is a JSON object with the challenge
+// member.
+func NewAdminHandler(store Store, apiKey string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if apiKey == "" || subtle.ConstantTimeCompare([]byte(token), []byte(apiKey)) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+
+		id, bound, err := formIdentity(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var opts []MintOption
+		if pairs := r.Form["metadata"]; len(pairs) > 0 {
+			md := make(map[string]string, len(pairs))
+			for _, pair := range pairs {
+				k, v := pair, ""
+				if i := strings.Index(pair, "="); i >= 0 {
+					k, v = pair[:i], pair[i+1:]
+				}
+				md[k] = v
+			}
+			opts = append(opts, WithMetadata(md))
+		}
+		var challenge string
+		if bound {
+			identityStore, ok := store.(IdentityStore)
+			if !ok {
+				http.Error(w, "challenge store does not support identities", http.StatusBadRequest)
+				return
+			}
+			challenge, err = identityStore.IdentityChallenge(id, opts...)
+		} else if cn := r.FormValue("cn"); cn != "" || len(opts) > 0 {
+			subjectStore, ok := store.(SubjectStore)
+			if !ok {
+				http.Error(w, "challenge store does not support subjects", http.StatusBadRequest)
+				return
+			}
+			challenge, err = subjectStore.SubjectChallenge(cn, opts...)
+		} else {
+			challenge, err = store.SCEPChallenge()
+		}
+		if err == ErrIdentityRequired {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Challenge string `json:"challenge"`
+		}{challenge})
+	})
+}
+
+// formIdentity returns the identity of the subject, dns, email, ip and uri
+// form values of r, and whether any of them was present.
+func formIdentity(r *http.Request) (Identity, bool, error) {
+	if err := r.ParseForm(); err != nil {
+		return Identity{}, false, err
+	}
+	id := Identity{
+		Subject:        r.Form.Get("subject"),
+		DNSNames:       r.Form["dns"],
+		EmailAddresses: r.Form["email"],
+	}
+	for _, s := range r.Form["ip"] {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return Identity{}, false, fmt.Errorf("invalid IP address %q", s)
+		}
+		id.IPAddresses = append(id.IPAddresses, ip)
+	}
+	for _, s := range r.Form["uri"] {
+		u, err := url.Parse(s)
+		if err != nil {
+			return Identity{}, false, fmt.Errorf("invalid URI %q", s)
+		}
+		id.URIs = append(id.URIs, u)
+	}
+	_, ok := r.Form["subject"]
+	ok = ok || len(id.DNSNames)+len(id.EmailAddresses)+len(id.IPAddresses)+len(id.URIs) > 0
+	return id, ok, nil
+}
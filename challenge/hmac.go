@@ -0,0 +1,304 @@
+package challenge
+
+import (
+	"container/heap"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	hmacNonceSize = 16
+	hmacTokenSize = 8 + hmacNonceSize + sha256.Size
+
+	// maxChallengeSize is the maximum size of the challengePassword
+	// attribute in RFC 2985.
+	maxChallengeSize = 255
+)
+
+// bindingKind is the kind of the binding of a challenge authenticated by
+// its MAC, so that a challenge of one kind never verifies as another.
+type bindingKind byte
+
+const (
+	bindAny bindingKind = iota
+	bindCommonName
+	bindIdentity
+)
+
+// ErrIdentityRequired is returned when minting a challenge not bound to an
+// Identity from an HMACStore created with RequireIdentity.
+var ErrIdentityRequired = errors.New("challenge: challenges must be bound to an identity")
+
+// HMACStore is a Store minting stateless challenges which carry their expiry
+// and are authenticated with HMAC-SHA256, optionally bound to the subject
+// common name or the exact Identity of the CSR. Used challenges are
+// remembered in memory until they expire, so each is accepted once by this
+// process; servers sharing challenges between replicas need a shared Store
+// instead.
+type HMACStore struct {
+	key             []byte
+	ttl             time.Duration
+	requireIdentity bool
+
+	mu      sync.Mutex
+	used    map[string]bool
+	expires usedChallenges
+}
+
+// usedChallenge is a used challenge remembered until its expiry.
+type usedChallenge struct {
+	mac    string
+	expiry time.Time
+}
+
+// usedChallenges is a heap of used challenges, soonest expiry first, so
+// expired ones are forgotten without scanning all of them.
+type usedChallenges []usedChallenge
+
+func (h usedChallenges) Len() int            { return len(h) }
+func (h usedChallenges) Less(i, j int) bool  { return h[i].expiry.Before(h[j].expiry) }
+func (h usedChallenges) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *usedChallenges) Push(x interface{}) { *h = append(*h, x.(usedChallenge)) }
+func (h *usedChallenges) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// HMACOption configures an HMACStore.
+type HMACOption func(*HMACStore)
+
+// RequireIdentity only mints and accepts challenges bound to an Identity,
+// so a device which learned a challenge can only enroll the identity it
+// was minted for.
+func RequireIdentity() HMACOption {
+	return func(s *HMACStore) {
+		s.requireIdentity = true
+	}
+}
+
+// NewHMACStore creates an HMACStore signing challenges with key, which are
+// valid for ttl.
+func NewHMACStore(key []byte, ttl time.Duration, opts ...HMACOption) (*HMACStore, error) {
+	if len(key) < 16 {
+		return nil, errors.New("challenge: HMAC key must be at least 16 bytes")
+	}
+	s := &HMACStore{key: key, ttl: ttl, used: make(map[string]bool)}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// Identity is the subject and subject alternative names a CSR must request
+// exactly to be signed with a challenge of IdentityChallenge. The order of
+// the SANs does not matter.
+type Identity struct {
+	// Subject is the subject in the format of pkix.Name.String, e.g.
+	// "CN=device-1,O=Example".
+	Subject        string
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+}
+
+// CSRIdentity returns the identity requested by csr.
+func CSRIdentity(csr *x509.CertificateRequest) Identity {
+	return Identity{
+		Subject:        csr.Subject.String(),
+		DNSNames:       csr.DNSNames,
+		EmailAddresses: csr.EmailAddresses,
+		IPAddresses:    csr.IPAddresses,
+		URIs:           csr.URIs,
+	}
+}
+
+// canonical returns the encoding of id authenticated by the MAC.
+func (id Identity) canonical() []byte {
+	sorted := func(s []string) []string {
+		s = append([]string{}, s...)
+		sort.Strings(s)
+		return s
+	}
+	var ips, uris []string
+	for _, ip := range id.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	for _, u := range id.URIs {
+		uris = append(uris, u.String())
+	}
+	b, err := json.Marshal([]interface{}{
+		id.Subject, sorted(id.DNSNames), sorted(id.EmailAddresses), sorted(ips), sorted(uris),
+	})
+	if err != nil {
+		panic(err) // strings only
+	}
+	return b
+}
+
+// MintOption configures a challenge minted by HMACStore.
+type MintOption func(*mintConfig)
+
+type mintConfig struct {
+	metadata map[string]string
+}
+
+// WithMetadata makes the challenge carry md, e.g. the serial number of the
+// device it is minted for. Middleware passes it on in the ChallengeMetadata
+// of the request, e.g. for certificate templates. The metadata is
+// authenticated but readable by anyone who has the challenge, and must fit
+// into a challenge of 255 characters.
+func WithMetadata(md map[string]string) MintOption {
+	return func(c *mintConfig) {
+		c.metadata = md
+	}
+}
+
+// SCEPChallenge returns a challenge valid for any subject.
+func (s *HMACStore) SCEPChallenge() (string, error) {
+	return s.SubjectChallenge("")
+}
+
+// SubjectChallenge returns a challenge only valid for CSRs with the subject
+// common name cn, or for any subject if cn is empty. It returns
+// ErrIdentityRequired if the store was created with RequireIdentity.
+func (s *HMACStore) SubjectChallenge(cn string, opts ...MintOption) (string, error) {
+	if s.requireIdentity {
+		return "", ErrIdentityRequired
+	}
+	if cn == "" {
+		return s.challenge(bindAny, nil, opts)
+	}
+	return s.challenge(bindCommonName, []byte(cn), opts)
+}
+
+// IdentityChallenge returns a challenge only valid for CSRs requesting
+// exactly the subject and SANs of id.
+func (s *HMACStore) IdentityChallenge(id Identity, opts ...MintOption) (string, error) {
+	return s.challenge(bindIdentity, id.canonical(), opts)
+}
+
+func (s *HMACStore) challenge(kind bindingKind, binding []byte, opts []MintOption) (string, error) {
+	c := &mintConfig{}
+	for _, opt := range opts {
+		opt(c)
+	}
+	token := make([]byte, 8+hmacNonceSize, hmacTokenSize)
+	binary.BigEndian.PutUint64(token, uint64(time.Now().Add(s.ttl).Unix()))
+	if _, err := rand.Read(token[8:]); err != nil {
+		return "", err
+	}
+	if len(c.metadata) > 0 {
+		md := make(url.Values, len(c.metadata))
+		for k, v := range c.metadata {
+			md.Set(k, v)
+		}
+		token = append(token, md.Encode()...)
+	}
+	token = append(token, s.mac(token, kind, binding)...)
+	// no padding, the challengePassword attribute is usually a
+	// PrintableString, which has the '+' and '/' of the standard alphabet
+	// but not the '_' of the URL one
+	challenge := base64.RawStdEncoding.EncodeToString(token)
+	if len(challenge) > maxChallengeSize {
+		return "", errors.New("challenge: metadata too long")
+	}
+	return challenge, nil
+}
+
+// HasChallenge reports whether pw is a valid challenge for any subject and
+// invalidates it.
+func (s *HMACStore) HasChallenge(pw string) (bool, error) {
+	_, valid := s.verify(pw, nil)
+	return valid, nil
+}
+
+// VerifyChallenge reports whether pw is a valid challenge for the subject
+// and SANs of csr and invalidates it.
+func (s *HMACStore) VerifyChallenge(pw string, csr *x509.CertificateRequest) (bool, error) {
+	_, valid := s.verify(pw, csr)
+	return valid, nil
+}
+
+// VerifyChallengeMetadata is VerifyChallenge also returning the metadata
+// of the challenge.
+func (s *HMACStore) VerifyChallengeMetadata(pw string, csr *x509.CertificateRequest) (map[string]string, bool, error) {
+	md, valid := s.verify(pw, csr)
+	return md, valid, nil
+}
+
+func (s *HMACStore) verify(pw string, csr *x509.CertificateRequest) (map[string]string, bool) {
+	token, err := base64.RawStdEncoding.DecodeString(pw)
+	if err != nil || len(token) < hmacTokenSize {
+		return nil, false
+	}
+	payload, mac := token[:len(token)-sha256.Size], token[len(token)-sha256.Size:]
+	expiry := time.Unix(int64(binary.BigEndian.Uint64(payload)), 0)
+	now := time.Now()
+	if now.After(expiry) {
+		return nil, false
+	}
+	var valid bool
+	if csr != nil {
+		valid = hmac.Equal(mac, s.mac(payload, bindIdentity, CSRIdentity(csr).canonical()))
+	}
+	if !valid && !s.requireIdentity {
+		valid = hmac.Equal(mac, s.mac(payload, bindAny, nil))
+		if !valid && csr != nil && csr.Subject.CommonName != "" {
+			valid = hmac.Equal(mac, s.mac(payload, bindCommonName, []byte(csr.Subject.CommonName)))
+		}
+	}
+	if !valid {
+		return nil, false
+	}
+	var md map[string]string
+	if encoded := payload[8+hmacNonceSize:]; len(encoded) > 0 {
+		values, err := url.ParseQuery(string(encoded))
+		if err != nil {
+			return nil, false
+		}
+		md = make(map[string]string, len(values))
+		for k := range values {
+			md[k] = values.Get(k)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.expires) > 0 && now.After(s.expires[0].expiry) {
+		delete(s.used, heap.Pop(&s.expires).(usedChallenge).mac)
+	}
+	if s.used[string(mac)] {
+		return nil, false
+	}
+	s.used[string(mac)] = true
+	heap.Push(&s.expires, usedChallenge{mac: string(mac), expiry: expiry})
+	return md, true
+}
+
+// mac authenticates the payload of a challenge with its binding. The kind
+// and length of the binding come first, so that no bytes can be moved
+// between the binding and the metadata at the end of the payload.
+func (s *HMACStore) mac(payload []byte, kind bindingKind, binding []byte) []byte {
+	h := hmac.New(sha256.New, s.key)
+	var prefix [5]byte
+	prefix[0] = byte(kind)
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(binding)))
+	h.Write(prefix[:])
+	h.Write(binding)
+	h.Write(payload)
+	return h.Sum(nil)
+}
@@ -0,0 +1,222 @@
+// Package ldapchallenge defines the Validator scepserver.ChallengeValidator
+// validating challenges against an LDAP directory like Active Directory,
+// similar to the integration of Microsoft NDES.
+package ldapchallenge
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Option configures a Validator.
+type Option func(*Validator)
+
+// WithUserBind validates challenges as the password of a directory user:
+// the challenge is valid if a simple bind as dn succeeds. Every {cn} in dn
+// is replaced by the subject common name of the CSR, e.g.
+// "{cn}@corp.example.com" for the user principal name of Active Directory
+// or "uid={cn},ou=devices,dc=example,dc=com". The common name is escaped
+// only if dn is a DN, i.e. contains an "=". Since the challenge is sent to
+// the directory, the URL must be ldaps:// or use WithStartTLS, as for
+// every Validator.
+func WithUserBind(dn string) Option {
+	return func(v *Validator) {
+		v.userDN = dn
+	}
+}
+
+// WithAttributeLookup validates challenges against an attribute of the
+// directory entry of the CSR: after binding as bindDN with bindPassword,
+// the entry below baseDN whose searchAttr equals the subject common name of
+// the CSR is looked up, e.g. with sAMAccountName, and the challenge is
+// valid if it equals a value of its challengeAttr. With an empty bindDN
+// the directory is searched anonymously.
+func WithAttributeLookup(bindDN, bindPassword, baseDN, searchAttr, challengeAttr string) Option {
+	return func(v *Validator) {
+		v.bindDN, v.bindPassword = bindDN, bindPassword
+		v.baseDN, v.searchAttr, v.challengeAttr = baseDN, searchAttr, challengeAttr
+	}
+}
+
+// WithStartTLS upgrades ldap:// connections to TLS with the StartTLS
+// operation of RFC 4511 before binding.
+func WithStartTLS() Option {
+	return func(v *Validator) {
+		v.startTLS = true
+	}
+}
+
+// WithTLSConfig sets the TLS configuration of ldaps:// URLs and StartTLS,
+// e.g. the root CAs of the directory. By default the system roots are used.
+func WithTLSConfig(conf *tls.Config) Option {
+	return func(v *Validator) {
+		v.tlsConfig = conf
+	}
+}
+
+// WithTimeout sets the time connecting to the directory and each of its
+// operations may take, 10 seconds by default.
+func WithTimeout(d time.Duration) Option {
+	return func(v *Validator) {
+		v.timeout = d
+	}
+}
+
+// New creates a Validator asking the directory at the ldap:// or ldaps://
+// URL directoryURL. Exactly one of WithUserBind and WithAttributeLookup
+// must be given. Since both send secrets to the directory, an ldap:// URL
+// requires WithStartTLS.
+func New(directoryURL string, logger log.Logger, opts ...Option) (*Validator, error) {
+	u, err := url.Parse(directoryURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return nil, errors.New("challenge directory must be an ldap or ldaps URL")
+	}
+	v := &Validator{url: u, timeout: 10 * time.Second, logger: logger}
+	for _, opt := range opts {
+		opt(v)
+	}
+	switch {
+	case v.userDN != "" && v.searchAttr != "":
+		return nil, errors.New("ldap user bind and attribute lookup are mutually exclusive")
+	case v.userDN == "" && v.searchAttr == "":
+		return nil, errors.New("ldap challenge validation requires a user bind DN or an attribute lookup")
+	case v.searchAttr != "" && (v.baseDN == "" || v.challengeAttr == ""):
+		return nil, errors.New("ldap attribute lookup requires a base DN and a challenge attribute")
+	case u.Scheme == "ldap" && !v.startTLS:
+		return nil, errors.New("ldap challenge validation sends passwords to the directory and requires ldaps or StartTLS")
+	}
+	return v, nil
+}
+
+// Validator implements a scepserver.ChallengeValidator.
+// It validates the challenge password of a CSR as the password of the
+// directory user named by the subject common name, or by comparing it with
+// an attribute of the directory entry of the common name. A CSR without a
+// common name or an empty challenge is always rejected, since LDAP treats a
+// simple bind without a password as an anonymous bind.
+type Validator struct {
+	url       *url.URL
+	tlsConfig *tls.Config
+	startTLS  bool
+	timeout   time.Duration
+	logger    log.Logger
+
+	userDN string
+
+	bindDN, bindPassword string
+	baseDN               string
+	searchAttr           string
+	challengeAttr        string
+}
+
+// ValidateChallenge asks the directory whether challenge is valid for csr.
+func (v *Validator) ValidateChallenge(challenge string, csr *x509.CertificateRequest) (bool, error) {
+	cn := csr.Subject.CommonName
+	if challenge == "" || cn == "" {
+		return false, nil
+	}
+	c, err := v.dial()
+	if err != nil {
+		return false, fmt.Errorf("challenge directory: %w", err)
+	}
+	defer c.Close()
+
+	if v.userDN != "" {
+		user := cn
+		if strings.Contains(v.userDN, "=") {
+			user = escapeDN(cn)
+		}
+		err := c.Bind(strings.ReplaceAll(v.userDN, "{cn}", user), challenge)
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			v.logger.Log("msg", "challenge rejected by directory bind", "cn", cn)
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("challenge directory: %w", err)
+		}
+		return true, nil
+	}
+
+	if v.bindDN != "" {
+		if err := c.Bind(v.bindDN, v.bindPassword); err != nil {
+			return false, fmt.Errorf("challenge directory: %w", err)
+		}
+	}
+	// referrals to other servers are not followed
+	result, err := c.Search(ldap.NewSearchRequest(
+		v.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(v.timeout/time.Second), false,
+		fmt.Sprintf("(%s=%s)", v.searchAttr, ldap.EscapeFilter(cn)), []string{v.challengeAttr}, nil,
+	))
+	if err != nil {
+		return false, fmt.Errorf("challenge directory: %w", err)
+	}
+	if len(result.Entries) != 1 {
+		v.logger.Log("msg", "challenge rejected, no unique directory entry", "cn", cn, "entries", len(result.Entries))
+		return false, nil
+	}
+	for _, val := range result.Entries[0].GetEqualFoldRawAttributeValues(v.challengeAttr) {
+		if subtle.ConstantTimeCompare(val, []byte(challenge)) == 1 {
+			return true, nil
+		}
+	}
+	v.logger.Log("msg", "challenge rejected by directory attribute", "cn", cn)
+	return false, nil
+}
+
+// dial connects to the directory and upgrades ldap:// connections with
+// StartTLS.
+func (v *Validator) dial() (*ldap.Conn, error) {
+	conf := v.tlsConfig.Clone()
+	if conf == nil {
+		conf = &tls.Config{}
+	}
+	if conf.ServerName == "" {
+		conf.ServerName = v.url.Hostname()
+	}
+	c, err := ldap.DialURL(v.url.String(), ldap.DialWithDialer(&net.Dialer{Timeout: v.timeout}), ldap.DialWithTLSConfig(conf))
+	if err != nil {
+		return nil, err
+	}
+	c.SetTimeout(v.timeout)
+	if v.startTLS && v.url.Scheme == "ldap" {
+		if err := c.StartTLS(conf); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// escapeDN escapes s for an attribute value of a DN as described in
+// RFC 4514 section 2.4.
+func escapeDN(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case strings.IndexByte(`"+,;<>\`, c) >= 0,
+			i == 0 && (c == ' ' || c == '#'),
+			i == len(s)-1 && c == ' ':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
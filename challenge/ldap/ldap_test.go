@@ -0,0 +1,391 @@
+package ldapchallenge
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// fakeDirectory is an LDAP server with users authenticated by password and
+// entries with a challenge attribute. Like Active Directory it encodes
+// every length of its responses in the long form with four bytes.
+type fakeDirectory struct {
+	t         *testing.T
+	tlsConfig *tls.Config
+	passwords map[string]string // by DN
+	entries   map[string]string // challenge by sAMAccountName
+}
+
+type ldapMessage struct {
+	MessageID  int
+	ProtocolOp asn1.RawValue
+	Controls   asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// protocolOp application tags of RFC 4511 section 4.2 to 4.5 and 4.12.
+const (
+	opBindRequest      = 0
+	opBindResponse     = 1
+	opUnbindRequest    = 2
+	opSearchRequest    = 3
+	opSearchEntry      = 4
+	opSearchDone       = 5
+	opExtendedRequest  = 23
+	opExtendedResponse = 24
+)
+
+// LDAPv3 result codes of RFC 4511 section 4.1.9.
+const (
+	resultSuccess            = 0
+	resultInvalidCredentials = 49
+)
+
+const oidStartTLS = "1.3.6.1.4.1.1466.20037"
+
+type bindRequest struct {
+	Version int
+	Name    []byte
+	Simple  []byte `asn1:"tag:0"`
+}
+
+type searchRequest struct {
+	BaseObject   []byte
+	Scope        asn1.Enumerated
+	DerefAliases asn1.Enumerated
+	SizeLimit    int
+	TimeLimit    int
+	TypesOnly    bool
+	Filter       asn1.RawValue
+	Attributes   [][]byte
+}
+
+type attributeValueAssertion struct {
+	AttributeDesc  []byte
+	AssertionValue []byte
+}
+
+type extendedRequest struct {
+	RequestName []byte `asn1:"tag:0"`
+}
+
+type ldapResult struct {
+	ResultCode        asn1.Enumerated
+	MatchedDN         []byte
+	DiagnosticMessage []byte
+}
+
+type searchResultEntry struct {
+	ObjectName []byte
+	Attributes []partialAttribute
+}
+
+type partialAttribute struct {
+	Type []byte
+	Vals [][]byte `asn1:"set"`
+}
+
+func (d *fakeDirectory) serve(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go d.handle(c)
+	}
+}
+
+func (d *fakeDirectory) handle(c net.Conn) {
+	defer c.Close()
+	for {
+		data, err := readMessage(c)
+		if err != nil {
+			return
+		}
+		var msg ldapMessage
+		if _, err := asn1.Unmarshal(data, &msg); err != nil {
+			d.t.Error(err)
+			return
+		}
+		op := msg.ProtocolOp
+		switch op.Tag {
+		case opExtendedRequest:
+			var req extendedRequest
+			if _, err := asn1.UnmarshalWithParams(op.FullBytes, &req, "application,tag:23"); err != nil {
+				d.t.Error(err)
+				return
+			}
+			if string(req.RequestName) != oidStartTLS {
+				d.t.Errorf("unexpected extended request %s", req.RequestName)
+				return
+			}
+			d.reply(c, msg.MessageID, opExtendedResponse, ldapResult{})
+			tc := tls.Server(c, d.tlsConfig)
+			defer tc.Close()
+			c = tc
+		case opBindRequest:
+			var req bindRequest
+			if _, err := asn1.UnmarshalWithParams(op.FullBytes, &req, "application,tag:0"); err != nil {
+				d.t.Error(err)
+				return
+			}
+			code := resultInvalidCredentials
+			if pw, ok := d.passwords[string(req.Name)]; ok && pw == string(req.Simple) {
+				code = resultSuccess
+			}
+			d.reply(c, msg.MessageID, opBindResponse, ldapResult{ResultCode: asn1.Enumerated(code)})
+		case opSearchRequest:
+			var req searchRequest
+			if _, err := asn1.UnmarshalWithParams(op.FullBytes, &req, "application,tag:3"); err != nil {
+				d.t.Error(err)
+				return
+			}
+			var ava attributeValueAssertion
+			if _, err := asn1.UnmarshalWithParams(req.Filter.FullBytes, &ava, "tag:3"); err != nil {
+				d.t.Error(err)
+				return
+			}
+			if challenge, ok := d.entries[string(ava.AssertionValue)]; ok && string(ava.AttributeDesc) == "sAMAccountName" {
+				d.reply(c, msg.MessageID, opSearchEntry, searchResultEntry{
+					ObjectName: []byte("CN=" + string(ava.AssertionValue) + ",DC=example,DC=com"),
+					Attributes: []partialAttribute{{Type: []byte("SCEPChallenge"), Vals: [][]byte{[]byte(challenge)}}},
+				})
+			}
+			d.reply(c, msg.MessageID, opSearchDone, ldapResult{})
+		case opUnbindRequest:
+			return
+		}
+	}
+}
+
+// readMessage reads one DER encoded LDAPMessage from r.
+func readMessage(r io.Reader) ([]byte, error) {
+	hdr := make([]byte, 2, 6)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	length := int(hdr[1])
+	if length&0x80 != 0 {
+		hdr = hdr[:2+length&0x7f]
+		if _, err := io.ReadFull(r, hdr[2:]); err != nil {
+			return nil, err
+		}
+		length = 0
+		for _, b := range hdr[2:] {
+			length = length<<8 | int(b)
+		}
+	}
+	msg := make([]byte, len(hdr)+length)
+	copy(msg, hdr)
+	_, err := io.ReadFull(r, msg[len(hdr):])
+	return msg, err
+}
+
+func (d *fakeDirectory) reply(c net.Conn, id, tag int, op interface{}) {
+	opBytes, err := asn1.MarshalWithParams(op, fmt.Sprintf("application,tag:%d", tag))
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	msg, err := asn1.Marshal(ldapMessage{MessageID: id, ProtocolOp: asn1.RawValue{FullBytes: opBytes}})
+	if err != nil {
+		d.t.Fatal(err)
+	}
+	c.Write(longLengths(d.t, msg))
+}
+
+// longLengths re-encodes the DER element der with every length in the long
+// form with four bytes, which encoding/asn1 rejects.
+func longLengths(t *testing.T, der []byte) []byte {
+	var v asn1.RawValue
+	if _, err := asn1.Unmarshal(der, &v); err != nil {
+		t.Fatal(err)
+	}
+	content := v.Bytes
+	if v.IsCompound {
+		content = nil
+		for rest := v.Bytes; len(rest) > 0; {
+			var child asn1.RawValue
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &child); err != nil {
+				t.Fatal(err)
+			}
+			content = append(content, longLengths(t, child.FullBytes)...)
+		}
+	}
+	out := []byte{der[0], 0x84, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(out[2:], uint32(len(content)))
+	return append(out, content...)
+}
+
+// newTLSConfigs returns the configuration of a server at 127.0.0.1 and of
+// a client trusting it.
+func newTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "directory"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "directory"},
+	}, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}},
+		&tls.Config{RootCAs: roots}
+}
+
+func startDirectory(t *testing.T, d *fakeDirectory) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go d.serve(l)
+	return "ldap://" + l.Addr().String()
+}
+
+func newCSR(t *testing.T, cn string) *x509.CertificateRequest {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: cn},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func TestValidateChallenge(t *testing.T) {
+	serverTLS, clientTLS := newTLSConfigs(t)
+	url := startDirectory(t, &fakeDirectory{
+		t:         t,
+		tlsConfig: serverTLS,
+		passwords: map[string]string{
+			"device-1@corp.example.com":      "secret",
+			"a+b@corp.example.com":           "upn",
+			`uid=a\+b,ou=devices,dc=example`: "dn",
+			"CN=scep,DC=example,DC=com":      "service",
+		},
+		entries: map[string]string{"device-2": "one-time"},
+	})
+	bind, err := New(url, log.NewNopLogger(), WithUserBind("{cn}@corp.example.com"), WithStartTLS(), WithTLSConfig(clientTLS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bindDN, err := New(url, log.NewNopLogger(), WithUserBind("uid={cn},ou=devices,dc=example"), WithStartTLS(), WithTLSConfig(clientTLS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	untrusted, err := New(url, log.NewNopLogger(), WithUserBind("{cn}@corp.example.com"), WithStartTLS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup, err := New(url, log.NewNopLogger(),
+		WithAttributeLookup("CN=scep,DC=example,DC=com", "service", "DC=example,DC=com", "sAMAccountName", "scepChallenge"),
+		WithStartTLS(), WithTLSConfig(clientTLS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	badService, err := New(url, log.NewNopLogger(),
+		WithAttributeLookup("CN=scep,DC=example,DC=com", "wrong", "DC=example,DC=com", "sAMAccountName", "scepChallenge"),
+		WithStartTLS(), WithTLSConfig(clientTLS))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		v         *Validator
+		cn        string
+		challenge string
+		want      bool
+		wantErr   bool
+	}{
+		{"bind", bind, "device-1", "secret", true, false},
+		{"bind wrong password", bind, "device-1", "wrong", false, false},
+		{"bind empty password", bind, "device-1", "", false, false},
+		{"bind unknown user", bind, "device-2", "secret", false, false},
+		{"bind user principal name is not escaped", bind, "a+b", "upn", true, false},
+		{"bind DN is escaped", bindDN, "a+b", "dn", true, false},
+		{"bind untrusted directory", untrusted, "device-1", "secret", false, true},
+		{"lookup", lookup, "device-2", "one-time", true, false},
+		{"lookup wrong challenge", lookup, "device-2", "secret", false, false},
+		{"lookup unknown entry", lookup, "device-1", "one-time", false, false},
+		{"lookup without common name", lookup, "", "one-time", false, false},
+		{"lookup service bind fails", badService, "device-2", "one-time", false, true},
+	} {
+		valid, err := test.v.ValidateChallenge(test.challenge, newCSR(t, test.cn))
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: have error %v, want error %t", test.name, err, test.wantErr)
+		}
+		if valid != test.want {
+			t.Errorf("%s: have valid %t, want %t", test.name, valid, test.want)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, test := range []struct {
+		url  string
+		opts []Option
+	}{
+		{"http://example.com", []Option{WithUserBind("{cn}")}},
+		{"ldap://example.com", nil},
+		{"ldap://example.com", []Option{WithUserBind("{cn}"), WithAttributeLookup("", "", "dc=example", "cn", "challenge")}},
+		{"ldap://example.com", []Option{WithAttributeLookup("", "", "", "cn", "challenge")}},
+		{"ldap://example.com", []Option{WithUserBind("{cn}@example.com")}},
+		{"ldap://example.com", []Option{WithAttributeLookup("cn=scep", "secret", "dc=example", "cn", "challenge")}},
+	} {
+		if _, err := New(test.url, log.NewNopLogger(), test.opts...); err == nil {
+			t.Errorf("%s %d options: expected an error", test.url, len(test.opts))
+		}
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	for in, want := range map[string]string{
+		"device-1":  "device-1",
+		"a,b+c":     `a\,b\+c`,
+		" #lead":    `\ #lead`,
+		"#x":        `\#x`,
+		"trail ":    `trail\ `,
+		`quote"\ok`: `quote\"\\ok`,
+	} {
+		if have := escapeDN(in); have != want {
+			t.Errorf("escapeDN(%q) = %q, want %q", in, have, want)
+		}
+	}
+}
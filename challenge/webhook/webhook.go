@@ -0,0 +1,112 @@
+// Package webhookchallenge defines the Validator scepserver.ChallengeValidator
+// asking an HTTP endpoint whether a challenge is valid.
+package webhookchallenge
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// Option configures a Validator.
+type Option func(*Validator)
+
+// WithHTTPClient sets the client used to call the endpoint. The default
+// client times out after 30 seconds.
+func WithHTTPClient(client *http.Client) Option {
+	return func(v *Validator) {
+		v.client = client
+	}
+}
+
+// WithHeader sets a header of the requests, e.g. an Authorization header
+// authenticating the server to the endpoint.
+func WithHeader(key, value string) Option {
+	return func(v *Validator) {
+		v.header.Set(key, value)
+	}
+}
+
+// New creates a Validator POSTing to endpointURL.
+func New(endpointURL string, logger log.Logger, opts ...Option) (*Validator, error) {
+	u, err := url.Parse(endpointURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("challenge validation endpoint must be an http or https URL")
+	}
+	v := &Validator{
+		url:    endpointURL,
+		client: &http.Client{Timeout: 30 * time.Second},
+		header: make(http.Header),
+		logger: logger,
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v, nil
+}
+
+// Validator implements a scepserver.ChallengeValidator.
+// It POSTs the challenge password, the subject and the PEM encoded CSR as
+// JSON to a URL. The challenge is valid if the endpoint answers 200 OK and
+// invalid if it answers with another 4xx status. Other answers are errors,
+// so an unavailable endpoint is not reported as a rejected challenge.
+type Validator struct {
+	url    string
+	client *http.Client
+	header http.Header
+	logger log.Logger
+}
+
+type validationRequest struct {
+	ChallengePassword string `json:"challenge_password"`
+	Subject           string `json:"subject"`
+	CSR               string `json:"csr"`
+}
+
+// ValidateChallenge asks the endpoint whether challenge is valid for csr.
+func (v *Validator) ValidateChallenge(challenge string, csr *x509.CertificateRequest) (bool, error) {
+	body, err := json.Marshal(validationRequest{
+		ChallengePassword: challenge,
+		Subject:           csr.Subject.String(),
+		CSR:               string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr.Raw})),
+	})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest(http.MethodPost, v.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for key, values := range v.header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("challenge validation endpoint: %w", err)
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return true, nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		v.logger.Log("msg", "challenge rejected by endpoint", "status", resp.StatusCode)
+		return false, nil
+	default:
+		return false, fmt.Errorf("challenge validation endpoint answered %s", resp.Status)
+	}
+}
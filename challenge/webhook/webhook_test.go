@@ -0,0 +1,75 @@
+package webhookchallenge
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestValidateChallenge(t *testing.T) {
+	// the endpoint knows a single challenge of one device
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var req validationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Error(err)
+		}
+		switch {
+		case req.Subject == "CN=unavailable":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case req.Subject != "CN=device" || req.ChallengePassword != "secret":
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := New(srv.URL, log.NewNopLogger(), WithHeader("Authorization", "Bearer token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		cn, challenge string
+		want, wantErr bool
+	}{
+		{"device", "secret", true, false},
+		{"device", "wrong", false, false},
+		{"other", "secret", false, false},
+		{"unavailable", "secret", false, true},
+	} {
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject: pkix.Name{CommonName: test.cn},
+		}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		valid, err := v.ValidateChallenge(test.challenge, csr)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: have error %v, want error %t", test.cn, err, test.wantErr)
+		}
+		if valid != test.want {
+			t.Errorf("%s: have valid %t, want %t", test.cn, valid, test.want)
+		}
+	}
+
+	if _, err := New("ftp://example.com", log.NewNopLogger()); err == nil {
+		t.Error("expected an error for a non-HTTP URL")
+	}
+}
@@ -0,0 +1,187 @@
+package scepclient
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// BatchRequest is one enrollment of EnrollBatch: a PKCSReq for CSR signed
+// by SignerCert and Key, like the arguments of Enroll.
+type BatchRequest struct {
+	CSR        *x509.CertificateRequest
+	SignerCert *x509.Certificate
+	Key        crypto.Signer
+}
+
+// BatchResult is the outcome of the BatchRequest at Index.
+type BatchResult struct {
+	Index       int
+	Certificate *x509.Certificate
+	Err         error
+	// Duration is the time taken by the enrollment, including polling
+	// while the CA answered PENDING.
+	Duration time.Duration
+}
+
+// BatchError is returned by EnrollBatch if some of the requests failed.
+type BatchError struct {
+	Total int
+	// Failed are the results of the failed requests, in request order.
+	Failed []BatchResult
+}
+
+// FailInfos counts the failed requests the CA rejected by failInfo.
+func (e *BatchError) FailInfos() map[scep.FailInfo]int {
+	counts := make(map[scep.FailInfo]int)
+	for _, r := range e.Failed {
+		var failure *FailureError
+		if errors.As(r.Err, &failure) {
+			counts[failure.FailInfo]++
+		}
+	}
+	return counts
+}
+
+func (e *BatchError) Error() string {
+	var rejected int
+	for _, n := range e.FailInfos() {
+		rejected += n
+	}
+	return fmt.Sprintf("scepclient: %d of %d enrollments failed, %d rejected by the CA, first: request %d: %v",
+		len(e.Failed), e.Total, rejected, e.Failed[0].Index, e.Failed[0].Err)
+}
+
+// Unwrap returns the errors of the failed requests.
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, len(e.Failed))
+	for i, r := range e.Failed {
+		errs[i] = r.Err
+	}
+	return errs
+}
+
+// BatchOption configures EnrollBatch.
+type BatchOption func(*batchConfig)
+
+type batchConfig struct {
+	workers    int
+	enrollOpts []EnrollOption
+	progress   func(BatchResult)
+}
+
+// WithBatchWorkers sets the number of requests enrolled concurrently, 4 by
+// default.
+func WithBatchWorkers(n int) BatchOption {
+	return func(c *batchConfig) {
+		c.workers = n
+	}
+}
+
+// WithBatchEnrollOptions passes opts to the enrollment of every request.
+func WithBatchEnrollOptions(opts ...EnrollOption) BatchOption {
+	return func(c *batchConfig) {
+		c.enrollOpts = append(c.enrollOpts, opts...)
+	}
+}
+
+// WithBatchProgress calls f with the result of every request as soon as it
+// is enrolled. The calls are not concurrent.
+func WithBatchProgress(f func(BatchResult)) BatchOption {
+	return func(c *batchConfig) {
+		c.progress = f
+	}
+}
+
+// EnrollBatch enrolls reqs concurrently with Enroll. The GetCACaps and
+// GetCACert responses of the CA are fetched once and shared by all
+// requests, unless WithCACerts is passed with WithBatchEnrollOptions.
+//
+// The results are returned in request order. If some requests failed the
+// error is a *BatchError; an error fetching the CA certificates fails the
+// whole batch and no results are returned.
+func EnrollBatch(ctx context.Context, c Client, reqs []BatchRequest, opts ...BatchOption) ([]BatchResult, error) {
+	conf := &batchConfig{workers: 4}
+	for _, opt := range opts {
+		opt(conf)
+	}
+	if conf.workers < 1 {
+		conf.workers = 1
+	}
+
+	enrollConf := &enrollConfig{}
+	for _, opt := range conf.enrollOpts {
+		opt(enrollConf)
+	}
+	caps, capsErr := c.GetCACaps(ctx)
+	enrollOpts := conf.enrollOpts
+	if len(enrollConf.caCerts) == 0 {
+		caCerts, err := GetCACerts(ctx, c, enrollConf.caMessage)
+		if err != nil {
+			return nil, fmt.Errorf("scepclient: GetCACert: %w", err)
+		}
+		enrollOpts = append(enrollOpts[:len(enrollOpts):len(enrollOpts)], WithCACerts(caCerts))
+	}
+	shared := &capsClient{Client: c, caps: caps, err: capsErr}
+
+	results := make([]BatchResult, len(reqs))
+	indexes := make(chan int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for w := 0; w < conf.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				req := reqs[i]
+				start := time.Now()
+				crt, err := Enroll(ctx, shared, req.CSR, req.SignerCert, req.Key, enrollOpts...)
+				result := BatchResult{Index: i, Certificate: crt, Err: err, Duration: time.Since(start)}
+				results[i] = result
+				if conf.progress != nil {
+					mu.Lock()
+					conf.progress(result)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i := range reqs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	batchErr := &BatchError{Total: len(reqs)}
+	for _, r := range results {
+		if r.Err != nil {
+			batchErr.Failed = append(batchErr.Failed, r)
+		}
+	}
+	if len(batchErr.Failed) > 0 {
+		return results, batchErr
+	}
+	return results, nil
+}
+
+// capsClient answers GetCACaps and Supports with the capabilities fetched
+// once for a batch.
+type capsClient struct {
+	Client
+	caps []byte
+	err  error
+}
+
+func (c *capsClient) GetCACaps(context.Context) ([]byte, error) {
+	return c.caps, c.err
+}
+
+func (c *capsClient) Supports(cap string) bool {
+	return scep.ParseCapabilities(c.caps).Has(scep.Capability(cap))
+}
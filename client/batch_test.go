@@ -0,0 +1,78 @@
+package scepclient
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// countingServer counts the GetCACaps and GetCACert requests of a batch.
+type countingServer struct {
+	*fakeServer
+	caps, caCerts int32
+}
+
+func (s *countingServer) GetCACaps(ctx context.Context) ([]byte, error) {
+	atomic.AddInt32(&s.caps, 1)
+	return s.fakeServer.GetCACaps(ctx)
+}
+
+func (s *countingServer) GetCACert(ctx context.Context, message string) ([]byte, int, error) {
+	atomic.AddInt32(&s.caCerts, 1)
+	return s.fakeServer.GetCACert(ctx, message)
+}
+
+func TestEnrollBatch(t *testing.T) {
+	srv := &countingServer{fakeServer: newFakeServer(t, "POSTPKIOperation\nSCEPStandard\nAES\nSHA-256")}
+	var reqs []BatchRequest
+	for i := 0; i < 6; i++ {
+		csr, self, key := newTestClient(t)
+		req := BatchRequest{CSR: csr, SignerCert: self, Key: key}
+		if i == 3 {
+			// the CertRep cannot be decrypted
+			req.Key = signOnlyKey{key}
+		}
+		reqs = append(reqs, req)
+	}
+
+	// pkcs7 parses BER with an unsynchronized package level counter
+	workers := 3
+	if raceEnabled {
+		workers = 1
+	}
+	var reported int
+	results, err := EnrollBatch(context.Background(), srv, reqs,
+		WithBatchWorkers(workers),
+		WithBatchProgress(func(BatchResult) { reported++ }),
+	)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("want a BatchError, have %v", err)
+	}
+	if batchErr.Total != 6 || len(batchErr.Failed) != 1 || batchErr.Failed[0].Index != 3 {
+		t.Errorf("have %d of %d failed, want request 3 of 6", len(batchErr.Failed), batchErr.Total)
+	}
+	if len(batchErr.FailInfos()) != 0 {
+		t.Errorf("have failInfos %v, want none", batchErr.FailInfos())
+	}
+	for i, r := range results {
+		if r.Index != i || (i != 3) != (r.Certificate != nil) {
+			t.Errorf("result %d = %+v", i, r)
+		}
+	}
+	if reported != len(reqs) {
+		t.Errorf("reported %d results, want %d", reported, len(reqs))
+	}
+	if srv.caps != 1 || srv.caCerts != 1 {
+		t.Errorf("have %d GetCACaps and %d GetCACert requests, want 1 each", srv.caps, srv.caCerts)
+	}
+
+	srv.failInfo = scep.BadRequest
+	_, err = EnrollBatch(context.Background(), srv, reqs[:2], WithBatchWorkers(workers))
+	if !errors.As(err, &batchErr) || batchErr.FailInfos()[scep.BadRequest] != 2 {
+		t.Errorf("want 2 badRequest rejections, have %v", err)
+	}
+}
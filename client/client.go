@@ -1,10 +1,15 @@
 package scepclient
 
 import (
+	"errors"
+	"net/http"
+	"net/url"
+
 	scepserver "github.com/micromdm/scep/v2/server"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	httptransport "github.com/go-kit/kit/transport/http"
 )
 
 // Client is a SCEP Client
@@ -13,12 +18,48 @@ type Client interface {
 	Supports(cap string) bool
 }
 
+// ClientOption configures the transport of a Client created with New.
+type ClientOption func(*clientConfig) error
+
+type clientConfig struct {
+	httpClient *http.Client
+	tls        *tlsConfig
+	proxy      func(*http.Request) (*url.URL, error)
+	proxySet   bool
+	retry      *retryTransport
+}
+
+// WithHTTPClient sends the requests with c instead of http.DefaultClient.
+// The TLS and proxy options modify a copy of its transport, which must then
+// be an *http.Transport.
+func WithHTTPClient(c *http.Client) ClientOption {
+	return func(conf *clientConfig) error {
+		conf.httpClient = c
+		return nil
+	}
+}
+
 // New creates a SCEP Client.
 func New(
 	serverURL string,
 	logger log.Logger,
+	opts ...ClientOption,
 ) (Client, error) {
-	endpoints, err := scepserver.MakeClientEndpoints(serverURL)
+	conf := &clientConfig{}
+	for _, opt := range opts {
+		if err := opt(conf); err != nil {
+			return nil, err
+		}
+	}
+	httpClient, err := conf.client()
+	if err != nil {
+		return nil, err
+	}
+	var clientOpts []httptransport.ClientOption
+	if httpClient != nil {
+		clientOpts = append(clientOpts, httptransport.SetClient(httpClient))
+	}
+	endpoints, err := scepserver.MakeClientEndpoints(serverURL, clientOpts...)
 	if err != nil {
 		return nil, err
 	}
@@ -27,3 +68,39 @@ func New(
 	endpoints.PostEndpoint = scepserver.EndpointLoggingMiddleware(logger)(endpoints.PostEndpoint)
 	return endpoints, nil
 }
+
+// client returns the HTTP client of the options, nil for the go-kit
+// default.
+func (c *clientConfig) client() (*http.Client, error) {
+	if c.tls == nil && !c.proxySet && c.retry == nil {
+		return c.httpClient, nil
+	}
+	client := &http.Client{}
+	if c.httpClient != nil {
+		*client = *c.httpClient
+	}
+	if c.tls != nil || c.proxySet {
+		var transport *http.Transport
+		switch t := client.Transport.(type) {
+		case nil:
+			transport = http.DefaultTransport.(*http.Transport).Clone()
+		case *http.Transport:
+			transport = t.Clone()
+		default:
+			return nil, errors.New("scepclient: TLS and proxy options need an *http.Transport")
+		}
+		if c.tls != nil {
+			transport.TLSClientConfig = c.tls.build(transport.TLSClientConfig)
+		}
+		if c.proxySet {
+			transport.Proxy = c.proxy
+		}
+		client.Transport = transport
+	}
+	if c.retry != nil {
+		retry := *c.retry
+		retry.next = client.Transport
+		client.Transport = &retry
+	}
+	return client, nil
+}
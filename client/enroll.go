@@ -0,0 +1,363 @@
+package scepclient
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/scep/v2/metrics"
+	"github.com/micromdm/scep/v2/scep"
+	"github.com/micromdm/scep/v2/scep/kitlog"
+	"github.com/micromdm/scep/v2/tracing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// FailureError is returned by Enroll and Renew when the CA rejects the
+// request with a verified FAILURE CertRep.
+type FailureError struct {
+	MessageType  scep.MessageType
+	FailInfo     scep.FailInfo
+	FailInfoText string
+}
+
+func (e *FailureError) Error() string {
+	if e.FailInfoText != "" {
+		return fmt.Sprintf("scepclient: %s request failed, failInfo: %s: %s", e.MessageType, e.FailInfo, e.FailInfoText)
+	}
+	return fmt.Sprintf("scepclient: %s request failed, failInfo: %s", e.MessageType, e.FailInfo)
+}
+
+// EnrollOption configures Enroll and Renew.
+type EnrollOption func(*enrollConfig)
+
+type enrollConfig struct {
+	logger     log.Logger
+	poller     *Poller
+	caCerts    []*x509.Certificate
+	caMessage  string
+	msgOpts    []scep.Option
+	strict     bool
+	metrics    metrics.Metrics
+	tracer     tracing.Tracer
+	strictness scep.Strictness
+	decrypter  crypto.Decrypter
+	keyEnc     scep.KeyEncryptionAlgorithm
+	fips       bool
+}
+
+// WithLogger sets the logger of the enrollment. It is also passed to the
+// scep message functions.
+func WithLogger(logger log.Logger) EnrollOption {
+	return func(c *enrollConfig) {
+		c.logger = logger
+	}
+}
+
+// WithMetrics records metrics of the enrollment with m.
+func WithMetrics(m metrics.Metrics) EnrollOption {
+	return func(c *enrollConfig) {
+		c.metrics = m
+	}
+}
+
+// WithTracer traces the enrollment with spans of t. The messages of the
+// enrollment are created and parsed with the scep.WithTracer option.
+func WithTracer(t tracing.Tracer) EnrollOption {
+	return func(c *enrollConfig) {
+		c.tracer = t
+	}
+}
+
+// WithPoller sets the Poller used while the CA answers PENDING. By default
+// NewPoller is used.
+func WithPoller(p *Poller) EnrollOption {
+	return func(c *enrollConfig) {
+		c.poller = p
+	}
+}
+
+// WithCACerts sets the CA/RA certificates, skipping the GetCACert request.
+func WithCACerts(certs []*x509.Certificate) EnrollOption {
+	return func(c *enrollConfig) {
+		c.caCerts = certs
+	}
+}
+
+// WithCACertMessage sets the message sent with the GetCACert request.
+func WithCACertMessage(message string) EnrollOption {
+	return func(c *enrollConfig) {
+		c.caMessage = message
+	}
+}
+
+// WithMessageOptions passes opts, e.g. scep.WithCertsSelector or
+// scep.WithEncryptionAlgorithm, to the creation of the request messages.
+// They take precedence over the digest and content encryption algorithms
+// chosen from the GetCACaps response of the CA, and over the recipients
+// chosen with scep.RecipientCertsSelector.
+func WithMessageOptions(opts ...scep.Option) EnrollOption {
+	return func(c *enrollConfig) {
+		c.msgOpts = append(c.msgOpts, opts...)
+	}
+}
+
+// WithStrictNonce rejects every CertRep, not only FAILURE responses, whose
+// transactionID and recipientNonce do not match the request, see
+// VerifyNonce.
+func WithStrictNonce() EnrollOption {
+	return func(c *enrollConfig) {
+		c.strict = true
+	}
+}
+
+// WithStrictness sets the handling of CA responses deviating from RFC 8894.
+// With scep.Lenient the quirks of Microsoft NDES are tolerated: CertRep
+// messages without a recipientNonce, BER encoded pkiEnvelopes and
+// GetCACert responses without RA certificates. The request content is then
+// encrypted with DES3 unless the CA advertises AES.
+func WithStrictness(s scep.Strictness) EnrollOption {
+	return func(c *enrollConfig) {
+		c.strictness = s
+	}
+}
+
+// WithDecrypter decrypts the pkiEnvelope of the CertRep with d instead of
+// the key signing the request. It is needed when the signing key of a TPM,
+// smartcard or KMS identity is a crypto.Signer that does not implement
+// crypto.Decrypter, while the same key is reachable through another handle
+// that only exposes Decrypt. d must be the RSA key of the signer
+// certificate.
+func WithDecrypter(d crypto.Decrypter) EnrollOption {
+	return func(c *enrollConfig) {
+		c.decrypter = d
+	}
+}
+
+// WithKeyEncryptionScheme encrypts the content encryption key of requests
+// to RSA recipients with scheme. With scep.RSAOAEP, required by some newer
+// CAs and FIPS deployments, the pkiEnvelope of the CertRep must use
+// RSAES-OAEP too, see scep.WithRequireOAEP. By default requests use
+// scep.RSAPKCS1v15 and responses are decrypted with either scheme.
+func WithKeyEncryptionScheme(scheme scep.KeyEncryptionAlgorithm) EnrollOption {
+	return func(c *enrollConfig) {
+		c.keyEnc = scheme
+	}
+}
+
+// WithFIPS restricts the requests and responses of the enrollment to
+// FIPS-approved algorithms, see scep.WithFIPS. Enrollment fails before a
+// request is sent if the CA advertises neither AES nor SHA-256, or if its
+// certificate or the key has a key size that is not approved.
+func WithFIPS() EnrollOption {
+	return func(c *enrollConfig) {
+		c.fips = true
+	}
+}
+
+// GetCACerts fetches and parses the CA/RA certificates with GetCACert.
+func GetCACerts(ctx context.Context, c Client, message string) ([]*x509.Certificate, error) {
+	resp, certNum, err := c.GetCACert(ctx, message)
+	if err != nil {
+		return nil, err
+	}
+	if certNum > 1 {
+		return scep.CACerts(resp)
+	}
+	return x509.ParseCertificates(resp)
+}
+
+// GetNextCACerts fetches the next CA certificates of a CA rollover with
+// GetNextCACert. The response must be signed by one of caCerts, the current
+// CA/RA certificates.
+func GetNextCACerts(ctx context.Context, c Client, caCerts []*x509.Certificate) ([]*x509.Certificate, error) {
+	if !c.Supports(string(scep.CapGetNextCACert)) {
+		return nil, errors.New("scepclient: CA does not support GetNextCACert")
+	}
+	resp, err := c.GetNextCACert(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return scep.ParseNextCACert(resp, caCerts)
+}
+
+// Enroll requests a certificate for csr with a PKCSReq signed by signerCert
+// and key, usually a self-signed certificate for the CSR key. While the CA
+// answers PENDING the certificate is polled for with CertPoll.
+func Enroll(ctx context.Context, c Client, csr *x509.CertificateRequest, signerCert *x509.Certificate, key crypto.Signer, opts ...EnrollOption) (*x509.Certificate, error) {
+	return enroll(ctx, c, scep.PKCSReq, csr, signerCert, key, opts)
+}
+
+// Renew requests a new certificate for csr with a request signed by the
+// certificate being renewed and its key. A RenewalReq is sent if the CA
+// advertises the Renewal capability, a PKCSReq otherwise.
+func Renew(ctx context.Context, c Client, csr *x509.CertificateRequest, cert *x509.Certificate, key crypto.Signer, opts ...EnrollOption) (*x509.Certificate, error) {
+	msgType := scep.MessageType(scep.PKCSReq)
+	if c.Supports(string(scep.CapRenewal)) {
+		msgType = scep.RenewalReq
+	}
+	return enroll(ctx, c, msgType, csr, cert, key, opts)
+}
+
+func enroll(ctx context.Context, c Client, msgType scep.MessageType, csr *x509.CertificateRequest, signerCert *x509.Certificate, key crypto.Signer, opts []EnrollOption) (*x509.Certificate, error) {
+	conf := &enrollConfig{logger: log.NewNopLogger(), metrics: metrics.Nop(), tracer: tracing.Nop()}
+	for _, opt := range opts {
+		opt(conf)
+	}
+	if conf.poller == nil {
+		conf.poller = NewPoller()
+	}
+	ctx, span := conf.tracer.Start(ctx, "scepclient.Enroll", tracing.String(tracing.MessageTypeKey, msgType.String()))
+	defer span.End()
+	crt, err := conf.enroll(ctx, span, c, msgType, csr, signerCert, key)
+	if err != nil {
+		span.RecordError(err)
+	}
+	return crt, err
+}
+
+// enroll runs the enrollment transaction, setting its transactionID on
+// span.
+func (conf *enrollConfig) enroll(ctx context.Context, span tracing.Span, c Client, msgType scep.MessageType, csr *x509.CertificateRequest, signerCert *x509.Certificate, key crypto.Signer) (*x509.Certificate, error) {
+	parseOpts := []scep.Option{
+		scep.WithLogger(kitlog.New(conf.logger)),
+		scep.WithTracer(conf.tracer),
+		scep.WithStrictness(conf.strictness),
+	}
+	if conf.keyEnc == scep.RSAOAEP {
+		parseOpts = append(parseOpts, scep.WithRequireOAEP())
+	}
+	if conf.fips {
+		parseOpts = append(parseOpts, scep.WithFIPS())
+	}
+	msgOpts := append(negotiate(ctx, c, conf.strictness, conf.logger), parseOpts...)
+	msgOpts = append(msgOpts, scep.WithCertsSelector(scep.RecipientCertsSelector()))
+	if conf.keyEnc != 0 {
+		msgOpts = append(msgOpts, scep.WithKeyEncryptionAlgorithm(conf.keyEnc))
+	}
+	msgOpts = append(msgOpts, conf.msgOpts...)
+
+	caCerts := conf.caCerts
+	if len(caCerts) == 0 {
+		var err error
+		if caCerts, err = GetCACerts(ctx, c, conf.caMessage); err != nil {
+			return nil, fmt.Errorf("scepclient: GetCACert: %w", err)
+		}
+	}
+	roles := scep.ClassifyCACerts(caCerts)
+
+	tmpl := &scep.PKIMessage{
+		MessageType: msgType,
+		Recipients:  caCerts,
+		SignerCert:  signerCert,
+		SignerKey:   key,
+	}
+	start := time.Now()
+	req, err := scep.NewCSRRequestContext(ctx, csr, tmpl, msgOpts...)
+	conf.metrics.SignDuration(time.Since(start))
+	if err != nil {
+		return nil, fmt.Errorf("scepclient: creating %s: %w", msgType, err)
+	}
+
+	// the first attempt sends the request, later ones poll for it within
+	// the same transaction
+	tmpl.TransactionID = req.TransactionID
+	span.SetAttributes(tracing.String(tracing.TransactionIDKey, string(req.TransactionID)))
+	ias := scep.NewIssuerAndSubject(roles.Issuer(), csr)
+	tx := NewTransaction(req)
+	rep, err := conf.poller.Poll(ctx, func(ctx context.Context) (*scep.PKIMessage, error) {
+		if tx.Response() != nil {
+			poll, err := scep.NewCertPollRequest(ias, tmpl, append([]scep.Option{scep.WithContext(ctx)}, msgOpts...)...)
+			if err != nil {
+				return nil, fmt.Errorf("scepclient: creating CertPoll: %w", err)
+			}
+			if err := tx.Poll(poll); err != nil {
+				return nil, err
+			}
+		}
+		msg := tx.Request()
+		rep, err := pkiOperation(ctx, c, msg, roles.Verifiers(), parseOpts)
+		if err != nil {
+			return nil, err
+		}
+		conf.metrics.MessageParsed(rep.MessageType)
+		if conf.strict && rep.PKIStatus != scep.FAILURE {
+			if err := verifyNonce(msg, rep, conf.strictness); err != nil {
+				return nil, err
+			}
+		}
+		state, err := tx.Receive(rep)
+		if err != nil {
+			return nil, err
+		}
+		if state == TransactionPending {
+			level.Info(conf.logger).Log("msg", "waiting for manual approval", "transaction_id", tx.ID())
+		}
+		return rep, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if tx.State() == TransactionFailed {
+		if err := verifyFailure(tx.Request(), rep, roles.Verifiers(), conf.strictness); err != nil {
+			return nil, err
+		}
+		conf.metrics.Failure(rep.FailInfo)
+		return nil, &FailureError{MessageType: msgType, FailInfo: rep.FailInfo, FailInfoText: rep.FailInfoText}
+	}
+	var decrypter crypto.PrivateKey = key
+	if conf.decrypter != nil {
+		decrypter = conf.decrypter
+	}
+	if err := rep.DecryptPKIEnvelopeContext(ctx, signerCert, decrypter); err != nil {
+		conf.metrics.DecryptFailed()
+		return nil, fmt.Errorf("scepclient: decrypt CertRep pkiEnvelope: %w", err)
+	}
+	crt, err := rep.CertRepMessage.LeafForCSR(csr)
+	if err != nil {
+		return nil, fmt.Errorf("scepclient: %s response: %w", msgType, err)
+	}
+	conf.metrics.CertIssued()
+	return crt, nil
+}
+
+// negotiate returns the message options for the strongest digest and
+// content encryption algorithms advertised by the CA. Without GetCACaps
+// the scep package defaults are used. With scep.Lenient, DES3 is used
+// instead of DES, which NDES rejects.
+func negotiate(ctx context.Context, c Client, s scep.Strictness, logger log.Logger) []scep.Option {
+	data, err := c.GetCACaps(ctx)
+	if err != nil {
+		level.Debug(logger).Log("msg", "GetCACaps failed, using default algorithms", "err", err)
+		if s == scep.Lenient {
+			return []scep.Option{scep.WithEncryptionAlgorithm(scep.DES3CBC)}
+		}
+		return nil
+	}
+	caps := scep.ParseCapabilities(data)
+	alg := caps.EncryptionAlgorithm()
+	if alg == scep.DESCBC && s == scep.Lenient {
+		alg = scep.DES3CBC
+	}
+	return []scep.Option{
+		scep.WithDigestAlgorithm(caps.DigestAlgorithm()),
+		scep.WithEncryptionAlgorithm(alg),
+	}
+}
+
+func pkiOperation(ctx context.Context, c Client, msg *scep.PKIMessage, caCerts []*x509.Certificate, opts []scep.Option) (*scep.PKIMessage, error) {
+	data, err := c.PKIOperation(ctx, msg.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("scepclient: PKIOperation for %s: %w", msg.MessageType, err)
+	}
+	rep, err := scep.ParsePKIMessageContext(ctx, data, append([]scep.Option{scep.WithCACerts(caCerts)}, opts...)...)
+	if err != nil {
+		return nil, fmt.Errorf("scepclient: parsing %s response: %w", msg.MessageType, err)
+	}
+	return rep, nil
+}
@@ -0,0 +1,259 @@
+package scepclient
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// fakeServer is an in-process CA answering PKIOperation requests.
+type fakeServer struct {
+	caps     string
+	ca       *x509.Certificate
+	key      *rsa.PrivateKey
+	pending  int
+	failInfo scep.FailInfo
+	next     *x509.Certificate
+	opts     []scep.Option // parse options of requests
+
+	mu       sync.Mutex
+	csr      *x509.CertificateRequest
+	msgTypes []scep.MessageType
+}
+
+func (s *fakeServer) GetCACaps(context.Context) ([]byte, error) { return []byte(s.caps), nil }
+
+func (s *fakeServer) Supports(cap string) bool {
+	return scep.ParseCapabilities([]byte(s.caps)).Has(scep.Capability(cap))
+}
+
+func (s *fakeServer) GetCACert(context.Context, string) ([]byte, int, error) {
+	return s.ca.Raw, 1, nil
+}
+
+func (s *fakeServer) GetNextCACert(context.Context) ([]byte, error) {
+	if s.next == nil {
+		return nil, errors.New("no next CA certificate")
+	}
+	return scep.NextCACert(s.ca, s.key, []*x509.Certificate{s.next})
+}
+
+func (s *fakeServer) PKIOperation(_ context.Context, data []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// requests must be signed with the strongest advertised digest
+	digest := scep.ParseCapabilities([]byte(s.caps)).DigestAlgorithm()
+	msg, err := scep.ParsePKIMessage(data, append([]scep.Option{scep.WithDigestAlgorithm(digest)}, s.opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	if err := msg.DecryptPKIEnvelope(s.ca, s.key); err != nil {
+		return nil, err
+	}
+	s.msgTypes = append(s.msgTypes, msg.MessageType)
+	if msg.CSRReqMessage != nil {
+		s.csr = msg.CSRReqMessage.CSR
+	}
+
+	var rep *scep.PKIMessage
+	switch {
+	case s.failInfo != "":
+		rep, err = msg.Fail(s.ca, s.key, s.failInfo)
+	case s.pending > 0:
+		s.pending--
+		rep, err = msg.Pending(s.ca, s.key)
+	default:
+		var crt *x509.Certificate
+		if crt, err = s.issue(); err == nil {
+			rep, err = msg.Success(s.ca, s.key, crt)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return rep.Raw, nil
+}
+
+func (s *fakeServer) issue() (*x509.Certificate, error) {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      s.csr.Subject,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, s.ca, s.csr.PublicKey, s.key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+func newFakeServer(t *testing.T, caps string) *fakeServer {
+	ca, key := newTestIdentity(t, true)
+	return &fakeServer{caps: caps, ca: ca, key: key}
+}
+
+// newTestClient returns a CSR and a self-signed certificate for a new key.
+func newTestClient(t *testing.T) (*x509.CertificateRequest, *x509.Certificate, *rsa.PrivateKey) {
+	cert, key := newTestIdentity(t, false)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "client"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr, cert, key
+}
+
+func TestEnroll(t *testing.T) {
+	srv := newFakeServer(t, "POSTPKIOperation\nSCEPStandard")
+	srv.pending = 2
+	csr, self, key := newTestClient(t)
+	poller := newTestPoller(&fakeClock{}, WithJitter(0))
+
+	crt, err := Enroll(context.Background(), srv, csr, self, key, WithPoller(poller))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crt.CheckSignatureFrom(srv.ca); err != nil {
+		t.Error(err)
+	}
+	want := []scep.MessageType{scep.PKCSReq, scep.CertPoll, scep.CertPoll}
+	if len(srv.msgTypes) != len(want) {
+		t.Fatalf("have messages %v, want %v", srv.msgTypes, want)
+	}
+	for i := range want {
+		if srv.msgTypes[i] != want[i] {
+			t.Errorf("message %d: have %s, want %s", i, srv.msgTypes[i], want[i])
+		}
+	}
+}
+
+func TestEnrollFailure(t *testing.T) {
+	srv := newFakeServer(t, "SCEPStandard")
+	srv.failInfo = scep.BadRequest
+	csr, self, key := newTestClient(t)
+
+	_, err := Enroll(context.Background(), srv, csr, self, key)
+	var failErr *FailureError
+	if !errors.As(err, &failErr) {
+		t.Fatalf("expected FailureError, got %v", err)
+	}
+	if have, want := failErr.FailInfo, scep.FailInfo(scep.BadRequest); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
+
+// signOnlyKey and decryptOnlyKey are separate handles of a key held by a
+// token, one exposing Sign and the other Decrypt.
+type signOnlyKey struct{ key *rsa.PrivateKey }
+
+func (k signOnlyKey) Public() crypto.PublicKey { return k.key.Public() }
+
+func (k signOnlyKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.key.Sign(rand, digest, opts)
+}
+
+type decryptOnlyKey struct{ key *rsa.PrivateKey }
+
+func (k decryptOnlyKey) Public() crypto.PublicKey { return k.key.Public() }
+
+func (k decryptOnlyKey) Decrypt(rand io.Reader, ciphertext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	return k.key.Decrypt(rand, ciphertext, opts)
+}
+
+func TestEnrollDecrypter(t *testing.T) {
+	srv := newFakeServer(t, "SCEPStandard")
+	csr, self, key := newTestClient(t)
+
+	if _, err := Enroll(context.Background(), srv, csr, self, signOnlyKey{key}); err == nil {
+		t.Fatal("decrypted the CertRep with a key without Decrypt")
+	}
+	crt, err := Enroll(context.Background(), srv, csr, self, signOnlyKey{key}, WithDecrypter(decryptOnlyKey{key}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crt.CheckSignatureFrom(srv.ca); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestEnrollKeyEncryptionScheme(t *testing.T) {
+	srv := newFakeServer(t, "SCEPStandard")
+	srv.opts = []scep.Option{scep.WithRequireOAEP()}
+	csr, self, key := newTestClient(t)
+
+	if _, err := Enroll(context.Background(), srv, csr, self, key); err == nil {
+		t.Fatal("enrolled with RSAES-PKCS1-v1_5 at a CA requiring RSAES-OAEP")
+	}
+	crt, err := Enroll(context.Background(), srv, csr, self, key, WithKeyEncryptionScheme(scep.RSAOAEP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crt.CheckSignatureFrom(srv.ca); err != nil {
+		t.Error(err)
+	}
+
+	// the CertRep of a CA answering with RSAES-PKCS1-v1_5 is rejected
+	srv.opts = []scep.Option{scep.WithKeyEncryptionAlgorithm(scep.RSAPKCS1v15)}
+	if _, err := Enroll(context.Background(), srv, csr, self, key, WithKeyEncryptionScheme(scep.RSAOAEP)); !errors.Is(err, scep.ErrDecrypt) {
+		t.Errorf("have error %v, want scep.ErrDecrypt", err)
+	}
+}
+
+func TestRenew(t *testing.T) {
+	for _, test := range []struct {
+		caps string
+		want scep.MessageType
+	}{
+		{"SCEPStandard", scep.PKCSReq},
+		{"Renewal\nSCEPStandard", scep.RenewalReq},
+	} {
+		srv := newFakeServer(t, test.caps)
+		csr, self, key := newTestClient(t)
+		if _, err := Renew(context.Background(), srv, csr, self, key); err != nil {
+			t.Fatal(err)
+		}
+		if have := srv.msgTypes[0]; have != test.want {
+			t.Errorf("caps %q: have %s, want %s", test.caps, have, test.want)
+		}
+	}
+}
+
+func TestGetNextCACerts(t *testing.T) {
+	srv := newFakeServer(t, "GetNextCACert\nSCEPStandard")
+	srv.next, _ = newTestIdentity(t, true)
+	next, err := GetNextCACerts(context.Background(), srv, []*x509.Certificate{srv.ca})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(next) != 1 || !next[0].Equal(srv.next) {
+		t.Errorf("have %d certificates, want the next CA certificate", len(next))
+	}
+
+	// the rollover must be signed by the current CA
+	other, _ := newTestIdentity(t, true)
+	if _, err := GetNextCACerts(context.Background(), srv, []*x509.Certificate{other}); err == nil {
+		t.Error("expected error for rollover not signed by the current CA")
+	}
+
+	srv.caps = "SCEPStandard"
+	if _, err := GetNextCACerts(context.Background(), srv, []*x509.Certificate{srv.ca}); err == nil {
+		t.Error("expected error without the GetNextCACert capability")
+	}
+}
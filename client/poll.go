@@ -0,0 +1,142 @@
+package scepclient
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// ErrPollTimeout is returned when the CA still answers PENDING after the
+// maximum number of polling attempts.
+var ErrPollTimeout = errors.New("scepclient: certificate still pending after maximum polling attempts")
+
+// PollFunc performs a single PKIOperation round-trip and returns the parsed
+// CertRep PKIMessage.
+type PollFunc func(ctx context.Context) (*scep.PKIMessage, error)
+
+// PollUntil calls poll every interval until the CA returns a CertRep with a
+// pkiStatus other than PENDING or ctx is done.
+func PollUntil(ctx context.Context, poll PollFunc, interval time.Duration) (*scep.PKIMessage, error) {
+	wait := func(int) (time.Duration, bool) { return interval, true }
+	return pollUntil(ctx, poll, wait, time.After)
+}
+
+// pollUntil calls poll until the CA stops answering PENDING. Between
+// attempts it waits for the duration returned by wait, which reports false
+// once no more attempts should be made.
+func pollUntil(
+	ctx context.Context,
+	poll PollFunc,
+	wait func(attempt int) (time.Duration, bool),
+	after func(time.Duration) <-chan time.Time,
+) (*scep.PKIMessage, error) {
+	for attempt := 1; ; attempt++ {
+		msg, err := poll(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if msg.CertRepMessage == nil {
+			return nil, errors.New("scepclient: response is not a CertRep message")
+		}
+		if msg.PKIStatus != scep.PENDING {
+			return msg, nil
+		}
+		d, ok := wait(attempt)
+		if !ok {
+			return nil, ErrPollTimeout
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-after(d):
+		}
+	}
+}
+
+// Poller polls a SCEP server for a pending certificate using exponential
+// backoff with jitter.
+type Poller struct {
+	initialInterval time.Duration
+	maxInterval     time.Duration
+	multiplier      float64
+	jitter          float64
+	maxAttempts     int
+
+	// replaced in tests
+	after func(time.Duration) <-chan time.Time
+	rand  func() float64
+}
+
+// PollOption configures a Poller.
+type PollOption func(*Poller)
+
+// WithBackoff sets the first polling interval, the upper bound of the
+// interval and the factor the interval grows by after each PENDING reply.
+func WithBackoff(initial, max time.Duration, multiplier float64) PollOption {
+	return func(p *Poller) {
+		p.initialInterval = initial
+		p.maxInterval = max
+		p.multiplier = multiplier
+	}
+}
+
+// WithJitter randomizes each interval by up to the given fraction in either
+// direction, so that a fleet of clients does not poll in lockstep.
+func WithJitter(fraction float64) PollOption {
+	return func(p *Poller) {
+		p.jitter = fraction
+	}
+}
+
+// WithMaxAttempts caps the number of PKIOperation requests. Zero means no
+// limit.
+func WithMaxAttempts(n int) PollOption {
+	return func(p *Poller) {
+		p.maxAttempts = n
+	}
+}
+
+// NewPoller creates a Poller. By default it waits 30 seconds after the first
+// PENDING reply, doubling up to 10 minutes with 20% jitter and no attempt limit.
+func NewPoller(opts ...PollOption) *Poller {
+	p := &Poller{
+		initialInterval: 30 * time.Second,
+		maxInterval:     10 * time.Minute,
+		multiplier:      2,
+		jitter:          0.2,
+		after:           time.After,
+		rand:            rand.Float64,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Poll calls poll until the CA returns SUCCESS or FAILURE, the maximum
+// number of attempts is reached or ctx is done.
+func (p *Poller) Poll(ctx context.Context, poll PollFunc) (*scep.PKIMessage, error) {
+	return pollUntil(ctx, poll, p.interval, p.after)
+}
+
+// interval returns the time to wait after attempt.
+func (p *Poller) interval(attempt int) (time.Duration, bool) {
+	if p.maxAttempts > 0 && attempt >= p.maxAttempts {
+		return 0, false
+	}
+	d := float64(p.initialInterval)
+	for i := 1; i < attempt; i++ {
+		d *= p.multiplier
+		if p.maxInterval > 0 && d >= float64(p.maxInterval) {
+			d = float64(p.maxInterval)
+			break
+		}
+	}
+	if p.jitter > 0 {
+		d += d * p.jitter * (2*p.rand() - 1)
+	}
+	return time.Duration(d), true
+}
@@ -0,0 +1,133 @@
+package scepclient
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// fakeCA answers PENDING the configured number of times, then SUCCESS.
+type fakeCA struct {
+	pending int
+	calls   int
+}
+
+func (f *fakeCA) poll(ctx context.Context) (*scep.PKIMessage, error) {
+	f.calls++
+	status := scep.PKIStatus(scep.SUCCESS)
+	if f.calls <= f.pending {
+		status = scep.PENDING
+	}
+	return &scep.PKIMessage{
+		MessageType:    scep.CertRep,
+		CertRepMessage: &scep.CertRepMessage{PKIStatus: status},
+	}, nil
+}
+
+// fakeClock records requested waits and fires immediately unless blocked.
+type fakeClock struct {
+	waits []time.Duration
+	block bool
+}
+
+func (c *fakeClock) after(d time.Duration) <-chan time.Time {
+	c.waits = append(c.waits, d)
+	ch := make(chan time.Time, 1)
+	if !c.block {
+		ch <- time.Time{}
+	}
+	return ch
+}
+
+func newTestPoller(clock *fakeClock, opts ...PollOption) *Poller {
+	p := NewPoller(opts...)
+	p.after = clock.after
+	p.rand = func() float64 { return 1 }
+	return p
+}
+
+func TestPollerBackoff(t *testing.T) {
+	clock := &fakeClock{}
+	ca := &fakeCA{pending: 5}
+	p := newTestPoller(clock, WithBackoff(time.Second, 5*time.Second, 2), WithJitter(0))
+
+	msg, err := p.Poll(context.Background(), ca.poll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := msg.PKIStatus, scep.PKIStatus(scep.SUCCESS); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if have, want := ca.calls, 6; have != want {
+		t.Errorf("have %d calls, want %d", have, want)
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	if len(clock.waits) != len(want) {
+		t.Fatalf("have waits %v, want %v", clock.waits, want)
+	}
+	for i := range want {
+		if clock.waits[i] != want[i] {
+			t.Errorf("wait %d: have %s, want %s", i, clock.waits[i], want[i])
+		}
+	}
+}
+
+func TestPollerJitter(t *testing.T) {
+	clock := &fakeClock{}
+	ca := &fakeCA{pending: 1}
+	p := newTestPoller(clock, WithBackoff(10*time.Second, time.Minute, 2), WithJitter(0.5))
+
+	if _, err := p.Poll(context.Background(), ca.poll); err != nil {
+		t.Fatal(err)
+	}
+	// rand is fixed at 1, the upper bound of the jitter range.
+	if have, want := clock.waits[0], 15*time.Second; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
+
+func TestPollerMaxAttempts(t *testing.T) {
+	clock := &fakeClock{}
+	ca := &fakeCA{pending: 10}
+	p := newTestPoller(clock, WithBackoff(time.Second, time.Second, 1), WithMaxAttempts(3))
+
+	_, err := p.Poll(context.Background(), ca.poll)
+	if err != ErrPollTimeout {
+		t.Fatalf("have %v, want %v", err, ErrPollTimeout)
+	}
+	if have, want := ca.calls, 3; have != want {
+		t.Errorf("have %d calls, want %d", have, want)
+	}
+}
+
+func TestPollerContextCancel(t *testing.T) {
+	clock := &fakeClock{block: true}
+	ca := &fakeCA{pending: 10}
+	p := newTestPoller(clock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := p.Poll(ctx, ca.poll)
+	if err != context.Canceled {
+		t.Fatalf("have %v, want %v", err, context.Canceled)
+	}
+	if have, want := ca.calls, 1; have != want {
+		t.Errorf("have %d calls, want %d", have, want)
+	}
+}
+
+func TestPollUntil(t *testing.T) {
+	ca := &fakeCA{pending: 2}
+	msg, err := PollUntil(context.Background(), ca.poll, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := msg.PKIStatus, scep.PKIStatus(scep.SUCCESS); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if have, want := ca.calls, 3; have != want {
+		t.Errorf("have %d calls, want %d", have, want)
+	}
+}
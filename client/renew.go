@@ -0,0 +1,199 @@
+package scepclient
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// ReloadHook is called by a RenewalManager after the renewed certificate
+// and key were saved, e.g. to reload a TLS server using them.
+type ReloadHook func(cert *x509.Certificate, key crypto.Signer) error
+
+// RenewalManager keeps the identity of a Store renewed with RenewalReq
+// requests signed by the current certificate and key.
+type RenewalManager struct {
+	client Client
+	store  Store
+
+	fraction      float64
+	retryInterval time.Duration
+	checkInterval time.Duration
+	newKey        func(crypto.Signer) (crypto.Signer, error)
+	enrollOpts    []EnrollOption
+	hooks         []ReloadHook
+	logger        log.Logger
+
+	// replaced in tests
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+}
+
+// RenewalOption configures a RenewalManager.
+type RenewalOption func(*RenewalManager)
+
+// WithRenewalFraction sets the fraction of the certificate lifetime after
+// which it is renewed, 2/3 by default.
+func WithRenewalFraction(f float64) RenewalOption {
+	return func(m *RenewalManager) {
+		m.fraction = f
+	}
+}
+
+// WithRenewalRetryInterval sets the time to wait after a failed renewal,
+// 10 minutes by default.
+func WithRenewalRetryInterval(d time.Duration) RenewalOption {
+	return func(m *RenewalManager) {
+		m.retryInterval = d
+	}
+}
+
+// WithRenewalCheckInterval sets how often the identity is loaded from the
+// store again while waiting for the renewal time, so that a certificate replaced
+// by other means is picked up. It is an hour by default.
+func WithRenewalCheckInterval(d time.Duration) RenewalOption {
+	return func(m *RenewalManager) {
+		m.checkInterval = d
+	}
+}
+
+// WithRenewalKeyGenerator sets the function returning the key of the
+// renewed certificate given the current one. By default the key is created
+// with Store.NewKey; returning the current key renews the certificate for
+// the same key.
+func WithRenewalKeyGenerator(newKey func(current crypto.Signer) (crypto.Signer, error)) RenewalOption {
+	return func(m *RenewalManager) {
+		m.newKey = newKey
+	}
+}
+
+// WithRenewalEnrollOptions passes opts to Renew.
+func WithRenewalEnrollOptions(opts ...EnrollOption) RenewalOption {
+	return func(m *RenewalManager) {
+		m.enrollOpts = append(m.enrollOpts, opts...)
+	}
+}
+
+// WithReloadHook adds a hook called after every renewal.
+func WithReloadHook(hook ReloadHook) RenewalOption {
+	return func(m *RenewalManager) {
+		m.hooks = append(m.hooks, hook)
+	}
+}
+
+// WithRenewalLogger sets the logger of the RenewalManager.
+func WithRenewalLogger(logger log.Logger) RenewalOption {
+	return func(m *RenewalManager) {
+		m.logger = logger
+	}
+}
+
+// NewRenewalManager creates a RenewalManager for the identity of store,
+// e.g. a FileStore.
+func NewRenewalManager(c Client, store Store, opts ...RenewalOption) *RenewalManager {
+	m := &RenewalManager{
+		client:        c,
+		store:         store,
+		fraction:      2.0 / 3,
+		retryInterval: 10 * time.Minute,
+		checkInterval: time.Hour,
+		newKey:        func(crypto.Signer) (crypto.Signer, error) { return store.NewKey() },
+		logger:        log.NewNopLogger(),
+		now:           time.Now,
+		after:         time.After,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// RenewAt returns the time at which cert is due for renewal.
+func (m *RenewalManager) RenewAt(cert *x509.Certificate) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotBefore.Add(time.Duration(float64(lifetime) * m.fraction))
+}
+
+// Run renews the certificate whenever it is due until ctx is done. Failed
+// renewals are retried after the retry interval. It returns an error if
+// the identity cannot be loaded.
+func (m *RenewalManager) Run(ctx context.Context) error {
+	for {
+		cert, _, err := m.store.Identity()
+		if err != nil {
+			return err
+		}
+		wait := m.RenewAt(cert).Sub(m.now())
+		if wait <= 0 {
+			renewed, err := m.Renew(ctx)
+			if err == nil {
+				level.Info(m.logger).Log("msg", "renewed certificate", "not_after", renewed.NotAfter)
+				continue
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			level.Info(m.logger).Log("msg", "certificate renewal failed", "err", err, "retry_in", m.retryInterval)
+			wait = m.retryInterval
+		}
+		if wait > m.checkInterval {
+			wait = m.checkInterval
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-m.after(wait):
+		}
+	}
+}
+
+// Renew renews the certificate now, regardless of the renewal time, and
+// saves the new identity in the store. The reload hooks are called once it
+// is saved; the first hook error is returned after all hooks ran.
+func (m *RenewalManager) Renew(ctx context.Context) (*x509.Certificate, error) {
+	cert, key, err := m.store.Identity()
+	if err != nil {
+		return nil, err
+	}
+	newKey, err := m.newKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("scepclient: generating renewal key: %w", err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		RawSubject:     cert.RawSubject,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		IPAddresses:    cert.IPAddresses,
+		URIs:           cert.URIs,
+	}, newKey)
+	if err != nil {
+		return nil, fmt.Errorf("scepclient: creating renewal CSR: %w", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+
+	renewed, err := Renew(ctx, m.client, csr, cert, key, m.enrollOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.store.Save(renewed, newKey); err != nil {
+		return nil, fmt.Errorf("scepclient: saving renewed identity: %w", err)
+	}
+
+	var hookErr error
+	for _, hook := range m.hooks {
+		if err := hook(renewed, newKey); err != nil && hookErr == nil {
+			hookErr = fmt.Errorf("scepclient: reload hook: %w", err)
+		}
+	}
+	return renewed, hookErr
+}
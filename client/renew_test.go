@@ -0,0 +1,139 @@
+package scepclient
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// writeTestIdentity stores the self-signed test client identity in dir.
+func writeTestIdentity(t *testing.T, dir string) (*x509.Certificate, *rsa.PrivateKey, string, string) {
+	_, cert, key := newTestClient(t)
+	certPath, keyPath := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	if err := ioutil.WriteFile(certPath, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := encodeKeyPEM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, certPath, keyPath
+}
+
+func TestRenewalManagerRenew(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scepclient-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := newFakeServer(t, "Renewal\nSCEPStandard")
+	old, oldKey, certPath, keyPath := writeTestIdentity(t, dir)
+
+	var reloaded *x509.Certificate
+	m := NewRenewalManager(srv, NewFileStore(certPath, keyPath), WithReloadHook(func(cert *x509.Certificate, key crypto.Signer) error {
+		reloaded = cert
+		return nil
+	}))
+	renewed, err := m.Renew(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := srv.msgTypes[0]; have != scep.RenewalReq {
+		t.Errorf("have %s, want RenewalReq", have)
+	}
+	if reloaded != renewed {
+		t.Error("reload hook not called with the renewed certificate")
+	}
+	if srv.csr.Subject.CommonName != old.Subject.CommonName {
+		t.Errorf("renewal CSR subject %q, want %q", srv.csr.Subject, old.Subject)
+	}
+
+	cert, key, err := m.store.Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cert.Equal(renewed) {
+		t.Error("renewed certificate not stored")
+	}
+	if key.(*rsa.PrivateKey).Equal(oldKey) {
+		t.Error("renewal did not rotate the key")
+	}
+	if err := cert.CheckSignatureFrom(srv.ca); err != nil {
+		t.Error(err)
+	}
+	if fi, err := os.Stat(keyPath); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("key file mode changed: %v %v", fi.Mode(), err)
+	}
+
+	// hook errors are returned once the files are written
+	hookErr := errors.New("reload failed")
+	m = NewRenewalManager(srv, NewFileStore(certPath, keyPath), WithReloadHook(func(*x509.Certificate, crypto.Signer) error {
+		return hookErr
+	}))
+	if _, err := m.Renew(context.Background()); !errors.Is(err, hookErr) {
+		t.Errorf("have %v, want the hook error", err)
+	}
+}
+
+func TestRenewalManagerRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scepclient-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srv := newFakeServer(t, "Renewal\nSCEPStandard")
+	old, _, certPath, keyPath := writeTestIdentity(t, dir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var waits []time.Duration
+	m := NewRenewalManager(srv, NewFileStore(certPath, keyPath))
+	now := m.RenewAt(old).Add(time.Minute)
+	m.now = func() time.Time { return now }
+	m.after = func(d time.Duration) <-chan time.Time {
+		waits = append(waits, d)
+		cancel()
+		return make(chan time.Time)
+	}
+
+	if err := m.Run(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("have %v, want context.Canceled", err)
+	}
+	if len(srv.msgTypes) != 1 {
+		t.Fatalf("have %d requests, want one renewal", len(srv.msgTypes))
+	}
+	cert, _, err := m.store.Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(waits) != 1 || waits[0] != m.RenewAt(cert).Sub(now) {
+		t.Errorf("have waits %v, want one until the renewal of %s", waits, m.RenewAt(cert))
+	}
+}
+
+func TestRenewAt(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{NotBefore: start, NotAfter: start.Add(90 * time.Hour)}
+	m := NewRenewalManager(nil, NewFileStore("", ""))
+	if have, want := m.RenewAt(cert), start.Add(60*time.Hour); !have.Equal(want) {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	m = NewRenewalManager(nil, NewFileStore("", ""), WithRenewalFraction(0.5))
+	if have, want := m.RenewAt(cert), start.Add(45*time.Hour); !have.Equal(want) {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
@@ -0,0 +1,144 @@
+package scepclient
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// WithProxy sends the requests through the proxy returned by proxy for each
+// request, e.g. http.ProxyURL. A nil proxy connects directly. Without the
+// option the proxy is taken from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY
+// environment variables for each request, like http.DefaultTransport does.
+func WithProxy(proxy func(*http.Request) (*url.URL, error)) ClientOption {
+	return func(c *clientConfig) error {
+		c.proxy = proxy
+		c.proxySet = true
+		return nil
+	}
+}
+
+// WithRetry retries failed requests up to retries times, waiting initial
+// before the first retry and doubling the wait up to max.
+//
+// GET requests, including GET PKIOperation, are retried after connection
+// errors and 5xx responses other than 501 Not Implemented. A POST
+// PKIOperation may already have been processed by the CA when it fails, and
+// a second identical request would then be rejected as a replay, so it is
+// only retried when it was not received: when the connection could not be
+// established, or on 503 Service Unavailable and 429 Too Many Requests. A
+// request whose enrollment state is unknown is recovered by polling with
+// GetCertInitial instead.
+//
+// A Retry-After header of a 429 or 503 response overrides the backoff; if it
+// asks to wait longer than max the response is returned.
+func WithRetry(retries int, initial, max time.Duration) ClientOption {
+	return func(c *clientConfig) error {
+		if retries < 0 || initial <= 0 || max < initial {
+			return errors.New("scepclient: invalid retry configuration")
+		}
+		c.retry = &retryTransport{
+			retries:         retries,
+			initialInterval: initial,
+			maxInterval:     max,
+			after:           time.After,
+		}
+		return nil
+	}
+}
+
+// retryTransport is an http.RoundTripper retrying failed requests with
+// exponential backoff.
+type retryTransport struct {
+	next            http.RoundTripper
+	retries         int
+	initialInterval time.Duration
+	maxInterval     time.Duration
+
+	// replaced in tests
+	after func(time.Duration) <-chan time.Time
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	for retry := 0; ; retry++ {
+		resp, err := next.RoundTrip(req)
+		if retry >= t.retries || !retryable(req, resp, err) {
+			return resp, err
+		}
+		wait, ok := t.interval(retry, resp)
+		if !ok || (req.Body != nil && req.Body != http.NoBody && req.GetBody == nil) {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+		select {
+		case <-t.after(wait):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// interval returns the time to wait before retry, false if the server asks
+// to wait longer than the maximum interval.
+func (t *retryTransport) interval(retry int, resp *http.Response) (time.Duration, bool) {
+	if resp != nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs >= 0 {
+			d := time.Duration(secs) * time.Second
+			return d, d <= t.maxInterval
+		}
+	}
+	d := t.initialInterval
+	for i := 0; i < retry && d < t.maxInterval; i++ {
+		d *= 2
+	}
+	if d > t.maxInterval {
+		d = t.maxInterval
+	}
+	return d, true
+}
+
+// retryable reports whether req may be sent again after it failed with
+// resp or err.
+func retryable(req *http.Request, resp *http.Response, err error) bool {
+	if req.Context().Err() != nil {
+		return false
+	}
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead
+	if err != nil {
+		return idempotent || isDialError(err)
+	}
+	switch code := resp.StatusCode; {
+	case code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable:
+		return true
+	case code >= 500 && code != http.StatusNotImplemented:
+		return idempotent
+	}
+	return false
+}
+
+// isDialError reports whether err happened while connecting to the server or
+// proxy, before any part of the request was sent.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect")
+}
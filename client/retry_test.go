@@ -0,0 +1,139 @@
+package scepclient
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestRetryTransport(t *testing.T) {
+	dialErr := &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "refused"}}
+	readErr := &net.OpError{Op: "read", Net: "tcp", Err: &net.DNSError{Err: "reset"}}
+	for _, test := range []struct {
+		testName  string
+		method    string
+		status    int
+		err       error
+		header    http.Header
+		wantCalls int
+	}{
+		{"GET 500", "GET", http.StatusInternalServerError, nil, nil, 4},
+		{"GET 501", "GET", http.StatusNotImplemented, nil, nil, 1},
+		{"GET read error", "GET", 0, readErr, nil, 4},
+		{"GET 400", "GET", http.StatusBadRequest, nil, nil, 1},
+		{"POST 500", "POST", http.StatusInternalServerError, nil, nil, 1},
+		{"POST 503", "POST", http.StatusServiceUnavailable, nil, nil, 4},
+		{"POST 429", "POST", http.StatusTooManyRequests, nil, http.Header{"Retry-After": {"2"}}, 4},
+		{"POST 429 long Retry-After", "POST", http.StatusTooManyRequests, nil, http.Header{"Retry-After": {"3600"}}, 1},
+		{"POST dial error", "POST", 0, dialErr, nil, 4},
+		{"POST read error", "POST", 0, readErr, nil, 1},
+	} {
+		t.Run(test.testName, func(t *testing.T) {
+			var calls int
+			var waits []time.Duration
+			rt := &retryTransport{
+				next: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					calls++
+					if r.Body != nil {
+						if body, _ := ioutil.ReadAll(r.Body); string(body) != "message" {
+							t.Errorf("attempt %d has body %q", calls, body)
+						}
+					}
+					if test.err != nil {
+						return nil, test.err
+					}
+					return &http.Response{
+						StatusCode: test.status,
+						Header:     test.header,
+						Body:       ioutil.NopCloser(&bytes.Buffer{}),
+					}, nil
+				}),
+				retries:         3,
+				initialInterval: time.Second,
+				maxInterval:     3 * time.Second,
+				after: func(d time.Duration) <-chan time.Time {
+					waits = append(waits, d)
+					c := make(chan time.Time, 1)
+					c <- time.Time{}
+					return c
+				},
+			}
+			req, _ := http.NewRequest(test.method, "http://scep.example.com/scep", nil)
+			if test.method == "POST" {
+				req, _ = http.NewRequest(test.method, "http://scep.example.com/scep", bytes.NewReader([]byte("message")))
+			}
+			rt.RoundTrip(req)
+			if calls != test.wantCalls {
+				t.Errorf("have %d calls, want %d", calls, test.wantCalls)
+			}
+			if test.header == nil && len(waits) == 3 && (waits[0] != time.Second || waits[1] != 2*time.Second || waits[2] != 3*time.Second) {
+				t.Errorf("have waits %v", waits)
+			}
+			if test.header != nil && len(waits) > 0 && waits[0] != 2*time.Second {
+				t.Errorf("have waits %v, want Retry-After", waits)
+			}
+		})
+	}
+}
+
+func TestRetryTransportContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var calls int
+	rt := &retryTransport{
+		next: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			calls++
+			cancel()
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: ioutil.NopCloser(&bytes.Buffer{})}, nil
+		}),
+		retries:         3,
+		initialInterval: time.Second,
+		maxInterval:     time.Second,
+		after:           time.After,
+	}
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://scep.example.com/scep", nil)
+	rt.RoundTrip(req)
+	if calls != 1 {
+		t.Errorf("have %d calls after cancellation, want 1", calls)
+	}
+}
+
+func TestClientProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Write([]byte("POSTPKIOperation"))
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	c, err := New("http://scep.example.com/scep", log.NewNopLogger(),
+		WithProxy(http.ProxyURL(proxyURL)),
+		WithRetry(2, time.Millisecond, time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caps, err := c.GetCACaps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(caps) != "POSTPKIOperation" || proxied != "http://scep.example.com/scep?operation=GetCACaps" {
+		t.Errorf("have caps %q through the proxy for %q", caps, proxied)
+	}
+
+	if _, err := New("http://scep.example.com/scep", log.NewNopLogger(), WithRetry(1, time.Second, time.Millisecond)); err == nil {
+		t.Error("expected an invalid retry configuration error")
+	}
+}
@@ -0,0 +1,75 @@
+package scepclient
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"time"
+)
+
+// DefaultSelfSignedValidity is the validity of the certificates created by
+// SelfSigned. It covers the PENDING polling of a manually approved request,
+// as CertPoll messages are signed with the same certificate.
+const DefaultSelfSignedValidity = 24 * time.Hour
+
+// selfSignedBackdate starts the validity of a self-signed certificate before
+// its creation to tolerate a CA clock behind the client.
+const selfSignedBackdate = 10 * time.Minute
+
+// SelfSignedOption configures the certificate created by SelfSigned.
+type SelfSignedOption func(*selfSignedConfig)
+
+type selfSignedConfig struct {
+	validity time.Duration
+	now      func() time.Time
+}
+
+// WithSelfSignedValidity sets the validity of the self-signed certificate.
+// The default is DefaultSelfSignedValidity.
+func WithSelfSignedValidity(validity time.Duration) SelfSignedOption {
+	return func(c *selfSignedConfig) {
+		c.validity = validity
+	}
+}
+
+// SelfSigned creates the temporary certificate signing the PKCSReq of a
+// first enrollment, before the client has a certificate issued by the CA.
+// Following RFC 8894 section 2.3 it is self-signed with key, the key of csr,
+// and carries the subject of csr. Its key usage allows the CA to encrypt the
+// CertRep pkiEnvelope to the key: key transport for RSA and key agreement
+// for ECDSA keys.
+func SelfSigned(csr *x509.CertificateRequest, key crypto.Signer, opts ...SelfSignedOption) (*x509.Certificate, error) {
+	conf := &selfSignedConfig{validity: DefaultSelfSignedValidity, now: time.Now}
+	for _, opt := range opts {
+		opt(conf)
+	}
+	if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(csr.PublicKey) {
+		return nil, errors.New("scepclient: key is not the key of the CSR")
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	usage := x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	if _, ok := key.Public().(*ecdsa.PublicKey); ok {
+		usage = x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement
+	}
+	now := conf.now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               csr.Subject,
+		RawSubject:            csr.RawSubject,
+		NotBefore:             now.Add(-selfSignedBackdate),
+		NotAfter:              now.Add(conf.validity),
+		KeyUsage:              usage,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
@@ -0,0 +1,81 @@
+package scepclient
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+)
+
+func TestSelfSigned(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func(c *selfSignedConfig) { c.now = func() time.Time { return now } }
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := newECKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		testName string
+		key      crypto.Signer
+		usage    x509.KeyUsage
+	}{
+		{"RSA", rsaKey, x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment},
+		{"ECDSA", ecKey, x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement},
+	} {
+		test := test
+		t.Run(test.testName, func(t *testing.T) {
+			der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+				Subject: pkix.Name{CommonName: "device", Organization: []string{"example"}},
+			}, test.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			csr, err := x509.ParseCertificateRequest(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, err := SelfSigned(csr, test.key, clock, WithSelfSignedValidity(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+				t.Errorf("not self-signed: %v", err)
+			}
+			if !bytes.Equal(cert.RawSubject, csr.RawSubject) {
+				t.Errorf("subject %s, want %s", cert.Subject, csr.Subject)
+			}
+			if cert.KeyUsage != test.usage {
+				t.Errorf("KeyUsage = %v, want %v", cert.KeyUsage, test.usage)
+			}
+			if cert.IsCA {
+				t.Error("self-signed certificate is a CA")
+			}
+			if have, want := cert.NotAfter, now.Add(time.Hour); !have.Equal(want) {
+				t.Errorf("NotAfter = %s, want %s", have, want)
+			}
+			if !cert.NotBefore.Before(now) {
+				t.Errorf("NotBefore %s not before %s", cert.NotBefore, now)
+			}
+		})
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SelfSigned(csr, rsaKey); err == nil {
+		t.Error("want an error for a key other than the key of the CSR")
+	}
+}
@@ -0,0 +1,195 @@
+package scepclient
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/micromdm/scep/v2/cryptoutil"
+)
+
+// ErrNoIdentity is returned by Store.Identity before an identity was saved.
+var ErrNoIdentity = errors.New("scepclient: no stored identity")
+
+// Store keeps the private key and certificate of an enrolled identity.
+// Hardware backed stores generate keys which never leave the device.
+type Store interface {
+	// Identity returns the stored certificate and its private key, or
+	// ErrNoIdentity.
+	Identity() (*x509.Certificate, crypto.Signer, error)
+
+	// NewKey creates a private key for a new identity. It becomes the
+	// stored key once its certificate is saved.
+	NewKey() (crypto.Signer, error)
+
+	// Save stores cert and key, returned by NewKey, as the identity,
+	// replacing the previous one.
+	Save(cert *x509.Certificate, key crypto.Signer) error
+}
+
+// FileStore stores the identity in a PEM encoded certificate file and an
+// unencrypted private key file, like the scepclient command.
+type FileStore struct {
+	certPath string
+	keyPath  string
+	keyGen   func() (crypto.Signer, error)
+}
+
+// FileStoreOption configures a FileStore.
+type FileStoreOption func(*FileStore)
+
+// WithKeyGenerator sets the function creating the keys of new identities.
+// By default a key of the type and size of the stored key is generated, or
+// a 2048 bit RSA key without a stored identity.
+func WithKeyGenerator(gen func() (crypto.Signer, error)) FileStoreOption {
+	return func(s *FileStore) {
+		s.keyGen = gen
+	}
+}
+
+// NewFileStore returns a FileStore for the certificate at certPath and its
+// key at keyPath.
+func NewFileStore(certPath, keyPath string, opts ...FileStoreOption) *FileStore {
+	s := &FileStore{certPath: certPath, keyPath: keyPath}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Identity implements Store.
+func (s *FileStore) Identity() (*x509.Certificate, crypto.Signer, error) {
+	cert, err := readCertFile(s.certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadFile(s.keyPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, ErrNoIdentity
+	} else if err != nil {
+		return nil, nil, err
+	}
+	key, err := cryptoutil.ParsePrivateKeyPEM(data, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("scepclient: parsing %s: %w", s.keyPath, err)
+	}
+	return cert, key, nil
+}
+
+// NewKey implements Store.
+func (s *FileStore) NewKey() (crypto.Signer, error) {
+	if s.keyGen != nil {
+		return s.keyGen()
+	}
+	_, key, err := s.Identity()
+	if errors.Is(err, ErrNoIdentity) {
+		return rsa.GenerateKey(rand.Reader, 2048)
+	} else if err != nil {
+		return nil, err
+	}
+	return newKeyLike(key)
+}
+
+// Save implements Store. The files are replaced with renames in their
+// directories, the key first, so readers never see a partially written
+// file.
+func (s *FileStore) Save(cert *x509.Certificate, key crypto.Signer) error {
+	if !publicKeyMatches(cert, key) {
+		return errors.New("scepclient: certificate is not for the key")
+	}
+	keyPEM, err := encodeKeyPEM(key)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.keyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	return writeCertFile(s.certPath, cert)
+}
+
+func readCertFile(path string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoIdentity
+	} else if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("scepclient: no PEM certificate in %s", path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func writeCertFile(path string, cert *x509.Certificate) error {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	return writeFileAtomic(path, certPEM, 0644)
+}
+
+// newKeyLike generates a new key of the type and size of key.
+func newKeyLike(key crypto.Signer) (crypto.Signer, error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return rsa.GenerateKey(rand.Reader, key.N.BitLen())
+	case *ecdsa.PrivateKey:
+		return ecdsa.GenerateKey(key.Curve, rand.Reader)
+	case ed25519.PrivateKey:
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
+	return nil, fmt.Errorf("unsupported key type %T", key)
+}
+
+// encodeKeyPEM encodes RSA keys as PKCS#1, like the scepclient command,
+// and other keys as PKCS#8.
+func encodeKeyPEM(key crypto.Signer) ([]byte, error) {
+	if key, ok := key.(*rsa.PrivateKey); ok {
+		return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// writeFileAtomic replaces the file at path with data by renaming a
+// temporary file in the same directory, keeping the mode of an existing
+// file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if fi, err := os.Stat(path); err == nil {
+		perm = fi.Mode().Perm()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,111 @@
+package scepclient
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+)
+
+// KeychainIdentity is a certificate of the macOS keychain paired with its
+// private key.
+type KeychainIdentity struct {
+	Certificate *x509.Certificate
+	Key         crypto.Signer
+}
+
+// Keychain is the part of the macOS Security framework used by
+// KeychainStore. The package does not link the framework; callers
+// implement Keychain on top of the binding of their choice, e.g. cgo calls
+// of SecKeyCreateRandomKey, SecItemAdd, SecItemCopyMatching and
+// SecItemDelete.
+type Keychain interface {
+	// GenerateKey creates a private key labelled label, which can be kept
+	// in the Secure Enclave and marked non-extractable.
+	GenerateKey(label string) (crypto.Signer, error)
+
+	// AddCertificate adds cert labelled label. The keychain pairs it with
+	// its private key to an identity.
+	AddCertificate(label string, cert *x509.Certificate) error
+
+	// Identities returns the identities of the certificates labelled
+	// label.
+	Identities(label string) ([]KeychainIdentity, error)
+
+	// DeleteCertificate removes cert.
+	DeleteCertificate(cert *x509.Certificate) error
+
+	// DeleteKey removes the private key key.
+	DeleteKey(key crypto.Signer) error
+}
+
+// KeychainStore stores the identity in the macOS keychain under a label.
+type KeychainStore struct {
+	keychain Keychain
+	label    string
+}
+
+// NewKeychainStore returns a KeychainStore for the identity labelled label
+// in keychain.
+func NewKeychainStore(keychain Keychain, label string) *KeychainStore {
+	return &KeychainStore{keychain: keychain, label: label}
+}
+
+// Identity implements Store. If the label has several identities, e.g.
+// after an interrupted Save, the one expiring last is returned.
+func (s *KeychainStore) Identity() (*x509.Certificate, crypto.Signer, error) {
+	ids, err := s.keychain.Identities(s.label)
+	if err != nil {
+		return nil, nil, err
+	}
+	var newest *KeychainIdentity
+	for i := range ids {
+		if newest == nil || ids[i].Certificate.NotAfter.After(newest.Certificate.NotAfter) {
+			newest = &ids[i]
+		}
+	}
+	if newest == nil {
+		return nil, nil, ErrNoIdentity
+	}
+	return newest.Certificate, newest.Key, nil
+}
+
+// NewKey implements Store.
+func (s *KeychainStore) NewKey() (crypto.Signer, error) {
+	return s.keychain.GenerateKey(s.label)
+}
+
+// Save implements Store. The previous identities of the label are deleted
+// once cert was added, keeping their key if it is renewed.
+func (s *KeychainStore) Save(cert *x509.Certificate, key crypto.Signer) error {
+	if !publicKeyMatches(cert, key) {
+		return errors.New("scepclient: certificate is not for the key")
+	}
+	old, err := s.keychain.Identities(s.label)
+	if err != nil {
+		return err
+	}
+	if err := s.keychain.AddCertificate(s.label, cert); err != nil {
+		return err
+	}
+	for _, id := range old {
+		if id.Certificate.Equal(cert) {
+			continue
+		}
+		if err := s.keychain.DeleteCertificate(id.Certificate); err != nil {
+			return err
+		}
+		if publicKeyMatches(cert, id.Key) {
+			continue
+		}
+		if err := s.keychain.DeleteKey(id.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publicKeyMatches reports whether cert is for the public key of key.
+func publicKeyMatches(cert *x509.Certificate, key crypto.Signer) bool {
+	pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	return ok && pub.Equal(cert.PublicKey)
+}
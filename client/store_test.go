@@ -0,0 +1,203 @@
+package scepclient
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newECKey() (crypto.Signer, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// selfSignTest returns a certificate for key valid for validity.
+func selfSignTest(t *testing.T, key crypto.Signer, validity time.Duration) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(validity),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// testStore saves two identities in store, the second for the key of the
+// first, and checks that the last one saved is returned.
+func testStore(t *testing.T, store Store) {
+	if _, _, err := store.Identity(); !errors.Is(err, ErrNoIdentity) {
+		t.Fatalf("have %v, want ErrNoIdentity", err)
+	}
+	key, err := store.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, validity := range []time.Duration{time.Hour, 2 * time.Hour} {
+		cert := selfSignTest(t, key, validity)
+		if err := store.Save(cert, key); err != nil {
+			t.Fatal(err)
+		}
+		have, haveKey, err := store.Identity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !have.Equal(cert) || !publicKeyMatches(cert, haveKey) {
+			t.Errorf("validity %s: stored identity not returned", validity)
+		}
+	}
+
+	other, err := newECKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(selfSignTest(t, other, time.Hour), key); err == nil {
+		t.Error("expected an error saving a certificate for another key")
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scepclient-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewFileStore(filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key"), WithKeyGenerator(newECKey))
+	testStore(t, store)
+
+	// without a generator new keys are like the stored one
+	store.keyGen = nil
+	key, err := store.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ec, ok := key.(*ecdsa.PrivateKey); !ok || ec.Curve != elliptic.P256() {
+		t.Errorf("have %T, want a P-256 key", key)
+	}
+}
+
+// fakeKeychain keeps identities in memory.
+type fakeKeychain struct {
+	keys  []crypto.Signer
+	certs map[string][]*x509.Certificate
+}
+
+func (k *fakeKeychain) GenerateKey(string) (crypto.Signer, error) {
+	key, err := newECKey()
+	k.keys = append(k.keys, key)
+	return key, err
+}
+
+func (k *fakeKeychain) AddCertificate(label string, cert *x509.Certificate) error {
+	k.certs[label] = append(k.certs[label], cert)
+	return nil
+}
+
+func (k *fakeKeychain) Identities(label string) ([]KeychainIdentity, error) {
+	var ids []KeychainIdentity
+	for _, cert := range k.certs[label] {
+		for _, key := range k.keys {
+			if publicKeyMatches(cert, key) {
+				ids = append(ids, KeychainIdentity{Certificate: cert, Key: key})
+			}
+		}
+	}
+	return ids, nil
+}
+
+func (k *fakeKeychain) DeleteCertificate(cert *x509.Certificate) error {
+	for label, certs := range k.certs {
+		for i, c := range certs {
+			if c.Equal(cert) {
+				k.certs[label] = append(certs[:i], certs[i+1:]...)
+				return nil
+			}
+		}
+	}
+	return errors.New("certificate not found")
+}
+
+func (k *fakeKeychain) DeleteKey(key crypto.Signer) error {
+	for i, have := range k.keys {
+		if have == key {
+			k.keys = append(k.keys[:i], k.keys[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("key not found")
+}
+
+func TestKeychainStore(t *testing.T) {
+	kc := &fakeKeychain{certs: make(map[string][]*x509.Certificate)}
+	testStore(t, NewKeychainStore(kc, "scep"))
+	if len(kc.certs["scep"]) != 1 || len(kc.keys) != 1 {
+		t.Errorf("have %d certificates and %d keys, want the renewed identity only", len(kc.certs["scep"]), len(kc.keys))
+	}
+
+	// a renewal with a new key deletes the old key
+	store := NewKeychainStore(kc, "scep")
+	key, err := store.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(selfSignTest(t, key, 3*time.Hour), key); err != nil {
+		t.Fatal(err)
+	}
+	if len(kc.keys) != 1 || kc.keys[0] != key {
+		t.Error("old key not deleted")
+	}
+}
+
+// fakeTPM wraps software keys in PKCS#8 blobs.
+type fakeTPM struct{}
+
+func (fakeTPM) CreateKey() ([]byte, error) {
+	key, err := newECKey()
+	if err != nil {
+		return nil, err
+	}
+	return x509.MarshalPKCS8PrivateKey(key)
+}
+
+func (fakeTPM) LoadKey(blob []byte) (crypto.Signer, error) {
+	key, err := x509.ParsePKCS8PrivateKey(blob)
+	if err != nil {
+		return nil, err
+	}
+	return key.(crypto.Signer), nil
+}
+
+func TestTPMStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scepclient-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := NewTPMStore(fakeTPM{}, filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.blob"))
+	testStore(t, store)
+
+	// keys not created by the store cannot be saved
+	other, err := newECKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Save(selfSignTest(t, other, time.Hour), other); err == nil {
+		t.Error("expected an error saving a foreign key")
+	}
+}
@@ -0,0 +1,115 @@
+package scepclient
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// TPM is the part of a TPM 2.0 used by TPMStore. The package does not link
+// a TPM library; callers implement TPM on top of the binding of their
+// choice, e.g. github.com/google/go-tpm.
+type TPM interface {
+	// CreateKey creates a signing key under the storage root key with
+	// TPM2_Create and returns its wrapped public and private area blob.
+	// The blob can only be loaded by the same TPM.
+	CreateKey() (blob []byte, err error)
+
+	// LoadKey loads blob with TPM2_Load and returns the key, signing with
+	// TPM2_Sign.
+	LoadKey(blob []byte) (crypto.Signer, error)
+}
+
+// TPMStore stores the identity as a certificate file and a key blob file
+// wrapped by a TPM, so that the private key never leaves the TPM.
+type TPMStore struct {
+	tpm      TPM
+	certPath string
+	blobPath string
+
+	mu      sync.Mutex
+	pending map[string][]byte // blobs by PKIX public key
+}
+
+// NewTPMStore returns a TPMStore for the PEM encoded certificate at
+// certPath and the TPM key blob at blobPath.
+func NewTPMStore(tpm TPM, certPath, blobPath string) *TPMStore {
+	return &TPMStore{
+		tpm:      tpm,
+		certPath: certPath,
+		blobPath: blobPath,
+		pending:  make(map[string][]byte),
+	}
+}
+
+// Identity implements Store.
+func (s *TPMStore) Identity() (*x509.Certificate, crypto.Signer, error) {
+	cert, err := readCertFile(s.certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	blob, err := ioutil.ReadFile(s.blobPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, ErrNoIdentity
+	} else if err != nil {
+		return nil, nil, err
+	}
+	key, err := s.tpm.LoadKey(blob)
+	if err != nil {
+		return nil, nil, fmt.Errorf("scepclient: loading TPM key: %w", err)
+	}
+	if !publicKeyMatches(cert, key) {
+		return nil, nil, fmt.Errorf("scepclient: %s is not for the TPM key of %s", s.certPath, s.blobPath)
+	}
+	return cert, key, nil
+}
+
+// NewKey implements Store. The blob of the key is kept in memory until its
+// certificate is saved.
+func (s *TPMStore) NewKey() (crypto.Signer, error) {
+	blob, err := s.tpm.CreateKey()
+	if err != nil {
+		return nil, fmt.Errorf("scepclient: creating TPM key: %w", err)
+	}
+	key, err := s.tpm.LoadKey(blob)
+	if err != nil {
+		return nil, fmt.Errorf("scepclient: loading TPM key: %w", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.pending[string(pub)] = blob
+	s.mu.Unlock()
+	return key, nil
+}
+
+// Save implements Store. key must have been returned by NewKey, or be the
+// stored key for renewals with the same key.
+func (s *TPMStore) Save(cert *x509.Certificate, key crypto.Signer) error {
+	if !publicKeyMatches(cert, key) {
+		return errors.New("scepclient: certificate is not for the key")
+	}
+	s.mu.Lock()
+	blob, ok := s.pending[string(cert.RawSubjectPublicKeyInfo)]
+	s.mu.Unlock()
+	if ok {
+		if err := writeFileAtomic(s.blobPath, blob, 0600); err != nil {
+			return err
+		}
+	} else if _, current, err := s.Identity(); err != nil || !publicKeyMatches(cert, current) {
+		return errors.New("scepclient: key was not created by the TPMStore")
+	}
+	if err := writeCertFile(s.certPath, cert); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.pending, string(cert.RawSubjectPublicKeyInfo))
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,147 @@
+package scepclient
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+)
+
+type tlsConfig struct {
+	base    *tls.Config
+	roots   *x509.CertPool
+	pins    []*x509.Certificate
+	getCert func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+}
+
+func (c *clientConfig) tlsConfig() *tlsConfig {
+	if c.tls == nil {
+		c.tls = &tlsConfig{}
+	}
+	return c.tls
+}
+
+// WithTLSConfig sets the TLS configuration of HTTPS requests. The other
+// TLS options are applied to a copy of cfg.
+func WithTLSConfig(cfg *tls.Config) ClientOption {
+	return func(c *clientConfig) error {
+		c.tlsConfig().base = cfg
+		return nil
+	}
+}
+
+// WithRootCAs verifies the server certificate with the roots of pool
+// instead of the system roots.
+func WithRootCAs(pool *x509.CertPool) ClientOption {
+	return func(c *clientConfig) error {
+		c.tlsConfig().roots = pool
+		return nil
+	}
+}
+
+// WithPinnedCertificates only trusts servers presenting one of certs, or a
+// certificate for the server name issued by one of certs. The root CAs are
+// then not consulted, so pinning works for self-signed servers.
+func WithPinnedCertificates(certs ...*x509.Certificate) ClientOption {
+	return func(c *clientConfig) error {
+		if len(certs) == 0 {
+			return errors.New("scepclient: no pinned certificates")
+		}
+		c.tlsConfig().pins = append(c.tlsConfig().pins, certs...)
+		return nil
+	}
+}
+
+// WithClientCertificate authenticates to the server with mutual TLS using
+// key and its certificate chain, leaf first, e.g. a bootstrap identity
+// provisioned with the device.
+func WithClientCertificate(key crypto.Signer, chain ...*x509.Certificate) ClientOption {
+	return func(c *clientConfig) error {
+		if len(chain) == 0 {
+			return errors.New("scepclient: no client certificate")
+		}
+		crt := &tls.Certificate{PrivateKey: key, Leaf: chain[0]}
+		for _, cert := range chain {
+			crt.Certificate = append(crt.Certificate, cert.Raw)
+		}
+		c.tlsConfig().getCert = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return crt, nil
+		}
+		return nil
+	}
+}
+
+// WithClientStore authenticates to the server with mutual TLS using the
+// identity of store, loaded for every handshake so that renewed
+// certificates are used right away. No certificate is sent while the store
+// has no identity.
+func WithClientStore(store Store) ClientOption {
+	return func(c *clientConfig) error {
+		c.tlsConfig().getCert = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, key, err := store.Identity()
+			if errors.Is(err, ErrNoIdentity) {
+				return &tls.Certificate{}, nil
+			} else if err != nil {
+				return nil, err
+			}
+			return &tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}, nil
+		}
+		return nil
+	}
+}
+
+func (c *tlsConfig) build(current *tls.Config) *tls.Config {
+	cfg := &tls.Config{}
+	if c.base != nil {
+		cfg = c.base.Clone()
+	} else if current != nil {
+		cfg = current.Clone()
+	}
+	if c.roots != nil {
+		cfg.RootCAs = c.roots
+	}
+	if c.getCert != nil {
+		cfg.GetClientCertificate = c.getCert
+	}
+	if len(c.pins) > 0 {
+		// the default verification is replaced by verifyPinned
+		cfg.InsecureSkipVerify = true
+		cfg.VerifyConnection = verifyPinned(c.pins)
+	}
+	return cfg
+}
+
+// verifyPinned returns a tls.Config VerifyConnection function accepting
+// the pinned certificates and certificates for the server name issued by
+// them.
+func verifyPinned(pins []*x509.Certificate) func(tls.ConnectionState) error {
+	roots := x509.NewCertPool()
+	for _, pin := range pins {
+		roots.AddCert(pin)
+	}
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("scepclient: server sent no certificate")
+		}
+		leaf := cs.PeerCertificates[0]
+		for _, pin := range pins {
+			if leaf.Equal(pin) {
+				return nil
+			}
+		}
+		intermediates := x509.NewCertPool()
+		for _, cert := range cs.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{
+			DNSName:       cs.ServerName,
+			Roots:         roots,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			return fmt.Errorf("scepclient: server certificate does not match the pinned certificates: %w", err)
+		}
+		return nil
+	}
+}
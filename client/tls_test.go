@@ -0,0 +1,65 @@
+package scepclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	stdlog "log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestClientTLS(t *testing.T) {
+	var peers int
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peers = len(r.TLS.PeerCertificates)
+		w.Write([]byte("POSTPKIOperation\nSCEPStandard"))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.Config.ErrorLog = stdlog.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	other, _ := newTestIdentity(t, true)
+	self, key := newTestIdentity(t, false)
+
+	for _, test := range []struct {
+		testName  string
+		opts      []ClientOption
+		wantErr   bool
+		wantPeers int
+	}{
+		{"system roots", nil, true, 0},
+		{"custom roots", []ClientOption{WithRootCAs(roots)}, false, 0},
+		{"pinned", []ClientOption{WithPinnedCertificates(srv.Certificate())}, false, 0},
+		{"pinned other", []ClientOption{WithPinnedCertificates(other)}, true, 0},
+		{"mutual TLS", []ClientOption{WithRootCAs(roots), WithClientCertificate(key, self)}, false, 1},
+	} {
+		t.Run(test.testName, func(t *testing.T) {
+			peers = 0
+			c, err := New(srv.URL, log.NewNopLogger(), test.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = c.GetCACaps(context.Background())
+			if test.wantErr {
+				if err == nil {
+					t.Error("expected a TLS error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if peers != test.wantPeers {
+				t.Errorf("server saw %d client certificates, want %d", peers, test.wantPeers)
+			}
+		})
+	}
+}
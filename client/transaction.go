@@ -0,0 +1,115 @@
+package scepclient
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// ErrTransactionMismatch is returned by Transaction when a message does not
+// belong to the transaction.
+var ErrTransactionMismatch = errors.New("scepclient: transactionID mismatch")
+
+// TransactionState is the state of a Transaction.
+type TransactionState int
+
+const (
+	// TransactionPending is the state while the request is unanswered or
+	// answered PENDING.
+	TransactionPending TransactionState = iota
+	// TransactionIssued is the state after a SUCCESS CertRep.
+	TransactionIssued
+	// TransactionFailed is the state after a FAILURE CertRep.
+	TransactionFailed
+)
+
+func (s TransactionState) String() string {
+	switch s {
+	case TransactionPending:
+		return "pending"
+	case TransactionIssued:
+		return "issued"
+	case TransactionFailed:
+		return "failed"
+	default:
+		return fmt.Sprintf("TransactionState(%d)", int(s))
+	}
+}
+
+// Transaction tracks the messages of a SCEP transaction across round-trips:
+// the enrollment request, the CertPoll requests sent while the CA answers
+// PENDING and their CertRep responses. All of them must carry the
+// transactionID of the original request.
+type Transaction struct {
+	req   *scep.PKIMessage
+	last  *scep.PKIMessage
+	rep   *scep.PKIMessage
+	state TransactionState
+}
+
+// NewTransaction starts tracking the transaction of the request req.
+func NewTransaction(req *scep.PKIMessage) *Transaction {
+	return &Transaction{req: req, last: req}
+}
+
+// ID returns the transactionID of the transaction.
+func (t *Transaction) ID() scep.TransactionID {
+	return t.req.TransactionID
+}
+
+// State returns the state of the transaction after the last response.
+func (t *Transaction) State() TransactionState {
+	return t.state
+}
+
+// Request returns the last request sent in the transaction, either the
+// original request or a later CertPoll.
+func (t *Transaction) Request() *scep.PKIMessage {
+	return t.last
+}
+
+// Response returns the last CertRep received in the transaction or nil.
+func (t *Transaction) Response() *scep.PKIMessage {
+	return t.rep
+}
+
+// Poll records poll, a CertPoll request, as the next request of the
+// transaction. Polling is only allowed while the transaction is pending.
+func (t *Transaction) Poll(poll *scep.PKIMessage) error {
+	if t.state != TransactionPending {
+		return fmt.Errorf("scepclient: CertPoll in %s transaction", t.state)
+	}
+	if poll.MessageType != scep.CertPoll {
+		return fmt.Errorf("scepclient: %s is not a CertPoll request", poll.MessageType)
+	}
+	if poll.TransactionID != t.ID() {
+		return fmt.Errorf("%w: CertPoll has %q, transaction %q", ErrTransactionMismatch, poll.TransactionID, t.ID())
+	}
+	t.last = poll
+	return nil
+}
+
+// Receive records the CertRep rep answering the last request and returns
+// the new state of the transaction.
+func (t *Transaction) Receive(rep *scep.PKIMessage) (TransactionState, error) {
+	if t.state != TransactionPending {
+		return t.state, fmt.Errorf("scepclient: CertRep in %s transaction", t.state)
+	}
+	if rep.CertRepMessage == nil {
+		return t.state, fmt.Errorf("scepclient: %s is not a CertRep", rep.MessageType)
+	}
+	if rep.TransactionID != t.ID() {
+		return t.state, fmt.Errorf("%w: CertRep has %q, transaction %q", ErrTransactionMismatch, rep.TransactionID, t.ID())
+	}
+	t.rep = rep
+	switch rep.PKIStatus {
+	case scep.SUCCESS:
+		t.state = TransactionIssued
+	case scep.FAILURE:
+		t.state = TransactionFailed
+	default:
+		t.state = TransactionPending
+	}
+	return t.state, nil
+}
@@ -0,0 +1,48 @@
+package scepclient
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+func TestTransaction(t *testing.T) {
+	req := &scep.PKIMessage{TransactionID: "t1", MessageType: scep.PKCSReq}
+	certRep := func(tID scep.TransactionID, status scep.PKIStatus) *scep.PKIMessage {
+		return &scep.PKIMessage{
+			TransactionID:  tID,
+			MessageType:    scep.CertRep,
+			CertRepMessage: &scep.CertRepMessage{PKIStatus: status},
+		}
+	}
+	tx := NewTransaction(req)
+
+	if _, err := tx.Receive(certRep("t2", scep.SUCCESS)); !errors.Is(err, ErrTransactionMismatch) {
+		t.Errorf("have %v, want %v", err, ErrTransactionMismatch)
+	}
+	if state, err := tx.Receive(certRep("t1", scep.PENDING)); err != nil || state != TransactionPending {
+		t.Fatalf("have state %s, err %v, want %s", state, err, TransactionPending)
+	}
+
+	if err := tx.Poll(&scep.PKIMessage{TransactionID: "t2", MessageType: scep.CertPoll}); !errors.Is(err, ErrTransactionMismatch) {
+		t.Errorf("have %v, want %v", err, ErrTransactionMismatch)
+	}
+	poll := &scep.PKIMessage{TransactionID: "t1", MessageType: scep.CertPoll}
+	if err := tx.Poll(poll); err != nil {
+		t.Fatal(err)
+	}
+	if tx.Request() != poll {
+		t.Error("CertPoll is not the last request")
+	}
+
+	if state, err := tx.Receive(certRep("t1", scep.SUCCESS)); err != nil || state != TransactionIssued {
+		t.Fatalf("have state %s, err %v, want %s", state, err, TransactionIssued)
+	}
+	if err := tx.Poll(poll); err == nil {
+		t.Error("expected error polling an issued transaction")
+	}
+	if _, err := tx.Receive(certRep("t1", scep.FAILURE)); err == nil {
+		t.Error("expected error receiving a CertRep for an issued transaction")
+	}
+}
@@ -0,0 +1,89 @@
+package scepclient
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// ErrUnverifiedFailure is returned by VerifyFailure when a FAILURE CertRep
+// cannot be attributed to the CA and the original request.
+var ErrUnverifiedFailure = errors.New("scepclient: unverified FAILURE response")
+
+// VerifyFailure checks that a FAILURE CertRep rep answers req before its
+// failInfo is treated as authoritative: the transactionID must match, the
+// recipientNonce must echo the senderNonce of req, and the message must be
+// signed by one of the trusted CA/RA certificates. Otherwise an attacker
+// could abort an enrollment with a spoofed FAILURE.
+func VerifyFailure(req, rep *scep.PKIMessage, trusted []*x509.Certificate) error {
+	return verifyFailure(req, rep, trusted, scep.Strict)
+}
+
+// verifyFailure is VerifyFailure, accepting a missing recipientNonce if s
+// is scep.Lenient.
+func verifyFailure(req, rep *scep.PKIMessage, trusted []*x509.Certificate, s scep.Strictness) error {
+	if rep.CertRepMessage == nil {
+		return fmt.Errorf("%w: not a CertRep message", ErrUnverifiedFailure)
+	}
+	if rep.TransactionID != req.TransactionID {
+		return fmt.Errorf("%w: transactionID %q does not match request %q",
+			ErrUnverifiedFailure, rep.TransactionID, req.TransactionID)
+	}
+	if !nonceMatches(req, rep, s) {
+		return fmt.Errorf("%w: recipientNonce does not match request senderNonce", ErrUnverifiedFailure)
+	}
+	if !isTrustedSigner(rep.SignerCert, trusted) {
+		return fmt.Errorf("%w: signer is not a trusted CA/RA certificate", ErrUnverifiedFailure)
+	}
+	return nil
+}
+
+// ErrNonceMismatch is returned by VerifyNonce when a CertRep does not
+// answer the request.
+var ErrNonceMismatch = errors.New("scepclient: CertRep does not answer request")
+
+// VerifyNonce checks that the CertRep rep answers req: the transactionID
+// must match and the recipientNonce must echo the senderNonce of req.
+func VerifyNonce(req, rep *scep.PKIMessage) error {
+	return verifyNonce(req, rep, scep.Strict)
+}
+
+// verifyNonce is VerifyNonce, accepting a missing recipientNonce if s is
+// scep.Lenient.
+func verifyNonce(req, rep *scep.PKIMessage, s scep.Strictness) error {
+	if rep.CertRepMessage == nil {
+		return fmt.Errorf("%w: not a CertRep message", ErrNonceMismatch)
+	}
+	if rep.TransactionID != req.TransactionID {
+		return fmt.Errorf("%w: transactionID %q does not match request %q",
+			ErrNonceMismatch, rep.TransactionID, req.TransactionID)
+	}
+	if !nonceMatches(req, rep, s) {
+		return fmt.Errorf("%w: recipientNonce does not match request senderNonce", ErrNonceMismatch)
+	}
+	return nil
+}
+
+// nonceMatches reports whether the recipientNonce of rep echoes the
+// senderNonce of req. NDES omits the recipientNonce, which is accepted if s
+// is scep.Lenient.
+func nonceMatches(req, rep *scep.PKIMessage, s scep.Strictness) bool {
+	if s == scep.Lenient && len(rep.RecipientNonce) == 0 {
+		return true
+	}
+	return len(req.SenderNonce) > 0 && rep.RecipientNonce.Matches(req.SenderNonce)
+}
+
+func isTrustedSigner(signer *x509.Certificate, trusted []*x509.Certificate) bool {
+	if signer == nil {
+		return false
+	}
+	for _, cert := range trusted {
+		if cert.Equal(signer) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+package scepclient
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/depot"
+	"github.com/micromdm/scep/v2/scep"
+)
+
+func TestVerifyFailure(t *testing.T) {
+	caCert, caKey := newTestIdentity(t, true)
+	attackerCert, attackerKey := newTestIdentity(t, true)
+	clientCert, clientKey := newTestIdentity(t, false)
+
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "client"},
+	}, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerCert:  clientCert,
+		SignerKey:   clientKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverMsg, err := scep.ParsePKIMessage(req.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failure := func(t *testing.T, crt *x509.Certificate, key *rsa.PrivateKey) *scep.PKIMessage {
+		rep, err := serverMsg.Fail(crt, key, scep.BadRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := scep.ParsePKIMessage(rep.Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+	trusted := []*x509.Certificate{caCert}
+
+	t.Run("authentic", func(t *testing.T) {
+		if err := VerifyFailure(req, failure(t, caCert, caKey), trusted); err != nil {
+			t.Fatal(err)
+		}
+	})
+	t.Run("wrong transactionID", func(t *testing.T) {
+		rep := failure(t, caCert, caKey)
+		rep.TransactionID = "spoofed"
+		if err := VerifyFailure(req, rep, trusted); err == nil {
+			t.Fatal("expected spoofed transactionID to be rejected")
+		}
+	})
+	t.Run("wrong recipientNonce", func(t *testing.T) {
+		rep := failure(t, caCert, caKey)
+		rep.RecipientNonce = scep.RecipientNonce("0123456789abcdef")
+		if err := VerifyFailure(req, rep, trusted); err == nil {
+			t.Fatal("expected spoofed recipientNonce to be rejected")
+		}
+	})
+	t.Run("untrusted signer", func(t *testing.T) {
+		rep := failure(t, attackerCert, attackerKey)
+		if err := VerifyFailure(req, rep, trusted); err == nil {
+			t.Fatal("expected untrusted signer to be rejected")
+		}
+	})
+}
+
+func TestVerifyNonce(t *testing.T) {
+	caCert, caKey := newTestIdentity(t, true)
+	csr, clientCert, clientKey := newTestClient(t)
+	tmpl := &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerCert:  clientCert,
+		SignerKey:   clientKey,
+	}
+	req, err := scep.NewCSRRequest(csr, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := scep.NewCSRRequest(csr, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := func(req *scep.PKIMessage) *scep.PKIMessage {
+		msg, err := scep.ParsePKIMessage(req.Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rep, err := msg.Pending(caCert, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg, err = scep.ParsePKIMessage(rep.Raw); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	if err := VerifyNonce(req, pending(req)); err != nil {
+		t.Error(err)
+	}
+	if err := VerifyNonce(req, pending(other)); !errors.Is(err, ErrNonceMismatch) {
+		t.Errorf("have %v, want %v", err, ErrNonceMismatch)
+	}
+
+	// NDES omits the recipientNonce
+	rep := pending(req)
+	rep.RecipientNonce = nil
+	if err := verifyNonce(req, rep, scep.Strict); !errors.Is(err, ErrNonceMismatch) {
+		t.Errorf("strict: have %v, want %v", err, ErrNonceMismatch)
+	}
+	if err := verifyNonce(req, rep, scep.Lenient); err != nil {
+		t.Errorf("lenient: %v", err)
+	}
+	if err := verifyNonce(req, pending(other), scep.Lenient); !errors.Is(err, ErrNonceMismatch) {
+		t.Errorf("lenient: have %v, want %v", err, ErrNonceMismatch)
+	}
+}
+
+func newTestIdentity(t *testing.T, ca bool) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var der []byte
+	if ca {
+		der, err = depot.NewCACert(
+			depot.WithCommonName("SCEP CA"),
+			depot.WithKeyUsage(x509.KeyUsageCertSign|x509.KeyUsageKeyEncipherment|x509.KeyUsageDigitalSignature),
+		).SelfSign(rand.Reader, &key.PublicKey, key)
+	} else {
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "SCEP SIGNER"},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		}
+		der, err = x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
@@ -1,17 +1,14 @@
 package main
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
-	"crypto/x509/pkix"
 	"encoding/pem"
 	"errors"
-	"fmt"
 	"io/ioutil"
-	"math/big"
 	"os"
-	"time"
+
+	scepclient "github.com/micromdm/scep/v2/client"
 )
 
 const (
@@ -28,7 +25,7 @@ func pemCert(derBytes []byte) []byte {
 	return out
 }
 
-func loadOrSign(path string, priv *rsa.PrivateKey, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+func loadOrSign(path string, priv crypto.Signer, csr *x509.CertificateRequest) (*x509.Certificate, error) {
 	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
 		if os.IsExist(err) {
@@ -37,7 +34,7 @@ func loadOrSign(path string, priv *rsa.PrivateKey, csr *x509.CertificateRequest)
 		return nil, err
 	}
 	defer file.Close()
-	self, err := selfSign(priv, csr)
+	self, err := scepclient.SelfSigned(csr, priv)
 	if err != nil {
 		return nil, err
 	}
@@ -52,36 +49,6 @@ func loadOrSign(path string, priv *rsa.PrivateKey, csr *x509.CertificateRequest)
 	return self, nil
 }
 
-func selfSign(priv *rsa.PrivateKey, csr *x509.CertificateRequest) (*x509.Certificate, error) {
-	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
-	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate serial number: %s", err)
-	}
-
-	notBefore := time.Now()
-	notAfter := notBefore.Add(time.Hour * 1)
-	template := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			CommonName:   "SCEP SIGNER",
-			Organization: csr.Subject.Organization,
-		},
-		NotBefore: notBefore,
-		NotAfter:  notAfter,
-
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
-		BasicConstraintsValid: true,
-	}
-
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
-	if err != nil {
-		return nil, err
-	}
-	return x509.ParseCertificate(derBytes)
-}
-
 func loadPEMCertFromFile(path string) (*x509.Certificate, error) {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
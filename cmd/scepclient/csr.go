@@ -1,14 +1,19 @@
 package main
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
+	"strings"
 
 	"github.com/micromdm/scep/v2/cryptoutil/x509util"
 )
@@ -19,7 +24,10 @@ const (
 
 type csrOptions struct {
 	cn, org, country, ou, locality, province, challenge string
-	key                                                 *rsa.PrivateKey
+	dnsNames, emailAddresses                            []string
+	ipAddresses                                         []net.IP
+	uris                                                []*url.URL
+	key                                                 crypto.Signer
 }
 
 func loadOrMakeCSR(path string, opts *csrOptions) (*x509.CertificateRequest, error) {
@@ -40,17 +48,22 @@ func loadOrMakeCSR(path string, opts *csrOptions) (*x509.CertificateRequest, err
 		Locality:           subjOrNil(opts.locality),
 		Country:            subjOrNil(opts.country),
 	}
-	template := x509util.CertificateRequest{
-		CertificateRequest: x509.CertificateRequest{
-			Subject:            subject,
-			SignatureAlgorithm: x509.SHA256WithRSA,
-		},
+	csrOpts := []x509util.CSROption{
+		x509util.WithChallengePassword(opts.challenge),
+		x509util.WithDNSNames(opts.dnsNames...),
+		x509util.WithEmailAddresses(opts.emailAddresses...),
+		x509util.WithIPAddresses(opts.ipAddresses...),
+		x509util.WithURIs(opts.uris...),
 	}
-	if opts.challenge != "" {
-		template.ChallengePassword = opts.challenge
+	// ECDSA keys use the default digest of their curve
+	if _, ok := opts.key.(*rsa.PrivateKey); ok {
+		csrOpts = append(csrOpts, x509util.WithSignatureAlgorithm(x509.SHA256WithRSA))
+	}
+	csr := x509util.NewCSR(subject, csrOpts...)
+	derBytes, err := csr.Create(rand.Reader, opts.key)
+	if err != nil {
+		return nil, err
 	}
-
-	derBytes, err := x509util.CreateCertificateRequest(rand.Reader, &template, opts.key)
 	pemBlock := &pem.Block{
 		Type:  csrPEMBlockType,
 		Bytes: derBytes,
@@ -61,6 +74,39 @@ func loadOrMakeCSR(path string, opts *csrOptions) (*x509.CertificateRequest, err
 	return x509.ParseCertificateRequest(derBytes)
 }
 
+// parseSANs returns the subjectAltNames of the comma separated lists of
+// the SAN flags.
+func parseSANs(dns, ips, emails, uris string, opts *csrOptions) error {
+	opts.dnsNames = splitList(dns)
+	opts.emailAddresses = splitList(emails)
+	for _, s := range splitList(ips) {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address %q", s)
+		}
+		opts.ipAddresses = append(opts.ipAddresses, ip)
+	}
+	for _, s := range splitList(uris) {
+		u, err := url.Parse(s)
+		if err != nil {
+			return fmt.Errorf("invalid URI %q: %w", s, err)
+		}
+		opts.uris = append(opts.uris, u)
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty elements.
+func splitList(list string) []string {
+	var out []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
 // returns nil or []string{input} to populate pkix.Name.Subject
 func subjOrNil(input string) []string {
 	if input == "" {
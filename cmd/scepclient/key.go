@@ -1,70 +1,130 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+
+	"github.com/micromdm/scep/v2/cryptoutil"
 )
 
 const (
 	rsaPrivateKeyPEMBlockType = "RSA PRIVATE KEY"
+	ecPrivateKeyPEMBlockType  = "EC PRIVATE KEY"
 )
 
-// create a new RSA private key
-func newRSAKey(bits int) (*rsa.PrivateKey, error) {
-	private, err := rsa.GenerateKey(rand.Reader, bits)
-	if err != nil {
-		return nil, err
+// keyOptions are the type and size of a new private key.
+type keyOptions struct {
+	keyType string // rsa or ecdsa
+	rsaBits int
+	curve   string // P-256, P-384 or P-521
+}
+
+// newKey creates a new private key and its PEM block.
+func newKey(opts keyOptions) (crypto.Signer, *pem.Block, error) {
+	switch opts.keyType {
+	case "rsa":
+		priv, err := rsa.GenerateKey(rand.Reader, opts.rsaBits)
+		if err != nil {
+			return nil, nil, err
+		}
+		return priv, &pem.Block{Type: rsaPrivateKeyPEMBlockType, Bytes: x509.MarshalPKCS1PrivateKey(priv)}, nil
+	case "ecdsa":
+		var curve elliptic.Curve
+		switch opts.curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, nil, fmt.Errorf("unknown curve %q, want P-256, P-384 or P-521", opts.curve)
+		}
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return nil, nil, err
+		}
+		return priv, &pem.Block{Type: ecPrivateKeyPEMBlockType, Bytes: der}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown key type %q, want rsa or ecdsa", opts.keyType)
 	}
-	return private, nil
 }
 
 // load key if it exists or create a new one
-func loadOrMakeKey(path string, rsaBits int) (*rsa.PrivateKey, error) {
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+func loadOrMakeKey(path string, opts keyOptions, password []byte) (crypto.Signer, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
 		if os.IsExist(err) {
-			return loadKeyFromFile(path)
+			return loadKeyFromFile(path, password)
 		}
 		return nil, err
 	}
 	defer file.Close()
 
 	// write key
-	priv, err := newRSAKey(rsaBits)
+	priv, pemBlock, err := newKey(opts)
 	if err != nil {
+		file.Close()
+		os.Remove(path)
 		return nil, err
 	}
-	privBytes := x509.MarshalPKCS1PrivateKey(priv)
-	pemBlock := &pem.Block{
-		Type:    rsaPrivateKeyPEMBlockType,
-		Headers: nil,
-		Bytes:   privBytes,
-	}
 	if err = pem.Encode(file, pemBlock); err != nil {
 		return nil, err
 	}
 	return priv, nil
 }
 
-// load a PEM private key from disk
-func loadKeyFromFile(path string) (*rsa.PrivateKey, error) {
+// load a PEM private key, which may be encrypted with password, from disk
+func loadKeyFromFile(path string, password []byte) (crypto.Signer, error) {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	pemBlock, _ := pem.Decode(data)
-	if pemBlock == nil {
-		return nil, errors.New("PEM decode failed")
+	key, err := cryptoutil.ParsePrivateKeyPEM(data, password)
+	if err != nil {
+		return nil, err
+	}
+	return supportedKey(key)
+}
+
+// load the private key and certificate of a PKCS#12 bundle from disk
+func loadPKCS12(path string, password []byte) (crypto.Signer, *x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
 	}
-	if pemBlock.Type != rsaPrivateKeyPEMBlockType {
-		return nil, errors.New("unmatched type or headers")
+
+	key, cert, _, err := cryptoutil.ParsePKCS12(data, string(password))
+	if err != nil {
+		return nil, nil, err
 	}
+	priv, err := supportedKey(key)
+	return priv, cert, err
+}
 
-	return x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+// supportedKey returns key if it is an RSA or ECDSA private key, the key
+// types the pkiEnvelope of CertRep messages can be decrypted with.
+func supportedKey(key interface{}) (crypto.Signer, error) {
+	switch priv := key.(type) {
+	case *rsa.PrivateKey:
+		return priv, nil
+	case *ecdsa.PrivateKey:
+		return priv, nil
+	default:
+		return nil, errors.New("only RSA and ECDSA private keys are supported")
+	}
 }
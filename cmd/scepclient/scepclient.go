@@ -35,7 +35,9 @@ type runCfg struct {
 	dir             string
 	csrPath         string
 	keyPath         string
-	keyBits         int
+	keyPassword     []byte
+	pkcs12Path      string
+	key             keyOptions
 	selfSignPath    string
 	certPath        string
 	cn              string
@@ -46,10 +48,27 @@ type runCfg struct {
 	country         string
 	challenge       string
 	serverURL       string
-	caCertsSelector scep.CertsSelector
+	caCertsSelector scep.CertsSelector // nil without -ca-fingerprint
 	debug           bool
 	logfmt          string
 	caCertMsg       string
+	nextCACertPath  string
+	strictness      scep.Strictness
+	sanDNS          string
+	sanIP           string
+	sanEmail        string
+	sanURI          string
+	chainPath       string
+	pollInterval    time.Duration
+	pollAttempts    int
+	tlsCAPath       string
+	tlsPinPath      string
+	tlsCertPath     string
+	tlsKeyPath      string
+	proxyURL        string
+	retries         int
+	oaep            bool
+	fips            bool
 }
 
 func run(cfg runCfg) error {
@@ -69,12 +88,24 @@ func run(cfg runCfg) error {
 	}
 	lginfo := level.Info(logger)
 
-	client, err := scepclient.New(cfg.serverURL, logger)
+	clientOpts, err := transportOptions(cfg)
+	if err != nil {
+		return err
+	}
+	client, err := scepclient.New(cfg.serverURL, logger, clientOpts...)
 	if err != nil {
 		return err
 	}
 
-	key, err := loadOrMakeKey(cfg.keyPath, cfg.keyBits)
+	var (
+		key  crypto.Signer
+		cert *x509.Certificate
+	)
+	if cfg.pkcs12Path != "" {
+		key, cert, err = loadPKCS12(cfg.pkcs12Path, cfg.keyPassword)
+	} else {
+		key, err = loadOrMakeKey(cfg.keyPath, cfg.key, cfg.keyPassword)
+	}
 	if err != nil {
 		return err
 	}
@@ -89,6 +120,9 @@ func run(cfg runCfg) error {
 		challenge: cfg.challenge,
 		key:       key,
 	}
+	if err := parseSANs(cfg.sanDNS, cfg.sanIP, cfg.sanEmail, cfg.sanURI, opts); err != nil {
+		return err
+	}
 
 	csr, err := loadOrMakeCSR(cfg.csrPath, opts)
 	if err != nil {
@@ -97,7 +131,9 @@ func run(cfg runCfg) error {
 	}
 
 	var self *x509.Certificate
-	cert, err := loadPEMCertFromFile(cfg.certPath)
+	if cert == nil {
+		cert, err = loadPEMCertFromFile(cfg.certPath)
+	}
 	if err != nil {
 		if !os.IsNotExist(err) {
 			return err
@@ -109,102 +145,61 @@ func run(cfg runCfg) error {
 		self = s
 	}
 
-	resp, certNum, err := client.GetCACert(ctx, cfg.caCertMsg)
+	certs, err := scepclient.GetCACerts(ctx, client, cfg.caCertMsg)
 	if err != nil {
 		return err
 	}
-	var certs []*x509.Certificate
-	{
-		if certNum > 1 {
-			certs, err = scep.CACerts(resp)
-			if err != nil {
-				return err
-			}
-		} else {
-			certs, err = x509.ParseCertificates(resp)
-			if err != nil {
-				return err
-			}
-		}
-	}
 
 	if cfg.debug {
 		logCerts(level.Debug(logger), certs)
 	}
 
-	var signerCert *x509.Certificate
-	{
-		if cert != nil {
-			signerCert = cert
-		} else {
-			signerCert = self
-		}
-	}
-
-	var msgType scep.MessageType
-	{
-		// TODO validate CA and set UpdateReq if needed
-		if cert != nil {
-			msgType = scep.RenewalReq
-		} else {
-			msgType = scep.PKCSReq
-		}
+	enrollOpts := []scepclient.EnrollOption{
+		scepclient.WithLogger(logger),
+		scepclient.WithCACerts(certs),
+		scepclient.WithStrictness(cfg.strictness),
+		scepclient.WithPoller(scepclient.NewPoller(
+			scepclient.WithBackoff(cfg.pollInterval, 10*time.Minute, 2),
+			scepclient.WithMaxAttempts(cfg.pollAttempts),
+		)),
 	}
-
-	tmpl := &scep.PKIMessage{
-		MessageType: msgType,
-		Recipients:  certs,
-		SignerKey:   key,
-		SignerCert:  signerCert,
+	if cfg.caCertsSelector != nil {
+		enrollOpts = append(enrollOpts, scepclient.WithMessageOptions(scep.WithCertsSelector(cfg.caCertsSelector)))
 	}
-
-	if cfg.challenge != "" && msgType == scep.PKCSReq {
-		tmpl.CSRReqMessage = &scep.CSRReqMessage{
-			ChallengePassword: cfg.challenge,
-		}
+	if cfg.oaep {
+		enrollOpts = append(enrollOpts, scepclient.WithKeyEncryptionScheme(scep.RSAOAEP))
 	}
-
-	msg, err := scep.NewCSRRequest(csr, tmpl, scep.WithLogger(logger), scep.WithCertsSelector(cfg.caCertsSelector))
-	if err != nil {
-		return errors.Wrap(err, "creating csr pkiMessage")
+	if cfg.fips {
+		enrollOpts = append(enrollOpts, scepclient.WithFIPS())
 	}
-
-	var respMsg *scep.PKIMessage
-
-	for {
-		// loop in case we get a PENDING response which requires
-		// a manual approval.
-
-		respBytes, err := client.PKIOperation(ctx, msg.Raw)
-		if err != nil {
-			return errors.Wrapf(err, "PKIOperation for %s", msgType)
-		}
-
-		respMsg, err = scep.ParsePKIMessage(respBytes, scep.WithLogger(logger), scep.WithCACerts(msg.Recipients))
-		if err != nil {
-			return errors.Wrapf(err, "parsing pkiMessage response %s", msgType)
-		}
-
-		switch respMsg.PKIStatus {
-		case scep.FAILURE:
-			return errors.Errorf("%s request failed, failInfo: %s", msgType, respMsg.FailInfo)
-		case scep.PENDING:
-			lginfo.Log("pkiStatus", "PENDING", "msg", "sleeping for 30 seconds, then trying again.")
-			time.Sleep(30 * time.Second)
-			continue
-		}
-		lginfo.Log("pkiStatus", "SUCCESS", "msg", "server returned a certificate.")
-		break // on scep.SUCCESS
+	// PENDING responses, e.g. waiting for manual approval, are polled for
+	// with CertPoll
+	var respCert *x509.Certificate
+	if cert != nil {
+		// TODO validate CA and set UpdateReq if needed
+		respCert, err = scepclient.Renew(ctx, client, csr, cert, key, enrollOpts...)
+	} else {
+		respCert, err = scepclient.Enroll(ctx, client, csr, self, key, enrollOpts...)
 	}
-
-	if err := respMsg.DecryptPKIEnvelope(signerCert, key); err != nil {
-		return errors.Wrapf(err, "decrypt pkiEnvelope, msgType: %s, status %s", msgType, respMsg.PKIStatus)
+	if err != nil {
+		return err
 	}
+	lginfo.Log("pkiStatus", "SUCCESS", "msg", "server returned a certificate.")
 
-	respCert := respMsg.CertRepMessage.Certificate
 	if err := ioutil.WriteFile(cfg.certPath, pemCert(respCert.Raw), 0666); err != nil {
 		return err
 	}
+	if cfg.chainPath != "" {
+		chain := pemCert(respCert.Raw)
+		for _, crt := range certs {
+			if crt.IsCA {
+				chain = append(chain, pemCert(crt.Raw)...)
+			}
+		}
+		if err := ioutil.WriteFile(cfg.chainPath, chain, 0666); err != nil {
+			return err
+		}
+	}
 
 	// remove self signer if used
 	if self != nil {
@@ -213,6 +208,25 @@ func run(cfg runCfg) error {
 		}
 	}
 
+	if cfg.nextCACertPath != "" && client.Supports(string(scep.CapGetNextCACert)) {
+		verifiers := certs
+		if cfg.caCertsSelector != nil {
+			verifiers = cfg.caCertsSelector.SelectCerts(certs)
+		}
+		next, err := scepclient.GetNextCACerts(ctx, client, verifiers)
+		if err != nil {
+			return errors.Wrap(err, "GetNextCACert")
+		}
+		var buf []byte
+		for _, crt := range next {
+			buf = append(buf, pemCert(crt.Raw)...)
+		}
+		if err := ioutil.WriteFile(cfg.nextCACertPath, buf, 0666); err != nil {
+			return err
+		}
+		lginfo.Log("msg", "stored next CA certificate", "path", cfg.nextCACertPath)
+	}
+
 	return nil
 }
 
@@ -234,10 +248,11 @@ func logCerts(logger log.Logger, certs []*x509.Certificate) {
 
 // validateFingerprint makes sure fingerprint looks like a hash.
 // We remove spaces and colons from fingerprint as it may come in various forms:
-//     e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855
-//     E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855
-//     e3b0c442 98fc1c14 9afbf4c8 996fb924 27ae41e4 649b934c a495991b 7852b855
-//     e3:b0:c4:42:98:fc:1c:14:9a:fb:f4:c8:99:6f:b9:24:27:ae:41:e4:64:9b:93:4c:a4:95:99:1b:78:52:b8:55
+//
+//	e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855
+//	E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855
+//	e3b0c442 98fc1c14 9afbf4c8 996fb924 27ae41e4 649b934c a495991b 7852b855
+//	e3:b0:c4:42:98:fc:1c:14:9a:fb:f4:c8:99:6f:b9:24:27:ae:41:e4:64:9b:93:4c:a4:95:99:1b:78:52:b8:55
 func validateFingerprint(fingerprint string) (hash []byte, err error) {
 	fingerprint = strings.NewReplacer(" ", "", ":", "").Replace(fingerprint)
 	hash, err = hex.DecodeString(fingerprint)
@@ -250,10 +265,13 @@ func validateFingerprint(fingerprint string) (hash []byte, err error) {
 	return
 }
 
-func validateFlags(keyPath, serverURL string) error {
-	if keyPath == "" {
+func validateFlags(keyPath, pkcs12Path, serverURL string) error {
+	if keyPath == "" && pkcs12Path == "" {
 		return errors.New("must specify private key path")
 	}
+	if keyPath != "" && pkcs12Path != "" {
+		return errors.New("must specify either private key or PKCS#12 path")
+	}
 	if serverURL == "" {
 		return errors.New("must specify server-url flag parameter")
 	}
@@ -270,20 +288,44 @@ func main() {
 		flServerURL         = flag.String("server-url", "", "SCEP server url")
 		flChallengePassword = flag.String("challenge", "", "enforce a challenge password")
 		flPKeyPath          = flag.String("private-key", "", "private key path, if there is no key, scepclient will create one")
+		flKeyPassword       = flag.String("key-password", "", "password of an encrypted private key or PKCS#12 bundle")
+		flPKCS12Path        = flag.String("pkcs12", "", "PKCS#12 bundle with the private key and certificate, instead of -private-key and -certificate")
 		flCertPath          = flag.String("certificate", "", "certificate path, if there is no key, scepclient will create one")
 		flKeySize           = flag.Int("keySize", 2048, "rsa key size")
+		flKeyType           = flag.String("key-type", "rsa", "type of a new private key: rsa or ecdsa")
+		flCurve             = flag.String("curve", "P-256", "curve of a new ecdsa private key: P-256, P-384 or P-521")
 		flOrg               = flag.String("organization", "scep-client", "organization for cert")
 		flCName             = flag.String("cn", "scepclient", "common name for certificate")
 		flOU                = flag.String("ou", "MDM", "organizational unit for certificate")
 		flLoc               = flag.String("locality", "", "locality for certificate")
 		flProvince          = flag.String("province", "", "province for certificate")
 		flCountry           = flag.String("country", "US", "country code in certificate")
+		flSANDNS            = flag.String("san-dns", "", "comma separated DNS names for the subjectAltName of the certificate")
+		flSANIP             = flag.String("san-ip", "", "comma separated IP addresses for the subjectAltName of the certificate")
+		flSANEmail          = flag.String("san-email", "", "comma separated email addresses for the subjectAltName of the certificate")
+		flSANURI            = flag.String("san-uri", "", "comma separated URIs for the subjectAltName of the certificate")
+		flChainPath         = flag.String("chain", "", "path to store the certificate followed by the CA certificates of the server")
+		flPollInterval      = flag.Duration("poll-interval", 30*time.Second, "time to wait before polling for a PENDING certificate, doubling up to 10 minutes")
+		flPollAttempts      = flag.Int("poll-attempts", 0, "number of requests before giving up on a PENDING certificate, 0 for no limit")
 		flCACertMessage     = flag.String("cacert-message", "", "message sent with GetCACert operation")
+		flNextCACertPath    = flag.String("next-ca-certificate", "", "path to store the next CA certificate at if the CA supports GetNextCACert")
 
 		// in case of multiple certificate authorities, we need to figure out who the recipient of the encrypted
 		// data is.
 		flCAFingerprint = flag.String("ca-fingerprint", "", "SHA-256 digest of CA certificate for NDES server. Note: Changed from MD5.")
 
+		flLenient = flag.Bool("lenient", false, "tolerate deviations of Microsoft NDES from RFC 8894")
+		flFIPS    = flag.Bool("fips", false, "restrict messages to FIPS-approved algorithms: RSA keys of 2048 bits or more, SHA-256 or stronger and AES")
+		flOAEP    = flag.Bool("oaep", false, "encrypt the request key with RSAES-OAEP instead of RSAES-PKCS1-v1_5 and require it in the response")
+
+		flTLSCA   = flag.String("tls-ca", "", "PEM file with the root CAs verifying an HTTPS server-url instead of the system roots")
+		flTLSPin  = flag.String("tls-pin", "", "PEM file with the pinned certificates an HTTPS server must present or be issued by")
+		flTLSCert = flag.String("tls-cert", "", "PEM certificate chain of the bootstrap identity authenticating to the server with mutual TLS")
+		flTLSKey  = flag.String("tls-key", "", "private key of the bootstrap identity, decrypted with -key-password")
+
+		flProxy   = flag.String("proxy", "", "HTTP proxy URL, instead of the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables")
+		flRetries = flag.Int("retries", 3, "number of times a failed request is retried with exponential backoff")
+
 		flDebugLogging = flag.Bool("debug", false, "enable debug logging")
 		flLogJSON      = flag.Bool("log-json", false, "use JSON for log output")
 	)
@@ -295,12 +337,12 @@ func main() {
 		os.Exit(0)
 	}
 
-	if err := validateFlags(*flPKeyPath, *flServerURL); err != nil {
+	if err := validateFlags(*flPKeyPath, *flPKCS12Path, *flServerURL); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
 
-	caCertsSelector := scep.NopCertsSelector()
+	var caCertsSelector scep.CertsSelector
 	if *flCAFingerprint != "" {
 		hash, err := validateFingerprint(*flCAFingerprint)
 		if err != nil {
@@ -310,7 +352,11 @@ func main() {
 		caCertsSelector = scep.FingerprintCertsSelector(fingerprintHashType, hash)
 	}
 
-	dir := filepath.Dir(*flPKeyPath)
+	keyPath := *flPKeyPath
+	if keyPath == "" {
+		keyPath = *flPKCS12Path
+	}
+	dir := filepath.Dir(keyPath)
 	csrPath := dir + "/csr.pem"
 	selfSignPath := dir + "/self.pem"
 	if *flCertPath == "" {
@@ -320,12 +366,18 @@ func main() {
 	if *flLogJSON {
 		logfmt = "json"
 	}
+	strictness := scep.Strict
+	if *flLenient {
+		strictness = scep.Lenient
+	}
 
 	cfg := runCfg{
 		dir:             dir,
 		csrPath:         csrPath,
 		keyPath:         *flPKeyPath,
-		keyBits:         *flKeySize,
+		keyPassword:     []byte(*flKeyPassword),
+		pkcs12Path:      *flPKCS12Path,
+		key:             keyOptions{keyType: *flKeyType, rsaBits: *flKeySize, curve: *flCurve},
 		selfSignPath:    selfSignPath,
 		certPath:        *flCertPath,
 		cn:              *flCName,
@@ -340,6 +392,23 @@ func main() {
 		debug:           *flDebugLogging,
 		logfmt:          logfmt,
 		caCertMsg:       *flCACertMessage,
+		nextCACertPath:  *flNextCACertPath,
+		strictness:      strictness,
+		sanDNS:          *flSANDNS,
+		sanIP:           *flSANIP,
+		sanEmail:        *flSANEmail,
+		sanURI:          *flSANURI,
+		chainPath:       *flChainPath,
+		pollInterval:    *flPollInterval,
+		pollAttempts:    *flPollAttempts,
+		tlsCAPath:       *flTLSCA,
+		tlsPinPath:      *flTLSPin,
+		tlsCertPath:     *flTLSCert,
+		tlsKeyPath:      *flTLSKey,
+		proxyURL:        *flProxy,
+		retries:         *flRetries,
+		oaep:            *flOAEP,
+		fips:            *flFIPS,
 	}
 
 	if err := run(cfg); err != nil {
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	scepclient "github.com/micromdm/scep/v2/client"
+	"github.com/micromdm/scep/v2/cryptoutil"
+)
+
+// transportOptions returns the client options for the TLS, proxy and retry
+// flags of cfg.
+func transportOptions(cfg runCfg) ([]scepclient.ClientOption, error) {
+	var opts []scepclient.ClientOption
+	if cfg.proxyURL != "" {
+		u, err := url.Parse(cfg.proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("parsing -proxy: %w", err)
+		}
+		opts = append(opts, scepclient.WithProxy(http.ProxyURL(u)))
+	}
+	if cfg.retries > 0 {
+		opts = append(opts, scepclient.WithRetry(cfg.retries, time.Second, 30*time.Second))
+	}
+	if cfg.tlsCAPath != "" {
+		certs, err := loadPEMCerts(cfg.tlsCAPath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		for _, cert := range certs {
+			pool.AddCert(cert)
+		}
+		opts = append(opts, scepclient.WithRootCAs(pool))
+	}
+	if cfg.tlsPinPath != "" {
+		certs, err := loadPEMCerts(cfg.tlsPinPath)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, scepclient.WithPinnedCertificates(certs...))
+	}
+	if cfg.tlsCertPath != "" || cfg.tlsKeyPath != "" {
+		if cfg.tlsCertPath == "" || cfg.tlsKeyPath == "" {
+			return nil, errors.New("-tls-cert and -tls-key must be used together")
+		}
+		chain, err := loadPEMCerts(cfg.tlsCertPath)
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadFile(cfg.tlsKeyPath)
+		if err != nil {
+			return nil, err
+		}
+		key, err := cryptoutil.ParsePrivateKeyPEM(data, cfg.keyPassword)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", cfg.tlsKeyPath, err)
+		}
+		opts = append(opts, scepclient.WithClientCertificate(key, chain...))
+	}
+	return opts, nil
+}
+
+// loadPEMCerts reads all the PEM certificates of the file at path.
+func loadPEMCerts(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM certificates in %s", path)
+	}
+	return certs, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	executablechallenge "github.com/micromdm/scep/v2/challenge/executable"
+	ldapchallenge "github.com/micromdm/scep/v2/challenge/ldap"
+	webhookchallenge "github.com/micromdm/scep/v2/challenge/webhook"
+	scepserver "github.com/micromdm/scep/v2/server"
+)
+
+// challengeSourceConfig selects the scepserver.ChallengeValidator of the
+// -challenge-source file or of a profile.
+type challengeSourceConfig struct {
+	// Type is static, ldap, http or exec.
+	Type string `json:"type"`
+	// Secret is the challenge of the static type.
+	Secret string `json:"secret,omitempty"`
+	// URL is the ldap:// or ldaps:// directory of the ldap type or the
+	// endpoint of the http type.
+	URL string `json:"url,omitempty"`
+	// StartTLS upgrades ldap:// connections of the ldap type to TLS,
+	// which they require.
+	StartTLS bool `json:"start_tls,omitempty"`
+	// Headers are set on the requests of the http type, e.g.
+	// Authorization.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Path is the executable of the exec type.
+	Path string `json:"path,omitempty"`
+	// UserDN validates challenges of the ldap type as the password of
+	// this user, with {cn} replaced by the common name of the CSR.
+	UserDN string `json:"user_dn,omitempty"`
+	// BindDN, BindPassword, BaseDN, SearchAttribute and
+	// ChallengeAttribute validate challenges of the ldap type against an
+	// attribute of the entry of the common name instead.
+	BindDN             string `json:"bind_dn,omitempty"`
+	BindPassword       string `json:"bind_password,omitempty"`
+	BaseDN             string `json:"base_dn,omitempty"`
+	SearchAttribute    string `json:"search_attribute,omitempty"`
+	ChallengeAttribute string `json:"challenge_attribute,omitempty"`
+	// Timeout of the ldap, http and exec types, e.g. "10s".
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// loadChallengeSource reads the challengeSourceConfig at path.
+func loadChallengeSource(path string) (*challengeSourceConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	var conf challengeSourceConfig
+	if err := dec.Decode(&conf); err != nil {
+		return nil, fmt.Errorf("decode challenge source: %w", err)
+	}
+	return &conf, nil
+}
+
+// validator returns the ChallengeValidator of the source.
+func (c *challengeSourceConfig) validator(logger log.Logger) (scepserver.ChallengeValidator, error) {
+	var timeout time.Duration
+	if c.Timeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(c.Timeout); err != nil {
+			return nil, fmt.Errorf("challenge source timeout: %w", err)
+		}
+	}
+	switch c.Type {
+	case "static":
+		if c.Secret == "" {
+			return nil, fmt.Errorf("static challenge source requires a secret")
+		}
+		return scepserver.StaticChallenge(c.Secret), nil
+	case "ldap":
+		var opts []ldapchallenge.Option
+		if c.UserDN != "" {
+			opts = append(opts, ldapchallenge.WithUserBind(c.UserDN))
+		}
+		if c.SearchAttribute != "" {
+			opts = append(opts, ldapchallenge.WithAttributeLookup(c.BindDN, c.BindPassword, c.BaseDN, c.SearchAttribute, c.ChallengeAttribute))
+		}
+		if c.StartTLS {
+			opts = append(opts, ldapchallenge.WithStartTLS())
+		}
+		if timeout > 0 {
+			opts = append(opts, ldapchallenge.WithTimeout(timeout))
+		}
+		return ldapchallenge.New(c.URL, logger, opts...)
+	case "http":
+		var opts []webhookchallenge.Option
+		for key, value := range c.Headers {
+			opts = append(opts, webhookchallenge.WithHeader(key, value))
+		}
+		if timeout > 0 {
+			opts = append(opts, webhookchallenge.WithHTTPClient(&http.Client{Timeout: timeout}))
+		}
+		return webhookchallenge.New(c.URL, logger, opts...)
+	case "exec":
+		var opts []executablechallenge.Option
+		if timeout > 0 {
+			opts = append(opts, executablechallenge.WithTimeout(timeout))
+		}
+		return executablechallenge.New(c.Path, logger, opts...)
+	default:
+		return nil, fmt.Errorf("unknown challenge source type %q, want static, ldap, http or exec", c.Type)
+	}
+}
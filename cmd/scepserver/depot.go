@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/micromdm/scep/v2/cryptoutil"
+	scepdepot "github.com/micromdm/scep/v2/depot"
+	boltdepot "github.com/micromdm/scep/v2/depot/bolt"
+	"github.com/micromdm/scep/v2/depot/file"
+
+	"github.com/boltdb/bolt"
+)
+
+// settings of the CA created with -init-ca, like the ca -init defaults
+const (
+	initCAKeySize = 4096
+	initCAYears   = 10
+	initCAOrg     = "scep-ca"
+	initCAOrgUnit = "SCEP CA"
+	initCACountry = "US"
+)
+
+// openDepot opens the depot of type typ at path, creating a missing file
+// depot folder if create is true.
+func openDepot(typ, path string, create bool) (scepdepot.Depot, error) {
+	switch typ {
+	case "file":
+		if create {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return nil, err
+			}
+		}
+		return file.NewFileDepot(path)
+	case "bolt":
+		db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+		if err != nil {
+			return nil, fmt.Errorf("opening bolt depot %s: %w", path, err)
+		}
+		return boltdepot.NewBoltDepot(db)
+	default:
+		return nil, fmt.Errorf("unknown depot type %q, want file or bolt", typ)
+	}
+}
+
+// initCA creates a self-signed CA in the depot unless it already has one.
+// The key of a file depot is encrypted with pass, bolt depots store it
+// unencrypted.
+func initCA(depot scepdepot.Depot, path string, pass []byte) error {
+	if d, ok := depot.(*boltdepot.Depot); ok {
+		key, err := d.CreateOrLoadKey(initCAKeySize)
+		if err != nil {
+			return err
+		}
+		_, err = d.CreateOrLoadCA(key, initCAYears, initCAOrg, initCACountry)
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(path, "ca.pem")); err == nil {
+		return nil
+	}
+	store, ok := depot.(scepdepot.CAStore)
+	if !ok {
+		return errors.New("depot cannot store a CA")
+	}
+	key, err := scepdepot.GenerateKey(rand.Reader, "rsa", initCAKeySize)
+	if err != nil {
+		return err
+	}
+	_, err = scepdepot.InitCA(rand.Reader, store, scepdepot.NewCACert(
+		scepdepot.WithYears(initCAYears),
+		scepdepot.WithOrganization(initCAOrg),
+		scepdepot.WithOrganizationalUnit(initCAOrgUnit),
+		scepdepot.WithCountry(initCACountry),
+	), key, pass)
+	return err
+}
+
+// caCeremony are the settings of a CA created with ca -init.
+type caCeremony struct {
+	depotType, depotPath string
+	keyType              string // rsa or ecdsa
+	rsaBits              int
+	curve                string // P-256, P-384 or P-521
+	password             []byte
+	keyUsage             string // comma separated names of keyUsages
+	csrPath              string // write a CSR instead of self-signing if set
+	certOpts             []scepdepot.CACertOption
+}
+
+// initCACeremony creates the key of a new CA and either stores it with a
+// self-signed certificate in the depot, or writes it to the ca.key of a
+// file depot and a CSR for an external CA to c.csrPath.
+func initCACeremony(c caCeremony) error {
+	size := c.rsaBits
+	if c.keyType == "ecdsa" {
+		bits, err := curveBits(c.curve)
+		if err != nil {
+			return err
+		}
+		size = bits
+	}
+	usage, err := parseKeyUsage(c.keyUsage)
+	if err != nil {
+		return err
+	}
+	cert := scepdepot.NewCACert(append(c.certOpts, scepdepot.WithKeyUsage(usage))...)
+	if c.csrPath != "" && c.depotType != "file" {
+		return errors.New("-csr requires a file depot")
+	}
+	depot, err := openDepot(c.depotType, c.depotPath, true)
+	if err != nil {
+		return err
+	}
+	key, err := scepdepot.GenerateKey(rand.Reader, c.keyType, size)
+	if err != nil {
+		return err
+	}
+	if c.csrPath == "" {
+		store, ok := depot.(scepdepot.CAStore)
+		if !ok {
+			return errors.New("depot cannot store a CA")
+		}
+		_, err := scepdepot.InitCA(rand.Reader, store, cert, key, c.password)
+		return err
+	}
+
+	csr, err := cert.CreateCSR(rand.Reader, key)
+	if err != nil {
+		return err
+	}
+	block, err := cryptoutil.MarshalPrivateKeyPEM(key, c.password)
+	if err != nil {
+		return err
+	}
+	keyPath := filepath.Join(c.depotPath, "ca.key")
+	f, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := pem.Encode(f, block); err != nil {
+		os.Remove(keyPath)
+		return err
+	}
+	csrPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csr})
+	if err := ioutil.WriteFile(c.csrPath, csrPEM, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s, store the signed CA certificate at %s\n", c.csrPath, filepath.Join(c.depotPath, "ca.pem"))
+	return nil
+}
+
+// curveBits returns the key size of the NIST curve name.
+func curveBits(name string) (int, error) {
+	switch name {
+	case "P-256":
+		return 256, nil
+	case "P-384":
+		return 384, nil
+	case "P-521":
+		return 521, nil
+	}
+	return 0, fmt.Errorf("unknown curve %q, want P-256, P-384 or P-521", name)
+}
+
+var keyUsages = map[string]x509.KeyUsage{
+	"digitalSignature":  x509.KeyUsageDigitalSignature,
+	"contentCommitment": x509.KeyUsageContentCommitment,
+	"keyEncipherment":   x509.KeyUsageKeyEncipherment,
+	"dataEncipherment":  x509.KeyUsageDataEncipherment,
+	"keyAgreement":      x509.KeyUsageKeyAgreement,
+	"certSign":          x509.KeyUsageCertSign,
+	"crlSign":           x509.KeyUsageCRLSign,
+}
+
+// parseKeyUsage returns the key usages of the comma separated list of
+// RFC 5280 names.
+func parseKeyUsage(list string) (x509.KeyUsage, error) {
+	var usage x509.KeyUsage
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		u, ok := keyUsages[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown key usage %q", name)
+		}
+		usage |= u
+	}
+	return usage, nil
+}
+
+// loadCA returns the CA certificate and key of the PEM files at certPath
+// and keyPath, or of the depot if both are empty.
+func loadCA(depot scepdepot.Depot, certPath, keyPath string, pass []byte) ([]*x509.Certificate, crypto.Signer, error) {
+	if certPath == "" && keyPath == "" {
+		crts, key, err := depot.CA(pass)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(crts) < 1 {
+			return nil, nil, errors.New("missing CA certificate")
+		}
+		return crts, key, nil
+	}
+	if certPath == "" || keyPath == "" {
+		return nil, nil, errors.New("-ca-cert and -ca-key must be used together")
+	}
+	crts, err := loadPEMCerts(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := cryptoutil.ParsePrivateKeyPEM(data, pass)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing %s: %w", keyPath, err)
+	}
+	if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(crts[0].PublicKey) {
+		return nil, nil, fmt.Errorf("%s is not the key of the CA certificate in %s", keyPath, certPath)
+	}
+	return crts, key, nil
+}
+
+// loadRAEncryption returns the RA encryption certificate of the PEM file at
+// certPath and its private key of the PEM file at keyPath.
+func loadRAEncryption(certPath, keyPath string, pass []byte) (*x509.Certificate, crypto.Signer, error) {
+	if certPath == "" || keyPath == "" {
+		return nil, nil, errors.New("-ra-encryption-cert and -ra-encryption-key must be used together")
+	}
+	crts, err := loadPEMCerts(certPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := cryptoutil.ParsePrivateKeyPEM(data, pass)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing %s: %w", keyPath, err)
+	}
+	if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(crts[0].PublicKey) {
+		return nil, nil, fmt.Errorf("%s is not the key of the certificate in %s", keyPath, certPath)
+	}
+	return crts[0], key, nil
+}
+
+// loadIssuanceLogKey returns the private key of the PEM file at path, which
+// must not be the key of the CA.
+func loadIssuanceLogKey(path string, caKey crypto.Signer) (crypto.Signer, error) {
+	if path == "" {
+		return nil, errors.New("-issuance-log requires -issuance-log-key")
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := cryptoutil.ParsePrivateKeyPEM(data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); ok && pub.Equal(caKey.Public()) {
+		return nil, fmt.Errorf("%s is the key of the CA, the issuance log needs a key of its own", path)
+	}
+	return key, nil
+}
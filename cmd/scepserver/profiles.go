@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/micromdm/scep/v2/challenge"
+	"github.com/micromdm/scep/v2/cryptoutil/x509util"
+	scepdepot "github.com/micromdm/scep/v2/depot"
+	scepserver "github.com/micromdm/scep/v2/server"
+)
+
+// profileConfig is an enrollment profile of the -profiles file, served at
+// /scep/<name> with its own certificate template, signing policy and
+// challenge. The CA, depot, CSR verifiers and service flags are shared with
+// /scep.
+type profileConfig struct {
+	// ValidityDays is the validity of the certificates in days, -crtvalid
+	// by default.
+	ValidityDays int `json:"validity_days,omitempty"`
+	// KeyUsage and ExtKeyUsage are the RFC 5280 names of the key usages of
+	// the certificates, digitalSignature and clientAuth by default. Extended
+	// key usages may also be smartcardLogon or OIDs.
+	KeyUsage    []string `json:"key_usage,omitempty"`
+	ExtKeyUsage []string `json:"ext_key_usage,omitempty"`
+	// CertTemplate rewrites the subject and SANs of the certificates,
+	// like -cert-template.
+	CertTemplate *scepdepot.RewriteConfig `json:"cert_template,omitempty"`
+	// Policy constrains the CSRs signed, like -signing-policy.
+	Policy *scepserver.PolicyConfig `json:"policy,omitempty"`
+	// Challenge is a static challenge password, like -challenge.
+	Challenge string `json:"challenge,omitempty"`
+	// ChallengeAPIKey enforces one-time challenges minted at
+	// /challenge/<name> with this API key, like -challenge-api-key.
+	ChallengeAPIKey string `json:"challenge_api_key,omitempty"`
+	// ChallengeIdentity only accepts one-time challenges bound to the
+	// exact subject and SANs of the CSR, like -challenge-identity.
+	ChallengeIdentity bool `json:"challenge_identity,omitempty"`
+	// ChallengeSource validates challenges with a static secret, an LDAP
+	// directory, an HTTP endpoint or an executable, like
+	// -challenge-source.
+	ChallengeSource *challengeSourceConfig `json:"challenge_source,omitempty"`
+}
+
+var profileName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// loadProfiles reads the JSON object of profileConfigs by name at path.
+// Unknown fields are rejected like in signing policies.
+func loadProfiles(path string) (map[string]profileConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	var profiles map[string]profileConfig
+	if err := dec.Decode(&profiles); err != nil {
+		return nil, fmt.Errorf("decode profiles: %w", err)
+	}
+	for name, p := range profiles {
+		if !profileName.MatchString(name) {
+			return nil, fmt.Errorf("profile name %q must only contain letters, digits, - and _", name)
+		}
+		if p.Challenge != "" && p.ChallengeAPIKey != "" {
+			return nil, fmt.Errorf("profile %s: challenge and challenge_api_key are mutually exclusive", name)
+		}
+		if p.ChallengeSource != nil && (p.Challenge != "" || p.ChallengeAPIKey != "") {
+			return nil, fmt.Errorf("profile %s: challenge_source, challenge and challenge_api_key are mutually exclusive", name)
+		}
+		if p.ChallengeIdentity && p.ChallengeAPIKey == "" {
+			return nil, fmt.Errorf("profile %s: challenge_identity requires challenge_api_key", name)
+		}
+	}
+	return profiles, nil
+}
+
+// signer returns the CSRSigner of the profile, signing with the depot signer
+// of opts, and its one-time challenge store if it has one. logger logs the
+// challenges rejected by its challenge source.
+func (p profileConfig) signer(depot scepdepot.Depot, challengeTTL time.Duration, logger log.Logger, opts ...scepdepot.Option) (scepserver.CSRSigner, *challenge.HMACStore, error) {
+	usage, err := parseKeyUsage(strings.Join(p.KeyUsage, ","))
+	if err != nil {
+		return nil, nil, err
+	}
+	extUsage, extOIDs, err := x509util.ParseExtKeyUsage(p.ExtKeyUsage)
+	if err != nil {
+		return nil, nil, err
+	}
+	if usage == 0 {
+		usage = x509.KeyUsageDigitalSignature
+	}
+	if len(extUsage) == 0 && len(extOIDs) == 0 {
+		extUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	opts = append(opts[:len(opts):len(opts)], scepdepot.WithTemplateOptions(
+		scepdepot.WithUsage(usage, extUsage...),
+		scepdepot.WithExtKeyUsageOIDs(extOIDs...),
+	))
+	if p.ValidityDays > 0 {
+		opts = append(opts, scepdepot.WithValidityDays(p.ValidityDays))
+	}
+	if p.CertTemplate != nil {
+		rewrite, err := scepdepot.NewRewrite(*p.CertTemplate)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, scepdepot.WithRewrite(rewrite))
+	}
+	var signer scepserver.CSRSigner = scepdepot.NewSigner(depot, opts...)
+	if p.Policy != nil {
+		policy, err := scepserver.NewPolicy(*p.Policy)
+		if err != nil {
+			return nil, nil, err
+		}
+		signer = scepserver.PolicyMiddleware(policy, signer)
+	}
+	if p.Challenge != "" {
+		signer = scepserver.ChallengeMiddleware(p.Challenge, signer)
+	}
+	if p.ChallengeSource != nil {
+		validator, err := p.ChallengeSource.validator(logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		signer = scepserver.ChallengeValidatorMiddleware(validator, signer)
+	}
+	var store *challenge.HMACStore
+	if p.ChallengeAPIKey != "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, nil, err
+		}
+		var challengeOpts []challenge.HMACOption
+		if p.ChallengeIdentity {
+			challengeOpts = append(challengeOpts, challenge.RequireIdentity())
+		}
+		if store, err = challenge.NewHMACStore(key, challengeTTL, challengeOpts...); err != nil {
+			return nil, nil, err
+		}
+		signer = challenge.Middleware(store, signer)
+	}
+	return signer, store, nil
+}
@@ -1,24 +1,46 @@
 package main
 
 import (
+	"context"
+	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/pem"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/micromdm/scep/v2/challenge"
+	scepclient "github.com/micromdm/scep/v2/client"
+	"github.com/micromdm/scep/v2/cryptoutil"
+	acmecsrsigner "github.com/micromdm/scep/v2/csrsigner/acme"
+	cmpcsrsigner "github.com/micromdm/scep/v2/csrsigner/cmp"
+	upstreamcsrsigner "github.com/micromdm/scep/v2/csrsigner/upstream"
+	vaultcsrsigner "github.com/micromdm/scep/v2/csrsigner/vault"
 	"github.com/micromdm/scep/v2/csrverifier"
 	executablecsrverifier "github.com/micromdm/scep/v2/csrverifier/executable"
+	webhookcsrverifier "github.com/micromdm/scep/v2/csrverifier/webhook"
 	scepdepot "github.com/micromdm/scep/v2/depot"
 	"github.com/micromdm/scep/v2/depot/file"
+	"github.com/micromdm/scep/v2/depot/issuancelog"
+	kafkaevent "github.com/micromdm/scep/v2/event/kafka"
+	natsevent "github.com/micromdm/scep/v2/event/nats"
+	webhookevent "github.com/micromdm/scep/v2/event/webhook"
+	"github.com/micromdm/scep/v2/metrics/prometheus"
+	"github.com/micromdm/scep/v2/scep"
 	scepserver "github.com/micromdm/scep/v2/server"
+	"github.com/micromdm/scep/v2/ui"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
@@ -31,12 +53,27 @@ var (
 
 func main() {
 	var caCMD = flag.NewFlagSet("ca", flag.ExitOnError)
+	var revokeCMD = flag.NewFlagSet("revoke", flag.ExitOnError)
+	var serialCMD = flag.NewFlagSet("serial", flag.ExitOnError)
+	var inspectCMD = flag.NewFlagSet("inspect", flag.ExitOnError)
 	{
 		if len(os.Args) >= 2 {
 			if os.Args[1] == "ca" {
 				status := caMain(caCMD)
 				os.Exit(status)
 			}
+			if os.Args[1] == "revoke" {
+				status := revokeMain(revokeCMD)
+				os.Exit(status)
+			}
+			if os.Args[1] == "serial" {
+				status := serialMain(serialCMD)
+				os.Exit(status)
+			}
+			if os.Args[1] == "inspect" {
+				status := inspectMain(inspectCMD)
+				os.Exit(status)
+			}
 		}
 	}
 
@@ -44,20 +81,88 @@ func main() {
 	var (
 		flVersion           = flag.Bool("version", false, "prints version information")
 		flPort              = flag.String("port", envString("SCEP_HTTP_LISTEN_PORT", "8080"), "port to listen on")
+		flListen            = flag.String("listen", envString("SCEP_HTTP_LISTEN_ADDR", ""), "address to listen on, e.g. 127.0.0.1:8080, instead of all interfaces on -port")
 		flDepotPath         = flag.String("depot", envString("SCEP_FILE_DEPOT", "depot"), "path to ca folder")
+		flDepotType         = flag.String("depot-type", envString("SCEP_DEPOT_TYPE", "file"), "depot backend: file for a folder at -depot or bolt for a BoltDB file at -depot")
+		flDepotCacheTTL     = flag.Duration("depot-cache-ttl", envDuration("SCEP_DEPOT_CACHE_TTL", 0), "cache the CA, certificate lookups and certificate and revocation lists of the depot for this duration, 0 to disable")
 		flCAPass            = flag.String("capass", envString("SCEP_CA_PASS", ""), "passwd for the ca.key")
+		flCACert            = flag.String("ca-cert", envString("SCEP_CA_CERT", ""), "PEM file with the CA certificate, instead of the CA of the depot")
+		flCAKey             = flag.String("ca-key", envString("SCEP_CA_KEY", ""), "PEM file with the CA private key, decrypted with -capass")
+		flInitCA            = flag.Bool("init-ca", envBool("SCEP_INIT_CA"), "create a CA in the depot on startup if it has none")
 		flClDuration        = flag.String("crtvalid", envString("SCEP_CERT_VALID", "365"), "validity for new client certificates in days")
+		flCertBackdate      = flag.Duration("cert-backdate", envDuration("SCEP_CERT_BACKDATE", scepdepot.DefaultBackdate), "start the validity of new client certificates this long before issuance to tolerate client clock skew")
+		flRandomSerial      = flag.Bool("random-serial", envBool("SCEP_RANDOM_SERIAL"), "issue certificates with random 128 bit serial numbers instead of the depot serial")
 		flClAllowRenewal    = flag.String("allowrenew", envString("SCEP_CERT_RENEW", "14"), "do not allow renewal until n days before expiry, set to 0 to always allow")
+		flDuplicates        = flag.String("duplicates", envString("SCEP_DUPLICATES", ""), "handle requests reusing the key or subject of an active certificate: reject, renew to only allow renewals signed with its key, or supersede to revoke it; replaces -allowrenew")
+		flDuplicateCheck    = flag.String("duplicate-check", envString("SCEP_DUPLICATE_CHECK", "key,subject"), "comma separated duplicates detected with -duplicates: key and subject")
 		flChallengePassword = flag.String("challenge", envString("SCEP_CHALLENGE_PASSWORD", ""), "enforce a challenge password")
+		flChallengeAPIKey   = flag.String("challenge-api-key", envString("SCEP_CHALLENGE_API_KEY", ""), "enforce one-time challenges minted at /challenge with this API key")
+		flChallengeTTL      = flag.Duration("challenge-ttl", envDuration("SCEP_CHALLENGE_TTL", time.Hour), "validity of one-time challenges")
+		flChallengeSource   = flag.String("challenge-source", envString("SCEP_CHALLENGE_SOURCE", ""), "JSON file selecting a static, ldap, http or exec source validating challenge passwords")
+		flChallengeIdentity = flag.Bool("challenge-identity", envBool("SCEP_CHALLENGE_IDENTITY"), "only accept one-time challenges bound to the exact subject and SANs of the CSR")
 		flCSRVerifierExec   = flag.String("csrverifierexec", envString("SCEP_CSR_VERIFIER_EXEC", ""), "will be passed the CSRs for verification")
+		flCSRVerifierURL    = flag.String("csrverifierwebhook", envString("SCEP_CSR_VERIFIER_WEBHOOK", ""), "URL the CSRs are POSTed to for verification")
 		flDebug             = flag.Bool("debug", envBool("SCEP_LOG_DEBUG"), "enable debug logging")
+		flLogLevel          = flag.String("log-level", envString("SCEP_LOG_LEVEL", "info"), "minimum level of the logs: debug, info, warn or error")
+		flAuditLog          = flag.String("audit-log", envString("SCEP_AUDIT_LOG", ""), "append JSON audit events of enrollment decisions to this file, or send them to the local syslog daemon with \"syslog\"")
+		flEventWebhook      = flag.String("event-webhook", envString("SCEP_EVENT_WEBHOOK", ""), "URL JSON events of issued, failed, revoked and expiring certificates are POSTed to, e.g. of an MDM or CMDB")
+		flEventSecret       = flag.String("event-webhook-secret", envString("SCEP_EVENT_WEBHOOK_SECRET", ""), "sign the -event-webhook requests with an HMAC-SHA256 of this secret")
+		flEventTypes        = flag.String("event-webhook-events", envString("SCEP_EVENT_WEBHOOK_EVENTS", ""), "comma-separated events POSTed to -event-webhook: issued, failed, revoked and expiring; all by default")
+		flEventNATS         = flag.String("event-nats", envString("SCEP_EVENT_NATS", ""), "nats:// or tls:// URL of a NATS server JSON events of issued, failed, revoked and expiring certificates are published to")
+		flEventNATSSubject  = flag.String("event-nats-subject", envString("SCEP_EVENT_NATS_SUBJECT", "scep.events"), "subject prefix of the -event-nats events, followed by the event type")
+		flEventKafka        = flag.String("event-kafka", envString("SCEP_EVENT_KAFKA", ""), "comma-separated host:port Kafka brokers JSON events of issued, failed, revoked and expiring certificates are produced to")
+		flEventKafkaTopic   = flag.String("event-kafka-topic", envString("SCEP_EVENT_KAFKA_TOPIC", "scep-events"), "Kafka topic of the -event-kafka events")
+		flExpiryWindow      = flag.Duration("expiry-window", envDuration("SCEP_EXPIRY_WINDOW", 0), "report the certificates expiring within this duration without renewal at /admin/certificates/expiring, as a metric and as expiring events, e.g. 720h; 0 to disable")
+		flExpiryInterval    = flag.Duration("expiry-scan-interval", envDuration("SCEP_EXPIRY_SCAN_INTERVAL", time.Hour), "how often the depot is scanned for expiring certificates")
+		flIssuanceLog       = flag.String("issuance-log", envString("SCEP_ISSUANCE_LOG", ""), "file of an append-only Merkle tree log of the issued and revoked certificates, served with signed tree heads and inclusion proofs at /log/")
+		flIssuanceLogKey    = flag.String("issuance-log-key", envString("SCEP_ISSUANCE_LOG_KEY", ""), "PEM file of an RSA or ECDSA key dedicated to signing the tree heads of -issuance-log, not the CA key")
+		flIssuanceLogAPIKey = flag.String("issuance-log-api-key", envString("SCEP_ISSUANCE_LOG_API_KEY", ""), "API key required by /log/ requests, none by default")
+		flMetrics           = flag.Bool("metrics", envBool("SCEP_METRICS"), "expose Prometheus metrics at /metrics")
 		flLogJSON           = flag.Bool("log-json", envBool("SCEP_LOG_JSON"), "output JSON logs")
+		flValidateSigner    = flag.Bool("validate-signer", envBool("SCEP_VALIDATE_SIGNER"), "reject requests signed by expired certificates or ones neither self-signed nor issued by the CA")
+		flMinNonceSize      = flag.Int("min-nonce-size", envInt("SCEP_MIN_NONCE_SIZE", 0), "reject requests with a senderNonce shorter than this many bytes, 0 for no minimum")
+		flMaxNonceSize      = flag.Int("max-nonce-size", envInt("SCEP_MAX_NONCE_SIZE", 0), "reject requests with a senderNonce longer than this many bytes, 0 for no maximum")
+		flFIPS              = flag.Bool("fips", envBool("SCEP_FIPS"), "restrict messages to FIPS-approved algorithms: RSA keys of 2048 bits or more, SHA-256 or stronger and AES")
+		flRequireOAEP       = flag.Bool("require-oaep", envBool("SCEP_REQUIRE_OAEP"), "reject requests whose pkiEnvelope key is encrypted with RSAES-PKCS1-v1_5 instead of RSAES-OAEP")
+		flReplayCacheTTL    = flag.Duration("replay-cache-ttl", envDuration("SCEP_REPLAY_CACHE_TTL", 0), "reject enrollment requests replayed within this duration, 0 to disable")
+		flRateLimit         = flag.Int("rate-limit", envInt("SCEP_RATE_LIMIT", 0), "PKIOperation requests allowed per minute by client IP and by transaction ID, 0 for no limit")
+		flChallengeBackoff  = flag.Duration("challenge-backoff", envDuration("SCEP_CHALLENGE_BACKOFF", 0), "refuse requests of a client IP or transaction ID for this duration after a rejected challenge, doubling with every further failure; 0 to disable")
+		flCRLValidity       = flag.Duration("crl-validity", envDuration("SCEP_CRL_VALIDITY", 0), "sign a fresh CRL of the certificates revoked in the depot, valid for this duration; 0 serves ca.crl from the depot")
+		flOCSP              = flag.Bool("ocsp", envBool("SCEP_OCSP"), "answer OCSP requests at /ocsp with the revocation state of the depot")
+		flMinRSAKeySize     = flag.Int("min-rsa-key-size", envInt("SCEP_MIN_RSA_KEY_SIZE", scepserver.DefaultKeyPolicy.MinRSAKeySize), "reject CSRs with RSA keys smaller than this many bits; RSA exponents below 65537 are always rejected")
+		flECDSACurves       = flag.String("ecdsa-curves", envString("SCEP_ECDSA_CURVES", strings.Join(scepserver.DefaultKeyPolicy.ECDSACurves, ",")), "comma separated curves allowed for ECDSA keys of CSRs")
+		flSigningPolicy     = flag.String("signing-policy", envString("SCEP_SIGNING_POLICY", ""), "JSON file with the signing policy constraining the CSRs signed")
+		flCertTemplate      = flag.String("cert-template", envString("SCEP_CERT_TEMPLATE", ""), "JSON file with templates rewriting the subject and SANs of the certificates signed with the depot CA per request")
+		flProfiles          = flag.String("profiles", envString("SCEP_PROFILES", ""), "JSON file with enrollment profiles served at /scep/<name>, each with its own certificate usage, validity, signing policy and challenge")
+		flNextCACert        = flag.String("next-ca-cert", envString("SCEP_NEXT_CA_CERT", ""), "PEM file with the next CA certificate, served with GetNextCACert during a CA rollover")
+		flRAEncCert         = flag.String("ra-encryption-cert", envString("SCEP_RA_ENCRYPTION_CERT", ""), "PEM file with a separate RA encryption certificate, published with GetCACert, that clients encrypt requests to")
+		flRAEncKey          = flag.String("ra-encryption-key", envString("SCEP_RA_ENCRYPTION_KEY", ""), "PEM file with the key of -ra-encryption-cert, decrypted with -capass")
+		flVaultAddr         = flag.String("vault-addr", envString("VAULT_ADDR", ""), "sign CSRs with the Vault PKI secrets engine at this address instead of the depot CA")
+		flVaultToken        = flag.String("vault-token", envString("VAULT_TOKEN", ""), "Vault token")
+		flVaultMount        = flag.String("vault-mount", envString("SCEP_VAULT_MOUNT", "pki"), "path of the Vault PKI secrets engine")
+		flVaultRole         = flag.String("vault-role", envString("SCEP_VAULT_ROLE", ""), "Vault PKI role used to sign CSRs")
+		flUpstreamURL       = flag.String("upstream-url", envString("SCEP_UPSTREAM_URL", ""), "enroll CSRs with the SCEP CA at this URL instead of signing them with the depot CA")
+		flACMEDirectory     = flag.String("acme-directory", envString("SCEP_ACME_DIRECTORY", ""), "order certificates from the ACME server of this directory URL instead of signing them with the depot CA")
+		flACMEAccountKey    = flag.String("acme-account-key", envString("SCEP_ACME_ACCOUNT_KEY", ""), "PEM file with the key of the ACME account")
+		flACMECACert        = flag.String("acme-ca-cert", envString("SCEP_ACME_CA_CERT", ""), "PEM file with the certificates of the ACME CA, served with the RA certificate")
+		flCMPURL            = flag.String("cmp-url", envString("SCEP_CMP_URL", ""), "request certificates from the CMP server at this URL instead of signing them with the depot CA")
+		flCMPCACert         = flag.String("cmp-ca-cert", envString("SCEP_CMP_CA_CERT", ""), "PEM file with the certificate of the CMP CA, followed by its chain")
+		flAdminAPIKey       = flag.String("admin-api-key", envString("SCEP_ADMIN_API_KEY", ""), "serve the admin API at /admin/ with this API key")
+		flManualApproval    = flag.Bool("manual-approval", envBool("SCEP_MANUAL_APPROVAL"), "hold enrollment requests PENDING until approved or rejected with the admin API; requires the bolt depot")
+		flIdempotent        = flag.Bool("idempotent", envBool("SCEP_IDEMPOTENT"), "answer enrollment requests resent with the transactionID of an issued certificate with that certificate instead of signing another; requires the bolt depot")
+		flUI                = flag.Bool("ui", envBool("SCEP_UI"), "serve the web dashboard for the admin API at /ui/")
+		flEST               = flag.Bool("est", envBool("SCEP_EST"), "also serve EST (RFC 7030) cacerts, simpleenroll and simplereenroll at /.well-known/est/")
+		flTLSCert           = flag.String("tls-cert", envString("SCEP_TLS_CERT", ""), "PEM file with the TLS server certificate, serve HTTPS instead of HTTP")
+		flTLSKey            = flag.String("tls-key", envString("SCEP_TLS_KEY", ""), "PEM file with the TLS server private key")
 	)
 	flag.Usage = func() {
 		flag.PrintDefaults()
 
 		fmt.Println("usage: scep [<command>] [<args>]")
 		fmt.Println(" ca <args> create/manage a CA")
+		fmt.Println(" revoke <args> revoke a certificate issued by the CA")
+		fmt.Println(" serial <args> move the serial counter of a depot forward")
+		fmt.Println(" inspect <args> <file> describe a SCEP message for debugging")
 		fmt.Println("type <command> --help to see usage for each subcommand")
 	}
 	flag.Parse()
@@ -67,7 +172,10 @@ func main() {
 		fmt.Println(version)
 		os.Exit(0)
 	}
-	port := ":" + *flPort
+	addr := *flListen
+	if addr == "" {
+		addr = ":" + *flPort
+	}
 
 	var logger log.Logger
 	{
@@ -77,22 +185,49 @@ func main() {
 		} else {
 			logger = log.NewLogfmtLogger(os.Stderr)
 		}
-		if !*flDebug {
-			logger = level.NewFilter(logger, level.AllowInfo())
+		logLevel := *flLogLevel
+		if *flDebug {
+			logLevel = "debug"
 		}
+		allow, err := levelOption(logLevel)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		logger = level.NewFilter(logger, allow)
 		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
 		logger = log.With(logger, "caller", log.DefaultCaller)
 	}
 	lginfo := level.Info(logger)
 
 	var err error
-	var depot scepdepot.Depot // cert storage
+	var depot scepdepot.Depot   // cert storage
+	var txDepot scepdepot.Depot // depot without the cache, for its transactions
+	var issuanceLog *issuancelog.Log
 	{
-		depot, err = file.NewFileDepot(*flDepotPath)
+		depot, err = openDepot(*flDepotType, *flDepotPath, *flInitCA)
 		if err != nil {
 			lginfo.Log("err", err)
 			os.Exit(1)
 		}
+		if *flInitCA && *flCACert == "" && *flCAKey == "" {
+			if err := initCA(depot, *flDepotPath, []byte(*flCAPass)); err != nil {
+				lginfo.Log("err", err, "msg", "could not create CA")
+				os.Exit(1)
+			}
+		}
+		txDepot = depot
+		if *flIssuanceLog != "" {
+			issuanceLog, err = issuancelog.Open(*flIssuanceLog)
+			if err != nil {
+				lginfo.Log("err", err, "msg", "could not open issuance log")
+				os.Exit(1)
+			}
+			depot = issuancelog.NewDepot(depot, issuanceLog)
+		}
+		if *flDepotCacheTTL > 0 {
+			depot = scepdepot.NewCache(depot, *flDepotCacheTTL)
+		}
 	}
 	allowRenewal, err := strconv.Atoi(*flClAllowRenewal)
 	if err != nil {
@@ -113,36 +248,516 @@ func main() {
 		}
 		csrVerifier = executableCSRVerifier
 	}
+	var webhookVerifier csrverifier.CSRVerifier
+	if *flCSRVerifierURL > "" {
+		webhookCSRVerifier, err := webhookcsrverifier.New(*flCSRVerifierURL, lginfo)
+		if err != nil {
+			lginfo.Log("err", err, "msg", "Could not instantiate CSR verifier webhook")
+			os.Exit(1)
+		}
+		webhookVerifier = webhookCSRVerifier
+	}
+	keyPolicy := scepserver.KeyPolicy{
+		MinRSAKeySize:  *flMinRSAKeySize,
+		MinRSAExponent: scepserver.DefaultKeyPolicy.MinRSAExponent,
+	}
+	for _, curve := range strings.Split(*flECDSACurves, ",") {
+		switch curve = strings.TrimSpace(curve); curve {
+		case "P-224", "P-256", "P-384", "P-521":
+			keyPolicy.ECDSACurves = append(keyPolicy.ECDSACurves, curve)
+		case "":
+		default:
+			lginfo.Log("err", fmt.Sprintf("unknown ECDSA curve %q", curve))
+			os.Exit(1)
+		}
+	}
+
+	if (*flManualApproval || *flUI) && *flAdminAPIKey == "" {
+		lginfo.Log("err", "-manual-approval and -ui require -admin-api-key")
+		os.Exit(1)
+	}
+
+	if *flChallengeIdentity && *flChallengeAPIKey == "" {
+		lginfo.Log("err", "-challenge-identity requires -challenge-api-key")
+		os.Exit(1)
+	}
+
+	var challengeValidator scepserver.ChallengeValidator
+	if *flChallengeSource != "" {
+		if *flChallengePassword != "" || *flChallengeAPIKey != "" {
+			lginfo.Log("err", "-challenge-source, -challenge and -challenge-api-key are mutually exclusive")
+			os.Exit(1)
+		}
+		source, err := loadChallengeSource(*flChallengeSource)
+		if err == nil {
+			challengeValidator, err = source.validator(log.With(lginfo, "component", "challenge_source"))
+		}
+		if err != nil {
+			lginfo.Log("err", err, "msg", "could not load challenge source")
+			os.Exit(1)
+		}
+	}
+
+	var challengeStore *challenge.HMACStore // one-time challenges
+	if *flChallengeAPIKey != "" {
+		if *flChallengePassword != "" {
+			lginfo.Log("err", "-challenge and -challenge-api-key are mutually exclusive")
+			os.Exit(1)
+		}
+		// challenges minted before a restart become invalid
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			lginfo.Log("err", err)
+			os.Exit(1)
+		}
+		var challengeOpts []challenge.HMACOption
+		if *flChallengeIdentity {
+			challengeOpts = append(challengeOpts, challenge.RequireIdentity())
+		}
+		challengeStore, err = challenge.NewHMACStore(key, *flChallengeTTL, challengeOpts...)
+		if err != nil {
+			lginfo.Log("err", err)
+			os.Exit(1)
+		}
+	}
 
+	var crls scepdepot.CRLGetter
+	var ocspResponder http.Handler
+	var estHandler http.Handler
+	var adminHandler http.Handler
+	var logHandler http.Handler
+	var profileEndpoints map[string]*scepserver.Endpoints
+	var profileChallenges map[string]http.Handler // by path
+	var clientCAs *x509.CertPool
+	var promMetrics *prometheus.Metrics
+	var eventQueue *scepserver.EventQueue
+	var eventClosers []io.Closer
 	var svc scepserver.Service // scep service
 	{
-		crts, key, err := depot.CA([]byte(*flCAPass))
+		crts, key, err := loadCA(depot, *flCACert, *flCAKey, []byte(*flCAPass))
 		if err != nil {
 			lginfo.Log("err", err)
 			os.Exit(1)
 		}
-		if len(crts) < 1 {
-			lginfo.Log("err", "missing CA certificate")
-			os.Exit(1)
+		tmplOpts := []scepdepot.TemplateOption{scepdepot.WithBackdate(*flCertBackdate)}
+		if *flRandomSerial {
+			tmplOpts = append(tmplOpts, scepdepot.WithRandomSerial(128))
 		}
-		var signer scepserver.CSRSigner = scepdepot.NewSigner(
-			depot,
+		signerOpts := []scepdepot.Option{
 			scepdepot.WithAllowRenewalDays(allowRenewal),
 			scepdepot.WithValidityDays(clientValidity),
 			scepdepot.WithCAPass(*flCAPass),
-		)
+			scepdepot.WithTemplateOptions(tmplOpts...),
+		}
+		if *flCACert != "" {
+			signerOpts = append(signerOpts, scepdepot.WithCA(crts[0], key))
+		}
+		if issuanceLog != nil {
+			logKey, err := loadIssuanceLogKey(*flIssuanceLogKey, key)
+			if err != nil {
+				lginfo.Log("err", err, "msg", "could not load issuance log key")
+				os.Exit(1)
+			}
+			logHandler = issuancelog.NewHandler(issuanceLog, logKey, *flIssuanceLogAPIKey)
+		}
+		if *flCertTemplate != "" {
+			rewrite, err := loadRewrite(*flCertTemplate)
+			if err != nil {
+				lginfo.Log("err", err, "msg", "could not load certificate template")
+				os.Exit(1)
+			}
+			signerOpts = append(signerOpts, scepdepot.WithRewrite(rewrite))
+		}
+		if *flDuplicates != "" {
+			opt, err := parseDuplicates(*flDuplicates, *flDuplicateCheck)
+			if err != nil {
+				lginfo.Log("err", err)
+				os.Exit(1)
+			}
+			signerOpts = append(signerOpts, opt)
+		}
+		var signer scepserver.CSRSigner = scepdepot.NewSigner(depot, signerOpts...)
+		issuers := crts
+		svcOpts := []scepserver.ServiceOption{scepserver.WithLogger(logger)}
+		if *flMetrics {
+			promMetrics = prometheus.New("scep")
+			svcOpts = append(svcOpts, scepserver.WithMetrics(promMetrics))
+		}
+		if *flAuditLog != "" {
+			auditLogger, err := newAuditLogger(*flAuditLog)
+			if err != nil {
+				lginfo.Log("err", err, "msg", "could not open audit log")
+				os.Exit(1)
+			}
+			svcOpts = append(svcOpts, scepserver.WithAuditLogger(auditLogger))
+		}
+		var eventPublishers []scepserver.EventPublisher
+		if *flEventWebhook != "" {
+			publisher, err := newEventPublisher(*flEventWebhook, *flEventSecret, *flEventTypes)
+			if err != nil {
+				lginfo.Log("err", err, "msg", "could not configure event webhook")
+				os.Exit(1)
+			}
+			eventPublishers = append(eventPublishers, publisher)
+		}
+		if *flEventNATS != "" {
+			publisher, err := natsevent.New(*flEventNATS, *flEventNATSSubject)
+			if err != nil {
+				lginfo.Log("err", err, "msg", "could not configure NATS events")
+				os.Exit(1)
+			}
+			eventPublishers = append(eventPublishers, publisher)
+			eventClosers = append(eventClosers, publisher)
+		}
+		if *flEventKafka != "" {
+			publisher, err := kafkaevent.New(strings.Split(*flEventKafka, ","), *flEventKafkaTopic)
+			if err != nil {
+				lginfo.Log("err", err, "msg", "could not configure Kafka events")
+				os.Exit(1)
+			}
+			eventPublishers = append(eventPublishers, publisher)
+			eventClosers = append(eventClosers, publisher)
+		}
+		if len(eventPublishers) > 0 {
+			eventQueue = scepserver.NewEventQueue(eventQueueSize, log.With(lginfo, "component", "events"), eventPublishers...)
+			eventPublishers = []scepserver.EventPublisher{eventQueue}
+		}
+		for _, publisher := range eventPublishers {
+			svcOpts = append(svcOpts, scepserver.WithEventPublisher(publisher))
+		}
+		var expiryMonitor *scepserver.ExpiryMonitor
+		if *flExpiryWindow > 0 {
+			expiryOpts := []scepserver.ExpiryOption{
+				scepserver.WithExpiryInterval(*flExpiryInterval),
+				scepserver.WithExpiryLogger(log.With(lginfo, "component", "expiry")),
+			}
+			if promMetrics != nil {
+				expiryOpts = append(expiryOpts, scepserver.WithExpiryMetrics(promMetrics))
+			}
+			for _, publisher := range eventPublishers {
+				expiryOpts = append(expiryOpts, scepserver.WithExpiryPublisher(publisher))
+			}
+			expiryMonitor, err = scepserver.NewExpiryMonitor(depot, *flExpiryWindow, expiryOpts...)
+			if err != nil {
+				lginfo.Log("err", err)
+				os.Exit(1)
+			}
+			go expiryMonitor.Run(context.Background())
+		}
+		if *flVaultAddr != "" {
+			// the depot CA keypair is only used as RA
+			vaultSigner, err := vaultcsrsigner.New(*flVaultAddr, *flVaultRole, *flVaultToken,
+				vaultcsrsigner.WithMount(*flVaultMount),
+				vaultcsrsigner.WithTTL(time.Duration(clientValidity)*24*time.Hour),
+			)
+			if err != nil {
+				lginfo.Log("err", err)
+				os.Exit(1)
+			}
+			vaultCerts, err := vaultSigner.CACerts(context.Background())
+			if err != nil {
+				lginfo.Log("err", err, "msg", "could not get Vault CA certificates")
+				os.Exit(1)
+			}
+			for _, crt := range vaultCerts {
+				svcOpts = append(svcOpts, scepserver.WithCertificateChain(crt))
+			}
+			signer = vaultSigner
+			issuers = vaultCerts
+		}
+		var delegates int
+		for _, fl := range []string{*flVaultAddr, *flUpstreamURL, *flACMEDirectory, *flCMPURL} {
+			if fl != "" {
+				delegates++
+			}
+		}
+		if delegates > 1 {
+			lginfo.Log("err", "-vault-addr, -upstream-url, -acme-directory and -cmp-url are mutually exclusive")
+			os.Exit(1)
+		}
+		if delegates > 0 && *flCertTemplate != "" {
+			lginfo.Log("err", "-cert-template cannot be combined with -vault-addr, -upstream-url, -acme-directory or -cmp-url")
+			os.Exit(1)
+		}
+		if delegates > 0 && *flDuplicates != "" {
+			lginfo.Log("err", "-duplicates cannot be combined with -vault-addr, -upstream-url, -acme-directory or -cmp-url")
+			os.Exit(1)
+		}
+		if *flUpstreamURL != "" {
+			// the depot CA keypair is the RA identity enrolling with the CA
+			client, err := scepclient.New(*flUpstreamURL, logger)
+			if err != nil {
+				lginfo.Log("err", err)
+				os.Exit(1)
+			}
+			upstreamSigner, err := upstreamcsrsigner.New(client, crts[0], key)
+			if err != nil {
+				lginfo.Log("err", err)
+				os.Exit(1)
+			}
+			upstreamCerts, err := upstreamSigner.CACerts(context.Background())
+			if err != nil {
+				lginfo.Log("err", err, "msg", "could not get upstream CA certificates")
+				os.Exit(1)
+			}
+			for _, crt := range upstreamCerts {
+				svcOpts = append(svcOpts, scepserver.WithCertificateChain(crt))
+			}
+			signer = upstreamSigner
+			issuers = upstreamCerts
+		}
+		if *flACMEDirectory != "" {
+			data, err := ioutil.ReadFile(*flACMEAccountKey)
+			if err != nil {
+				lginfo.Log("err", err, "msg", "could not read ACME account key")
+				os.Exit(1)
+			}
+			accountKey, err := cryptoutil.ParsePrivateKeyPEM(data, nil)
+			if err != nil {
+				lginfo.Log("err", err, "msg", "could not parse ACME account key")
+				os.Exit(1)
+			}
+			acmeSigner, err := acmecsrsigner.New(*flACMEDirectory, accountKey)
+			if err != nil {
+				lginfo.Log("err", err)
+				os.Exit(1)
+			}
+			if *flACMECACert != "" {
+				acmeCerts, err := loadPEMCerts(*flACMECACert)
+				if err != nil {
+					lginfo.Log("err", err, "msg", "could not load ACME CA certificates")
+					os.Exit(1)
+				}
+				svcOpts = append(svcOpts, scepserver.WithCertificateChain(acmeCerts...))
+				issuers = acmeCerts
+			}
+			signer = acmeSigner
+		}
+		if *flCMPURL != "" {
+			cmpCerts, err := loadPEMCerts(*flCMPCACert)
+			if err != nil {
+				lginfo.Log("err", err, "msg", "could not load CMP CA certificate")
+				os.Exit(1)
+			}
+			// the depot CA keypair is the RA identity protecting the requests
+			cmpSigner, err := cmpcsrsigner.New(*flCMPURL, cmpCerts[0], crts[0], key)
+			if err != nil {
+				lginfo.Log("err", err)
+				os.Exit(1)
+			}
+			svcOpts = append(svcOpts, scepserver.WithCertificateChain(cmpCerts...))
+			signer = cmpSigner
+			issuers = cmpCerts
+		}
+		var txStore scepdepot.TransactionStore
+		var txOpts []scepserver.TransactionOption
+		if revocations, ok := depot.(scepdepot.RevocationLister); ok {
+			txOpts = append(txOpts, scepserver.WithTransactionRevocations(revocations))
+		}
+		var approval *scepserver.ManualApproval
+		if *flManualApproval || *flIdempotent {
+			var ok bool
+			if txStore, ok = txDepot.(scepdepot.TransactionStore); !ok {
+				lginfo.Log("err", "depot does not support -manual-approval or -idempotent")
+				os.Exit(1)
+			}
+			svcOpts = append(svcOpts, scepserver.WithTransactionStore(txStore))
+		}
+		if *flManualApproval {
+			// the middlewares below check the requests before they are held
+			approval = scepserver.NewManualApproval(txStore, signer, txOpts...)
+			signer = approval
+		}
+		if *flSigningPolicy != "" {
+			policy, err := loadSigningPolicy(*flSigningPolicy)
+			if err != nil {
+				lginfo.Log("err", err, "msg", "could not load signing policy")
+				os.Exit(1)
+			}
+			signer = scepserver.PolicyMiddleware(policy, signer)
+		}
 		if *flChallengePassword != "" {
 			signer = scepserver.ChallengeMiddleware(*flChallengePassword, signer)
 		}
+		if challengeStore != nil {
+			signer = challenge.Middleware(challengeStore, signer)
+		}
+		if challengeValidator != nil {
+			signer = scepserver.ChallengeValidatorMiddleware(challengeValidator, signer)
+		}
 		if csrVerifier != nil {
 			signer = csrverifier.Middleware(csrVerifier, signer)
 		}
-		svc, err = scepserver.NewService(crts[0], key, signer, scepserver.WithLogger(logger))
+		if webhookVerifier != nil {
+			signer = csrverifier.Middleware(webhookVerifier, signer)
+		}
+		if *flIdempotent {
+			// resent requests skip the checks of their used challenge
+			signer = scepserver.IdempotentMiddleware(txStore, signer, txOpts...)
+		}
+		signer = scepserver.PublicKeyMiddleware(keyPolicy, signer)
+		signer = scepserver.SignatureAlgorithmMiddleware(nil, signer)
+		if *flEST {
+			estHandler = scepserver.NewESTHandler(issuers, signer,
+				scepserver.WithESTLogger(log.With(lginfo, "component", "est")),
+			)
+			// simplereenroll authenticates with a client certificate of the CA
+			clientCAs = x509.NewCertPool()
+			for _, crt := range issuers {
+				clientCAs.AddCert(crt)
+			}
+		}
+		if *flAdminAPIKey != "" {
+			adminOpts := []scepserver.AdminOption{
+				scepserver.WithAdminLogger(log.With(lginfo, "component", "admin")),
+				scepserver.WithAdminCA(issuers...),
+				scepserver.WithAdminDepot(depot),
+			}
+			for _, publisher := range eventPublishers {
+				adminOpts = append(adminOpts, scepserver.WithAdminEventPublisher(publisher))
+			}
+			if expiryMonitor != nil {
+				adminOpts = append(adminOpts, scepserver.WithAdminExpiry(expiryMonitor))
+			}
+			if challengeStore != nil {
+				adminOpts = append(adminOpts, scepserver.WithAdminChallenges(func(cn string) (string, error) {
+					if *flChallengeIdentity {
+						// the dashboard binds the subject CN=cn without SANs
+						if cn == "" {
+							return "", &scepserver.FailInfoError{
+								FailInfo: scep.BadRequest,
+								Text:     "a common name is required",
+								Err:      challenge.ErrIdentityRequired,
+							}
+						}
+						return challengeStore.IdentityChallenge(challenge.Identity{Subject: pkix.Name{CommonName: cn}.String()})
+					}
+					if cn != "" {
+						return challengeStore.SubjectChallenge(cn)
+					}
+					return challengeStore.SCEPChallenge()
+				}))
+			}
+			var approver scepserver.Approver
+			if approval != nil {
+				approver = approval
+			}
+			adminHandler = scepserver.NewAdminHandler(txStore, approver, *flAdminAPIKey, adminOpts...)
+		}
+		if getter, ok := depot.(scepdepot.CertGetter); ok {
+			svcOpts = append(svcOpts, scepserver.WithCertGetter(getter))
+		}
+		if lister, ok := depot.(scepdepot.RevocationLister); ok && *flCRLValidity > 0 {
+			crls = scepdepot.NewCRLBuilder(lister, crts[0], key, scepdepot.WithCRLValidity(*flCRLValidity))
+		} else if getter, ok := depot.(scepdepot.CRLGetter); ok {
+			crls = getter
+		}
+		if crls != nil {
+			svcOpts = append(svcOpts, scepserver.WithCRLGetter(scepserver.DepotCRL(crts[0], crls)))
+		}
+		if *flOCSP {
+			lister, ok := depot.(scepdepot.RevocationLister)
+			if !ok {
+				lginfo.Log("err", "depot does not support OCSP")
+				os.Exit(1)
+			}
+			var ocspOpts []scepserver.OCSPOption
+			if getter, ok := depot.(scepdepot.CertGetter); ok {
+				ocspOpts = append(ocspOpts, scepserver.WithOCSPCertGetter(getter))
+			}
+			responder, err := scepserver.NewOCSPResponder(crts[0], key, lister, ocspOpts...)
+			if err != nil {
+				lginfo.Log("err", err)
+				os.Exit(1)
+			}
+			ocspResponder = http.StripPrefix("/ocsp", responder)
+		}
+		if *flValidateSigner {
+			svcOpts = append(svcOpts, scepserver.WithSignerValidation())
+		}
+		if *flMinNonceSize != 0 || *flMaxNonceSize != 0 {
+			svcOpts = append(svcOpts, scepserver.WithNonceSizeRange(*flMinNonceSize, *flMaxNonceSize))
+		}
+		if *flRequireOAEP {
+			svcOpts = append(svcOpts, scepserver.WithRequireOAEP())
+		}
+		if *flFIPS {
+			svcOpts = append(svcOpts, scepserver.WithFIPS())
+		}
+		if *flReplayCacheTTL > 0 {
+			svcOpts = append(svcOpts, scepserver.WithReplayCache(scepserver.NewReplayCache(*flReplayCacheTTL, 100000)))
+		}
+		if *flRateLimit > 0 || *flChallengeBackoff > 0 {
+			limiter := scepserver.NewRateLimiter(*flRateLimit, time.Minute, *flChallengeBackoff, 100000)
+			svcOpts = append(svcOpts, scepserver.WithRateLimiter(limiter))
+		}
+		if *flNextCACert != "" {
+			next, err := loadPEMCerts(*flNextCACert)
+			if err != nil {
+				lginfo.Log("err", err, "msg", "could not load next CA certificate")
+				os.Exit(1)
+			}
+			svcOpts = append(svcOpts, scepserver.WithNextCA(next...))
+		}
+		if *flRAEncCert != "" || *flRAEncKey != "" {
+			crt, key, err := loadRAEncryption(*flRAEncCert, *flRAEncKey, []byte(*flCAPass))
+			if err != nil {
+				lginfo.Log("err", err, "msg", "could not load RA encryption keypair")
+				os.Exit(1)
+			}
+			svcOpts = append(svcOpts, scepserver.WithRAEncryption(crt, key))
+		}
+		svc, err = scepserver.NewService(crts[0], key, signer, svcOpts...)
 		if err != nil {
 			lginfo.Log("err", err)
 			os.Exit(1)
 		}
 		svc = scepserver.NewLoggingService(log.With(lginfo, "component", "scep_service"), svc)
+
+		if *flProfiles != "" {
+			if delegates > 0 || *flManualApproval {
+				lginfo.Log("err", "-profiles cannot be combined with -vault-addr, -upstream-url, -acme-directory, -cmp-url or -manual-approval")
+				os.Exit(1)
+			}
+			profiles, err := loadProfiles(*flProfiles)
+			if err != nil {
+				lginfo.Log("err", err, "msg", "could not load profiles")
+				os.Exit(1)
+			}
+			profileEndpoints = make(map[string]*scepserver.Endpoints)
+			profileChallenges = make(map[string]http.Handler)
+			for name, profile := range profiles {
+				signer, store, err := profile.signer(depot, *flChallengeTTL, log.With(lginfo, "component", "challenge_source", "profile", name), signerOpts...)
+				if err != nil {
+					lginfo.Log("err", err, "profile", name)
+					os.Exit(1)
+				}
+				if csrVerifier != nil {
+					signer = csrverifier.Middleware(csrVerifier, signer)
+				}
+				if webhookVerifier != nil {
+					signer = csrverifier.Middleware(webhookVerifier, signer)
+				}
+				if *flIdempotent {
+					signer = scepserver.IdempotentMiddleware(txStore, signer, txOpts...)
+				}
+				signer = scepserver.PublicKeyMiddleware(keyPolicy, signer)
+				signer = scepserver.SignatureAlgorithmMiddleware(nil, signer)
+				profileSvc, err := scepserver.NewService(crts[0], key, signer, svcOpts...)
+				if err != nil {
+					lginfo.Log("err", err, "profile", name)
+					os.Exit(1)
+				}
+				profileSvc = scepserver.NewLoggingService(log.With(lginfo, "component", "scep_service", "profile", name), profileSvc)
+				e := scepserver.MakeServerEndpoints(profileSvc)
+				e.GetEndpoint = scepserver.EndpointLoggingMiddleware(lginfo)(e.GetEndpoint)
+				e.PostEndpoint = scepserver.EndpointLoggingMiddleware(lginfo)(e.PostEndpoint)
+				profileEndpoints[name] = e
+				if store != nil {
+					profileChallenges["/challenge/"+name] = challenge.NewAdminHandler(store, profile.ChallengeAPIKey)
+				}
+			}
+		}
 	}
 
 	var h http.Handler // http handler
@@ -151,118 +766,329 @@ func main() {
 		e.GetEndpoint = scepserver.EndpointLoggingMiddleware(lginfo)(e.GetEndpoint)
 		e.PostEndpoint = scepserver.EndpointLoggingMiddleware(lginfo)(e.PostEndpoint)
 		h = scepserver.MakeHTTPHandler(e, svc, log.With(lginfo, "component", "http"))
+		mux := http.NewServeMux()
+		if challengeStore != nil {
+			mux.Handle("/challenge", challenge.NewAdminHandler(challengeStore, *flChallengeAPIKey))
+		}
+		if profileEndpoints != nil {
+			// a /scep/ subtree alone would redirect /scep to it
+			mux.Handle("/scep", h)
+			mux.Handle("/scep/", scepserver.MakeProfileHTTPHandler(profileEndpoints, log.With(lginfo, "component", "http")))
+		}
+		for path, handler := range profileChallenges {
+			mux.Handle(path, handler)
+		}
+		if crls != nil {
+			mux.Handle("/crl", scepserver.NewCRLHandler(crls))
+		}
+		if ocspResponder != nil {
+			mux.Handle("/ocsp", ocspResponder)
+			mux.Handle("/ocsp/", ocspResponder)
+		}
+		if promMetrics != nil {
+			mux.Handle("/metrics", promMetrics)
+		}
+		if estHandler != nil {
+			mux.Handle(scepserver.ESTPathPrefix, estHandler)
+		}
+		if adminHandler != nil {
+			mux.Handle(scepserver.AdminPathPrefix, adminHandler)
+		}
+		if logHandler != nil {
+			mux.Handle(issuancelog.PathPrefix, logHandler)
+		}
+		if *flUI {
+			mux.Handle(ui.PathPrefix, http.StripPrefix(ui.PathPrefix, ui.Handler()))
+		}
+		mux.Handle("/", h)
+		h = mux
 	}
 
 	// start http server
 	errs := make(chan error, 2)
 	go func() {
-		lginfo.Log("transport", "http", "address", port, "msg", "listening")
-		errs <- http.ListenAndServe(port, h)
+		lginfo.Log("transport", "http", "address", addr, "msg", "listening")
+		if *flTLSCert == "" {
+			errs <- http.ListenAndServe(addr, h)
+			return
+		}
+		srv := &http.Server{Addr: addr, Handler: h}
+		if clientCAs != nil {
+			srv.TLSConfig = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: clientCAs}
+		}
+		errs <- srv.ListenAndServeTLS(*flTLSCert, *flTLSKey)
 	}()
 	go func() {
-		c := make(chan os.Signal)
-		signal.Notify(c, syscall.SIGINT)
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 		errs <- fmt.Errorf("%s", <-c)
 	}()
 
 	lginfo.Log("terminated", <-errs)
+	if eventQueue != nil {
+		eventQueue.Close()
+	}
+	for _, c := range eventClosers {
+		c.Close()
+	}
 }
 
+// eventQueueSize is the number of events waiting to be published before
+// further events are dropped.
+const eventQueueSize = 1024
+
 func caMain(cmd *flag.FlagSet) int {
 	var (
-		flDepotPath = cmd.String("depot", "depot", "path to ca folder")
+		flDepotPath = cmd.String("depot", "depot", "path to ca folder, or BoltDB file with -depot-type bolt")
+		flDepotType = cmd.String("depot-type", "file", "depot backend: file or bolt")
 		flInit      = cmd.Bool("init", false, "create a new CA")
 		flYears     = cmd.Int("years", 10, "default CA years")
+		flKeyType   = cmd.String("key-type", "rsa", "type of the CA key: rsa or ecdsa")
 		flKeySize   = cmd.Int("keySize", 4096, "rsa key size")
+		flCurve     = cmd.String("curve", "P-384", "curve of an ecdsa CA key: P-256, P-384 or P-521")
+		flCN        = cmd.String("cn", "", "common name for CA cert")
 		flOrg       = cmd.String("organization", "scep-ca", "organization for CA cert")
 		flOrgUnit   = cmd.String("organizational_unit", "SCEP CA", "organizational unit (OU) for CA cert")
-		flPassword  = cmd.String("key-password", "", "password to store rsa key")
+		flPassword  = cmd.String("key-password", "", "password to store the CA key")
 		flCountry   = cmd.String("country", "US", "country for CA cert")
+		flPathLen   = cmd.Int("pathlen", -1, "maximum number of intermediate CAs below the CA, -1 for no limit")
+		flKeyUsage  = cmd.String("key-usage", "certSign,crlSign", "comma separated key usages of the CA cert")
+		flCSR       = cmd.String("csr", "", "write a CSR for signing by an external CA to this path instead of self-signing, the key is stored as ca.key of a file depot")
 	)
 	cmd.Parse(os.Args[2:])
-	if *flInit {
-		fmt.Println("Initializing new CA")
-		key, err := createKey(*flKeySize, []byte(*flPassword), *flDepotPath)
-		if err != nil {
-			fmt.Println(err)
-			return 1
-		}
-		if err := createCertificateAuthority(key, *flYears, *flOrg, *flOrgUnit, *flCountry, *flDepotPath); err != nil {
-			fmt.Println(err)
-			return 1
-		}
+	if !*flInit {
+		return 0
+	}
+	fmt.Println("Initializing new CA")
+	if err := initCACeremony(caCeremony{
+		depotType: *flDepotType,
+		depotPath: *flDepotPath,
+		keyType:   *flKeyType,
+		rsaBits:   *flKeySize,
+		curve:     *flCurve,
+		password:  []byte(*flPassword),
+		keyUsage:  *flKeyUsage,
+		csrPath:   *flCSR,
+		certOpts: []scepdepot.CACertOption{
+			scepdepot.WithYears(*flYears),
+			scepdepot.WithCommonName(*flCN),
+			scepdepot.WithOrganization(*flOrg),
+			scepdepot.WithOrganizationalUnit(*flOrgUnit),
+			scepdepot.WithCountry(*flCountry),
+			scepdepot.WithMaxPathLen(*flPathLen),
+		},
+	}); err != nil {
+		fmt.Println(err)
+		return 1
 	}
-
 	return 0
 }
 
-// create a key, save it to depot and return it for further usage.
-func createKey(bits int, password []byte, depot string) (*rsa.PrivateKey, error) {
-	// create depot folder if missing
-	if err := os.MkdirAll(depot, 0755); err != nil {
-		return nil, err
+// newAuditLogger returns an AuditLogger appending to the file at path, or
+// writing to the local syslog daemon if path is "syslog".
+func newAuditLogger(path string) (scepserver.AuditLogger, error) {
+	if path == "syslog" {
+		return newSyslogAuditLogger()
 	}
-	name := filepath.Join(depot, "ca.key")
-	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	return scepserver.NewJSONAuditLogger(f), nil
+}
 
-	// create RSA key and save as PEM file
-	key, err := rsa.GenerateKey(rand.Reader, bits)
-	if err != nil {
-		return nil, err
+// newEventPublisher returns the EventPublisher POSTing to url, signing
+// with secret if it is not empty and only publishing the comma-separated
+// types if they are not empty.
+func newEventPublisher(url, secret, types string) (scepserver.EventPublisher, error) {
+	var opts []webhookevent.Option
+	if secret != "" {
+		opts = append(opts, webhookevent.WithSecret([]byte(secret)))
 	}
-	privPEMBlock, err := x509.EncryptPEMBlock(
-		rand.Reader,
-		rsaPrivateKeyPEMBlockType,
-		x509.MarshalPKCS1PrivateKey(key),
-		password,
-		x509.PEMCipher3DES,
+	if types != "" {
+		var eventTypes []scepserver.EventType
+		for _, t := range strings.Split(types, ",") {
+			switch t := scepserver.EventType(strings.TrimSpace(t)); t {
+			case scepserver.EventIssued, scepserver.EventFailed, scepserver.EventRevoked, scepserver.EventExpiring:
+				eventTypes = append(eventTypes, t)
+			default:
+				return nil, fmt.Errorf("unknown event %q", t)
+			}
+		}
+		opts = append(opts, webhookevent.WithEvents(eventTypes...))
+	}
+	return webhookevent.New(url, opts...)
+}
+
+func revokeMain(cmd *flag.FlagSet) int {
+	var (
+		flDepotPath = cmd.String("depot", "depot", "path to ca folder")
+		flSerial    = cmd.String("serial", "", "serial number of the certificate to revoke, in hex")
+		flReason    = cmd.Int("reason", 0, "RFC 5280 CRLReason code, e.g. 1 for keyCompromise")
+		flWebhook   = cmd.String("event-webhook", envString("SCEP_EVENT_WEBHOOK", ""), "URL the revoked event is POSTed to")
+		flSecret    = cmd.String("event-webhook-secret", envString("SCEP_EVENT_WEBHOOK_SECRET", ""), "sign the -event-webhook request with an HMAC-SHA256 of this secret")
+		flTypes     = cmd.String("event-webhook-events", envString("SCEP_EVENT_WEBHOOK_EVENTS", ""), "comma-separated events POSTed to -event-webhook, the revoked event is only POSTed if included; all by default")
 	)
+	cmd.Parse(os.Args[2:])
+	serial, ok := new(big.Int).SetString(*flSerial, 16)
+	if !ok {
+		fmt.Printf("invalid serial number %q\n", *flSerial)
+		return 1
+	}
+	var publisher scepserver.EventPublisher
+	if *flWebhook != "" {
+		var err error
+		if publisher, err = newEventPublisher(*flWebhook, *flSecret, *flTypes); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	}
+	depot, err := file.NewFileDepot(*flDepotPath)
 	if err != nil {
-		return nil, err
+		fmt.Println(err)
+		return 1
 	}
-	if err := pem.Encode(file, privPEMBlock); err != nil {
-		os.Remove(name)
-		return nil, err
+	if err := depot.Revoke(serial, *flReason); err != nil {
+		fmt.Println(err)
+		return 1
 	}
-
-	return key, nil
+	if publisher == nil {
+		return 0
+	}
+	e := scepserver.Event{Type: scepserver.EventRevoked, Time: time.Now().UTC(), Serial: fmt.Sprintf("%X", serial), Reason: *flReason}
+	if crt, err := depot.GetCert(serial); err == nil {
+		notAfter := crt.NotAfter.UTC()
+		e.Subject, e.NotAfter = crt.Subject.String(), &notAfter
+	}
+	if err := publisher.Publish(context.Background(), e); err != nil {
+		fmt.Printf("revoked, but failed to publish event: %v\n", err)
+		return 1
+	}
+	return 0
 }
 
-func createCertificateAuthority(key *rsa.PrivateKey, years int, organization string, organizationalUnit string, country string, depot string) error {
-	cert := scepdepot.NewCACert(
-		scepdepot.WithYears(years),
-		scepdepot.WithOrganization(organization),
-		scepdepot.WithOrganizationalUnit(organizationalUnit),
-		scepdepot.WithCountry(country),
+// serialMain seeds the serial counter of a depot, e.g. of a bolt depot
+// replacing a file depot with the counter of the file depot.
+func serialMain(cmd *flag.FlagSet) int {
+	var (
+		flDepotPath = cmd.String("depot", "depot.db", "path to the BoltDB file, or ca folder with -depot-type file")
+		flDepotType = cmd.String("depot-type", "bolt", "depot backend: file or bolt")
+		flFrom      = cmd.String("from", "", "continue the serial counter of the file depot in this ca folder")
+		flNext      = cmd.String("next", "", "allocate serial numbers from this one on, in hex")
 	)
-	crtBytes, err := cert.SelfSign(rand.Reader, &key.PublicKey, key)
+	cmd.Parse(os.Args[2:])
+	var next *big.Int
+	switch {
+	case *flNext != "":
+		var ok bool
+		if next, ok = new(big.Int).SetString(*flNext, 16); !ok {
+			fmt.Printf("invalid serial number %q\n", *flNext)
+			return 1
+		}
+	case *flFrom != "":
+		from, err := file.NewFileDepot(*flFrom)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		if next, err = from.Serial(); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+	default:
+		fmt.Println("-from or -next is required")
+		return 1
+	}
+	depot, err := openDepot(*flDepotType, *flDepotPath, false)
 	if err != nil {
-		return err
+		fmt.Println(err)
+		return 1
+	}
+	seeder, ok := depot.(scepdepot.SerialSeeder)
+	if !ok {
+		fmt.Printf("depot type %s does not support seeding the serial counter\n", *flDepotType)
+		return 1
+	}
+	if err := seeder.SeedSerial(next); err != nil {
+		fmt.Println(err)
+		return 1
 	}
+	fmt.Printf("serial numbers allocated from at least %X\n", next)
+	return 0
+}
 
-	name := filepath.Join(depot, "ca.pem")
-	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+// inspectMain describes the SCEP message of a file, decrypting its
+// pkiEnvelope with the CA of a depot or PEM files if one is given.
+func inspectMain(cmd *flag.FlagSet) int {
+	var (
+		flDepotPath = cmd.String("depot", "", "decrypt the pkiEnvelope with the CA of the depot at this path")
+		flDepotType = cmd.String("depot-type", "file", "depot backend: file or bolt")
+		flCACert    = cmd.String("ca-cert", "", "PEM file with the certificate the pkiEnvelope is encrypted to")
+		flCAKey     = cmd.String("ca-key", "", "PEM file with the key decrypting the pkiEnvelope")
+		flCAPass    = cmd.String("capass", "", "passwd for the ca.key or -ca-key")
+	)
+	cmd.Usage = func() {
+		fmt.Fprintln(cmd.Output(), "usage: scepserver inspect [<args>] <file>")
+		fmt.Fprintln(cmd.Output(), "file is a DER, PEM or base64 encoded PKIMessage, - for stdin")
+		cmd.PrintDefaults()
+	}
+	cmd.Parse(os.Args[2:])
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return 1
+	}
+	var (
+		data []byte
+		err  error
+	)
+	if path := cmd.Arg(0); path == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
 	if err != nil {
-		return err
+		fmt.Println(err)
+		return 1
 	}
-	defer file.Close()
-
-	if _, err := file.Write(pemCert(crtBytes)); err != nil {
-		file.Close()
-		os.Remove(name)
-		return err
+	der, err := scep.DecodeMessage(data)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	msg, err := scep.ParsePKIMessage(der, scep.WithStrictness(scep.Lenient))
+	if err != nil {
+		fmt.Println(err)
+		return 1
 	}
 
-	return nil
+	var (
+		crt *x509.Certificate
+		key crypto.Signer
+	)
+	if *flDepotPath != "" || *flCACert != "" || *flCAKey != "" {
+		var depot scepdepot.Depot
+		if *flDepotPath != "" {
+			if depot, err = openDepot(*flDepotType, *flDepotPath, false); err != nil {
+				fmt.Println(err)
+				return 1
+			}
+		}
+		crts, caKey, err := loadCA(depot, *flCACert, *flCAKey, []byte(*flCAPass))
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		crt, key = crts[0], caKey
+	}
+	if err := msg.Dump(os.Stdout, crt, key); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
 }
 
 const (
-	rsaPrivateKeyPEMBlockType = "RSA PRIVATE KEY"
-	certificatePEMBlockType   = "CERTIFICATE"
+	certificatePEMBlockType = "CERTIFICATE"
 )
 
 func pemCert(derBytes []byte) []byte {
@@ -275,6 +1101,80 @@ func pemCert(derBytes []byte) []byte {
 	return out
 }
 
+// parseDuplicates returns the depot signer option of the -duplicates action
+// and the comma separated -duplicate-check list.
+func parseDuplicates(action, check string) (scepdepot.Option, error) {
+	actions := map[string]scepdepot.DuplicateAction{
+		"reject":    scepdepot.RejectDuplicates,
+		"renew":     scepdepot.RenewDuplicates,
+		"supersede": scepdepot.SupersedeDuplicates,
+	}
+	a, ok := actions[action]
+	if !ok {
+		return nil, fmt.Errorf("unknown -duplicates action %q", action)
+	}
+	var duplicates scepdepot.Duplicates
+	for _, name := range strings.Split(check, ",") {
+		switch strings.TrimSpace(name) {
+		case "key":
+			duplicates |= scepdepot.DuplicateKeys
+		case "subject":
+			duplicates |= scepdepot.DuplicateSubjects
+		default:
+			return nil, fmt.Errorf("unknown -duplicate-check %q", name)
+		}
+	}
+	return scepdepot.WithDuplicates(duplicates, a), nil
+}
+
+// loadSigningPolicy returns the Policy of the JSON file at path.
+func loadSigningPolicy(path string) (*scepserver.Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return scepserver.LoadPolicy(f)
+}
+
+// loadRewrite returns the Rewrite of the JSON file at path.
+func loadRewrite(path string) (*scepdepot.Rewrite, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return scepdepot.LoadRewrite(f)
+}
+
+// loadPEMCerts returns the certificates of the PEM file at path.
+func loadPEMCerts(path string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != certificatePEMBlockType {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) < 1 {
+		return nil, fmt.Errorf("no certificate in %s", path)
+	}
+	return certs, nil
+}
+
 func envString(key, def string) string {
 	if env := os.Getenv(key); env != "" {
 		return env
@@ -288,3 +1188,45 @@ func envBool(key string) bool {
 	}
 	return false
 }
+
+func envInt(key string, def int) int {
+	env := os.Getenv(key)
+	if env == "" {
+		return def
+	}
+	n, err := strconv.Atoi(env)
+	if err != nil {
+		fmt.Printf("invalid %s: %v\n", key, err)
+		os.Exit(1)
+	}
+	return n
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	env := os.Getenv(key)
+	if env == "" {
+		return def
+	}
+	d, err := time.ParseDuration(env)
+	if err != nil {
+		fmt.Printf("invalid %s: %v\n", key, err)
+		os.Exit(1)
+	}
+	return d
+}
+
+// levelOption returns the filter of the -log-level name.
+func levelOption(name string) (level.Option, error) {
+	switch name {
+	case "debug":
+		return level.AllowDebug(), nil
+	case "info":
+		return level.AllowInfo(), nil
+	case "warn":
+		return level.AllowWarn(), nil
+	case "error":
+		return level.AllowError(), nil
+	default:
+		return nil, fmt.Errorf("unknown log level %q, want debug, info, warn or error", name)
+	}
+}
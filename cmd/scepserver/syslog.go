@@ -0,0 +1,18 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"log/syslog"
+
+	scepserver "github.com/micromdm/scep/v2/server"
+)
+
+func newSyslogAuditLogger() (scepserver.AuditLogger, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, "scepserver")
+	if err != nil {
+		return nil, err
+	}
+	return scepserver.NewSyslogAuditLogger(w), nil
+}
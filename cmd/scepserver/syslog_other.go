@@ -0,0 +1,14 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+
+	scepserver "github.com/micromdm/scep/v2/server"
+)
+
+func newSyslogAuditLogger() (scepserver.AuditLogger, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
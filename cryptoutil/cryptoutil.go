@@ -1,12 +1,15 @@
 package cryptoutil
 
 import (
+	"context"
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/asn1"
+	"io"
 
 	"github.com/pkg/errors"
 )
@@ -23,6 +26,9 @@ func GenerateSubjectKeyID(pub crypto.PublicKey) ([]byte, error) {
 			return nil, err
 		}
 	case *ecdsa.PublicKey:
+		if pub.Curve == nil || !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("invalid ECDSA public key")
+		}
 		pubBytes = elliptic.Marshal(pub.Curve, pub.X, pub.Y)
 	default:
 		return nil, errors.New("only ECDSA and RSA public keys are supported")
@@ -35,3 +41,37 @@ func GenerateSubjectKeyID(pub crypto.PublicKey) ([]byte, error) {
 	// subjectPublicKey (excluding the tag, length, and number of unused bits).
 	return hash[:20], nil
 }
+
+// SubjectKeyID returns the Subject Key Identifier of cert. If the
+// certificate does not carry a SubjectKeyId extension the identifier is
+// computed from the certificate public key with GenerateSubjectKeyID, so
+// that certificates with and without the extension can be matched the
+// same way.
+func SubjectKeyID(cert *x509.Certificate) ([]byte, error) {
+	if cert == nil {
+		return nil, errors.New("nil certificate")
+	}
+	if len(cert.SubjectKeyId) > 0 {
+		return cert.SubjectKeyId, nil
+	}
+	return GenerateSubjectKeyID(cert.PublicKey)
+}
+
+// ContextSigner is implemented by crypto.Signers which sign remotely, e.g.
+// with a KMS, and accept a context to bound or cancel the operation.
+type ContextSigner interface {
+	crypto.Signer
+	SignContext(ctx context.Context, rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error)
+}
+
+// SignContext signs digest with signer. If signer is a ContextSigner ctx is
+// passed on, otherwise it is only checked before signing.
+func SignContext(ctx context.Context, signer crypto.Signer, rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if cs, ok := signer.(ContextSigner); ok {
+		return cs.SignContext(ctx, rand, digest, opts)
+	}
+	return signer.Sign(rand, digest, opts)
+}
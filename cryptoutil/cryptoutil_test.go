@@ -4,18 +4,26 @@ import (
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"math/big"
 	"testing"
+	"time"
 )
 
 func TestGenerateSubjectKeyID(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
 	for _, test := range []struct {
 		testName string
 		pub      crypto.PublicKey
 	}{
 		{"RSA", &rsa.PublicKey{N: big.NewInt(123), E: 65537}},
-		{"ECDSA", &ecdsa.PublicKey{X: big.NewInt(123), Y: big.NewInt(123), Curve: elliptic.P224()}},
+		{"ECDSA", &ecKey.PublicKey},
 	} {
 		test := test
 		t.Run(test.testName, func(t *testing.T) {
@@ -38,6 +46,13 @@ func TestGenerateSubjectKeyID(t *testing.T) {
 	}
 }
 
+func TestGenerateSubjectKeyIDInvalidECDSA(t *testing.T) {
+	pub := &ecdsa.PublicKey{X: big.NewInt(123), Y: big.NewInt(123), Curve: elliptic.P224()}
+	if _, err := GenerateSubjectKeyID(pub); err == nil {
+		t.Fatal("expected error for point not on curve")
+	}
+}
+
 func testSKIEq(a, b []byte) bool {
 	if len(a) != len(b) {
 		return false
@@ -51,3 +66,54 @@ func testSKIEq(a, b []byte) bool {
 
 	return true
 }
+
+func TestSubjectKeyID(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	computed, err := GenerateSubjectKeyID(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	explicit := []byte{1, 2, 3, 4}
+
+	for _, test := range []struct {
+		testName string
+		ski      []byte
+		want     []byte
+	}{
+		{"missing SubjectKeyId extension", nil, computed},
+		{"SubjectKeyId extension", explicit, explicit},
+	} {
+		test := test
+		t.Run(test.testName, func(t *testing.T) {
+			t.Parallel()
+			tmpl := &x509.Certificate{
+				SerialNumber: big.NewInt(1),
+				Subject:      pkix.Name{CommonName: "ski test"},
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+				SubjectKeyId: test.ski,
+			}
+			der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.ski == nil && len(cert.SubjectKeyId) != 0 {
+				t.Fatal("expected certificate without SubjectKeyId extension")
+			}
+			ski, err := SubjectKeyID(cert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !testSKIEq(ski, test.want) {
+				t.Errorf("have %x, want %x", ski, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package cryptoutil
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+
+	"github.com/pkg/errors"
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// ParsePrivateKeyPEM parses the first PEM encoded private key of data:
+// a PKCS#1 "RSA PRIVATE KEY", SEC 1 "EC PRIVATE KEY" or PKCS#8 "PRIVATE
+// KEY", or a PKCS#8 "ENCRYPTED PRIVATE KEY" with PBES2. PKCS#1 and SEC 1
+// keys may be encrypted with the legacy OpenSSL Proc-Type and DEK-Info
+// headers, which are only read.
+// password is only used for encrypted keys.
+func ParsePrivateKeyPEM(data, password []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("PEM decode failed")
+	}
+	der := block.Bytes
+	if x509.IsEncryptedPEMBlock(block) {
+		var err error
+		if der, err = x509.DecryptPEMBlock(block, password); err != nil {
+			if err == x509.IncorrectPasswordError {
+				return nil, ErrIncorrectPassword
+			}
+			return nil, err
+		}
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(der)
+	case "PRIVATE KEY":
+		return parsePKCS8(der)
+	case "ENCRYPTED PRIVATE KEY":
+		return decryptPKCS8(der, password)
+	}
+	return nil, errors.Errorf("unsupported PEM block type %q", block.Type)
+}
+
+// MarshalPrivateKeyPEM returns the PEM block of an RSA or ECDSA private
+// key: a PKCS#1 "RSA PRIVATE KEY" or SEC 1 "EC PRIVATE KEY", the formats
+// read by ParsePrivateKeyPEM and OpenSSL alike. If password is not empty
+// the key is returned as a PKCS#8 "ENCRYPTED PRIVATE KEY" instead, with
+// PBES2 using PBKDF2-HMAC-SHA256 and AES-256-CBC.
+func MarshalPrivateKeyPEM(key crypto.Signer, password []byte) (*pem.Block, error) {
+	var block *pem.Block
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	default:
+		return nil, errors.Errorf("unsupported private key type %T", key)
+	}
+	if len(password) == 0 {
+		return block, nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	alg, encrypted, err := pbes2Encrypt(der, password)
+	if err != nil {
+		return nil, err
+	}
+	if der, err = asn1.Marshal(encryptedPrivateKeyInfo{Algorithm: alg, EncryptedData: encrypted}); err != nil {
+		return nil, err
+	}
+	return &pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}, nil
+}
+
+// decryptPKCS8 parses the PKCS#8 EncryptedPrivateKeyInfo der.
+func decryptPKCS8(der, password []byte) (crypto.Signer, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, errors.Wrap(err, "parsing encrypted private key")
+	}
+	der, err := pbes2Decrypt(info.Algorithm, info.EncryptedData, password)
+	if err != nil {
+		return nil, err
+	}
+	// a wrong password may still yield valid padding
+	if _, err := x509.ParsePKCS8PrivateKey(der); err != nil {
+		return nil, ErrIncorrectPassword
+	}
+	return parsePKCS8(der)
+}
+
+func parsePKCS8(der []byte) (crypto.Signer, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
@@ -0,0 +1,93 @@
+package cryptoutil
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParsePrivateKeyPEM(t *testing.T) {
+	cert := loadTestCert(t, "testdata/cert.pem")
+	for _, test := range []struct {
+		testName string
+		file     string
+	}{
+		{"encrypted PKCS#1", "testdata/key-pkcs1-enc.pem"},
+		{"encrypted PKCS#8", "testdata/key-pkcs8-enc.pem"},
+	} {
+		test := test
+		t.Run(test.testName, func(t *testing.T) {
+			t.Parallel()
+			data, err := ioutil.ReadFile(test.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := ParsePrivateKeyPEM(data, []byte("secret"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pub, err := x509.MarshalPKIXPublicKey(key.Public())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(pub, cert.RawSubjectPublicKeyInfo) {
+				t.Error("private key does not match the certificate")
+			}
+			if _, err := ParsePrivateKeyPEM(data, []byte("wrong")); !errors.Is(err, ErrIncorrectPassword) {
+				t.Errorf("want ErrIncorrectPassword for a wrong password, have %v", err)
+			}
+		})
+	}
+}
+
+func TestParsePrivateKeyPEMUnencrypted(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/ec-pkcs8.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParsePrivateKeyPEM(data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := key.(*ecdsa.PrivateKey); !ok {
+		t.Errorf("want *ecdsa.PrivateKey, have %T", key)
+	}
+}
+
+func TestMarshalPrivateKeyPEM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []crypto.Signer{rsaKey, ecKey} {
+		block, err := MarshalPrivateKeyPEM(key, []byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if block.Type != "ENCRYPTED PRIVATE KEY" || len(block.Headers) != 0 {
+			t.Errorf("%T: have PEM block %q with %d headers, want PKCS#8", key, block.Type, len(block.Headers))
+		}
+		parsed, err := ParsePrivateKeyPEM(pem.EncodeToMemory(block), []byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !parsed.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(key.Public()) {
+			t.Errorf("%T: parsed another key", key)
+		}
+		if _, err := ParsePrivateKeyPEM(pem.EncodeToMemory(block), []byte("wrong")); !errors.Is(err, ErrIncorrectPassword) {
+			t.Errorf("%T: want ErrIncorrectPassword for a wrong password, have %v", key, err)
+		}
+	}
+}
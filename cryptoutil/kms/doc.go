@@ -0,0 +1,9 @@
+// package kms adapts asymmetric signing keys of AWS KMS and Google Cloud
+// KMS to crypto.Signer, so that a CA key never leaves the cloud HSM. Use
+// them with depot.WithCA to sign issued certificates.
+//
+// The package does not import the cloud SDKs. Callers implement AWSClient
+// or GCPClient on top of the SDK of their choice. Neither service supports
+// PKCS #1 v1.5 decryption, so the keys can not decrypt SCEP pkiEnvelopes;
+// the SCEP service keypair remains a separate RA keypair.
+package kms
@@ -0,0 +1,116 @@
+package kms
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// AWSClient signs with AWS KMS asymmetric keys, e.g. by calling Sign of the
+// AWS SDK kms.Client with MessageType DIGEST.
+type AWSClient interface {
+	// Sign returns the signature of digest with the key keyID and the KMS
+	// SigningAlgorithm algorithm, e.g. "ECDSA_SHA_256".
+	Sign(ctx context.Context, keyID string, digest []byte, algorithm string) ([]byte, error)
+}
+
+// GCPClient signs with Google Cloud KMS asymmetric keys, e.g. by calling
+// AsymmetricSign of the Cloud KMS KeyManagementClient.
+type GCPClient interface {
+	// AsymmetricSign returns the signature of digest, computed with hash,
+	// with the CryptoKeyVersion name.
+	AsymmetricSign(ctx context.Context, name string, digest []byte, hash crypto.Hash) ([]byte, error)
+}
+
+// NewAWSKey returns the AWS KMS key keyID, whose public key is pub, as
+// returned by GetPublicKey and parsed with x509.ParsePKIXPublicKey.
+func NewAWSKey(client AWSClient, keyID string, pub crypto.PublicKey) (crypto.Signer, error) {
+	if err := checkPublicKey(pub); err != nil {
+		return nil, err
+	}
+	sign := func(ctx context.Context, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+		algorithm, err := awsSigningAlgorithm(pub, opts)
+		if err != nil {
+			return nil, err
+		}
+		return client.Sign(ctx, keyID, digest, algorithm)
+	}
+	return &key{pub: pub, sign: sign}, nil
+}
+
+// NewGCPKey returns the Cloud KMS CryptoKeyVersion name, whose public key is
+// pub, as returned by GetPublicKey and parsed with x509.ParsePKIXPublicKey.
+// The signature algorithm is a property of the key version; signing fails
+// if opts do not match it.
+func NewGCPKey(client GCPClient, name string, pub crypto.PublicKey) (crypto.Signer, error) {
+	if err := checkPublicKey(pub); err != nil {
+		return nil, err
+	}
+	sign := func(ctx context.Context, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+		return client.AsymmetricSign(ctx, name, digest, opts.HashFunc())
+	}
+	return &key{pub: pub, sign: sign}, nil
+}
+
+func checkPublicKey(pub crypto.PublicKey) error {
+	switch pub.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return nil
+	default:
+		return errors.Errorf("kms: unsupported public key type %T", pub)
+	}
+}
+
+type key struct {
+	pub  crypto.PublicKey
+	sign func(ctx context.Context, digest []byte, opts crypto.SignerOpts) ([]byte, error)
+}
+
+func (k *key) Public() crypto.PublicKey { return k.pub }
+
+// Sign signs digest with the KMS key. Both services return RSA signatures
+// as is and ECDSA signatures ASN.1 encoded, as expected by crypto.Signer.
+func (k *key) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.SignContext(context.Background(), rand, digest, opts)
+}
+
+// SignContext is like Sign but passes ctx to the KMS client, see
+// cryptoutil.ContextSigner.
+func (k *key) SignContext(ctx context.Context, _ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if len(digest) != opts.HashFunc().Size() {
+		return nil, errors.New("kms: digest length does not match hash function")
+	}
+	sig, err := k.sign(ctx, digest, opts)
+	return sig, errors.Wrap(err, "kms: sign")
+}
+
+// awsSigningAlgorithm returns the AWS KMS SigningAlgorithmSpec for pub and
+// opts. KMS supports neither SHA-1 nor PSS salts other than the hash length.
+func awsSigningAlgorithm(pub crypto.PublicKey, opts crypto.SignerOpts) (string, error) {
+	var suffix string
+	switch opts.HashFunc() {
+	case crypto.SHA256:
+		suffix = "SHA_256"
+	case crypto.SHA384:
+		suffix = "SHA_384"
+	case crypto.SHA512:
+		suffix = "SHA_512"
+	default:
+		return "", errors.Errorf("kms: unsupported hash function %s", opts.HashFunc())
+	}
+	if _, ok := pub.(*ecdsa.PublicKey); ok {
+		return "ECDSA_" + suffix, nil
+	}
+	pss, ok := opts.(*rsa.PSSOptions)
+	if !ok {
+		return "RSASSA_PKCS1_V1_5_" + suffix, nil
+	}
+	if pss.SaltLength != rsa.PSSSaltLengthEqualsHash && pss.SaltLength != opts.HashFunc().Size() {
+		return "", errors.New("kms: PSS salt length must equal the hash length")
+	}
+	return "RSASSA_PSS_" + suffix, nil
+}
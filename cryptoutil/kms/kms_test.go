@@ -0,0 +1,121 @@
+package kms
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// fakeAWS implements the AWS KMS signing algorithms with in-memory keys.
+type fakeAWS struct {
+	keys map[string]crypto.Signer
+}
+
+func (c *fakeAWS) Sign(_ context.Context, keyID string, digest []byte, algorithm string) ([]byte, error) {
+	key, ok := c.keys[keyID]
+	if !ok {
+		return nil, errors.New("NotFoundException")
+	}
+	hashes := map[string]crypto.Hash{"SHA_256": crypto.SHA256, "SHA_384": crypto.SHA384, "SHA_512": crypto.SHA512}
+	hash := hashes[algorithm[len(algorithm)-7:]]
+	switch {
+	case strings.HasPrefix(algorithm, "RSASSA_PKCS1_V1_5_"):
+		return key.Sign(rand.Reader, digest, hash)
+	case strings.HasPrefix(algorithm, "RSASSA_PSS_"):
+		return key.Sign(rand.Reader, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash})
+	case strings.HasPrefix(algorithm, "ECDSA_"):
+		return key.Sign(rand.Reader, digest, hash)
+	}
+	return nil, errors.Errorf("unknown algorithm %s", algorithm)
+}
+
+// fakeGCP signs with in-memory keys, PKCS #1 v1.5 for RSA keys.
+type fakeGCP struct {
+	keys map[string]crypto.Signer
+}
+
+func (c *fakeGCP) AsymmetricSign(_ context.Context, name string, digest []byte, hash crypto.Hash) ([]byte, error) {
+	key, ok := c.keys[name]
+	if !ok {
+		return nil, errors.New("NotFound")
+	}
+	return key.Sign(rand.Reader, digest, hash)
+}
+
+func TestKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aws := &fakeAWS{keys: map[string]crypto.Signer{"alias/rsa": rsaKey, "alias/ec": ecKey}}
+	gcp := &fakeGCP{keys: map[string]crypto.Signer{"rsa/cryptoKeyVersions/1": rsaKey, "ec/cryptoKeyVersions/1": ecKey}}
+
+	newKey := func(key crypto.Signer, err error) crypto.Signer {
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	awsRSA := newKey(NewAWSKey(aws, "alias/rsa", &rsaKey.PublicKey))
+	awsEC := newKey(NewAWSKey(aws, "alias/ec", &ecKey.PublicKey))
+	gcpRSA := newKey(NewGCPKey(gcp, "rsa/cryptoKeyVersions/1", &rsaKey.PublicKey))
+	gcpEC := newKey(NewGCPKey(gcp, "ec/cryptoKeyVersions/1", &ecKey.PublicKey))
+	for _, test := range []struct {
+		name   string
+		key    crypto.Signer
+		sigAlg x509.SignatureAlgorithm
+	}{
+		{"aws rsa", awsRSA, x509.SHA256WithRSA},
+		{"aws rsa pss", awsRSA, x509.SHA384WithRSAPSS},
+		{"aws ecdsa", awsEC, x509.ECDSAWithSHA256},
+		{"gcp rsa", gcpRSA, x509.SHA512WithRSA},
+		{"gcp ecdsa", gcpEC, x509.ECDSAWithSHA384},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tmpl := &x509.Certificate{
+				SerialNumber:          big.NewInt(1),
+				Subject:               pkix.Name{CommonName: test.name},
+				NotBefore:             time.Now().Add(-time.Hour),
+				NotAfter:              time.Now().Add(time.Hour),
+				IsCA:                  true,
+				BasicConstraintsValid: true,
+				KeyUsage:              x509.KeyUsageCertSign,
+				SignatureAlgorithm:    test.sigAlg,
+			}
+			der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, test.key.Public(), test.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			crt, err := x509.ParseCertificate(der)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := crt.CheckSignatureFrom(crt); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	digest := make([]byte, crypto.SHA1.Size())
+	if _, err := awsRSA.Sign(rand.Reader, digest, crypto.SHA1); err == nil {
+		t.Error("expected error for SHA-1 with AWS KMS")
+	}
+	if _, err := NewAWSKey(aws, "alias/ed", "not a key"); err == nil {
+		t.Error("expected error for unsupported public key")
+	}
+}
@@ -0,0 +1,7 @@
+// package pkcs11 adapts private keys held in PKCS#11 tokens such as HSMs
+// and YubiKeys to crypto.Signer, so that they can sign and decrypt SCEP
+// messages without exporting key material.
+//
+// The package does not link a PKCS#11 library. Callers implement Session
+// on top of the binding of their choice, e.g. github.com/miekg/pkcs11.
+package pkcs11
@@ -0,0 +1,120 @@
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"io"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+// Mechanism is a PKCS#11 CKM_* mechanism type.
+type Mechanism uint
+
+// Mechanisms used by the keys of this package.
+const (
+	// CKM_RSA_PKCS, raw PKCS #1 v1.5 signing and decryption.
+	MechanismRSAPKCS Mechanism = 0x00000001
+	// CKM_ECDSA, ECDSA signing of a precomputed digest.
+	MechanismECDSA Mechanism = 0x00001041
+)
+
+// Session is an open PKCS#11 session bound to a private key object.
+type Session interface {
+	// Sign runs C_SignInit and C_Sign on the private key with mechanism.
+	Sign(mechanism Mechanism, data []byte) ([]byte, error)
+
+	// Decrypt runs C_DecryptInit and C_Decrypt on the private key with
+	// mechanism.
+	Decrypt(mechanism Mechanism, ciphertext []byte) ([]byte, error)
+}
+
+// NewKey returns the private key of session, whose public key is pub. RSA
+// keys also implement crypto.Decrypter.
+func NewKey(session Session, pub crypto.PublicKey) (crypto.Signer, error) {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return &rsaKey{session: session, pub: pub}, nil
+	case *ecdsa.PublicKey:
+		return &ecdsaKey{session: session, pub: pub}, nil
+	default:
+		return nil, errors.Errorf("pkcs11: unsupported public key type %T", pub)
+	}
+}
+
+type rsaKey struct {
+	session Session
+	pub     *rsa.PublicKey
+}
+
+func (k *rsaKey) Public() crypto.PublicKey { return k.pub }
+
+// Sign signs digest with PKCS #1 v1.5. CKM_RSA_PKCS expects the DER
+// encoded DigestInfo rather than the bare digest.
+func (k *rsaKey) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return nil, errors.New("pkcs11: RSA-PSS signatures are not supported")
+	}
+	prefix, ok := digestInfoPrefix[opts.HashFunc()]
+	if !ok {
+		return nil, errors.Errorf("pkcs11: unsupported hash function %s", opts.HashFunc())
+	}
+	if len(digest) != opts.HashFunc().Size() {
+		return nil, errors.New("pkcs11: digest length does not match hash function")
+	}
+	return k.session.Sign(MechanismRSAPKCS, append(append([]byte{}, prefix...), digest...))
+}
+
+// Decrypt decrypts a PKCS #1 v1.5 encrypted ciphertext. Only nil or
+// *rsa.PKCS1v15DecryptOptions without a session key length are accepted.
+func (k *rsaKey) Decrypt(_ io.Reader, ciphertext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	switch opts := opts.(type) {
+	case nil:
+	case *rsa.PKCS1v15DecryptOptions:
+		if opts.SessionKeyLen > 0 {
+			return nil, errors.New("pkcs11: session key length is not supported")
+		}
+	default:
+		return nil, errors.Errorf("pkcs11: unsupported decrypter options %T", opts)
+	}
+	return k.session.Decrypt(MechanismRSAPKCS, ciphertext)
+}
+
+type ecdsaKey struct {
+	session Session
+	pub     *ecdsa.PublicKey
+}
+
+func (k *ecdsaKey) Public() crypto.PublicKey { return k.pub }
+
+// Sign signs digest with CKM_ECDSA and converts the raw r || s signature
+// returned by the token to the ASN.1 encoding expected by crypto.Signer.
+func (k *ecdsaKey) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	sig, err := k.session.Sign(MechanismECDSA, digest)
+	if err != nil {
+		return nil, err
+	}
+	size := (k.pub.Curve.Params().BitSize + 7) / 8
+	if len(sig) != 2*size {
+		return nil, errors.Errorf("pkcs11: invalid ECDSA signature length %d", len(sig))
+	}
+	return asn1.Marshal(struct {
+		R, S *big.Int
+	}{
+		R: new(big.Int).SetBytes(sig[:size]),
+		S: new(big.Int).SetBytes(sig[size:]),
+	})
+}
+
+// digestInfoPrefix is the DER encoded DigestInfo up to the digest, see
+// RFC 8017 section 9.2.
+var digestInfoPrefix = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA224: {0x30, 0x2d, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x04, 0x05, 0x00, 0x04, 0x1c},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
@@ -0,0 +1,105 @@
+package pkcs11
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// softSession implements the PKCS#11 mechanisms with an in-memory key.
+type softSession struct {
+	key crypto.Signer
+}
+
+func (s *softSession) Sign(mechanism Mechanism, data []byte) ([]byte, error) {
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		if mechanism != MechanismRSAPKCS {
+			return nil, errors.New("CKR_MECHANISM_INVALID")
+		}
+		// a zero hash signs the DigestInfo as is
+		return rsa.SignPKCS1v15(rand.Reader, key, 0, data)
+	case *ecdsa.PrivateKey:
+		if mechanism != MechanismECDSA {
+			return nil, errors.New("CKR_MECHANISM_INVALID")
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, key, data)
+		if err != nil {
+			return nil, err
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...), nil
+	}
+	return nil, errors.New("CKR_KEY_TYPE_INCONSISTENT")
+}
+
+func (s *softSession) Decrypt(mechanism Mechanism, ciphertext []byte) ([]byte, error) {
+	key, ok := s.key.(*rsa.PrivateKey)
+	if !ok || mechanism != MechanismRSAPKCS {
+		return nil, errors.New("CKR_MECHANISM_INVALID")
+	}
+	return rsa.DecryptPKCS1v15(rand.Reader, key, ciphertext)
+}
+
+func TestRSAKey(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := NewKey(&softSession{key: priv}, &priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256([]byte("SCEP"))
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPKCS1v15(&priv.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		t.Error(err)
+	}
+	if _, err := key.Sign(rand.Reader, digest[:], &rsa.PSSOptions{Hash: crypto.SHA256}); err == nil {
+		t.Error("expected error for RSA-PSS")
+	}
+
+	ciphertext, err := rsa.EncryptPKCS1v15(rand.Reader, &priv.PublicKey, []byte("content key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := key.(crypto.Decrypter).Decrypt(rand.Reader, ciphertext, &rsa.PKCS1v15DecryptOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, []byte("content key")) {
+		t.Errorf("have %q, want %q", plaintext, "content key")
+	}
+}
+
+func TestECDSAKey(t *testing.T) {
+	for _, curve := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := NewKey(&softSession{key: priv}, &priv.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest := sha256.Sum256([]byte("SCEP"))
+		sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ecdsa.VerifyASN1(&priv.PublicKey, digest[:], sig) {
+			t.Errorf("%s: invalid signature", curve.Params().Name)
+		}
+	}
+}
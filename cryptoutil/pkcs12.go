@@ -0,0 +1,79 @@
+package cryptoutil
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/pkcs12"
+)
+
+// ParsePKCS12 parses the private key and certificates of the PKCS#12
+// bundle data, e.g. a .p12 or .pfx file exported from an MDM, the macOS
+// keychain or an HSM. It returns the key, the certificate for the key and
+// the other certificates of the bundle, usually its CA chain.
+//
+// Bundles are decoded with golang.org/x/crypto/pkcs12, which supports the
+// 3DES and RC2 password based encryption of PKCS#12 and a SHA-1 MAC. The
+// PBES2 bundles exported by OpenSSL 3 by default must be exported with
+// -legacy instead. The integrity of the bundle is always verified with its
+// MAC, bundles without one are rejected.
+func ParsePKCS12(data []byte, password string) (crypto.Signer, *x509.Certificate, []*x509.Certificate, error) {
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err == pkcs12.ErrIncorrectPassword || err == pkcs12.ErrDecryption {
+		return nil, nil, nil, ErrIncorrectPassword
+	} else if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "parsing PKCS#12")
+	}
+	var (
+		key   crypto.Signer
+		certs []*x509.Certificate
+	)
+	for _, block := range blocks {
+		switch block.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			certs = append(certs, cert)
+		case "PRIVATE KEY", "EC PRIVATE KEY":
+			if key != nil {
+				return nil, nil, nil, errors.New("PKCS#12 contains more than one private key")
+			}
+			// ToPEM encodes RSA keys as PKCS#1 despite the block type
+			if block.Type == "PRIVATE KEY" {
+				key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+			} else {
+				key, err = x509.ParseECPrivateKey(block.Bytes)
+			}
+			if err != nil {
+				return nil, nil, nil, err
+			}
+		}
+	}
+	if key == nil {
+		return nil, nil, nil, errors.New("PKCS#12 contains no private key")
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var (
+		leaf    *x509.Certificate
+		caCerts []*x509.Certificate
+	)
+	for _, cert := range certs {
+		if leaf == nil && bytes.Equal(cert.RawSubjectPublicKeyInfo, pub) {
+			leaf = cert
+			continue
+		}
+		caCerts = append(caCerts, cert)
+	}
+	if leaf == nil {
+		return nil, nil, nil, errors.New("PKCS#12 contains no certificate for the private key")
+	}
+	return key, leaf, caCerts, nil
+}
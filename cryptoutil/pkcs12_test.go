@@ -0,0 +1,92 @@
+package cryptoutil
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParsePKCS12(t *testing.T) {
+	cert := loadTestCert(t, "testdata/cert.pem")
+	for _, test := range []struct {
+		testName string
+		file     string
+		password string
+		caCerts  int
+	}{
+		{"3DES key and RC2 certificates", "testdata/legacy.p12", "secret", 1},
+	} {
+		test := test
+		t.Run(test.testName, func(t *testing.T) {
+			t.Parallel()
+			data, err := ioutil.ReadFile(test.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, leaf, caCerts, err := ParsePKCS12(data, test.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !leaf.Equal(cert) {
+				t.Errorf("unexpected certificate %s", leaf.Subject)
+			}
+			pub, err := x509.MarshalPKIXPublicKey(key.Public())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(pub, cert.RawSubjectPublicKeyInfo) {
+				t.Error("private key does not match the certificate")
+			}
+			if len(caCerts) != test.caCerts {
+				t.Fatalf("want %d CA certificates, have %d", test.caCerts, len(caCerts))
+			}
+			for _, ca := range caCerts {
+				if err := cert.CheckSignatureFrom(ca); err != nil {
+					t.Error(err)
+				}
+			}
+
+			if _, _, _, err := ParsePKCS12(data, "wrong"); !errors.Is(err, ErrIncorrectPassword) {
+				t.Errorf("want ErrIncorrectPassword for a wrong password, have %v", err)
+			}
+		})
+	}
+}
+
+func TestParsePKCS12Unsupported(t *testing.T) {
+	for _, test := range []struct {
+		testName string
+		file     string
+	}{
+		{"PBES2 AES", "testdata/modern.p12"},
+		{"without MAC", "testdata/nomac.p12"},
+	} {
+		data, err := ioutil.ReadFile(test.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := ParsePKCS12(data, "secret"); err == nil {
+			t.Errorf("%s: parsed an unsupported PKCS#12 bundle", test.testName)
+		}
+	}
+}
+
+func loadTestCert(t *testing.T, path string) *x509.Certificate {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("%s: PEM decode failed", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
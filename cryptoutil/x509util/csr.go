@@ -0,0 +1,174 @@
+package x509util
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"net/url"
+)
+
+var (
+	oidExtensionKeyUsage    = asn1.ObjectIdentifier{2, 5, 29, 15}
+	oidExtensionExtKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37}
+)
+
+var extKeyUsageOIDs = map[x509.ExtKeyUsage]asn1.ObjectIdentifier{
+	x509.ExtKeyUsageAny:             {2, 5, 29, 37, 0},
+	x509.ExtKeyUsageServerAuth:      {1, 3, 6, 1, 5, 5, 7, 3, 1},
+	x509.ExtKeyUsageClientAuth:      {1, 3, 6, 1, 5, 5, 7, 3, 2},
+	x509.ExtKeyUsageCodeSigning:     {1, 3, 6, 1, 5, 5, 7, 3, 3},
+	x509.ExtKeyUsageEmailProtection: {1, 3, 6, 1, 5, 5, 7, 3, 4},
+	x509.ExtKeyUsageIPSECEndSystem:  {1, 3, 6, 1, 5, 5, 7, 3, 5},
+	x509.ExtKeyUsageIPSECTunnel:     {1, 3, 6, 1, 5, 5, 7, 3, 6},
+	x509.ExtKeyUsageIPSECUser:       {1, 3, 6, 1, 5, 5, 7, 3, 7},
+	x509.ExtKeyUsageTimeStamping:    {1, 3, 6, 1, 5, 5, 7, 3, 8},
+	x509.ExtKeyUsageOCSPSigning:     {1, 3, 6, 1, 5, 5, 7, 3, 9},
+}
+
+// CSR builds a certificate request for SCEP enrollment: the subject, the
+// challengePassword attribute and an extensionRequest attribute with the
+// subject alternative names and key usages.
+type CSR struct {
+	template    CertificateRequest
+	keyUsage    x509.KeyUsage
+	extKeyUsage []x509.ExtKeyUsage
+	extensions  []pkix.Extension
+}
+
+// NewCSR creates a new CSR for subject with options.
+func NewCSR(subject pkix.Name, opts ...CSROption) *CSR {
+	c := &CSR{}
+	c.template.Subject = subject
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+type CSROption func(*CSR)
+
+// WithChallengePassword specifies the challengePassword attribute.
+func WithChallengePassword(password string) CSROption {
+	return func(c *CSR) {
+		c.template.ChallengePassword = password
+	}
+}
+
+// WithDNSNames adds DNS subject alternative names.
+func WithDNSNames(names ...string) CSROption {
+	return func(c *CSR) {
+		c.template.DNSNames = append(c.template.DNSNames, names...)
+	}
+}
+
+// WithEmailAddresses adds email subject alternative names.
+func WithEmailAddresses(addresses ...string) CSROption {
+	return func(c *CSR) {
+		c.template.EmailAddresses = append(c.template.EmailAddresses, addresses...)
+	}
+}
+
+// WithIPAddresses adds IP address subject alternative names.
+func WithIPAddresses(ips ...net.IP) CSROption {
+	return func(c *CSR) {
+		c.template.IPAddresses = append(c.template.IPAddresses, ips...)
+	}
+}
+
+// WithURIs adds URI subject alternative names.
+func WithURIs(uris ...*url.URL) CSROption {
+	return func(c *CSR) {
+		c.template.URIs = append(c.template.URIs, uris...)
+	}
+}
+
+// WithKeyUsage requests the X.509 Key Usage.
+func WithKeyUsage(usage x509.KeyUsage) CSROption {
+	return func(c *CSR) {
+		c.keyUsage = usage
+	}
+}
+
+// WithExtKeyUsage requests the X.509 Extended Key Usages.
+func WithExtKeyUsage(usages ...x509.ExtKeyUsage) CSROption {
+	return func(c *CSR) {
+		c.extKeyUsage = append(c.extKeyUsage, usages...)
+	}
+}
+
+// WithExtensions adds exts to the extensionRequest attribute, e.g. the
+// extension of a scep.TPMAttestation.
+func WithExtensions(exts ...pkix.Extension) CSROption {
+	return func(c *CSR) {
+		c.extensions = append(c.extensions, exts...)
+	}
+}
+
+// WithSignatureAlgorithm specifies the signature algorithm of the CSR. By
+// default it is chosen from the key type.
+func WithSignatureAlgorithm(alg x509.SignatureAlgorithm) CSROption {
+	return func(c *CSR) {
+		c.template.SignatureAlgorithm = alg
+	}
+}
+
+// Create returns the DER encoded CSR signed by key, ready to be parsed
+// and passed to scep.NewCSRRequest.
+func (c *CSR) Create(rand io.Reader, key crypto.Signer) ([]byte, error) {
+	template := c.template
+	template.ExtraExtensions = nil
+	if c.keyUsage != 0 {
+		ext, err := marshalKeyUsage(c.keyUsage)
+		if err != nil {
+			return nil, err
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, ext)
+	}
+	if len(c.extKeyUsage) > 0 {
+		ext, err := marshalExtKeyUsage(c.extKeyUsage)
+		if err != nil {
+			return nil, err
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, ext)
+	}
+	template.ExtraExtensions = append(template.ExtraExtensions, c.extensions...)
+	return CreateCertificateRequest(rand, &template, key)
+}
+
+// marshalKeyUsage encodes the key usage extension like the x509 package
+// does for certificates.
+func marshalKeyUsage(usage x509.KeyUsage) (pkix.Extension, error) {
+	b := []byte{bits.Reverse8(byte(usage)), bits.Reverse8(byte(usage >> 8))}
+	if b[1] == 0 {
+		b = b[:1]
+	}
+	value, err := asn1.Marshal(asn1.BitString{
+		Bytes:     b,
+		BitLength: len(b)*8 - bits.TrailingZeros8(b[len(b)-1]),
+	})
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidExtensionKeyUsage, Critical: true, Value: value}, nil
+}
+
+func marshalExtKeyUsage(usages []x509.ExtKeyUsage) (pkix.Extension, error) {
+	oids := make([]asn1.ObjectIdentifier, 0, len(usages))
+	for _, usage := range usages {
+		oid, ok := extKeyUsageOIDs[usage]
+		if !ok {
+			return pkix.Extension{}, fmt.Errorf("x509util: unsupported extended key usage %d", usage)
+		}
+		oids = append(oids, oid)
+	}
+	value, err := asn1.Marshal(oids)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	return pkix.Extension{Id: oidExtensionExtKeyUsage, Value: value}, nil
+}
@@ -0,0 +1,90 @@
+package x509util
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewCSR(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage := x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
+	extra := pkix.Extension{Id: asn1.ObjectIdentifier{2, 23, 133, 20, 1}, Value: []byte{0x30, 0x00}}
+	der, err := NewCSR(pkix.Name{CommonName: "device-1"},
+		WithChallengePassword("secret"),
+		WithDNSNames("device-1.example.com"),
+		WithIPAddresses(net.IPv4(192, 0, 2, 1)),
+		WithKeyUsage(usage),
+		WithExtKeyUsage(x509.ExtKeyUsageClientAuth),
+		WithExtensions(extra),
+	).Create(rand.Reader, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		t.Fatal(err)
+	}
+	if challenge, err := ParseChallengePassword(der); err != nil || challenge != "secret" {
+		t.Errorf("have challenge %q, err %v", challenge, err)
+	}
+	if len(csr.DNSNames) != 1 || csr.DNSNames[0] != "device-1.example.com" || len(csr.IPAddresses) != 1 {
+		t.Errorf("have SANs %v %v", csr.DNSNames, csr.IPAddresses)
+	}
+
+	// the key usage is encoded like in certificates
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     usage,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []byte
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidExtensionKeyUsage) {
+			want = ext.Value
+		}
+	}
+	var found, foundEKU, foundExtra bool
+	for _, ext := range csr.Extensions {
+		switch {
+		case ext.Id.Equal(oidExtensionKeyUsage):
+			found = true
+			if !bytes.Equal(ext.Value, want) {
+				t.Errorf("have key usage %x, want %x", ext.Value, want)
+			}
+		case ext.Id.Equal(oidExtensionExtKeyUsage):
+			foundEKU = true
+		case ext.Id.Equal(extra.Id):
+			foundExtra = bytes.Equal(ext.Value, extra.Value)
+		}
+	}
+	if !found || !foundEKU {
+		t.Error("CSR is missing the key usage extensions")
+	}
+	if !foundExtra {
+		t.Error("CSR is missing the extra extension")
+	}
+}
@@ -0,0 +1,91 @@
+package x509util
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// OIDSmartcardLogon is the Microsoft smart card logon extended key usage,
+// which Windows requires of certificates for smart card logon.
+var OIDSmartcardLogon = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 2}
+
+// extKeyUsageNames are the RFC 5280 names of the extended key usages.
+var extKeyUsageNames = map[string]asn1.ObjectIdentifier{
+	"any":             extKeyUsageOIDs[x509.ExtKeyUsageAny],
+	"serverAuth":      extKeyUsageOIDs[x509.ExtKeyUsageServerAuth],
+	"clientAuth":      extKeyUsageOIDs[x509.ExtKeyUsageClientAuth],
+	"codeSigning":     extKeyUsageOIDs[x509.ExtKeyUsageCodeSigning],
+	"emailProtection": extKeyUsageOIDs[x509.ExtKeyUsageEmailProtection],
+	"ipsecEndSystem":  extKeyUsageOIDs[x509.ExtKeyUsageIPSECEndSystem],
+	"ipsecTunnel":     extKeyUsageOIDs[x509.ExtKeyUsageIPSECTunnel],
+	"ipsecUser":       extKeyUsageOIDs[x509.ExtKeyUsageIPSECUser],
+	"timeStamping":    extKeyUsageOIDs[x509.ExtKeyUsageTimeStamping],
+	"OCSPSigning":     extKeyUsageOIDs[x509.ExtKeyUsageOCSPSigning],
+	"smartcardLogon":  OIDSmartcardLogon,
+}
+
+// ParseExtKeyUsageOID returns the OID of an extended key usage given by its
+// RFC 5280 name, e.g. "clientAuth", "smartcardLogon", or in dotted
+// notation, e.g. "1.3.6.1.5.5.7.3.2".
+func ParseExtKeyUsageOID(s string) (asn1.ObjectIdentifier, error) {
+	if oid, ok := extKeyUsageNames[s]; ok {
+		return oid, nil
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("x509util: unknown extended key usage %q", s)
+	}
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("x509util: unknown extended key usage %q", s)
+		}
+		oid[i] = n
+	}
+	return oid, nil
+}
+
+// ParseExtKeyUsage parses extended key usages like ParseExtKeyUsageOID and
+// splits them into the ones known to crypto/x509, for the ExtKeyUsage of a
+// certificate template, and the other OIDs, for its UnknownExtKeyUsage.
+func ParseExtKeyUsage(names []string) ([]x509.ExtKeyUsage, []asn1.ObjectIdentifier, error) {
+	var usages []x509.ExtKeyUsage
+	var unknown []asn1.ObjectIdentifier
+names:
+	for _, name := range names {
+		oid, err := ParseExtKeyUsageOID(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		for usage, known := range extKeyUsageOIDs {
+			if oid.Equal(known) {
+				usages = append(usages, usage)
+				continue names
+			}
+		}
+		unknown = append(unknown, oid)
+	}
+	return usages, unknown, nil
+}
+
+// RequestedExtKeyUsage returns the extended key usages requested in the
+// extensionRequest attribute of csr.
+func RequestedExtKeyUsage(csr *x509.CertificateRequest) ([]asn1.ObjectIdentifier, error) {
+	for _, ext := range csr.Extensions {
+		if !ext.Id.Equal(oidExtensionExtKeyUsage) {
+			continue
+		}
+		var oids []asn1.ObjectIdentifier
+		if rest, err := asn1.Unmarshal(ext.Value, &oids); err != nil {
+			return nil, fmt.Errorf("x509util: parse extended key usage: %w", err)
+		} else if len(rest) > 0 {
+			return nil, fmt.Errorf("x509util: trailing data after extended key usage")
+		}
+		return oids, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,54 @@
+package x509util
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"reflect"
+	"testing"
+)
+
+func TestParseExtKeyUsage(t *testing.T) {
+	usages, oids, err := ParseExtKeyUsage([]string{"clientAuth", "1.3.6.1.5.5.7.3.4", "smartcardLogon", "1.2.3.4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageEmailProtection}; !reflect.DeepEqual(usages, want) {
+		t.Errorf("usages = %v, want %v", usages, want)
+	}
+	if want := []asn1.ObjectIdentifier{OIDSmartcardLogon, {1, 2, 3, 4}}; !reflect.DeepEqual(oids, want) {
+		t.Errorf("OIDs = %v, want %v", oids, want)
+	}
+	for _, name := range []string{"clientauth", "1", "1.2.x", "1.-2"} {
+		if _, err := ParseExtKeyUsageOID(name); err == nil {
+			t.Errorf("expected an error for %q", name)
+		}
+	}
+}
+
+func TestRequestedExtKeyUsage(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := NewCSR(pkix.Name{CommonName: "device-1"},
+		WithExtKeyUsage(x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageIPSECTunnel),
+	).Create(rand.Reader, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oids, err := RequestedExtKeyUsage(csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []asn1.ObjectIdentifier{{1, 3, 6, 1, 5, 5, 7, 3, 2}, {1, 3, 6, 1, 5, 5, 7, 3, 6}}
+	if !reflect.DeepEqual(oids, want) {
+		t.Errorf("OIDs = %v, want %v", oids, want)
+	}
+}
@@ -137,6 +137,41 @@ func ParseChallengePassword(asn1Data []byte) (string, error) {
 	return password, nil
 }
 
+// RemoveChallengePassword returns the DER encoded Certificate Signing
+// Request asn1Data without its challengePassword attribute. The original
+// signature is kept, so the result no longer verifies: it is meant to be
+// stored or logged, not to be verified or signed again.
+func RemoveChallengePassword(asn1Data []byte) ([]byte, error) {
+	type attribute struct {
+		ID    asn1.ObjectIdentifier
+		Value asn1.RawValue `asn1:"set"`
+	}
+	var csr certificateRequest
+	rest, err := asn1.Unmarshal(asn1Data, &csr)
+	if err != nil {
+		return nil, err
+	} else if len(rest) != 0 {
+		return nil, asn1.SyntaxError{Msg: "trailing data"}
+	}
+
+	attrs := csr.TBSCSR.RawAttributes[:0]
+	for _, rawAttr := range csr.TBSCSR.RawAttributes {
+		var attr attribute
+		if _, err := asn1.Unmarshal(rawAttr.FullBytes, &attr); err != nil {
+			return nil, err
+		}
+		if !attr.ID.Equal(oidChallengePassword) {
+			attrs = append(attrs, rawAttr)
+		}
+	}
+	csr.TBSCSR.RawAttributes = attrs
+
+	// clear the raw encodings so the modified structures are marshaled
+	csr.Raw = nil
+	csr.TBSCSR.Raw = nil
+	return asn1.Marshal(csr)
+}
+
 // addChallenge takes a raw CSR created by x509.CreateCertificateRequest,
 // adds a passwordChallengeAttribute and re-signs the raw CSR bytes.
 func addChallenge(
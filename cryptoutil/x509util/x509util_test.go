@@ -48,3 +48,43 @@ func TestCreateCertificateRequest(t *testing.T) {
 		t.Errorf("have %s, want %s", have, want)
 	}
 }
+
+func TestRemoveChallengePassword(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := CertificateRequest{
+		CertificateRequest: x509.CertificateRequest{
+			Subject:  pkix.Name{CommonName: "test.acme.co"},
+			DNSNames: []string{"test.acme.co"},
+		},
+		ChallengePassword: "foobar",
+	}
+	derBytes, err := CreateCertificateRequest(rand.Reader, &template, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sanitized, err := RemoveChallengePassword(derBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, err := ParseChallengePassword(sanitized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if challenge != "" {
+		t.Errorf("challengePassword %q not removed", challenge)
+	}
+	out, err := x509.ParseCertificateRequest(sanitized)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := out.Subject.CommonName, template.Subject.CommonName; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if len(out.DNSNames) != 1 || out.DNSNames[0] != "test.acme.co" {
+		t.Errorf("have DNSNames %v, want [test.acme.co]", out.DNSNames)
+	}
+}
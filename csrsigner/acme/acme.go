@@ -0,0 +1,213 @@
+// Package acmecsrsigner defines a scepserver.CSRSigner which issues
+// certificates by ordering them from an ACME (RFC 8555) server, typically
+// an internal CA which pre-validates the identifiers of its accounts or
+// validates them with a challenge provisioned by a Solver.
+package acmecsrsigner
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+	scepserver "github.com/micromdm/scep/v2/server"
+	"golang.org/x/crypto/acme"
+)
+
+// Solver provisions the response to chal, e.g. the dns-01 TXT record or the
+// http-01 resource of client.HTTP01ChallengeResponse, before the challenge
+// is accepted. The returned cleanup function is called once the
+// authorization is finished.
+type Solver func(ctx context.Context, client *acme.Client, id acme.AuthzID, chal *acme.Challenge) (cleanup func(), err error)
+
+// Signer orders a certificate for each CSR from an ACME server.
+type Signer struct {
+	client  *acme.Client
+	account *acme.Account
+	chType  string
+	solver  Solver
+	timeout time.Duration
+
+	mu         sync.Mutex
+	registered bool
+}
+
+// Option configures a Signer.
+type Option func(*Signer)
+
+// WithChallengeType sets the type of the challenges accepted for pending
+// authorizations, e.g. "dns-01". The default is "http-01".
+func WithChallengeType(typ string) Option {
+	return func(s *Signer) {
+		s.chType = typ
+	}
+}
+
+// WithSolver provisions the challenges before they are accepted. Without a
+// Solver the server must validate the challenges by other means.
+func WithSolver(solver Solver) Option {
+	return func(s *Signer) {
+		s.solver = solver
+	}
+}
+
+// WithContact sets the contact URLs of the account, e.g.
+// "mailto:pki@example.com".
+func WithContact(contact ...string) Option {
+	return func(s *Signer) {
+		s.account.Contact = contact
+	}
+}
+
+// WithExternalAccountBinding binds the account to the key identifier kid
+// and MAC key of the CA, as many internal CAs require.
+func WithExternalAccountBinding(kid string, key []byte) Option {
+	return func(s *Signer) {
+		s.account.ExternalAccountBinding = &acme.ExternalAccountBinding{KID: kid, Key: key}
+	}
+}
+
+// WithTimeout bounds the time an order may take, including the validation
+// of its authorizations. The default is two minutes.
+func WithTimeout(timeout time.Duration) Option {
+	return func(s *Signer) {
+		s.timeout = timeout
+	}
+}
+
+// New creates a Signer ordering certificates from the ACME server of
+// directoryURL with the account of key. The account is registered, or
+// looked up if it exists, on the first enrollment.
+func New(directoryURL string, key crypto.Signer, opts ...Option) (*Signer, error) {
+	if directoryURL == "" || key == nil {
+		return nil, errors.New("ACME directory URL and account key are required")
+	}
+	s := &Signer{
+		client:  &acme.Client{DirectoryURL: directoryURL, Key: key},
+		account: &acme.Account{},
+		chType:  "http-01",
+		timeout: 2 * time.Minute,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// SignCSR orders a certificate for the DNS names and IP addresses of the
+// CSR of m. Problems reported by the ACME server are returned as a
+// *scepserver.FailInfoError with the badRequest failInfo.
+func (s *Signer) SignCSR(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+	var ids []acme.AuthzID
+	ids = append(ids, acme.DomainIDs(m.CSR.DNSNames...)...)
+	for _, ip := range m.CSR.IPAddresses {
+		ids = append(ids, acme.IPIDs(ip.String())...)
+	}
+	if len(ids) == 0 {
+		err := errors.New("CSR has no DNS name or IP address")
+		return nil, &scepserver.FailInfoError{FailInfo: scep.BadRequest, Text: err.Error(), Err: err}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	crt, err := s.order(ctx, ids, m.CSR.Raw)
+	if err != nil {
+		return nil, acmeFailure(err)
+	}
+	return crt, nil
+}
+
+func (s *Signer) order(ctx context.Context, ids []acme.AuthzID, csr []byte) (*x509.Certificate, error) {
+	if err := s.register(ctx); err != nil {
+		return nil, err
+	}
+	order, err := s.client.AuthorizeOrder(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, url := range order.AuthzURLs {
+		if err := s.authorize(ctx, url); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := s.client.WaitOrder(ctx, order.URI); err != nil {
+		return nil, err
+	}
+	der, _, err := s.client.CreateOrderCert(ctx, order.FinalizeURL, csr, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(der) == 0 {
+		return nil, errors.New("acme: no certificate issued")
+	}
+	return x509.ParseCertificate(der[0])
+}
+
+// register creates the account, or looks up the existing one of the key.
+func (s *Signer) register(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.registered {
+		return nil
+	}
+	_, err := s.client.Register(ctx, s.account, acme.AcceptTOS)
+	if err != nil && !errors.Is(err, acme.ErrAccountAlreadyExists) {
+		return fmt.Errorf("acme: register account: %w", err)
+	}
+	s.registered = true
+	return nil
+}
+
+// authorize accepts a challenge of a pending authorization and waits for
+// it to become valid.
+func (s *Signer) authorize(ctx context.Context, url string) error {
+	authz, err := s.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return err
+	}
+	if authz.Status == acme.StatusValid {
+		return nil
+	}
+	var chal *acme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == s.chType {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("acme: no %s challenge for %s", s.chType, authz.Identifier.Value)
+	}
+	if s.solver != nil {
+		cleanup, err := s.solver(ctx, s.client, authz.Identifier, chal)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+	}
+	if _, err := s.client.Accept(ctx, chal); err != nil {
+		return err
+	}
+	_, err = s.client.WaitAuthorization(ctx, url)
+	return err
+}
+
+// acmeFailure wraps the problems of the ACME server, which are caused by
+// the request, in a FailInfoError.
+func acmeFailure(err error) error {
+	var (
+		acmeErr  *acme.Error
+		authzErr *acme.AuthorizationError
+		orderErr *acme.OrderError
+	)
+	switch {
+	case errors.As(err, &acmeErr):
+		return &scepserver.FailInfoError{FailInfo: scep.BadRequest, Text: acmeErr.Detail, Err: err}
+	case errors.As(err, &authzErr), errors.As(err, &orderErr):
+		return &scepserver.FailInfoError{FailInfo: scep.BadRequest, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,225 @@
+package acmecsrsigner
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+	scepserver "github.com/micromdm/scep/v2/server"
+	"golang.org/x/crypto/acme"
+)
+
+// fakeACME is a minimal stand-in for an ACME server. JWS signatures are not
+// verified.
+type fakeACME struct {
+	t        *testing.T
+	url      string
+	ca       *x509.Certificate
+	caKey    *ecdsa.PrivateKey
+	accepted []string
+	authz    string
+	cert     []byte
+	reject   bool
+}
+
+func (f *fakeACME) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Replay-Nonce", "nonce")
+	w.Header().Set("Content-Type", "application/json")
+	order := map[string]interface{}{
+		"status":         "pending",
+		"identifiers":    []acme.AuthzID{{Type: "dns", Value: "device.example.com"}},
+		"authorizations": []string{f.url + "/authz"},
+		"finalize":       f.url + "/finalize",
+	}
+	switch r.URL.Path {
+	case "/directory":
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   f.url + "/nonce",
+			"newAccount": f.url + "/account",
+			"newOrder":   f.url + "/order",
+		})
+	case "/nonce":
+	case "/account":
+		w.Header().Set("Location", f.url+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"status":"valid"}`))
+	case "/order":
+		if f.reject {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"type":"urn:ietf:params:acme:error:rejectedIdentifier","detail":"not allowed"}`))
+			return
+		}
+		w.Header().Set("Location", f.url+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(order)
+	case "/order/1":
+		order["status"] = "ready"
+		json.NewEncoder(w).Encode(order)
+	case "/authz":
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":     f.authz,
+			"identifier": acme.AuthzID{Type: "dns", Value: "device.example.com"},
+			"challenges": []map[string]string{
+				{"type": "http-01", "url": f.url + "/chal/http", "token": "t1", "status": "pending"},
+				{"type": "dns-01", "url": f.url + "/chal/dns", "token": "t2", "status": "pending"},
+			},
+		})
+	case "/chal/http", "/chal/dns":
+		f.accepted = append(f.accepted, r.URL.Path)
+		f.authz = "valid"
+		w.Write([]byte(`{"type":"dns-01","status":"processing"}`))
+	case "/finalize":
+		var jws struct{ Payload string }
+		if err := json.NewDecoder(r.Body).Decode(&jws); err != nil {
+			f.t.Fatal(err)
+		}
+		payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		var req struct{ CSR string }
+		if err := json.Unmarshal(payload, &req); err != nil {
+			f.t.Fatal(err)
+		}
+		der, err := base64.RawURLEncoding.DecodeString(req.CSR)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		f.cert, err = x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      csr.Subject,
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}, f.ca, csr.PublicKey, f.caKey)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		order["status"] = "valid"
+		order["certificate"] = f.url + "/cert"
+		json.NewEncoder(w).Encode(order)
+	case "/cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: f.cert})
+		pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: f.ca.Raw})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestSignCSR(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "acme ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, caKey.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeACME{t: t, ca: ca, caKey: caKey, authz: "pending"}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	fake.url = srv.URL
+
+	accountKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var solved []string
+	signer, err := New(srv.URL+"/directory", accountKey,
+		WithChallengeType("dns-01"),
+		WithSolver(func(ctx context.Context, client *acme.Client, id acme.AuthzID, chal *acme.Challenge) (func(), error) {
+			solved = append(solved, id.Value+" "+chal.Token)
+			return func() {}, nil
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "device.example.com"},
+		DNSNames: []string{"device.example.com"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crt, err := signer.SignCSR(&scep.CSRReqMessage{CSR: csr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crt.CheckSignatureFrom(ca); err != nil {
+		t.Errorf("certificate not issued by the ACME CA: %v", err)
+	}
+	if len(solved) != 1 || solved[0] != "device.example.com t2" {
+		t.Errorf("solved %v, want the dns-01 challenge", solved)
+	}
+	if len(fake.accepted) != 1 || fake.accepted[0] != "/chal/dns" {
+		t.Errorf("accepted %v, want the dns-01 challenge", fake.accepted)
+	}
+
+	fake.reject = true
+	_, err = signer.SignCSR(&scep.CSRReqMessage{CSR: csr})
+	var fiErr *scepserver.FailInfoError
+	if !errors.As(err, &fiErr) {
+		t.Fatalf("expected FailInfoError, got %v", err)
+	}
+	if fiErr.FailInfo != scep.BadRequest || fiErr.Text != "not allowed" {
+		t.Errorf("have failInfo %s %q, want badRequest", fiErr.FailInfo, fiErr.Text)
+	}
+
+	// without names there is nothing to order
+	der, err = x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "device"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err = x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := signer.SignCSR(&scep.CSRReqMessage{CSR: csr}); !errors.As(err, &fiErr) {
+		t.Errorf("expected FailInfoError for a CSR without names, got %v", err)
+	}
+}
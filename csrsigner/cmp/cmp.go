@@ -0,0 +1,468 @@
+// Package cmpcsrsigner defines a scepserver.CSRSigner which issues
+// certificates with a CMP (RFC 4210) p10cr request to a CA. The requests
+// are protected with the signature of the RA identity, and the responses
+// must be signed by the CA or a CMP server certificate it issued for the
+// id-kp-cmcCA or id-kp-cmcRA extended key usage.
+package cmpcsrsigner
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+	scepserver "github.com/micromdm/scep/v2/server"
+)
+
+// PKIBody choices of RFC 4210 section 5.1.2.
+const (
+	bodyCP       = 3
+	bodyP10CR    = 4
+	bodyPKIConf  = 19
+	bodyError    = 23
+	bodyCertConf = 24
+)
+
+// PKIStatus values of RFC 4210 section 5.2.3.
+const (
+	statusAccepted        = 0
+	statusGrantedWithMods = 1
+	statusRejection       = 2
+	statusWaiting         = 3
+)
+
+var (
+	oidImplicitConfirm = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 4, 13}
+
+	// extended key usages of CMP server certificates, RFC 6402
+	oidCMCCA = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 27}
+	oidCMCRA = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 28}
+
+	oidSHA256WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	oidSHA384WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}
+	oidSHA512WithRSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	oidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+)
+
+var signatureAlgorithms = map[string]x509.SignatureAlgorithm{
+	oidSHA256WithRSA.String():   x509.SHA256WithRSA,
+	oidSHA384WithRSA.String():   x509.SHA384WithRSA,
+	oidSHA512WithRSA.String():   x509.SHA512WithRSA,
+	oidECDSAWithSHA256.String(): x509.ECDSAWithSHA256,
+	oidECDSAWithSHA384.String(): x509.ECDSAWithSHA384,
+	oidECDSAWithSHA512.String(): x509.ECDSAWithSHA512,
+}
+
+// failInfos are the SCEP failInfos with the meaning of the first
+// PKIFailureInfo bits of RFC 4210.
+var failInfos = []scep.FailInfo{
+	scep.BadAlg,
+	scep.BadMessageCheck,
+	scep.BadRequest,
+	scep.BadTime,
+	scep.BadCertID,
+}
+
+type pkiHeader struct {
+	PVNO          int
+	Sender        asn1.RawValue
+	Recipient     asn1.RawValue
+	MessageTime   time.Time                `asn1:"generalized,explicit,optional,tag:0"`
+	ProtectionAlg pkix.AlgorithmIdentifier `asn1:"explicit,optional,tag:1"`
+	SenderKID     []byte                   `asn1:"explicit,optional,tag:2"`
+	RecipKID      []byte                   `asn1:"explicit,optional,tag:3"`
+	TransactionID []byte                   `asn1:"explicit,optional,tag:4"`
+	SenderNonce   []byte                   `asn1:"explicit,optional,tag:5"`
+	RecipNonce    []byte                   `asn1:"explicit,optional,tag:6"`
+	FreeText      []string                 `asn1:"explicit,optional,tag:7"`
+	GeneralInfo   []infoTypeAndValue       `asn1:"explicit,optional,tag:8"`
+}
+
+type infoTypeAndValue struct {
+	InfoType  asn1.ObjectIdentifier
+	InfoValue asn1.RawValue `asn1:"optional"`
+}
+
+// pkiMessage keeps the encoding of the header, which is covered by the
+// protection.
+type pkiMessage struct {
+	Header     asn1.RawValue
+	Body       asn1.RawValue
+	Protection asn1.BitString  `asn1:"explicit,optional,tag:0"`
+	ExtraCerts []asn1.RawValue `asn1:"explicit,optional,tag:1"`
+}
+
+type protectedPart struct {
+	Header asn1.RawValue
+	Body   asn1.RawValue
+}
+
+// response is a verified response of the CMP server.
+type response struct {
+	header pkiHeader
+	body   asn1.RawValue
+}
+
+type pkiStatusInfo struct {
+	Status       int
+	StatusString []string       `asn1:"optional"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+type certRepMessage struct {
+	CAPubs   []asn1.RawValue `asn1:"explicit,optional,tag:1"`
+	Response []certResponse
+}
+
+type certResponse struct {
+	CertReqID        *big.Int
+	Status           pkiStatusInfo
+	CertifiedKeyPair certifiedKeyPair `asn1:"optional"`
+	RspInfo          []byte           `asn1:"optional"`
+}
+
+type certifiedKeyPair struct {
+	// CertOrEncCert is the certificate [0] or encryptedCert [1] choice,
+	// only certificates are supported.
+	CertOrEncCert asn1.RawValue
+	Rest          asn1.RawValue `asn1:"optional"`
+}
+
+type errorMsgContent struct {
+	Status       pkiStatusInfo
+	ErrorCode    int      `asn1:"optional"`
+	ErrorDetails []string `asn1:"optional"`
+}
+
+type certStatus struct {
+	CertHash  []byte
+	CertReqID *big.Int
+}
+
+// Signer enrolls CSRs with a CMP server.
+type Signer struct {
+	url    string
+	ca     *x509.Certificate
+	crt    *x509.Certificate
+	key    crypto.Signer
+	client *http.Client
+}
+
+// Option configures a Signer.
+type Option func(*Signer)
+
+// WithHTTPClient sets the client used for CMP requests. By default
+// http.DefaultClient is used.
+func WithHTTPClient(client *http.Client) Option {
+	return func(s *Signer) {
+		s.client = client
+	}
+}
+
+// New creates a Signer sending p10cr requests for the CA certificate ca to
+// the CMP server at url. Requests are signed with the RA certificate crt
+// and its RSA or ECDSA key.
+func New(url string, ca, crt *x509.Certificate, key crypto.Signer, opts ...Option) (*Signer, error) {
+	if url == "" || ca == nil || crt == nil || key == nil {
+		return nil, errors.New("CMP URL, CA certificate and RA identity are required")
+	}
+	s := &Signer{
+		url:    url,
+		ca:     ca,
+		crt:    crt,
+		key:    key,
+		client: http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// SignCSR requests a certificate for the CSR of m with a p10cr message. A
+// rejection by the CA is returned as a *scepserver.FailInfoError with the
+// failInfo matching its PKIFailureInfo.
+func (s *Signer) SignCSR(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+	ctx := context.Background()
+	transactionID := make([]byte, 16)
+	if _, err := rand.Read(transactionID); err != nil {
+		return nil, err
+	}
+	body := asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: bodyP10CR, IsCompound: true, Bytes: m.CSR.Raw}
+	resp, err := s.exchange(ctx, transactionID, nil, body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.body.Tag != bodyCP {
+		return nil, fmt.Errorf("cmp: unexpected response body %d to p10cr", resp.body.Tag)
+	}
+	var rep certRepMessage
+	if _, err := asn1.Unmarshal(resp.body.Bytes, &rep); err != nil {
+		return nil, fmt.Errorf("cmp: parse cp: %w", err)
+	}
+	if len(rep.Response) != 1 {
+		return nil, fmt.Errorf("cmp: %d responses to p10cr", len(rep.Response))
+	}
+	cr := rep.Response[0]
+	if err := statusError(cr.Status); err != nil {
+		return nil, err
+	}
+	choice := cr.CertifiedKeyPair.CertOrEncCert
+	if choice.Class != asn1.ClassContextSpecific || choice.Tag != 0 {
+		return nil, errors.New("cmp: no certificate in cp, encrypted certificates are not supported")
+	}
+	crt, err := x509.ParseCertificate(choice.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cmp: parse issued certificate: %w", err)
+	}
+	if !implicitlyConfirmed(resp.header) {
+		if err := s.confirm(ctx, transactionID, resp.header.SenderNonce, crt, cr.CertReqID); err != nil {
+			return nil, err
+		}
+	}
+	return crt, nil
+}
+
+// confirm sends the certConf for crt, which the CA answers with pkiconf.
+func (s *Signer) confirm(ctx context.Context, transactionID, recipNonce []byte, crt *x509.Certificate, certReqID *big.Int) error {
+	hash := crypto.SHA256
+	switch crt.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384:
+		hash = crypto.SHA384
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512:
+		hash = crypto.SHA512
+	}
+	h := hash.New()
+	h.Write(crt.Raw)
+	content, err := asn1.Marshal([]certStatus{{CertHash: h.Sum(nil), CertReqID: certReqID}})
+	if err != nil {
+		return err
+	}
+	body := asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: bodyCertConf, IsCompound: true, Bytes: content}
+	resp, err := s.exchange(ctx, transactionID, recipNonce, body)
+	if err != nil {
+		return err
+	}
+	if resp.body.Tag != bodyPKIConf {
+		return fmt.Errorf("cmp: unexpected response body %d to certConf", resp.body.Tag)
+	}
+	return nil
+}
+
+// exchange sends a request with body and returns the verified response.
+// An error message of the CA is returned as an error.
+func (s *Signer) exchange(ctx context.Context, transactionID, recipNonce []byte, body asn1.RawValue) (*response, error) {
+	req, senderNonce, err := s.newMessage(transactionID, recipNonce, body)
+	if err != nil {
+		return nil, err
+	}
+	data, err := s.post(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	var msg pkiMessage
+	if _, err := asn1.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("cmp: parse response: %w", err)
+	}
+	resp := &response{body: msg.Body}
+	if _, err := asn1.Unmarshal(msg.Header.FullBytes, &resp.header); err != nil {
+		return nil, fmt.Errorf("cmp: parse response header: %w", err)
+	}
+	if err := s.verify(&msg, resp.header.ProtectionAlg); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(resp.header.TransactionID, transactionID) || !bytes.Equal(resp.header.RecipNonce, senderNonce) {
+		return nil, errors.New("cmp: response does not match the request")
+	}
+	if resp.body.Tag == bodyError {
+		var content errorMsgContent
+		if _, err := asn1.Unmarshal(resp.body.Bytes, &content); err != nil {
+			return nil, fmt.Errorf("cmp: parse error message: %w", err)
+		}
+		if err := statusError(content.Status); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("cmp: error message: " + strings.Join(content.ErrorDetails, "; "))
+	}
+	return resp, nil
+}
+
+// newMessage returns a DER encoded request with body, signed with the RA
+// identity, and its senderNonce.
+func (s *Signer) newMessage(transactionID, recipNonce []byte, body asn1.RawValue) ([]byte, []byte, error) {
+	var alg pkix.AlgorithmIdentifier
+	switch s.key.Public().(type) {
+	case *rsa.PublicKey:
+		alg = pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1.NullRawValue}
+	case *ecdsa.PublicKey:
+		alg = pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256}
+	default:
+		return nil, nil, errors.New("cmp: RA key must be RSA or ECDSA")
+	}
+	senderNonce := make([]byte, 16)
+	if _, err := rand.Read(senderNonce); err != nil {
+		return nil, nil, err
+	}
+	header := pkiHeader{
+		PVNO:          2,
+		Sender:        directoryName(s.crt.RawSubject),
+		Recipient:     directoryName(s.ca.RawSubject),
+		MessageTime:   time.Now().UTC().Truncate(time.Second),
+		ProtectionAlg: alg,
+		SenderKID:     s.crt.SubjectKeyId,
+		TransactionID: transactionID,
+		SenderNonce:   senderNonce,
+		RecipNonce:    recipNonce,
+		GeneralInfo:   []infoTypeAndValue{{InfoType: oidImplicitConfirm, InfoValue: asn1.NullRawValue}},
+	}
+	rawHeader, err := asn1.Marshal(header)
+	if err != nil {
+		return nil, nil, err
+	}
+	protected, err := asn1.Marshal(protectedPart{Header: asn1.RawValue{FullBytes: rawHeader}, Body: body})
+	if err != nil {
+		return nil, nil, err
+	}
+	digest := crypto.SHA256.New()
+	digest.Write(protected)
+	sig, err := s.key.Sign(rand.Reader, digest.Sum(nil), crypto.SHA256)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err := asn1.Marshal(pkiMessage{
+		Header:     asn1.RawValue{FullBytes: rawHeader},
+		Body:       body,
+		Protection: asn1.BitString{Bytes: sig, BitLength: len(sig) * 8},
+		ExtraCerts: []asn1.RawValue{{FullBytes: s.crt.Raw}},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return msg, senderNonce, nil
+}
+
+// verify checks the signature protecting msg with protectionAlg. The
+// signer is the CA or the first of the extraCerts if it is a CMP server
+// certificate of the CA, see checkServerCert.
+func (s *Signer) verify(msg *pkiMessage, protectionAlg pkix.AlgorithmIdentifier) error {
+	alg, ok := signatureAlgorithms[protectionAlg.Algorithm.String()]
+	if !ok {
+		return fmt.Errorf("cmp: unsupported response protection %s", protectionAlg.Algorithm)
+	}
+	protected, err := asn1.Marshal(protectedPart{Header: msg.Header, Body: msg.Body})
+	if err != nil {
+		return err
+	}
+	signer := s.ca
+	if len(msg.ExtraCerts) > 0 {
+		crt, err := x509.ParseCertificate(msg.ExtraCerts[0].FullBytes)
+		if err != nil {
+			return fmt.Errorf("cmp: parse extraCerts: %w", err)
+		}
+		if !crt.Equal(s.ca) {
+			if err := checkServerCert(crt, s.ca, time.Now()); err != nil {
+				return err
+			}
+			signer = crt
+		}
+	}
+	if err := signer.CheckSignature(alg, protected, msg.Protection.RightAlign()); err != nil {
+		return fmt.Errorf("cmp: response protection: %w", err)
+	}
+	return nil
+}
+
+// checkServerCert checks that crt is a CMP server certificate issued by
+// ca: valid at now and with the id-kp-cmcCA or id-kp-cmcRA extended key
+// usage. Other certificates of the CA, like those of devices, must not
+// sign responses.
+func checkServerCert(crt, ca *x509.Certificate, now time.Time) error {
+	if err := crt.CheckSignatureFrom(ca); err != nil {
+		return fmt.Errorf("cmp: response signer not issued by the CA: %w", err)
+	}
+	if now.Before(crt.NotBefore) || now.After(crt.NotAfter) {
+		return fmt.Errorf("cmp: response signer %s is not valid at %s", crt.Subject, now.Format(time.RFC3339))
+	}
+	for _, eku := range crt.UnknownExtKeyUsage {
+		if eku.Equal(oidCMCCA) || eku.Equal(oidCMCRA) {
+			return nil
+		}
+	}
+	return fmt.Errorf("cmp: response signer %s is not a CMP server certificate", crt.Subject)
+}
+
+func (s *Signer) post(ctx context.Context, msg []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/pkixcmp")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cmp: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("cmp: reading response: %w", err)
+	}
+	// error messages may come with a 4xx or 5xx status
+	if resp.Header.Get("Content-Type") != "application/pkixcmp" {
+		return nil, fmt.Errorf("cmp: %s response of type %q", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	return data, nil
+}
+
+// statusError returns nil for an accepted status and else an error, a
+// FailInfoError for a rejection.
+func statusError(info pkiStatusInfo) error {
+	text := strings.Join(info.StatusString, "; ")
+	switch info.Status {
+	case statusAccepted, statusGrantedWithMods:
+		return nil
+	case statusRejection:
+		var failInfo scep.FailInfo = scep.BadRequest
+		for bit, fi := range failInfos {
+			if info.FailInfo.At(bit) == 1 {
+				failInfo = fi
+				break
+			}
+		}
+		return &scepserver.FailInfoError{FailInfo: failInfo, Text: text, Err: errors.New("cmp: request rejected: " + text)}
+	case statusWaiting:
+		return errors.New("cmp: request is waiting for approval, polling is not supported")
+	}
+	return fmt.Errorf("cmp: status %d: %s", info.Status, text)
+}
+
+func implicitlyConfirmed(header pkiHeader) bool {
+	for _, info := range header.GeneralInfo {
+		if info.InfoType.Equal(oidImplicitConfirm) {
+			return true
+		}
+	}
+	return false
+}
+
+// directoryName returns the directoryName [4] GeneralName of a DER encoded
+// Name.
+func directoryName(name []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 4, IsCompound: true, Bytes: name}
+}
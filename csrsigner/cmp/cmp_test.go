@@ -0,0 +1,298 @@
+package cmpcsrsigner
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+	scepserver "github.com/micromdm/scep/v2/server"
+)
+
+// fakeCMP is a minimal CMP server issuing certificates for p10cr requests.
+type fakeCMP struct {
+	t     *testing.T
+	ca    *x509.Certificate
+	caKey *rsa.PrivateKey
+	// signer and signerKey sign the responses instead of the CA
+	signer    *x509.Certificate
+	signerKey *rsa.PrivateKey
+	implicit  bool
+	reject    bool
+	confirms  int
+}
+
+func (f *fakeCMP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	var msg pkiMessage
+	if _, err := asn1.Unmarshal(data, &msg); err != nil {
+		f.t.Fatal(err)
+	}
+	var header pkiHeader
+	if _, err := asn1.Unmarshal(msg.Header.FullBytes, &header); err != nil {
+		f.t.Fatal(err)
+	}
+	ra, err := x509.ParseCertificate(msg.ExtraCerts[0].FullBytes)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	protected, _ := asn1.Marshal(protectedPart{Header: msg.Header, Body: msg.Body})
+	if err := ra.CheckSignature(x509.SHA256WithRSA, protected, msg.Protection.RightAlign()); err != nil {
+		f.t.Errorf("request protection: %v", err)
+	}
+
+	var body asn1.RawValue
+	var respInfo []infoTypeAndValue
+	switch {
+	case msg.Body.Tag == bodyP10CR && f.reject:
+		content, _ := asn1.Marshal(errorMsgContent{
+			Status: pkiStatusInfo{
+				Status:       statusRejection,
+				StatusString: []string{"unknown RA"},
+				FailInfo:     asn1.BitString{Bytes: []byte{0x40}, BitLength: 2},
+			},
+		})
+		body = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: bodyError, IsCompound: true, Bytes: content}
+	case msg.Body.Tag == bodyP10CR:
+		csr, err := x509.ParseCertificateRequest(msg.Body.Bytes)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      csr.Subject,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}, f.ca, csr.PublicKey, f.caKey)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		content, err := asn1.Marshal(certRepMessage{Response: []certResponse{{
+			CertReqID:        big.NewInt(-1),
+			Status:           pkiStatusInfo{Status: statusAccepted},
+			CertifiedKeyPair: certifiedKeyPair{CertOrEncCert: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}},
+		}}})
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		body = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: bodyCP, IsCompound: true, Bytes: content}
+		if f.implicit {
+			respInfo = header.GeneralInfo
+		}
+	case msg.Body.Tag == bodyCertConf:
+		f.confirms++
+		body = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: bodyPKIConf, IsCompound: true, Bytes: asn1.NullBytes}
+	default:
+		f.t.Fatalf("unexpected body %d", msg.Body.Tag)
+	}
+
+	rawHeader, err := asn1.Marshal(pkiHeader{
+		PVNO:          2,
+		Sender:        directoryName(f.ca.RawSubject),
+		Recipient:     header.Sender,
+		ProtectionAlg: pkix.AlgorithmIdentifier{Algorithm: oidSHA256WithRSA, Parameters: asn1.NullRawValue},
+		TransactionID: header.TransactionID,
+		SenderNonce:   []byte("server nonce"),
+		RecipNonce:    header.SenderNonce,
+		GeneralInfo:   respInfo,
+	})
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	protected, _ = asn1.Marshal(protectedPart{Header: asn1.RawValue{FullBytes: rawHeader}, Body: body})
+	digest := crypto.SHA256.New()
+	digest.Write(protected)
+	signerKey, extraCerts := f.caKey, []asn1.RawValue(nil)
+	if f.signer != nil {
+		signerKey, extraCerts = f.signerKey, []asn1.RawValue{{FullBytes: f.signer.Raw}}
+	}
+	sig, err := signerKey.Sign(rand.Reader, digest.Sum(nil), crypto.SHA256)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	resp, err := asn1.Marshal(pkiMessage{
+		Header:     asn1.RawValue{FullBytes: rawHeader},
+		Body:       body,
+		Protection: asn1.BitString{Bytes: sig, BitLength: len(sig) * 8},
+		ExtraCerts: extraCerts,
+	})
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	w.Header().Set("Content-Type", "application/pkixcmp")
+	w.Write(resp)
+}
+
+func TestSignCSR(t *testing.T) {
+	ca, caKey := newTestCert(t, "cmp ca")
+	ra, raKey := newTestCert(t, "cmp ra")
+	fake := &fakeCMP{t: t, ca: ca, caKey: caKey}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	signer, err := New(srv.URL, ca, ra, raKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "device"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, implicit := range []bool{true, false} {
+		fake.implicit, fake.confirms = implicit, 0
+		crt, err := signer.SignCSR(&scep.CSRReqMessage{CSR: csr})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := crt.CheckSignatureFrom(ca); err != nil {
+			t.Errorf("certificate not issued by the CMP CA: %v", err)
+		}
+		if !bytes.Equal(crt.RawSubject, csr.RawSubject) {
+			t.Errorf("have subject %s, want %s", crt.Subject, csr.Subject)
+		}
+		if want := map[bool]int{true: 0, false: 1}[implicit]; fake.confirms != want {
+			t.Errorf("implicitConfirm %v: %d certConf, want %d", implicit, fake.confirms, want)
+		}
+	}
+
+	fake.reject = true
+	_, err = signer.SignCSR(&scep.CSRReqMessage{CSR: csr})
+	var fiErr *scepserver.FailInfoError
+	if !errors.As(err, &fiErr) {
+		t.Fatalf("expected FailInfoError, got %v", err)
+	}
+	if fiErr.FailInfo != scep.BadMessageCheck || fiErr.Text != "unknown RA" {
+		t.Errorf("have failInfo %s %q, want badMessageCheck", fiErr.FailInfo, fiErr.Text)
+	}
+
+	// responses must be signed by the CA
+	other, _ := newTestCert(t, "other ca")
+	signer, err = New(srv.URL, other, ra, raKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.reject = false
+	if _, err := signer.SignCSR(&scep.CSRReqMessage{CSR: csr}); err == nil {
+		t.Error("want an error for a response not signed by the CA")
+	}
+}
+
+func TestResponseSigner(t *testing.T) {
+	ca, caKey := newTestCert(t, "cmp ca")
+	ra, raKey := newTestCert(t, "cmp ra")
+	fake := &fakeCMP{t: t, ca: ca, caKey: caKey}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	signer, err := New(srv.URL, ca, ra, raKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "device"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, test := range []struct {
+		name      string
+		eku       []asn1.ObjectIdentifier
+		notBefore time.Time
+		notAfter  time.Time
+		ok        bool
+	}{
+		{"cmcRA", []asn1.ObjectIdentifier{oidCMCRA}, now.Add(-time.Hour), now.Add(time.Hour), true},
+		{"cmcCA", []asn1.ObjectIdentifier{oidCMCCA}, now.Add(-time.Hour), now.Add(time.Hour), true},
+		{"device leaf", nil, now.Add(-time.Hour), now.Add(time.Hour), false},
+		{"expired", []asn1.ObjectIdentifier{oidCMCRA}, now.Add(-2 * time.Hour), now.Add(-time.Hour), false},
+		{"not yet valid", []asn1.ObjectIdentifier{oidCMCRA}, now.Add(time.Hour), now.Add(2 * time.Hour), false},
+	} {
+		fake.signerKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber:       big.NewInt(3),
+			Subject:            pkix.Name{CommonName: test.name},
+			NotBefore:          test.notBefore,
+			NotAfter:           test.notAfter,
+			KeyUsage:           x509.KeyUsageDigitalSignature,
+			UnknownExtKeyUsage: test.eku,
+		}, ca, &fake.signerKey.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fake.signer, err = x509.ParseCertificate(der); err != nil {
+			t.Fatal(err)
+		}
+		_, err = signer.SignCSR(&scep.CSRReqMessage{CSR: csr})
+		if test.ok && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: response signer accepted", test.name)
+		}
+	}
+}
+
+// newTestCert returns a self-signed CA certificate and its key.
+func newTestCert(t *testing.T, cn string) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crt, key
+}
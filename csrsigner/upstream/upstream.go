@@ -0,0 +1,118 @@
+// Package upstreamcsrsigner defines a scepserver.CSRSigner which forwards
+// enrollments to an upstream SCEP CA. The SCEP server then acts as an RA:
+// devices enroll with it, their challenge is validated locally by the
+// middlewares wrapping the Signer, and the CSR is sent on to the CA in a
+// request signed with the RA identity.
+package upstreamcsrsigner
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"sync"
+	"time"
+
+	scepclient "github.com/micromdm/scep/v2/client"
+	"github.com/micromdm/scep/v2/scep"
+	scepserver "github.com/micromdm/scep/v2/server"
+)
+
+// Signer enrolls the CSRs of devices with an upstream SCEP CA.
+type Signer struct {
+	client     scepclient.Client
+	crt        *x509.Certificate
+	key        crypto.Signer
+	timeout    time.Duration
+	cacheTTL   time.Duration
+	enrollOpts []scepclient.EnrollOption
+	now        func() time.Time
+
+	mu      sync.Mutex
+	caCerts []*x509.Certificate
+	fetched time.Time
+}
+
+// Option configures a Signer.
+type Option func(*Signer)
+
+// WithTimeout bounds the time an enrollment may take, including polling
+// the CA while it answers PENDING. The default is two minutes.
+func WithTimeout(timeout time.Duration) Option {
+	return func(s *Signer) {
+		s.timeout = timeout
+	}
+}
+
+// WithCACertsTTL sets how long the GetCACert response of the CA is cached.
+// The default is one hour.
+func WithCACertsTTL(ttl time.Duration) Option {
+	return func(s *Signer) {
+		s.cacheTTL = ttl
+	}
+}
+
+// WithEnrollOptions adds options to the enrollments with the CA, e.g.
+// scepclient.WithPoller or scepclient.WithStrictness.
+func WithEnrollOptions(opts ...scepclient.EnrollOption) Option {
+	return func(s *Signer) {
+		s.enrollOpts = append(s.enrollOpts, opts...)
+	}
+}
+
+// New creates a Signer enrolling with the CA behind client. Requests are
+// signed with the RA certificate crt and key, which also decrypt the
+// CertRep of the CA.
+func New(client scepclient.Client, crt *x509.Certificate, key crypto.Signer, opts ...Option) (*Signer, error) {
+	if client == nil || crt == nil || key == nil {
+		return nil, errors.New("upstream client and RA identity are required")
+	}
+	s := &Signer{
+		client:   client,
+		crt:      crt,
+		key:      key,
+		timeout:  2 * time.Minute,
+		cacheTTL: time.Hour,
+		now:      time.Now,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+// SignCSR enrolls the CSR of m with the CA and returns the issued
+// certificate. A FAILURE of the CA is returned as a
+// *scepserver.FailInfoError with its failInfo.
+func (s *Signer) SignCSR(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	caCerts, err := s.CACerts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	opts := append([]scepclient.EnrollOption{scepclient.WithCACerts(caCerts)}, s.enrollOpts...)
+	crt, err := scepclient.Enroll(ctx, s.client, m.CSR, s.crt, s.key, opts...)
+	var failure *scepclient.FailureError
+	if errors.As(err, &failure) {
+		return nil, &scepserver.FailInfoError{FailInfo: failure.FailInfo, Text: failure.FailInfoText, Err: err}
+	}
+	return crt, err
+}
+
+// CACerts returns the CA and RA certificates of the GetCACert response of
+// the CA, cached for the TTL of WithCACertsTTL. They may be served with the
+// RA certificate, e.g. with scepserver.WithCertificateChain.
+func (s *Signer) CACerts(ctx context.Context) ([]*x509.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.caCerts != nil && s.now().Sub(s.fetched) < s.cacheTTL {
+		return s.caCerts, nil
+	}
+	certs, err := scepclient.GetCACerts(ctx, s.client, "")
+	if err != nil {
+		return nil, err
+	}
+	s.caCerts, s.fetched = certs, s.now()
+	return certs, nil
+}
@@ -0,0 +1,139 @@
+package upstreamcsrsigner
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+	scepserver "github.com/micromdm/scep/v2/server"
+)
+
+// testCA is an upstream SCEP CA served in-process.
+type testCA struct {
+	scepserver.Service
+	getCACert int
+}
+
+func (c *testCA) Supports(cap string) bool { return false }
+
+func (c *testCA) GetCACert(ctx context.Context, message string) ([]byte, int, error) {
+	c.getCACert++
+	return c.Service.GetCACert(ctx, message)
+}
+
+func TestSignCSR(t *testing.T) {
+	caCert, caKey := newTestCert(t, "upstream CA")
+	raCert, raKey := newTestCert(t, "RA")
+
+	var reject bool
+	caSvc, err := scepserver.NewService(caCert, caKey, scepserver.CSRSignerFunc(func(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+		if reject {
+			return nil, &scepserver.FailInfoError{FailInfo: scep.BadRequest, Text: "no more devices"}
+		}
+		if !m.SignerCert.Equal(raCert) {
+			t.Errorf("request signed by %s, want the RA", m.SignerCert.Subject)
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      m.CSR.Subject,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}, caCert, m.CSR.PublicKey, caKey)
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParseCertificate(der)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{Service: caSvc}
+
+	now := time.Now()
+	signer, err := New(ca, raCert, raKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer.now = func() time.Time { return now }
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "device"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crt, err := signer.SignCSR(&scep.CSRReqMessage{CSR: csr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := crt.CheckSignatureFrom(caCert); err != nil {
+		t.Errorf("certificate not issued by the upstream CA: %v", err)
+	}
+	if crt.Subject.CommonName != "device" {
+		t.Errorf("have subject %s, want device", crt.Subject)
+	}
+
+	reject = true
+	_, err = signer.SignCSR(&scep.CSRReqMessage{CSR: csr})
+	var fiErr *scepserver.FailInfoError
+	if !errors.As(err, &fiErr) {
+		t.Fatalf("expected FailInfoError, got %v", err)
+	}
+	if fiErr.FailInfo != scep.BadRequest || fiErr.Text != "no more devices" {
+		t.Errorf("have failInfo %s %q, want badRequest", fiErr.FailInfo, fiErr.Text)
+	}
+
+	if ca.getCACert != 1 {
+		t.Errorf("CA certificates fetched %d times, want 1", ca.getCACert)
+	}
+	now = now.Add(2 * time.Hour)
+	if _, err := signer.CACerts(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ca.getCACert != 2 {
+		t.Errorf("expired CA certificates were not fetched again")
+	}
+}
+
+// newTestCert returns a self-signed CA certificate and its key.
+func newTestCert(t *testing.T, cn string) (*x509.Certificate, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crt, key
+}
@@ -0,0 +1,186 @@
+// Package vaultcsrsigner defines a scepserver.CSRSigner which issues
+// certificates with the PKI secrets engine of HashiCorp Vault. The SCEP
+// server then acts as an RA and does not hold the CA key.
+package vaultcsrsigner
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// Signer signs CSRs with the sign endpoint of a Vault PKI role.
+type Signer struct {
+	addr   string
+	mount  string
+	role   string
+	token  string
+	ttl    time.Duration
+	client *http.Client
+}
+
+// Option configures a Signer.
+type Option func(*Signer)
+
+// WithMount sets the path the PKI secrets engine is mounted at. The
+// default is "pki".
+func WithMount(mount string) Option {
+	return func(s *Signer) {
+		s.mount = strings.Trim(mount, "/")
+	}
+}
+
+// WithTTL sets the requested validity of issued certificates. By default the
+// TTL of the role is used.
+func WithTTL(ttl time.Duration) Option {
+	return func(s *Signer) {
+		s.ttl = ttl
+	}
+}
+
+// WithHTTPClient sets the client used for Vault requests. By default
+// http.DefaultClient is used.
+func WithHTTPClient(client *http.Client) Option {
+	return func(s *Signer) {
+		s.client = client
+	}
+}
+
+// New creates a Signer which signs CSRs with role of the Vault server at
+// addr, e.g. https://vault.example.com:8200, authenticating with token.
+func New(addr, role, token string, opts ...Option) (*Signer, error) {
+	if addr == "" || role == "" {
+		return nil, errors.New("vault address and role are required")
+	}
+	s := &Signer{
+		addr:   strings.TrimRight(addr, "/"),
+		mount:  "pki",
+		role:   role,
+		token:  token,
+		client: http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
+}
+
+type signRequest struct {
+	CSR        string `json:"csr"`
+	CommonName string `json:"common_name,omitempty"`
+	TTL        string `json:"ttl,omitempty"`
+	Format     string `json:"format"`
+}
+
+type signResponse struct {
+	Data struct {
+		Certificate string `json:"certificate"`
+	} `json:"data"`
+}
+
+type errorResponse struct {
+	Errors []string `json:"errors"`
+}
+
+// SignCSR sends the CSR of m to Vault and returns the issued certificate.
+func (s *Signer) SignCSR(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+	req := signRequest{
+		CSR:        string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: m.CSR.Raw})),
+		CommonName: m.CSR.Subject.CommonName,
+		Format:     "pem",
+	}
+	if s.ttl > 0 {
+		req.TTL = s.ttl.String()
+	}
+	var resp signResponse
+	if err := s.do(context.Background(), http.MethodPost, "/sign/"+s.role, req, &resp); err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(resp.Data.Certificate))
+	if block == nil {
+		return nil, errors.New("vault: no certificate in sign response")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// CACerts returns the certificate chain of the Vault CA, e.g. to be
+// returned with the RA certificate in answer to GetCACert.
+func (s *Signer) CACerts(ctx context.Context) ([]*x509.Certificate, error) {
+	var data []byte
+	if err := s.do(ctx, http.MethodGet, "/ca_chain", nil, &data); err != nil {
+		return nil, err
+	}
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("vault: empty CA chain")
+	}
+	return certs, nil
+}
+
+// do sends a request to path below the PKI mount. The response is decoded
+// as JSON into out, or copied if out is a *[]byte.
+func (s *Signer) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, s.addr+"/v1/"+s.mount+path, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	if s.token != "" {
+		req.Header.Set("X-Vault-Token", s.token)
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault: %w", err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("vault: reading response: %w", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var errResp errorResponse
+		if json.Unmarshal(data, &errResp) == nil && len(errResp.Errors) > 0 {
+			return fmt.Errorf("vault: %s %s: %s", method, path, strings.Join(errResp.Errors, "; "))
+		}
+		return fmt.Errorf("vault: %s %s: %s", method, path, resp.Status)
+	}
+	if raw, ok := out.(*[]byte); ok {
+		*raw = data
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
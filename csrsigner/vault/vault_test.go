@@ -0,0 +1,129 @@
+package vaultcsrsigner
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+func TestSignCSR(t *testing.T) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "vault ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a minimal stand-in for the Vault PKI API
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/scep-pki/sign/devices", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		var req signRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		if req.TTL != "1h0m0s" {
+			t.Errorf("have ttl %q, want 1h0m0s", req.TTL)
+		}
+		block, _ := pem.Decode([]byte(req.CSR))
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: req.CommonName},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, csr.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp signResponse
+		resp.Data.Certificate = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+		json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("/v1/scep-pki/ca_chain", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "device"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := New(srv.URL, "devices", "s.token", WithMount("/scep-pki/"), WithTTL(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := signer.SignCSR(&scep.CSRReqMessage{CSR: csr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if crt.Subject.CommonName != "device" {
+		t.Errorf("have CN %q, want device", crt.Subject.CommonName)
+	}
+	if err := crt.CheckSignatureFrom(ca); err != nil {
+		t.Error(err)
+	}
+
+	certs, err := signer.CACerts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || !certs[0].Equal(ca) {
+		t.Errorf("have CA chain %v, want the Vault CA", certs)
+	}
+
+	signer, err = New(srv.URL, "devices", "wrong", WithMount("scep-pki"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := signer.SignCSR(&scep.CSRReqMessage{CSR: csr}); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("have error %v, want permission denied", err)
+	}
+}
@@ -0,0 +1,82 @@
+// Package webhookcsrverifier defines the WebhookCSRVerifier csrverifier.CSRVerifier.
+package webhookcsrverifier
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+// Option configures a WebhookCSRVerifier.
+type Option func(*WebhookCSRVerifier)
+
+// WithHTTPClient sets the client used to call the webhook. The default
+// client times out after 30 seconds.
+func WithHTTPClient(client *http.Client) Option {
+	return func(v *WebhookCSRVerifier) {
+		v.client = client
+	}
+}
+
+// New creates a webhookcsrverifier.WebhookCSRVerifier calling webhookURL.
+func New(webhookURL string, logger log.Logger, opts ...Option) (*WebhookCSRVerifier, error) {
+	u, err := url.Parse(webhookURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("CSR verifier webhook must be an http or https URL")
+	}
+	v := &WebhookCSRVerifier{
+		url:    webhookURL,
+		client: &http.Client{Timeout: 30 * time.Second},
+		logger: logger,
+	}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v, nil
+}
+
+// WebhookCSRVerifier implements a csrverifier.CSRVerifier.
+// It POSTs the PEM encoded CSR and the challenge password as JSON to a URL.
+// If the webhook answers 200 OK, the CSR is considered valid.
+// In any other cases, the CSR is considered invalid.
+type WebhookCSRVerifier struct {
+	url    string
+	client *http.Client
+	logger log.Logger
+}
+
+type webhookRequest struct {
+	CSR               string `json:"csr"`
+	ChallengePassword string `json:"challenge_password,omitempty"`
+}
+
+func (v *WebhookCSRVerifier) Verify(data []byte, challengePassword string, _ *x509.CertificateRequest) (bool, error) {
+	body, err := json.Marshal(webhookRequest{
+		CSR:               string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: data})),
+		ChallengePassword: challengePassword,
+	})
+	if err != nil {
+		return false, err
+	}
+	resp, err := v.client.Post(v.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("CSR verifier webhook: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		v.logger.Log("msg", "CSR rejected by webhook", "status", resp.StatusCode)
+		return false, nil
+	}
+	return true, nil
+}
@@ -0,0 +1,72 @@
+package webhookcsrverifier
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+)
+
+func TestVerify(t *testing.T) {
+	// the webhook allows a single device
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req webhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		block, _ := pem.Decode([]byte(req.CSR))
+		if block == nil {
+			t.Fatal("no PEM CSR in webhook request")
+		}
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if csr.Subject.CommonName != "allowed" || req.ChallengePassword != "secret" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer srv.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := New(srv.URL, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		cn, challenge string
+		want          bool
+	}{
+		{"allowed", "secret", true},
+		{"allowed", "wrong", false},
+		{"other", "secret", false},
+	} {
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject: pkix.Name{CommonName: test.cn},
+		}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := v.Verify(der, test.challenge, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != test.want {
+			t.Errorf("%s/%s: have %v, want %v", test.cn, test.challenge, ok, test.want)
+		}
+	}
+
+	if _, err := New("file:///etc/passwd", log.NewNopLogger()); err == nil {
+		t.Error("expected error for non-HTTP URL")
+	}
+}
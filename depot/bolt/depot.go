@@ -2,14 +2,19 @@ package bolt
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math/big"
+	"time"
 
+	"github.com/micromdm/scep/v2/cryptoutil"
 	"github.com/micromdm/scep/v2/depot"
+	"github.com/micromdm/scep/v2/scep"
 
 	"github.com/boltdb/bolt"
 )
@@ -22,14 +27,24 @@ type Depot struct {
 
 const (
 	certBucket = "scep_certificates"
+	// serialBucket maps the serial numbers of issued certificates to their
+	// key in certBucket.
+	serialBucket = "scep_serials"
+	// revokedBucket maps the serial numbers of revoked certificates to
+	// their revocation.
+	revokedBucket = "scep_revoked"
+	// transactionBucket maps the transactionIDs of requests held PENDING
+	// to their depot.Transaction.
+	transactionBucket = "scep_transactions"
 )
 
 // NewBoltDepot creates a depot.Depot backed by BoltDB.
 func NewBoltDepot(db *bolt.DB) (*Depot, error) {
 	err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(certBucket))
-		if err != nil {
-			return fmt.Errorf("create bucket: %s", err)
+		for _, name := range []string{certBucket, serialBucket, revokedBucket, transactionBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return fmt.Errorf("create bucket: %s", err)
+			}
 		}
 		return nil
 	})
@@ -53,9 +68,9 @@ func bucketGetCopy(b *bolt.Bucket, key []byte) (out []byte) {
 	return
 }
 
-func (db *Depot) CA(pass []byte) ([]*x509.Certificate, *rsa.PrivateKey, error) {
+func (db *Depot) CA(pass []byte) ([]*x509.Certificate, crypto.Signer, error) {
 	chain := []*x509.Certificate{}
-	var key *rsa.PrivateKey
+	var key crypto.Signer
 	err := db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(certBucket))
 		if bucket == nil {
@@ -77,11 +92,8 @@ func (db *Depot) CA(pass []byte) ([]*x509.Certificate, *rsa.PrivateKey, error) {
 		if caKey == nil {
 			return fmt.Errorf("no ca_key in bucket")
 		}
-		key, err = x509.ParsePKCS1PrivateKey(caKey)
-		if err != nil {
-			return err
-		}
-		return nil
+		key, err = parseKey(caKey)
+		return err
 	})
 	if err != nil {
 		return nil, nil, err
@@ -89,45 +101,49 @@ func (db *Depot) CA(pass []byte) ([]*x509.Certificate, *rsa.PrivateKey, error) {
 	return chain, key, nil
 }
 
+// Put stores crt under its CN and the current value of the serial counter
+// and increments the counter, all in one transaction.
 func (db *Depot) Put(cn string, crt *x509.Certificate) error {
 	if crt == nil || crt.Raw == nil {
 		return fmt.Errorf("%q does not specify a valid certificate for storage", cn)
 	}
-	serial, err := db.Serial()
-	if err != nil {
-		return err
-	}
-
-	err = db.Update(func(tx *bolt.Tx) error {
+	return db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(certBucket))
 		if bucket == nil {
 			return fmt.Errorf("bucket %q not found!", certBucket)
 		}
-		name := cn + "." + serial.String()
-		return bucket.Put([]byte(name), crt.Raw)
+		serials := tx.Bucket([]byte(serialBucket))
+		if serials == nil {
+			return fmt.Errorf("bucket %q not found!", serialBucket)
+		}
+		serial := big.NewInt(2)
+		if k := bucket.Get([]byte("serial")); k != nil {
+			serial.SetBytes(k)
+		}
+		name := []byte(cn + "." + serial.String())
+		if err := bucket.Put(name, crt.Raw); err != nil {
+			return err
+		}
+		if err := serials.Put(crt.SerialNumber.Bytes(), name); err != nil {
+			return err
+		}
+		serial.Add(serial, big.NewInt(1))
+		return bucket.Put([]byte("serial"), serial.Bytes())
 	})
-	if err != nil {
-		return err
-	}
-	return db.incrementSerial(serial)
 }
 
+// Serial returns the serial number for the next certificate, initializing
+// the counter to two if it does not exist yet.
 func (db *Depot) Serial() (*big.Int, error) {
 	s := big.NewInt(2)
-	if !db.hasKey([]byte("serial")) {
-		if err := db.writeSerial(s); err != nil {
-			return nil, err
-		}
-		return s, nil
-	}
-	err := db.View(func(tx *bolt.Tx) error {
+	err := db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(certBucket))
 		if bucket == nil {
 			return fmt.Errorf("bucket %q not found!", certBucket)
 		}
 		k := bucket.Get([]byte("serial"))
 		if k == nil {
-			return fmt.Errorf("key %q not found", "serial")
+			return bucket.Put([]byte("serial"), s.Bytes())
 		}
 		s = s.SetBytes(k)
 		return nil
@@ -138,31 +154,51 @@ func (db *Depot) Serial() (*big.Int, error) {
 	return s, nil
 }
 
-func (db *Depot) writeSerial(s *big.Int) error {
+// AllocateSerial implements depot.SerialAllocator. It returns the counter
+// and advances it in one transaction. Put advances the counter as well, so
+// the serial numbers of successive certificates skip values.
+func (db *Depot) AllocateSerial() (*big.Int, error) {
+	s := big.NewInt(2)
 	err := db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(certBucket))
 		if bucket == nil {
 			return fmt.Errorf("bucket %q not found!", certBucket)
 		}
-		return bucket.Put([]byte("serial"), []byte(s.Bytes()))
+		if k := bucket.Get([]byte("serial")); k != nil {
+			s.SetBytes(k)
+		}
+		next := new(big.Int).Add(s, big.NewInt(1))
+		return bucket.Put([]byte("serial"), next.Bytes())
 	})
-	return err
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
-func (db *Depot) hasKey(name []byte) bool {
-	var present bool
-	db.View(func(tx *bolt.Tx) error {
+// SeedSerial implements depot.SerialSeeder.
+func (db *Depot) SeedSerial(next *big.Int) error {
+	return db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(certBucket))
 		if bucket == nil {
 			return fmt.Errorf("bucket %q not found!", certBucket)
 		}
-		k := bucket.Get([]byte("serial"))
-		if k != nil {
-			present = true
+		if k := bucket.Get([]byte("serial")); k != nil && new(big.Int).SetBytes(k).Cmp(next) >= 0 {
+			return nil
 		}
-		return nil
+		return bucket.Put([]byte("serial"), next.Bytes())
+	})
+}
+
+func (db *Depot) writeSerial(s *big.Int) error {
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(certBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", certBucket)
+		}
+		return bucket.Put([]byte("serial"), []byte(s.Bytes()))
 	})
-	return present
+	return err
 }
 
 func (db *Depot) incrementSerial(s *big.Int) error {
@@ -200,6 +236,224 @@ func (db *Depot) HasCN(cn string, allowTime int, cert *x509.Certificate, revokeO
 	return hasCN, err
 }
 
+// GetCert returns the issued certificate with the given serial number.
+func (db *Depot) GetCert(serial *big.Int) (*x509.Certificate, error) {
+	var cert *x509.Certificate
+	suffix := []byte("." + serial.String())
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(certBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", certBucket)
+		}
+		if serials := tx.Bucket([]byte(serialBucket)); serials != nil {
+			if name := serials.Get(serial.Bytes()); name != nil {
+				var err error
+				cert, err = x509.ParseCertificate(bucketGetCopy(bucket, name))
+				return err
+			}
+		}
+		// certificates stored before the serial index existed
+		return bucket.ForEach(func(k, v []byte) error {
+			if cert != nil || !bytes.HasSuffix(k, suffix) {
+				return nil
+			}
+			crt, err := x509.ParseCertificate(v)
+			if err != nil {
+				return err
+			}
+			if crt.SerialNumber.Cmp(serial) == 0 {
+				// v is only valid during the transaction
+				cert, err = x509.ParseCertificate(bucketGetCopy(bucket, k))
+				return err
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil {
+		return nil, depot.ErrCertNotFound
+	}
+	return cert, nil
+}
+
+// Certs returns the issued certificates.
+func (db *Depot) Certs() ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(certBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", certBucket)
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			switch string(k) {
+			case "ca_certificate", "ca_key", "serial":
+				return nil
+			}
+			// v is only valid during the transaction
+			crt, err := x509.ParseCertificate(bucketGetCopy(bucket, k))
+			if err != nil {
+				return err
+			}
+			certs = append(certs, crt)
+			return nil
+		})
+	})
+	return certs, err
+}
+
+type revocation struct {
+	RevokedAt time.Time
+	NotAfter  time.Time
+	Reason    int
+}
+
+// Revoke marks the certificate with the given serial number as revoked.
+func (db *Depot) Revoke(serial *big.Int, reason int) error {
+	crt, err := db.GetCert(serial)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(revocation{
+		RevokedAt: time.Now().UTC(),
+		NotAfter:  crt.NotAfter,
+		Reason:    reason,
+	})
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(revokedBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", revokedBucket)
+		}
+		return bucket.Put(serial.Bytes(), value)
+	})
+}
+
+// Revoked returns the revoked, unexpired certificates.
+func (db *Depot) Revoked() ([]depot.Revocation, error) {
+	now := time.Now()
+	var revoked []depot.Revocation
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(revokedBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", revokedBucket)
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var r revocation
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			if r.NotAfter.Before(now) {
+				return nil
+			}
+			revoked = append(revoked, depot.Revocation{
+				SerialNumber: new(big.Int).SetBytes(k),
+				RevokedAt:    r.RevokedAt,
+				Reason:       r.Reason,
+			})
+			return nil
+		})
+	})
+	return revoked, err
+}
+
+// SaveTransaction creates or replaces the transaction with the ID of t.
+func (db *Depot) SaveTransaction(t *depot.Transaction) error {
+	value, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(transactionBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", transactionBucket)
+		}
+		return bucket.Put([]byte(t.ID), value)
+	})
+}
+
+// Transaction returns the transaction with id.
+func (db *Depot) Transaction(id scep.TransactionID) (*depot.Transaction, error) {
+	var t *depot.Transaction
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(transactionBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", transactionBucket)
+		}
+		value := bucket.Get([]byte(id))
+		if value == nil {
+			return depot.ErrTransactionNotFound
+		}
+		t = new(depot.Transaction)
+		return json.Unmarshal(value, t)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Transactions returns the transactions with status, or all of them if
+// status is empty, oldest first.
+func (db *Depot) Transactions(status depot.TransactionStatus) ([]*depot.Transaction, error) {
+	var txs []*depot.Transaction
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(transactionBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", transactionBucket)
+		}
+		return bucket.ForEach(func(_, v []byte) error {
+			t := new(depot.Transaction)
+			if err := json.Unmarshal(v, t); err != nil {
+				return err
+			}
+			if status == "" || t.Status == status {
+				txs = append(txs, t)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	depot.SortTransactions(txs)
+	return txs, nil
+}
+
+// PutCA stores the CA certificate and its RSA or ECDSA key. Bolt depots
+// store the key unencrypted, pass is ignored.
+func (db *Depot) PutCA(crt *x509.Certificate, key crypto.Signer, pass []byte) error {
+	block, err := cryptoutil.MarshalPrivateKeyPEM(key, nil)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(certBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", certBucket)
+		}
+		if bucket.Get([]byte("ca_certificate")) != nil || bucket.Get([]byte("ca_key")) != nil {
+			return errors.New("depot already has a CA")
+		}
+		if err := bucket.Put([]byte("ca_key"), block.Bytes); err != nil {
+			return err
+		}
+		return bucket.Put([]byte("ca_certificate"), crt.Raw)
+	})
+}
+
+// parseKey parses a PKCS#1 RSA key as stored by CreateOrLoadKey or a SEC 1
+// ECDSA key stored by PutCA.
+func parseKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	return x509.ParseECPrivateKey(der)
+}
+
 func (db *Depot) CreateOrLoadKey(bits int) (*rsa.PrivateKey, error) {
 	var (
 		key *rsa.PrivateKey
@@ -1,11 +1,19 @@
 package bolt
 
 import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"io/ioutil"
 	"math/big"
 	"os"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/depot"
+	"github.com/micromdm/scep/v2/scep"
 
 	"github.com/boltdb/bolt"
 )
@@ -107,6 +115,48 @@ func TestDepot_incrementSerial(t *testing.T) {
 	}
 }
 
+func TestDepot_AllocateSerial(t *testing.T) {
+	db := createDB(0666, nil)
+	const n = 20
+	serials := make(chan *big.Int, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serial, err := db.AllocateSerial()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			serials <- serial
+		}()
+	}
+	wg.Wait()
+	close(serials)
+	seen := make(map[string]bool)
+	for serial := range serials {
+		if seen[serial.String()] {
+			t.Errorf("serial %s allocated twice", serial)
+		}
+		seen[serial.String()] = true
+	}
+	if len(seen) != n {
+		t.Errorf("allocated %d serials, want %d", len(seen), n)
+	}
+
+	// seeding moves the counter forward only
+	if err := db.SeedSerial(big.NewInt(1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SeedSerial(big.NewInt(10)); err != nil {
+		t.Fatal(err)
+	}
+	if serial, err := db.AllocateSerial(); err != nil || serial.Int64() != 1000 {
+		t.Errorf("AllocateSerial() = %v, %v, want 1000", serial, err)
+	}
+}
+
 func TestDepot_CreateOrLoadKey(t *testing.T) {
 	db := createDB(0666, nil)
 	tests := []struct {
@@ -146,3 +196,169 @@ func TestDepot_CreateOrLoadCA(t *testing.T) {
 		}
 	}
 }
+
+func TestDepot_GetCert(t *testing.T) {
+	db := createDB(0666, nil)
+	key, err := db.CreateOrLoadKey(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := db.Serial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "getcert"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("getcert", crt); err != nil {
+		t.Fatal(err)
+	}
+	next, err := db.Serial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := new(big.Int).Add(serial, big.NewInt(1)); next.Cmp(want) != 0 {
+		t.Errorf("Depot.Serial() after Put = %v, want %v", next, want)
+	}
+
+	got, err := db.GetCert(crt.SerialNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(crt) {
+		t.Error("Depot.GetCert() returned a different certificate")
+	}
+	certs, err := db.Certs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || !certs[0].Equal(crt) {
+		t.Errorf("Depot.Certs() = %d certificates, want the stored one", len(certs))
+	}
+
+	if _, err := db.GetCert(big.NewInt(1000)); err != depot.ErrCertNotFound {
+		t.Errorf("Depot.GetCert() error = %v, want %v", err, depot.ErrCertNotFound)
+	}
+}
+
+func TestDepot_Revoke(t *testing.T) {
+	db := createDB(0666, nil)
+	key, err := db.CreateOrLoadKey(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := db.CreateOrLoadCA(key, 10, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := db.Serial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "revoke"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("revoke", crt); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Revoke(big.NewInt(1000), 0); err != depot.ErrCertNotFound {
+		t.Errorf("Depot.Revoke() error = %v, want %v", err, depot.ErrCertNotFound)
+	}
+	if err := db.Revoke(crt.SerialNumber, 1); err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := db.Revoked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 1 || revoked[0].SerialNumber.Cmp(crt.SerialNumber) != 0 || revoked[0].Reason != 1 {
+		t.Fatalf("Depot.Revoked() = %v, want serial %v with reason 1", revoked, crt.SerialNumber)
+	}
+
+	der, err = depot.NewCRLBuilder(db, ca, key).CRL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseCRL(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ca.CheckCRLSignature(crl); err != nil {
+		t.Error(err)
+	}
+	entries := crl.TBSCertList.RevokedCertificates
+	if len(entries) != 1 || entries[0].SerialNumber.Cmp(crt.SerialNumber) != 0 {
+		t.Fatalf("CRL lists %v, want serial %v", entries, crt.SerialNumber)
+	}
+	if len(entries[0].Extensions) != 1 {
+		t.Error("CRL entry is missing the reasonCode extension")
+	}
+}
+
+func TestDepot_Transactions(t *testing.T) {
+	db := createDB(0666, nil)
+	if _, err := db.Transaction("missing"); err != depot.ErrTransactionNotFound {
+		t.Errorf("Depot.Transaction() error = %v, want %v", err, depot.ErrTransactionNotFound)
+	}
+	created := time.Now().UTC().Truncate(time.Second)
+	for i, id := range []scep.TransactionID{"b", "a"} {
+		err := db.SaveTransaction(&depot.Transaction{
+			ID:        id,
+			Status:    depot.TransactionPending,
+			CSR:       []byte{byte(i)},
+			CreatedAt: created.Add(time.Duration(i) * time.Minute),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx, err := db.Transaction("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Status, tx.Reason = depot.TransactionRejected, "unknown device"
+	if err := db.SaveTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := db.Transactions(depot.TransactionPending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].ID != "b" {
+		t.Errorf("Depot.Transactions(pending) = %v, want b", pending)
+	}
+	all, err := db.Transactions("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].ID != "b" || all[1].ID != "a" {
+		t.Fatalf("Depot.Transactions() = %v, want b and a oldest first", all)
+	}
+	if all[1].Reason != "unknown device" || !all[1].CreatedAt.Equal(created.Add(time.Minute)) {
+		t.Errorf("Depot.Transactions() = %+v, want the saved rejection", all[1])
+	}
+}
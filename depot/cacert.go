@@ -2,10 +2,16 @@ package depot
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
 	"io"
 	"math/big"
+	"math/bits"
 	"time"
 
 	"github.com/micromdm/scep/v2/cryptoutil"
@@ -19,6 +25,7 @@ type CACert struct {
 	organizationalUnit string
 	years              int
 	keyUsage           x509.KeyUsage
+	maxPathLen         int
 }
 
 // NewCACert creates a new CACert object with options
@@ -28,6 +35,7 @@ func NewCACert(opts ...CACertOption) *CACert {
 		organizationalUnit: "SCEP CA",
 		years:              10,
 		keyUsage:           x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		maxPathLen:         -1,
 	}
 	for _, opt := range opts {
 		opt(c)
@@ -79,6 +87,14 @@ func WithKeyUsage(usage x509.KeyUsage) CACertOption {
 	}
 }
 
+// WithMaxPathLen limits the number of intermediate CAs below the CA, 0 for
+// none. By default the path length is unconstrained.
+func WithMaxPathLen(n int) CACertOption {
+	return func(c *CACert) {
+		c.maxPathLen = n
+	}
+}
+
 // newPkixName creates a new pkix.Name from c
 func (c *CACert) newPkixName() *pkix.Name {
 	return &pkix.Name{
@@ -111,8 +127,8 @@ func (c *CACert) SelfSign(rand io.Reader, pub crypto.PublicKey, priv interface{}
 		BasicConstraintsValid: true,
 		IsCA:                  true,
 
-		// Not allow any non-self-issued intermediate CA
-		MaxPathLen: 0,
+		MaxPathLen:     c.maxPathLen,
+		MaxPathLenZero: c.maxPathLen == 0,
 
 		// 160-bit SHA-1 hash of the value of the BIT STRING subjectPublicKey
 		// (excluding the tag, length, and number of unused bits)
@@ -121,3 +137,96 @@ func (c *CACert) SelfSign(rand io.Reader, pub crypto.PublicKey, priv interface{}
 
 	return x509.CreateCertificate(rand, &tmpl, &tmpl, pub, priv)
 }
+
+// CreateCSR creates a PKCS#10 request for the CA certificate signed with
+// priv, e.g. to have the CA issued by an offline root. It requests the
+// basic constraints and key usage of c with an extensionRequest.
+func (c *CACert) CreateCSR(rand io.Reader, priv crypto.Signer) ([]byte, error) {
+	bc := basicConstraints{IsCA: true, MaxPathLen: -1}
+	if c.maxPathLen >= 0 {
+		bc.MaxPathLen = c.maxPathLen
+	}
+	bcDER, err := asn1.Marshal(bc)
+	if err != nil {
+		return nil, err
+	}
+	kuDER, err := marshalKeyUsage(c.keyUsage)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.CertificateRequest{
+		Subject: *c.newPkixName(),
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidExtensionBasicConstraints, Critical: true, Value: bcDER},
+			{Id: oidExtensionKeyUsage, Critical: true, Value: kuDER},
+		},
+	}
+	return x509.CreateCertificateRequest(rand, tmpl, priv)
+}
+
+var (
+	oidExtensionKeyUsage         = asn1.ObjectIdentifier{2, 5, 29, 15}
+	oidExtensionBasicConstraints = asn1.ObjectIdentifier{2, 5, 29, 19}
+)
+
+// basicConstraints is the RFC 5280 BasicConstraints extension.
+type basicConstraints struct {
+	IsCA       bool `asn1:"optional"`
+	MaxPathLen int  `asn1:"optional,default:-1"`
+}
+
+// marshalKeyUsage encodes usage as the RFC 5280 KeyUsage BIT STRING, bit 0
+// being digitalSignature.
+func marshalKeyUsage(usage x509.KeyUsage) ([]byte, error) {
+	b := []byte{bits.Reverse8(byte(usage)), bits.Reverse8(byte(usage >> 8))}
+	if b[1] == 0 {
+		b = b[:1]
+	}
+	bitLen := len(b) * 8
+	for bitLen > 0 && b[(bitLen-1)/8]&(0x80>>uint((bitLen-1)%8)) == 0 {
+		bitLen--
+	}
+	return asn1.Marshal(asn1.BitString{Bytes: b, BitLength: bitLen})
+}
+
+// GenerateKey creates a CA private key: an RSA key of size bits for keyType
+// "rsa", or an ECDSA key on the NIST curve of size bits, 256, 384 or 521,
+// for keyType "ecdsa".
+func GenerateKey(rand io.Reader, keyType string, size int) (crypto.Signer, error) {
+	switch keyType {
+	case "rsa":
+		return rsa.GenerateKey(rand, size)
+	case "ecdsa":
+		var curve elliptic.Curve
+		switch size {
+		case 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported ECDSA key size %d, want 256, 384 or 521", size)
+		}
+		return ecdsa.GenerateKey(curve, rand)
+	default:
+		return nil, fmt.Errorf("unknown key type %q, want rsa or ecdsa", keyType)
+	}
+}
+
+// InitCA self-signs the CA certificate c with key and stores both in store,
+// the key encrypted with pass where the depot supports it.
+func InitCA(rand io.Reader, store CAStore, c *CACert, key crypto.Signer, pass []byte) (*x509.Certificate, error) {
+	crtBytes, err := c.SelfSign(rand, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	crt, err := x509.ParseCertificate(crtBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.PutCA(crt, key, pass); err != nil {
+		return nil, err
+	}
+	return crt, nil
+}
@@ -0,0 +1,107 @@
+package depot
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"testing"
+)
+
+type memCAStore struct {
+	crt *x509.Certificate
+	key crypto.Signer
+}
+
+func (s *memCAStore) PutCA(crt *x509.Certificate, key crypto.Signer, pass []byte) error {
+	if s.crt != nil {
+		return errors.New("depot already has a CA")
+	}
+	s.crt, s.key = crt, key
+	return nil
+}
+
+func TestInitCA(t *testing.T) {
+	key, err := GenerateKey(rand.Reader, "ecdsa", 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := new(memCAStore)
+	crt, err := InitCA(rand.Reader, store, NewCACert(WithCommonName("Test CA"), WithMaxPathLen(0)), key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := crt.PublicKey.(*ecdsa.PublicKey); !ok {
+		t.Errorf("want an ECDSA CA certificate, have %T", crt.PublicKey)
+	}
+	if !crt.IsCA || crt.MaxPathLen != 0 || !crt.MaxPathLenZero {
+		t.Errorf("want a CA with path length 0, have IsCA %v, MaxPathLen %d", crt.IsCA, crt.MaxPathLen)
+	}
+	if crt.Subject.CommonName != "Test CA" {
+		t.Errorf("CommonName = %q, want %q", crt.Subject.CommonName, "Test CA")
+	}
+	if store.crt != crt || store.key != key {
+		t.Error("CA not stored")
+	}
+	if _, err := InitCA(rand.Reader, store, NewCACert(), key, nil); err == nil {
+		t.Error("want an error storing a second CA")
+	}
+
+	if _, err := GenerateKey(rand.Reader, "ecdsa", 224); err == nil {
+		t.Error("want an error for an unsupported curve")
+	}
+}
+
+func TestCACertCreateCSR(t *testing.T) {
+	key, err := GenerateKey(rand.Reader, "rsa", 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage := x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	der, err := NewCACert(WithCommonName("Issuing CA"), WithMaxPathLen(1), WithKeyUsage(usage)).CreateCSR(rand.Reader, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the requested extensions are those of a certificate with the settings
+	tmpl := &x509.Certificate{
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            1,
+		KeyUsage:              usage,
+		SerialNumber:          big.NewInt(1),
+	}
+	crtDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(crtDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := make(map[string][]byte)
+	for _, ext := range crt.Extensions {
+		want[ext.Id.String()] = ext.Value
+	}
+	for _, ext := range csr.Extensions {
+		if w, ok := want[ext.Id.String()]; ok && !bytes.Equal(ext.Value, w) {
+			t.Errorf("extension %s = %x, want %x", ext.Id, ext.Value, w)
+		}
+		delete(want, ext.Id.String())
+	}
+	for _, oid := range []string{"2.5.29.15", "2.5.29.19"} {
+		if _, ok := want[oid]; ok {
+			t.Errorf("extension %s not requested", oid)
+		}
+	}
+}
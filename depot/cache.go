@@ -0,0 +1,232 @@
+package depot
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// maxCachedCerts bounds the certificates looked up by serial number which a
+// Cache keeps.
+const maxCachedCerts = 10000
+
+// Cache is a Depot which memoizes the CA, the certificates looked up by
+// serial number and the certificate and revocation lists of another depot
+// for a TTL, e.g. to spare a SQL or remote depot most reads during
+// enrollment bursts. Serial numbers are never cached.
+//
+// Put, Revoke and HasCN invalidate the lists they change, so a Cache sees
+// its own writes at once; writes of other replicas sharing the depot are
+// seen once the TTL expires.
+//
+// Besides Depot, a Cache implements SerialAllocator, CertGetter,
+// CertLister, Revoker, RevocationLister and CRLGetter, forwarding to the
+// wrapped depot. AllocateSerial falls back to Serial, like the Signer, and
+// CRL returns ErrCRLNotFound if the wrapped depot does not implement them.
+// Other optional interfaces, like TransactionStore, must be used on the
+// wrapped depot.
+type Cache struct {
+	depot Depot
+	ttl   time.Duration
+	now   func() time.Time
+
+	mu      sync.Mutex
+	ca      map[string]cachedCA
+	certs   map[string]cachedCert
+	list    []*x509.Certificate
+	listAt  time.Time
+	revoked []Revocation
+	revAt   time.Time
+	// gen counts the invalidations, so that lists read before one are
+	// not cached after it.
+	gen uint64
+}
+
+type cachedCA struct {
+	certs []*x509.Certificate
+	key   crypto.Signer
+	at    time.Time
+}
+
+type cachedCert struct {
+	crt *x509.Certificate
+	at  time.Time
+}
+
+// NewCache returns a Cache of d keeping what it read for ttl.
+func NewCache(d Depot, ttl time.Duration) *Cache {
+	return &Cache{
+		depot: d,
+		ttl:   ttl,
+		now:   time.Now,
+		ca:    make(map[string]cachedCA),
+		certs: make(map[string]cachedCert),
+	}
+}
+
+// fresh reports whether something cached at t has not expired.
+func (c *Cache) fresh(t time.Time) bool {
+	return !t.IsZero() && c.now().Sub(t) < c.ttl
+}
+
+func (c *Cache) CA(pass []byte) ([]*x509.Certificate, crypto.Signer, error) {
+	c.mu.Lock()
+	ca, ok := c.ca[string(pass)]
+	c.mu.Unlock()
+	if ok && c.fresh(ca.at) {
+		return ca.certs, ca.key, nil
+	}
+	certs, key, err := c.depot.CA(pass)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.mu.Lock()
+	c.ca[string(pass)] = cachedCA{certs: certs, key: key, at: c.now()}
+	c.mu.Unlock()
+	return certs, key, nil
+}
+
+func (c *Cache) Put(name string, crt *x509.Certificate) error {
+	if err := c.depot.Put(name, crt); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.listAt = time.Time{}
+	c.gen++
+	c.putCert(crt)
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Cache) Serial() (*big.Int, error) {
+	return c.depot.Serial()
+}
+
+// AllocateSerial allocates a serial number with the wrapped depot if it is
+// a SerialAllocator, or else returns its Serial.
+func (c *Cache) AllocateSerial() (*big.Int, error) {
+	if a, ok := c.depot.(SerialAllocator); ok {
+		return a.AllocateSerial()
+	}
+	return c.depot.Serial()
+}
+
+func (c *Cache) HasCN(cn string, allowTime int, cert *x509.Certificate, revokeOldCertificate bool) (bool, error) {
+	has, err := c.depot.HasCN(cn, allowTime, cert, revokeOldCertificate)
+	if revokeOldCertificate {
+		c.mu.Lock()
+		c.revAt = time.Time{}
+		c.gen++
+		c.mu.Unlock()
+	}
+	return has, err
+}
+
+func (c *Cache) GetCert(serial *big.Int) (*x509.Certificate, error) {
+	c.mu.Lock()
+	cached, ok := c.certs[serial.String()]
+	c.mu.Unlock()
+	if ok && c.fresh(cached.at) {
+		return cached.crt, nil
+	}
+	getter, ok := c.depot.(CertGetter)
+	if !ok {
+		return nil, ErrCertNotFound
+	}
+	crt, err := getter.GetCert(serial)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.putCert(crt)
+	c.mu.Unlock()
+	return crt, nil
+}
+
+// putCert caches crt for GetCert. c.mu must be held.
+func (c *Cache) putCert(crt *x509.Certificate) {
+	if len(c.certs) >= maxCachedCerts {
+		for serial, cached := range c.certs {
+			if !c.fresh(cached.at) {
+				delete(c.certs, serial)
+			}
+		}
+		if len(c.certs) >= maxCachedCerts {
+			c.certs = make(map[string]cachedCert)
+		}
+	}
+	c.certs[crt.SerialNumber.String()] = cachedCert{crt: crt, at: c.now()}
+}
+
+func (c *Cache) Certs() ([]*x509.Certificate, error) {
+	c.mu.Lock()
+	list, at, gen := c.list, c.listAt, c.gen
+	c.mu.Unlock()
+	if c.fresh(at) {
+		return append([]*x509.Certificate(nil), list...), nil
+	}
+	lister, ok := c.depot.(CertLister)
+	if !ok {
+		return nil, errors.New("depot does not list certificates")
+	}
+	list, err := lister.Certs()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.gen == gen {
+		c.list, c.listAt = list, c.now()
+	}
+	c.mu.Unlock()
+	return append([]*x509.Certificate(nil), list...), nil
+}
+
+func (c *Cache) Revoke(serial *big.Int, reason int) error {
+	revoker, ok := c.depot.(Revoker)
+	if !ok {
+		return errors.New("depot does not revoke certificates")
+	}
+	if err := revoker.Revoke(serial, reason); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.revAt = time.Time{}
+	c.gen++
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Cache) Revoked() ([]Revocation, error) {
+	c.mu.Lock()
+	revoked, at, gen := c.revoked, c.revAt, c.gen
+	c.mu.Unlock()
+	if c.fresh(at) {
+		return append([]Revocation(nil), revoked...), nil
+	}
+	lister, ok := c.depot.(RevocationLister)
+	if !ok {
+		return nil, errors.New("depot does not list revocations")
+	}
+	revoked, err := lister.Revoked()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.gen == gen {
+		c.revoked, c.revAt = revoked, c.now()
+	}
+	c.mu.Unlock()
+	return append([]Revocation(nil), revoked...), nil
+}
+
+// CRL returns the CRL of the wrapped depot. It is not cached.
+func (c *Cache) CRL() ([]byte, error) {
+	getter, ok := c.depot.(CRLGetter)
+	if !ok {
+		return nil, ErrCRLNotFound
+	}
+	return getter.CRL()
+}
@@ -0,0 +1,108 @@
+package depot
+
+import (
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// countingDepot counts the reads of a memDepot.
+type countingDepot struct {
+	*memDepot
+	certsCalls, revokedCalls int
+}
+
+func (d *countingDepot) Certs() ([]*x509.Certificate, error) {
+	d.certsCalls++
+	return d.memDepot.Certs()
+}
+
+func (d *countingDepot) Revoked() ([]Revocation, error) {
+	d.revokedCalls++
+	return d.memDepot.Revoked()
+}
+
+func (d *countingDepot) GetCert(serial *big.Int) (*x509.Certificate, error) {
+	for _, crt := range d.certs {
+		if crt.SerialNumber.Cmp(serial) == 0 {
+			return crt, nil
+		}
+	}
+	return nil, ErrCertNotFound
+}
+
+func TestCache(t *testing.T) {
+	backend := &countingDepot{memDepot: new(memDepot)}
+	now := time.Now()
+	cache := NewCache(backend, time.Minute)
+	cache.now = func() time.Time { return now }
+
+	certs := func(want int) {
+		t.Helper()
+		list, err := cache.Certs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != want {
+			t.Errorf("have %d certificates, want %d", len(list), want)
+		}
+	}
+	certs(0)
+	certs(0)
+	if backend.certsCalls != 1 {
+		t.Errorf("listed certificates %d times, want 1", backend.certsCalls)
+	}
+
+	// a Put invalidates the list
+	crt := &x509.Certificate{SerialNumber: big.NewInt(2)}
+	if err := cache.Put("device", crt); err != nil {
+		t.Fatal(err)
+	}
+	certs(1)
+	if backend.certsCalls != 2 {
+		t.Errorf("listed certificates %d times, want 2", backend.certsCalls)
+	}
+
+	// writes of other replicas are seen after the TTL
+	backend.certs = append(backend.certs, &x509.Certificate{SerialNumber: big.NewInt(3)})
+	certs(1)
+	now = now.Add(time.Minute)
+	certs(2)
+
+	if _, err := cache.Revoked(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Revoke(big.NewInt(2), 1); err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := cache.Revoked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 1 || backend.revokedCalls != 2 {
+		t.Errorf("have %d revocations after %d lists, want 1 after 2", len(revoked), backend.revokedCalls)
+	}
+
+	// GetCert is answered from the cache, even once the backend forgot
+	if _, err := cache.GetCert(big.NewInt(2)); err != nil {
+		t.Fatal(err)
+	}
+	backend.certs = nil
+	if have, err := cache.GetCert(big.NewInt(2)); err != nil || have != crt {
+		t.Errorf("have %v, %v, want the cached certificate", have, err)
+	}
+	now = now.Add(time.Minute)
+	if _, err := cache.GetCert(big.NewInt(2)); err != ErrCertNotFound {
+		t.Errorf("want ErrCertNotFound after the TTL, have %v", err)
+	}
+
+	// memDepot is no SerialAllocator
+	serial, err := cache.AllocateSerial()
+	if err != nil || serial.Int64() != 1 {
+		t.Errorf("have serial %v, %v, want 1 from Serial", serial, err)
+	}
+	if _, err := cache.CRL(); err != ErrCRLNotFound {
+		t.Errorf("want ErrCRLNotFound, have %v", err)
+	}
+}
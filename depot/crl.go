@@ -0,0 +1,83 @@
+package depot
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+	"math/big"
+	"time"
+)
+
+var oidExtensionReasonCode = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+// CreateCRL creates a DER encoded X.509 CRL of revoked signed by the CA
+// certificate ca with its key. The CRL number is derived from thisUpdate, so
+// that later CRLs have higher numbers.
+func CreateCRL(rand io.Reader, revoked []Revocation, ca *x509.Certificate, key crypto.Signer, thisUpdate, nextUpdate time.Time) ([]byte, error) {
+	entries := make([]pkix.RevokedCertificate, 0, len(revoked))
+	for _, r := range revoked {
+		entry := pkix.RevokedCertificate{SerialNumber: r.SerialNumber, RevocationTime: r.RevokedAt.UTC()}
+		if r.Reason != 0 {
+			value, err := asn1.Marshal(asn1.Enumerated(r.Reason))
+			if err != nil {
+				return nil, err
+			}
+			entry.Extensions = []pkix.Extension{{Id: oidExtensionReasonCode, Value: value}}
+		}
+		entries = append(entries, entry)
+	}
+	return x509.CreateRevocationList(rand, &x509.RevocationList{
+		RevokedCertificates: entries,
+		Number:              big.NewInt(thisUpdate.Unix()),
+		ThisUpdate:          thisUpdate,
+		NextUpdate:          nextUpdate,
+	}, ca, key)
+}
+
+// CRLBuilder is a CRLGetter which signs a fresh CRL of the certificates
+// revoked in a depot on every call.
+type CRLBuilder struct {
+	revoked  RevocationLister
+	ca       *x509.Certificate
+	key      crypto.Signer
+	validity time.Duration
+}
+
+// CRLOption configures a CRLBuilder.
+type CRLOption func(*CRLBuilder)
+
+// WithCRLValidity sets the time until the nextUpdate of the CRL. The
+// default is 24 hours.
+func WithCRLValidity(validity time.Duration) CRLOption {
+	return func(b *CRLBuilder) {
+		b.validity = validity
+	}
+}
+
+// NewCRLBuilder creates a CRLBuilder listing the certificates revoked in
+// revoked, signing with the CA certificate ca and its key.
+func NewCRLBuilder(revoked RevocationLister, ca *x509.Certificate, key crypto.Signer, opts ...CRLOption) *CRLBuilder {
+	b := &CRLBuilder{
+		revoked:  revoked,
+		ca:       ca,
+		key:      key,
+		validity: 24 * time.Hour,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// CRL returns a newly signed DER encoded CRL.
+func (b *CRLBuilder) CRL() ([]byte, error) {
+	revoked, err := b.revoked.Revoked()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return CreateCRL(rand.Reader, revoked, b.ca, b.key, now, now.Add(b.validity))
+}
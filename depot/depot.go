@@ -1,15 +1,97 @@
 package depot
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
+	"errors"
 	"math/big"
+	"time"
 )
 
 // Depot is a repository for managing certificates
 type Depot interface {
-	CA(pass []byte) ([]*x509.Certificate, *rsa.PrivateKey, error)
+	CA(pass []byte) ([]*x509.Certificate, crypto.Signer, error)
 	Put(name string, crt *x509.Certificate) error
 	Serial() (*big.Int, error)
 	HasCN(cn string, allowTime int, cert *x509.Certificate, revokeOldCertificate bool) (bool, error)
 }
+
+// SerialAllocator is implemented by depots which allocate serial numbers
+// atomically: every call returns a serial number no other call returned,
+// including calls of other replicas sharing the depot. Signers prefer it to
+// Depot.Serial, which returns the current value of a counter that only Put
+// advances, so concurrent requests may get the same serial number.
+type SerialAllocator interface {
+	AllocateSerial() (*big.Int, error)
+}
+
+// SerialSeeder is implemented by depots whose serial counter can be moved
+// forward, e.g. to continue the counter of a file depot when migrating to
+// a database.
+type SerialSeeder interface {
+	// SeedSerial makes the depot allocate serial numbers of at least next.
+	// It never moves the counter back.
+	SeedSerial(next *big.Int) error
+}
+
+// CAStore is implemented by depots which can store a new CA, e.g. one
+// created with InitCA.
+type CAStore interface {
+	// PutCA stores the CA certificate and its RSA or ECDSA key, encrypted
+	// with pass where the depot supports it. It fails if the depot already
+	// has a CA.
+	PutCA(crt *x509.Certificate, key crypto.Signer, pass []byte) error
+}
+
+// CertGetter is implemented by depots which can look up previously issued
+// certificates, e.g. to answer SCEP GetCert requests.
+type CertGetter interface {
+	// GetCert returns the certificate with the given serial number or
+	// ErrCertNotFound.
+	GetCert(serial *big.Int) (*x509.Certificate, error)
+}
+
+// CertLister is implemented by depots which can list the issued
+// certificates, e.g. to search them in an admin interface.
+type CertLister interface {
+	// Certs returns the issued certificates, including the expired and
+	// revoked ones.
+	Certs() ([]*x509.Certificate, error)
+}
+
+// ErrCertNotFound is returned by a CertGetter if no certificate with the
+// requested serial number is stored.
+var ErrCertNotFound = errors.New("certificate not found")
+
+// CRLGetter is implemented by depots which store a CRL of the CA, e.g. to
+// answer SCEP GetCRL requests.
+type CRLGetter interface {
+	// CRL returns the current DER encoded CRL of the CA or ErrCRLNotFound.
+	CRL() ([]byte, error)
+}
+
+// ErrCRLNotFound is returned by a CRLGetter if no CRL is stored.
+var ErrCRLNotFound = errors.New("CRL not found")
+
+// Revoker is implemented by depots which can revoke issued certificates.
+type Revoker interface {
+	// Revoke marks the certificate with the given serial number as revoked
+	// with an RFC 5280 CRLReason, or 0 for unspecified. It returns
+	// ErrCertNotFound if no such certificate was issued.
+	Revoke(serial *big.Int, reason int) error
+}
+
+// Revocation is a revoked certificate.
+type Revocation struct {
+	SerialNumber *big.Int
+	RevokedAt    time.Time
+	// Reason is an RFC 5280 CRLReason, 0 for unspecified.
+	Reason int
+}
+
+// RevocationLister is implemented by depots which can list the revoked
+// certificates, e.g. to sign a CRL with NewCRLBuilder.
+type RevocationLister interface {
+	// Revoked returns the revoked certificates which have not expired yet.
+	Revoked() ([]Revocation, error)
+}
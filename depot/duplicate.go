@@ -0,0 +1,159 @@
+package depot
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// Duplicates selects what WithDuplicates compares with the active, i.e.
+// unexpired and unrevoked, certificates of the depot.
+type Duplicates uint
+
+const (
+	// DuplicateKeys detects requests reusing the public key of an active
+	// certificate.
+	DuplicateKeys Duplicates = 1 << iota
+	// DuplicateSubjects detects requests for the subject of an active
+	// certificate.
+	DuplicateSubjects
+)
+
+// DuplicateAction is how WithDuplicates handles a detected duplicate.
+type DuplicateAction int
+
+const (
+	// RejectDuplicates rejects the request with ErrDuplicate.
+	RejectDuplicates DuplicateAction = iota
+	// RenewDuplicates only signs renewals signed with the key of the
+	// active certificates, and rejects other requests with ErrDuplicate.
+	RenewDuplicates
+	// SupersedeDuplicates signs the request and then revokes the active
+	// certificates with the superseded CRLReason. The depot must be a
+	// Revoker.
+	SupersedeDuplicates
+)
+
+// crlReasonSuperseded is the RFC 5280 superseded CRLReason.
+const crlReasonSuperseded = 4
+
+// ErrDuplicate is returned by a Signer with WithDuplicates for a request
+// duplicating an active certificate.
+var ErrDuplicate = errors.New("duplicate of an active certificate")
+
+// WithDuplicates detects requests duplicating active certificates of the
+// depot and handles them with action. The depot must be a CertLister; if
+// it is a RevocationLister the revoked certificates are ignored. Subjects
+// are compared after the WithRewrite templates are applied. The check
+// replaces the one of WithAllowRenewalDays.
+func WithDuplicates(check Duplicates, action DuplicateAction) Option {
+	return func(s *Signer) {
+		s.duplicates = check
+		s.duplicateAction = action
+	}
+}
+
+// findDuplicates returns the active certificates of the depot duplicating
+// the certificate tmpl for the CSR of m.
+func (s *Signer) findDuplicates(m *scep.CSRReqMessage, tmpl *x509.Certificate) ([]*x509.Certificate, error) {
+	lister, ok := s.depot.(CertLister)
+	if !ok {
+		return nil, errors.New("depot does not list certificates to detect duplicates")
+	}
+	certs, err := lister.Certs()
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := s.revokedSerials()
+	if err != nil {
+		return nil, err
+	}
+
+	subject := tmpl.Subject.String()
+	now := time.Now()
+	var duplicates []*x509.Certificate
+	for _, crt := range certs {
+		if now.After(crt.NotAfter) || revoked[crt.SerialNumber.String()] {
+			continue
+		}
+		if s.duplicates&DuplicateKeys != 0 && bytes.Equal(crt.RawSubjectPublicKeyInfo, m.CSR.RawSubjectPublicKeyInfo) ||
+			s.duplicates&DuplicateSubjects != 0 && subject != "" && crt.Subject.String() == subject {
+			duplicates = append(duplicates, crt)
+		}
+	}
+	return duplicates, nil
+}
+
+// checkDuplicates returns ErrDuplicate if the action does not allow the
+// request m duplicating the active certificates duplicates.
+func (s *Signer) checkDuplicates(m *scep.CSRReqMessage, duplicates []*x509.Certificate) error {
+	if len(duplicates) == 0 {
+		return nil
+	}
+	switch s.duplicateAction {
+	case SupersedeDuplicates:
+		if _, ok := s.depot.(Revoker); !ok {
+			return errors.New("depot does not revoke superseded certificates")
+		}
+		return nil
+	case RenewDuplicates:
+		if m.IsRenewal() && m.SignerCert != nil {
+			renewal := true
+			for _, crt := range duplicates {
+				if !bytes.Equal(crt.RawSubjectPublicKeyInfo, m.SignerCert.RawSubjectPublicKeyInfo) {
+					renewal = false
+				}
+			}
+			if renewal {
+				return nil
+			}
+		}
+	}
+	crt := duplicates[0]
+	return fmt.Errorf("%w: certificate %X of %s", ErrDuplicate, crt.SerialNumber, crt.Subject)
+}
+
+// supersede revokes the duplicates of a signed request if the action is
+// SupersedeDuplicates.
+func (s *Signer) supersede(duplicates []*x509.Certificate) error {
+	if s.duplicateAction != SupersedeDuplicates || len(duplicates) == 0 {
+		return nil
+	}
+	// the depot may already have revoked them when storing the new one
+	revoked, err := s.revokedSerials()
+	if err != nil {
+		return err
+	}
+	revoker := s.depot.(Revoker)
+	for _, crt := range duplicates {
+		if revoked[crt.SerialNumber.String()] {
+			continue
+		}
+		if err := revoker.Revoke(crt.SerialNumber, crlReasonSuperseded); err != nil {
+			return fmt.Errorf("revoke superseded certificate %X: %w", crt.SerialNumber, err)
+		}
+	}
+	return nil
+}
+
+// revokedSerials returns the serial numbers of the revoked certificates if
+// the depot is a RevocationLister.
+func (s *Signer) revokedSerials() (map[string]bool, error) {
+	revoked := make(map[string]bool)
+	rl, ok := s.depot.(RevocationLister)
+	if !ok {
+		return revoked, nil
+	}
+	revocations, err := rl.Revoked()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range revocations {
+		revoked[r.SerialNumber.String()] = true
+	}
+	return revoked, nil
+}
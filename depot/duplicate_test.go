@@ -0,0 +1,137 @@
+package depot
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// memDepot is a Depot, CertLister, Revoker and RevocationLister in memory.
+type memDepot struct {
+	certs   []*x509.Certificate
+	revoked []Revocation
+	serial  int64
+}
+
+func (d *memDepot) CA(pass []byte) ([]*x509.Certificate, crypto.Signer, error) {
+	return nil, nil, errors.New("no CA")
+}
+
+func (d *memDepot) Put(name string, crt *x509.Certificate) error {
+	d.certs = append(d.certs, crt)
+	return nil
+}
+
+func (d *memDepot) Serial() (*big.Int, error) {
+	d.serial++
+	return big.NewInt(d.serial), nil
+}
+
+func (d *memDepot) HasCN(cn string, allowTime int, cert *x509.Certificate, revokeOldCertificate bool) (bool, error) {
+	return false, nil
+}
+
+func (d *memDepot) Certs() ([]*x509.Certificate, error) { return d.certs, nil }
+
+func (d *memDepot) Revoke(serial *big.Int, reason int) error {
+	d.revoked = append(d.revoked, Revocation{SerialNumber: serial, RevokedAt: time.Now(), Reason: reason})
+	return nil
+}
+
+func (d *memDepot) Revoked() ([]Revocation, error) { return d.revoked, nil }
+
+func TestDuplicates(t *testing.T) {
+	caKey, err := GenerateKey(rand.Reader, "ecdsa", 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := InitCA(rand.Reader, new(memCAStore), NewCACert(WithCommonName("Test CA")), caKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newMessage := func(t *testing.T, cn string, key crypto.Signer) *scep.CSRReqMessage {
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &scep.CSRReqMessage{CSR: csr, MessageType: scep.PKCSReq}
+	}
+	key1, err := GenerateKey(rand.Reader, "ecdsa", 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := GenerateKey(rand.Reader, "ecdsa", 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		testName string
+		check    Duplicates
+		action   DuplicateAction
+		second   func(t *testing.T, first *x509.Certificate) *scep.CSRReqMessage
+		allowed  bool
+	}{
+		{"other subject and key", DuplicateKeys | DuplicateSubjects, RejectDuplicates, func(t *testing.T, _ *x509.Certificate) *scep.CSRReqMessage {
+			return newMessage(t, "device-2", key2)
+		}, true},
+		{"reused key", DuplicateKeys, RejectDuplicates, func(t *testing.T, _ *x509.Certificate) *scep.CSRReqMessage {
+			return newMessage(t, "device-2", key1)
+		}, false},
+		{"reused subject", DuplicateSubjects, RejectDuplicates, func(t *testing.T, _ *x509.Certificate) *scep.CSRReqMessage {
+			return newMessage(t, "device-1", key2)
+		}, false},
+		{"reused subject unchecked", DuplicateKeys, RejectDuplicates, func(t *testing.T, _ *x509.Certificate) *scep.CSRReqMessage {
+			return newMessage(t, "device-1", key2)
+		}, true},
+		{"enrollment instead of renewal", DuplicateSubjects, RenewDuplicates, func(t *testing.T, _ *x509.Certificate) *scep.CSRReqMessage {
+			return newMessage(t, "device-1", key2)
+		}, false},
+		{"renewal with original key", DuplicateSubjects, RenewDuplicates, func(t *testing.T, first *x509.Certificate) *scep.CSRReqMessage {
+			m := newMessage(t, "device-1", key2)
+			m.MessageType, m.SignerCert = scep.RenewalReq, first
+			return m
+		}, true},
+		{"superseded", DuplicateKeys | DuplicateSubjects, SupersedeDuplicates, func(t *testing.T, _ *x509.Certificate) *scep.CSRReqMessage {
+			return newMessage(t, "device-1", key2)
+		}, true},
+	} {
+		test := test
+		t.Run(test.testName, func(t *testing.T) {
+			t.Parallel()
+			depot := new(memDepot)
+			signer := NewSigner(depot, WithCA(ca, caKey), WithDuplicates(test.check, test.action))
+			first, err := signer.SignCSR(newMessage(t, "device-1", key1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = signer.SignCSR(test.second(t, first))
+			if test.allowed && err != nil {
+				t.Fatal(err)
+			}
+			if !test.allowed && !errors.Is(err, ErrDuplicate) {
+				t.Fatalf("want ErrDuplicate, have %v", err)
+			}
+			if test.action == SupersedeDuplicates {
+				if len(depot.revoked) != 1 || depot.revoked[0].SerialNumber.Cmp(first.SerialNumber) != 0 || depot.revoked[0].Reason != crlReasonSuperseded {
+					t.Errorf("revoked = %v, want the first certificate as superseded", depot.revoked)
+				}
+				// the superseded certificate is no longer a duplicate
+				if _, err := signer.SignCSR(newMessage(t, "device-3", key1)); err != nil {
+					t.Errorf("reusing the key of the superseded certificate: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -3,6 +3,8 @@ package file
 import (
 	"bufio"
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
@@ -17,6 +19,9 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/micromdm/scep/v2/cryptoutil"
+	"github.com/micromdm/scep/v2/depot"
 )
 
 // NewFileDepot returns a new cert depot.
@@ -34,7 +39,7 @@ type fileDepot struct {
 	dirPath string
 }
 
-func (d *fileDepot) CA(pass []byte) ([]*x509.Certificate, *rsa.PrivateKey, error) {
+func (d *fileDepot) CA(pass []byte) ([]*x509.Certificate, crypto.Signer, error) {
 	caPEM, err := d.getFile("ca.pem")
 	if err != nil {
 		return nil, nil, err
@@ -57,10 +62,45 @@ func (d *fileDepot) CA(pass []byte) ([]*x509.Certificate, *rsa.PrivateKey, error
 // file permissions
 const (
 	certPerm   = 0444
+	keyPerm    = 0400
 	serialPerm = 0400
 	dbPerm     = 0600
 )
 
+// PutCA writes the CA certificate and key to ca.pem and ca.key. The key is
+// encrypted if pass is not empty. Existing files are not overwritten.
+func (d *fileDepot) PutCA(crt *x509.Certificate, key crypto.Signer, pass []byte) error {
+	block, err := cryptoutil.MarshalPrivateKeyPEM(key, pass)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(d.dirPath, 0755); err != nil {
+		return err
+	}
+	if err := d.create("ca.key", pem.EncodeToMemory(block), keyPerm); err != nil {
+		return err
+	}
+	if err := d.create("ca.pem", pemCert(crt.Raw), certPerm); err != nil {
+		os.Remove(d.path("ca.key"))
+		return err
+	}
+	return nil
+}
+
+// create writes data to the new file name, removing it again on failure.
+func (d *fileDepot) create(name string, data []byte, perm os.FileMode) error {
+	file, err := os.OpenFile(d.path(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		os.Remove(d.path(name))
+		return err
+	}
+	return nil
+}
+
 // Put adds a certificate to the depot
 func (d *fileDepot) Put(cn string, crt *x509.Certificate) error {
 	if crt == nil {
@@ -254,6 +294,204 @@ func (d *fileDepot) HasCN(_ string, allowTime int, cert *x509.Certificate, revok
 	return true, nil
 }
 
+// GetCert returns the issued certificate with the given serial number,
+// looked up in the CA database.
+func (d *fileDepot) GetCert(serial *big.Int) (*x509.Certificate, error) {
+	serialHex := fmt.Sprintf("%X", serial)
+	if len(serialHex)%2 == 1 {
+		serialHex = fmt.Sprintf("0%s", serialHex)
+	}
+
+	file, err := os.Open(d.path("index.txt"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var filename string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entries := strings.Split(scanner.Text(), "\t")
+		if len(entries) < 5 {
+			continue
+		}
+		if strings.ToUpper(entries[3]) == serialHex {
+			filename = entries[4]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if filename == "" || filename == "unknown" {
+		return nil, depot.ErrCertNotFound
+	}
+
+	crtPEM, err := d.getFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return loadCert(crtPEM.Data)
+}
+
+// Certs returns the issued certificates of the CA database.
+func (d *fileDepot) Certs() ([]*x509.Certificate, error) {
+	file, err := os.Open(d.path("index.txt"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var certs []*x509.Certificate
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entries := strings.Split(scanner.Text(), "\t")
+		if len(entries) < 5 || entries[4] == "unknown" {
+			continue
+		}
+		crtPEM, err := d.getFile(entries[4])
+		if err != nil {
+			return nil, err
+		}
+		crt, err := loadCert(crtPEM.Data)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, crt)
+	}
+	return certs, scanner.Err()
+}
+
+// CRL returns the CRL stored as ca.crl in the depot, PEM or DER encoded,
+// e.g. as created by "openssl ca -gencrl".
+func (d *fileDepot) CRL() ([]byte, error) {
+	crlFile, err := d.getFile("ca.crl")
+	if os.IsNotExist(err) {
+		return nil, depot.ErrCRLNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	data := crlFile.Data
+	if pemBlock, _ := pem.Decode(data); pemBlock != nil {
+		if pemBlock.Type != crlPEMBlockType {
+			return nil, errors.New("unmatched type or headers")
+		}
+		data = pemBlock.Bytes
+	}
+	if _, err := x509.ParseCRL(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// crlReasons are the CRLReason names used in the revocation date column
+// of the CA database by "openssl ca -revoke -crl_reason".
+var crlReasons = map[int]string{
+	0: "unspecified",
+	1: "keyCompromise",
+	2: "CACompromise",
+	3: "affiliationChanged",
+	4: "superseded",
+	5: "cessationOfOperation",
+	6: "certificateHold",
+	8: "removeFromCRL",
+}
+
+// Revoke marks the certificate with the given serial number as revoked in
+// the CA database, in the format of "openssl ca -revoke".
+func (d *fileDepot) Revoke(serial *big.Int, reason int) error {
+	reasonName, ok := crlReasons[reason]
+	if !ok {
+		return fmt.Errorf("unsupported CRL reason %d", reason)
+	}
+	revocation := makeOpenSSLTime(time.Now().UTC())
+	if reason != 0 {
+		revocation += "," + reasonName
+	}
+
+	name := d.path("index.txt")
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	var (
+		db    bytes.Buffer
+		found bool
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		entries := strings.Split(line, "\t")
+		if len(entries) == 6 && entries[0] == "V" && serialMatches(entries[3], serial) {
+			entries[0], entries[2] = "R", revocation
+			line = strings.Join(entries, "\t")
+			found = true
+		}
+		db.WriteString(line + "\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if !found {
+		return depot.ErrCertNotFound
+	}
+	return ioutil.WriteFile(name, db.Bytes(), dbPerm)
+}
+
+// Revoked returns the revoked, unexpired certificates of the CA database.
+func (d *fileDepot) Revoked() ([]depot.Revocation, error) {
+	file, err := os.Open(d.path("index.txt"))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	now := time.Now()
+	var revoked []depot.Revocation
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entries := strings.Split(scanner.Text(), "\t")
+		if len(entries) < 4 || entries[0] != "R" {
+			continue
+		}
+		expiry, err := parseOpenSSLTime(entries[1])
+		if err != nil {
+			return nil, err
+		}
+		if expiry.Before(now) {
+			continue
+		}
+		serial, ok := new(big.Int).SetString(entries[3], 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial %q in CA database", entries[3])
+		}
+		fields := strings.SplitN(entries[2], ",", 2)
+		revokedAt, err := parseOpenSSLTime(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		r := depot.Revocation{SerialNumber: serial, RevokedAt: revokedAt}
+		if len(fields) == 2 {
+			for code, name := range crlReasons {
+				if strings.EqualFold(name, fields[1]) {
+					r.Reason = code
+				}
+			}
+		}
+		revoked = append(revoked, r)
+	}
+	return revoked, scanner.Err()
+}
+
+func parseOpenSSLTime(s string) (time.Time, error) {
+	return time.Parse("060102150405Z", s)
+}
+
+func serialMatches(serialHex string, serial *big.Int) bool {
+	n, ok := new(big.Int).SetString(serialHex, 16)
+	return ok && n.Cmp(serial) == 0
+}
+
 func (d *fileDepot) writeDB(cn string, serial *big.Int, filename string, cert *x509.Certificate) error {
 
 	var dbEntry bytes.Buffer
@@ -365,25 +603,23 @@ func (d *fileDepot) path(name string) string {
 }
 
 const (
-	rsaPrivateKeyPEMBlockType = "RSA PRIVATE KEY"
-	certificatePEMBlockType   = "CERTIFICATE"
+	certificatePEMBlockType = "CERTIFICATE"
+	crlPEMBlockType         = "X509 CRL"
 )
 
-// load an encrypted private key from disk
-func loadKey(data []byte, password []byte) (*rsa.PrivateKey, error) {
-	pemBlock, _ := pem.Decode(data)
-	if pemBlock == nil {
-		return nil, errors.New("PEM decode failed")
-	}
-	if pemBlock.Type != rsaPrivateKeyPEMBlockType {
-		return nil, errors.New("unmatched type or headers")
-	}
-
-	b, err := x509.DecryptPEMBlock(pemBlock, password)
+// load an encrypted private key from disk, a PKCS#1 or SEC 1 key as
+// written by "ca -init" or a PKCS#8 one as exported by current OpenSSL
+// versions
+func loadKey(data []byte, password []byte) (crypto.Signer, error) {
+	key, err := cryptoutil.ParsePrivateKeyPEM(data, password)
 	if err != nil {
 		return nil, err
 	}
-	return x509.ParsePKCS1PrivateKey(b)
+	switch key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		return key, nil
+	}
+	return nil, errors.New("unmatched type or headers")
 }
 
 // load an encrypted private key from disk
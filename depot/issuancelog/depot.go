@@ -0,0 +1,110 @@
+package issuancelog
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/micromdm/scep/v2/depot"
+)
+
+// Depot is a depot.Depot recording the certificates put into and revoked
+// with another depot in a Log. A certificate is logged before it is
+// stored, so no certificate is handed out without being logged: if logging
+// fails, it is not stored, and if storing fails, Put fails but the log
+// keeps the entry of a certificate the CA signed and did not hand out.
+// Revocations are logged once stored. Certificates revoked by HasCN are
+// not logged, as the depot does not tell which ones it revoked.
+//
+// Like depot.Cache, a Depot implements SerialAllocator, CertGetter,
+// CertLister, Revoker, RevocationLister and CRLGetter, forwarding to the
+// wrapped depot. Other optional interfaces, like TransactionStore, must be
+// used on the wrapped depot.
+type Depot struct {
+	depot depot.Depot
+	log   *Log
+}
+
+// NewDepot returns a Depot recording the certificates of d in l.
+func NewDepot(d depot.Depot, l *Log) *Depot {
+	return &Depot{depot: d, log: l}
+}
+
+// serial returns the hex encoded serial number of the entries.
+func serial(n *big.Int) string {
+	return fmt.Sprintf("%X", n)
+}
+
+func (d *Depot) CA(pass []byte) ([]*x509.Certificate, crypto.Signer, error) {
+	return d.depot.CA(pass)
+}
+
+func (d *Depot) Put(name string, crt *x509.Certificate) error {
+	if _, err := d.log.Append(Entry{Type: Issued, Serial: serial(crt.SerialNumber), Certificate: crt.Raw}); err != nil {
+		return err
+	}
+	return d.depot.Put(name, crt)
+}
+
+func (d *Depot) Serial() (*big.Int, error) {
+	return d.depot.Serial()
+}
+
+// AllocateSerial allocates a serial number with the wrapped depot if it is
+// a SerialAllocator, or else returns its Serial.
+func (d *Depot) AllocateSerial() (*big.Int, error) {
+	if a, ok := d.depot.(depot.SerialAllocator); ok {
+		return a.AllocateSerial()
+	}
+	return d.depot.Serial()
+}
+
+func (d *Depot) HasCN(cn string, allowTime int, cert *x509.Certificate, revokeOldCertificate bool) (bool, error) {
+	return d.depot.HasCN(cn, allowTime, cert, revokeOldCertificate)
+}
+
+func (d *Depot) GetCert(serial *big.Int) (*x509.Certificate, error) {
+	getter, ok := d.depot.(depot.CertGetter)
+	if !ok {
+		return nil, depot.ErrCertNotFound
+	}
+	return getter.GetCert(serial)
+}
+
+func (d *Depot) Certs() ([]*x509.Certificate, error) {
+	lister, ok := d.depot.(depot.CertLister)
+	if !ok {
+		return nil, errors.New("depot does not list certificates")
+	}
+	return lister.Certs()
+}
+
+func (d *Depot) Revoke(n *big.Int, reason int) error {
+	revoker, ok := d.depot.(depot.Revoker)
+	if !ok {
+		return errors.New("depot does not revoke certificates")
+	}
+	if err := revoker.Revoke(n, reason); err != nil {
+		return err
+	}
+	_, err := d.log.Append(Entry{Type: Revoked, Serial: serial(n), Reason: reason})
+	return err
+}
+
+func (d *Depot) Revoked() ([]depot.Revocation, error) {
+	lister, ok := d.depot.(depot.RevocationLister)
+	if !ok {
+		return nil, errors.New("depot does not list revocations")
+	}
+	return lister.Revoked()
+}
+
+func (d *Depot) CRL() ([]byte, error) {
+	getter, ok := d.depot.(depot.CRLGetter)
+	if !ok {
+		return nil, depot.ErrCRLNotFound
+	}
+	return getter.CRL()
+}
@@ -0,0 +1,186 @@
+package issuancelog
+
+import (
+	"crypto"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PathPrefix is the path below which NewHandler serves the log.
+const PathPrefix = "/log/"
+
+// maxEntries bounds the entries of a single entries request.
+const maxEntries = 1000
+
+// LogEntry is an entry as returned by the entries request. Its leaf hash is
+// the LeafHash of LeafInput; Entry is LeafInput decoded for convenience.
+type LogEntry struct {
+	LeafInput []byte          `json:"leaf_input"`
+	Entry     json.RawMessage `json:"entry"`
+}
+
+// InclusionProof is the response of the proof request.
+type InclusionProof struct {
+	LeafIndex uint64   `json:"leaf_index"`
+	TreeSize  uint64   `json:"tree_size"`
+	AuditPath [][]byte `json:"audit_path"`
+}
+
+// ConsistencyProof is the response of the consistency request.
+type ConsistencyProof struct {
+	First       uint64   `json:"first"`
+	Second      uint64   `json:"second"`
+	Consistency [][]byte `json:"consistency"`
+}
+
+type handler struct {
+	log    *Log
+	signer crypto.Signer
+	apiKey string
+}
+
+// NewHandler returns an http.Handler serving l below PathPrefix, with tree
+// heads signed by signer, the key dedicated to the log:
+//
+//	GET sth                          the SignedTreeHead of the whole log
+//	GET entries?start=0&end=10       the entries from start up to but not including end
+//	GET proof?index=3&tree_size=10   the InclusionProof of the entry at index
+//	GET proof?serial=0A&tree_size=10 the InclusionProof of the issued certificate with the hex serial
+//	GET consistency?first=5&second=10 the ConsistencyProof between two tree sizes
+//
+// The tree_size defaults to the current size of the log. At most 1000
+// entries are returned at once. If apiKey is not empty, requests must have
+// the "Authorization: Bearer <apiKey>" header. Hashes and signatures are
+// base64 encoded.
+func NewHandler(l *Log, signer crypto.Signer, apiKey string) http.Handler {
+	return &handler{log: l, signer: signer, apiKey: apiKey}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.apiKey != "" {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(h.apiKey)) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	switch strings.TrimPrefix(r.URL.Path, PathPrefix) {
+	case "sth":
+		sth, err := h.log.SignedTreeHead(h.signer)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, sth)
+	case "entries":
+		h.entries(w, r)
+	case "proof":
+		h.proof(w, r)
+	case "consistency":
+		h.consistency(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// params parses the unsigned query parameters names of r. Empty ones are
+// def.
+func params(r *http.Request, def uint64, names ...string) ([]uint64, bool) {
+	var values []uint64
+	for _, name := range names {
+		s := r.URL.Query().Get(name)
+		if s == "" {
+			values = append(values, def)
+			continue
+		}
+		v, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		values = append(values, v)
+	}
+	return values, true
+}
+
+func (h *handler) entries(w http.ResponseWriter, r *http.Request) {
+	size := h.log.Size()
+	p, ok := params(r, size, "start", "end")
+	if !ok {
+		http.Error(w, "invalid start or end", http.StatusBadRequest)
+		return
+	}
+	start, end := p[0], p[1]
+	if end > size {
+		end = size
+	}
+	if start > end {
+		http.Error(w, "start beyond end", http.StatusBadRequest)
+		return
+	}
+	if end-start > maxEntries {
+		end = start + maxEntries
+	}
+	data, err := h.log.Entries(start, end)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	entries := []LogEntry{}
+	for _, d := range data {
+		entries = append(entries, LogEntry{LeafInput: d, Entry: d})
+	}
+	writeJSON(w, struct {
+		Entries []LogEntry `json:"entries"`
+	}{entries})
+}
+
+func (h *handler) proof(w http.ResponseWriter, r *http.Request) {
+	p, ok := params(r, h.log.Size(), "tree_size", "index")
+	if !ok {
+		http.Error(w, "invalid index or tree_size", http.StatusBadRequest)
+		return
+	}
+	size, index := p[0], p[1]
+	if serial := r.URL.Query().Get("serial"); serial != "" {
+		if index, ok = h.log.IssuedIndex(strings.ToUpper(serial)); !ok {
+			http.NotFound(w, r)
+			return
+		}
+	} else if r.URL.Query().Get("index") == "" {
+		http.Error(w, "missing index or serial", http.StatusBadRequest)
+		return
+	}
+	path, err := h.log.InclusionProof(index, size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, InclusionProof{LeafIndex: index, TreeSize: size, AuditPath: path})
+}
+
+func (h *handler) consistency(w http.ResponseWriter, r *http.Request) {
+	p, ok := params(r, h.log.Size(), "first", "second")
+	if !ok || r.URL.Query().Get("first") == "" {
+		http.Error(w, "invalid first or second", http.StatusBadRequest)
+		return
+	}
+	proof, err := h.log.ConsistencyProof(p[0], p[1])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, ConsistencyProof{First: p[0], Second: p[1], Consistency: proof})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
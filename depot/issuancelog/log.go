@@ -0,0 +1,294 @@
+// Package issuancelog keeps an append-only, tamper-evident log of the
+// certificates issued and revoked by a depot, like the Certificate
+// Transparency logs of RFC 9162.
+//
+// The entries are the leaves of a Merkle tree. A key dedicated to the log
+// signs the root hash of the tree as a SignedTreeHead. An auditor keeping
+// the tree heads it saw can ask for inclusion proofs showing that a
+// certificate is in the log, and for consistency proofs showing that a
+// later tree only appends to an earlier one. Rewriting the history of the log breaks these proofs.
+package issuancelog
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// EntryType is the type of an Entry.
+type EntryType string
+
+const (
+	// Issued entries record an issued certificate.
+	Issued EntryType = "issued"
+	// Revoked entries record the revocation of a certificate.
+	Revoked EntryType = "revoked"
+)
+
+// Entry is an entry of the log. Its leaf data is its JSON encoding.
+type Entry struct {
+	Index uint64    `json:"index"`
+	Type  EntryType `json:"type"`
+	Time  time.Time `json:"time"`
+	// Serial is the hex encoded serial number of the certificate.
+	Serial string `json:"serial"`
+	// Certificate is the DER encoded certificate of Issued entries.
+	Certificate []byte `json:"certificate,omitempty"`
+	// Reason is the RFC 5280 CRLReason of Revoked entries.
+	Reason int `json:"reason,omitempty"`
+}
+
+// ErrSize is returned for tree sizes or indexes beyond the log.
+var ErrSize = errors.New("issuance log: size or index beyond the log")
+
+// Log is an issuance log stored in a file of one JSON Entry per line. It
+// keeps the hashes of the complete subtrees and the offsets of the entries
+// in memory. It is safe for concurrent use, but the file must not be
+// shared by several processes.
+type Log struct {
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	tree    tree
+	offsets []int64
+	issued  map[string]uint64
+
+	// replaced in tests
+	now func() time.Time
+}
+
+// Open opens the log at path, creating it if it does not exist. A last
+// entry without its newline, written partially during a crash, is removed;
+// it was never acknowledged.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{f: f, issued: make(map[string]uint64), now: time.Now}
+	if err := l.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) load() error {
+	r := bufio.NewReader(l.f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return l.f.Truncate(l.size)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		data := line[:len(line)-1]
+		var e Entry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return fmt.Errorf("issuance log: entry %d: %w", l.tree.size(), err)
+		}
+		if e.Index != uint64(l.tree.size()) {
+			return fmt.Errorf("issuance log: entry %d has index %d", l.tree.size(), e.Index)
+		}
+		l.add(e, data)
+	}
+}
+
+// add records the leaf of e with data, written at the end of the file.
+func (l *Log) add(e Entry, data []byte) {
+	if e.Type == Issued {
+		l.issued[e.Serial] = e.Index
+	}
+	l.tree.append(LeafHash(data))
+	l.offsets = append(l.offsets, l.size)
+	l.size += int64(len(data)) + 1
+}
+
+// Close closes the file of the log.
+func (l *Log) Close() error {
+	return l.f.Close()
+}
+
+// Append appends e to the log and returns it with its Index and, if it had
+// none, its Time. It returns once the entry is synced to disk.
+func (l *Log) Append(e Entry) (Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.Index = uint64(l.tree.size())
+	if e.Time.IsZero() {
+		e.Time = l.now()
+	}
+	e.Time = e.Time.UTC()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return Entry{}, err
+	}
+	_, err = l.f.WriteAt(append(data, '\n'), l.size)
+	if err == nil {
+		err = l.f.Sync()
+	}
+	if err != nil {
+		// drop what was written, the entry is not part of the log
+		l.f.Truncate(l.size)
+		return Entry{}, fmt.Errorf("issuance log: append: %w", err)
+	}
+	l.add(e, data)
+	return e, nil
+}
+
+// Size returns the number of entries of the log.
+func (l *Log) Size() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return uint64(l.tree.size())
+}
+
+// Entries returns the leaf data of the entries from start up to but not
+// including end.
+func (l *Log) Entries(start, end uint64) ([][]byte, error) {
+	l.mu.Lock()
+	if start > end || end > uint64(l.tree.size()) {
+		l.mu.Unlock()
+		return nil, ErrSize
+	}
+	offsets := l.offsets[start:end]
+	last := l.size
+	if end < uint64(len(l.offsets)) {
+		last = l.offsets[end]
+	}
+	l.mu.Unlock()
+
+	var entries [][]byte
+	for i, off := range offsets {
+		next := last
+		if i+1 < len(offsets) {
+			next = offsets[i+1]
+		}
+		data := make([]byte, next-off-1)
+		if _, err := l.f.ReadAt(data, off); err != nil {
+			return nil, err
+		}
+		entries = append(entries, data)
+	}
+	return entries, nil
+}
+
+// IssuedIndex returns the index of the Issued entry of the certificate
+// with the hex encoded serial number.
+func (l *Log) IssuedIndex(serial string) (uint64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	index, ok := l.issued[serial]
+	return index, ok
+}
+
+// RootHash returns the root hash of the tree of the first size entries.
+func (l *Log) RootHash(size uint64) ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if size > uint64(l.tree.size()) {
+		return nil, ErrSize
+	}
+	return l.tree.hash(0, int(size)), nil
+}
+
+// InclusionProof returns the audit path of the entry at index in the tree
+// of the first size entries, see VerifyInclusion.
+func (l *Log) InclusionProof(index, size uint64) ([][]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if index >= size || size > uint64(l.tree.size()) {
+		return nil, ErrSize
+	}
+	return l.tree.inclusionPath(int(index), 0, int(size)), nil
+}
+
+// ConsistencyProof returns the proof that the tree of the first entries is
+// a prefix of the tree of the second entries, see VerifyConsistency.
+func (l *Log) ConsistencyProof(first, second uint64) ([][]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if first > second || second > uint64(l.tree.size()) {
+		return nil, ErrSize
+	}
+	if first == 0 {
+		return nil, nil
+	}
+	return l.tree.consistencyPath(int(first), 0, int(second), true), nil
+}
+
+// SignedTreeHead is the root hash of the tree of the first TreeSize
+// entries, signed by the log key at Timestamp, in milliseconds since the
+// epoch.
+type SignedTreeHead struct {
+	TreeSize  uint64 `json:"tree_size"`
+	Timestamp int64  `json:"timestamp"`
+	RootHash  []byte `json:"root_hash"`
+	Signature []byte `json:"signature"`
+}
+
+// treeHeadDigest returns the SHA-256 digest signed in a SignedTreeHead. The
+// message starts with a context string, so it is never the DER structure
+// of a certificate, CRL or CMS message and a signature cannot be taken for
+// another; the log key should still not sign anything else.
+func treeHeadDigest(sth SignedTreeHead) []byte {
+	h := sha256.New()
+	h.Write([]byte("scep issuance log tree head v1\x00"))
+	binary.Write(h, binary.BigEndian, sth.TreeSize)
+	binary.Write(h, binary.BigEndian, sth.Timestamp)
+	h.Write(sth.RootHash)
+	return h.Sum(nil)
+}
+
+// SignedTreeHead returns the tree head of the whole log signed with signer,
+// the RSA or ECDSA key of the log. It should be dedicated to the log rather
+// than the key of the CA, so auditors trusting it for the log trust nothing
+// else.
+func (l *Log) SignedTreeHead(signer crypto.Signer) (SignedTreeHead, error) {
+	l.mu.Lock()
+	size := l.tree.size()
+	sth := SignedTreeHead{
+		TreeSize:  uint64(size),
+		Timestamp: l.now().UnixNano() / int64(time.Millisecond),
+		RootHash:  l.tree.hash(0, size),
+	}
+	l.mu.Unlock()
+	sig, err := signer.Sign(rand.Reader, treeHeadDigest(sth), crypto.SHA256)
+	if err != nil {
+		return SignedTreeHead{}, fmt.Errorf("issuance log: sign tree head: %w", err)
+	}
+	sth.Signature = sig
+	return sth, nil
+}
+
+// VerifyTreeHead verifies the signature of sth with the public key of the
+// log.
+func VerifyTreeHead(pub crypto.PublicKey, sth SignedTreeHead) error {
+	digest := treeHeadDigest(sth)
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest, sth.Signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(pub, digest, sth.Signature) {
+			return errors.New("issuance log: invalid tree head signature")
+		}
+		return nil
+	default:
+		return fmt.Errorf("issuance log: unsupported key type %T", pub)
+	}
+}
@@ -0,0 +1,233 @@
+package issuancelog
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/micromdm/scep/v2/depot"
+)
+
+// memDepot is a depot storing and revoking certificates in memory.
+type memDepot struct {
+	depot.Depot
+	certs   map[string]*x509.Certificate
+	revoked map[string]int
+	putErr  error
+}
+
+func (d *memDepot) Put(name string, crt *x509.Certificate) error {
+	if d.putErr != nil {
+		return d.putErr
+	}
+	d.certs[crt.SerialNumber.String()] = crt
+	return nil
+}
+
+func (d *memDepot) Revoke(serial *big.Int, reason int) error {
+	if d.certs[serial.String()] == nil {
+		return depot.ErrCertNotFound
+	}
+	d.revoked[serial.String()] = reason
+	return nil
+}
+
+func TestLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "issuance.log")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := &memDepot{certs: make(map[string]*x509.Certificate), revoked: make(map[string]int)}
+	d := NewDepot(mem, l)
+	for i := int64(1); i <= 5; i++ {
+		crt := &x509.Certificate{SerialNumber: big.NewInt(i * 10), Raw: []byte{byte(i)}}
+		if err := d.Put("device", crt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Revoke(big.NewInt(20), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Revoke(big.NewInt(99), 1); err != depot.ErrCertNotFound {
+		t.Errorf("have error %v revoking an unknown certificate, want ErrCertNotFound", err)
+	}
+	if size := l.Size(); size != 6 {
+		t.Fatalf("have size %d, want 6", size)
+	}
+	oldRoot, err := l.RootHash(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := l.RootHash(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	// a torn last entry is dropped when reopened
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"index":6,"type":"iss`)
+	f.Close()
+	if l, err = Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if have, _ := l.RootHash(l.Size()); l.Size() != 6 || string(have) != string(root) {
+		t.Fatalf("have size %d after reopening, want the same tree of 6 entries", l.Size())
+	}
+	if _, err := l.Append(Entry{Type: Revoked, Serial: "32"}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := l.Entries(1, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e Entry
+	if err := json.Unmarshal(entries[5], &e); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 6 || e.Index != 6 || e.Serial != "32" {
+		t.Errorf("have %d entries ending with %+v", len(entries), e)
+	}
+	index, ok := l.IssuedIndex("14")
+	if !ok || index != 1 {
+		t.Errorf("have index %d of serial 14, want 1", index)
+	}
+	path7, err := l.InclusionProof(index, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root7, _ := l.RootHash(7)
+	if err := VerifyInclusion(LeafHash(entries[0]), index, 7, path7, root7); err != nil {
+		t.Error(err)
+	}
+	proof, err := l.ConsistencyProof(3, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyConsistency(3, 7, proof, oldRoot, root7); err != nil {
+		t.Error(err)
+	}
+	if _, err := l.InclusionProof(7, 7); err != ErrSize {
+		t.Errorf("have error %v for an index beyond the tree, want ErrSize", err)
+	}
+}
+
+func TestDepotLogsBeforeStoring(t *testing.T) {
+	l, err := Open(filepath.Join(t.TempDir(), "issuance.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := &memDepot{certs: make(map[string]*x509.Certificate), putErr: errors.New("disk full")}
+	d := NewDepot(mem, l)
+
+	// a certificate failing to be stored is still logged
+	if err := d.Put("device", &x509.Certificate{SerialNumber: big.NewInt(1), Raw: []byte{1}}); err == nil {
+		t.Fatal("expected the error of the depot")
+	}
+	if _, ok := l.IssuedIndex("1"); !ok {
+		t.Error("certificate not logged")
+	}
+
+	// a certificate failing to be logged is not stored
+	mem.putErr = nil
+	l.Close()
+	if err := d.Put("device", &x509.Certificate{SerialNumber: big.NewInt(2), Raw: []byte{2}}); err == nil {
+		t.Fatal("expected the error of the log")
+	}
+	if len(mem.certs) != 0 {
+		t.Errorf("have %d certificates stored without being logged", len(mem.certs))
+	}
+}
+
+func TestHandler(t *testing.T) {
+	l, err := Open(filepath.Join(t.TempDir(), "issuance.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for _, serial := range []string{"01", "02", "03"} {
+		if _, err := l.Append(Entry{Type: Issued, Serial: serial}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(NewHandler(l, key, "secret"))
+	defer srv.Close()
+
+	get := func(path string, v interface{}) int {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+PathPrefix+path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	var sth SignedTreeHead
+	if code := get("sth", &sth); code != http.StatusOK {
+		t.Fatalf("have status %d", code)
+	}
+	if err := VerifyTreeHead(&key.PublicKey, sth); err != nil || sth.TreeSize != 3 {
+		t.Fatalf("have tree head of size %d: %v", sth.TreeSize, err)
+	}
+	sth.TreeSize = 2
+	if err := VerifyTreeHead(&key.PublicKey, sth); err == nil {
+		t.Error("verified a modified tree head")
+	}
+
+	var entries struct{ Entries []LogEntry }
+	if code := get("entries?start=1&end=100", &entries); code != http.StatusOK || len(entries.Entries) != 2 {
+		t.Fatalf("have status %d and %d entries, want 2", code, len(entries.Entries))
+	}
+	var proof InclusionProof
+	if code := get("proof?serial=02", &proof); code != http.StatusOK {
+		t.Fatalf("have status %d", code)
+	}
+	root, _ := l.RootHash(3)
+	if err := VerifyInclusion(LeafHash(entries.Entries[0].LeafInput), proof.LeafIndex, proof.TreeSize, proof.AuditPath, root); err != nil {
+		t.Error(err)
+	}
+	var consistency ConsistencyProof
+	if code := get("consistency?first=1&second=3", &consistency); code != http.StatusOK || len(consistency.Consistency) == 0 {
+		t.Errorf("have status %d and proof %v", code, consistency.Consistency)
+	}
+
+	for path, want := range map[string]int{
+		"proof?serial=FF":      http.StatusNotFound,
+		"proof?index=3":        http.StatusBadRequest,
+		"consistency?first=x":  http.StatusBadRequest,
+		"entries?start=4&end=": http.StatusBadRequest,
+	} {
+		if code := get(path, nil); code != want {
+			t.Errorf("%s: have status %d, want %d", path, code, want)
+		}
+	}
+	if resp, err := http.Get(srv.URL + PathPrefix + "sth"); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected an unauthorized request to fail")
+	}
+}
@@ -0,0 +1,203 @@
+package issuancelog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+// The Merkle tree of the log is the one of RFC 9162 section 2.1, so the
+// proofs of Certificate Transparency tooling apply.
+
+// LeafHash returns the Merkle tree hash of the leaf data.
+func LeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// splitPoint returns the largest power of two smaller than n > 1.
+func splitPoint(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// tree keeps the hashes of the complete subtrees of a Merkle tree, so the
+// root hash and the proofs of any of its sizes take O(log n) hashes
+// instead of rehashing every leaf.
+type tree struct {
+	// levels[h][i] is the hash of the leaves i<<h up to (i+1)<<h.
+	levels [][][]byte
+}
+
+// size returns the number of leaves of t.
+func (t *tree) size() int {
+	if len(t.levels) == 0 {
+		return 0
+	}
+	return len(t.levels[0])
+}
+
+// append adds the leaf hash to t and hashes the subtrees it completes.
+func (t *tree) append(leaf []byte) {
+	h := leaf
+	for level := 0; ; level++ {
+		if level == len(t.levels) {
+			t.levels = append(t.levels, nil)
+		}
+		t.levels[level] = append(t.levels[level], h)
+		n := len(t.levels[level])
+		if n%2 == 1 {
+			return
+		}
+		h = nodeHash(t.levels[level][n-2], h)
+	}
+}
+
+// hash returns the Merkle tree hash of the leaves lo up to hi. lo is the
+// start of a subtree of the tree of hi leaves.
+func (t *tree) hash(lo, hi int) []byte {
+	n := hi - lo
+	switch {
+	case n == 0:
+		h := sha256.Sum256(nil)
+		return h[:]
+	case n&(n-1) == 0:
+		level := 0
+		for 1<<level < n {
+			level++
+		}
+		return t.levels[level][lo>>level]
+	}
+	k := splitPoint(n)
+	return nodeHash(t.hash(lo, lo+k), t.hash(lo+k, hi))
+}
+
+// inclusionPath returns the audit path of leaf m in the tree of the leaves
+// lo up to hi.
+func (t *tree) inclusionPath(m, lo, hi int) [][]byte {
+	if hi-lo <= 1 {
+		return nil
+	}
+	k := splitPoint(hi - lo)
+	if m < lo+k {
+		return append(t.inclusionPath(m, lo, lo+k), t.hash(lo+k, hi))
+	}
+	return append(t.inclusionPath(m, lo+k, hi), t.hash(lo, lo+k))
+}
+
+// consistencyPath returns the proof that the tree of the leaves lo up to m
+// is a prefix of the tree of the leaves lo up to hi.
+func (t *tree) consistencyPath(m, lo, hi int, complete bool) [][]byte {
+	if m == hi {
+		if complete {
+			return nil
+		}
+		return [][]byte{t.hash(lo, hi)}
+	}
+	k := splitPoint(hi - lo)
+	if m <= lo+k {
+		return append(t.consistencyPath(m, lo, lo+k, complete), t.hash(lo+k, hi))
+	}
+	return append(t.consistencyPath(m, lo+k, hi, false), t.hash(lo, lo+k))
+}
+
+// errProof is returned for proofs which do not verify.
+var errProof = errors.New("issuance log: proof does not verify")
+
+// VerifyInclusion verifies that the leaf with leafHash is the leaf at
+// index of the tree of size leaves with the root hash root, given its
+// audit path as described in RFC 9162 section 2.1.3.2.
+func VerifyInclusion(leafHash []byte, index, size uint64, path [][]byte, root []byte) error {
+	if index >= size {
+		return errProof
+	}
+	fn, sn := index, size-1
+	r := leafHash
+	for _, p := range path {
+		if sn == 0 {
+			return errProof
+		}
+		if fn&1 == 1 || fn == sn {
+			r = nodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = nodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(r, root) {
+		return errProof
+	}
+	return nil
+}
+
+// VerifyConsistency verifies that the tree of first leaves with the root
+// hash firstRoot is a prefix of the tree of second leaves with the root
+// hash secondRoot, given the consistency proof as described in RFC 9162
+// section 2.1.4.2.
+func VerifyConsistency(first, second uint64, proof [][]byte, firstRoot, secondRoot []byte) error {
+	switch {
+	case first > second:
+		return errProof
+	case first == second:
+		if len(proof) != 0 || !bytes.Equal(firstRoot, secondRoot) {
+			return errProof
+		}
+		return nil
+	case first == 0:
+		// the empty tree is a prefix of every tree
+		if len(proof) != 0 {
+			return errProof
+		}
+		return nil
+	case len(proof) == 0:
+		return errProof
+	}
+	if first&(first-1) == 0 {
+		proof = append([][]byte{firstRoot}, proof...)
+	}
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return errProof
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = nodeHash(c, fr)
+			sr = nodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = nodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	if sn != 0 || !bytes.Equal(fr, firstRoot) || !bytes.Equal(sr, secondRoot) {
+		return errProof
+	}
+	return nil
+}
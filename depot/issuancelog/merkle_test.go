@@ -0,0 +1,97 @@
+package issuancelog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// rootHash is the Merkle tree hash of RFC 9162 section 2.1.1, computed
+// from every leaf.
+func rootHash(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		h := sha256.Sum256(nil)
+		return h[:]
+	case 1:
+		return leaves[0]
+	}
+	k := splitPoint(len(leaves))
+	return nodeHash(rootHash(leaves[:k]), rootHash(leaves[k:]))
+}
+
+func newTree(leaves [][]byte) *tree {
+	t := &tree{}
+	for _, leaf := range leaves {
+		t.append(leaf)
+	}
+	return t
+}
+
+// testLeaves are the leaves of the test vectors of RFC 6962.
+func testLeaves(t *testing.T) [][]byte {
+	var leaves [][]byte
+	for _, s := range []string{"", "00", "10", "2021", "3031", "40414243", "5051525354555657", "606162636465666768696a6b6c6d6e6f"} {
+		data, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaves = append(leaves, LeafHash(data))
+	}
+	return leaves
+}
+
+func TestRootHash(t *testing.T) {
+	leaves := testLeaves(t)
+	for size, want := range map[int]string{
+		0: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		1: "6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+		8: "5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+	} {
+		if have := hex.EncodeToString(newTree(leaves[:size]).hash(0, size)); have != want {
+			t.Errorf("size %d: have root %s, want %s", size, have, want)
+		}
+	}
+}
+
+func TestProofs(t *testing.T) {
+	leaves := testLeaves(t)
+	leaves = append(leaves, leaves...)
+	leaves = append(leaves, leaves[:5]...)
+	full := newTree(leaves)
+	for n := 1; n <= len(leaves); n++ {
+		root := rootHash(leaves[:n])
+		if have := full.hash(0, n); !bytes.Equal(have, root) {
+			t.Errorf("root of %d: have %x, want %x", n, have, root)
+		}
+		for m := 0; m < n; m++ {
+			path := full.inclusionPath(m, 0, n)
+			if err := VerifyInclusion(leaves[m], uint64(m), uint64(n), path, root); err != nil {
+				t.Errorf("inclusion of %d in %d: %v", m, n, err)
+			}
+			if err := VerifyInclusion(leaves[(m+1)%n], uint64(m), uint64(n), path, root); err == nil && n > 1 && !bytes.Equal(leaves[m], leaves[(m+1)%n]) {
+				t.Errorf("inclusion of %d in %d: verified another leaf", m, n)
+			}
+			if len(path) > 0 {
+				tampered := append([][]byte{}, path...)
+				tampered[0] = leaves[n-1-m]
+				if err := VerifyInclusion(leaves[m], uint64(m), uint64(n), tampered, root); err == nil && !bytes.Equal(path[0], tampered[0]) {
+					t.Errorf("inclusion of %d in %d: verified a tampered path", m, n)
+				}
+			}
+		}
+		for m := 1; m <= n; m++ {
+			proof := full.consistencyPath(m, 0, n, true)
+			first := rootHash(leaves[:m])
+			if err := VerifyConsistency(uint64(m), uint64(n), proof, first, root); err != nil {
+				t.Errorf("consistency of %d and %d: %v", m, n, err)
+			}
+			if m < n {
+				if err := VerifyConsistency(uint64(m), uint64(n), proof, LeafHash([]byte("forged")), root); err == nil {
+					t.Errorf("consistency of %d and %d: verified a forged first root", m, n)
+				}
+			}
+		}
+	}
+}
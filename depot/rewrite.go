@@ -0,0 +1,293 @@
+package depot
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// RewriteConfig is the declarative form of a Rewrite, e.g. loaded from JSON
+// with LoadRewrite. Its values are text/template templates evaluated with
+// the RewriteData of each request, e.g.
+//
+//	{"subject": {"O": "Corp", "SERIALNUMBER": "{{.Metadata.serial}}"},
+//	 "upns": ["{{lower .Subject.CommonName}}@corp.example.com"]}
+type RewriteConfig struct {
+	// Subject sets the subject attributes by their short names: CN, O,
+	// OU, C, ST, L, STREET, POSTALCODE and SERIALNUMBER. A template
+	// evaluating to the empty string removes the attribute.
+	Subject map[string]string `json:"subject,omitempty"`
+	// DNSNames, EmailAddresses and URIs add SANs of their type, UPNs
+	// Microsoft User Principal Name SANs. Templates evaluating to the empty
+	// string add none.
+	DNSNames       []string `json:"dns_names,omitempty"`
+	EmailAddresses []string `json:"email_addresses,omitempty"`
+	URIs           []string `json:"uris,omitempty"`
+	UPNs           []string `json:"upns,omitempty"`
+}
+
+// RewriteData is the data the templates of a Rewrite are evaluated with.
+type RewriteData struct {
+	// Subject and the SANs are the ones of the CSR, e.g.
+	// {{.Subject.CommonName}}.
+	Subject        pkix.Name
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []net.IP
+	URIs           []*url.URL
+	// Metadata is the ChallengeMetadata of the request, e.g.
+	// {{.Metadata.serial}}. Missing keys fail the request.
+	Metadata map[string]string
+	// TransactionID is the SCEP transactionID of the request.
+	TransactionID string
+}
+
+// Rewrite rewrites the subject and SANs of certificate templates per
+// request, compiled from a RewriteConfig.
+type Rewrite struct {
+	subject        map[string]*template.Template
+	dnsNames       []*template.Template
+	emailAddresses []*template.Template
+	uris           []*template.Template
+	upns           []*template.Template
+}
+
+// rewriteFuncs are the functions available to the templates besides the
+// text/template builtins.
+var rewriteFuncs = template.FuncMap{
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"trim":    strings.TrimSpace,
+	"replace": strings.ReplaceAll,
+}
+
+// subjectAttributes sets the attributes of RewriteConfig.Subject on a name.
+var subjectAttributes = map[string]func(n *pkix.Name, v []string){
+	"CN":           func(n *pkix.Name, v []string) { n.CommonName = strings.Join(v, "") },
+	"O":            func(n *pkix.Name, v []string) { n.Organization = v },
+	"OU":           func(n *pkix.Name, v []string) { n.OrganizationalUnit = v },
+	"C":            func(n *pkix.Name, v []string) { n.Country = v },
+	"ST":           func(n *pkix.Name, v []string) { n.Province = v },
+	"L":            func(n *pkix.Name, v []string) { n.Locality = v },
+	"STREET":       func(n *pkix.Name, v []string) { n.StreetAddress = v },
+	"POSTALCODE":   func(n *pkix.Name, v []string) { n.PostalCode = v },
+	"SERIALNUMBER": func(n *pkix.Name, v []string) { n.SerialNumber = strings.Join(v, "") },
+}
+
+// NewRewrite compiles cfg.
+func NewRewrite(cfg RewriteConfig) (*Rewrite, error) {
+	parse := func(name, text string) (*template.Template, error) {
+		t, err := template.New(name).Funcs(rewriteFuncs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite template %s: %w", name, err)
+		}
+		return t, nil
+	}
+	parseAll := func(name string, texts []string) ([]*template.Template, error) {
+		var ts []*template.Template
+		for _, text := range texts {
+			t, err := parse(name, text)
+			if err != nil {
+				return nil, err
+			}
+			ts = append(ts, t)
+		}
+		return ts, nil
+	}
+
+	r := &Rewrite{subject: make(map[string]*template.Template)}
+	for attr, text := range cfg.Subject {
+		if _, ok := subjectAttributes[attr]; !ok {
+			return nil, fmt.Errorf("unknown subject attribute %q", attr)
+		}
+		t, err := parse(attr, text)
+		if err != nil {
+			return nil, err
+		}
+		r.subject[attr] = t
+	}
+	var err error
+	if r.dnsNames, err = parseAll("dns_names", cfg.DNSNames); err != nil {
+		return nil, err
+	}
+	if r.emailAddresses, err = parseAll("email_addresses", cfg.EmailAddresses); err != nil {
+		return nil, err
+	}
+	if r.uris, err = parseAll("uris", cfg.URIs); err != nil {
+		return nil, err
+	}
+	if r.upns, err = parseAll("upns", cfg.UPNs); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// LoadRewrite reads a JSON encoded RewriteConfig from r and compiles it.
+// Unknown fields are rejected.
+func LoadRewrite(r io.Reader) (*Rewrite, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var cfg RewriteConfig
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("decode rewrite: %w", err)
+	}
+	return NewRewrite(cfg)
+}
+
+// NewRewriteData returns the RewriteData of m.
+func NewRewriteData(m *scep.CSRReqMessage) RewriteData {
+	return RewriteData{
+		Subject:        m.CSR.Subject,
+		DNSNames:       m.CSR.DNSNames,
+		EmailAddresses: m.CSR.EmailAddresses,
+		IPAddresses:    m.CSR.IPAddresses,
+		URIs:           m.CSR.URIs,
+		Metadata:       m.ChallengeMetadata,
+		TransactionID:  string(m.TransactionID),
+	}
+}
+
+// Apply rewrites the subject and SANs of tmpl with the templates evaluated
+// with data.
+func (r *Rewrite) Apply(tmpl *x509.Certificate, data RewriteData) error {
+	if data.Metadata == nil {
+		data.Metadata = map[string]string{}
+	}
+	execute := func(t *template.Template) (string, error) {
+		var b strings.Builder
+		if err := t.Execute(&b, data); err != nil {
+			return "", fmt.Errorf("rewrite template %s: %w", t.Name(), err)
+		}
+		return b.String(), nil
+	}
+	executeAll := func(ts []*template.Template) ([]string, error) {
+		var values []string
+		for _, t := range ts {
+			v, err := execute(t)
+			if err != nil {
+				return nil, err
+			}
+			if v != "" {
+				values = append(values, v)
+			}
+		}
+		return values, nil
+	}
+
+	// set the attributes in a fixed order for deterministic errors
+	attrs := make([]string, 0, len(r.subject))
+	for attr := range r.subject {
+		attrs = append(attrs, attr)
+	}
+	sort.Strings(attrs)
+	for _, attr := range attrs {
+		v, err := execute(r.subject[attr])
+		if err != nil {
+			return err
+		}
+		var values []string
+		if v != "" {
+			values = []string{v}
+		}
+		subjectAttributes[attr](&tmpl.Subject, values)
+	}
+
+	dnsNames, err := executeAll(r.dnsNames)
+	if err != nil {
+		return err
+	}
+	emailAddresses, err := executeAll(r.emailAddresses)
+	if err != nil {
+		return err
+	}
+	uris, err := executeAll(r.uris)
+	if err != nil {
+		return err
+	}
+	upns, err := executeAll(r.upns)
+	if err != nil {
+		return err
+	}
+	// the SANs of tmpl may share their arrays with the CSR
+	tmpl.DNSNames = append(tmpl.DNSNames[:len(tmpl.DNSNames):len(tmpl.DNSNames)], dnsNames...)
+	tmpl.EmailAddresses = append(tmpl.EmailAddresses[:len(tmpl.EmailAddresses):len(tmpl.EmailAddresses)], emailAddresses...)
+	tmpl.URIs = tmpl.URIs[:len(tmpl.URIs):len(tmpl.URIs)]
+	for _, s := range uris {
+		u, err := url.Parse(s)
+		if err != nil {
+			return fmt.Errorf("rewrite template uris: %w", err)
+		}
+		tmpl.URIs = append(tmpl.URIs, u)
+	}
+	if len(upns) > 0 {
+		// crypto/x509 cannot encode otherName SANs, so encode all SANs
+		ext, err := marshalSANs(tmpl, upns)
+		if err != nil {
+			return err
+		}
+		tmpl.ExtraExtensions = append(tmpl.ExtraExtensions, ext)
+	}
+	return nil
+}
+
+var (
+	oidExtensionSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+	oidUPN                     = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 3}
+)
+
+// marshalSANs returns the subjectAltName extension of the SANs of tmpl and
+// the UPN otherNames upns. It is critical if the subject is empty, as
+// required by RFC 5280 section 4.2.1.6.
+func marshalSANs(tmpl *x509.Certificate, upns []string) (pkix.Extension, error) {
+	var names []asn1.RawValue
+	for _, upn := range upns {
+		value, err := asn1.MarshalWithParams(upn, "utf8")
+		if err != nil {
+			return pkix.Extension{}, err
+		}
+		otherName, err := asn1.Marshal(struct {
+			TypeID asn1.ObjectIdentifier
+			Value  asn1.RawValue
+		}{oidUPN, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: value}})
+		if err != nil {
+			return pkix.Extension{}, err
+		}
+		// replace the SEQUENCE tag by the [0] otherName one
+		var seq asn1.RawValue
+		if _, err := asn1.Unmarshal(otherName, &seq); err != nil {
+			return pkix.Extension{}, err
+		}
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: seq.Bytes})
+	}
+	for _, email := range tmpl.EmailAddresses {
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 1, Bytes: []byte(email)})
+	}
+	for _, name := range tmpl.DNSNames {
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, Bytes: []byte(name)})
+	}
+	for _, u := range tmpl.URIs {
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 6, Bytes: []byte(u.String())})
+	}
+	for _, ip := range tmpl.IPAddresses {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		names = append(names, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 7, Bytes: ip})
+	}
+	value, err := asn1.Marshal(names)
+	if err != nil {
+		return pkix.Extension{}, err
+	}
+	critical := len(tmpl.Subject.ToRDNSequence()) == 0
+	return pkix.Extension{Id: oidExtensionSubjectAltName, Critical: critical, Value: value}, nil
+}
@@ -0,0 +1,112 @@
+package depot
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr := &x509.CertificateRequest{
+		Subject:   pkix.Name{CommonName: "Device-1", Organization: []string{"Spoofed"}, OrganizationalUnit: []string{"Laptops"}},
+		PublicKey: &key.PublicKey,
+		DNSNames:  []string{"device-1.example.com"},
+	}
+	rw, err := LoadRewrite(strings.NewReader(`{
+		"subject": {"O": "Corp", "OU": "", "SERIALNUMBER": "{{.Metadata.serial}}"},
+		"dns_names": ["{{lower .Subject.CommonName}}.corp.example.com"],
+		"upns": ["{{lower .Subject.CommonName}}@corp.example.com"]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := NewCertificateTemplate(csr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := RewriteData{Subject: csr.Subject, DNSNames: csr.DNSNames, Metadata: map[string]string{"serial": "C02XYZ"}}
+	if err := rw.Apply(tmpl, data); err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if have, want := crt.Subject.String(), "SERIALNUMBER=C02XYZ,CN=Device-1,O=Corp"; have != want {
+		t.Errorf("subject = %s, want %s", have, want)
+	}
+	if want := []string{"device-1.example.com", "device-1.corp.example.com"}; !reflect.DeepEqual(crt.DNSNames, want) {
+		t.Errorf("DNSNames = %v, want %v", crt.DNSNames, want)
+	}
+	if want := []string{"device-1.example.com"}; !reflect.DeepEqual(csr.DNSNames, want) {
+		t.Errorf("CSR DNSNames changed to %v", csr.DNSNames)
+	}
+	if have := upns(t, crt); !reflect.DeepEqual(have, []string{"device-1@corp.example.com"}) {
+		t.Errorf("UPNs = %v, want device-1@corp.example.com", have)
+	}
+
+	// templates referring to missing metadata fail
+	tmpl, err = NewCertificateTemplate(csr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rw.Apply(tmpl, RewriteData{Subject: csr.Subject}); err == nil {
+		t.Error("expected an error for missing metadata")
+	}
+
+	if _, err := NewRewrite(RewriteConfig{Subject: map[string]string{"UID": "x"}}); err == nil {
+		t.Error("expected an error for an unknown subject attribute")
+	}
+	if _, err := NewRewrite(RewriteConfig{DNSNames: []string{"{{.Subject"}}); err == nil {
+		t.Error("expected an error for an invalid template")
+	}
+}
+
+// upns returns the UPN otherName SANs of crt.
+func upns(t *testing.T, crt *x509.Certificate) []string {
+	t.Helper()
+	var upns []string
+	for _, ext := range crt.Extensions {
+		if !ext.Id.Equal(oidExtensionSubjectAltName) {
+			continue
+		}
+		var names []asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range names {
+			if name.Class != asn1.ClassContextSpecific || name.Tag != 0 {
+				continue
+			}
+			var otherName struct {
+				TypeID asn1.ObjectIdentifier
+				Value  asn1.RawValue `asn1:"tag:0,explicit"`
+			}
+			if _, err := asn1.UnmarshalWithParams(name.FullBytes, &otherName, "tag:0"); err != nil {
+				t.Fatal(err)
+			}
+			var upn string
+			if _, err := asn1.UnmarshalWithParams(otherName.Value.Bytes, &upn, "utf8"); err != nil {
+				t.Fatal(err)
+			}
+			if otherName.TypeID.Equal(oidUPN) {
+				upns = append(upns, upn)
+			}
+		}
+	}
+	return upns
+}
@@ -1,11 +1,12 @@
 package depot
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/x509"
+	"math/big"
 	"time"
 
-	"github.com/micromdm/scep/v2/cryptoutil"
 	"github.com/micromdm/scep/v2/scep"
 )
 
@@ -15,6 +16,12 @@ type Signer struct {
 	caPass           string
 	allowRenewalDays int
 	validityDays     int
+	caCert           *x509.Certificate
+	caKey            crypto.Signer
+	templateOpts     []TemplateOption
+	rewrite          *Rewrite
+	duplicates       Duplicates
+	duplicateAction  DuplicateAction
 }
 
 // Option customizes Signer
@@ -40,6 +47,15 @@ func WithCAPass(pass string) Option {
 	}
 }
 
+// WithCA signs certificates with crt and key instead of the CA keypair
+// stored in the depot, e.g. with a key held by a KMS or HSM.
+func WithCA(crt *x509.Certificate, key crypto.Signer) Option {
+	return func(s *Signer) {
+		s.caCert = crt
+		s.caKey = key
+	}
+}
+
 // WithAllowRenewalDays sets the allowable renewal time for existing certs
 func WithAllowRenewalDays(r int) Option {
 	return func(s *Signer) {
@@ -54,42 +70,63 @@ func WithValidityDays(v int) Option {
 	}
 }
 
+// WithTemplateOptions customizes the certificate templates, e.g. with
+// WithRandomSerial, WithBackdate or WithMaxValidity. They are applied after
+// the serial from the depot and the validity of WithValidityDays.
+func WithTemplateOptions(opts ...TemplateOption) Option {
+	return func(s *Signer) {
+		s.templateOpts = append(s.templateOpts, opts...)
+	}
+}
+
+// WithRewrite rewrites the subject and SANs of the certificates with rw,
+// evaluated with the RewriteData of each request.
+func WithRewrite(rw *Rewrite) Option {
+	return func(s *Signer) {
+		s.rewrite = rw
+	}
+}
+
 // SignCSR signs a certificate using Signer's Depot CA
 func (s *Signer) SignCSR(m *scep.CSRReqMessage) (*x509.Certificate, error) {
-	id, err := cryptoutil.GenerateSubjectKeyID(m.CSR.PublicKey)
+	serial, err := s.serial()
 	if err != nil {
 		return nil, err
 	}
 
-	serial, err := s.depot.Serial()
-	if err != nil {
-		return nil, err
+	caCert, caKey := s.caCert, s.caKey
+	if caKey == nil {
+		caCerts, key, err := s.depot.CA([]byte(s.caPass))
+		if err != nil {
+			return nil, err
+		}
+		caCert, caKey = caCerts[0], key
 	}
 
-	// create cert template
-	tmpl := &x509.Certificate{
-		SerialNumber: serial,
-		Subject:      m.CSR.Subject,
-		NotBefore:    time.Now().Add(-600).UTC(),
-		NotAfter:     time.Now().AddDate(0, 0, s.validityDays).UTC(),
-		SubjectKeyId: id,
-		KeyUsage:     x509.KeyUsageDigitalSignature,
-		ExtKeyUsage: []x509.ExtKeyUsage{
-			x509.ExtKeyUsageClientAuth,
-		},
-		SignatureAlgorithm: m.CSR.SignatureAlgorithm,
-		DNSNames:           m.CSR.DNSNames,
-		EmailAddresses:     m.CSR.EmailAddresses,
-		IPAddresses:        m.CSR.IPAddresses,
-		URIs:               m.CSR.URIs,
-	}
-
-	caCerts, caKey, err := s.depot.CA([]byte(s.caPass))
+	opts := append([]TemplateOption{
+		WithSerial(serial),
+		WithValidity(time.Duration(s.validityDays) * 24 * time.Hour),
+	}, s.templateOpts...)
+	tmpl, err := NewCertificateTemplate(m.CSR, caCert, opts...)
 	if err != nil {
 		return nil, err
 	}
+	if s.rewrite != nil {
+		if err := s.rewrite.Apply(tmpl, NewRewriteData(m)); err != nil {
+			return nil, err
+		}
+	}
+	var duplicates []*x509.Certificate
+	if s.duplicates != 0 {
+		if duplicates, err = s.findDuplicates(m, tmpl); err != nil {
+			return nil, err
+		}
+		if err := s.checkDuplicates(m, duplicates); err != nil {
+			return nil, err
+		}
+	}
 
-	crtBytes, err := x509.CreateCertificate(rand.Reader, tmpl, caCerts[0], m.CSR.PublicKey, caKey)
+	crtBytes, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, m.CSR.PublicKey, caKey)
 	if err != nil {
 		return nil, err
 	}
@@ -104,18 +141,32 @@ func (s *Signer) SignCSR(m *scep.CSRReqMessage) (*x509.Certificate, error) {
 	// Test if this certificate is already in the CADB, revoke if needed
 	// revocation is done if the validity of the existing certificate is
 	// less than allowRenewalDays
-	_, err = s.depot.HasCN(name, s.allowRenewalDays, crt, false)
-	if err != nil {
-		return nil, err
+	if s.duplicates == 0 {
+		_, err = s.depot.HasCN(name, s.allowRenewalDays, crt, false)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	if err := s.depot.Put(name, crt); err != nil {
 		return nil, err
 	}
+	if err := s.supersede(duplicates); err != nil {
+		return nil, err
+	}
 
 	return crt, nil
 }
 
+// serial returns the serial number of the next certificate, allocated
+// atomically if the depot is a SerialAllocator.
+func (s *Signer) serial() (*big.Int, error) {
+	if a, ok := s.depot.(SerialAllocator); ok {
+		return a.AllocateSerial()
+	}
+	return s.depot.Serial()
+}
+
 func certName(crt *x509.Certificate) string {
 	if crt.Subject.CommonName != "" {
 		return crt.Subject.CommonName
@@ -0,0 +1,438 @@
+// Package sqldepot implements a SCEP certificate depot and challenge store
+// on top of database/sql. Several SCEP server replicas can share one
+// database, e.g. behind a load balancer.
+//
+// The package does not import a database driver; register one, e.g.
+// github.com/lib/pq or github.com/go-sql-driver/mysql, in the main package
+// and pass the opened *sql.DB to NewSQLDepot.
+package sqldepot
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/micromdm/scep/v2/cryptoutil"
+	"github.com/micromdm/scep/v2/depot"
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// Depot is a SCEP certificate depot stored in a SQL database.
+type Depot struct {
+	db          *sql.DB
+	dialect     Dialect
+	caPass      []byte
+	crlValidity time.Duration
+}
+
+// Option configures a Depot.
+type Option func(*Depot)
+
+// WithCAPass sets the password of the CA key, used to sign the CRL.
+func WithCAPass(pass string) Option {
+	return func(d *Depot) {
+		d.caPass = []byte(pass)
+	}
+}
+
+// WithCRLValidity sets the time until the nextUpdate of the CRL. The
+// default is 24 hours.
+func WithCRLValidity(validity time.Duration) Option {
+	return func(d *Depot) {
+		d.crlValidity = validity
+	}
+}
+
+// NewSQLDepot creates a depot.Depot backed by db, creating or updating the
+// tables as needed.
+func NewSQLDepot(db *sql.DB, dialect Dialect, opts ...Option) (*Depot, error) {
+	d := &Depot{db: db, dialect: dialect, crlValidity: 24 * time.Hour}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if err := d.migrate(context.Background()); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// PutCA stores the CA certificate and its RSA or ECDSA key. The key is
+// encrypted if pass is not empty.
+func (db *Depot) PutCA(crt *x509.Certificate, key crypto.Signer, pass []byte) error {
+	block, err := cryptoutil.MarshalPrivateKeyPEM(key, pass)
+	if err != nil {
+		return err
+	}
+	_, err = db.exec(context.Background(), `INSERT INTO scep_ca (id, certificate, private_key) VALUES (1, ?, ?)`,
+		crt.Raw, pem.EncodeToMemory(block))
+	return err
+}
+
+// CA returns the CA certificate and key stored with PutCA.
+func (db *Depot) CA(pass []byte) ([]*x509.Certificate, crypto.Signer, error) {
+	var crtDER, keyPEM []byte
+	row := db.queryRow(context.Background(), `SELECT certificate, private_key FROM scep_ca WHERE id = 1`)
+	if err := row.Scan(&crtDER, &keyPEM); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, errors.New("no CA in depot")
+		}
+		return nil, nil, err
+	}
+	crt, err := x509.ParseCertificate(crtDER)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := cryptoutil.ParsePrivateKeyPEM(keyPEM, pass)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid CA key in depot: %w", err)
+	}
+	return []*x509.Certificate{crt}, key, nil
+}
+
+// Serial allocates and returns a new serial number. Unlike the file and bolt
+// depots every call returns a different serial, so replicas sharing the
+// database never issue duplicates.
+func (db *Depot) Serial() (*big.Int, error) {
+	ctx := context.Background()
+	var serial int64
+	err := db.inTx(ctx, func(tx *sql.Tx) error {
+		// the update locks the row until the end of the transaction
+		if _, err := tx.ExecContext(ctx, `UPDATE scep_serial SET serial = serial + 1 WHERE id = 1`); err != nil {
+			return err
+		}
+		return tx.QueryRowContext(ctx, `SELECT serial - 1 FROM scep_serial WHERE id = 1`).Scan(&serial)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return big.NewInt(serial), nil
+}
+
+// AllocateSerial implements depot.SerialAllocator. Serial already allocates
+// the serial numbers atomically in the database.
+func (db *Depot) AllocateSerial() (*big.Int, error) {
+	return db.Serial()
+}
+
+// SeedSerial implements depot.SerialSeeder.
+func (db *Depot) SeedSerial(next *big.Int) error {
+	if !next.IsInt64() {
+		return fmt.Errorf("serial number %s exceeds the serial counter", next)
+	}
+	_, err := db.exec(context.Background(), `UPDATE scep_serial SET serial = ? WHERE id = 1 AND serial < ?`, next.Int64(), next.Int64())
+	return err
+}
+
+// Put stores the issued certificate crt under cn.
+func (db *Depot) Put(cn string, crt *x509.Certificate) error {
+	if crt == nil || crt.Raw == nil {
+		return fmt.Errorf("%q does not specify a valid certificate for storage", cn)
+	}
+	_, err := db.exec(context.Background(), `INSERT INTO scep_certificates (serial, cn, certificate, not_after) VALUES (?, ?, ?, ?)`,
+		serialKey(crt.SerialNumber), cn, crt.Raw, crt.NotAfter.Unix())
+	return err
+}
+
+// HasCN reports whether an unexpired and unrevoked certificate was issued
+// for cn. Like the file depot it returns an error if such a certificate is
+// not within allowTime days of its expiry, and if revokeOldCertificate is
+// set revokes the existing certificates.
+func (db *Depot) HasCN(cn string, allowTime int, cert *x509.Certificate, revokeOldCertificate bool) (bool, error) {
+	ctx := context.Background()
+	now := time.Now()
+	var notAfter sql.NullInt64
+	row := db.queryRow(ctx, `SELECT MAX(not_after) FROM scep_certificates WHERE cn = ? AND revoked_at IS NULL AND not_after > ?`,
+		cn, now.Unix())
+	if err := row.Scan(&notAfter); err != nil {
+		return false, err
+	}
+	if !notAfter.Valid {
+		return false, nil
+	}
+	if allowTime > 0 && notAfter.Int64 > now.AddDate(0, 0, allowTime).Unix() {
+		return false, fmt.Errorf("CN %q already exists", cn)
+	}
+	if revokeOldCertificate {
+		if _, err := db.exec(ctx, `UPDATE scep_certificates SET revoked_at = ? WHERE cn = ? AND revoked_at IS NULL`,
+			now.Unix(), cn); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// GetCert returns the issued certificate with the given serial number.
+func (db *Depot) GetCert(serial *big.Int) (*x509.Certificate, error) {
+	var der []byte
+	row := db.queryRow(context.Background(), `SELECT certificate FROM scep_certificates WHERE serial = ?`, serialKey(serial))
+	if err := row.Scan(&der); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, depot.ErrCertNotFound
+		}
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// Certs returns the issued certificates.
+func (db *Depot) Certs() ([]*x509.Certificate, error) {
+	rows, err := db.query(context.Background(), `SELECT certificate FROM scep_certificates`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var certs []*x509.Certificate
+	for rows.Next() {
+		var der []byte
+		if err := rows.Scan(&der); err != nil {
+			return nil, err
+		}
+		crt, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, crt)
+	}
+	return certs, rows.Err()
+}
+
+// Revoke marks the certificate with the given serial number as revoked with
+// an RFC 5280 CRLReason, or 0 for unspecified.
+func (db *Depot) Revoke(serial *big.Int, reason int) error {
+	res, err := db.exec(context.Background(), `UPDATE scep_certificates SET revoked_at = ?, revocation_reason = ? WHERE serial = ?`,
+		time.Now().Unix(), reason, serialKey(serial))
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return depot.ErrCertNotFound
+	}
+	return nil
+}
+
+// Revoked returns the revoked, unexpired certificates.
+func (db *Depot) Revoked() ([]depot.Revocation, error) {
+	rows, err := db.query(context.Background(), `SELECT serial, revoked_at, revocation_reason FROM scep_certificates WHERE revoked_at IS NOT NULL AND not_after > ?`,
+		time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var revoked []depot.Revocation
+	for rows.Next() {
+		var (
+			serial    string
+			revokedAt int64
+			reason    sql.NullInt64
+		)
+		if err := rows.Scan(&serial, &revokedAt, &reason); err != nil {
+			return nil, err
+		}
+		n, ok := new(big.Int).SetString(serial, 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial %q in depot", serial)
+		}
+		revoked = append(revoked, depot.Revocation{
+			SerialNumber: n,
+			RevokedAt:    time.Unix(revokedAt, 0).UTC(),
+			Reason:       int(reason.Int64),
+		})
+	}
+	return revoked, rows.Err()
+}
+
+// CRL returns a CRL of the revoked, unexpired certificates signed with the
+// CA key.
+func (db *Depot) CRL() ([]byte, error) {
+	revoked, err := db.Revoked()
+	if err != nil {
+		return nil, err
+	}
+	caCerts, caKey, err := db.CA(db.caPass)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return depot.CreateCRL(rand.Reader, revoked, caCerts[0], caKey, now, now.Add(db.crlValidity))
+}
+
+// PutTransaction records that the request with transactionID was answered
+// with the certificate serial, so a resent request can be answered with
+// the same certificate by any replica.
+func (db *Depot) PutTransaction(transactionID string, serial *big.Int) error {
+	_, err := db.exec(context.Background(), `INSERT INTO scep_transactions (transaction_id, serial, created_at) VALUES (?, ?, ?)`,
+		transactionID, serialKey(serial), time.Now().Unix())
+	return err
+}
+
+// GetTransaction returns the certificate recorded for transactionID or
+// depot.ErrCertNotFound.
+func (db *Depot) GetTransaction(transactionID string) (*x509.Certificate, error) {
+	var der []byte
+	row := db.queryRow(context.Background(), `SELECT c.certificate FROM scep_transactions t
+		JOIN scep_certificates c ON c.serial = t.serial WHERE t.transaction_id = ?`, transactionID)
+	if err := row.Scan(&der); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, depot.ErrCertNotFound
+		}
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// SaveTransaction creates or replaces the transaction with the ID of t.
+func (db *Depot) SaveTransaction(t *depot.Transaction) error {
+	ctx := context.Background()
+	challenge := 0
+	if t.Challenge {
+		challenge = 1
+	}
+	var metadata sql.NullString
+	if len(t.ChallengeMetadata) > 0 {
+		b, err := json.Marshal(t.ChallengeMetadata)
+		if err != nil {
+			return err
+		}
+		metadata = sql.NullString{String: string(b), Valid: true}
+	}
+	return db.inTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, db.dialect.rebind(`DELETE FROM scep_pending_transactions WHERE transaction_id = ?`), t.ID); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, db.dialect.rebind(`INSERT INTO scep_pending_transactions
+			(transaction_id, message_type, status, csr, request_digest, signer_certificate, challenge, challenge_metadata, certificate, reason, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+			t.ID, t.MessageType, t.Status, t.CSR, t.RequestDigest, t.SignerCert, challenge, metadata, t.Certificate, t.Reason, t.CreatedAt.Unix(), t.UpdatedAt.Unix())
+		return err
+	})
+}
+
+const transactionColumns = `transaction_id, message_type, status, csr, request_digest, signer_certificate, challenge, challenge_metadata, certificate, reason, created_at, updated_at`
+
+// Transaction returns the transaction with id.
+func (db *Depot) Transaction(id scep.TransactionID) (*depot.Transaction, error) {
+	row := db.queryRow(context.Background(), `SELECT `+transactionColumns+` FROM scep_pending_transactions WHERE transaction_id = ?`, id)
+	t, err := scanTransaction(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, depot.ErrTransactionNotFound
+	}
+	return t, err
+}
+
+// Transactions returns the transactions with status, or all of them if
+// status is empty, oldest first.
+func (db *Depot) Transactions(status depot.TransactionStatus) ([]*depot.Transaction, error) {
+	query := `SELECT ` + transactionColumns + ` FROM scep_pending_transactions`
+	var args []interface{}
+	if status != "" {
+		query += ` WHERE status = ?`
+		args = append(args, status)
+	}
+	rows, err := db.query(context.Background(), query+` ORDER BY created_at, transaction_id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var txs []*depot.Transaction
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		txs = append(txs, t)
+	}
+	return txs, rows.Err()
+}
+
+// scanTransaction scans the transactionColumns of a row.
+func scanTransaction(row interface{ Scan(...interface{}) error }) (*depot.Transaction, error) {
+	var (
+		t                  depot.Transaction
+		id, msgType        string
+		status             string
+		challenge          int
+		metadata           sql.NullString
+		createdAt, updated int64
+	)
+	if err := row.Scan(&id, &msgType, &status, &t.CSR, &t.RequestDigest, &t.SignerCert, &challenge, &metadata, &t.Certificate, &t.Reason, &createdAt, &updated); err != nil {
+		return nil, err
+	}
+	t.Challenge = challenge != 0
+	if metadata.Valid {
+		if err := json.Unmarshal([]byte(metadata.String), &t.ChallengeMetadata); err != nil {
+			return nil, err
+		}
+	}
+	t.ID = scep.TransactionID(id)
+	t.MessageType = scep.MessageType(msgType)
+	t.Status = depot.TransactionStatus(status)
+	t.CreatedAt = time.Unix(createdAt, 0).UTC()
+	t.UpdatedAt = time.Unix(updated, 0).UTC()
+	return &t, nil
+}
+
+// SCEPChallenge creates and stores a new one-time challenge password.
+func (db *Depot) SCEPChallenge() (string, error) {
+	key := make([]byte, 24)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	challenge := base64.StdEncoding.EncodeToString(key)
+	if _, err := db.exec(context.Background(), `INSERT INTO scep_challenges (challenge, created_at) VALUES (?, ?)`,
+		challenge, time.Now().Unix()); err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// HasChallenge reports whether pw is a stored challenge password and
+// deletes it, so each challenge is accepted once across all replicas.
+func (db *Depot) HasChallenge(pw string) (bool, error) {
+	res, err := db.exec(context.Background(), `DELETE FROM scep_challenges WHERE challenge = ?`, pw)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// serialKey is the primary key of a serial number in scep_certificates.
+func serialKey(serial *big.Int) string {
+	return fmt.Sprintf("%X", serial)
+}
+
+func (db *Depot) exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return db.db.ExecContext(ctx, db.dialect.rebind(query), args...)
+}
+
+func (db *Depot) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return db.db.QueryContext(ctx, db.dialect.rebind(query), args...)
+}
+
+func (db *Depot) queryRow(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return db.db.QueryRowContext(ctx, db.dialect.rebind(query), args...)
+}
+
+func (db *Depot) inTx(ctx context.Context, fn func(*sql.Tx) error) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
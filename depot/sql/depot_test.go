@@ -0,0 +1,111 @@
+package sqldepot
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRebind(t *testing.T) {
+	query := `INSERT INTO t (a, b) VALUES (?, ?)`
+	if have, want := Postgres.rebind(query), `INSERT INTO t (a, b) VALUES ($1, $2)`; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+	if have := MySQL.rebind(query); have != query {
+		t.Errorf("have %q, want %q", have, query)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		dialect Dialect
+		version int64
+		blob    string
+		want    int
+	}{
+		{"postgres", Postgres, 0, "BYTEA", migrationStatements(Postgres, 0)},
+		{"mysql", MySQL, 0, "LONGBLOB", migrationStatements(MySQL, 0)},
+		{"pending transactions", Postgres, 1, "scep_pending_transactions", migrationStatements(Postgres, 1)},
+		{"transaction challenge", MySQL, 2, "challenge", migrationStatements(MySQL, 2)},
+		{"challenge metadata", Postgres, 3, "challenge_metadata", migrationStatements(Postgres, 3)},
+		{"request digest", MySQL, 4, "request_digest", migrationStatements(MySQL, 4)},
+		{"up to date", Postgres, int64(len(migrations)), "", 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conn := &recordingConn{version: test.version}
+			d := &Depot{db: sql.OpenDB(conn), dialect: test.dialect}
+			if err := d.migrate(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			// the first statement creates the migrations table
+			execs := conn.execs[1:]
+			if len(execs) != test.want {
+				t.Fatalf("have %d statements, want %d", len(execs), test.want)
+			}
+			if test.want == 0 {
+				return
+			}
+			if !strings.Contains(execs[0], test.blob) {
+				t.Errorf("have %q, want %s column", execs[0], test.blob)
+			}
+			if last := execs[len(execs)-1]; !strings.HasPrefix(last, "INSERT INTO scep_schema_migrations") {
+				t.Errorf("have last statement %q, want schema version update", last)
+			}
+		})
+	}
+}
+
+// migrationStatements returns the number of statements executed by the
+// migrations after version, including the schema version updates.
+func migrationStatements(d Dialect, version int) int {
+	n := 0
+	for _, m := range migrations[version:] {
+		n += len(m(d)) + 1
+	}
+	return n
+}
+
+// recordingConn is a driver.Conn and driver.Connector recording the
+// executed statements. Queries return the schema version.
+type recordingConn struct {
+	version int64
+	execs   []string
+}
+
+func (c *recordingConn) Connect(context.Context) (driver.Conn, error) { return c, nil }
+func (c *recordingConn) Driver() driver.Driver                        { return nil }
+func (c *recordingConn) Prepare(string) (driver.Stmt, error)          { return nil, driver.ErrSkip }
+func (c *recordingConn) Close() error                                 { return nil }
+func (c *recordingConn) Begin() (driver.Tx, error)                    { return c, nil }
+func (c *recordingConn) Commit() error                                { return nil }
+func (c *recordingConn) Rollback() error                              { return nil }
+
+func (c *recordingConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	c.execs = append(c.execs, query)
+	return driver.RowsAffected(1), nil
+}
+
+func (c *recordingConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	return &versionRows{version: c.version}, nil
+}
+
+type versionRows struct {
+	version int64
+	done    bool
+}
+
+func (r *versionRows) Columns() []string { return []string{"version"} }
+func (r *versionRows) Close() error      { return nil }
+
+func (r *versionRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = r.version
+	return nil
+}
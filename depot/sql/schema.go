@@ -0,0 +1,152 @@
+package sqldepot
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Dialect selects the SQL variant of the database.
+type Dialect int
+
+const (
+	// Postgres uses $1 style placeholders and BYTEA columns.
+	Postgres Dialect = iota
+	// MySQL uses ? placeholders and LONGBLOB columns.
+	MySQL
+)
+
+func (d Dialect) String() string {
+	switch d {
+	case Postgres:
+		return "postgres"
+	case MySQL:
+		return "mysql"
+	}
+	return fmt.Sprintf("Dialect(%d)", int(d))
+}
+
+// rebind replaces the ? placeholders of query with the placeholders of d.
+func (d Dialect) rebind(query string) string {
+	if d != Postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (d Dialect) blob() string {
+	if d == MySQL {
+		return "LONGBLOB"
+	}
+	return "BYTEA"
+}
+
+// migrations are applied in order, each in its own transaction. Applied
+// migrations must never change; add a new one instead. Times are stored as
+// Unix seconds to avoid the differences in timestamp handling.
+var migrations = []func(d Dialect) []string{
+	func(d Dialect) []string {
+		return []string{
+			`CREATE TABLE scep_ca (
+				id INTEGER PRIMARY KEY,
+				certificate ` + d.blob() + ` NOT NULL,
+				private_key ` + d.blob() + ` NOT NULL
+			)`,
+			`CREATE TABLE scep_serial (
+				id INTEGER PRIMARY KEY,
+				serial BIGINT NOT NULL
+			)`,
+			`INSERT INTO scep_serial (id, serial) VALUES (1, 2)`,
+			`CREATE TABLE scep_certificates (
+				serial VARCHAR(64) PRIMARY KEY,
+				cn VARCHAR(255) NOT NULL,
+				certificate ` + d.blob() + ` NOT NULL,
+				not_after BIGINT NOT NULL,
+				revoked_at BIGINT NULL,
+				revocation_reason INTEGER NULL
+			)`,
+			`CREATE INDEX scep_certificates_cn ON scep_certificates (cn)`,
+			`CREATE TABLE scep_transactions (
+				transaction_id VARCHAR(255) PRIMARY KEY,
+				serial VARCHAR(64) NOT NULL,
+				created_at BIGINT NOT NULL
+			)`,
+			`CREATE TABLE scep_challenges (
+				challenge VARCHAR(255) PRIMARY KEY,
+				created_at BIGINT NOT NULL
+			)`,
+		}
+	},
+	func(d Dialect) []string {
+		return []string{
+			`CREATE TABLE scep_pending_transactions (
+				transaction_id VARCHAR(255) PRIMARY KEY,
+				message_type VARCHAR(8) NOT NULL,
+				status VARCHAR(16) NOT NULL,
+				csr ` + d.blob() + ` NOT NULL,
+				signer_certificate ` + d.blob() + ` NULL,
+				certificate ` + d.blob() + ` NULL,
+				reason VARCHAR(1024) NOT NULL,
+				created_at BIGINT NOT NULL,
+				updated_at BIGINT NOT NULL
+			)`,
+			`CREATE INDEX scep_pending_transactions_status ON scep_pending_transactions (status, created_at)`,
+		}
+	},
+	func(d Dialect) []string {
+		return []string{
+			`ALTER TABLE scep_pending_transactions ADD COLUMN challenge INTEGER NOT NULL DEFAULT 0`,
+		}
+	},
+	func(d Dialect) []string {
+		return []string{
+			`ALTER TABLE scep_pending_transactions ADD COLUMN challenge_metadata VARCHAR(1024) NULL`,
+		}
+	},
+	func(d Dialect) []string {
+		return []string{
+			`ALTER TABLE scep_pending_transactions ADD COLUMN request_digest ` + d.blob() + ` NULL`,
+		}
+	},
+}
+
+// migrate creates or updates the depot tables, skipping already applied
+// migrations.
+func (db *Depot) migrate(ctx context.Context) error {
+	if _, err := db.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS scep_schema_migrations (
+		version INTEGER PRIMARY KEY
+	)`); err != nil {
+		return fmt.Errorf("create migrations table: %w", err)
+	}
+	var version int
+	row := db.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM scep_schema_migrations`)
+	if err := row.Scan(&version); err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	for v := version; v < len(migrations); v++ {
+		err := db.inTx(ctx, func(tx *sql.Tx) error {
+			for _, stmt := range migrations[v](db.dialect) {
+				if _, err := tx.ExecContext(ctx, stmt); err != nil {
+					return err
+				}
+			}
+			_, err := tx.ExecContext(ctx, db.dialect.rebind(`INSERT INTO scep_schema_migrations (version) VALUES (?)`), v+1)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", v+1, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,261 @@
+package depot
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/micromdm/scep/v2/cryptoutil"
+)
+
+// DefaultBackdate is the backdate of the NotBefore of issued certificates,
+// tolerating clients with slow clocks.
+const DefaultBackdate = 10 * time.Minute
+
+// minSerialBits is the minimum serial number entropy required by the
+// CA/Browser Forum Baseline Requirements section 7.1.
+const minSerialBits = 64
+
+// SANs selects the subject alternative name types copied from the CSR to
+// the issued certificate.
+type SANs uint
+
+const (
+	SANDNSNames SANs = 1 << iota
+	SANEmailAddresses
+	SANIPAddresses
+	SANURIs
+
+	// AllSANs copies all the subject alternative names of the CSR.
+	AllSANs = SANDNSNames | SANEmailAddresses | SANIPAddresses | SANURIs
+)
+
+type templateConfig struct {
+	serial        *big.Int
+	serialBits    int
+	validity      time.Duration
+	maxValidity   time.Duration
+	backdate      time.Duration
+	sans          SANs
+	commonNameSAN bool
+	keyUsage      x509.KeyUsage
+	extKeyUsage   []x509.ExtKeyUsage
+	extKeyOIDs    []asn1.ObjectIdentifier
+	now           func() time.Time
+}
+
+// TemplateOption configures NewCertificateTemplate.
+type TemplateOption func(*templateConfig)
+
+// WithSerial sets the serial number of the certificate, e.g. one allocated
+// with Depot.Serial.
+func WithSerial(serial *big.Int) TemplateOption {
+	return func(c *templateConfig) {
+		c.serial = serial
+		c.serialBits = 0
+	}
+}
+
+// WithRandomSerial sets a random serial number of bits bits, at least 64,
+// from crypto/rand. It is the default with 128 bits.
+func WithRandomSerial(bits int) TemplateOption {
+	return func(c *templateConfig) {
+		c.serial = nil
+		c.serialBits = bits
+	}
+}
+
+// WithValidity sets the validity of the certificate from now on, one year
+// by default.
+func WithValidity(validity time.Duration) TemplateOption {
+	return func(c *templateConfig) {
+		c.validity = validity
+	}
+}
+
+// WithMaxValidity caps the validity of the certificate, including the
+// backdate, e.g. to 398 days. By default only the validity of the issuer
+// caps it.
+func WithMaxValidity(max time.Duration) TemplateOption {
+	return func(c *templateConfig) {
+		c.maxValidity = max
+	}
+}
+
+// WithBackdate sets how long before now the certificate becomes valid,
+// DefaultBackdate by default.
+func WithBackdate(backdate time.Duration) TemplateOption {
+	return func(c *templateConfig) {
+		c.backdate = backdate
+	}
+}
+
+// WithSANs sets the subject alternative name types copied from the CSR,
+// AllSANs by default.
+func WithSANs(sans SANs) TemplateOption {
+	return func(c *templateConfig) {
+		c.sans = sans
+	}
+}
+
+// WithCommonNameSAN adds the subject common name of the CSR as a DNS name
+// or IP address SAN if it is a valid one and not already included, as the
+// CA/Browser Forum Baseline Requirements expect every name in the subject
+// to be repeated in the SANs.
+func WithCommonNameSAN() TemplateOption {
+	return func(c *templateConfig) {
+		c.commonNameSAN = true
+	}
+}
+
+// WithUsage sets the key usage and extended key usages of the certificate,
+// digitalSignature and clientAuth by default, e.g. keyEncipherment and
+// serverAuth for a VPN gateway.
+func WithUsage(usage x509.KeyUsage, extUsage ...x509.ExtKeyUsage) TemplateOption {
+	return func(c *templateConfig) {
+		c.keyUsage = usage
+		c.extKeyUsage = extUsage
+	}
+}
+
+// WithExtKeyUsageOIDs adds extended key usages unknown to crypto/x509 to
+// the certificate, e.g. x509util.OIDSmartcardLogon.
+func WithExtKeyUsageOIDs(oids ...asn1.ObjectIdentifier) TemplateOption {
+	return func(c *templateConfig) {
+		c.extKeyOIDs = oids
+	}
+}
+
+// NewCertificateTemplate returns the template of a client certificate
+// issued by issuer for csr, for x509.CreateCertificate. The NotAfter is
+// capped at the NotAfter of issuer, so that no certificate outlives its
+// CA.
+func NewCertificateTemplate(csr *x509.CertificateRequest, issuer *x509.Certificate, opts ...TemplateOption) (*x509.Certificate, error) {
+	c := &templateConfig{
+		serialBits:  128,
+		validity:    365 * 24 * time.Hour,
+		backdate:    DefaultBackdate,
+		sans:        AllSANs,
+		keyUsage:    x509.KeyUsageDigitalSignature,
+		extKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		now:         time.Now,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	serial := c.serial
+	if serial == nil {
+		var err error
+		if serial, err = randomSerial(c.serialBits); err != nil {
+			return nil, err
+		}
+	}
+	id, err := cryptoutil.GenerateSubjectKeyID(csr.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	now := c.now()
+	notBefore := now.Add(-c.backdate)
+	notAfter := now.Add(c.validity)
+	if c.maxValidity > 0 && notAfter.Sub(notBefore) > c.maxValidity {
+		notAfter = notBefore.Add(c.maxValidity)
+	}
+	if issuer != nil && notAfter.After(issuer.NotAfter) {
+		notAfter = issuer.NotAfter
+	}
+	if !notAfter.After(notBefore) {
+		return nil, fmt.Errorf("certificate validity ends before it starts at %s", notBefore.UTC())
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:       serial,
+		Subject:            csr.Subject,
+		NotBefore:          notBefore.UTC(),
+		NotAfter:           notAfter.UTC(),
+		SubjectKeyId:       id,
+		KeyUsage:           c.keyUsage,
+		ExtKeyUsage:        c.extKeyUsage,
+		UnknownExtKeyUsage: c.extKeyOIDs,
+	}
+	if c.sans&SANDNSNames != 0 {
+		tmpl.DNSNames = csr.DNSNames
+	}
+	if c.sans&SANEmailAddresses != 0 {
+		tmpl.EmailAddresses = csr.EmailAddresses
+	}
+	if c.sans&SANIPAddresses != 0 {
+		tmpl.IPAddresses = csr.IPAddresses
+	}
+	if c.sans&SANURIs != 0 {
+		tmpl.URIs = csr.URIs
+	}
+	if c.commonNameSAN {
+		addCommonNameSAN(tmpl)
+	}
+	return tmpl, nil
+}
+
+func randomSerial(bits int) (*big.Int, error) {
+	if bits < minSerialBits {
+		return nil, fmt.Errorf("serial number of %d bits below the minimum of %d", bits, minSerialBits)
+	}
+	// the serial must be positive, a leading zero bit keeps the DER
+	// encoding at bits/8 bytes
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), uint(bits)))
+	if err != nil {
+		return nil, err
+	}
+	if serial.Sign() == 0 {
+		return nil, errors.New("random serial number is zero")
+	}
+	return serial, nil
+}
+
+func addCommonNameSAN(tmpl *x509.Certificate) {
+	cn := tmpl.Subject.CommonName
+	if ip := net.ParseIP(cn); ip != nil {
+		for _, have := range tmpl.IPAddresses {
+			if have.Equal(ip) {
+				return
+			}
+		}
+		tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		return
+	}
+	if !isDNSName(cn) {
+		return
+	}
+	for _, have := range tmpl.DNSNames {
+		if strings.EqualFold(have, cn) {
+			return
+		}
+	}
+	tmpl.DNSNames = append(tmpl.DNSNames, cn)
+}
+
+// isDNSName reports whether name is a valid host name of letters, digits
+// and hyphens.
+func isDNSName(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
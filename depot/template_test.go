@@ -0,0 +1,139 @@
+package depot
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewCertificateTemplate(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, _ := url.Parse("spiffe://example.com/device")
+	csr := &x509.CertificateRequest{
+		Subject:        pkix.Name{CommonName: "device.example.com"},
+		PublicKey:      &key.PublicKey,
+		DNSNames:       []string{"alt.example.com"},
+		EmailAddresses: []string{"device@example.com"},
+		IPAddresses:    []net.IP{net.ParseIP("10.0.0.1")},
+		URIs:           []*url.URL{uri},
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	issuer := &x509.Certificate{NotAfter: now.Add(48 * time.Hour)}
+	clock := func(c *templateConfig) { c.now = func() time.Time { return now } }
+
+	t.Run("defaults", func(t *testing.T) {
+		tmpl, err := NewCertificateTemplate(csr, nil, clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, want := tmpl.NotBefore, now.Add(-DefaultBackdate); !have.Equal(want) {
+			t.Errorf("NotBefore = %s, want %s", have, want)
+		}
+		if have, want := tmpl.NotAfter, now.Add(365*24*time.Hour); !have.Equal(want) {
+			t.Errorf("NotAfter = %s, want %s", have, want)
+		}
+		if tmpl.SerialNumber.Sign() <= 0 || tmpl.SerialNumber.BitLen() > 128 {
+			t.Errorf("serial %s is not a positive 128 bit number", tmpl.SerialNumber)
+		}
+		if !reflect.DeepEqual(tmpl.DNSNames, csr.DNSNames) || !reflect.DeepEqual(tmpl.EmailAddresses, csr.EmailAddresses) ||
+			!reflect.DeepEqual(tmpl.IPAddresses, csr.IPAddresses) || !reflect.DeepEqual(tmpl.URIs, csr.URIs) {
+			t.Error("SANs of the CSR not copied")
+		}
+		if tmpl.KeyUsage != x509.KeyUsageDigitalSignature || !reflect.DeepEqual(tmpl.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}) {
+			t.Errorf("usage = %v %v, want digitalSignature and clientAuth", tmpl.KeyUsage, tmpl.ExtKeyUsage)
+		}
+	})
+
+	t.Run("options", func(t *testing.T) {
+		tmpl, err := NewCertificateTemplate(csr, nil, clock,
+			WithSerial(big.NewInt(42)),
+			WithValidity(24*time.Hour),
+			WithBackdate(time.Hour),
+			WithSANs(SANDNSNames|SANURIs),
+			WithCommonNameSAN(),
+			WithUsage(x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment, x509.ExtKeyUsageServerAuth),
+			WithExtKeyUsageOIDs(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 2}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tmpl.SerialNumber.Int64() != 42 {
+			t.Errorf("serial = %s, want 42", tmpl.SerialNumber)
+		}
+		if have, want := tmpl.NotBefore, now.Add(-time.Hour); !have.Equal(want) {
+			t.Errorf("NotBefore = %s, want %s", have, want)
+		}
+		if have, want := tmpl.NotAfter, now.Add(24*time.Hour); !have.Equal(want) {
+			t.Errorf("NotAfter = %s, want %s", have, want)
+		}
+		if want := []string{"alt.example.com", "device.example.com"}; !reflect.DeepEqual(tmpl.DNSNames, want) {
+			t.Errorf("DNSNames = %v, want %v", tmpl.DNSNames, want)
+		}
+		if tmpl.EmailAddresses != nil || tmpl.IPAddresses != nil || len(tmpl.URIs) != 1 {
+			t.Errorf("unexpected SANs: %v %v %v", tmpl.EmailAddresses, tmpl.IPAddresses, tmpl.URIs)
+		}
+		if tmpl.KeyUsage != x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment || !reflect.DeepEqual(tmpl.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}) {
+			t.Errorf("usage = %v %v, want keyEncipherment and serverAuth", tmpl.KeyUsage, tmpl.ExtKeyUsage)
+		}
+		if len(tmpl.UnknownExtKeyUsage) != 1 || tmpl.UnknownExtKeyUsage[0].String() != "1.3.6.1.4.1.311.20.2.2" {
+			t.Errorf("UnknownExtKeyUsage = %v, want smartcard logon", tmpl.UnknownExtKeyUsage)
+		}
+	})
+
+	t.Run("max validity", func(t *testing.T) {
+		tmpl, err := NewCertificateTemplate(csr, nil, clock, WithMaxValidity(24*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := tmpl.NotAfter.Sub(tmpl.NotBefore); have != 24*time.Hour {
+			t.Errorf("validity = %s, want 24h", have)
+		}
+	})
+
+	t.Run("issuer expiry", func(t *testing.T) {
+		tmpl, err := NewCertificateTemplate(csr, issuer, clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !tmpl.NotAfter.Equal(issuer.NotAfter) {
+			t.Errorf("NotAfter = %s, want the issuer NotAfter %s", tmpl.NotAfter, issuer.NotAfter)
+		}
+		expired := &x509.Certificate{NotAfter: now.Add(-time.Hour)}
+		if _, err := NewCertificateTemplate(csr, expired, clock); err == nil {
+			t.Error("expected an error for an expired issuer")
+		}
+	})
+
+	t.Run("short random serial", func(t *testing.T) {
+		if _, err := NewCertificateTemplate(csr, nil, clock, WithRandomSerial(32)); err == nil {
+			t.Error("expected an error for a 32 bit random serial")
+		}
+	})
+}
+
+func TestIsDNSName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"device":               true,
+		"device-1.example.com": true,
+		"":                     false,
+		"John Doe":             false,
+		"-device":              false,
+		"device..example.com":  false,
+		"device@example.com":   false,
+	} {
+		if have := isDNSName(name); have != want {
+			t.Errorf("isDNSName(%q) = %v, want %v", name, have, want)
+		}
+	}
+}
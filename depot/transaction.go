@@ -0,0 +1,130 @@
+package depot
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// TransactionStatus is the state of an enrollment request held PENDING.
+type TransactionStatus string
+
+const (
+	// TransactionPending is waiting for the decision of an operator.
+	TransactionPending TransactionStatus = "pending"
+	// TransactionIssued was approved and its certificate issued.
+	TransactionIssued TransactionStatus = "issued"
+	// TransactionRejected was rejected by an operator.
+	TransactionRejected TransactionStatus = "rejected"
+)
+
+// Transaction is an enrollment request held PENDING until an operator
+// approves or rejects it. Clients poll for the outcome with CertPoll
+// requests carrying the transactionID of the request.
+type Transaction struct {
+	ID          scep.TransactionID `json:"id"`
+	MessageType scep.MessageType   `json:"message_type"`
+	Status      TransactionStatus  `json:"status"`
+
+	// CSR is the DER encoded request without its challengePassword, see
+	// scep.CSRReqMessage.SanitizedCSR.
+	CSR []byte `json:"csr"`
+	// RequestDigest is the SHA-256 digest of the DER encoded CSR as
+	// received, challengePassword included. It tells a resent request from
+	// a new request for the same key, which has the same transactionID.
+	RequestDigest []byte `json:"request_digest,omitempty"`
+	// SignerCert is the DER encoded signer certificate of the request.
+	SignerCert []byte `json:"signer_cert,omitempty"`
+	// Challenge reports whether the request had a challengePassword,
+	// checked by the CSRSigner middleware which passed it on.
+	Challenge bool `json:"challenge"`
+	// ChallengeMetadata is the scep.CSRReqMessage.ChallengeMetadata of the
+	// request, for the signer issuing the certificate on approval.
+	ChallengeMetadata map[string]string `json:"challenge_metadata,omitempty"`
+
+	// Certificate is the DER encoded certificate issued on approval.
+	Certificate []byte `json:"certificate,omitempty"`
+	// Reason explains a rejection. It is sent to the client as the
+	// failInfoText of the FAILURE.
+	Reason string `json:"reason,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TransactionStore is implemented by depots which persist the transactions
+// held PENDING, so that CertPoll requests are answered across restarts and
+// by every replica sharing the depot.
+type TransactionStore interface {
+	// SaveTransaction creates or replaces the transaction with the ID of t.
+	SaveTransaction(t *Transaction) error
+
+	// Transaction returns the transaction with id or
+	// ErrTransactionNotFound.
+	Transaction(id scep.TransactionID) (*Transaction, error)
+
+	// Transactions returns the transactions with status, or all of them if
+	// status is empty, oldest first.
+	Transactions(status TransactionStatus) ([]*Transaction, error)
+}
+
+// ErrTransactionNotFound is returned by a TransactionStore if no
+// transaction with the requested ID is stored.
+var ErrTransactionNotFound = errors.New("transaction not found")
+
+type memTransactionStore struct {
+	mu  sync.Mutex
+	txs map[scep.TransactionID]Transaction
+}
+
+// NewTransactionStore returns a TransactionStore keeping the transactions
+// in memory. Pending requests are forgotten on restart; use the store of a
+// persistent depot for anything but tests.
+func NewTransactionStore() TransactionStore {
+	return &memTransactionStore{txs: make(map[scep.TransactionID]Transaction)}
+}
+
+func (s *memTransactionStore) SaveTransaction(t *Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.txs[t.ID] = *t
+	return nil
+}
+
+func (s *memTransactionStore) Transaction(id scep.TransactionID) (*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.txs[id]
+	if !ok {
+		return nil, ErrTransactionNotFound
+	}
+	return &t, nil
+}
+
+func (s *memTransactionStore) Transactions(status TransactionStatus) ([]*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var txs []*Transaction
+	for _, t := range s.txs {
+		if status == "" || t.Status == status {
+			t := t
+			txs = append(txs, &t)
+		}
+	}
+	SortTransactions(txs)
+	return txs, nil
+}
+
+// SortTransactions sorts txs oldest first, as returned by
+// TransactionStore.Transactions.
+func SortTransactions(txs []*Transaction) {
+	sort.SliceStable(txs, func(i, j int) bool {
+		if !txs[i].CreatedAt.Equal(txs[j].CreatedAt) {
+			return txs[i].CreatedAt.Before(txs[j].CreatedAt)
+		}
+		return txs[i].ID < txs[j].ID
+	})
+}
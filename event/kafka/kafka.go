@@ -0,0 +1,115 @@
+// Package kafkaevent defines the Publisher scepserver.EventPublisher
+// producing issuance events to a Kafka topic, e.g. for inventory and
+// expiry alerting pipelines.
+package kafkaevent
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	scepserver "github.com/micromdm/scep/v2/server"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// Option configures a Publisher.
+type Option func(*Publisher)
+
+// WithTLSConfig connects to the brokers with TLS, e.g. with the root CAs of
+// the cluster and a client certificate authenticating the server.
+func WithTLSConfig(conf *tls.Config) Option {
+	return func(p *Publisher) {
+		p.tlsConfig = conf
+	}
+}
+
+// WithTimeout sets the time publishing an event may take, 10 seconds by
+// default.
+func WithTimeout(d time.Duration) Option {
+	return func(p *Publisher) {
+		p.timeout = d
+	}
+}
+
+// New creates a Publisher producing to topic of the cluster of the
+// bootstrap brokers, given as host:port addresses.
+func New(brokers []string, topic string, opts ...Option) (*Publisher, error) {
+	if len(brokers) == 0 {
+		return nil, errors.New("event Kafka publisher requires a broker")
+	}
+	for _, addr := range brokers {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid Kafka broker %q: %w", addr, err)
+		}
+	}
+	if topic == "" {
+		return nil, errors.New("event Kafka publisher requires a topic")
+	}
+	p := &Publisher{timeout: 10 * time.Second}
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.writer = &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Murmur2Balancer{},
+		MaxAttempts:  3,
+		BatchSize:    1,
+		WriteTimeout: p.timeout,
+		RequiredAcks: kafka.RequireAll,
+		Transport:    &kafka.Transport{ClientID: "scepserver", TLS: p.tlsConfig},
+	}
+	return p, nil
+}
+
+// Publisher implements a scepserver.EventPublisher.
+// It produces each scepserver.Event as a JSON record with the event-type
+// header, keyed by the serial number or else the transaction ID. Keys are
+// partitioned like the Java client does, so the events of a certificate
+// stay in order in one partition. Records are acknowledged by all in-sync
+// replicas. The connections to the brokers are kept open between events.
+type Publisher struct {
+	writer    messageWriter
+	tlsConfig *tls.Config
+	timeout   time.Duration
+}
+
+// messageWriter is the part of *kafka.Writer used by a Publisher.
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Publish produces e to the topic.
+func (p *Publisher) Publish(ctx context.Context, e scepserver.Event) error {
+	value, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	msg := kafka.Message{
+		Value:   value,
+		Headers: []kafka.Header{{Key: "event-type", Value: []byte(e.Type)}},
+	}
+	switch {
+	case e.Serial != "":
+		msg.Key = []byte(e.Serial)
+	case e.TransactionID != "":
+		msg.Key = []byte(e.TransactionID)
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	if err := p.writer.WriteMessages(ctx, msg); err != nil {
+		return fmt.Errorf("event Kafka publisher: %w", err)
+	}
+	return nil
+}
+
+// Close closes the connections to the brokers.
+func (p *Publisher) Close() error {
+	return p.writer.Close()
+}
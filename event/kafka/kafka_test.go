@@ -0,0 +1,97 @@
+package kafkaevent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	scepserver "github.com/micromdm/scep/v2/server"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeWriter records the messages written to it and fails with err.
+type fakeWriter struct {
+	msgs []kafka.Message
+	err  error
+}
+
+func (w *fakeWriter) WriteMessages(_ context.Context, msgs ...kafka.Message) error {
+	w.msgs = append(w.msgs, msgs...)
+	return w.err
+}
+
+func (w *fakeWriter) Close() error { return nil }
+
+func TestPublish(t *testing.T) {
+	p, err := New([]string{"127.0.0.1:9092"}, "scep-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kw, ok := p.writer.(*kafka.Writer)
+	if !ok {
+		t.Fatalf("have writer %T, want *kafka.Writer", p.writer)
+	}
+	if kw.Topic != "scep-events" || kw.RequiredAcks != kafka.RequireAll {
+		t.Errorf("have topic %q and acks %v, want scep-events acknowledged by all replicas", kw.Topic, kw.RequiredAcks)
+	}
+	if _, ok := kw.Balancer.(*kafka.Murmur2Balancer); !ok {
+		t.Errorf("have balancer %T, want the murmur2 partitioning of the Java client", kw.Balancer)
+	}
+
+	w := &fakeWriter{}
+	p.writer = w
+	for _, e := range []scepserver.Event{
+		{Type: scepserver.EventIssued, Serial: "0A", TransactionID: "tx1"},
+		{Type: scepserver.EventFailed, TransactionID: "tx2"},
+	} {
+		if err := p.Publish(context.Background(), e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(w.msgs) != 2 {
+		t.Fatalf("have %d records, want 2", len(w.msgs))
+	}
+	for i, want := range []struct {
+		key, eventType string
+	}{
+		{"0A", "issued"},
+		{"tx2", "failed"},
+	} {
+		msg := w.msgs[i]
+		if string(msg.Key) != want.key {
+			t.Errorf("have key %q, want %q", msg.Key, want.key)
+		}
+		if len(msg.Headers) != 1 || msg.Headers[0].Key != "event-type" || string(msg.Headers[0].Value) != want.eventType {
+			t.Errorf("have headers %v, want event-type %s", msg.Headers, want.eventType)
+		}
+		var e scepserver.Event
+		if err := json.Unmarshal(msg.Value, &e); err != nil {
+			t.Fatal(err)
+		}
+		if string(e.Type) != want.eventType {
+			t.Errorf("have event %+v, want %s", e, want.eventType)
+		}
+	}
+
+	w.err = errors.New("leader not available")
+	if err := p.Publish(context.Background(), scepserver.Event{Type: scepserver.EventRevoked, Serial: "0A"}); !errors.Is(err, w.err) {
+		t.Errorf("have error %v, want %v", err, w.err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, test := range []struct {
+		brokers []string
+		topic   string
+	}{
+		{nil, "scep-events"},
+		{[]string{"localhost"}, "scep-events"},
+		{[]string{"localhost:9092"}, ""},
+	} {
+		if _, err := New(test.brokers, test.topic); err == nil {
+			t.Errorf("%v %q: expected an error", test.brokers, test.topic)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Package natsevent defines the Publisher scepserver.EventPublisher
+// publishing issuance events to a NATS server, e.g. for inventory and
+// expiry alerting pipelines.
+package natsevent
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	scepserver "github.com/micromdm/scep/v2/server"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Option configures a Publisher.
+type Option func(*Publisher)
+
+// WithTLSConfig connects to the server with TLS, e.g. with the root CAs of
+// the server or a client certificate. tls:// URLs use the system roots by
+// default.
+func WithTLSConfig(conf *tls.Config) Option {
+	return func(p *Publisher) {
+		p.tlsConfig = conf
+	}
+}
+
+// WithTimeout sets the time connecting to the server and publishing an
+// event may take, 10 seconds by default.
+func WithTimeout(d time.Duration) Option {
+	return func(p *Publisher) {
+		p.timeout = d
+	}
+}
+
+// New creates a Publisher publishing to the NATS server at the nats:// or
+// tls:// URL serverURL. The user and password, or the token as user, of the
+// URL authenticate to the server. Each event is published on subject
+// followed by a dot and the scepserver.EventType, e.g. scep.events.issued.
+//
+// The connection is kept open and re-established in the background if it
+// is lost, also if the server cannot be reached at first.
+func New(serverURL, subject string, opts ...Option) (*Publisher, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return nil, errors.New("event NATS server must be a nats or tls URL")
+	}
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n*>") {
+		return nil, fmt.Errorf("invalid NATS subject %q", subject)
+	}
+	p := &Publisher{subject: subject, timeout: 10 * time.Second}
+	for _, opt := range opts {
+		opt(p)
+	}
+	natsOpts := []nats.Option{
+		nats.Name("scepserver"),
+		nats.Timeout(p.timeout),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+	}
+	if p.tlsConfig != nil {
+		natsOpts = append(natsOpts, nats.Secure(p.tlsConfig))
+	}
+	if p.conn, err = nats.Connect(serverURL, natsOpts...); err != nil {
+		return nil, fmt.Errorf("event NATS server: %w", err)
+	}
+	return p, nil
+}
+
+// Publisher implements a scepserver.EventPublisher.
+// It publishes each scepserver.Event as JSON with the NATS core protocol and
+// waits for the server to receive it.
+type Publisher struct {
+	conn      *nats.Conn
+	subject   string
+	tlsConfig *tls.Config
+	timeout   time.Duration
+}
+
+// Publish publishes e on the subject of its type.
+func (p *Publisher) Publish(ctx context.Context, e scepserver.Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	if err := p.conn.Publish(p.subject+"."+string(e.Type), body); err != nil {
+		return fmt.Errorf("event NATS server: %w", err)
+	}
+	// the server answers the PING of the flush after the message
+	if err := p.conn.FlushWithContext(ctx); err != nil {
+		return fmt.Errorf("event NATS server: %w", err)
+	}
+	return nil
+}
+
+// Close closes the connection to the server.
+func (p *Publisher) Close() error {
+	p.conn.Close()
+	return nil
+}
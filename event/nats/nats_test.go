@@ -0,0 +1,140 @@
+package natsevent
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	scepserver "github.com/micromdm/scep/v2/server"
+)
+
+// published is a message received by fakeServer.
+type published struct {
+	subject string
+	body    []byte
+}
+
+// fakeServer is a NATS server accepting the token "token" and sending the
+// messages published to it on msgs. It counts its connections on conns.
+func fakeServer(t *testing.T, msgs chan<- published, conns chan<- struct{}) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- struct{}{}
+			go serve(t, c, msgs)
+		}
+	}()
+	return l.Addr().String()
+}
+
+func serve(t *testing.T, c net.Conn, msgs chan<- published) {
+	defer c.Close()
+	fmt.Fprintf(c, "INFO {\"server_id\":\"test\",\"auth_required\":true,\"max_payload\":1048576}\r\n")
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "CONNECT "):
+			var connect struct {
+				AuthToken string `json:"auth_token"`
+			}
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "CONNECT ")), &connect); err != nil {
+				t.Error(err)
+			}
+			if connect.AuthToken != "token" {
+				fmt.Fprintf(c, "-ERR 'Authorization Violation'\r\n")
+				return
+			}
+		case strings.HasPrefix(line, "PUB "):
+			var msg published
+			var n int
+			if _, err := fmt.Sscanf(line, "PUB %s %d", &msg.subject, &n); err != nil {
+				t.Error(err)
+				return
+			}
+			msg.body = make([]byte, n+2)
+			if _, err := io.ReadFull(r, msg.body); err != nil {
+				t.Error(err)
+				return
+			}
+			msg.body = msg.body[:n]
+			msgs <- msg
+		case line == "PING":
+			fmt.Fprintf(c, "PONG\r\n")
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	msgs := make(chan published, 2)
+	conns := make(chan struct{}, 10)
+	addr := fakeServer(t, msgs, conns)
+
+	p, err := New("nats://token@"+addr, "scep.events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	for _, serial := range []string{"0A", "0B"} {
+		if err := p.Publish(context.Background(), scepserver.Event{Type: scepserver.EventIssued, Serial: serial}); err != nil {
+			t.Fatal(err)
+		}
+		msg := <-msgs
+		if msg.subject != "scep.events.issued" {
+			t.Errorf("have subject %q, want scep.events.issued", msg.subject)
+		}
+		var e scepserver.Event
+		if err := json.Unmarshal(msg.body, &e); err != nil {
+			t.Fatal(err)
+		}
+		if e.Type != scepserver.EventIssued || e.Serial != serial {
+			t.Errorf("unexpected event %+v", e)
+		}
+	}
+	// both events were published on one connection
+	if len(conns) != 1 {
+		t.Errorf("have %d connections, want 1", len(conns))
+	}
+
+	unauthorized, err := New("nats://wrong@"+addr, "scep.events", WithTimeout(500*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unauthorized.Close()
+	if err := unauthorized.Publish(context.Background(), scepserver.Event{Type: scepserver.EventFailed}); err == nil {
+		t.Error("expected an error for a rejected token")
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, test := range []struct {
+		url, subject string
+	}{
+		{"http://localhost", "scep.events"},
+		{"nats://localhost", ""},
+		{"nats://localhost", "scep.*"},
+		{"nats://localhost", "scep events"},
+	} {
+		if _, err := New(test.url, test.subject); err == nil {
+			t.Errorf("%s %q: expected an error", test.url, test.subject)
+		}
+	}
+}
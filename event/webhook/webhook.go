@@ -0,0 +1,179 @@
+// Package webhookevent defines the Publisher scepserver.EventPublisher
+// POSTing signed issuance events to an HTTP endpoint, e.g. of an MDM like
+// Jamf Pro or of a CMDB.
+package webhookevent
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	scepserver "github.com/micromdm/scep/v2/server"
+)
+
+// Headers of the requests of a Publisher with a secret.
+const (
+	// TimestampHeader is the Unix time the request was signed at.
+	TimestampHeader = "X-SCEP-Timestamp"
+	// SignatureHeader is "sha256=" followed by the hex encoded Signature
+	// of the request.
+	SignatureHeader = "X-SCEP-Signature"
+)
+
+// Option configures a Publisher.
+type Option func(*Publisher)
+
+// WithHTTPClient sets the client used to call the endpoint. The default
+// client times out after 30 seconds.
+func WithHTTPClient(client *http.Client) Option {
+	return func(p *Publisher) {
+		p.client = client
+	}
+}
+
+// WithHeader sets a header of the requests, e.g. an Authorization header
+// authenticating the server to the endpoint.
+func WithHeader(key, value string) Option {
+	return func(p *Publisher) {
+		p.header.Set(key, value)
+	}
+}
+
+// WithSecret signs the requests with an HMAC-SHA256 of secret, see
+// Signature, so the endpoint can authenticate them.
+func WithSecret(secret []byte) Option {
+	return func(p *Publisher) {
+		p.secret = secret
+	}
+}
+
+// WithEvents only publishes the events of types. By default all events are
+// published.
+func WithEvents(types ...scepserver.EventType) Option {
+	return func(p *Publisher) {
+		p.types = make(map[scepserver.EventType]bool)
+		for _, t := range types {
+			p.types[t] = true
+		}
+	}
+}
+
+// WithRetries retries failed requests up to n times, waiting one second
+// before the first retry and doubling the wait with every further one. The
+// default is 3 retries.
+func WithRetries(n int) Option {
+	return func(p *Publisher) {
+		p.retries = n
+	}
+}
+
+// New creates a Publisher POSTing to endpointURL.
+func New(endpointURL string, opts ...Option) (*Publisher, error) {
+	u, err := url.Parse(endpointURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("event webhook must be an http or https URL")
+	}
+	p := &Publisher{
+		url:     endpointURL,
+		client:  &http.Client{Timeout: 30 * time.Second},
+		header:  make(http.Header),
+		retries: 3,
+		backoff: time.Second,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p, nil
+}
+
+// Publisher implements a scepserver.EventPublisher.
+// It POSTs each scepserver.Event as JSON to a URL. Requests failing or
+// answered with a 5xx status are retried, other statuses than 2xx are
+// errors.
+type Publisher struct {
+	url     string
+	client  *http.Client
+	header  http.Header
+	secret  []byte
+	types   map[scepserver.EventType]bool
+	retries int
+	backoff time.Duration
+}
+
+// Publish POSTs e to the endpoint.
+func (p *Publisher) Publish(ctx context.Context, e scepserver.Event) error {
+	if p.types != nil && !p.types[e.Type] {
+		return nil
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	wait := p.backoff
+	for attempt := 0; ; attempt++ {
+		retry, err := p.post(ctx, body)
+		if err == nil || !retry || attempt >= p.retries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// post sends body once, reporting whether a failure may be retried.
+func (p *Publisher) post(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	for key, values := range p.header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.secret != nil {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, "sha256="+Signature(p.secret, timestamp, body))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("event webhook: %w", err)
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 1<<16))
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode >= 500, fmt.Errorf("event webhook answered %s", resp.Status)
+	}
+	return false, nil
+}
+
+// Signature returns the hex encoded HMAC-SHA256 with secret of the
+// timestamp, a dot and the body of a request. Endpoints compare it with the
+// SignatureHeader with hmac.Equal, and reject old timestamps to prevent
+// replays.
+func Signature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
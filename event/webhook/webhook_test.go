@@ -0,0 +1,86 @@
+package webhookevent
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	scepserver "github.com/micromdm/scep/v2/server"
+)
+
+func TestPublish(t *testing.T) {
+	secret := []byte("secret")
+	var (
+		calls  int32
+		events = make(chan scepserver.Event, 10)
+	)
+	// the endpoint fails the first request and verifies the signature
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		want := "sha256=" + Signature(secret, r.Header.Get(TimestampHeader), body)
+		if !hmac.Equal([]byte(r.Header.Get(SignatureHeader)), []byte(want)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var e scepserver.Event
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Error(err)
+		}
+		events <- e
+	}))
+	defer srv.Close()
+
+	p, err := New(srv.URL, WithSecret(secret), WithEvents(scepserver.EventIssued))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.backoff = time.Millisecond
+
+	notAfter := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := p.Publish(context.Background(), scepserver.Event{Type: scepserver.EventFailed}); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Publish(context.Background(), scepserver.Event{
+		Type:     scepserver.EventIssued,
+		Serial:   "0A",
+		Subject:  "CN=device",
+		DeviceID: "C02XYZ",
+		NotAfter: &notAfter,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if have := atomic.LoadInt32(&calls); have != 2 {
+		t.Errorf("have %d requests, want 2", have)
+	}
+	e := <-events
+	if e.Type != scepserver.EventIssued || e.Serial != "0A" || e.DeviceID != "C02XYZ" || !e.NotAfter.Equal(notAfter) {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	wrongSecret, err := New(srv.URL, WithSecret([]byte("wrong")), WithRetries(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wrongSecret.Publish(context.Background(), scepserver.Event{Type: scepserver.EventRevoked}); err == nil {
+		t.Error("expected an error for a rejected signature")
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New("ftp://example.com"); err == nil {
+		t.Error("expected an error for a non-HTTP URL")
+	}
+}
@@ -5,14 +5,16 @@ go 1.16
 require (
 	github.com/boltdb/bolt v1.3.1
 	github.com/go-kit/kit v0.4.0
+	github.com/go-ldap/ldap/v3 v3.4.1
 	github.com/go-logfmt/logfmt v0.3.0 // indirect
 	github.com/go-stack/stack v1.6.0 // indirect
 	github.com/gorilla/context v0.0.0-20160226214623-1ea25387ff6f // indirect
 	github.com/gorilla/mux v1.4.0
 	github.com/groob/finalizer v0.0.0-20170707115354-4c2ed49aabda
 	github.com/kr/logfmt v0.0.0-20140226030751-b84e30acd515 // indirect
+	github.com/nats-io/nats.go v1.11.0
 	github.com/pkg/errors v0.8.0
+	github.com/segmentio/kafka-go v0.4.23
 	go.mozilla.org/pkcs7 v0.0.0-20210826202110-33d05740a352
-	golang.org/x/net v0.0.0-20170726083632-f5079bd7f6f7 // indirect
-	golang.org/x/sys v0.0.0-20170728174421-0f826bdd13b5 // indirect
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
 )
@@ -0,0 +1,60 @@
+// Package metrics defines the instrumentation of SCEP message processing
+// used by the server and client packages.
+package metrics
+
+import (
+	"strings"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// Metrics records SCEP message and operation metrics. Implementations
+// must be safe for concurrent use.
+type Metrics interface {
+	// MessageParsed counts a successfully parsed PKIMessage.
+	MessageParsed(messageType scep.MessageType)
+
+	// DecryptFailed counts a pkiEnvelope which could not be decrypted.
+	DecryptFailed()
+
+	// SignDuration observes the time taken to sign a request: issuing
+	// the certificate on the server, creating the PKIMessage on the client.
+	SignDuration(d time.Duration)
+
+	// CertIssued counts a certificate issued by the server or received by
+	// the client.
+	CertIssued()
+
+	// Failure counts a CertRep FAILURE sent by the server or received by
+	// the client.
+	Failure(info scep.FailInfo)
+}
+
+// ExpiryMetrics records the scans of the server for certificates nearing
+// expiry. Implementations must be safe for concurrent use.
+type ExpiryMetrics interface {
+	// CertificatesExpiring sets the number of certificates found expiring
+	// without having been renewed by the last scan.
+	CertificatesExpiring(n int)
+}
+
+type nop struct{}
+
+// Nop returns Metrics which discard all observations.
+func Nop() Metrics { return nop{} }
+
+func (nop) MessageParsed(scep.MessageType) {}
+func (nop) DecryptFailed()                 {}
+func (nop) SignDuration(time.Duration)     {}
+func (nop) CertIssued()                    {}
+func (nop) Failure(scep.FailInfo)          {}
+
+// Name returns the name of a MessageType or FailInfo without its numeric
+// value, e.g. "PKCSReq" for scep.PKCSReq, for use as a metric label.
+func Name(v interface{ String() string }) string {
+	if fields := strings.Fields(v.String()); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
+}
@@ -0,0 +1,184 @@
+// Package prometheus implements metrics.Metrics exposed in the Prometheus
+// text exposition format.
+package prometheus
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/micromdm/scep/v2/metrics"
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// DefaultBuckets are the upper bounds in seconds of the sign duration
+// histogram buckets, those of the Prometheus client libraries.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics collects metrics.Metrics observations and serves them to
+// Prometheus scrapes as an http.Handler.
+type Metrics struct {
+	namespace string
+	buckets   []float64
+
+	mu              sync.Mutex
+	messages        map[string]uint64
+	decryptFailures uint64
+	issued          uint64
+	failures        map[string]uint64
+	signCounts      []uint64
+	signSum         float64
+	signCount       uint64
+	expiring        int
+	expiryScanned   bool
+}
+
+// Option configures Metrics.
+type Option func(*Metrics)
+
+// WithBuckets sets the upper bounds in seconds of the sign duration
+// histogram buckets, DefaultBuckets by default.
+func WithBuckets(buckets []float64) Option {
+	return func(m *Metrics) {
+		m.buckets = buckets
+	}
+}
+
+// New creates Metrics with names prefixed by namespace, e.g. "scep".
+func New(namespace string, opts ...Option) *Metrics {
+	m := &Metrics{
+		namespace: namespace,
+		buckets:   DefaultBuckets,
+		messages:  make(map[string]uint64),
+		failures:  make(map[string]uint64),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	m.buckets = append([]float64(nil), m.buckets...)
+	sort.Float64s(m.buckets)
+	m.signCounts = make([]uint64, len(m.buckets))
+	return m
+}
+
+var (
+	_ metrics.Metrics       = (*Metrics)(nil)
+	_ metrics.ExpiryMetrics = (*Metrics)(nil)
+)
+
+// MessageParsed implements metrics.Metrics.
+func (m *Metrics) MessageParsed(messageType scep.MessageType) {
+	m.mu.Lock()
+	m.messages[metrics.Name(messageType)]++
+	m.mu.Unlock()
+}
+
+// DecryptFailed implements metrics.Metrics.
+func (m *Metrics) DecryptFailed() {
+	m.mu.Lock()
+	m.decryptFailures++
+	m.mu.Unlock()
+}
+
+// SignDuration implements metrics.Metrics.
+func (m *Metrics) SignDuration(d time.Duration) {
+	s := d.Seconds()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, upper := range m.buckets {
+		if s <= upper {
+			m.signCounts[i]++
+		}
+	}
+	m.signSum += s
+	m.signCount++
+}
+
+// CertIssued implements metrics.Metrics.
+func (m *Metrics) CertIssued() {
+	m.mu.Lock()
+	m.issued++
+	m.mu.Unlock()
+}
+
+// Failure implements metrics.Metrics.
+func (m *Metrics) Failure(info scep.FailInfo) {
+	m.mu.Lock()
+	m.failures[metrics.Name(info)]++
+	m.mu.Unlock()
+}
+
+// CertificatesExpiring implements metrics.ExpiryMetrics.
+func (m *Metrics) CertificatesExpiring(n int) {
+	m.mu.Lock()
+	m.expiring = n
+	m.expiryScanned = true
+	m.mu.Unlock()
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format to w.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var b strings.Builder
+	name := func(s string) string {
+		if m.namespace == "" {
+			return s
+		}
+		return m.namespace + "_" + s
+	}
+
+	writeHeader(&b, name("messages_parsed_total"), "counter", "PKIMessages parsed by message type.")
+	writeLabeled(&b, name("messages_parsed_total"), "message_type", m.messages)
+	writeHeader(&b, name("decrypt_failures_total"), "counter", "pkiEnvelopes which could not be decrypted.")
+	fmt.Fprintf(&b, "%s %d\n", name("decrypt_failures_total"), m.decryptFailures)
+	writeHeader(&b, name("certificates_issued_total"), "counter", "Certificates issued or received.")
+	fmt.Fprintf(&b, "%s %d\n", name("certificates_issued_total"), m.issued)
+	writeHeader(&b, name("failures_total"), "counter", "CertRep FAILURE messages by failInfo.")
+	writeLabeled(&b, name("failures_total"), "fail_info", m.failures)
+
+	sign := name("sign_duration_seconds")
+	writeHeader(&b, sign, "histogram", "Time taken to sign requests.")
+	for i, upper := range m.buckets {
+		fmt.Fprintf(&b, "%s_bucket{le=%q} %d\n", sign, strconv.FormatFloat(upper, 'g', -1, 64), m.signCounts[i])
+	}
+	fmt.Fprintf(&b, "%s_bucket{le=\"+Inf\"} %d\n", sign, m.signCount)
+	fmt.Fprintf(&b, "%s_sum %s\n", sign, strconv.FormatFloat(m.signSum, 'g', -1, 64))
+	fmt.Fprintf(&b, "%s_count %d\n", sign, m.signCount)
+
+	if m.expiryScanned {
+		writeHeader(&b, name("certificates_expiring"), "gauge", "Certificates nearing expiry without having been renewed.")
+		fmt.Fprintf(&b, "%s %d\n", name("certificates_expiring"), m.expiring)
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func writeHeader(b *strings.Builder, name, typ, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeLabeled(b *strings.Builder, name, label string, values map[string]uint64) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s{%s=\"%s\"} %d\n", name, label, labelEscaper.Replace(k), values[k])
+	}
+}
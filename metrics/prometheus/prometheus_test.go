@@ -0,0 +1,59 @@
+package prometheus
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+func TestMetrics(t *testing.T) {
+	m := New("scep", WithBuckets([]float64{1, 0.1}))
+	m.MessageParsed(scep.PKCSReq)
+	m.MessageParsed(scep.PKCSReq)
+	m.MessageParsed(scep.GetCRL)
+	m.DecryptFailed()
+	m.SignDuration(50 * time.Millisecond)
+	m.SignDuration(2 * time.Second)
+	m.CertIssued()
+	m.Failure(scep.BadRequest)
+	if strings.Contains(metricsText(m), "scep_certificates_expiring") {
+		t.Error("expiring gauge written before a scan")
+	}
+	m.CertificatesExpiring(3)
+
+	rr := httptest.NewRecorder()
+	m.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if have, want := rr.Header().Get("Content-Type"), "text/plain; version=0.0.4"; have != want {
+		t.Errorf("have Content-Type %q, want %q", have, want)
+	}
+	body := rr.Body.String()
+	for _, line := range []string{
+		"# TYPE scep_messages_parsed_total counter",
+		`scep_messages_parsed_total{message_type="GetCRL"} 1`,
+		`scep_messages_parsed_total{message_type="PKCSReq"} 2`,
+		"scep_decrypt_failures_total 1",
+		"scep_certificates_issued_total 1",
+		`scep_failures_total{fail_info="badRequest"} 1`,
+		"# TYPE scep_sign_duration_seconds histogram",
+		`scep_sign_duration_seconds_bucket{le="0.1"} 1`,
+		`scep_sign_duration_seconds_bucket{le="1"} 1`,
+		`scep_sign_duration_seconds_bucket{le="+Inf"} 2`,
+		"scep_sign_duration_seconds_sum 2.05",
+		"scep_sign_duration_seconds_count 2",
+		"# TYPE scep_certificates_expiring gauge",
+		"scep_certificates_expiring 3",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("missing line %q in\n%s", line, body)
+		}
+	}
+}
+
+func metricsText(m *Metrics) string {
+	var b strings.Builder
+	m.WriteTo(&b)
+	return b.String()
+}
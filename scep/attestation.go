@@ -0,0 +1,92 @@
+package scep
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+
+	"github.com/pkg/errors"
+)
+
+// OIDTPMAttestation is the tcg-attest-tpm-certify identifier of the TCG,
+// used as the CSR extension carrying a TPMAttestation.
+var OIDTPMAttestation = asn1.ObjectIdentifier{2, 23, 133, 20, 1}
+
+// ErrNoAttestation is returned by ParseTPMAttestation for CSRs without a
+// TPMAttestation extension.
+var ErrNoAttestation = errors.New("scep: CSR has no TPM attestation")
+
+// TPMAttestation is evidence that the key of a CSR resides in a TPM 2.0:
+// the output of TPM2_Certify of the CSR key by an attestation key (AK),
+// modelled on the TcgAttestCertify structure of the TCG. It is carried in
+// the CSR, so it is covered by the CSR signature and encrypted in the
+// pkiEnvelope like the rest of the request.
+//
+// The package neither creates nor verifies the TPM structures, see
+// scepserver.AttestationMiddleware for the verification by the CA.
+type TPMAttestation struct {
+	// CertifyInfo is the TPMS_ATTEST structure signed by the AK. Its
+	// extraData should bind the attestation to the request, e.g. to a
+	// hash of the challenge password.
+	CertifyInfo []byte
+	// Signature is the TPMT_SIGNATURE of CertifyInfo by the AK.
+	Signature []byte
+	// KeyPublic is the TPMT_PUBLIC area of the certified key, whose name
+	// is the attested name of CertifyInfo.
+	KeyPublic []byte `asn1:"optional"`
+	// AKCertificates are the DER certificates of the AK, e.g. issued by an
+	// attestation CA after an EK based credential activation, or the EK
+	// certificate chain, leaf first.
+	AKCertificates []asn1.RawValue `asn1:"optional,tag:0"`
+}
+
+// AKCertificateChain parses the AKCertificates of a.
+func (a *TPMAttestation) AKCertificateChain() ([]*x509.Certificate, error) {
+	certs := make([]*x509.Certificate, 0, len(a.AKCertificates))
+	for _, raw := range a.AKCertificates {
+		cert, err := x509.ParseCertificate(raw.FullBytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "scep: parsing AK certificate")
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// AddAKCertificates appends the DER encoding of certs to the
+// AKCertificates of a.
+func (a *TPMAttestation) AddAKCertificates(certs ...*x509.Certificate) {
+	for _, cert := range certs {
+		a.AKCertificates = append(a.AKCertificates, asn1.RawValue{FullBytes: cert.Raw})
+	}
+}
+
+// Extension returns the CSR extension carrying a, for the ExtraExtensions
+// of the CSR template.
+func (a *TPMAttestation) Extension() (pkix.Extension, error) {
+	value, err := asn1.Marshal(*a)
+	if err != nil {
+		return pkix.Extension{}, errors.Wrap(err, "scep: marshaling TPM attestation")
+	}
+	return pkix.Extension{Id: OIDTPMAttestation, Value: value}, nil
+}
+
+// ParseTPMAttestation returns the TPMAttestation of csr, or
+// ErrNoAttestation.
+func ParseTPMAttestation(csr *x509.CertificateRequest) (*TPMAttestation, error) {
+	for _, ext := range csr.Extensions {
+		if !ext.Id.Equal(OIDTPMAttestation) {
+			continue
+		}
+		var a TPMAttestation
+		rest, err := asn1.Unmarshal(ext.Value, &a)
+		if err != nil {
+			return nil, errors.Wrap(err, "scep: parsing TPM attestation")
+		}
+		if len(rest) > 0 {
+			return nil, errors.New("scep: trailing data after TPM attestation")
+		}
+		return &a, nil
+	}
+	return nil, ErrNoAttestation
+}
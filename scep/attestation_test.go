@@ -0,0 +1,78 @@
+package scep
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestTPMAttestation(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "AK"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ak, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	att := &TPMAttestation{
+		CertifyInfo: []byte("TPMS_ATTEST"),
+		Signature:   []byte("TPMT_SIGNATURE"),
+		KeyPublic:   []byte("TPMT_PUBLIC"),
+	}
+	att.AddAKCertificates(ak)
+	ext, err := att.Extension()
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:         pkix.Name{CommonName: "device"},
+		ExtraExtensions: []pkix.Extension{ext},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	have, err := ParseTPMAttestation(csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have.CertifyInfo, att.CertifyInfo) || !bytes.Equal(have.Signature, att.Signature) ||
+		!bytes.Equal(have.KeyPublic, att.KeyPublic) {
+		t.Errorf("have %+v, want %+v", have, att)
+	}
+	chain, err := have.AKCertificateChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 1 || !chain[0].Equal(ak) {
+		t.Errorf("have %d AK certificates, want the AK certificate", len(chain))
+	}
+
+	csr.Extensions = nil
+	if _, err := ParseTPMAttestation(csr); !errors.Is(err, ErrNoAttestation) {
+		t.Errorf("have %v, want ErrNoAttestation", err)
+	}
+}
@@ -0,0 +1,98 @@
+package scep_test
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+func BenchmarkNewCSRRequest(b *testing.B) {
+	cacert, _ := loadCACredentials(b)
+	clientcert, clientkey := loadClientCredentials(b)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "bench"}}, clientkey)
+	if err != nil {
+		b.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		b.Fatal(err)
+	}
+	tmpl := &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{cacert},
+		SignerCert:  clientcert,
+		SignerKey:   clientkey,
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := scep.NewCSRRequest(csr, tmpl, scep.WithEncryptionAlgorithm(scep.AES128CBC)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkParsePKIMessage(b *testing.B) {
+	data := loadTestFile(b, "testdata/PKCSReq.der")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := scep.ParsePKIMessage(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecryptPKIEnvelope(b *testing.B) {
+	data := loadTestFile(b, "testdata/PKCSReq.der")
+	cacert, cakey := loadCACredentials(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		msg, err := scep.ParsePKIMessage(data)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := msg.DecryptPKIEnvelope(cacert, cakey); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSuccess(b *testing.B) {
+	msg, err := scep.ParsePKIMessage(loadTestFile(b, "testdata/PKCSReq.der"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	cacert, cakey := loadCACredentials(b)
+	if err := msg.DecryptPKIEnvelope(cacert, cakey); err != nil {
+		b.Fatal(err)
+	}
+	csr := msg.CSRReqMessage.CSR
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(4),
+		Subject:      csr.Subject,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, cacert, csr.PublicKey, cakey)
+	if err != nil {
+		b.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := msg.Success(cacert, cakey, crt); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
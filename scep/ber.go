@@ -0,0 +1,132 @@
+package scep
+
+import (
+	"github.com/pkg/errors"
+	"go.mozilla.org/pkcs7"
+)
+
+var errTruncatedBER = errors.New("scep: truncated BER element")
+
+// parsePKCS7 parses the PKCS#7 data after converting BER encodings, as
+// emitted by some HSM-backed CAs, to DER.
+func parsePKCS7(data []byte) (*pkcs7.PKCS7, error) {
+	return pkcs7.Parse(normalizeBER(data))
+}
+
+// normalizeBER returns the DER encoding of the BER encoding data, or data
+// if it cannot be converted.
+func normalizeBER(data []byte) []byte {
+	if der, err := berToDER(data); err == nil {
+		return der
+	}
+	return data
+}
+
+// berToDER converts the BER encoding data to DER. Indefinite lengths are
+// replaced by definite ones and constructed OCTET STRINGs are joined into
+// primitive ones, as produced by NDES; other BER forms are kept.
+func berToDER(data []byte) ([]byte, error) {
+	ident, content, rest, err := berElement(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("scep: trailing data after BER element")
+	}
+	return derElement(ident, content), nil
+}
+
+// berElement returns the identifier octets, the content converted to DER
+// and the data following the first BER element of data.
+func berElement(data []byte) (ident, content, rest []byte, err error) {
+	pos := 1
+	if len(data) > 0 && data[0]&0x1f == 0x1f {
+		// high tag number form
+		for pos < len(data) && data[pos]&0x80 != 0 {
+			pos++
+		}
+		pos++
+	}
+	if pos >= len(data) {
+		return nil, nil, nil, errTruncatedBER
+	}
+	ident = data[:pos]
+	constructed := data[0]&0x20 != 0
+
+	l := data[pos]
+	pos++
+	length := -1 // indefinite
+	switch {
+	case l < 0x80:
+		length = int(l)
+	case l > 0x80:
+		n := int(l & 0x7f)
+		if n > 4 || pos+n > len(data) {
+			return nil, nil, nil, errTruncatedBER
+		}
+		length = 0
+		for _, b := range data[pos : pos+n] {
+			length = length<<8 | int(b)
+		}
+		pos += n
+	case !constructed:
+		return nil, nil, nil, errors.New("scep: indefinite length of primitive BER element")
+	}
+	if length > len(data)-pos {
+		return nil, nil, nil, errTruncatedBER
+	}
+	if !constructed {
+		return ident, data[pos : pos+length], data[pos+length:], nil
+	}
+
+	body := data[pos:]
+	if length >= 0 {
+		body, rest = data[pos:pos+length], data[pos+length:]
+	}
+	// a constructed OCTET STRING is the concatenation of its segments
+	octetString := len(ident) == 1 && ident[0] == 0x24
+	for {
+		if length < 0 {
+			if len(body) < 2 {
+				return nil, nil, nil, errTruncatedBER
+			}
+			if body[0] == 0 && body[1] == 0 {
+				rest = body[2:]
+				break
+			}
+		} else if len(body) == 0 {
+			break
+		}
+		childIdent, childContent, childRest, err := berElement(body)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if octetString {
+			content = append(content, childContent...)
+		} else {
+			content = append(content, derElement(childIdent, childContent)...)
+		}
+		body = childRest
+	}
+	if octetString {
+		ident = []byte{0x04}
+	}
+	return ident, content, rest, nil
+}
+
+// derElement encodes the element ident with a definite length content.
+func derElement(ident, content []byte) []byte {
+	out := append([]byte{}, ident...)
+	switch n := len(content); {
+	case n < 0x80:
+		out = append(out, byte(n))
+	default:
+		var length []byte
+		for ; n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		out = append(out, 0x80|byte(len(length)))
+		out = append(out, length...)
+	}
+	return append(out, content...)
+}
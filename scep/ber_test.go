@@ -0,0 +1,142 @@
+package scep
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"io/ioutil"
+	"testing"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// toIndefinite re-encodes every constructed element of the DER encoding
+// der with an indefinite length.
+func toIndefinite(t *testing.T, der []byte) []byte {
+	t.Helper()
+	var out []byte
+	for len(der) > 0 {
+		ident, content, rest, err := berElement(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ident[0]&0x20 == 0 {
+			out = append(out, derElement(ident, content)...)
+		} else {
+			out = append(out, ident...)
+			out = append(out, 0x80)
+			out = append(out, toIndefinite(t, content)...)
+			out = append(out, 0, 0)
+		}
+		der = rest
+	}
+	return out
+}
+
+func TestBERToDER(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := newEnvelopeTestCert(t, key)
+	content := bytes.Repeat([]byte("SCEP pkiEnvelope content"), 20)
+	der, err := encryptPKIEnvelope(content, []*x509.Certificate{cert}, pkcs7.EncryptionAlgorithmDESCBC, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ber := toIndefinite(t, der)
+	if _, err := decryptPKIEnvelope(ber, cert, key); err == nil {
+		t.Error("expected error decrypting an indefinite length pkiEnvelope")
+	}
+	converted, err := berToDER(ber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(converted, der) {
+		t.Error("indefinite length pkiEnvelope not converted to its DER encoding")
+	}
+	decrypted, err := decryptPKIEnvelope(converted, cert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, content) {
+		t.Errorf("have %q, want %q", decrypted, content)
+	}
+
+	// constructed OCTET STRING segments are joined
+	segmented := []byte{0x24, 0x80, 0x04, 0x02, 'a', 'b', 0x04, 0x01, 'c', 0x00, 0x00}
+	converted, err = berToDER(segmented)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x04, 0x03, 'a', 'b', 'c'}; !bytes.Equal(converted, want) {
+		t.Errorf("have % x, want % x", converted, want)
+	}
+
+	for _, data := range [][]byte{{0x30}, {0x30, 0x80, 0x04, 0x01, 'a'}, {0x04, 0x80}, {0x04, 0x05, 'a'}} {
+		if _, err := berToDER(data); err == nil {
+			t.Errorf("% x: expected error", data)
+		}
+	}
+}
+
+func TestParseBER(t *testing.T) {
+	der, err := ioutil.ReadFile("testdata/PKCSReq.der")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ParsePKIMessage(toIndefinite(t, der))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.MessageType != PKCSReq {
+		t.Errorf("have messageType %s, want %s", msg.MessageType, MessageType(PKCSReq))
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := newEnvelopeTestCert(t, key)
+	degenerate, err := DegenerateCertificates([]*x509.Certificate{cert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := CACerts(toIndefinite(t, degenerate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || !certs[0].Equal(cert) {
+		t.Errorf("have %d certificates, want the CA certificate", len(certs))
+	}
+}
+
+func TestReadPKIMessage(t *testing.T) {
+	der, err := ioutil.ReadFile("testdata/PKCSReq.der")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// data following a DER encoding is left in the reader
+	r := bytes.NewReader(append(append([]byte{}, der...), "trailer"...))
+	read, err := ReadPKIMessage(r, int64(len(der)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, der) || r.Len() != len("trailer") {
+		t.Error("DER message not read up to its end")
+	}
+
+	for _, data := range [][]byte{der, toIndefinite(t, der)} {
+		if _, err := ParsePKIMessageReader(bytes.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := ReadPKIMessage(bytes.NewReader(data), int64(len(data))-1); err != ErrMessageTooLarge {
+			t.Errorf("have error %v, want %v", err, ErrMessageTooLarge)
+		}
+		if _, err := ParsePKIMessageReader(bytes.NewReader(data[:len(data)/2]), int64(len(data))); err == nil {
+			t.Error("expected error for truncated message")
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package scep
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"strings"
+)
+
+// Capability is a GetCACaps keyword, see RFC 8894 section 3.5.2.
+type Capability string
+
+// Capabilities defined by RFC 8894.
+const (
+	CapAES              Capability = "AES"
+	CapDES3             Capability = "DES3"
+	CapGetNextCACert    Capability = "GetNextCACert"
+	CapPOSTPKIOperation Capability = "POSTPKIOperation"
+	CapRenewal          Capability = "Renewal"
+	CapSHA1             Capability = "SHA-1"
+	CapSHA256           Capability = "SHA-256"
+	CapSHA512           Capability = "SHA-512"
+	// CapSCEPStandard implies AES, POSTPKIOperation and SHA-256.
+	CapSCEPStandard Capability = "SCEPStandard"
+)
+
+// Capabilities are the capabilities of a CA as returned by GetCACaps.
+type Capabilities []Capability
+
+// ParseCapabilities parses a GetCACaps response with one keyword per line.
+// Unknown keywords are kept.
+func ParseCapabilities(data []byte) Capabilities {
+	var caps Capabilities
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			caps = append(caps, Capability(line))
+		}
+	}
+	return caps
+}
+
+// Marshal returns the GetCACaps response body for caps.
+func (caps Capabilities) Marshal() []byte {
+	var buf bytes.Buffer
+	for i, c := range caps {
+		if i > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(string(c))
+	}
+	return buf.Bytes()
+}
+
+// Has reports whether c is one of caps. Keywords are compared case
+// insensitively.
+func (caps Capabilities) Has(c Capability) bool {
+	for _, have := range caps {
+		if strings.EqualFold(string(have), string(c)) {
+			return true
+		}
+	}
+	return false
+}
+
+// DigestAlgorithm returns the strongest digest algorithm supported by the
+// CA, defaulting to SHA-1, for use with WithDigestAlgorithm.
+func (caps Capabilities) DigestAlgorithm() crypto.Hash {
+	switch {
+	case caps.Has(CapSHA512):
+		return crypto.SHA512
+	case caps.Has(CapSHA256), caps.Has(CapSCEPStandard):
+		return crypto.SHA256
+	default:
+		return crypto.SHA1
+	}
+}
+
+// EncryptionAlgorithm returns the strongest content encryption algorithm
+// supported by the CA, defaulting to DES-CBC, for use with
+// WithEncryptionAlgorithm.
+func (caps Capabilities) EncryptionAlgorithm() EncryptionAlgorithm {
+	switch {
+	case caps.Has(CapAES), caps.Has(CapSCEPStandard):
+		return AES128CBC
+	case caps.Has(CapDES3):
+		return DES3CBC
+	default:
+		return DESCBC
+	}
+}
+
+// POSTPKIOperation reports whether PKIOperation requests may be sent with
+// HTTP POST.
+func (caps Capabilities) POSTPKIOperation() bool {
+	return caps.Has(CapPOSTPKIOperation) || caps.Has(CapSCEPStandard)
+}
@@ -0,0 +1,135 @@
+package scep
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+)
+
+// oidCMCRA is the id-kp-cmcRA extended key usage of RFC 6402 marking
+// registration authority certificates.
+var oidCMCRA = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 28}
+
+// CACertRoles are the certificates of a GetCACert response classified by
+// their role in the SCEP transaction, see RFC 8894 section 2.2.
+type CACertRoles struct {
+	// CA is the certificate of the CA issuing the client certificates.
+	CA *x509.Certificate
+	// RAEncryption is the RA certificate the pkiEnvelope of requests is
+	// encrypted to, nil without an RA.
+	RAEncryption *x509.Certificate
+	// RASigning is the RA certificate signing the CertRep messages, nil
+	// without an RA. NDES publishes separate encryption and signing RA
+	// certificates, other RAs use a single one for both.
+	RASigning *x509.Certificate
+	// Certs are all the classified certificates.
+	Certs []*x509.Certificate
+}
+
+// ClassifyCACerts classifies the certificates of a GetCACert response.
+//
+// The CA is a CA certificate allowed to sign certificates, preferably the
+// issuer of the RA certificates. RA certificates are the other, non-CA,
+// certificates: the first one with the keyEncipherment or dataEncipherment
+// key usage is the encryption certificate and the first one with the
+// digitalSignature usage the signing certificate. Certificates without a
+// key usage extension fill either role, and ones with the id-kp-cmcRA
+// extended key usage take precedence.
+func ClassifyCACerts(certs []*x509.Certificate) *CACertRoles {
+	roles := &CACertRoles{Certs: certs}
+	var ras []*x509.Certificate
+	for _, cert := range certs {
+		if cert.IsCA {
+			continue
+		}
+		if hasExtKeyUsage(cert, oidCMCRA) {
+			ras = append([]*x509.Certificate{cert}, ras...)
+		} else {
+			ras = append(ras, cert)
+		}
+	}
+	for _, ra := range ras {
+		if roles.RAEncryption == nil && allowsKeyUsage(ra, x509.KeyUsageKeyEncipherment|x509.KeyUsageDataEncipherment) {
+			roles.RAEncryption = ra
+		}
+		if roles.RASigning == nil && allowsKeyUsage(ra, x509.KeyUsageDigitalSignature) {
+			roles.RASigning = ra
+		}
+	}
+	for _, cert := range certs {
+		if !cert.IsCA || !allowsKeyUsage(cert, x509.KeyUsageCertSign) {
+			continue
+		}
+		if roles.CA == nil || roles.issued(cert) {
+			roles.CA = cert
+		}
+		if roles.issued(cert) {
+			break
+		}
+	}
+	return roles
+}
+
+// issued reports whether ca is the issuer of the RA certificates.
+func (r *CACertRoles) issued(ca *x509.Certificate) bool {
+	for _, ra := range []*x509.Certificate{r.RAEncryption, r.RASigning} {
+		if ra != nil && bytes.Equal(ra.RawIssuer, ca.RawSubject) {
+			return true
+		}
+	}
+	return false
+}
+
+// Issuer returns the CA certificate, or the first certificate if none was
+// recognized, for the IssuerAndSubject of GetCertInitial requests.
+func (r *CACertRoles) Issuer() *x509.Certificate {
+	if r.CA != nil || len(r.Certs) == 0 {
+		return r.CA
+	}
+	return r.Certs[0]
+}
+
+// Recipients returns the certificates to encrypt the pkiEnvelope of
+// requests to: the RA encryption certificate with an RA and the CA
+// certificate otherwise. If neither was recognized all certificates are
+// returned.
+func (r *CACertRoles) Recipients() []*x509.Certificate {
+	switch {
+	case r.RAEncryption != nil:
+		return []*x509.Certificate{r.RAEncryption}
+	case r.CA != nil && r.RASigning == nil:
+		return []*x509.Certificate{r.CA}
+	}
+	return r.Certs
+}
+
+// Verifiers returns the certificates trusted to sign CertRep messages: the
+// RA signing certificate and the CA certificate. If neither was recognized
+// all certificates are returned.
+func (r *CACertRoles) Verifiers() []*x509.Certificate {
+	var verifiers []*x509.Certificate
+	for _, cert := range []*x509.Certificate{r.RASigning, r.CA} {
+		if cert != nil {
+			verifiers = append(verifiers, cert)
+		}
+	}
+	if len(verifiers) == 0 {
+		return r.Certs
+	}
+	return verifiers
+}
+
+// allowsKeyUsage reports whether cert may be used for any of usage.
+// Certificates without a key usage extension are unrestricted.
+func allowsKeyUsage(cert *x509.Certificate, usage x509.KeyUsage) bool {
+	return cert.KeyUsage == 0 || cert.KeyUsage&usage != 0
+}
+
+func hasExtKeyUsage(cert *x509.Certificate, oid asn1.ObjectIdentifier) bool {
+	for _, eku := range cert.UnknownExtKeyUsage {
+		if eku.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+package scep
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"testing"
+)
+
+func TestClassifyCACerts(t *testing.T) {
+	root := &x509.Certificate{
+		Subject:    pkix.Name{CommonName: "root CA"},
+		RawSubject: []byte("root"),
+		RawIssuer:  []byte("root"),
+		IsCA:       true,
+		KeyUsage:   x509.KeyUsageCertSign,
+	}
+	issuing := &x509.Certificate{
+		Subject:    pkix.Name{CommonName: "issuing CA"},
+		RawSubject: []byte("issuing"),
+		RawIssuer:  []byte("root"),
+		IsCA:       true,
+		KeyUsage:   x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	raSigning := &x509.Certificate{
+		Subject:   pkix.Name{CommonName: "Enrollment Agent"},
+		RawIssuer: []byte("issuing"),
+		KeyUsage:  x509.KeyUsageDigitalSignature,
+	}
+	raEncryption := &x509.Certificate{
+		Subject:   pkix.Name{CommonName: "CEP Encryption"},
+		RawIssuer: []byte("issuing"),
+		KeyUsage:  x509.KeyUsageKeyEncipherment,
+	}
+	ra := &x509.Certificate{
+		Subject:   pkix.Name{CommonName: "SCEP RA"},
+		RawIssuer: []byte("root"),
+	}
+	cmcRA := &x509.Certificate{
+		Subject:            pkix.Name{CommonName: "CMC RA"},
+		RawIssuer:          []byte("root"),
+		KeyUsage:           x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		UnknownExtKeyUsage: []asn1.ObjectIdentifier{oidCMCRA},
+	}
+
+	for _, test := range []struct {
+		testName     string
+		certs        []*x509.Certificate
+		ca           *x509.Certificate
+		raEncryption *x509.Certificate
+		raSigning    *x509.Certificate
+		recipients   []*x509.Certificate
+		verifiers    []*x509.Certificate
+	}{
+		{
+			"CA only",
+			[]*x509.Certificate{root},
+			root, nil, nil,
+			[]*x509.Certificate{root},
+			[]*x509.Certificate{root},
+		},
+		{
+			"NDES",
+			[]*x509.Certificate{raSigning, raEncryption, root, issuing},
+			issuing, raEncryption, raSigning,
+			[]*x509.Certificate{raEncryption},
+			[]*x509.Certificate{raSigning, issuing},
+		},
+		{
+			"single RA without key usage",
+			[]*x509.Certificate{ra, issuing, root},
+			root, ra, ra,
+			[]*x509.Certificate{ra},
+			[]*x509.Certificate{ra, root},
+		},
+		{
+			"id-kp-cmcRA preferred",
+			[]*x509.Certificate{ra, cmcRA, root},
+			root, cmcRA, cmcRA,
+			[]*x509.Certificate{cmcRA},
+			[]*x509.Certificate{cmcRA, root},
+		},
+		{
+			"unrecognized",
+			[]*x509.Certificate{raSigning},
+			nil, nil, raSigning,
+			[]*x509.Certificate{raSigning},
+			[]*x509.Certificate{raSigning},
+		},
+	} {
+		test := test
+		t.Run(test.testName, func(t *testing.T) {
+			t.Parallel()
+			roles := ClassifyCACerts(test.certs)
+			if roles.CA != test.ca {
+				t.Errorf("CA: want %v, have %v", subject(test.ca), subject(roles.CA))
+			}
+			if roles.RAEncryption != test.raEncryption {
+				t.Errorf("RA encryption: want %v, have %v", subject(test.raEncryption), subject(roles.RAEncryption))
+			}
+			if roles.RASigning != test.raSigning {
+				t.Errorf("RA signing: want %v, have %v", subject(test.raSigning), subject(roles.RASigning))
+			}
+			certsEq(t, "recipients", test.recipients, roles.Recipients())
+			certsEq(t, "verifiers", test.verifiers, roles.Verifiers())
+		})
+	}
+}
+
+func subject(cert *x509.Certificate) string {
+	if cert == nil {
+		return "<nil>"
+	}
+	return cert.Subject.CommonName
+}
+
+func certsEq(t *testing.T, name string, want, have []*x509.Certificate) {
+	t.Helper()
+	if len(want) != len(have) {
+		t.Errorf("%s: want %d certs, have %d", name, len(want), len(have))
+		return
+	}
+	for i := range want {
+		if want[i] != have[i] {
+			t.Errorf("%s: want %s, have %s", name, subject(want[i]), subject(have[i]))
+		}
+	}
+}
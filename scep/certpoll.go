@@ -0,0 +1,82 @@
+package scep
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+
+	"github.com/pkg/errors"
+)
+
+// IssuerAndSubject identifies a pending certificate request by the DER
+// encoded name of the issuing CA and the subject of the requested
+// certificate. It is the pkiEnvelope content of CertPoll requests.
+type IssuerAndSubject struct {
+	Issuer  asn1.RawValue
+	Subject asn1.RawValue
+}
+
+// NewIssuerAndSubject returns the IssuerAndSubject for polling the request
+// of csr sent to ca.
+func NewIssuerAndSubject(ca *x509.Certificate, csr *x509.CertificateRequest) IssuerAndSubject {
+	return IssuerAndSubject{
+		Issuer:  asn1.RawValue{FullBytes: ca.RawSubject},
+		Subject: asn1.RawValue{FullBytes: csr.RawSubject},
+	}
+}
+
+func parseIssuerAndSubject(data []byte) (IssuerAndSubject, error) {
+	var ias IssuerAndSubject
+	rest, err := asn1.Unmarshal(data, &ias)
+	if err != nil {
+		return ias, errors.Wrap(err, "scep: parse IssuerAndSubject in pkiEnvelope")
+	}
+	if len(rest) > 0 {
+		return ias, errors.New("scep: trailing data after IssuerAndSubject")
+	}
+	return ias, nil
+}
+
+// CertPollMessage is a CertPoll request checking on a PENDING enrolment.
+// The content of this message is protected by the recipient public key.
+type CertPollMessage struct {
+	IssuerAndSubject
+}
+
+// NewCertPollRequest creates a scep PKI CertPoll message for the pending
+// request identified by ias. The Recipients, SignerCert and SignerKey of
+// tmpl are used to encrypt and sign the request.
+//
+// The transactionID must be the one of the original request. If
+// tmpl.TransactionID is empty it is derived from the SignerCert public key,
+// as NewCSRRequest does for the CSR key.
+func NewCertPollRequest(ias IssuerAndSubject, tmpl *PKIMessage, opts ...Option) (*PKIMessage, error) {
+	conf := &config{logger: nopLogger{}, certsSelector: NopCertsSelector()}
+	for _, opt := range opts {
+		opt(conf)
+	}
+
+	content, err := asn1.Marshal(ias)
+	if err != nil {
+		return nil, err
+	}
+
+	tID := tmpl.TransactionID
+	if tID == "" {
+		tID, err = newTransactionID(tmpl.SignerCert.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	debug(conf.logger,
+		"msg", "creating SCEP CertPoll request",
+		"transaction_id", tID,
+	)
+
+	newMsg, err := newRequest(content, tID, CertPoll, tmpl, conf)
+	if err != nil {
+		return nil, err
+	}
+	newMsg.CertPollMessage = &CertPollMessage{IssuerAndSubject: ias}
+	return newMsg, nil
+}
@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"crypto"
 	"crypto/x509"
+	"regexp"
+
+	"github.com/micromdm/scep/v2/cryptoutil"
 )
 
 // A CertsSelector filters certificates.
@@ -29,10 +32,74 @@ func NopCertsSelector() CertsSelectorFunc {
 // certificates eligible for key encipherment. This certsSelector can be used
 // to filter PKCSReq recipients.
 func EnciphermentCertsSelector() CertsSelectorFunc {
+	return KeyUsageCertsSelector(x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment)
+}
+
+// RecipientCertsSelector returns a CertsSelectorFunc that selects the
+// recipients of requests among GetCACert certificates, see
+// CACertRoles.Recipients.
+func RecipientCertsSelector() CertsSelectorFunc {
+	return func(certs []*x509.Certificate) []*x509.Certificate {
+		return ClassifyCACerts(certs).Recipients()
+	}
+}
+
+// SignatureCertsSelector returns a CertsSelectorFunc that selects
+// certificates eligible for digital signatures. This certsSelector can be
+// used to find the CA/RA certificates verifying CertRep messages.
+func SignatureCertsSelector() CertsSelectorFunc {
+	return KeyUsageCertsSelector(x509.KeyUsageDigitalSignature)
+}
+
+// KeyUsageCertsSelector selects the certificates with any of the key usages
+// of usage.
+func KeyUsageCertsSelector(usage x509.KeyUsage) CertsSelectorFunc {
 	return func(certs []*x509.Certificate) (selected []*x509.Certificate) {
-		enciphermentKeyUsages := x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment
 		for _, cert := range certs {
-			if cert.KeyUsage&enciphermentKeyUsages != 0 {
+			if cert.KeyUsage&usage != 0 {
+				selected = append(selected, cert)
+			}
+		}
+		return selected
+	}
+}
+
+// SubjectCertsSelector selects the certificates whose subject, formatted
+// with pkix.Name.String, e.g. "CN=SCEP RA,O=Example", matches re.
+func SubjectCertsSelector(re *regexp.Regexp) CertsSelectorFunc {
+	return func(certs []*x509.Certificate) (selected []*x509.Certificate) {
+		for _, cert := range certs {
+			if re.MatchString(cert.Subject.String()) {
+				selected = append(selected, cert)
+			}
+		}
+		return selected
+	}
+}
+
+// AllCertsSelector selects the certificates selected by all selectors, by
+// applying them in order. Without selectors all certificates are selected.
+func AllCertsSelector(selectors ...CertsSelector) CertsSelectorFunc {
+	return func(certs []*x509.Certificate) []*x509.Certificate {
+		for _, selector := range selectors {
+			certs = selector.SelectCerts(certs)
+		}
+		return certs
+	}
+}
+
+// AnyCertsSelector selects the certificates selected by any of selectors,
+// in their original order.
+func AnyCertsSelector(selectors ...CertsSelector) CertsSelectorFunc {
+	return func(certs []*x509.Certificate) (selected []*x509.Certificate) {
+		chosen := make(map[*x509.Certificate]bool)
+		for _, selector := range selectors {
+			for _, cert := range selector.SelectCerts(certs) {
+				chosen[cert] = true
+			}
+		}
+		for _, cert := range certs {
+			if chosen[cert] {
 				selected = append(selected, cert)
 			}
 		}
@@ -55,3 +122,22 @@ func FingerprintCertsSelector(hashType crypto.Hash, hash []byte) CertsSelectorFu
 		return
 	}
 }
+
+// SubjectKeyIDCertsSelector selects the certificates whose Subject Key
+// Identifier matches ski. Certificates without a SubjectKeyId extension are
+// matched against the identifier computed from their public key, the same
+// way transaction IDs are derived.
+func SubjectKeyIDCertsSelector(ski []byte) CertsSelectorFunc {
+	return func(certs []*x509.Certificate) (selected []*x509.Certificate) {
+		for _, cert := range certs {
+			id, err := cryptoutil.SubjectKeyID(cert)
+			if err != nil {
+				continue
+			}
+			if bytes.Equal(ski, id) {
+				selected = append(selected, cert)
+			}
+		}
+		return
+	}
+}
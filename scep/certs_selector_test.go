@@ -2,10 +2,18 @@ package scep
 
 import (
 	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
 	_ "crypto/sha256"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/hex"
+	"math/big"
+	"regexp"
 	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/cryptoutil"
 )
 
 func TestFingerprintCertsSelector(t *testing.T) {
@@ -154,3 +162,107 @@ func certsKeyUsagesEq(a []*x509.Certificate, b []*x509.Certificate) bool {
 	}
 	return true
 }
+
+func TestSubjectKeyIDCertsSelector(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noSKI := newTestCert(t, key, nil)
+	if len(noSKI.SubjectKeyId) != 0 {
+		t.Fatal("expected certificate without SubjectKeyId extension")
+	}
+	withSKI := newTestCert(t, key, []byte{1, 2, 3, 4})
+	computed, err := cryptoutil.GenerateSubjectKeyID(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs := []*x509.Certificate{noSKI, withSKI}
+	for _, test := range []struct {
+		testName string
+		ski      []byte
+		expected *x509.Certificate
+	}{
+		{"computed SKI of cert without extension", computed, noSKI},
+		{"SKI from extension", []byte{1, 2, 3, 4}, withSKI},
+	} {
+		test := test
+		t.Run(test.testName, func(t *testing.T) {
+			t.Parallel()
+			selected := SubjectKeyIDCertsSelector(test.ski).SelectCerts(certs)
+			if len(selected) != 1 {
+				t.Fatalf("wrong selected certs count, want: 1 have: %d", len(selected))
+			}
+			if selected[0] != test.expected {
+				t.Error("selected the wrong certificate")
+			}
+		})
+	}
+}
+
+func newTestCert(t *testing.T, key *rsa.PrivateKey, ski []byte) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "scep test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		SubjectKeyId: ski,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestCertsSelectorCombinators(t *testing.T) {
+	ra := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "SCEP RA"},
+		KeyUsage: x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+	}
+	raEncipherment := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "SCEP RA encryption"},
+		KeyUsage: x509.KeyUsageKeyEncipherment,
+	}
+	ca := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "SCEP CA"},
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	certs := []*x509.Certificate{ra, raEncipherment, ca}
+
+	for _, test := range []struct {
+		testName string
+		selector CertsSelector
+		expected []*x509.Certificate
+	}{
+		{"signature", SignatureCertsSelector(), []*x509.Certificate{ra, ca}},
+		{"key usage", KeyUsageCertsSelector(x509.KeyUsageCertSign), []*x509.Certificate{ca}},
+		{"subject", SubjectCertsSelector(regexp.MustCompile(`^CN=SCEP RA`)), []*x509.Certificate{ra, raEncipherment}},
+		{"all", AllCertsSelector(EnciphermentCertsSelector(), SignatureCertsSelector()), []*x509.Certificate{ra}},
+		{"all without selectors", AllCertsSelector(), certs},
+		{"any", AnyCertsSelector(
+			KeyUsageCertsSelector(x509.KeyUsageCertSign),
+			SubjectCertsSelector(regexp.MustCompile(`encryption$`)),
+		), []*x509.Certificate{raEncipherment, ca}},
+		{"any without selectors", AnyCertsSelector(), nil},
+	} {
+		test := test
+		t.Run(test.testName, func(t *testing.T) {
+			t.Parallel()
+			selected := test.selector.SelectCerts(certs)
+			if len(selected) != len(test.expected) {
+				t.Fatalf("wrong selected certs count, want: %d have: %d", len(test.expected), len(selected))
+			}
+			for i := range selected {
+				if selected[i] != test.expected[i] {
+					t.Errorf("selected %s instead of %s", selected[i].Subject, test.expected[i].Subject)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package scep
+
+import (
+	"crypto"
+	"encoding/asn1"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ComplianceRule identifies a requirement of RFC 8894 checked with
+// WithRFC8894Strict.
+type ComplianceRule string
+
+// Requirements checked with WithRFC8894Strict.
+const (
+	// RuleDigestAlgorithm requires SHA-256 or stronger signature digests.
+	RuleDigestAlgorithm ComplianceRule = "digest-algorithm"
+	// RuleContentEncryption requires AES content encryption of the
+	// pkiEnvelope.
+	RuleContentEncryption ComplianceRule = "content-encryption"
+	// RuleSenderNonce requires a 16 byte senderNonce in every message.
+	RuleSenderNonce ComplianceRule = "sender-nonce"
+	// RuleRecipientNonce requires a 16 byte recipientNonce in CertRep
+	// messages.
+	RuleRecipientNonce ComplianceRule = "recipient-nonce"
+	// RuleTransactionID requires a PrintableString transactionID.
+	RuleTransactionID ComplianceRule = "transaction-id"
+	// RuleMessageType rejects the UpdateReq messageType of the SCEP
+	// drafts, which RFC 8894 replaced with RenewalReq.
+	RuleMessageType ComplianceRule = "message-type"
+)
+
+// Violation describes a deviation of a message from RFC 8894.
+type Violation struct {
+	Rule   ComplianceRule
+	Detail string
+}
+
+func (v Violation) String() string {
+	return string(v.Rule) + ": " + v.Detail
+}
+
+// ComplianceError is returned with WithRFC8894Strict for messages
+// violating RFC 8894. It lists every violation found.
+type ComplianceError struct {
+	Violations []Violation
+}
+
+func (e *ComplianceError) Error() string {
+	details := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		details[i] = v.String()
+	}
+	return "scep: RFC 8894 violations: " + strings.Join(details, "; ")
+}
+
+// WithRFC8894Strict rejects messages violating RFC 8894 with a
+// *ComplianceError: parsed messages must be signed with SHA-256 or
+// stronger, have PrintableString transactionIDs and 16 byte nonces and
+// must not be UpdateReq messages, and their pkiEnvelope must be encrypted
+// with AES. Created messages default to SHA-256 and AES-128-CBC, weaker
+// configured algorithms are rejected.
+func WithRFC8894Strict() Option {
+	return func(c *config) {
+		c.rfc8894Strict = true
+	}
+}
+
+func complianceError(violations []Violation) error {
+	if len(violations) == 0 {
+		return nil
+	}
+	return &ComplianceError{Violations: violations}
+}
+
+// checkRFC8894 returns a *ComplianceError if the parsed msg violates
+// RFC 8894.
+func (msg *PKIMessage) checkRFC8894() error {
+	var violations []Violation
+	for _, signer := range msg.p7.Signers {
+		if h, ok := digestHash(signer.DigestAlgorithm.Algorithm); !ok || h.Size() < crypto.SHA256.Size() {
+			violations = append(violations, Violation{RuleDigestAlgorithm,
+				fmt.Sprintf("signer digest algorithm %s is weaker than SHA-256", signer.DigestAlgorithm.Algorithm)})
+		}
+	}
+	var tID asn1.RawValue
+	if err := msg.p7.UnmarshalSignedAttribute(oidSCEPtransactionID, &tID); err != nil || tID.Tag != asn1.TagPrintableString {
+		violations = append(violations, Violation{RuleTransactionID, "transactionID is not a PrintableString"})
+	}
+	if v, ok := msg.checkNonce(oidSCEPsenderNonce, RuleSenderNonce, "senderNonce"); !ok {
+		violations = append(violations, v)
+	}
+	if msg.MessageType == CertRep {
+		if v, ok := msg.checkNonce(oidSCEPrecipientNonce, RuleRecipientNonce, "recipientNonce"); !ok {
+			violations = append(violations, v)
+		}
+	}
+	if msg.MessageType == UpdateReq {
+		violations = append(violations, Violation{RuleMessageType, "UpdateReq is not defined, use RenewalReq"})
+	}
+	return complianceError(violations)
+}
+
+func (msg *PKIMessage) checkNonce(oid asn1.ObjectIdentifier, rule ComplianceRule, name string) (Violation, bool) {
+	var nonce []byte
+	if err := msg.p7.UnmarshalSignedAttribute(oid, &nonce); err != nil {
+		return Violation{rule, name + " is missing"}, false
+	}
+	if len(nonce) != 16 {
+		return Violation{rule, fmt.Sprintf("%s has %d bytes instead of 16", name, len(nonce))}, false
+	}
+	return Violation{}, true
+}
+
+// checkEnvelopeRFC8894 returns a *ComplianceError if the pkiEnvelope data
+// is not encrypted with AES.
+func checkEnvelopeRFC8894(data []byte) error {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(data, &ci); err != nil {
+		return errors.Wrap(err, "scep: parse pkiEnvelope")
+	}
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		return errors.Wrap(err, "scep: parse pkiEnvelope EnvelopedData")
+	}
+	alg := ed.EncryptedContentInfo.ContentEncryptionAlgorithm.Algorithm
+	if !isAES(alg) {
+		return complianceError([]Violation{{RuleContentEncryption,
+			fmt.Sprintf("pkiEnvelope content encryption algorithm %s is not AES", alg)}})
+	}
+	return nil
+}
+
+// oidAESArc is the arc of the NIST AES algorithms.
+var oidAESArc = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1}
+
+// isAES reports whether the content encryption algorithm alg is AES.
+func isAES(alg asn1.ObjectIdentifier) bool {
+	return len(alg) == len(oidAESArc)+1 && alg[:len(oidAESArc)].Equal(oidAESArc)
+}
+
+// digest returns the digest algorithm of created messages: the configured
+// one, or SHA-256 with WithRFC8894Strict or in FIPS mode and SHA-1
+// otherwise.
+func (conf *config) digest() (crypto.Hash, error) {
+	switch h := conf.digestAlgorithm; {
+	case h == 0 && (conf.rfc8894Strict || conf.fipsMode()):
+		return crypto.SHA256, nil
+	case h == 0:
+		return crypto.SHA1, nil
+	case h == crypto.SHA256 || h == crypto.SHA384 || h == crypto.SHA512:
+		return h, nil
+	case conf.rfc8894Strict:
+		return 0, complianceError([]Violation{{RuleDigestAlgorithm,
+			fmt.Sprintf("digest algorithm %s is weaker than SHA-256", h)}})
+	case conf.fipsMode():
+		return 0, fipsError("digest algorithm %s", h)
+	default:
+		return h, nil
+	}
+}
+
+// contentEncryption returns the pkcs7 content encryption algorithm of
+// created messages: the configured one, or AES-128-CBC with
+// WithRFC8894Strict or in FIPS mode and the pkcs7 package default
+// otherwise.
+func (conf *config) contentEncryption() (int, error) {
+	if !conf.rfc8894Strict && !conf.fipsMode() {
+		return conf.encryptionAlgorithm.pkcs7()
+	}
+	switch alg := conf.encryptionAlgorithm; alg {
+	case 0:
+		return AES128CBC.pkcs7()
+	case AES128CBC, AES256CBC, AES128GCM, AES256GCM:
+		return alg.pkcs7()
+	default:
+		if !conf.rfc8894Strict {
+			return 0, fipsError("content encryption algorithm %s", alg)
+		}
+		return 0, complianceError([]Violation{{RuleContentEncryption,
+			fmt.Sprintf("content encryption algorithm %s is not AES", alg)}})
+	}
+}
@@ -0,0 +1,100 @@
+package scep
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+
+	"github.com/micromdm/scep/v2/tracing"
+)
+
+// context returns the context set with WithContext or
+// context.Background.
+func (conf *config) context() context.Context {
+	if conf.ctx == nil {
+		return context.Background()
+	}
+	return conf.ctx
+}
+
+// startSpan starts the span name with the configured Tracer and makes its
+// context the context of conf, so spans started later are its children.
+func (conf *config) startSpan(name string, attrs ...tracing.Attribute) tracing.Span {
+	ctx, span := startSpan(conf.context(), conf.tracer, name, attrs...)
+	conf.ctx = ctx
+	return span
+}
+
+func startSpan(ctx context.Context, t tracing.Tracer, name string, attrs ...tracing.Attribute) (context.Context, tracing.Span) {
+	if t == nil {
+		t = tracing.Nop()
+	}
+	return t.Start(ctx, name, attrs...)
+}
+
+// spanAttributes returns the span attributes identifying msg.
+func (msg *PKIMessage) spanAttributes() []tracing.Attribute {
+	return []tracing.Attribute{
+		tracing.String(tracing.TransactionIDKey, string(msg.TransactionID)),
+		tracing.String(tracing.MessageTypeKey, msg.MessageType.String()),
+	}
+}
+
+// ParsePKIMessageContext is like ParsePKIMessage with WithContext(ctx).
+func ParsePKIMessageContext(ctx context.Context, data []byte, opts ...Option) (*PKIMessage, error) {
+	return ParsePKIMessage(data, append([]Option{WithContext(ctx)}, opts...)...)
+}
+
+// DecryptPKIEnvelopeContext is like DecryptPKIEnvelope but returns the
+// error of ctx if it is done before decrypting. The decryption is traced
+// as a child of the span in ctx with the Tracer the message was parsed
+// with.
+func (msg *PKIMessage) DecryptPKIEnvelopeContext(ctx context.Context, cert *x509.Certificate, key crypto.PrivateKey) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, span := startSpan(ctx, msg.tracer, "scep.DecryptPKIEnvelope", msg.spanAttributes()...)
+	defer span.End()
+	if err := msg.decryptPKIEnvelope(cert, key); err != nil {
+		span.RecordError(err)
+		return err
+	}
+	return nil
+}
+
+// OpenEnvelopeContext is like OpenEnvelope but returns the error of ctx if
+// it is done before decrypting. The decryption is traced like
+// DecryptPKIEnvelopeContext.
+func (msg *PKIMessage) OpenEnvelopeContext(ctx context.Context, cert *x509.Certificate, key crypto.PrivateKey) (*Envelope, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	_, span := startSpan(ctx, msg.tracer, "scep.DecryptPKIEnvelope", msg.spanAttributes()...)
+	defer span.End()
+	env, err := msg.openEnvelope(cert, key)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	return env, nil
+}
+
+// SuccessContext is like Success with WithContext(ctx).
+func (msg *PKIMessage) SuccessContext(ctx context.Context, crtAuth *x509.Certificate, keyAuth crypto.Signer, crt *x509.Certificate, opts ...Option) (*PKIMessage, error) {
+	return msg.Success(crtAuth, keyAuth, crt, append([]Option{WithContext(ctx)}, opts...)...)
+}
+
+// FailContext is like Fail with WithContext(ctx).
+func (msg *PKIMessage) FailContext(ctx context.Context, crtAuth *x509.Certificate, keyAuth crypto.Signer, info FailInfo, opts ...Option) (*PKIMessage, error) {
+	return msg.Fail(crtAuth, keyAuth, info, append([]Option{WithContext(ctx)}, opts...)...)
+}
+
+// FailWithContext is like FailWith with WithContext(ctx).
+func (msg *PKIMessage) FailWithContext(ctx context.Context, crtAuth *x509.Certificate, keyAuth crypto.Signer, fo FailureOptions, opts ...Option) (*PKIMessage, error) {
+	return msg.FailWith(crtAuth, keyAuth, fo, append([]Option{WithContext(ctx)}, opts...)...)
+}
+
+// NewCSRRequestContext is like NewCSRRequest with WithContext(ctx).
+func NewCSRRequestContext(ctx context.Context, csr *x509.CertificateRequest, tmpl *PKIMessage, opts ...Option) (*PKIMessage, error) {
+	return NewCSRRequest(csr, tmpl, append([]Option{WithContext(ctx)}, opts...)...)
+}
@@ -0,0 +1,110 @@
+package scep
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+)
+
+// GetCRLMessage is a GetCRL request for the CRL covering the certificate
+// identified by IssuerAndSerial.
+// The content of this message is protected by the recipient public key.
+type GetCRLMessage struct {
+	IssuerAndSerial
+}
+
+// CRLRepMessage is the content of a CertRep answering a GetCRL request.
+type CRLRepMessage struct {
+	CRL *pkix.CertificateList
+
+	degenerate []byte
+}
+
+// NewGetCRLRequest creates a scep PKI GetCRL message asking for the CRL
+// covering the certificate identified by ias. The Recipients, SignerCert
+// and SignerKey of tmpl are used to encrypt and sign the request.
+func NewGetCRLRequest(ias IssuerAndSerial, tmpl *PKIMessage, opts ...Option) (*PKIMessage, error) {
+	conf := &config{logger: nopLogger{}, certsSelector: NopCertsSelector()}
+	for _, opt := range opts {
+		opt(conf)
+	}
+
+	content, err := asn1.Marshal(ias)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := newNonce(DefaultNonceSize)
+	if err != nil {
+		return nil, err
+	}
+	tID := TransactionID(base64.StdEncoding.EncodeToString(id))
+
+	debug(conf.logger,
+		"msg", "creating SCEP GetCRL request",
+		"transaction_id", tID,
+		"serial", ias.SerialNumber,
+	)
+
+	newMsg, err := newRequest(content, tID, GetCRL, tmpl, conf)
+	if err != nil {
+		return nil, err
+	}
+	newMsg.GetCRLMessage = &GetCRLMessage{IssuerAndSerial: ias}
+	return newMsg, nil
+}
+
+// SuccessCRL returns a new PKIMessage with CertRep data carrying the DER
+// encoded crl, answering a GetCRL request.
+func (msg *PKIMessage) SuccessCRL(crtAuth *x509.Certificate, keyAuth crypto.Signer, crl []byte, opts ...Option) (*PKIMessage, error) {
+	conf := &config{}
+	for _, opt := range opts {
+		opt(conf)
+	}
+	conf.replyTo(msg)
+	span := conf.startSpan("scep.SuccessCRL", msg.spanAttributes()...)
+	defer span.End()
+
+	parsed, err := x509.ParseCRL(crl)
+	if err != nil {
+		return nil, err
+	}
+
+	deg, err := DegenerateCRL(crl)
+	if err != nil {
+		return nil, err
+	}
+
+	certRepBytes, err := msg.successCertRep(crtAuth, keyAuth, deg, nil, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	cr := &CertRepMessage{
+		PKIStatus:      SUCCESS,
+		RecipientNonce: RecipientNonce(msg.SenderNonce),
+	}
+
+	// create a CertRep message from the original
+	crepMsg := &PKIMessage{
+		Raw:            certRepBytes,
+		TransactionID:  msg.TransactionID,
+		MessageType:    CertRep,
+		CertRepMessage: cr,
+		CRLRepMessage:  &CRLRepMessage{CRL: parsed, degenerate: deg},
+	}
+
+	return crepMsg, nil
+}
+
+// DegenerateCRL creates a degenerate PKCS#7 SignedData carrying the DER
+// encoded crl, as sent in the pkiEnvelope of a GetCRL response.
+func DegenerateCRL(crl []byte) ([]byte, error) {
+	d, err := NewDegenerateP7(nil, crl)
+	if err != nil {
+		return nil, err
+	}
+	return d.Raw, nil
+}
@@ -0,0 +1,124 @@
+package scep
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// ErrChainOrder is returned by DegenerateP7.CheckLeafFirst if a certificate
+// precedes a certificate it issued.
+var ErrChainOrder = errors.New("scep: certificates are not ordered leaf first")
+
+// DegenerateP7 is a degenerate PKCS#7 SignedData: a SignedData without
+// signers transporting certificates, e.g. the CA certificates of a
+// GetCACert response or the issued certificate of a CertRep, and CRLs.
+type DegenerateP7 struct {
+	// Certificates without duplicates, in the order they were encoded.
+	Certificates []*x509.Certificate
+	CRLs         []pkix.CertificateList
+
+	// Raw is the encoding of the SignedData.
+	Raw []byte
+}
+
+// NewDegenerateP7 creates a DegenerateP7 of certs, in their order with
+// duplicates dropped, and the DER encoded crls.
+func NewDegenerateP7(certs []*x509.Certificate, crls ...[]byte) (*DegenerateP7, error) {
+	d := &DegenerateP7{Certificates: dedupCerts(certs)}
+	var certsLen, crlsLen int
+	for _, cert := range d.Certificates {
+		certsLen += len(cert.Raw)
+	}
+	for _, crl := range crls {
+		parsed, err := x509.ParseCRL(crl)
+		if err != nil {
+			return nil, err
+		}
+		d.CRLs = append(d.CRLs, *parsed)
+		crlsLen += len(crl)
+	}
+
+	// version, empty digestAlgorithms and an empty data contentInfo
+	innerLen := len(derVersion1) + 2 + derLen(len(derOIDData)) + 2
+	if certsLen > 0 {
+		innerLen += derLen(certsLen)
+	}
+	if crlsLen > 0 {
+		innerLen += derLen(crlsLen)
+	}
+	b := make([]byte, 0, contentInfoLen(derOIDSignedData, derLen(innerLen)))
+	b = appendContentInfo(b, derOIDSignedData, derLen(innerLen))
+	b = appendDERHeader(b, derTagSequence, innerLen)
+	b = append(b, derVersion1...)
+	b = appendDERHeader(b, derTagSet, 0)
+	b = appendDER(b, derTagSequence, derOIDData)
+	if certsLen > 0 {
+		// certificates [0] IMPLICIT ExtendedCertificatesAndCertificates
+		b = appendDERHeader(b, derTagContext0, certsLen)
+		for _, cert := range d.Certificates {
+			b = append(b, cert.Raw...)
+		}
+	}
+	if crlsLen > 0 {
+		// crls [1] IMPLICIT CertificateRevocationLists
+		b = appendDERHeader(b, derTagContext1, crlsLen)
+		for _, crl := range crls {
+			b = append(b, crl...)
+		}
+	}
+	// no signerInfos
+	d.Raw = appendDERHeader(b, derTagSet, 0)
+	return d, nil
+}
+
+// ParseDegenerateP7 parses the certificates and CRLs of a degenerate PKCS#7
+// SignedData. BER encoded data is accepted. Duplicate certificates are
+// dropped, the order of the others is kept.
+func ParseDegenerateP7(data []byte) (*DegenerateP7, error) {
+	p7, err := parsePKCS7(data)
+	if err != nil {
+		return nil, err
+	}
+	return &DegenerateP7{
+		Certificates: dedupCerts(p7.Certificates),
+		CRLs:         p7.CRLs,
+		Raw:          data,
+	}, nil
+}
+
+// CheckLeafFirst returns ErrChainOrder if a certificate precedes one it
+// issued. Certificates must follow those they issued in the chain of a
+// CertRep, while the CA and RA certificates of a GetCACert response are
+// commonly sent CA first.
+func (d *DegenerateP7) CheckLeafFirst() error {
+	for i, cert := range d.Certificates {
+		if isSelfSigned(cert) {
+			continue
+		}
+		for _, prev := range d.Certificates[:i] {
+			if issuedBy(cert, []*x509.Certificate{prev}) {
+				return fmt.Errorf("%w: %s precedes %s it issued", ErrChainOrder, prev.Subject, cert.Subject)
+			}
+		}
+	}
+	return nil
+}
+
+// dedupCerts returns certs without repeated certificates.
+func dedupCerts(certs []*x509.Certificate) []*x509.Certificate {
+	out := make([]*x509.Certificate, 0, len(certs))
+outer:
+	for _, cert := range certs {
+		for _, seen := range out {
+			if bytes.Equal(cert.Raw, seen.Raw) {
+				continue outer
+			}
+		}
+		out = append(out, cert)
+	}
+	return out
+}
@@ -0,0 +1,102 @@
+package scep
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestDegenerateP7(t *testing.T) {
+	root, rootKey := newDegenerateTestCert(t, "root CA", nil, nil, true)
+	issuing, issuingKey := newDegenerateTestCert(t, "issuing CA", root, rootKey, true)
+	leaf, _ := newDegenerateTestCert(t, "leaf", issuing, issuingKey, false)
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+	}, issuing, issuingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewDegenerateP7([]*x509.Certificate{leaf, issuing, leaf, root, issuing}, crl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*x509.Certificate{leaf, issuing, root}
+	parsed, err := ParseDegenerateP7(d.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, have := range [][]*x509.Certificate{d.Certificates, parsed.Certificates} {
+		if len(have) != len(want) {
+			t.Fatalf("have %d certificates, want %d", len(have), len(want))
+		}
+		for i := range want {
+			if !have[i].Equal(want[i]) {
+				t.Errorf("certificate %d is %s, want %s", i, have[i].Subject, want[i].Subject)
+			}
+		}
+	}
+	if len(parsed.CRLs) != 1 {
+		t.Fatalf("have %d CRLs, want 1", len(parsed.CRLs))
+	}
+	if err := parsed.CheckLeafFirst(); err != nil {
+		t.Error(err)
+	}
+
+	// CA first, as in GetCACert responses
+	d, err = NewDegenerateP7([]*x509.Certificate{issuing, leaf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CheckLeafFirst(); !errors.Is(err, ErrChainOrder) {
+		t.Errorf("have %v, want ErrChainOrder", err)
+	}
+	certs, err := CACerts(d.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || !certs[0].Equal(issuing) || !certs[1].Equal(leaf) {
+		t.Error("CACerts did not keep the order of the certificates")
+	}
+}
+
+// newDegenerateTestCert returns a certificate issued by parent, or a
+// self-signed one if parent is nil, and its key.
+func newDegenerateTestCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
@@ -0,0 +1,186 @@
+package scep
+
+import (
+	"encoding/asn1"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// The messages are built with these helpers where asn1.Marshal would copy
+// the encrypted content and the certificates once per level of nesting.
+// The encoding is the same DER.
+
+// DER identifier octets of the universal and context-specific types used.
+const (
+	derTagInteger           = 0x02
+	derTagOctetString       = 0x04
+	derTagOID               = 0x06
+	derTagPrintableString   = 0x13
+	derTagSequence          = 0x30
+	derTagSet               = 0x31
+	derTagContext0          = 0xa0 // [0] constructed
+	derTagContext0Primitive = 0x80 // [0] primitive
+	derTagContext1          = 0xa1 // [1] constructed
+)
+
+var (
+	derOIDData          = mustMarshal(pkcs7.OIDData)
+	derOIDSignedData    = mustMarshal(pkcs7.OIDSignedData)
+	derOIDEnvelopedData = mustMarshal(pkcs7.OIDEnvelopedData)
+	derVersion1         = []byte{derTagInteger, 1, 1}
+)
+
+func mustMarshal(v interface{}) []byte {
+	der, err := asn1.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return der
+}
+
+// derLen returns the length of a DER TLV with n content octets.
+func derLen(n int) int {
+	l := 2 + n
+	if n >= 0x80 {
+		for ; n > 0; n >>= 8 {
+			l++
+		}
+	}
+	return l
+}
+
+// appendDERHeader appends the identifier and length octets of a TLV with
+// n content octets to b.
+func appendDERHeader(b []byte, tag byte, n int) []byte {
+	b = append(b, tag)
+	if n < 0x80 {
+		return append(b, byte(n))
+	}
+	var size int
+	for m := n; m > 0; m >>= 8 {
+		size++
+	}
+	b = append(b, 0x80|byte(size))
+	for i := size - 1; i >= 0; i-- {
+		b = append(b, byte(n>>(8*i)))
+	}
+	return b
+}
+
+// appendDER appends the TLV of tag with the concatenated contents to b.
+func appendDER(b []byte, tag byte, contents ...[]byte) []byte {
+	var n int
+	for _, c := range contents {
+		n += len(c)
+	}
+	b = appendDERHeader(b, tag, n)
+	for _, c := range contents {
+		b = append(b, c...)
+	}
+	return b
+}
+
+// appendContentInfo appends a ContentInfo of contentType, the DER encoded
+// OID, with an explicit [0] content of n octets to b. The content itself
+// must be appended by the caller.
+func appendContentInfo(b []byte, contentType []byte, n int) []byte {
+	b = appendDERHeader(b, derTagSequence, len(contentType)+derLen(n))
+	b = append(b, contentType...)
+	return appendDERHeader(b, derTagContext0, n)
+}
+
+// contentInfoLen returns the length of a ContentInfo of contentType with n
+// content octets.
+func contentInfoLen(contentType []byte, n int) int {
+	return derLen(len(contentType) + derLen(n))
+}
+
+// appendOID appends the DER encoding of oid to b.
+func appendOID(b []byte, oid asn1.ObjectIdentifier) ([]byte, error) {
+	if len(oid) < 2 || oid[0] > 2 || (oid[0] < 2 && oid[1] >= 40) {
+		// let asn1 report the invalid identifier
+		der, err := asn1.Marshal(oid)
+		return append(b, der...), err
+	}
+	// the first two arcs are encoded as one
+	first := oid[0]*40 + oid[1]
+	n := base128Len(first)
+	for _, arc := range oid[2:] {
+		n += base128Len(arc)
+	}
+	b = appendDERHeader(b, derTagOID, n)
+	b = appendBase128(b, first)
+	for _, arc := range oid[2:] {
+		b = appendBase128(b, arc)
+	}
+	return b, nil
+}
+
+// appendBase128 appends arc in base 128 to b, the high bit set on all but
+// the last octet.
+func appendBase128(b []byte, arc int) []byte {
+	for i := base128Len(arc) - 1; i >= 0; i-- {
+		o := byte(arc>>(7*i)) & 0x7f
+		if i > 0 {
+			o |= 0x80
+		}
+		b = append(b, o)
+	}
+	return b
+}
+
+// base128Len returns the number of octets of arc in base 128.
+func base128Len(arc int) int {
+	n := 1
+	for ; arc > 0x7f; arc >>= 7 {
+		n++
+	}
+	return n
+}
+
+// marshalAttributeValue returns the DER encoding of a signed attribute
+// value. The octet and printable strings of the SCEP attributes are
+// encoded directly, other values with asn1.Marshal.
+func marshalAttributeValue(v interface{}) ([]byte, error) {
+	var s string
+	switch v := v.(type) {
+	case []byte:
+		return appendDER(nil, derTagOctetString, v), nil
+	case SenderNonce:
+		return appendDER(nil, derTagOctetString, v), nil
+	case RecipientNonce:
+		return appendDER(nil, derTagOctetString, v), nil
+	case TransactionID:
+		s = string(v)
+	case MessageType:
+		s = string(v)
+	case PKIStatus:
+		s = string(v)
+	case FailInfo:
+		s = string(v)
+	case string:
+		s = v
+	default:
+		return asn1.Marshal(v)
+	}
+	if !isPrintableString(s) {
+		return asn1.Marshal(v)
+	}
+	b := appendDERHeader(make([]byte, 0, derLen(len(s))), derTagPrintableString, len(s))
+	return append(b, s...), nil
+}
+
+// isPrintableString reports whether s only has characters of the ASN.1
+// PrintableString type, which asn1.Marshal encodes it as.
+func isPrintableString(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == ' ', c == '\'', c == '(', c == ')', c == '+', c == ',', c == '-', c == '.', c == '/', c == ':', c == '=', c == '?':
+		default:
+			return false
+		}
+	}
+	return true
+}
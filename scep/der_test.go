@@ -0,0 +1,58 @@
+package scep
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"testing"
+	"time"
+)
+
+// The DER helpers must encode like asn1.Marshal.
+
+func TestAppendOID(t *testing.T) {
+	for _, oid := range []asn1.ObjectIdentifier{
+		{1, 2},
+		{0, 39},
+		{2, 999, 3},
+		{1, 2, 840, 113549, 1, 9, 16, 1, 1000000},
+		{2, 16, 840, 1, 113733, 1, 9, 2},
+	} {
+		want, err := asn1.Marshal(oid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, err := appendOID(nil, oid)
+		if err != nil || !bytes.Equal(have, want) {
+			t.Errorf("%v: have %x, %v, want %x", oid, have, err, want)
+		}
+	}
+	if _, err := appendOID(nil, asn1.ObjectIdentifier{1, 40}); err == nil {
+		t.Error("want an error for an invalid identifier")
+	}
+}
+
+func TestMarshalAttributeValue(t *testing.T) {
+	for _, v := range []interface{}{
+		[]byte{},
+		bytes.Repeat([]byte{1}, 200),
+		SenderNonce{1, 2, 3},
+		RecipientNonce(bytes.Repeat([]byte{1}, 70000)),
+		TransactionID("Dw+/v9r7HuM="),
+		CertRep,
+		SUCCESS,
+		BadRequest,
+		"printable (string) 1:2=3?",
+		"not printable: *&",
+		"ünicode",
+		time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	} {
+		want, err := asn1.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		have, err := marshalAttributeValue(v)
+		if err != nil || !bytes.Equal(have, want) {
+			t.Errorf("%T: have %x, %v, want %x", v, have, err, want)
+		}
+	}
+}
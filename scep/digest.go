@@ -0,0 +1,101 @@
+package scep
+
+import (
+	"crypto"
+	"encoding/asn1"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/pkcs7"
+)
+
+// digestOID returns the pkcs7 digest algorithm identifier for h.
+func digestOID(h crypto.Hash) (asn1.ObjectIdentifier, error) {
+	switch h {
+	case crypto.SHA1:
+		return pkcs7.OIDDigestAlgorithmSHA1, nil
+	case crypto.SHA256:
+		return pkcs7.OIDDigestAlgorithmSHA256, nil
+	case crypto.SHA384:
+		return pkcs7.OIDDigestAlgorithmSHA384, nil
+	case crypto.SHA512:
+		return pkcs7.OIDDigestAlgorithmSHA512, nil
+	default:
+		return nil, errors.Errorf("scep: unsupported digest algorithm %s", h)
+	}
+}
+
+// digestHash returns the hash of a SignerInfo digest algorithm identifier.
+func digestHash(oid asn1.ObjectIdentifier) (crypto.Hash, bool) {
+	switch {
+	case oid.Equal(pkcs7.OIDDigestAlgorithmSHA1):
+		return crypto.SHA1, true
+	case oid.Equal(pkcs7.OIDDigestAlgorithmSHA256):
+		return crypto.SHA256, true
+	case oid.Equal(pkcs7.OIDDigestAlgorithmSHA384):
+		return crypto.SHA384, true
+	case oid.Equal(pkcs7.OIDDigestAlgorithmSHA512):
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
+// newSignedData creates the SignedData for content using the configured
+// digest algorithm, see digest.
+func (conf *config) newSignedData(content []byte) (*signedData, error) {
+	digest, err := conf.digest()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := digestOID(digest); err != nil {
+		return nil, err
+	}
+	return &signedData{ctx: conf.context(), tracer: conf.tracer, content: content, digest: digest, fips: conf.fipsMode()}, nil
+}
+
+// replyTo makes replies to msg use the Tracer of msg and the digest
+// algorithm of its signer, unless they are configured, and RFC 8894 strict
+// mode, WithRequireOAEP and WithFIPS if msg was parsed with them. The key
+// encryption algorithm is the one msg was parsed with, or RSAOAEP if the
+// pkiEnvelope of msg used it.
+func (conf *config) replyTo(msg *PKIMessage) {
+	if conf.tracer == nil {
+		conf.tracer = msg.tracer
+	}
+	if msg.rfc8894Strict {
+		conf.rfc8894Strict = true
+	}
+	if msg.requireOAEP {
+		conf.requireOAEP = true
+	}
+	if msg.fips {
+		conf.fips = true
+	}
+	if conf.keyEncryption == nil {
+		conf.keyEncryption = msg.keyEncryption
+	}
+	if conf.keyEncryption == nil && msg.p7 != nil && envelopeUsesOAEP(msg.p7.Content) {
+		conf.keyEncryption = allRecipients(RSAOAEP)
+	}
+	if conf.digestAlgorithm != 0 || msg.p7 == nil || len(msg.p7.Signers) == 0 {
+		return
+	}
+	if h, ok := digestHash(msg.p7.Signers[0].DigestAlgorithm.Algorithm); ok {
+		conf.digestAlgorithm = h
+	}
+}
+
+// checkDigestAlgorithm rejects signers of p7 using a weaker digest than the
+// configured one.
+func (conf *config) checkDigestAlgorithm(p7 *pkcs7.PKCS7) error {
+	if conf.digestAlgorithm == 0 {
+		return nil
+	}
+	for _, signer := range p7.Signers {
+		h, ok := digestHash(signer.DigestAlgorithm.Algorithm)
+		if !ok || h.Size() < conf.digestAlgorithm.Size() {
+			return errors.Errorf("scep: message digest algorithm %s is weaker than required %s",
+				signer.DigestAlgorithm.Algorithm, conf.digestAlgorithm)
+		}
+	}
+	return nil
+}
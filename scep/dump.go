@@ -0,0 +1,230 @@
+package scep
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// Dump writes a human-readable description of msg to w for debugging
+// interoperability problems: the transactionID, messageType, nonces and
+// CertRep status, and for a message parsed with ParsePKIMessage the signer
+// and the digest, signature and content encryption algorithms.
+//
+// If key is not nil the pkiEnvelope is opened with cert and key, like with
+// OpenEnvelope, and its content is described too, e.g. the subject, SANs
+// and key of the CSR. The challengePassword is not written, only its
+// presence. msg is not modified.
+func (msg *PKIMessage) Dump(w io.Writer, cert *x509.Certificate, key crypto.PrivateKey) error {
+	d := &dumper{w: w}
+	d.line("transactionID", "%s", msg.TransactionID)
+	d.line("messageType", "%s", msg.MessageType)
+	d.line("senderNonce", "%s", nonceString(msg.SenderNonce))
+	if rep := msg.CertRepMessage; rep != nil {
+		d.line("recipientNonce", "%s", nonceString(rep.RecipientNonce))
+		d.line("pkiStatus", "%s", pkiStatusName(rep.PKIStatus))
+		if rep.PKIStatus == FAILURE {
+			d.line("failInfo", "%s", rep.FailInfo)
+			if rep.FailInfoText != "" {
+				d.line("failInfoText", "%q", rep.FailInfoText)
+			}
+		}
+	}
+
+	if si, err := msg.SignerInfo(); err == nil {
+		if si.Certificate != nil {
+			d.line("signer", "%s", si.Certificate.Subject)
+			d.line("signer issuer", "%s", si.Certificate.Issuer)
+			d.line("signer serial", "%x", si.Certificate.SerialNumber)
+		}
+		d.line("digest", "%s", algorithmName(si.DigestAlgorithm))
+		d.line("signature", "%s", algorithmName(si.SignatureAlgorithm))
+		d.line("certificates", "%d", len(msg.p7.Certificates))
+	}
+	if msg.p7 != nil {
+		alg, err := msg.ContentEncryptionAlgorithm()
+		switch {
+		case err != nil:
+			d.line("encryption", "%v", err)
+		case alg != nil:
+			d.line("encryption", "%s", algorithmName(alg))
+		}
+	}
+	if d.err != nil || key == nil || msg.p7 == nil || len(msg.p7.Content) == 0 {
+		return d.err
+	}
+
+	env, err := msg.OpenEnvelope(cert, key)
+	if err != nil {
+		d.line("pkiEnvelope", "%v", err)
+		return d.err
+	}
+	switch {
+	case env.CSRReqMessage != nil:
+		d.csr(env.CSRReqMessage)
+	case env.Certificates != nil:
+		for _, crt := range env.Certificates {
+			d.certificate(crt)
+		}
+	case env.CRLRepMessage != nil:
+		crl := env.CRLRepMessage.CRL
+		d.line("crl issuer", "%s", crl.TBSCertList.Issuer)
+		d.line("crl this update", "%s", crl.TBSCertList.ThisUpdate)
+		d.line("crl next update", "%s", crl.TBSCertList.NextUpdate)
+		d.line("crl revoked", "%d", len(crl.TBSCertList.RevokedCertificates))
+	case env.GetCertMessage != nil:
+		d.line("issuer", "%s", rawNameString(env.GetCertMessage.Issuer))
+		d.line("serial", "%x", env.GetCertMessage.SerialNumber)
+	case env.GetCRLMessage != nil:
+		d.line("issuer", "%s", rawNameString(env.GetCRLMessage.Issuer))
+		d.line("serial", "%x", env.GetCRLMessage.SerialNumber)
+	case env.CertPollMessage != nil:
+		d.line("issuer", "%s", rawNameString(env.CertPollMessage.Issuer))
+		d.line("subject", "%s", rawNameString(env.CertPollMessage.Subject))
+	}
+	return d.err
+}
+
+// dumper writes the lines of Dump, keeping the first write error.
+type dumper struct {
+	w   io.Writer
+	err error
+}
+
+func (d *dumper) line(name, format string, args ...interface{}) {
+	if d.err != nil {
+		return
+	}
+	_, d.err = fmt.Fprintf(d.w, "%-17s "+format+"\n", append([]interface{}{name + ":"}, args...)...)
+}
+
+func (d *dumper) csr(m *CSRReqMessage) {
+	csr := m.CSR
+	d.line("csr subject", "%s", csr.Subject)
+	d.line("csr key", "%s", publicKeyName(csr.PublicKey))
+	d.line("csr signature", "%s", csr.SignatureAlgorithm)
+	d.sans("csr", csr.DNSNames, csr.EmailAddresses, csr.IPAddresses, csr.URIs)
+	if m.ChallengePassword != "" {
+		d.line("csr challenge", "present")
+	} else {
+		d.line("csr challenge", "absent")
+	}
+}
+
+func (d *dumper) certificate(crt *x509.Certificate) {
+	d.line("cert subject", "%s", crt.Subject)
+	d.line("cert issuer", "%s", crt.Issuer)
+	d.line("cert serial", "%x", crt.SerialNumber)
+	d.line("cert validity", "%s to %s", crt.NotBefore, crt.NotAfter)
+	d.line("cert key", "%s", publicKeyName(crt.PublicKey))
+	d.sans("cert", crt.DNSNames, crt.EmailAddresses, crt.IPAddresses, crt.URIs)
+}
+
+func (d *dumper) sans(prefix string, dns, email []string, ips []net.IP, uris []*url.URL) {
+	if len(dns) > 0 {
+		d.line(prefix+" dns", "%s", strings.Join(dns, ", "))
+	}
+	if len(email) > 0 {
+		d.line(prefix+" email", "%s", strings.Join(email, ", "))
+	}
+	if len(ips) > 0 {
+		d.line(prefix+" ip", "%s", ips)
+	}
+	if len(uris) > 0 {
+		d.line(prefix+" uri", "%s", uris)
+	}
+}
+
+// nonceString returns the hex form of a nonce, or absent.
+func nonceString(nonce []byte) string {
+	if len(nonce) == 0 {
+		return "absent"
+	}
+	return hex.EncodeToString(nonce)
+}
+
+func pkiStatusName(status PKIStatus) string {
+	switch status {
+	case SUCCESS:
+		return "SUCCESS (0)"
+	case FAILURE:
+		return "FAILURE (2)"
+	case PENDING:
+		return "PENDING (3)"
+	default:
+		return "unknown(" + string(status) + ")"
+	}
+}
+
+// algorithmName returns the name and OID of a digest, signature or
+// content encryption algorithm.
+func algorithmName(oid asn1.ObjectIdentifier) string {
+	for _, known := range []struct {
+		oid  asn1.ObjectIdentifier
+		name string
+	}{
+		{pkcs7.OIDDigestAlgorithmSHA1, "SHA-1"},
+		{pkcs7.OIDDigestAlgorithmSHA256, "SHA-256"},
+		{pkcs7.OIDDigestAlgorithmSHA384, "SHA-384"},
+		{pkcs7.OIDDigestAlgorithmSHA512, "SHA-512"},
+		{pkcs7.OIDEncryptionAlgorithmRSA, "rsaEncryption"},
+		{oidRSAESOAEP, RSAOAEP.String()},
+		{pkcs7.OIDEncryptionAlgorithmRSASHA1, "sha1WithRSAEncryption"},
+		{pkcs7.OIDEncryptionAlgorithmRSASHA256, "sha256WithRSAEncryption"},
+		{pkcs7.OIDEncryptionAlgorithmRSASHA384, "sha384WithRSAEncryption"},
+		{pkcs7.OIDEncryptionAlgorithmRSASHA512, "sha512WithRSAEncryption"},
+		{pkcs7.OIDDigestAlgorithmECDSASHA1, "ecdsa-with-SHA1"},
+		{pkcs7.OIDDigestAlgorithmECDSASHA256, "ecdsa-with-SHA256"},
+		{pkcs7.OIDDigestAlgorithmECDSASHA384, "ecdsa-with-SHA384"},
+		{pkcs7.OIDDigestAlgorithmECDSASHA512, "ecdsa-with-SHA512"},
+		{pkcs7.OIDEncryptionAlgorithmECDSAP256, "ecdsa P-256"},
+		{pkcs7.OIDEncryptionAlgorithmECDSAP384, "ecdsa P-384"},
+		{pkcs7.OIDEncryptionAlgorithmECDSAP521, "ecdsa P-521"},
+		{pkcs7.OIDEncryptionAlgorithmDESCBC, DESCBC.String()},
+		{pkcs7.OIDEncryptionAlgorithmDESEDE3CBC, DES3CBC.String()},
+		{pkcs7.OIDEncryptionAlgorithmAES128CBC, AES128CBC.String()},
+		{pkcs7.OIDEncryptionAlgorithmAES256CBC, AES256CBC.String()},
+		{pkcs7.OIDEncryptionAlgorithmAES128GCM, AES128GCM.String()},
+		{pkcs7.OIDEncryptionAlgorithmAES256GCM, AES256GCM.String()},
+	} {
+		if oid.Equal(known.oid) {
+			return known.name + " (" + oid.String() + ")"
+		}
+	}
+	return oid.String()
+}
+
+// publicKeyName describes the type and size of pub.
+func publicKeyName(pub crypto.PublicKey) string {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d bits", pub.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + pub.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return fmt.Sprintf("%T", pub)
+	}
+}
+
+// rawNameString returns the string form of the DER encoded Name raw.
+func rawNameString(raw asn1.RawValue) string {
+	var rdns pkix.RDNSequence
+	if _, err := asn1.Unmarshal(raw.FullBytes, &rdns); err != nil {
+		return "invalid name: " + err.Error()
+	}
+	return rdns.String()
+}
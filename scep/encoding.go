@@ -0,0 +1,92 @@
+package scep
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// PEMBlockType is the type of the PEM blocks written by EncodePEM.
+const PEMBlockType = "PKCS7"
+
+// EncodeBase64 returns the standard base64 encoding of a DER encoded
+// message, the value of the message parameter of a PKIOperation GET
+// request. It must be URL-escaped, e.g. by url.Values.Encode, unless
+// EncodeGETMessage is used.
+func EncodeBase64(der []byte) string {
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+// EncodeGETMessage returns the message parameter of a PKIOperation GET
+// request for a DER encoded message, base64 encoded and then URL-escaped as
+// described in RFC 8894 section 4.1, ready to append to a raw query.
+func EncodeGETMessage(der []byte) string {
+	return url.QueryEscape(EncodeBase64(der))
+}
+
+// DecodeBase64 decodes the message parameter of a PKIOperation GET request,
+// whether or not it is still URL-escaped. The encodings of clients
+// differing from RFC 8894 are accepted too: the URL-safe alphabet, missing
+// padding, line breaks, and '+' turned into a space by a query parser.
+func DecodeBase64(s string) ([]byte, error) {
+	if strings.Contains(s, "%") {
+		unescaped, err := url.PathUnescape(s)
+		if err != nil {
+			return nil, errors.Wrap(err, "scep: unescape base64 message")
+		}
+		s = unescaped
+	}
+	s = strings.TrimSpace(s)
+	s = strings.ReplaceAll(s, " ", "+")
+	s = strings.Join(strings.Fields(s), "")
+	s = strings.TrimRight(s, "=")
+	enc := base64.RawStdEncoding
+	if strings.ContainsAny(s, "-_") {
+		enc = base64.RawURLEncoding
+	}
+	der, err := enc.DecodeString(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "scep: decode base64 message")
+	}
+	return der, nil
+}
+
+// EncodePEM returns a DER encoded message, or another PKCS#7 ContentInfo
+// such as a GetCACert response, as a PEM block of PEMBlockType.
+func EncodePEM(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: PEMBlockType, Bytes: der})
+}
+
+// DecodePEM returns the DER of the first PKCS7 or CMS PEM block of data.
+func DecodePEM(data []byte) ([]byte, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("scep: no PKCS7 PEM block")
+		}
+		if block.Type == PEMBlockType || block.Type == "CMS" {
+			return block.Bytes, nil
+		}
+	}
+}
+
+// DecodeMessage returns the DER or BER of a message in any of the
+// transport encodings: binary, as sent in a POST body, PEM, or base64 as
+// sent in a GET request.
+func DecodeMessage(data []byte) ([]byte, error) {
+	if len(data) > 0 && data[0] == 0x30 {
+		return data, nil
+	}
+	if der, err := DecodePEM(data); err == nil {
+		return der, nil
+	}
+	der, err := DecodeBase64(string(data))
+	if err != nil {
+		return nil, errors.New("scep: message is neither DER, PEM nor base64 encoded")
+	}
+	return der, nil
+}
@@ -0,0 +1,73 @@
+package scep_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+func TestDecodeBase64(t *testing.T) {
+	// base64 encoded with '+' and '/'
+	der := []byte{0x30, 0x07, 0x04, 0x05, 0, 0, 0xfb, 0xef, 0xbf}
+	std := base64.StdEncoding.EncodeToString(der)
+	if !strings.ContainsAny(std, "+/") {
+		t.Fatalf("%s has no '+' or '/'", std)
+	}
+	if have, want := scep.EncodeGETMessage(der), url.QueryEscape(std); have != want {
+		t.Errorf("have GET message %s, want %s", have, want)
+	}
+	for _, s := range []string{
+		std,
+		scep.EncodeBase64(der),
+		scep.EncodeGETMessage(der),
+		strings.ReplaceAll(std, "+", " "),
+		base64.URLEncoding.EncodeToString(der),
+		base64.RawStdEncoding.EncodeToString(der),
+		std[:4] + "\r\n" + std[4:] + "\n",
+	} {
+		have, err := scep.DecodeBase64(s)
+		if err != nil {
+			t.Errorf("%q: %v", s, err)
+			continue
+		}
+		if !bytes.Equal(have, der) {
+			t.Errorf("%q: have %x, want %x", s, have, der)
+		}
+	}
+	if _, err := scep.DecodeBase64("not-base64!"); err == nil {
+		t.Error("decoded invalid base64")
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	der := loadTestFile(t, "testdata/PKCSReq.der")
+	pemData := scep.EncodePEM(der)
+	if !bytes.HasPrefix(pemData, []byte("-----BEGIN PKCS7-----")) {
+		t.Errorf("have PEM %.21s, want a PKCS7 block", pemData)
+	}
+	if have, err := scep.DecodePEM(pemData); err != nil || !bytes.Equal(have, der) {
+		t.Errorf("DecodePEM: have %d bytes, %v, want %d bytes", len(have), err, len(der))
+	}
+	for name, data := range map[string][]byte{
+		"DER":    der,
+		"PEM":    pemData,
+		"base64": []byte(scep.EncodeBase64(der)),
+		"GET":    []byte(scep.EncodeGETMessage(der)),
+	} {
+		have, err := scep.DecodeMessage(data)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(have, der) {
+			t.Errorf("%s: decoded another message", name)
+		}
+	}
+	if _, err := scep.DecodeMessage([]byte("-----BEGIN CERTIFICATE-----\n-----END CERTIFICATE-----\n")); err == nil {
+		t.Error("decoded a certificate PEM block")
+	}
+}
@@ -0,0 +1,756 @@
+package scep
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"math/big"
+
+	"github.com/micromdm/scep/v2/cryptoutil"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/pkcs7"
+)
+
+// The pkiEnvelope is a CMS EnvelopedData (RFC 5652). RSA recipients use key
+// transport, EC recipients use ephemeral-static ECDH key agreement as
+// specified in RFC 5753 and referenced by RFC 8894.
+
+var (
+	oidAES192CBC = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+
+	oidAES128Wrap = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 5}
+	oidAES256Wrap = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 45}
+
+	oidDHSinglePassStdDHSHA1KDF        = asn1.ObjectIdentifier{1, 3, 133, 16, 840, 63, 0, 2}
+	oidDHSinglePassCofactorDHSHA1KDF   = asn1.ObjectIdentifier{1, 3, 133, 16, 840, 63, 0, 3}
+	oidDHSinglePassStdDHSHA224KDF      = asn1.ObjectIdentifier{1, 3, 132, 1, 11, 0}
+	oidDHSinglePassStdDHSHA256KDF      = asn1.ObjectIdentifier{1, 3, 132, 1, 11, 1}
+	oidDHSinglePassStdDHSHA384KDF      = asn1.ObjectIdentifier{1, 3, 132, 1, 11, 2}
+	oidDHSinglePassStdDHSHA512KDF      = asn1.ObjectIdentifier{1, 3, 132, 1, 11, 3}
+	oidDHSinglePassCofactorDHSHA224KDF = asn1.ObjectIdentifier{1, 3, 132, 1, 14, 0}
+	oidDHSinglePassCofactorDHSHA256KDF = asn1.ObjectIdentifier{1, 3, 132, 1, 14, 1}
+	oidDHSinglePassCofactorDHSHA384KDF = asn1.ObjectIdentifier{1, 3, 132, 1, 14, 2}
+	oidDHSinglePassCofactorDHSHA512KDF = asn1.ObjectIdentifier{1, 3, 132, 1, 14, 3}
+
+	oidPublicKeyECDSA = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+)
+
+// EncryptionAlgorithm is the content encryption algorithm of a pkiEnvelope.
+type EncryptionAlgorithm int
+
+// Supported pkiEnvelope content encryption algorithms.
+const (
+	DESCBC EncryptionAlgorithm = iota + 1
+	AES128CBC
+	AES256CBC
+	AES128GCM
+	AES256GCM
+	DES3CBC
+)
+
+// encryptionAlgorithmDESEDE3CBC extends the pkcs7.EncryptionAlgorithm
+// constants, which lack 3DES.
+const encryptionAlgorithmDESEDE3CBC = -1
+
+func (alg EncryptionAlgorithm) String() string {
+	switch alg {
+	case DESCBC:
+		return "DES-CBC"
+	case AES128CBC:
+		return "AES-128-CBC"
+	case AES256CBC:
+		return "AES-256-CBC"
+	case AES128GCM:
+		return "AES-128-GCM"
+	case AES256GCM:
+		return "AES-256-GCM"
+	case DES3CBC:
+		return "DES-EDE3-CBC"
+	default:
+		return fmt.Sprintf("EncryptionAlgorithm(%d)", int(alg))
+	}
+}
+
+// pkcs7 returns the matching pkcs7.EncryptionAlgorithm constant. The zero
+// value selects the pkcs7.ContentEncryptionAlgorithm package default.
+func (alg EncryptionAlgorithm) pkcs7() (int, error) {
+	switch alg {
+	case DESCBC:
+		return pkcs7.EncryptionAlgorithmDESCBC, nil
+	case AES128CBC:
+		return pkcs7.EncryptionAlgorithmAES128CBC, nil
+	case AES256CBC:
+		return pkcs7.EncryptionAlgorithmAES256CBC, nil
+	case AES128GCM:
+		return pkcs7.EncryptionAlgorithmAES128GCM, nil
+	case AES256GCM:
+		return pkcs7.EncryptionAlgorithmAES256GCM, nil
+	case DES3CBC:
+		return encryptionAlgorithmDESEDE3CBC, nil
+	case 0:
+		return pkcs7.ContentEncryptionAlgorithm, nil
+	default:
+		return 0, errors.Errorf("scep: unsupported content encryption algorithm %s", alg)
+	}
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type envelopedData struct {
+	Version              int
+	RecipientInfos       []asn1.RawValue `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"tag:0,optional"`
+}
+
+type keyTransRecipientInfo struct {
+	Version                int
+	RID                    asn1.RawValue
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+// keyAgreeRecipientInfo is encoded as [1] IMPLICIT in a RecipientInfo.
+type keyAgreeRecipientInfo struct {
+	Version                int
+	Originator             asn1.RawValue // [0] EXPLICIT OriginatorIdentifierOrKey
+	UKM                    []byte        `asn1:"explicit,optional,tag:1"`
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	RecipientEncryptedKeys []recipientEncryptedKey
+}
+
+// originatorPublicKey is encoded as [1] IMPLICIT in an OriginatorIdentifierOrKey.
+type originatorPublicKey struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+type recipientEncryptedKey struct {
+	RID          asn1.RawValue
+	EncryptedKey []byte
+}
+
+type eccCMSSharedInfo struct {
+	KeyInfo     pkix.AlgorithmIdentifier
+	EntityUInfo []byte `asn1:"explicit,optional,tag:0"`
+	SuppPubInfo []byte `asn1:"explicit,tag:2"`
+}
+
+type gcmParameters struct {
+	Nonce  []byte
+	ICVLen int `asn1:"default:12"`
+}
+
+// encryptPKIEnvelope encrypts content for recipients using the
+// pkcs7.EncryptionAlgorithm alg and returns the DER encoded EnvelopedData
+// ContentInfo. keyEnc returns the key encryption algorithm of each RSA
+// recipient; if it is nil RSAPKCS1v15 is used.
+func encryptPKIEnvelope(content []byte, recipients []*x509.Certificate, alg int, keyEnc func(*x509.Certificate) (KeyEncryptionAlgorithm, error)) ([]byte, error) {
+	for _, recipient := range recipients {
+		if _, ok := recipient.PublicKey.(*ecdsa.PublicKey); ok && alg == pkcs7.EncryptionAlgorithmDESCBC {
+			// a DES key is too short for AES key wrap
+			alg = pkcs7.EncryptionAlgorithmAES128CBC
+		}
+	}
+	key, eci, err := encryptContent(content, alg)
+	if err != nil {
+		return nil, err
+	}
+
+	version := 0
+	infos := make([]asn1.RawValue, 0, len(recipients))
+	for _, recipient := range recipients {
+		var info []byte
+		switch pub := recipient.PublicKey.(type) {
+		case *rsa.PublicKey:
+			keyAlg := RSAPKCS1v15
+			if keyEnc != nil {
+				if keyAlg, err = keyEnc(recipient); err != nil {
+					return nil, err
+				}
+			}
+			info, err = keyTransRecipient(key, recipient, pub, keyAlg)
+		case *ecdsa.PublicKey:
+			info, err = keyAgreeRecipient(key, recipient, pub)
+			version = 2
+		default:
+			err = errors.Errorf("scep: unsupported recipient public key type %T", recipient.PublicKey)
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, asn1.RawValue{FullBytes: info})
+	}
+
+	algID, err := asn1.Marshal(eci.ContentEncryptionAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	var infosLen int
+	for _, info := range infos {
+		infosLen += len(info.FullBytes)
+	}
+
+	// the EnvelopedData is written into a single buffer, innermost
+	// lengths first
+	ciphertext := eci.EncryptedContent.Bytes
+	eciLen := len(derOIDData) + len(algID) + derLen(len(ciphertext))
+	innerLen := 3 + derLen(infosLen) + derLen(eciLen)
+	b := make([]byte, 0, contentInfoLen(derOIDEnvelopedData, derLen(innerLen)))
+	b = appendContentInfo(b, derOIDEnvelopedData, derLen(innerLen))
+	b = appendDERHeader(b, derTagSequence, innerLen)
+	b = append(b, derTagInteger, 1, byte(version))
+	b = appendDERHeader(b, derTagSet, infosLen)
+	for _, info := range infos {
+		b = append(b, info.FullBytes...)
+	}
+	b = appendDERHeader(b, derTagSequence, eciLen)
+	b = append(b, derOIDData...)
+	b = append(b, algID...)
+	// encryptedContent [0] IMPLICIT OCTET STRING
+	b = appendDER(b, derTagContext0Primitive, ciphertext)
+	return b, nil
+}
+
+// decryptPKIEnvelope decrypts the EnvelopedData ContentInfo data for the
+// recipient cert using its private key.
+func decryptPKIEnvelope(data []byte, cert *x509.Certificate, key crypto.PrivateKey) ([]byte, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(data, &ci); err != nil {
+		return nil, errors.Wrap(err, "scep: parse pkiEnvelope")
+	}
+	if !ci.ContentType.Equal(pkcs7.OIDEnvelopedData) {
+		return nil, errors.New("scep: pkiEnvelope is not an EnvelopedData")
+	}
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		return nil, errors.Wrap(err, "scep: parse pkiEnvelope EnvelopedData")
+	}
+
+	for _, info := range ed.RecipientInfos {
+		var (
+			cek []byte
+			err error
+		)
+		switch {
+		case info.Class == asn1.ClassUniversal && info.Tag == asn1.TagSequence:
+			var ktri keyTransRecipientInfo
+			if _, err := asn1.Unmarshal(info.FullBytes, &ktri); err != nil {
+				return nil, errors.Wrap(err, "scep: parse KeyTransRecipientInfo")
+			}
+			if !recipientMatches(ktri.RID, cert) {
+				continue
+			}
+			cek, err = decryptKeyTrans(ktri, key)
+		case info.Class == asn1.ClassContextSpecific && info.Tag == 1:
+			var kari keyAgreeRecipientInfo
+			if _, err := asn1.UnmarshalWithParams(info.FullBytes, &kari, "tag:1"); err != nil {
+				return nil, errors.Wrap(err, "scep: parse KeyAgreeRecipientInfo")
+			}
+			rek := kari.recipientKey(cert)
+			if rek == nil {
+				continue
+			}
+			cek, err = decryptKeyAgree(kari, rek.EncryptedKey, key)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return decryptContent(ed.EncryptedContentInfo, cek)
+	}
+	return nil, errors.New("scep: no pkiEnvelope recipient for certificate")
+}
+
+// recipientMatches reports whether a RecipientIdentifier or
+// KeyAgreeRecipientIdentifier identifies cert.
+func recipientMatches(rid asn1.RawValue, cert *x509.Certificate) bool {
+	switch {
+	case rid.Class == asn1.ClassUniversal && rid.Tag == asn1.TagSequence:
+		var ias IssuerAndSerial
+		if _, err := asn1.Unmarshal(rid.FullBytes, &ias); err != nil {
+			return false
+		}
+		return ias.Matches(cert)
+	case rid.Class == asn1.ClassContextSpecific && rid.Tag == 0:
+		ski := rid.Bytes
+		if rid.IsCompound {
+			// rKeyId RecipientKeyIdentifier starts with the subjectKeyIdentifier
+			if _, err := asn1.Unmarshal(rid.Bytes, &ski); err != nil {
+				return false
+			}
+		}
+		certSKI, err := cryptoutil.SubjectKeyID(cert)
+		return err == nil && bytes.Equal(ski, certSKI)
+	}
+	return false
+}
+
+func (kari keyAgreeRecipientInfo) recipientKey(cert *x509.Certificate) *recipientEncryptedKey {
+	for i := range kari.RecipientEncryptedKeys {
+		if recipientMatches(kari.RecipientEncryptedKeys[i].RID, cert) {
+			return &kari.RecipientEncryptedKeys[i]
+		}
+	}
+	return nil
+}
+
+func keyTransRecipient(cek []byte, cert *x509.Certificate, pub *rsa.PublicKey, alg KeyEncryptionAlgorithm) ([]byte, error) {
+	keyAlg, encrypted, err := encryptKeyTrans(cek, pub, alg)
+	if err != nil {
+		return nil, err
+	}
+	rid, err := asn1.Marshal(NewIssuerAndSerial(cert))
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(keyTransRecipientInfo{
+		RID:                    asn1.RawValue{FullBytes: rid},
+		KeyEncryptionAlgorithm: keyAlg,
+		EncryptedKey:           encrypted,
+	})
+}
+
+func decryptKeyTrans(ktri keyTransRecipientInfo, key crypto.PrivateKey) ([]byte, error) {
+	var opts crypto.DecrypterOpts = &rsa.PKCS1v15DecryptOptions{}
+	switch alg := ktri.KeyEncryptionAlgorithm; {
+	case alg.Algorithm.Equal(pkcs7.OIDEncryptionAlgorithmRSA):
+	case alg.Algorithm.Equal(oidRSAESOAEP):
+		oaep, err := oaepOptions(alg)
+		if err != nil {
+			return nil, err
+		}
+		opts = oaep
+	default:
+		return nil, errors.Errorf("scep: unsupported key encryption algorithm %s", alg.Algorithm)
+	}
+	priv, ok := key.(crypto.Decrypter)
+	if !ok {
+		return nil, errors.Errorf("scep: key transport recipient requires an RSA key, got %T", key)
+	}
+	if _, ok := priv.Public().(*rsa.PublicKey); !ok {
+		return nil, errors.Errorf("scep: key transport recipient requires an RSA key, got %T", priv.Public())
+	}
+	return priv.Decrypt(rand.Reader, ktri.EncryptedKey, opts)
+}
+
+// keyAgreement returns the key agreement algorithm, KDF hash and key wrap
+// algorithm for curve as recommended by RFC 5753.
+func keyAgreement(curve elliptic.Curve) (asn1.ObjectIdentifier, crypto.Hash, asn1.ObjectIdentifier, error) {
+	switch curve {
+	case elliptic.P256():
+		return oidDHSinglePassStdDHSHA256KDF, crypto.SHA256, oidAES128Wrap, nil
+	case elliptic.P384():
+		return oidDHSinglePassStdDHSHA384KDF, crypto.SHA384, oidAES256Wrap, nil
+	case elliptic.P521():
+		return oidDHSinglePassStdDHSHA512KDF, crypto.SHA512, oidAES256Wrap, nil
+	}
+	return nil, 0, nil, errors.New("scep: unsupported elliptic curve for key agreement")
+}
+
+// keyAgreementKDF returns the KDF hash of the key agreement algorithm oid.
+// The cofactor variants are equivalent on the NIST prime curves, which
+// have a cofactor of one.
+func keyAgreementKDF(oid asn1.ObjectIdentifier) (crypto.Hash, bool) {
+	switch {
+	case oid.Equal(oidDHSinglePassStdDHSHA1KDF), oid.Equal(oidDHSinglePassCofactorDHSHA1KDF):
+		return crypto.SHA1, true
+	case oid.Equal(oidDHSinglePassStdDHSHA224KDF), oid.Equal(oidDHSinglePassCofactorDHSHA224KDF):
+		return crypto.SHA224, true
+	case oid.Equal(oidDHSinglePassStdDHSHA256KDF), oid.Equal(oidDHSinglePassCofactorDHSHA256KDF):
+		return crypto.SHA256, true
+	case oid.Equal(oidDHSinglePassStdDHSHA384KDF), oid.Equal(oidDHSinglePassCofactorDHSHA384KDF):
+		return crypto.SHA384, true
+	case oid.Equal(oidDHSinglePassStdDHSHA512KDF), oid.Equal(oidDHSinglePassCofactorDHSHA512KDF):
+		return crypto.SHA512, true
+	}
+	return 0, false
+}
+
+func keyAgreeRecipient(cek []byte, cert *x509.Certificate, pub *ecdsa.PublicKey) ([]byte, error) {
+	kaOID, h, wrapOID, err := keyAgreement(pub.Curve)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdsa.GenerateKey(pub.Curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	wrapAlg := pkix.AlgorithmIdentifier{Algorithm: wrapOID}
+	kek, err := sharedKEK(pub.Curve, pub.X, pub.Y, ephemeral.D.Bytes(), h, wrapAlg, nil)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := aesKeyWrap(kek, cek)
+	if err != nil {
+		return nil, err
+	}
+
+	point := elliptic.Marshal(pub.Curve, ephemeral.X, ephemeral.Y)
+	originator, err := asn1.MarshalWithParams(originatorPublicKey{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidPublicKeyECDSA},
+		PublicKey: asn1.BitString{Bytes: point, BitLength: 8 * len(point)},
+	}, "tag:1")
+	if err != nil {
+		return nil, err
+	}
+	wrapParams, err := asn1.Marshal(wrapAlg)
+	if err != nil {
+		return nil, err
+	}
+	rid, err := asn1.Marshal(NewIssuerAndSerial(cert))
+	if err != nil {
+		return nil, err
+	}
+	return asn1.MarshalWithParams(keyAgreeRecipientInfo{
+		Version:    3,
+		Originator: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: originator},
+		KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  kaOID,
+			Parameters: asn1.RawValue{FullBytes: wrapParams},
+		},
+		RecipientEncryptedKeys: []recipientEncryptedKey{
+			{RID: asn1.RawValue{FullBytes: rid}, EncryptedKey: wrapped},
+		},
+	}, "tag:1")
+}
+
+func decryptKeyAgree(kari keyAgreeRecipientInfo, wrapped []byte, key crypto.PrivateKey) ([]byte, error) {
+	priv, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.Errorf("scep: key agreement recipient requires an ECDSA key, got %T", key)
+	}
+	h, ok := keyAgreementKDF(kari.KeyEncryptionAlgorithm.Algorithm)
+	if !ok || !h.Available() {
+		return nil, errors.Errorf("scep: unsupported key agreement algorithm %s", kari.KeyEncryptionAlgorithm.Algorithm)
+	}
+	var wrapAlg pkix.AlgorithmIdentifier
+	if _, err := asn1.Unmarshal(kari.KeyEncryptionAlgorithm.Parameters.FullBytes, &wrapAlg); err != nil {
+		return nil, errors.Wrap(err, "scep: parse key wrap algorithm")
+	}
+	if !wrapAlg.Algorithm.Equal(oidAES128Wrap) && !wrapAlg.Algorithm.Equal(oidAES256Wrap) {
+		return nil, errors.Errorf("scep: unsupported key wrap algorithm %s", wrapAlg.Algorithm)
+	}
+
+	// originator [0] EXPLICIT originatorKey [1] IMPLICIT OriginatorPublicKey
+	var originator asn1.RawValue
+	if _, err := asn1.Unmarshal(kari.Originator.Bytes, &originator); err != nil {
+		return nil, errors.Wrap(err, "scep: parse key agreement originator")
+	}
+	if originator.Class != asn1.ClassContextSpecific || originator.Tag != 1 {
+		return nil, errors.New("scep: key agreement originator is not an ephemeral public key")
+	}
+	var opk originatorPublicKey
+	if _, err := asn1.UnmarshalWithParams(originator.FullBytes, &opk, "tag:1"); err != nil {
+		return nil, errors.Wrap(err, "scep: parse key agreement originator")
+	}
+	x, y := elliptic.Unmarshal(priv.Curve, opk.PublicKey.RightAlign())
+	if x == nil {
+		return nil, errors.New("scep: invalid key agreement originator public key")
+	}
+
+	kek, err := sharedKEK(priv.Curve, x, y, priv.D.Bytes(), h, pkix.AlgorithmIdentifier{Algorithm: wrapAlg.Algorithm}, kari.UKM)
+	if err != nil {
+		return nil, err
+	}
+	return aesKeyUnwrap(kek, wrapped)
+}
+
+// sharedKEK derives the key-encryption key from the ECDH shared secret
+// using the ANSI X9.63 KDF with the ECC-CMS-SharedInfo of RFC 5753.
+func sharedKEK(curve elliptic.Curve, x, y *big.Int, scalar []byte, h crypto.Hash, wrapAlg pkix.AlgorithmIdentifier, ukm []byte) ([]byte, error) {
+	keyLen := 16
+	if wrapAlg.Algorithm.Equal(oidAES256Wrap) {
+		keyLen = 32
+	}
+	suppPubInfo := make([]byte, 4)
+	binary.BigEndian.PutUint32(suppPubInfo, uint32(keyLen*8))
+	sharedInfo, err := asn1.Marshal(eccCMSSharedInfo{
+		KeyInfo:     wrapAlg,
+		EntityUInfo: ukm,
+		SuppPubInfo: suppPubInfo,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	zx, _ := curve.ScalarMult(x, y, scalar)
+	z := make([]byte, (curve.Params().BitSize+7)/8)
+	zx.FillBytes(z)
+
+	return x963KDF(h.New, z, sharedInfo, keyLen), nil
+}
+
+func x963KDF(newHash func() hash.Hash, z, sharedInfo []byte, keyLen int) []byte {
+	var out []byte
+	counter := make([]byte, 4)
+	for i := uint32(1); len(out) < keyLen; i++ {
+		binary.BigEndian.PutUint32(counter, i)
+		h := newHash()
+		h.Write(z)
+		h.Write(counter)
+		h.Write(sharedInfo)
+		out = h.Sum(out)
+	}
+	return out[:keyLen]
+}
+
+var aesKeyWrapIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+// aesKeyWrap wraps key with kek as specified in RFC 3394.
+func aesKeyWrap(kek, key []byte) ([]byte, error) {
+	if len(key) < 16 || len(key)%8 != 0 {
+		return nil, errors.New("scep: key wrap input must be a multiple of 8 and at least 16 bytes")
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(key) / 8
+	out := make([]byte, 8+len(key))
+	copy(out, aesKeyWrapIV)
+	copy(out[8:], key)
+	buf := make([]byte, 16)
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(buf, out[:8])
+			copy(buf[8:], out[8*i:8*i+8])
+			block.Encrypt(buf, buf)
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(out[:8], binary.BigEndian.Uint64(buf[:8])^t)
+			copy(out[8*i:], buf[8:])
+		}
+	}
+	return out, nil
+}
+
+// aesKeyUnwrap unwraps a key wrapped with kek as specified in RFC 3394.
+func aesKeyUnwrap(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 24 || len(wrapped)%8 != 0 {
+		return nil, errors.New("scep: invalid wrapped key length")
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	n := len(wrapped)/8 - 1
+	out := make([]byte, len(wrapped))
+	copy(out, wrapped)
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(buf, binary.BigEndian.Uint64(out[:8])^t)
+			copy(buf[8:], out[8*i:8*i+8])
+			block.Decrypt(buf, buf)
+			copy(out[:8], buf[:8])
+			copy(out[8*i:], buf[8:])
+		}
+	}
+	if subtle.ConstantTimeCompare(out[:8], aesKeyWrapIV) != 1 {
+		return nil, errors.New("scep: key unwrap integrity check failed")
+	}
+	return out[8:], nil
+}
+
+// encryptContent encrypts content with a new random key using the
+// pkcs7.EncryptionAlgorithm alg.
+func encryptContent(content []byte, alg int) ([]byte, encryptedContentInfo, error) {
+	var (
+		oid    asn1.ObjectIdentifier
+		keyLen int
+		gcm    bool
+	)
+	switch alg {
+	case pkcs7.EncryptionAlgorithmDESCBC:
+		oid, keyLen = pkcs7.OIDEncryptionAlgorithmDESCBC, 8
+	case encryptionAlgorithmDESEDE3CBC:
+		oid, keyLen = pkcs7.OIDEncryptionAlgorithmDESEDE3CBC, 24
+	case pkcs7.EncryptionAlgorithmAES128CBC:
+		oid, keyLen = pkcs7.OIDEncryptionAlgorithmAES128CBC, 16
+	case pkcs7.EncryptionAlgorithmAES256CBC:
+		oid, keyLen = pkcs7.OIDEncryptionAlgorithmAES256CBC, 32
+	case pkcs7.EncryptionAlgorithmAES128GCM:
+		oid, keyLen, gcm = pkcs7.OIDEncryptionAlgorithmAES128GCM, 16, true
+	case pkcs7.EncryptionAlgorithmAES256GCM:
+		oid, keyLen, gcm = pkcs7.OIDEncryptionAlgorithmAES256GCM, 32, true
+	default:
+		return nil, encryptedContentInfo{}, errors.Errorf("scep: unsupported content encryption algorithm %d", alg)
+	}
+
+	key := make([]byte, keyLen)
+	if _, err := rand.Read(key); err != nil {
+		return nil, encryptedContentInfo{}, err
+	}
+	var (
+		block cipher.Block
+		err   error
+	)
+	switch alg {
+	case pkcs7.EncryptionAlgorithmDESCBC:
+		block, err = des.NewCipher(key)
+	case encryptionAlgorithmDESEDE3CBC:
+		block, err = des.NewTripleDESCipher(key)
+	default:
+		block, err = aes.NewCipher(key)
+	}
+	if err != nil {
+		return nil, encryptedContentInfo{}, err
+	}
+
+	var ciphertext, params []byte
+	if gcm {
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, encryptedContentInfo{}, err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, encryptedContentInfo{}, err
+		}
+		ciphertext = aead.Seal(nil, nonce, content, nil)
+		params, err = asn1.Marshal(gcmParameters{Nonce: nonce, ICVLen: aead.Overhead()})
+		if err != nil {
+			return nil, encryptedContentInfo{}, err
+		}
+	} else {
+		iv := make([]byte, block.BlockSize())
+		if _, err := rand.Read(iv); err != nil {
+			return nil, encryptedContentInfo{}, err
+		}
+		// the padded copy of content is encrypted in place
+		ciphertext = pad(content, block.BlockSize())
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
+		params, err = asn1.Marshal(iv)
+		if err != nil {
+			return nil, encryptedContentInfo{}, err
+		}
+	}
+
+	return key, encryptedContentInfo{
+		ContentType: pkcs7.OIDData,
+		ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oid,
+			Parameters: asn1.RawValue{FullBytes: params},
+		},
+		EncryptedContent: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, Bytes: ciphertext},
+	}, nil
+}
+
+func decryptContent(eci encryptedContentInfo, key []byte) ([]byte, error) {
+	// EncryptedContent is either a primitive [0] OCTET STRING or
+	// constructed from multiple OCTET STRINGs
+	ciphertext := eci.EncryptedContent.Bytes
+	if eci.EncryptedContent.IsCompound {
+		var buf bytes.Buffer
+		for rest := ciphertext; len(rest) > 0; {
+			var part []byte
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &part); err != nil {
+				return nil, errors.Wrap(err, "scep: parse encrypted content")
+			}
+			buf.Write(part)
+		}
+		ciphertext = buf.Bytes()
+	}
+
+	alg := eci.ContentEncryptionAlgorithm
+	var (
+		block cipher.Block
+		err   error
+		gcm   bool
+	)
+	switch {
+	case alg.Algorithm.Equal(pkcs7.OIDEncryptionAlgorithmDESCBC):
+		block, err = des.NewCipher(key)
+	case alg.Algorithm.Equal(pkcs7.OIDEncryptionAlgorithmDESEDE3CBC):
+		block, err = des.NewTripleDESCipher(key)
+	case alg.Algorithm.Equal(pkcs7.OIDEncryptionAlgorithmAES128CBC),
+		alg.Algorithm.Equal(oidAES192CBC),
+		alg.Algorithm.Equal(pkcs7.OIDEncryptionAlgorithmAES256CBC):
+		block, err = aes.NewCipher(key)
+	case alg.Algorithm.Equal(pkcs7.OIDEncryptionAlgorithmAES128GCM),
+		alg.Algorithm.Equal(pkcs7.OIDEncryptionAlgorithmAES256GCM):
+		block, err = aes.NewCipher(key)
+		gcm = true
+	default:
+		return nil, errors.Errorf("scep: unsupported content encryption algorithm %s", alg.Algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if gcm {
+		var params gcmParameters
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+			return nil, errors.Wrap(err, "scep: parse GCM parameters")
+		}
+		aead, err := cipher.NewGCMWithTagSize(block, params.ICVLen)
+		if err != nil {
+			return nil, err
+		}
+		if len(params.Nonce) != aead.NonceSize() {
+			return nil, errors.New("scep: invalid GCM nonce")
+		}
+		return aead.Open(nil, params.Nonce, ciphertext, nil)
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &iv); err != nil {
+		return nil, errors.Wrap(err, "scep: parse CBC IV")
+	}
+	if len(iv) != block.BlockSize() || len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return nil, errors.New("scep: malformed CBC encrypted content")
+	}
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	return unpad(plaintext, block.BlockSize())
+}
+
+// pad applies PKCS#7 padding.
+func pad(data []byte, blockSize int) []byte {
+	n := blockSize - len(data)%blockSize
+	padded := make([]byte, len(data)+n)
+	copy(padded, data)
+	for i := len(data); i < len(padded); i++ {
+		padded[i] = byte(n)
+	}
+	return padded
+}
+
+// unpad removes PKCS#7 padding.
+func unpad(data []byte, blockSize int) ([]byte, error) {
+	n := int(data[len(data)-1])
+	if n == 0 || n > blockSize || n > len(data) {
+		return nil, errors.New("scep: invalid content padding")
+	}
+	for _, b := range data[len(data)-n:] {
+		if int(b) != n {
+			return nil, errors.New("scep: invalid content padding")
+		}
+	}
+	return data[:len(data)-n], nil
+}
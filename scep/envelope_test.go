@@ -0,0 +1,424 @@
+package scep
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"go.mozilla.org/pkcs7"
+)
+
+func TestAESKeyWrap(t *testing.T) {
+	// RFC 3394 section 4.1 and 4.6
+	for _, test := range []struct {
+		kek, key, wrapped string
+	}{
+		{
+			"000102030405060708090A0B0C0D0E0F",
+			"00112233445566778899AABBCCDDEEFF",
+			"1FA68B0A8112B447AEF34BD8FB5A7B829D3E862371D2CFE5",
+		},
+		{
+			"000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F",
+			"00112233445566778899AABBCCDDEEFF000102030405060708090A0B0C0D0E0F",
+			"28C9F404C4B810F4CBCCB35CFB87F8263F5786E2D80ED326CBC7F0E71A99F43BFB988B9B7A02DD21",
+		},
+	} {
+		kek, _ := hex.DecodeString(test.kek)
+		key, _ := hex.DecodeString(test.key)
+		want, _ := hex.DecodeString(test.wrapped)
+
+		wrapped, err := aesKeyWrap(kek, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(wrapped, want) {
+			t.Errorf("have %X, want %X", wrapped, want)
+		}
+		unwrapped, err := aesKeyUnwrap(kek, wrapped)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(unwrapped, key) {
+			t.Errorf("have %X, want %X", unwrapped, key)
+		}
+		wrapped[0] ^= 1
+		if _, err := aesKeyUnwrap(kek, wrapped); err == nil {
+			t.Error("expected integrity check failure")
+		}
+	}
+}
+
+func TestPKIEnvelopeRoundTrip(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("SCEP pkiEnvelope content")
+	for _, key := range []crypto.Signer{rsaKey, p256Key, p384Key} {
+		cert := newEnvelopeTestCert(t, key)
+		for _, alg := range []int{
+			pkcs7.EncryptionAlgorithmDESCBC,
+			pkcs7.EncryptionAlgorithmAES128CBC,
+			pkcs7.EncryptionAlgorithmAES256CBC,
+			pkcs7.EncryptionAlgorithmAES128GCM,
+			pkcs7.EncryptionAlgorithmAES256GCM,
+		} {
+			data, err := encryptPKIEnvelope(content, []*x509.Certificate{cert}, alg, nil)
+			if err != nil {
+				t.Fatalf("%T, alg %d: %v", key, alg, err)
+			}
+			decrypted, err := decryptPKIEnvelope(data, cert, key)
+			if err != nil {
+				t.Fatalf("%T, alg %d: %v", key, alg, err)
+			}
+			if !bytes.Equal(decrypted, content) {
+				t.Errorf("%T, alg %d: have %q, want %q", key, alg, decrypted, content)
+			}
+		}
+	}
+
+	// a certificate which is not a recipient
+	data, err := encryptPKIEnvelope(content, []*x509.Certificate{newEnvelopeTestCert(t, p256Key)}, pkcs7.EncryptionAlgorithmAES128CBC, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decryptPKIEnvelope(data, newEnvelopeTestCert(t, rsaKey), rsaKey); err == nil {
+		t.Error("expected error for unknown recipient")
+	}
+}
+
+func TestPKIEnvelopeDecryptPKCS7(t *testing.T) {
+	// envelopes produced by the pkcs7 package must remain readable
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := newEnvelopeTestCert(t, key)
+	content := []byte("SCEP pkiEnvelope content")
+	for _, alg := range []int{pkcs7.EncryptionAlgorithmDESCBC, pkcs7.EncryptionAlgorithmAES256CBC} {
+		pkcs7.ContentEncryptionAlgorithm = alg
+		data, err := pkcs7.Encrypt(content, []*x509.Certificate{cert})
+		pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmDESCBC
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := decryptPKIEnvelope(data, cert, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, content) {
+			t.Errorf("have %q, want %q", decrypted, content)
+		}
+	}
+}
+
+func TestWithEncryptionAlgorithm(t *testing.T) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert := newEnvelopeTestCert(t, caKey)
+	clientCert := newEnvelopeTestCert(t, clientKey)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "encryption"},
+	}, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := NewCSRRequest(csr, &PKIMessage{
+		MessageType: PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerCert:  clientCert,
+		SignerKey:   clientKey,
+	}, WithEncryptionAlgorithm(AES256GCM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ParsePKIMessage(req.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEnvelopeAlgorithm(t, msg.p7.Content, pkcs7.OIDEncryptionAlgorithmAES256GCM)
+	if err := msg.DecryptPKIEnvelope(caCert, caKey); err != nil {
+		t.Fatal(err)
+	}
+
+	rep, err := msg.Success(caCert, caKey, clientCert, WithEncryptionAlgorithm(AES128CBC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err = ParsePKIMessage(rep.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEnvelopeAlgorithm(t, msg.p7.Content, pkcs7.OIDEncryptionAlgorithmAES128CBC)
+
+	if _, err := NewCSRRequest(csr, &PKIMessage{
+		MessageType: PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerCert:  clientCert,
+		SignerKey:   clientKey,
+	}, WithEncryptionAlgorithm(EncryptionAlgorithm(42))); err == nil {
+		t.Error("expected error for unknown encryption algorithm")
+	}
+}
+
+func checkEnvelopeAlgorithm(t *testing.T, data []byte, want asn1.ObjectIdentifier) {
+	t.Helper()
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(data, &ci); err != nil {
+		t.Fatal(err)
+	}
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		t.Fatal(err)
+	}
+	if have := ed.EncryptedContentInfo.ContentEncryptionAlgorithm.Algorithm; !have.Equal(want) {
+		t.Errorf("have content encryption %s, want %s", have, want)
+	}
+}
+
+func newEnvelopeTestCert(t testing.TB, key crypto.Signer) *x509.Certificate {
+	t.Helper()
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "envelope test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageKeyAgreement,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestKeyEncryptionSelector(t *testing.T) {
+	raKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raCert, caCert, ecCert := newEnvelopeTestCert(t, raKey), newEnvelopeTestCert(t, caKey), newEnvelopeTestCert(t, ecKey)
+	clientCert := newEnvelopeTestCert(t, clientKey)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "oaep"},
+	}, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &PKIMessage{
+		MessageType: PKCSReq,
+		Recipients:  []*x509.Certificate{raCert, caCert, ecCert},
+		SignerCert:  clientCert,
+		SignerKey:   clientKey,
+	}
+
+	// the CA supports OAEP, the RA only PKCS#1 v1.5
+	req, err := NewCSRRequest(csr, tmpl, WithKeyEncryptionSelector(func(recipient *x509.Certificate) KeyEncryptionAlgorithm {
+		if recipient.Equal(caCert) {
+			return RSAOAEP
+		}
+		return 0
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ParsePKIMessage(req.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []struct {
+		cert *x509.Certificate
+		key  crypto.PrivateKey
+		oaep bool
+	}{
+		{raCert, raKey, false},
+		{caCert, caKey, true},
+		{ecCert, ecKey, false},
+	} {
+		env, err := msg.OpenEnvelope(r.cert, r.key)
+		if err != nil {
+			t.Fatalf("%s: %v", r.cert.Subject, err)
+		}
+		if !bytes.Equal(env.CSRReqMessage.RawDecrypted, der) {
+			t.Errorf("%s: opened another CSR", r.cert.Subject)
+		}
+		if err := checkEnvelopeOAEP(msg.p7.Content, r.cert); (err == nil) != (r.oaep || r.cert == ecCert) {
+			t.Errorf("%s: have OAEP check %v, want OAEP %t", r.cert.Subject, err, r.oaep)
+		}
+	}
+
+	// parsed with WithRequireOAEP, only the CA may open the request
+	strict, err := ParsePKIMessage(req.Raw, WithRequireOAEP())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := strict.OpenEnvelope(raCert, raKey); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("RA opened a PKCS#1 v1.5 pkiEnvelope: %v", err)
+	}
+	if _, err := strict.OpenEnvelope(caCert, caKey); err != nil {
+		t.Fatal(err)
+	}
+	// and the reply requires OAEP too
+	rep, err := strict.Success(caCert, caKey, clientCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repMsg, err := ParsePKIMessage(rep.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEnvelopeOAEP(repMsg.p7.Content, clientCert); err != nil {
+		t.Error(err)
+	}
+	if _, err := repMsg.OpenEnvelope(clientCert, clientKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// without WithRequireOAEP the reply uses OAEP because the request did
+	rep, err = msg.Success(raCert, raKey, clientCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repMsg, err = ParsePKIMessage(rep.Raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEnvelopeOAEP(repMsg.p7.Content, clientCert); err != nil {
+		t.Error(err)
+	}
+	// unless the request was parsed with another algorithm
+	msg, err = ParsePKIMessage(req.Raw, WithKeyEncryptionAlgorithm(RSAPKCS1v15))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep, err = msg.Success(raCert, raKey, clientCert); err != nil {
+		t.Fatal(err)
+	}
+	if repMsg, err = ParsePKIMessage(rep.Raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkEnvelopeOAEP(repMsg.p7.Content, clientCert); err == nil {
+		t.Error("reply uses OAEP, want PKCS#1 v1.5")
+	}
+
+	if _, err := NewCSRRequest(csr, tmpl, WithRequireOAEP(), WithKeyEncryptionAlgorithm(RSAPKCS1v15)); err == nil {
+		t.Error("selected PKCS#1 v1.5 with WithRequireOAEP")
+	}
+	if _, err := NewCSRRequest(csr, tmpl, WithKeyEncryptionAlgorithm(KeyEncryptionAlgorithm(42))); err == nil {
+		t.Error("expected error for unknown key encryption algorithm")
+	}
+}
+
+func TestSuccessSeparateEncryptionKey(t *testing.T) {
+	encKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encCert, caCert, clientCert := newEnvelopeTestCert(t, encKey), newEnvelopeTestCert(t, caKey), newEnvelopeTestCert(t, clientKey)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "ra encryption"},
+	}, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the request is encrypted to the RA encryption certificate only
+	req, err := NewCSRRequest(csr, &PKIMessage{
+		MessageType: PKCSReq,
+		Recipients:  []*x509.Certificate{encCert},
+		SignerCert:  clientCert,
+		SignerKey:   clientKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ParsePKIMessage(req.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := msg.OpenEnvelope(encCert, encKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := msg.OpenEnvelope(caCert, caKey); err == nil {
+		t.Fatal("CA opened a request encrypted to the RA")
+	}
+
+	// and answered by the CA, which cannot open it
+	rep, err := msg.Success(caCert, caKey, clientCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repMsg, err := ParsePKIMessage(rep.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repMsg.OpenEnvelope(clientCert, clientKey); err != nil {
+		t.Fatal(err)
+	}
+}
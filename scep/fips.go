@@ -0,0 +1,103 @@
+package scep
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/pkcs7"
+)
+
+// ErrNotFIPSApproved is wrapped by the errors for messages, keys and
+// configured algorithms that are not FIPS-approved in FIPS mode, see
+// WithFIPS.
+var ErrNotFIPSApproved = errors.New("scep: algorithm not FIPS-approved")
+
+// WithFIPS restricts parsed and created messages to FIPS-approved
+// algorithms: SHA-256 or stronger digests, AES content encryption, RSA keys
+// of at least 2048 bits and ECDSA keys on P-256, P-384 or P-521. Other
+// messages fail with an error wrapping ErrNotFIPSApproved before they are
+// decrypted or signed. Created messages default to SHA-256, AES-128-CBC
+// and RSAOAEP key transport, since RSAES-PKCS1-v1_5 encryption is
+// unavailable in strict FIPS 140 builds; RSAPKCS1v15 may still be selected
+// for CAs which do not support RSAES-OAEP.
+//
+// FIPS mode is always on in binaries built with GOEXPERIMENT=boringcrypto
+// or run with the Go FIPS 140 module enabled, see FIPSMode.
+func WithFIPS() Option {
+	return func(c *config) {
+		c.fips = true
+	}
+}
+
+// FIPSMode reports whether FIPS mode is enforced for the whole process,
+// without WithFIPS: in boringcrypto builds and with GODEBUG=fips140=on.
+func FIPSMode() bool {
+	return boringCrypto || fips140Enabled()
+}
+
+func (conf *config) fipsMode() bool {
+	return conf.fips || FIPSMode()
+}
+
+func fipsError(format string, args ...interface{}) error {
+	return &kindError{kind: ErrNotFIPSApproved, err: errors.Errorf("scep: "+format+" is not FIPS-approved", args...)}
+}
+
+// CheckFIPSKey returns an error wrapping ErrNotFIPSApproved unless pub is
+// an RSA key of at least 2048 bits or an ECDSA key on P-256, P-384 or
+// P-521.
+func CheckFIPSKey(pub crypto.PublicKey) error {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if bits := pub.N.BitLen(); bits < 2048 {
+			return fipsError("%d bit RSA key", bits)
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		switch bits := pub.Curve.Params().BitSize; bits {
+		case 256, 384, 521:
+			return nil
+		default:
+			return fipsError("ECDSA key on %s", pub.Curve.Params().Name)
+		}
+	default:
+		return fipsError("%T key", pub)
+	}
+}
+
+// checkFIPS returns an error wrapping ErrNotFIPSApproved if a signer of
+// the parsed p7 uses a digest weaker than SHA-256 or a key that is not
+// approved.
+func checkFIPS(p7 *pkcs7.PKCS7) error {
+	for _, signer := range p7.Signers {
+		if h, ok := digestHash(signer.DigestAlgorithm.Algorithm); !ok || h.Size() < crypto.SHA256.Size() {
+			return fipsError("signer digest algorithm %s", algorithmName(signer.DigestAlgorithm.Algorithm))
+		}
+	}
+	if crt := p7.GetOnlySigner(); crt != nil {
+		return CheckFIPSKey(crt.PublicKey)
+	}
+	return nil
+}
+
+// checkEnvelopeFIPS returns an error wrapping ErrNotFIPSApproved if the
+// pkiEnvelope data is not encrypted with AES or the key of the recipient
+// cert is not approved.
+func checkEnvelopeFIPS(data []byte, cert *x509.Certificate) error {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(data, &ci); err != nil {
+		return errors.Wrap(err, "scep: parse pkiEnvelope")
+	}
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		return errors.Wrap(err, "scep: parse pkiEnvelope EnvelopedData")
+	}
+	if alg := ed.EncryptedContentInfo.ContentEncryptionAlgorithm.Algorithm; !isAES(alg) {
+		return fipsError("pkiEnvelope content encryption algorithm %s", algorithmName(alg))
+	}
+	return CheckFIPSKey(cert.PublicKey)
+}
@@ -0,0 +1,12 @@
+//go:build go1.24
+// +build go1.24
+
+package scep
+
+import "crypto/fips140"
+
+// fips140Enabled reports whether the Go FIPS 140 module is enabled, e.g.
+// with GODEBUG=fips140=on.
+func fips140Enabled() bool {
+	return fips140.Enabled()
+}
@@ -0,0 +1,10 @@
+//go:build !go1.24
+// +build !go1.24
+
+package scep
+
+// fips140Enabled reports false, Go releases before 1.24 have no FIPS 140
+// module.
+func fips140Enabled() bool {
+	return false
+}
@@ -0,0 +1,7 @@
+//go:build boringcrypto
+// +build boringcrypto
+
+package scep
+
+// boringCrypto is set in binaries built with GOEXPERIMENT=boringcrypto.
+const boringCrypto = true
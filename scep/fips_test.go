@@ -0,0 +1,156 @@
+package scep
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"testing"
+)
+
+func TestCheckFIPSKey(t *testing.T) {
+	rsa1024, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsa2048, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p224, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name     string
+		pub      crypto.PublicKey
+		approved bool
+	}{
+		{"RSA 1024", &rsa1024.PublicKey, false},
+		{"RSA 2048", &rsa2048.PublicKey, true},
+		{"P-224", &p224.PublicKey, false},
+		{"P-256", &p256.PublicKey, true},
+		{"Ed25519", edPub, false},
+	} {
+		err := CheckFIPSKey(tc.pub)
+		if tc.approved && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if !tc.approved && !errors.Is(err, ErrNotFIPSApproved) {
+			t.Errorf("%s: have %v, want ErrNotFIPSApproved", tc.name, err)
+		}
+	}
+}
+
+func TestWithFIPS(t *testing.T) {
+	if FIPSMode() {
+		t.Skip("FIPS mode is enforced for the process")
+	}
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	weakKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, clientCert, weakCert := newEnvelopeTestCert(t, caKey), newEnvelopeTestCert(t, clientKey), newEnvelopeTestCert(t, weakKey)
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "fips"},
+	}, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &PKIMessage{
+		MessageType: PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerCert:  clientCert,
+		SignerKey:   clientKey,
+	}
+
+	// created messages default to approved algorithms
+	req, err := NewCSRRequest(csr, tmpl, WithFIPS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ParsePKIMessage(req.Raw, WithFIPS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alg, err := msg.ContentEncryptionAlgorithm(); err != nil || !isAES(alg) {
+		t.Errorf("have content encryption %v, %v, want AES", alg, err)
+	}
+	if err := checkEnvelopeOAEP(msg.p7.Content, caCert); err != nil {
+		t.Error(err)
+	}
+	if _, err := msg.OpenEnvelope(caCert, caKey); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := msg.Success(caCert, caKey, clientCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParsePKIMessage(rep.Raw, WithFIPS()); err != nil {
+		t.Fatal(err)
+	}
+
+	// weaker configured algorithms and keys fail before signing
+	for name, opts := range map[string][]Option{
+		"SHA-1":    {WithFIPS(), WithDigestAlgorithm(crypto.SHA1)},
+		"DES3-CBC": {WithFIPS(), WithEncryptionAlgorithm(DES3CBC)},
+	} {
+		if _, err := NewCSRRequest(csr, tmpl, opts...); !errors.Is(err, ErrNotFIPSApproved) {
+			t.Errorf("%s: have %v, want ErrNotFIPSApproved", name, err)
+		}
+	}
+	weak := *tmpl
+	weak.Recipients = []*x509.Certificate{weakCert}
+	if _, err := NewCSRRequest(csr, &weak, WithFIPS()); !errors.Is(err, ErrNotFIPSApproved) {
+		t.Errorf("1024 bit recipient: have %v, want ErrNotFIPSApproved", err)
+	}
+	weak = *tmpl
+	weak.SignerCert, weak.SignerKey = weakCert, weakKey
+	if _, err := NewCSRRequest(csr, &weak, WithFIPS()); !errors.Is(err, ErrNotFIPSApproved) {
+		t.Errorf("1024 bit signer: have %v, want ErrNotFIPSApproved", err)
+	}
+
+	// and parsed messages using them fail before decryption
+	legacy, err := NewCSRRequest(csr, tmpl, WithDigestAlgorithm(crypto.SHA1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParsePKIMessage(legacy.Raw, WithFIPS()); !errors.Is(err, ErrNotFIPSApproved) {
+		t.Errorf("SHA-1 request: have %v, want ErrNotFIPSApproved", err)
+	}
+	legacy, err = NewCSRRequest(csr, tmpl, WithDigestAlgorithm(crypto.SHA256), WithEncryptionAlgorithm(DES3CBC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = ParsePKIMessage(legacy.Raw, WithFIPS()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := msg.OpenEnvelope(caCert, caKey); !errors.Is(err, ErrNotFIPSApproved) {
+		t.Errorf("DES3 pkiEnvelope: have %v, want ErrNotFIPSApproved", err)
+	}
+}
@@ -0,0 +1,127 @@
+//go:build go1.18
+// +build go1.18
+
+package scep
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// FuzzParsePKIMessage checks that malformed messages are rejected with an
+// error. The corpus is seeded with the messages in testdata.
+func FuzzParsePKIMessage(f *testing.F) {
+	files, err := filepath.Glob("testdata/*/*.der")
+	if err != nil {
+		f.Fatal(err)
+	}
+	top, err := filepath.Glob("testdata/*.der")
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, file := range append(top, files...) {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		f.Fatal(err)
+	}
+	cert := newEnvelopeTestCert(f, key)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, s := range []Strictness{Strict, Lenient} {
+			msg, err := ParsePKIMessage(data, WithStrictness(s))
+			if err != nil {
+				continue
+			}
+			_ = msg.MessageType.String()
+			if msg.CertRepMessage != nil {
+				_ = msg.FailInfo.String()
+			}
+			// the recipient does not match, but the envelope is parsed
+			_ = msg.DecryptPKIEnvelope(cert, key)
+		}
+	})
+}
+
+// FuzzDecryptPKIEnvelope checks that malformed pkiEnvelopes, and malformed
+// contents of well-formed ones, are rejected with an error. The corpus is
+// seeded with envelopes for both RSA key transport and ECDH key agreement
+// recipients.
+func FuzzDecryptPKIEnvelope(f *testing.F) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		f.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		f.Fatal(err)
+	}
+	rsaCert, ecCert := newEnvelopeTestCert(f, rsaKey), newEnvelopeTestCert(f, ecKey)
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "fuzz"},
+	}, rsaKey)
+	if err != nil {
+		f.Fatal(err)
+	}
+	degenerate, err := DegenerateCertificates([]*x509.Certificate{rsaCert})
+	if err != nil {
+		f.Fatal(err)
+	}
+	ias, err := asn1.Marshal(NewIssuerAndSerial(rsaCert))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, seed := range []struct {
+		msgType MessageType
+		content []byte
+	}{
+		{PKCSReq, csr},
+		{CertRep, degenerate},
+		{GetCert, ias},
+		{GetCRL, ias},
+	} {
+		for _, alg := range []int{pkcs7.EncryptionAlgorithmAES128CBC, pkcs7.EncryptionAlgorithmAES256GCM} {
+			data, err := encryptPKIEnvelope(seed.content, []*x509.Certificate{rsaCert, ecCert}, alg, nil)
+			if err != nil {
+				f.Fatal(err)
+			}
+			f.Add(string(seed.msgType), data, false)
+			f.Add(string(seed.msgType), data, true)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, msgType string, data []byte, ecdh bool) {
+		var (
+			cert *x509.Certificate = rsaCert
+			key  crypto.PrivateKey = rsaKey
+		)
+		if ecdh {
+			cert, key = ecCert, ecKey
+		}
+		msg := &PKIMessage{
+			MessageType:    MessageType(msgType),
+			CertRepMessage: &CertRepMessage{},
+			p7:             &pkcs7.PKCS7{Content: data},
+			logger:         nopLogger{},
+		}
+		_ = msg.DecryptPKIEnvelope(cert, key)
+		_ = msg.MessageType.String()
+	})
+}
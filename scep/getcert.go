@@ -0,0 +1,90 @@
+package scep
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+// IssuerAndSerial identifies a certificate by the DER encoded name of its
+// issuer and its serial number. It is the pkiEnvelope content of GetCert
+// and GetCRL requests.
+type IssuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+// NewIssuerAndSerial returns the IssuerAndSerial of cert.
+func NewIssuerAndSerial(cert *x509.Certificate) IssuerAndSerial {
+	return IssuerAndSerial{
+		Issuer:       asn1.RawValue{FullBytes: cert.RawIssuer},
+		SerialNumber: cert.SerialNumber,
+	}
+}
+
+// Matches reports whether cert is the certificate identified by ias.
+func (ias IssuerAndSerial) Matches(cert *x509.Certificate) bool {
+	if cert == nil || ias.SerialNumber == nil {
+		return false
+	}
+	return cert.SerialNumber.Cmp(ias.SerialNumber) == 0 &&
+		bytes.Equal(cert.RawIssuer, ias.Issuer.FullBytes)
+}
+
+func parseIssuerAndSerial(data []byte) (IssuerAndSerial, error) {
+	var ias IssuerAndSerial
+	rest, err := asn1.Unmarshal(data, &ias)
+	if err != nil {
+		return ias, errors.Wrap(err, "scep: parse IssuerAndSerialNumber in pkiEnvelope")
+	}
+	if len(rest) > 0 {
+		return ias, errors.New("scep: trailing data after IssuerAndSerialNumber")
+	}
+	return ias, nil
+}
+
+// GetCertMessage is a GetCert request for a previously issued certificate.
+// The content of this message is protected by the recipient public key.
+type GetCertMessage struct {
+	IssuerAndSerial
+}
+
+// NewGetCertRequest creates a scep PKI GetCert message asking for the
+// certificate identified by ias. The Recipients, SignerCert and SignerKey of
+// tmpl are used to encrypt and sign the request.
+func NewGetCertRequest(ias IssuerAndSerial, tmpl *PKIMessage, opts ...Option) (*PKIMessage, error) {
+	conf := &config{logger: nopLogger{}, certsSelector: NopCertsSelector()}
+	for _, opt := range opts {
+		opt(conf)
+	}
+
+	content, err := asn1.Marshal(ias)
+	if err != nil {
+		return nil, err
+	}
+
+	// GetCert is not bound to a key pair being enrolled, so the
+	// transaction ID is random.
+	id, err := newNonce(DefaultNonceSize)
+	if err != nil {
+		return nil, err
+	}
+	tID := TransactionID(base64.StdEncoding.EncodeToString(id))
+
+	debug(conf.logger,
+		"msg", "creating SCEP GetCert request",
+		"transaction_id", tID,
+		"serial", ias.SerialNumber,
+	)
+
+	newMsg, err := newRequest(content, tID, GetCert, tmpl, conf)
+	if err != nil {
+		return nil, err
+	}
+	newMsg.GetCertMessage = &GetCertMessage{IssuerAndSerial: ias}
+	return newMsg, nil
+}
@@ -0,0 +1,72 @@
+package scep
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/pkcs7"
+)
+
+// SignerInfo describes the signer of the outer SignedData of a parsed
+// PKIMessage.
+type SignerInfo struct {
+	// Certificate is the certificate of the signer, which
+	// ParsePKIMessage also sets as the SignerCert of the message.
+	Certificate *x509.Certificate
+
+	// DigestAlgorithm is the OID of the digest algorithm, e.g.
+	// pkcs7.OIDDigestAlgorithmSHA256.
+	DigestAlgorithm asn1.ObjectIdentifier
+
+	// SignatureAlgorithm is the OID of the digestEncryptionAlgorithm, e.g.
+	// pkcs7.OIDEncryptionAlgorithmRSA or
+	// pkcs7.OIDEncryptionAlgorithmRSASHA256.
+	SignatureAlgorithm asn1.ObjectIdentifier
+}
+
+// PKCS7 returns the outer SignedData of a message parsed with
+// ParsePKIMessage, or nil for a created message. It must not be modified.
+func (msg *PKIMessage) PKCS7() *pkcs7.PKCS7 {
+	return msg.p7
+}
+
+// SignerInfo returns the signer of the outer SignedData of a message
+// parsed with ParsePKIMessage.
+func (msg *PKIMessage) SignerInfo() (*SignerInfo, error) {
+	if msg.p7 == nil || len(msg.p7.Signers) == 0 {
+		return nil, errors.New("scep: message has no parsed signer")
+	}
+	signer := msg.p7.Signers[0]
+	return &SignerInfo{
+		Certificate:        msg.p7.GetOnlySigner(),
+		DigestAlgorithm:    signer.DigestAlgorithm.Algorithm,
+		SignatureAlgorithm: signer.DigestEncryptionAlgorithm.Algorithm,
+	}, nil
+}
+
+// ContentEncryptionAlgorithm returns the OID of the content encryption
+// algorithm of the pkiEnvelope of a message parsed with ParsePKIMessage,
+// e.g. pkcs7.OIDEncryptionAlgorithmAES128CBC. The pkiEnvelope does not
+// need to be decrypted. Messages without a pkiEnvelope, like FAILURE
+// CertReps, return nil.
+func (msg *PKIMessage) ContentEncryptionAlgorithm() (asn1.ObjectIdentifier, error) {
+	if msg.p7 == nil {
+		return nil, errors.New("scep: message is not parsed")
+	}
+	if len(msg.p7.Content) == 0 {
+		return nil, nil
+	}
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(normalizeBER(msg.p7.Content), &ci); err != nil {
+		return nil, errors.Wrap(err, "scep: parse pkiEnvelope")
+	}
+	if !ci.ContentType.Equal(pkcs7.OIDEnvelopedData) {
+		return nil, errors.New("scep: pkiEnvelope is not an EnvelopedData")
+	}
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		return nil, errors.Wrap(err, "scep: parse pkiEnvelope EnvelopedData")
+	}
+	return ed.EncryptedContentInfo.ContentEncryptionAlgorithm.Algorithm, nil
+}
@@ -0,0 +1,179 @@
+package scep_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/micromdm/scep/v2/cryptoutil/x509util"
+	"github.com/micromdm/scep/v2/scep"
+	"go.mozilla.org/pkcs7"
+)
+
+func TestSignerInfo(t *testing.T) {
+	key, err := newRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := newCSR(key, "john.doe@example.com", "US", "inspect")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientcert, clientkey := loadClientCredentials(t)
+	cacert, cakey := loadCACredentials(t)
+	req, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{cacert},
+		SignerCert:  clientcert,
+		SignerKey:   clientkey,
+	}, scep.WithDigestAlgorithm(crypto.SHA256), scep.WithEncryptionAlgorithm(scep.AES256GCM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.PKCS7() != nil {
+		t.Error("created message has a parsed SignedData")
+	}
+
+	msg := testParsePKIMessage(t, req.Raw)
+	if p7 := msg.PKCS7(); p7 == nil || len(p7.Signers) != 1 {
+		t.Fatal("parsed message has no SignedData")
+	}
+	si, err := msg.SignerInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !si.Certificate.Equal(clientcert) {
+		t.Errorf("have signer %s, want %s", si.Certificate.Subject, clientcert.Subject)
+	}
+	if !si.DigestAlgorithm.Equal(pkcs7.OIDDigestAlgorithmSHA256) {
+		t.Errorf("have digest %s, want SHA-256", si.DigestAlgorithm)
+	}
+	if !si.SignatureAlgorithm.Equal(pkcs7.OIDEncryptionAlgorithmRSASHA256) {
+		t.Errorf("have signature algorithm %s, want sha256WithRSAEncryption", si.SignatureAlgorithm)
+	}
+	alg, err := msg.ContentEncryptionAlgorithm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !alg.Equal(pkcs7.OIDEncryptionAlgorithmAES256GCM) {
+		t.Errorf("have content encryption %s, want AES-256-GCM", alg)
+	}
+
+	// a FAILURE CertRep has no pkiEnvelope
+	failed, err := msg.Fail(cacert, cakey, scep.BadRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := testParsePKIMessage(t, failed.Raw)
+	if alg, err := rep.ContentEncryptionAlgorithm(); err != nil || alg != nil {
+		t.Errorf("have %s, %v, want no content encryption", alg, err)
+	}
+}
+
+func TestDump(t *testing.T) {
+	key, err := newRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509util.CreateCertificateRequest(rand.Reader, &x509util.CertificateRequest{
+		CertificateRequest: x509.CertificateRequest{
+			Subject:  pkix.Name{CommonName: "inspect"},
+			DNSNames: []string{"device.example.com"},
+		},
+		ChallengePassword: "secret challenge",
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientcert, clientkey := loadClientCredentials(t)
+	cacert, cakey := loadCACredentials(t)
+	req, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{cacert},
+		SignerCert:  clientcert,
+		SignerKey:   clientkey,
+	}, scep.WithDigestAlgorithm(crypto.SHA256), scep.WithEncryptionAlgorithm(scep.AES128CBC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := testParsePKIMessage(t, req.Raw)
+
+	var buf bytes.Buffer
+	if err := msg.Dump(&buf, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"transactionID:    " + string(req.TransactionID),
+		"messageType:      PKCSReq (19)",
+		"senderNonce:      " + hex.EncodeToString(req.SenderNonce),
+		"signer:           " + clientcert.Subject.String(),
+		"digest:           SHA-256 (2.16.840.1.101.3.4.2.1)",
+		"encryption:       AES-128-CBC (2.16.840.1.101.3.4.1.2)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "csr subject") {
+		t.Errorf("pkiEnvelope described without a key:\n%s", out)
+	}
+
+	buf.Reset()
+	if err := msg.Dump(&buf, cacert, cakey); err != nil {
+		t.Fatal(err)
+	}
+	out = buf.String()
+	for _, want := range []string{
+		"csr subject:      CN=inspect",
+		"csr key:          RSA 2048 bits",
+		"csr dns:          device.example.com",
+		"csr challenge:    present",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "secret challenge") {
+		t.Errorf("challengePassword written:\n%s", out)
+	}
+	if msg.CSRReqMessage != nil {
+		t.Error("Dump decrypted the pkiEnvelope into the message")
+	}
+
+	// a CertRep describes its status and, opened by the requester, the
+	// issued certificate
+	certRep, err := msg.Success(cacert, cakey, clientcert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := testParsePKIMessage(t, certRep.Raw)
+	buf.Reset()
+	if err := rep.Dump(&buf, clientcert, clientkey); err != nil {
+		t.Fatal(err)
+	}
+	out = buf.String()
+	for _, want := range []string{
+		"messageType:      CertRep (3)",
+		"recipientNonce:   " + hex.EncodeToString(req.SenderNonce),
+		"pkiStatus:        SUCCESS (0)",
+		"cert subject:     " + clientcert.Subject.String(),
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+// Package kitlog adapts go-kit loggers to the scep.Logger interface.
+package kitlog
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/micromdm/scep/v2/scep"
+)
+
+type logger struct {
+	next log.Logger
+}
+
+// New returns a scep.Logger logging to next with the go-kit level values,
+// so the events of the scep package are filtered by level.NewFilter.
+func New(next log.Logger) scep.Logger {
+	return logger{next: next}
+}
+
+func (l logger) Log(keyvals ...interface{}) error {
+	kvs := make([]interface{}, len(keyvals))
+	copy(kvs, keyvals)
+	for i := 0; i+1 < len(kvs); i += 2 {
+		if kvs[i] != scep.LevelKey {
+			continue
+		}
+		switch kvs[i+1] {
+		case scep.LevelDebug:
+			kvs[i], kvs[i+1] = level.Key(), level.DebugValue()
+		case scep.LevelWarn:
+			kvs[i], kvs[i+1] = level.Key(), level.WarnValue()
+		}
+	}
+	return l.next.Log(kvs...)
+}
@@ -0,0 +1,22 @@
+package kitlog_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/micromdm/scep/v2/scep"
+	"github.com/micromdm/scep/v2/scep/kitlog"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger := kitlog.New(level.NewFilter(log.NewLogfmtLogger(&buf), level.AllowInfo()))
+	logger.Log(scep.LevelKey, scep.LevelDebug, "msg", "filtered")
+	logger.Log(scep.LevelKey, scep.LevelWarn, "msg", "logged")
+	if have, want := strings.TrimSpace(buf.String()), "level=warn msg=logged"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
@@ -0,0 +1,37 @@
+package scep
+
+// Logger is the structured logger of the package, logging alternating keys
+// and values. It has the method set of the go-kit log.Logger, which can be
+// used directly or wrapped with the kitlog package to keep filtering by
+// level.
+type Logger interface {
+	Log(keyvals ...interface{}) error
+}
+
+// Level is the value of the LevelKey of the logged events.
+type Level string
+
+// LevelKey is the key of the level of the logged events.
+const LevelKey = "level"
+
+// Levels of the logged events.
+const (
+	LevelDebug Level = "debug"
+	LevelWarn  Level = "warn"
+)
+
+func (l Level) String() string {
+	return string(l)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(...interface{}) error { return nil }
+
+func debug(logger Logger, keyvals ...interface{}) {
+	logger.Log(append([]interface{}{LevelKey, LevelDebug}, keyvals...)...)
+}
+
+func warn(logger Logger, keyvals ...interface{}) {
+	logger.Log(append([]interface{}{LevelKey, LevelWarn}, keyvals...)...)
+}
@@ -0,0 +1,74 @@
+package scep
+
+import (
+	"crypto"
+	"crypto/x509"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/pkcs7"
+)
+
+// NextCACert returns a GetNextCACert response, see RFC 8894 section 4.7:
+// the degenerate certificates-only PKCS#7 of the next CA certificate (and
+// any RA certificates) in next, signed by the current CA certificate crtAuth
+// and key keyAuth. The digest algorithm may be set with WithDigestAlgorithm
+// and defaults to SHA-256.
+func NextCACert(crtAuth *x509.Certificate, keyAuth crypto.Signer, next []*x509.Certificate, opts ...Option) ([]byte, error) {
+	conf := &config{digestAlgorithm: crypto.SHA256}
+	for _, opt := range opts {
+		opt(conf)
+	}
+	if len(next) < 1 {
+		return nil, errors.New("scep: no next CA certificate")
+	}
+	deg, err := DegenerateCertificates(next)
+	if err != nil {
+		return nil, err
+	}
+	sd, err := conf.newSignedData(deg)
+	if err != nil {
+		return nil, err
+	}
+	if err := sd.AddSigner(crtAuth, keyAuth, pkcs7.SignerInfoConfig{}); err != nil {
+		return nil, err
+	}
+	return sd.Finish()
+}
+
+// ParseNextCACert verifies a GetNextCACert response and returns the next CA
+// certificates. The response must be signed by one of the current CA
+// certificates caCerts, as obtained with GetCACert, and contain a CA
+// certificate.
+func ParseNextCACert(data []byte, caCerts []*x509.Certificate) ([]*x509.Certificate, error) {
+	p7, err := parsePKCS7(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(p7.Signers) != 1 {
+		return nil, errors.New("scep: GetNextCACert response must have a single signer")
+	}
+	// only the current CA certificates may sign the rollover
+	p7.Certificates = caCerts
+	if err := p7.Verify(); err != nil {
+		return nil, errors.Wrap(err, "scep: verifying GetNextCACert response")
+	}
+	next, err := CACerts(p7.Content)
+	if err != nil {
+		return nil, errors.Wrap(err, "scep: parsing next CA certificates")
+	}
+	for _, cert := range next {
+		if cert.IsCA && !isCurrent(cert, caCerts) {
+			return next, nil
+		}
+	}
+	return nil, errors.New("scep: GetNextCACert response has no new CA certificate")
+}
+
+func isCurrent(cert *x509.Certificate, caCerts []*x509.Certificate) bool {
+	for _, ca := range caCerts {
+		if cert.Equal(ca) {
+			return true
+		}
+	}
+	return false
+}
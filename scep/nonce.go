@@ -0,0 +1,91 @@
+package scep
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultNonceSize is the size in bytes of the senderNonce of created
+// messages, unless set with WithNonceSize.
+const DefaultNonceSize = 16
+
+// ErrNonceSize is wrapped by the errors of ParsePKIMessage for a message
+// whose senderNonce or recipientNonce is outside the range set with
+// WithNonceSizeRange.
+var ErrNonceSize = errors.New("scep: nonce size out of range")
+
+// WithNonceSize sets the size in bytes of the senderNonce of created
+// requests. RFC 8894 requires 16 bytes, the default, but some CAs expect
+// 8 or 20 byte nonces.
+func WithNonceSize(n int) Option {
+	return func(c *config) {
+		c.nonceSize = n
+	}
+}
+
+// WithNonceSizeRange makes ParsePKIMessage reject messages with a
+// senderNonce, or the recipientNonce of a CertRep, shorter than min or
+// longer than max bytes; a max of 0 sets no upper bound. By default nonces
+// of any size are accepted.
+// WithRFC8894Strict requires exactly 16 bytes regardless.
+func WithNonceSizeRange(min, max int) Option {
+	return func(c *config) {
+		c.nonceMin, c.nonceMax = min, max
+	}
+}
+
+// Equal reports whether n and other are the same nonce, in constant time.
+func (n SenderNonce) Equal(other []byte) bool {
+	return subtle.ConstantTimeCompare(n, other) == 1
+}
+
+// Matches reports whether n echoes the senderNonce sn of a request, in
+// constant time. An empty nonce never matches.
+func (n RecipientNonce) Matches(sn SenderNonce) bool {
+	return len(n) > 0 && subtle.ConstantTimeCompare(n, sn) == 1
+}
+
+// newSenderNonce returns a random senderNonce of the configured size.
+func (conf *config) newSenderNonce() (SenderNonce, error) {
+	size := conf.nonceSize
+	if size == 0 {
+		size = DefaultNonceSize
+	}
+	if size < 0 {
+		return nil, errors.Errorf("scep: invalid nonce size %d", size)
+	}
+	return newNonce(size)
+}
+
+func newNonce(size int) (SenderNonce, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return SenderNonce(b), nil
+}
+
+// checkNonceSize returns an error wrapping ErrNonceSize if a nonce of the
+// parsed msg is outside the range set with WithNonceSizeRange. Absent
+// nonces are left to the attribute checks.
+func (conf *config) checkNonceSize(msg *PKIMessage) error {
+	if conf.nonceMin == 0 && conf.nonceMax == 0 {
+		return nil
+	}
+	check := func(name string, nonce []byte) error {
+		if len(nonce) == 0 || (len(nonce) >= conf.nonceMin && (conf.nonceMax == 0 || len(nonce) <= conf.nonceMax)) {
+			return nil
+		}
+		return &kindError{kind: ErrNonceSize, err: errors.Errorf("scep: %s has %d bytes, want %d to %d",
+			name, len(nonce), conf.nonceMin, conf.nonceMax)}
+	}
+	if err := check("senderNonce", msg.SenderNonce); err != nil {
+		return err
+	}
+	if msg.CertRepMessage != nil {
+		return check("recipientNonce", msg.CertRepMessage.RecipientNonce)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package scep_test
+
+import (
+	"crypto/x509"
+	"errors"
+	"testing"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+func TestNonceSize(t *testing.T) {
+	key, err := newRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := newCSR(key, "john.doe@example.com", "US", "nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientcert, clientkey := loadClientCredentials(t)
+	cacert, cakey := loadCACredentials(t)
+	tmpl := &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{cacert},
+		SignerCert:  clientcert,
+		SignerKey:   clientkey,
+	}
+	req, err := scep.NewCSRRequest(csr, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(req.SenderNonce), scep.DefaultNonceSize; have != want {
+		t.Errorf("have %d byte senderNonce, want %d", have, want)
+	}
+	req, err = scep.NewCSRRequest(csr, tmpl, scep.WithNonceSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(req.SenderNonce), 8; have != want {
+		t.Errorf("have %d byte senderNonce, want %d", have, want)
+	}
+
+	// nonces of any size are accepted by default
+	msg := testParsePKIMessage(t, req.Raw)
+	if !msg.SenderNonce.Equal(req.SenderNonce) {
+		t.Error("parsed another senderNonce")
+	}
+	if _, err := scep.ParsePKIMessage(req.Raw, scep.WithNonceSizeRange(8, 20)); err != nil {
+		t.Errorf("8 byte nonce rejected by 8 to 20 range: %v", err)
+	}
+	if _, err := scep.ParsePKIMessage(req.Raw, scep.WithNonceSizeRange(16, 0)); !errors.Is(err, scep.ErrNonceSize) {
+		t.Errorf("have %v, want ErrNonceSize", err)
+	}
+
+	// the recipientNonce of the CertRep is checked too
+	certRep, err := msg.Success(cacert, cakey, clientcert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scep.ParsePKIMessage(certRep.Raw, scep.WithNonceSizeRange(16, 16)); !errors.Is(err, scep.ErrNonceSize) {
+		t.Errorf("have %v, want ErrNonceSize", err)
+	}
+	rep := testParsePKIMessage(t, certRep.Raw)
+	if !rep.RecipientNonce.Matches(req.SenderNonce) {
+		t.Error("recipientNonce does not match the senderNonce")
+	}
+	if rep.RecipientNonce.Matches(req.SenderNonce[:4]) || scep.RecipientNonce(nil).Matches(nil) {
+		t.Error("recipientNonce matches another senderNonce")
+	}
+
+	if _, err := scep.NewCSRRequest(csr, tmpl, scep.WithNonceSize(-1)); err == nil {
+		t.Error("created a request with a negative nonce size")
+	}
+}
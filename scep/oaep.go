@@ -0,0 +1,245 @@
+package scep
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/pkcs7"
+)
+
+// KeyEncryptionAlgorithm is the algorithm encrypting the content encryption
+// key of a pkiEnvelope for an RSA recipient. EC recipients always use key
+// agreement.
+type KeyEncryptionAlgorithm int
+
+// Supported key transport algorithms of RSA recipients.
+const (
+	// RSAPKCS1v15 is RSAES-PKCS1-v1_5, the only algorithm of RFC 8894 and
+	// the default.
+	RSAPKCS1v15 KeyEncryptionAlgorithm = iota + 1
+	// RSAOAEP is RSAES-OAEP with SHA-256 and MGF1 with SHA-256, RFC 4055.
+	RSAOAEP
+)
+
+func (alg KeyEncryptionAlgorithm) String() string {
+	switch alg {
+	case RSAPKCS1v15:
+		return "RSAES-PKCS1-v1_5"
+	case RSAOAEP:
+		return "RSAES-OAEP"
+	default:
+		return fmt.Sprintf("KeyEncryptionAlgorithm(%d)", int(alg))
+	}
+}
+
+// KeyEncryptionSelector returns the key encryption algorithm of an RSA
+// recipient of a created pkiEnvelope, e.g. RSAOAEP for a CA known to
+// support it and RSAPKCS1v15 for an RA which does not. 0 selects the
+// default.
+type KeyEncryptionSelector func(recipient *x509.Certificate) KeyEncryptionAlgorithm
+
+// WithKeyEncryptionAlgorithm sets the key encryption algorithm of all RSA
+// recipients of the pkiEnvelope created by NewCSRRequest, Success and the
+// other request and response constructors. By default RSAPKCS1v15 is used.
+func WithKeyEncryptionAlgorithm(alg KeyEncryptionAlgorithm) Option {
+	return WithKeyEncryptionSelector(allRecipients(alg))
+}
+
+// allRecipients selects alg for every recipient.
+func allRecipients(alg KeyEncryptionAlgorithm) KeyEncryptionSelector {
+	return func(*x509.Certificate) KeyEncryptionAlgorithm {
+		return alg
+	}
+}
+
+// WithKeyEncryptionSelector selects the key encryption algorithm of each
+// RSA recipient of created pkiEnvelopes, for requests encrypted to several
+// recipients, like an RA and a CA, which support different algorithms.
+// Passed to ParsePKIMessage, it is used by the replies to the message too;
+// otherwise replies use RSAOAEP if the pkiEnvelope of the message did.
+func WithKeyEncryptionSelector(selector KeyEncryptionSelector) Option {
+	return func(c *config) {
+		c.keyEncryption = selector
+	}
+}
+
+// WithRequireOAEP makes created pkiEnvelopes use RSAOAEP for RSA recipients
+// by default; a KeyEncryptionSelector choosing RSAPKCS1v15 is an error.
+// Passed to ParsePKIMessage, pkiEnvelopes whose key is encrypted for the
+// RSA recipient with RSAES-PKCS1-v1_5 are not decrypted, and replies to the
+// message require RSAOAEP too.
+func WithRequireOAEP() Option {
+	return func(c *config) {
+		c.requireOAEP = true
+	}
+}
+
+// keyEncryptionFor returns the key encryption algorithm of the RSA
+// recipient.
+func (conf *config) keyEncryptionFor(recipient *x509.Certificate) (KeyEncryptionAlgorithm, error) {
+	if conf.fipsMode() {
+		if err := CheckFIPSKey(recipient.PublicKey); err != nil {
+			return 0, err
+		}
+	}
+	var alg KeyEncryptionAlgorithm
+	if conf.keyEncryption != nil {
+		alg = conf.keyEncryption(recipient)
+	}
+	switch {
+	case alg == 0 && (conf.requireOAEP || conf.fipsMode()):
+		return RSAOAEP, nil
+	case alg == 0:
+		return RSAPKCS1v15, nil
+	case alg == RSAPKCS1v15 && conf.requireOAEP:
+		return 0, errors.Errorf("scep: %s required, %s selected for recipient %s", RSAOAEP, alg, recipient.Subject)
+	case alg == RSAPKCS1v15 || alg == RSAOAEP:
+		return alg, nil
+	default:
+		return 0, errors.Errorf("scep: unsupported key encryption algorithm %s", alg)
+	}
+}
+
+var (
+	oidRSAESOAEP  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 7}
+	oidMGF1       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 8}
+	oidPSpecified = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 9}
+)
+
+// rsaOAEPParameters are the RSAES-OAEP-params of RFC 4055. Absent fields
+// default to SHA-1, MGF1 with SHA-1 and an empty label.
+type rsaOAEPParameters struct {
+	HashFunc    pkix.AlgorithmIdentifier `asn1:"optional,explicit,tag:0"`
+	MaskGenFunc pkix.AlgorithmIdentifier `asn1:"optional,explicit,tag:1"`
+	PSourceFunc pkix.AlgorithmIdentifier `asn1:"optional,explicit,tag:2"`
+}
+
+// oaepSHA256 is the AlgorithmIdentifier of RSAES-OAEP with SHA-256.
+var oaepSHA256 = func() pkix.AlgorithmIdentifier {
+	sha256 := pkix.AlgorithmIdentifier{Algorithm: pkcs7.OIDDigestAlgorithmSHA256, Parameters: asn1.NullRawValue}
+	params := rsaOAEPParameters{
+		HashFunc:    sha256,
+		MaskGenFunc: pkix.AlgorithmIdentifier{Algorithm: oidMGF1, Parameters: asn1.RawValue{FullBytes: mustMarshal(sha256)}},
+	}
+	return pkix.AlgorithmIdentifier{Algorithm: oidRSAESOAEP, Parameters: asn1.RawValue{FullBytes: mustMarshal(params)}}
+}()
+
+// encryptKeyTrans encrypts cek for pub with alg and returns the
+// KeyEncryptionAlgorithm identifier and the encrypted key.
+func encryptKeyTrans(cek []byte, pub *rsa.PublicKey, alg KeyEncryptionAlgorithm) (pkix.AlgorithmIdentifier, []byte, error) {
+	if alg == RSAOAEP {
+		encrypted, err := rsa.EncryptOAEP(crypto.SHA256.New(), rand.Reader, pub, cek, nil)
+		return oaepSHA256, encrypted, err
+	}
+	encrypted, err := rsa.EncryptPKCS1v15(rand.Reader, pub, cek)
+	return pkix.AlgorithmIdentifier{Algorithm: pkcs7.OIDEncryptionAlgorithmRSA}, encrypted, err
+}
+
+// oaepOptions returns the decrypter options of the RSAES-OAEP-params of
+// alg. The MGF1 hash must be the OAEP hash.
+func oaepOptions(alg pkix.AlgorithmIdentifier) (*rsa.OAEPOptions, error) {
+	var params rsaOAEPParameters
+	if len(alg.Parameters.FullBytes) > 0 {
+		if _, err := asn1.Unmarshal(alg.Parameters.FullBytes, &params); err != nil {
+			return nil, errors.Wrap(err, "scep: parse RSAES-OAEP parameters")
+		}
+	}
+	h := crypto.SHA1
+	if params.HashFunc.Algorithm != nil {
+		var ok bool
+		if h, ok = digestHash(params.HashFunc.Algorithm); !ok {
+			return nil, errors.Errorf("scep: unsupported RSAES-OAEP hash %s", params.HashFunc.Algorithm)
+		}
+	}
+	mgfHash := crypto.SHA1
+	if params.MaskGenFunc.Algorithm != nil {
+		var mgfAlg pkix.AlgorithmIdentifier
+		if !params.MaskGenFunc.Algorithm.Equal(oidMGF1) {
+			return nil, errors.Errorf("scep: unsupported RSAES-OAEP mask generation function %s", params.MaskGenFunc.Algorithm)
+		}
+		if _, err := asn1.Unmarshal(params.MaskGenFunc.Parameters.FullBytes, &mgfAlg); err != nil {
+			return nil, errors.Wrap(err, "scep: parse RSAES-OAEP MGF1 hash")
+		}
+		var ok bool
+		if mgfHash, ok = digestHash(mgfAlg.Algorithm); !ok {
+			return nil, errors.Errorf("scep: unsupported RSAES-OAEP MGF1 hash %s", mgfAlg.Algorithm)
+		}
+	}
+	if mgfHash != h {
+		return nil, errors.Errorf("scep: unsupported RSAES-OAEP MGF1 hash %s with hash %s", mgfHash, h)
+	}
+	opts := &rsa.OAEPOptions{Hash: h}
+	if params.PSourceFunc.Algorithm != nil {
+		if !params.PSourceFunc.Algorithm.Equal(oidPSpecified) {
+			return nil, errors.Errorf("scep: unsupported RSAES-OAEP label source %s", params.PSourceFunc.Algorithm)
+		}
+		if _, err := asn1.Unmarshal(params.PSourceFunc.Parameters.FullBytes, &opts.Label); err != nil {
+			return nil, errors.Wrap(err, "scep: parse RSAES-OAEP label")
+		}
+	}
+	return opts, nil
+}
+
+// envelopeUsesOAEP reports whether the key of the pkiEnvelope data is
+// encrypted with RSAES-OAEP for any recipient, i.e. whether its sender
+// supports RSAES-OAEP.
+func envelopeUsesOAEP(data []byte) bool {
+	ktris, err := keyTransRecipients(data)
+	if err != nil {
+		return false
+	}
+	for _, ktri := range ktris {
+		if ktri.KeyEncryptionAlgorithm.Algorithm.Equal(oidRSAESOAEP) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEnvelopeOAEP returns an error if the key of the pkiEnvelope data is
+// encrypted for the RSA recipient cert with another algorithm than
+// RSAES-OAEP.
+func checkEnvelopeOAEP(data []byte, cert *x509.Certificate) error {
+	ktris, err := keyTransRecipients(data)
+	if err != nil {
+		return err
+	}
+	for _, ktri := range ktris {
+		if recipientMatches(ktri.RID, cert) && !ktri.KeyEncryptionAlgorithm.Algorithm.Equal(oidRSAESOAEP) {
+			return errors.Errorf("scep: pkiEnvelope key encrypted with %s, RSAES-OAEP required",
+				algorithmName(ktri.KeyEncryptionAlgorithm.Algorithm))
+		}
+	}
+	return nil
+}
+
+// keyTransRecipients returns the KeyTransRecipientInfos of the pkiEnvelope
+// data.
+func keyTransRecipients(data []byte) ([]keyTransRecipientInfo, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(data, &ci); err != nil {
+		return nil, errors.Wrap(err, "scep: parse pkiEnvelope")
+	}
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		return nil, errors.Wrap(err, "scep: parse pkiEnvelope EnvelopedData")
+	}
+	var ktris []keyTransRecipientInfo
+	for _, info := range ed.RecipientInfos {
+		if info.Class != asn1.ClassUniversal || info.Tag != asn1.TagSequence {
+			continue
+		}
+		var ktri keyTransRecipientInfo
+		if _, err := asn1.Unmarshal(info.FullBytes, &ktri); err != nil {
+			return nil, errors.Wrap(err, "scep: parse KeyTransRecipientInfo")
+		}
+		ktris = append(ktris, ktri)
+	}
+	return ktris, nil
+}
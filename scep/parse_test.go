@@ -0,0 +1,139 @@
+package scep
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"testing"
+
+	"go.mozilla.org/pkcs7"
+)
+
+func TestParseInvalidAttributes(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := newEnvelopeTestCert(t, key)
+	for _, test := range []struct {
+		attrs     []pkcs7.Attribute
+		attribute string
+		err       error
+	}{
+		{
+			attrs:     []pkcs7.Attribute{{Type: oidSCEPmessageType, Value: MessageType("99")}},
+			attribute: "messageType",
+			err:       ErrUnknownMessageType,
+		},
+		{
+			attrs: []pkcs7.Attribute{
+				{Type: oidSCEPmessageType, Value: CertRep},
+				{Type: oidSCEPpkiStatus, Value: PKIStatus("7")},
+				{Type: oidSCEPrecipientNonce, Value: RecipientNonce("nonce")},
+			},
+			attribute: "pkiStatus",
+			err:       ErrUnknownPKIStatus,
+		},
+	} {
+		sd, err := (&config{}).newSignedData(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{
+			ExtraSignedAttributes: append([]pkcs7.Attribute{
+				{Type: oidSCEPtransactionID, Value: TransactionID("invalid")},
+				{Type: oidSCEPsenderNonce, Value: SenderNonce("nonce")},
+			}, test.attrs...),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		data, err := sd.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = ParsePKIMessage(data)
+		var attrErr *InvalidAttributeError
+		if !errors.As(err, &attrErr) || attrErr.Attribute != test.attribute {
+			t.Fatalf("have %v, want an invalid %s", err, test.attribute)
+		}
+		if !errors.Is(err, test.err) {
+			t.Errorf("have %v, want %v", err, test.err)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := newEnvelopeTestCert(t, key)
+	sd, err := (&config{}).newSignedData(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{
+		ExtraSignedAttributes: []pkcs7.Attribute{
+			{Type: oidSCEPtransactionID, Value: TransactionID("missing")},
+			{Type: oidSCEPmessageType, Value: PKCSReq},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := sd.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var missing *MissingAttributeError
+	if _, err := ParsePKIMessage(data); !errors.As(err, &missing) || !missing.OID.Equal(oidSCEPsenderNonce) {
+		t.Errorf("have %v, want a missing senderNonce", err)
+	}
+
+	der, err := ioutil.ReadFile("testdata/PKCSReq.der")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the signature is at the end of the message
+	tampered := append([]byte{}, der...)
+	tampered[len(tampered)-1] ^= 0xff
+	if _, err := ParsePKIMessage(tampered); !errors.Is(err, ErrVerify) {
+		t.Errorf("have %v, want %v", err, ErrVerify)
+	}
+
+	msg, err := ParsePKIMessage(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.DecryptPKIEnvelope(cert, key); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("have %v, want %v", err, ErrDecrypt)
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificateRequest(csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &PKIMessage{MessageType: CertPoll, Recipients: []*x509.Certificate{cert}, SignerCert: cert, SignerKey: key}
+	if _, err := NewCSRRequest(parsed, tmpl); !errors.Is(err, ErrUnsupportedMessageType) {
+		t.Errorf("have %v, want %v", err, ErrUnsupportedMessageType)
+	}
+}
+
+func TestMessageTypeValid(t *testing.T) {
+	for _, msgType := range []MessageType{CertRep, RenewalReq, UpdateReq, PKCSReq, CertPoll, GetCert, GetCRL} {
+		if !msgType.Valid() {
+			t.Errorf("%s is not valid", msgType)
+		}
+	}
+	for _, msgType := range []MessageType{"", "99", "19 "} {
+		if msgType.Valid() {
+			t.Errorf("%q is valid", msgType)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package scep
+
+import (
+	"github.com/pkg/errors"
+)
+
+// ReEnvelope creates a request forwarding the CSR of msg, an enrollment
+// request decrypted by an RA, to an upstream CA. The CSR is encrypted for
+// the Recipients of tmpl and the request signed with its SignerCert and
+// SignerKey, the RA identity. The MessageType of tmpl defaults to PKCSReq,
+// as only the device can sign a RenewalReq with the certificate being
+// renewed.
+//
+// The CSR, including its challengePassword, is forwarded unchanged: it is
+// signed by the device key. The transactionID of msg is kept, so the RA can
+// answer the device with the CertRep of the upstream CA for the same
+// transaction, re-encrypted with msg.Success.
+func ReEnvelope(msg *PKIMessage, tmpl *PKIMessage, opts ...Option) (*PKIMessage, error) {
+	conf := &config{logger: nopLogger{}, certsSelector: NopCertsSelector()}
+	for _, opt := range opts {
+		opt(conf)
+	}
+	if msg.CSRReqMessage == nil || len(msg.CSRReqMessage.RawDecrypted) == 0 {
+		return nil, errors.New("scep: ReEnvelope needs a decrypted enrollment request")
+	}
+	msgType := tmpl.MessageType
+	if msgType == "" {
+		msgType = PKCSReq
+	}
+
+	debug(conf.logger,
+		"msg", "re-enveloping SCEP CSR request",
+		"transaction_id", msg.TransactionID,
+		"message_type", msg.MessageType,
+		"signer_cn", tmpl.SignerCert.Subject.CommonName,
+	)
+
+	newMsg, err := newRequest(msg.CSRReqMessage.RawDecrypted, msg.TransactionID, msgType, tmpl, conf)
+	if err != nil {
+		return nil, err
+	}
+	newMsg.CSRReqMessage = &CSRReqMessage{
+		RawDecrypted:      msg.CSRReqMessage.RawDecrypted,
+		CSR:               msg.CSRReqMessage.CSR,
+		ChallengePassword: msg.CSRReqMessage.ChallengePassword,
+		MessageType:       msgType,
+		SignerCert:        tmpl.SignerCert,
+	}
+	return newMsg, nil
+}
@@ -0,0 +1,84 @@
+package scep
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// ErrMessageTooLarge is returned by ReadPKIMessage and
+// ParsePKIMessageReader for messages exceeding the maximum size.
+var ErrMessageTooLarge = errors.New("scep: message exceeds the maximum size")
+
+// ParsePKIMessageReader reads a message of at most maxSize bytes from r
+// with ReadPKIMessage and parses it with ParsePKIMessage.
+func ParsePKIMessageReader(r io.Reader, maxSize int64, opts ...Option) (*PKIMessage, error) {
+	data, err := ReadPKIMessage(r, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePKIMessage(data, opts...)
+}
+
+// ReadPKIMessage reads a DER or BER encoded PKCS#7 ContentInfo of at most
+// maxSize bytes from r, such as a pkiMessage or a GetCACert response. The
+// length in the header of a DER encoding is checked before the content is
+// read into a buffer of its size, so large CertRep payloads are read
+// without copying and oversized ones without buffering. Indefinite length
+// encodings are read until the end of r. ErrMessageTooLarge is returned if
+// the message exceeds maxSize.
+func ReadPKIMessage(r io.Reader, maxSize int64) ([]byte, error) {
+	// the identifier, the length octets and at most 4 bytes of length
+	header := make([]byte, 2, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, errors.Wrap(err, "scep: read PKCS#7 ContentInfo")
+	}
+	if header[0] != 0x30 {
+		return nil, errors.New("scep: pkiMessage is not a PKCS#7 ContentInfo")
+	}
+
+	var length int64
+	switch l := header[1]; {
+	case l < 0x80:
+		length = int64(l)
+	case l == 0x80:
+		return readIndefinite(r, header, maxSize)
+	default:
+		n := int(l & 0x7f)
+		if n > 4 {
+			return nil, ErrMessageTooLarge
+		}
+		header = header[:2+n]
+		if _, err := io.ReadFull(r, header[2:]); err != nil {
+			return nil, errors.Wrap(err, "scep: read PKCS#7 ContentInfo")
+		}
+		for _, b := range header[2:] {
+			length = length<<8 | int64(b)
+		}
+	}
+	if int64(len(header))+length > maxSize {
+		return nil, ErrMessageTooLarge
+	}
+
+	data := make([]byte, int64(len(header))+length)
+	copy(data, header)
+	if _, err := io.ReadFull(r, data[len(header):]); err != nil {
+		return nil, errors.Wrap(err, "scep: read PKCS#7 ContentInfo")
+	}
+	return data, nil
+}
+
+// readIndefinite reads the rest of an indefinite length encoding, whose
+// size is only known at its end, following header from r.
+func readIndefinite(r io.Reader, header []byte, maxSize int64) ([]byte, error) {
+	buf := bytes.NewBuffer(header)
+	n, err := buf.ReadFrom(io.LimitReader(r, maxSize-int64(len(header))+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "scep: read PKCS#7 ContentInfo")
+	}
+	if int64(len(header))+n > maxSize {
+		return nil, ErrMessageTooLarge
+	}
+	return buf.Bytes(), nil
+}
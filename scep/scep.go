@@ -5,26 +5,55 @@ package scep
 
 import (
 	"bytes"
+	"context"
 	"crypto"
-	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/base64"
+	"fmt"
 
 	"github.com/micromdm/scep/v2/cryptoutil"
 	"github.com/micromdm/scep/v2/cryptoutil/x509util"
+	"github.com/micromdm/scep/v2/tracing"
 
-	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/log/level"
 	"github.com/pkg/errors"
 	"go.mozilla.org/pkcs7"
 )
 
 // errors
 var (
-	errNotImplemented     = errors.New("not implemented")
-	errUnknownMessageType = errors.New("unknown messageType")
+	// ErrUnknownMessageType is wrapped by the *InvalidAttributeError of a
+	// message with a messageType not defined by RFC 8894.
+	ErrUnknownMessageType = errors.New("scep: unknown messageType")
+
+	// ErrUnknownPKIStatus is wrapped by the *InvalidAttributeError of a
+	// CertRep with a pkiStatus not defined by RFC 8894.
+	ErrUnknownPKIStatus = errors.New("scep: unknown pkiStatus")
+
+	// ErrUnsupportedMessageType is wrapped by the errors of operations
+	// given a message of a defined messageType they do not handle, e.g.
+	// NewCSRRequest for a CertPoll.
+	ErrUnsupportedMessageType = errors.New("scep: unsupported messageType")
+
+	// ErrVerify is wrapped by the errors of ParsePKIMessage for a message
+	// whose signature or, with WithSignerValidation, signer certificate
+	// does not verify, and of DecryptPKIEnvelope for a self-signed signer
+	// certificate not matching the CSR. It maps to the badMessageCheck
+	// failInfo.
+	ErrVerify = errors.New("scep: verify pkiMessage")
+
+	// ErrDecrypt is wrapped by the errors of DecryptPKIEnvelope for a
+	// pkiEnvelope that cannot be decrypted with the given certificate and
+	// key.
+	ErrDecrypt = errors.New("scep: decrypt pkiEnvelope")
+
+	// ErrNotSignedData is returned by ParsePKIMessage when the PKCS#7
+	// content type of the message is not SignedData.
+	ErrNotSignedData = errors.New("scep: not a SignedData SCEP message")
+
+	// ErrNoMatchingCertificate is returned by CertRepMessage.Leaf when no
+	// certificate of a CertRep is for the requested public key.
+	ErrNoMatchingCertificate = errors.New("scep: no CertRep certificate for public key")
 )
 
 // The MessageType attribute specifies the type of operation performed
@@ -56,16 +85,63 @@ func (msg MessageType) String() string {
 	case PKCSReq:
 		return "PKCSReq (19)"
 	case CertPoll:
-		return "CertPoll (20) "
+		return "CertPoll (20)"
 	case GetCert:
 		return "GetCert (21)"
 	case GetCRL:
 		return "GetCRL (22)"
 	default:
-		panic("scep: unknown messageType" + msg)
+		// unknown values come from the peer and are only logged
+		return "unknown(" + string(msg) + ")"
 	}
 }
 
+// Valid reports whether msg is a messageType defined by RFC 8894 or, for
+// UpdateReq, by the SCEP drafts.
+func (msg MessageType) Valid() bool {
+	switch msg {
+	case CertRep, RenewalReq, UpdateReq, PKCSReq, CertPoll, GetCert, GetCRL:
+		return true
+	}
+	return false
+}
+
+// InvalidAttributeError is returned by ParsePKIMessage for a message with
+// an attribute value not defined by RFC 8894. It wraps
+// ErrUnknownMessageType or ErrUnknownPKIStatus.
+type InvalidAttributeError struct {
+	// Attribute is the name of the attribute, e.g. "messageType".
+	Attribute string
+	Value     string
+	Err       error
+}
+
+func (e *InvalidAttributeError) Error() string {
+	return fmt.Sprintf("scep: unknown %s %q", e.Attribute, e.Value)
+}
+
+func (e *InvalidAttributeError) Unwrap() error { return e.Err }
+
+// MissingAttributeError is returned by ParsePKIMessage for a message
+// without an attribute its messageType requires.
+type MissingAttributeError struct {
+	OID asn1.ObjectIdentifier
+}
+
+func (e *MissingAttributeError) Error() string {
+	return "scep: missing " + attributeName(e.OID) + " attribute"
+}
+
+// kindError adds the sentinel kind to the chain of err for errors.Is.
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string        { return e.err.Error() }
+func (e *kindError) Unwrap() error        { return e.err }
+func (e *kindError) Is(target error) bool { return target == e.kind }
+
 // PKIStatus is a SCEP pkiStatus attribute which holds transaction status information.
 // All SCEP responses MUST include a pkiStatus.
 //
@@ -107,11 +183,12 @@ func (info FailInfo) String() string {
 	case BadCertID:
 		return "badCertID (4)"
 	default:
-		panic("scep: unknown failInfo type" + info)
+		// values added after RFC 8894 are passed through
+		return "unknown(" + string(info) + ")"
 	}
 }
 
-// SenderNonce is a random 16 byte number.
+// SenderNonce is a random number, 16 bytes unless set with WithNonceSize.
 // A sender must include the senderNonce in each transaction to a recipient.
 type SenderNonce []byte
 
@@ -134,10 +211,48 @@ var (
 	oidSCEPsenderNonce    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 5}
 	oidSCEPrecipientNonce = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 6}
 	oidSCEPtransactionID  = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 7}
+
+	// id-scep-failInfoText, RFC 8894 section 3.2.1.4.
+	oidSCEPfailInfoText = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 24, 1}
 )
 
-// WithLogger adds option logging to the SCEP operations.
-func WithLogger(logger log.Logger) Option {
+// attributeName returns the RFC 8894 name of the SCEP attribute oid.
+func attributeName(oid asn1.ObjectIdentifier) string {
+	for name, known := range map[string]asn1.ObjectIdentifier{
+		"messageType":    oidSCEPmessageType,
+		"pkiStatus":      oidSCEPpkiStatus,
+		"failInfo":       oidSCEPfailInfo,
+		"senderNonce":    oidSCEPsenderNonce,
+		"recipientNonce": oidSCEPrecipientNonce,
+		"transactionID":  oidSCEPtransactionID,
+		"failInfoText":   oidSCEPfailInfoText,
+	} {
+		if oid.Equal(known) {
+			return name
+		}
+	}
+	return oid.String()
+}
+
+// unmarshalSignedAttribute is p7.UnmarshalSignedAttribute returning a
+// *MissingAttributeError for an attribute the signer did not include.
+func unmarshalSignedAttribute(p7 *pkcs7.PKCS7, oid asn1.ObjectIdentifier, out interface{}) error {
+	err := p7.UnmarshalSignedAttribute(oid, out)
+	if err == nil || len(p7.Signers) == 0 {
+		return err
+	}
+	for _, attr := range p7.Signers[0].AuthenticatedAttributes {
+		if attr.Type.Equal(oid) {
+			return errors.Wrapf(err, "scep: parse %s attribute", attributeName(oid))
+		}
+	}
+	return &MissingAttributeError{OID: oid}
+}
+
+// WithLogger adds option logging to the SCEP operations. Loggers filtering
+// by level, like *slog.Logger or go-kit level.NewFilter, must be adapted
+// with NewSlogLogger or the kitlog package.
+func WithLogger(logger Logger) Option {
 	return func(c *config) {
 		c.logger = logger
 	}
@@ -163,13 +278,99 @@ func WithCertsSelector(selector CertsSelector) Option {
 	}
 }
 
+// WithEncryptionAlgorithm sets the content encryption algorithm of the
+// pkiEnvelope created by NewCSRRequest, Success and the other request and
+// response constructors. By default the pkcs7.ContentEncryptionAlgorithm
+// package variable is used. DES-CBC is replaced by AES-128-CBC for EC
+// recipients.
+func WithEncryptionAlgorithm(alg EncryptionAlgorithm) Option {
+	return func(c *config) {
+		c.encryptionAlgorithm = alg
+	}
+}
+
+// WithDigestAlgorithm sets the digest algorithm used to sign messages created
+// by NewCSRRequest, Success, Fail and the other request and response
+// constructors. SHA-1, SHA-256, SHA-384 and SHA-512 are supported; by default
+// requests are signed with SHA-1 and responses with the digest algorithm of
+// the request.
+// Passed to ParsePKIMessage, messages signed with a weaker digest are
+// rejected.
+func WithDigestAlgorithm(h crypto.Hash) Option {
+	return func(c *config) {
+		c.digestAlgorithm = h
+	}
+}
+
+// WithCertificateChain adds the issuing intermediate CA certificates chain
+// after the issued certificate in the pkiEnvelope of a Success CertRep, so
+// clients can build the path to a root they trust.
+func WithCertificateChain(chain []*x509.Certificate) Option {
+	return func(c *config) {
+		c.certChain = chain
+	}
+}
+
+// WithFailInfoText adds a failInfoText attribute with the human-readable
+// reason text to the CertRep created by Fail.
+func WithFailInfoText(text string) Option {
+	return func(c *config) {
+		c.failInfoText = text
+	}
+}
+
+// WithExtraSignedAttributes adds attrs, e.g. vendor-specific metadata, to
+// the signed attributes of the messages created by NewCSRRequest, Success,
+// Fail and the other request and response constructors. The SCEP attributes
+// are always included and must not be repeated in attrs.
+func WithExtraSignedAttributes(attrs []pkcs7.Attribute) Option {
+	return func(c *config) {
+		c.extraAttrs = append(c.extraAttrs, attrs...)
+	}
+}
+
+// WithContext sets the context of the message operations. It is checked
+// before parsing and signing and passed to cryptoutil.ContextSigner keys,
+// so deadlines and cancellation apply to remote signers. See also the
+// Context variants, e.g. ParsePKIMessageContext.
+func WithContext(ctx context.Context) Option {
+	return func(c *config) {
+		c.ctx = ctx
+	}
+}
+
+// WithTracer traces the message operations with spans of t, started from
+// the context set with WithContext. Replies inherit the Tracer of the
+// parsed request.
+func WithTracer(t tracing.Tracer) Option {
+	return func(c *config) {
+		c.tracer = t
+	}
+}
+
 // Option specifies custom configuration for SCEP.
 type Option func(*config)
 
 type config struct {
-	logger        log.Logger
-	caCerts       []*x509.Certificate // specified if CA certificates have already been retrieved
-	certsSelector CertsSelector
+	logger              Logger
+	caCerts             []*x509.Certificate // specified if CA certificates have already been retrieved
+	certsSelector       CertsSelector
+	encryptionAlgorithm EncryptionAlgorithm
+	digestAlgorithm     crypto.Hash
+	certChain           []*x509.Certificate
+	validateSigner      bool
+	signerIssuers       []*x509.Certificate
+	failInfoText        string
+	extraAttrs          []pkcs7.Attribute
+	ctx                 context.Context
+	tracer              tracing.Tracer
+	strictness          Strictness
+	rfc8894Strict       bool
+	nonceSize           int
+	nonceMin, nonceMax  int
+	keyEncryption       KeyEncryptionSelector
+	requireOAEP         bool
+	fips                bool
 }
 
 // PKIMessage defines the possible SCEP message types
@@ -179,6 +380,10 @@ type PKIMessage struct {
 	SenderNonce
 	*CertRepMessage
 	*CSRReqMessage
+	*GetCertMessage
+	*GetCRLMessage
+	*CRLRepMessage
+	*CertPollMessage
 
 	// DER Encoded PKIMessage
 	Raw []byte
@@ -193,10 +398,21 @@ type PKIMessage struct {
 	Recipients []*x509.Certificate
 
 	// Signer info
-	SignerKey  *rsa.PrivateKey
+	// SignerCert is set by ParsePKIMessage to the certificate of the
+	// PKCS#7 signer.
+	SignerKey  crypto.Signer
 	SignerCert *x509.Certificate
 
-	logger log.Logger
+	// set by WithSignerValidation
+	validateSignerKey bool
+
+	logger        Logger
+	tracer        tracing.Tracer
+	strictness    Strictness
+	rfc8894Strict bool
+	requireOAEP   bool
+	keyEncryption KeyEncryptionSelector
+	fips          bool
 }
 
 // CertRepMessage is a type of PKIMessage
@@ -205,11 +421,39 @@ type CertRepMessage struct {
 	RecipientNonce
 	FailInfo
 
-	Certificate *x509.Certificate
+	// FailInfoText is the optional human-readable reason of a FAILURE.
+	FailInfoText string
+
+	// Certificates are the certificates in the pkiEnvelope of a SUCCESS
+	// CertRep: the issued certificate and any chain sent with it, in the
+	// order chosen by the CA. Use Leaf or LeafForCSR to find the issued
+	// certificate.
+	Certificates []*x509.Certificate
 
 	degenerate []byte
 }
 
+// Leaf returns the certificate for the public key pub among the
+// certificates of the CertRep.
+func (m *CertRepMessage) Leaf(pub crypto.PublicKey) (*x509.Certificate, error) {
+	key, ok := pub.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok {
+		return nil, errors.Errorf("scep: unsupported public key type %T", pub)
+	}
+	for _, cert := range m.Certificates {
+		if key.Equal(cert.PublicKey) {
+			return cert, nil
+		}
+	}
+	return nil, ErrNoMatchingCertificate
+}
+
+// LeafForCSR returns the certificate issued for csr among the certificates
+// of the CertRep.
+func (m *CertRepMessage) LeafForCSR(csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	return m.Leaf(csr.PublicKey)
+}
+
 // CSRReqMessage can be of the type PKCSReq/RenewalReq/UpdateReq
 // and includes a PKCS#10 CSR request.
 // The content of this message is protected
@@ -221,17 +465,82 @@ type CSRReqMessage struct {
 	CSR *x509.CertificateRequest
 
 	ChallengePassword string
+
+	// ChallengeMetadata are the values the challenge store minted the
+	// ChallengePassword with, e.g. a device serial number for certificate
+	// templates.
+	ChallengeMetadata map[string]string
+
+	// TransactionID, MessageType and SignerCert of the PKIMessage carrying
+	// the CSR. The signer of a renewal is the certificate being renewed.
+	TransactionID TransactionID
+	MessageType   MessageType
+	SignerCert    *x509.Certificate
+
+	// Replayed is set by signers answering a resent request with the
+	// decision already made for it, e.g. the certificate issued before,
+	// so the decision is not reported again.
+	Replayed bool
+}
+
+// SanitizedCSR returns the DER encoded CSR without the challengePassword
+// attribute, for depots and audit logs which must not persist the secret.
+// The CSR signature covers the removed attribute, so the result keeps the
+// original signature but no longer verifies.
+func (m *CSRReqMessage) SanitizedCSR() ([]byte, error) {
+	return x509util.RemoveChallengePassword(m.RawDecrypted)
+}
+
+// IsRenewal reports whether m renews an existing certificate: it is a
+// RenewalReq or UpdateReq, or, as described in RFC 8894 section 3.3.1.2,
+// a PKCSReq signed with a certificate which is not self-signed.
+func (m *CSRReqMessage) IsRenewal() bool {
+	switch m.MessageType {
+	case RenewalReq, UpdateReq:
+		return true
+	}
+	if m.SignerCert == nil {
+		return false
+	}
+	crt := m.SignerCert
+	return !bytes.Equal(crt.RawIssuer, crt.RawSubject) ||
+		crt.CheckSignature(crt.SignatureAlgorithm, crt.RawTBSCertificate, crt.Signature) != nil
 }
 
-// ParsePKIMessage unmarshals a PKCS#7 signed data into a PKI message struct
+// ParsePKIMessage unmarshals a PKCS#7 signed data into a PKI message struct.
+// BER encoded messages, e.g. with indefinite lengths, are converted to DER.
 func ParsePKIMessage(data []byte, opts ...Option) (*PKIMessage, error) {
-	conf := &config{logger: log.NewNopLogger()}
+	conf := &config{logger: nopLogger{}}
 	for _, opt := range opts {
 		opt(conf)
 	}
+	if err := conf.context().Err(); err != nil {
+		return nil, err
+	}
+	span := conf.startSpan("scep.ParsePKIMessage")
+	defer span.End()
+	msg, err := parsePKIMessage(data, conf)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	span.SetAttributes(msg.spanAttributes()...)
+	return msg, nil
+}
+
+func parsePKIMessage(data []byte, conf *config) (*PKIMessage, error) {
+	der := normalizeBER(data)
+	// a SCEP pkiMessage is always a PKCS#7 SignedData
+	contentType, err := pkcs7ContentType(der)
+	if err != nil {
+		return nil, err
+	}
+	if !contentType.Equal(pkcs7.OIDSignedData) {
+		return nil, ErrNotSignedData
+	}
 
 	// parse PKCS#7 signed data
-	p7, err := pkcs7.Parse(data)
+	p7, err := pkcs7.Parse(der)
 	if err != nil {
 		return nil, err
 	}
@@ -249,16 +558,24 @@ func ParsePKIMessage(data []byte, opts ...Option) (*PKIMessage, error) {
 	}
 
 	if err := p7.Verify(); err != nil {
+		return nil, &kindError{kind: ErrVerify, err: err}
+	}
+	if err := conf.checkDigestAlgorithm(p7); err != nil {
 		return nil, err
 	}
+	if conf.fipsMode() {
+		if err := checkFIPS(p7); err != nil {
+			return nil, err
+		}
+	}
 
 	var tID TransactionID
-	if err := p7.UnmarshalSignedAttribute(oidSCEPtransactionID, &tID); err != nil {
+	if err := unmarshalSignedAttribute(p7, oidSCEPtransactionID, &tID); err != nil {
 		return nil, err
 	}
 
 	var msgType MessageType
-	if err := p7.UnmarshalSignedAttribute(oidSCEPmessageType, &msgType); err != nil {
+	if err := unmarshalSignedAttribute(p7, oidSCEPmessageType, &msgType); err != nil {
 		return nil, err
 	}
 
@@ -267,7 +584,14 @@ func ParsePKIMessage(data []byte, opts ...Option) (*PKIMessage, error) {
 		MessageType:   msgType,
 		Raw:           data,
 		p7:            p7,
+		SignerCert:    p7.GetOnlySigner(),
 		logger:        conf.logger,
+		tracer:        conf.tracer,
+		strictness:    conf.strictness,
+		rfc8894Strict: conf.rfc8894Strict,
+		requireOAEP:   conf.requireOAEP,
+		keyEncryption: conf.keyEncryption,
+		fips:          conf.fips,
 	}
 
 	// log relevant key-values when parsing a pkiMessage.
@@ -276,11 +600,27 @@ func ParsePKIMessage(data []byte, opts ...Option) (*PKIMessage, error) {
 		"scep_message_type", msgType,
 		"transaction_id", tID,
 	}
-	level.Debug(msg.logger).Log(logKeyVals...)
+	debug(msg.logger, logKeyVals...)
 
 	if err := msg.parseMessageType(); err != nil {
 		return nil, err
 	}
+	if err := conf.checkNonceSize(msg); err != nil {
+		return nil, err
+	}
+
+	if conf.rfc8894Strict {
+		if err := msg.checkRFC8894(); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.validateSigner {
+		if err := msg.validateSigner(conf.signerIssuers); err != nil {
+			return nil, &kindError{kind: ErrVerify, err: err}
+		}
+		msg.validateSignerKey = true
+	}
 
 	return msg, nil
 }
@@ -289,15 +629,15 @@ func (msg *PKIMessage) parseMessageType() error {
 	switch msg.MessageType {
 	case CertRep:
 		var status PKIStatus
-		if err := msg.p7.UnmarshalSignedAttribute(oidSCEPpkiStatus, &status); err != nil {
+		if err := unmarshalSignedAttribute(msg.p7, oidSCEPpkiStatus, &status); err != nil {
 			return err
 		}
 		var rn RecipientNonce
-		if err := msg.p7.UnmarshalSignedAttribute(oidSCEPrecipientNonce, &rn); err != nil {
+		if err := unmarshalSignedAttribute(msg.p7, oidSCEPrecipientNonce, &rn); err != nil && msg.strictness != Lenient {
 			return err
 		}
-		if len(rn) == 0 {
-			return errors.New("scep pkiMessage must include recipientNonce attribute")
+		if len(rn) == 0 && msg.strictness != Lenient {
+			return &MissingAttributeError{OID: oidSCEPrecipientNonce}
 		}
 		cr := &CertRepMessage{
 			PKIStatus:      status,
@@ -308,87 +648,259 @@ func (msg *PKIMessage) parseMessageType() error {
 			break
 		case FAILURE:
 			var fi FailInfo
-			if err := msg.p7.UnmarshalSignedAttribute(oidSCEPfailInfo, &fi); err != nil {
+			if err := unmarshalSignedAttribute(msg.p7, oidSCEPfailInfo, &fi); err != nil {
 				return err
 			}
 			if fi == "" {
-				return errors.New("scep pkiStatus FAILURE must have a failInfo attribute")
+				return &MissingAttributeError{OID: oidSCEPfailInfo}
 			}
 			cr.FailInfo = fi
+			// failInfoText is optional
+			var text string
+			if err := msg.p7.UnmarshalSignedAttribute(oidSCEPfailInfoText, &text); err == nil {
+				cr.FailInfoText = text
+			}
 		case PENDING:
 			break
 		default:
-			return errors.Errorf("unknown scep pkiStatus %s", status)
+			return &InvalidAttributeError{Attribute: "pkiStatus", Value: string(status), Err: ErrUnknownPKIStatus}
 		}
 		msg.CertRepMessage = cr
 		return nil
-	case PKCSReq, UpdateReq, RenewalReq:
+	case PKCSReq, UpdateReq, RenewalReq, GetCert, GetCRL, CertPoll:
 		var sn SenderNonce
-		if err := msg.p7.UnmarshalSignedAttribute(oidSCEPsenderNonce, &sn); err != nil {
+		if err := unmarshalSignedAttribute(msg.p7, oidSCEPsenderNonce, &sn); err != nil {
 			return err
 		}
 		if len(sn) == 0 {
-			return errors.New("scep pkiMessage must include senderNonce attribute")
+			return &MissingAttributeError{OID: oidSCEPsenderNonce}
 		}
 		msg.SenderNonce = sn
 		return nil
-	case GetCRL, GetCert, CertPoll:
-		return errNotImplemented
 	default:
-		return errUnknownMessageType
+		return &InvalidAttributeError{Attribute: "messageType", Value: string(msg.MessageType), Err: ErrUnknownMessageType}
+	}
+}
+
+// pkcs7ContentType returns the contentType of a PKCS#7 ContentInfo without
+// parsing the content. Both definite and (BER) indefinite length encodings
+// of the outer SEQUENCE are accepted.
+func pkcs7ContentType(data []byte) (asn1.ObjectIdentifier, error) {
+	if len(data) < 2 || data[0] != 0x30 {
+		return nil, errors.New("scep: pkiMessage is not a PKCS#7 ContentInfo")
+	}
+	offset := 2
+	if l := data[1]; l > 0x80 {
+		offset += int(l & 0x7f)
+	}
+	if offset >= len(data) {
+		return nil, errors.New("scep: truncated PKCS#7 ContentInfo")
+	}
+	var contentType asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(data[offset:], &contentType); err != nil {
+		return nil, errors.Wrap(err, "scep: parse PKCS#7 contentType")
 	}
+	return contentType, nil
 }
 
-// DecryptPKIEnvelope decrypts the pkcs envelopedData inside the SCEP PKIMessage
-func (msg *PKIMessage) DecryptPKIEnvelope(cert *x509.Certificate, key *rsa.PrivateKey) error {
-	p7, err := pkcs7.Parse(msg.p7.Content)
+// DecryptPKIEnvelope decrypts the pkcs envelopedData inside the SCEP PKIMessage.
+// The key is an RSA crypto.Decrypter, such as an *rsa.PrivateKey, for key
+// transport recipients or an *ecdsa.PrivateKey for ECDH key agreement
+// recipients. It sets the CSRReqMessage or other field of msg for its
+// messageType; use OpenEnvelope to share msg between goroutines.
+func (msg *PKIMessage) DecryptPKIEnvelope(cert *x509.Certificate, key crypto.PrivateKey) error {
+	return msg.DecryptPKIEnvelopeContext(context.Background(), cert, key)
+}
+
+func (msg *PKIMessage) decryptPKIEnvelope(cert *x509.Certificate, key crypto.PrivateKey) error {
+	env, err := msg.openEnvelope(cert, key)
 	if err != nil {
 		return err
 	}
-	msg.pkiEnvelope, err = p7.Decrypt(cert, key)
+	msg.pkiEnvelope = env.Raw
+	switch {
+	case env.CRLRepMessage != nil:
+		msg.CRLRepMessage = env.CRLRepMessage
+	case env.Certificates != nil:
+		msg.CertRepMessage.Certificates = env.Certificates
+	case env.CSRReqMessage != nil:
+		msg.CSRReqMessage = env.CSRReqMessage
+	case env.GetCertMessage != nil:
+		msg.GetCertMessage = env.GetCertMessage
+	case env.GetCRLMessage != nil:
+		msg.GetCRLMessage = env.GetCRLMessage
+	case env.CertPollMessage != nil:
+		msg.CertPollMessage = env.CertPollMessage
+	}
+	return nil
+}
+
+// Envelope is the decrypted pkiEnvelope of a PKIMessage and the message it
+// carries, which depends on the messageType.
+type Envelope struct {
+	// Raw is the decrypted content.
+	Raw []byte
+
+	// CSRReqMessage is the request of a PKCSReq, RenewalReq or UpdateReq.
+	CSRReqMessage *CSRReqMessage
+	// Certificates are the certificates of a SUCCESS CertRep, like
+	// CertRepMessage.Certificates.
+	Certificates []*x509.Certificate
+	// CRLRepMessage is the CRL of a CertRep answering GetCRL.
+	CRLRepMessage   *CRLRepMessage
+	GetCertMessage  *GetCertMessage
+	GetCRLMessage   *GetCRLMessage
+	CertPollMessage *CertPollMessage
+}
+
+// OpenEnvelope decrypts the pkiEnvelope like DecryptPKIEnvelope, but returns
+// it instead of setting the fields of msg. msg is not modified, so the same
+// parsed message may be opened and answered from several goroutines.
+func (msg *PKIMessage) OpenEnvelope(cert *x509.Certificate, key crypto.PrivateKey) (*Envelope, error) {
+	return msg.OpenEnvelopeContext(context.Background(), cert, key)
+}
+
+func (msg *PKIMessage) openEnvelope(cert *x509.Certificate, key crypto.PrivateKey) (*Envelope, error) {
+	envelope := msg.p7.Content
+	var err error
+	if msg.strictness == Lenient {
+		if envelope, err = berToDER(envelope); err != nil {
+			return nil, err
+		}
+	}
+	if msg.rfc8894Strict {
+		if err := checkEnvelopeRFC8894(envelope); err != nil {
+			return nil, err
+		}
+	}
+	if msg.requireOAEP {
+		if err := checkEnvelopeOAEP(envelope, cert); err != nil {
+			return nil, &kindError{kind: ErrDecrypt, err: err}
+		}
+	}
+	if msg.fips || FIPSMode() {
+		if err := checkEnvelopeFIPS(envelope, cert); err != nil {
+			return nil, err
+		}
+	}
+	content, err := decryptPKIEnvelope(envelope, cert, key)
 	if err != nil {
-		return err
+		return nil, &kindError{kind: ErrDecrypt, err: err}
 	}
+	env := &Envelope{Raw: content}
 
 	logKeyVals := []interface{}{
 		"msg", "decrypt pkiEnvelope",
 	}
-	defer func() { level.Debug(msg.logger).Log(logKeyVals...) }()
+	defer func() { debug(msg.logger, logKeyVals...) }()
 
 	switch msg.MessageType {
 	case CertRep:
-		certs, err := CACerts(msg.pkiEnvelope)
+		p7, err := ParseDegenerateP7(content)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		msg.CertRepMessage.Certificate = certs[0]
-		logKeyVals = append(logKeyVals, "ca_certs", len(certs))
-		return nil
+		// a CertRep answering GetCRL carries a CRL instead of certificates
+		if len(p7.CRLs) > 0 {
+			env.CRLRepMessage = &CRLRepMessage{CRL: &p7.CRLs[0]}
+			logKeyVals = append(logKeyVals, "crls", len(p7.CRLs))
+			return env, nil
+		}
+		if len(p7.Certificates) < 1 {
+			return nil, errors.New("scep: no certificate or CRL in CertRep pkiEnvelope")
+		}
+		env.Certificates = p7.Certificates
+		logKeyVals = append(logKeyVals, "ca_certs", len(p7.Certificates))
+		return env, nil
 	case PKCSReq, UpdateReq, RenewalReq:
-		csr, err := x509.ParseCertificateRequest(msg.pkiEnvelope)
+		csr, err := x509.ParseCertificateRequest(content)
 		if err != nil {
-			return errors.Wrap(err, "parse CSR from pkiEnvelope")
+			return nil, errors.Wrap(err, "parse CSR from pkiEnvelope")
+		}
+		if err := msg.checkSignerKey(csr); err != nil {
+			return nil, &kindError{kind: ErrVerify, err: err}
 		}
 		// check for challengePassword
-		cp, err := x509util.ParseChallengePassword(msg.pkiEnvelope)
+		cp, err := x509util.ParseChallengePassword(content)
 		if err != nil {
-			return errors.Wrap(err, "scep: parse challenge password in pkiEnvelope")
+			return nil, errors.Wrap(err, "scep: parse challenge password in pkiEnvelope")
 		}
-		msg.CSRReqMessage = &CSRReqMessage{
-			RawDecrypted:      msg.pkiEnvelope,
+		env.CSRReqMessage = &CSRReqMessage{
+			RawDecrypted:      content,
 			CSR:               csr,
 			ChallengePassword: cp,
+			TransactionID:     msg.TransactionID,
+			MessageType:       msg.MessageType,
+			SignerCert:        msg.SignerCert,
 		}
 		logKeyVals = append(logKeyVals, "has_challenge", cp != "")
-		return nil
-	case GetCRL, GetCert, CertPoll:
-		return errNotImplemented
+		return env, nil
+	case GetCert:
+		iasn, err := parseIssuerAndSerial(content)
+		if err != nil {
+			return nil, err
+		}
+		env.GetCertMessage = &GetCertMessage{IssuerAndSerial: iasn}
+		logKeyVals = append(logKeyVals, "serial", iasn.SerialNumber)
+		return env, nil
+	case GetCRL:
+		iasn, err := parseIssuerAndSerial(content)
+		if err != nil {
+			return nil, err
+		}
+		env.GetCRLMessage = &GetCRLMessage{IssuerAndSerial: iasn}
+		logKeyVals = append(logKeyVals, "serial", iasn.SerialNumber)
+		return env, nil
+	case CertPoll:
+		ias, err := parseIssuerAndSubject(content)
+		if err != nil {
+			return nil, err
+		}
+		env.CertPollMessage = &CertPollMessage{IssuerAndSubject: ias}
+		return env, nil
 	default:
-		return errUnknownMessageType
+		return nil, &InvalidAttributeError{Attribute: "messageType", Value: string(msg.MessageType), Err: ErrUnknownMessageType}
 	}
 }
 
-func (msg *PKIMessage) Fail(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKey, info FailInfo) (*PKIMessage, error) {
+// FailureOptions describe the FAILURE CertRep created by FailWith.
+type FailureOptions struct {
+	// FailInfo is the failure reason, badRequest if empty.
+	FailInfo FailInfo
+
+	// FailInfoText is the optional human-readable failure reason. It takes
+	// precedence over WithFailInfoText.
+	FailInfoText string
+
+	// ExtraAttributes are added to the signed attributes of the CertRep.
+	ExtraAttributes []pkcs7.Attribute
+}
+
+// Fail returns a new PKIMessage with CertRep data rejecting the request msg
+// with the failInfo info.
+func (msg *PKIMessage) Fail(crtAuth *x509.Certificate, keyAuth crypto.Signer, info FailInfo, opts ...Option) (*PKIMessage, error) {
+	return msg.FailWith(crtAuth, keyAuth, FailureOptions{FailInfo: info}, opts...)
+}
+
+// FailWith returns a new PKIMessage with CertRep data rejecting the request
+// msg as described by fo.
+func (msg *PKIMessage) FailWith(crtAuth *x509.Certificate, keyAuth crypto.Signer, fo FailureOptions, opts ...Option) (*PKIMessage, error) {
+	conf := &config{}
+	for _, opt := range opts {
+		opt(conf)
+	}
+	conf.replyTo(msg)
+	span := conf.startSpan("scep.Fail", msg.spanAttributes()...)
+	defer span.End()
+	info := fo.FailInfo
+	if info == "" {
+		info = BadRequest
+	}
+	text := fo.FailInfoText
+	if text == "" {
+		text = conf.failInfoText
+	}
+
 	config := pkcs7.SignerInfoConfig{
 		ExtraSignedAttributes: []pkcs7.Attribute{
 			{
@@ -417,8 +929,16 @@ func (msg *PKIMessage) Fail(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKey,
 			},
 		},
 	}
+	config.ExtraSignedAttributes = append(config.ExtraSignedAttributes, conf.extraAttrs...)
+	if text != "" {
+		config.ExtraSignedAttributes = append(config.ExtraSignedAttributes, pkcs7.Attribute{
+			Type:  oidSCEPfailInfoText,
+			Value: asn1.RawValue{Tag: asn1.TagUTF8String, Bytes: []byte(text)},
+		})
+	}
+	config.ExtraSignedAttributes = append(config.ExtraSignedAttributes, fo.ExtraAttributes...)
 
-	sd, err := pkcs7.NewSignedData(nil)
+	sd, err := conf.newSignedData(nil)
 	if err != nil {
 		return nil, err
 	}
@@ -435,7 +955,8 @@ func (msg *PKIMessage) Fail(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKey,
 
 	cr := &CertRepMessage{
 		PKIStatus:      FAILURE,
-		FailInfo:       BadRequest,
+		FailInfo:       info,
+		FailInfoText:   text,
 		RecipientNonce: RecipientNonce(msg.SenderNonce),
 	}
 
@@ -451,28 +972,18 @@ func (msg *PKIMessage) Fail(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKey,
 
 }
 
-// Success returns a new PKIMessage with CertRep data using an already-issued certificate
-func (msg *PKIMessage) Success(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKey, crt *x509.Certificate) (*PKIMessage, error) {
-	// check if CSRReqMessage has already been decrypted
-	if msg.CSRReqMessage.CSR == nil {
-		if err := msg.DecryptPKIEnvelope(crtAuth, keyAuth); err != nil {
-			return nil, err
-		}
-	}
-
-	// create a degenerate cert structure
-	deg, err := DegenerateCertificates([]*x509.Certificate{crt})
-	if err != nil {
-		return nil, err
-	}
-
-	// encrypt degenerate data using the original messages recipients
-	e7, err := pkcs7.Encrypt(deg, msg.p7.Certificates)
-	if err != nil {
-		return nil, err
+// Pending returns a new PKIMessage with CertRep data indicating the request
+// is waiting for manual approval. The client is expected to poll with
+// CertPoll using the same transactionID.
+func (msg *PKIMessage) Pending(crtAuth *x509.Certificate, keyAuth crypto.Signer, opts ...Option) (*PKIMessage, error) {
+	conf := &config{}
+	for _, opt := range opts {
+		opt(conf)
 	}
+	conf.replyTo(msg)
+	span := conf.startSpan("scep.Pending", msg.spanAttributes()...)
+	defer span.End()
 
-	// PKIMessageAttributes to be signed
 	config := pkcs7.SignerInfoConfig{
 		ExtraSignedAttributes: []pkcs7.Attribute{
 			{
@@ -481,7 +992,7 @@ func (msg *PKIMessage) Success(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKe
 			},
 			{
 				Type:  oidSCEPpkiStatus,
-				Value: SUCCESS,
+				Value: PENDING,
 			},
 			{
 				Type:  oidSCEPmessageType,
@@ -497,21 +1008,67 @@ func (msg *PKIMessage) Success(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKe
 			},
 		},
 	}
+	config.ExtraSignedAttributes = append(config.ExtraSignedAttributes, conf.extraAttrs...)
 
-	signedData, err := pkcs7.NewSignedData(e7)
+	sd, err := conf.newSignedData(nil)
 	if err != nil {
 		return nil, err
 	}
-	// add the certificate into the signed data type
-	// this cert must be added before the signedData because the recipient will expect it
-	// as the first certificate in the array
-	signedData.AddCertificate(crt)
+
 	// sign the attributes
-	if err := signedData.AddSigner(crtAuth, keyAuth, config); err != nil {
+	if err := sd.AddSigner(crtAuth, keyAuth, config); err != nil {
 		return nil, err
 	}
 
-	certRepBytes, err := signedData.Finish()
+	certRepBytes, err := sd.Finish()
+	if err != nil {
+		return nil, err
+	}
+
+	cr := &CertRepMessage{
+		PKIStatus:      PENDING,
+		RecipientNonce: RecipientNonce(msg.SenderNonce),
+	}
+
+	// create a CertRep message from the original
+	crepMsg := &PKIMessage{
+		Raw:            certRepBytes,
+		TransactionID:  msg.TransactionID,
+		MessageType:    CertRep,
+		CertRepMessage: cr,
+	}
+
+	return crepMsg, nil
+}
+
+// Success returns a new PKIMessage with CertRep data using an already-issued certificate.
+// It answers both certificate enrolment and GetCert requests. The content
+// encryption of the pkiEnvelope may be set with WithEncryptionAlgorithm,
+// the signature digest with WithDigestAlgorithm and intermediate CA
+// certificates to send along with WithCertificateChain. msg is not
+// modified and its pkiEnvelope is not decrypted again: the request may
+// have been opened with a separate RA encryption key, which crtAuth and
+// keyAuth only sign the reply with.
+func (msg *PKIMessage) Success(crtAuth *x509.Certificate, keyAuth crypto.Signer, crt *x509.Certificate, opts ...Option) (*PKIMessage, error) {
+	conf := &config{}
+	for _, opt := range opts {
+		opt(conf)
+	}
+	conf.replyTo(msg)
+	span := conf.startSpan("scep.Success", msg.spanAttributes()...)
+	defer span.End()
+
+	// create a degenerate cert structure, the issued certificate first
+	deg, err := NewDegenerateP7(append([]*x509.Certificate{crt}, conf.certChain...))
+	if err != nil {
+		return nil, err
+	}
+	if err := deg.CheckLeafFirst(); err != nil {
+		return nil, errors.Wrap(err, "scep: certificate chain")
+	}
+	certs := deg.Certificates
+
+	certRepBytes, err := msg.successCertRep(crtAuth, keyAuth, deg.Raw, crt, conf)
 	if err != nil {
 		return nil, err
 	}
@@ -519,8 +1076,8 @@ func (msg *PKIMessage) Success(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKe
 	cr := &CertRepMessage{
 		PKIStatus:      SUCCESS,
 		RecipientNonce: RecipientNonce(msg.SenderNonce),
-		Certificate:    crt,
-		degenerate:     deg,
+		Certificates:   certs,
+		degenerate:     deg.Raw,
 	}
 
 	// create a CertRep message from the original
@@ -534,37 +1091,133 @@ func (msg *PKIMessage) Success(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKe
 	return crepMsg, nil
 }
 
-// DegenerateCertificates creates degenerate certificates pkcs#7 type
-func DegenerateCertificates(certs []*x509.Certificate) ([]byte, error) {
-	var buf bytes.Buffer
-	for _, cert := range certs {
-		buf.Write(cert.Raw)
+// successCertRep encrypts the degenerate PKCS#7 deg for the original
+// message's signer and returns the signed CertRep with pkiStatus SUCCESS.
+// If crt is not nil it is added as the first certificate of the SignedData.
+func (msg *PKIMessage) successCertRep(crtAuth *x509.Certificate, keyAuth crypto.Signer, deg []byte, crt *x509.Certificate, conf *config) ([]byte, error) {
+	alg, err := conf.contentEncryption()
+	if err != nil {
+		return nil, err
 	}
-	degenerate, err := pkcs7.DegenerateCertificate(buf.Bytes())
+	// encrypt degenerate data using the original messages recipients
+	e7, err := encryptPKIEnvelope(deg, msg.p7.Certificates, alg, conf.keyEncryptionFor)
 	if err != nil {
 		return nil, err
 	}
-	return degenerate, nil
+
+	// PKIMessageAttributes to be signed
+	config := pkcs7.SignerInfoConfig{
+		ExtraSignedAttributes: []pkcs7.Attribute{
+			{
+				Type:  oidSCEPtransactionID,
+				Value: msg.TransactionID,
+			},
+			{
+				Type:  oidSCEPpkiStatus,
+				Value: SUCCESS,
+			},
+			{
+				Type:  oidSCEPmessageType,
+				Value: CertRep,
+			},
+			{
+				Type:  oidSCEPsenderNonce,
+				Value: msg.SenderNonce,
+			},
+			{
+				Type:  oidSCEPrecipientNonce,
+				Value: msg.SenderNonce,
+			},
+		},
+	}
+	config.ExtraSignedAttributes = append(config.ExtraSignedAttributes, conf.extraAttrs...)
+
+	signedData, err := conf.newSignedData(e7)
+	if err != nil {
+		return nil, err
+	}
+	// add the certificate into the signed data type
+	// this cert must be added before the signedData because the recipient will expect it
+	// as the first certificate in the array
+	if crt != nil {
+		signedData.AddCertificate(crt)
+	}
+	// sign the attributes
+	if err := signedData.AddSigner(crtAuth, keyAuth, config); err != nil {
+		return nil, err
+	}
+
+	return signedData.Finish()
+}
+
+// DegenerateCertificates creates degenerate certificates pkcs#7 type.
+// The certificates keep their order, duplicates are dropped.
+func DegenerateCertificates(certs []*x509.Certificate) ([]byte, error) {
+	d, err := NewDegenerateP7(certs)
+	if err != nil {
+		return nil, err
+	}
+	return d.Raw, nil
 }
 
-// CACerts extract CA Certificate or chain from pkcs7 degenerate signed data
+// CACerts extract CA Certificate or chain from pkcs7 degenerate signed data.
+// BER encoded data is accepted. The certificates keep their order,
+// duplicates are dropped.
 func CACerts(data []byte) ([]*x509.Certificate, error) {
-	p7, err := pkcs7.Parse(data)
+	d, err := ParseDegenerateP7(data)
 	if err != nil {
 		return nil, err
 	}
-	return p7.Certificates, nil
+	return d.Certificates, nil
 }
 
 // NewCSRRequest creates a scep PKI PKCSReq/UpdateReq message
 func NewCSRRequest(csr *x509.CertificateRequest, tmpl *PKIMessage, opts ...Option) (*PKIMessage, error) {
-	conf := &config{logger: log.NewNopLogger(), certsSelector: NopCertsSelector()}
+	conf := &config{logger: nopLogger{}, certsSelector: NopCertsSelector()}
 	for _, opt := range opts {
 		opt(conf)
 	}
 
-	derBytes := csr.Raw
+	switch tmpl.MessageType {
+	case PKCSReq, RenewalReq, UpdateReq:
+	default:
+		return nil, fmt.Errorf("%w: %s is not a CSR request", ErrUnsupportedMessageType, tmpl.MessageType)
+	}
+
+	// create transaction ID from public key hash
+	tID, err := newTransactionID(csr.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	debug(conf.logger,
+		"msg", "creating SCEP CSR request",
+		"transaction_id", tID,
+		"signer_cn", tmpl.SignerCert.Subject.CommonName,
+	)
+
+	newMsg, err := newRequest(csr.Raw, tID, tmpl.MessageType, tmpl, conf)
+	if err != nil {
+		return nil, err
+	}
+	newMsg.CSRReqMessage = &CSRReqMessage{
+		CSR: csr,
+	}
+	return newMsg, nil
+}
+
+// newRequest encrypts content for the selected recipients of tmpl and signs
+// it with the SCEP request attributes.
+func newRequest(content []byte, tID TransactionID, msgType MessageType, tmpl *PKIMessage, conf *config) (*PKIMessage, error) {
+	span := conf.startSpan("scep.NewRequest",
+		tracing.String(tracing.TransactionIDKey, string(tID)),
+		tracing.String(tracing.MessageTypeKey, msgType.String()),
+	)
+	defer span.End()
 	recipients := conf.certsSelector.SelectCerts(tmpl.Recipients)
+	if len(recipients) < 1 && conf.strictness == Lenient {
+		recipients = caRecipients(tmpl.Recipients)
+	}
 	if len(recipients) < 1 {
 		if len(tmpl.Recipients) >= 1 {
 			// our certsSelector eliminated any CA/RA recipients
@@ -572,33 +1225,31 @@ func NewCSRRequest(csr *x509.CertificateRequest, tmpl *PKIMessage, opts ...Optio
 		}
 		return nil, errors.New("no CA/RA recipients")
 	}
-	e7, err := pkcs7.Encrypt(derBytes, recipients)
+	alg, err := conf.contentEncryption()
 	if err != nil {
 		return nil, err
 	}
-
-	signedData, err := pkcs7.NewSignedData(e7)
+	if alg == pkcs7.EncryptionAlgorithmDESCBC {
+		warn(conf.logger,
+			"msg", "encrypting SCEP request with deprecated DES-CBC, use AES if the CA supports it",
+			"content_encryption", DESCBC,
+		)
+	}
+	e7, err := encryptPKIEnvelope(content, recipients, alg, conf.keyEncryptionFor)
 	if err != nil {
 		return nil, err
 	}
 
-	// create transaction ID from public key hash
-	tID, err := newTransactionID(csr.PublicKey)
+	signedData, err := conf.newSignedData(e7)
 	if err != nil {
 		return nil, err
 	}
 
-	sn, err := newNonce()
+	sn, err := conf.newSenderNonce()
 	if err != nil {
 		return nil, err
 	}
 
-	level.Debug(conf.logger).Log(
-		"msg", "creating SCEP CSR request",
-		"transaction_id", tID,
-		"signer_cn", tmpl.SignerCert.Subject.CommonName,
-	)
-
 	// PKIMessageAttributes to be signed
 	config := pkcs7.SignerInfoConfig{
 		ExtraSignedAttributes: []pkcs7.Attribute{
@@ -608,7 +1259,7 @@ func NewCSRRequest(csr *x509.CertificateRequest, tmpl *PKIMessage, opts ...Optio
 			},
 			{
 				Type:  oidSCEPmessageType,
-				Value: tmpl.MessageType,
+				Value: msgType,
 			},
 			{
 				Type:  oidSCEPsenderNonce,
@@ -616,6 +1267,7 @@ func NewCSRRequest(csr *x509.CertificateRequest, tmpl *PKIMessage, opts ...Optio
 			},
 		},
 	}
+	config.ExtraSignedAttributes = append(config.ExtraSignedAttributes, conf.extraAttrs...)
 
 	// sign attributes
 	if err := signedData.AddSigner(tmpl.SignerCert, tmpl.SignerKey, config); err != nil {
@@ -627,16 +1279,11 @@ func NewCSRRequest(csr *x509.CertificateRequest, tmpl *PKIMessage, opts ...Optio
 		return nil, err
 	}
 
-	cr := &CSRReqMessage{
-		CSR: csr,
-	}
-
 	newMsg := &PKIMessage{
 		Raw:           rawPKIMessage,
-		MessageType:   tmpl.MessageType,
+		MessageType:   msgType,
 		TransactionID: tID,
 		SenderNonce:   sn,
-		CSRReqMessage: cr,
 		Recipients:    recipients,
 		logger:        conf.logger,
 	}
@@ -644,17 +1291,9 @@ func NewCSRRequest(csr *x509.CertificateRequest, tmpl *PKIMessage, opts ...Optio
 	return newMsg, nil
 }
 
-func newNonce() (SenderNonce, error) {
-	size := 16
-	b := make([]byte, size)
-	_, err := rand.Read(b)
-	if err != nil {
-		return SenderNonce{}, err
-	}
-	return SenderNonce(b), nil
-}
-
-// use public key to create a deterministric transactionID
+// use public key to create a deterministric transactionID.
+// The key hash is the same computed Subject Key Identifier used by
+// SubjectKeyIDCertsSelector for certificates without a SubjectKeyId extension.
 func newTransactionID(key crypto.PublicKey) (TransactionID, error) {
 	id, err := cryptoutil.GenerateSubjectKeyID(key)
 	if err != nil {
@@ -1,12 +1,20 @@
 package scep_test
 
 import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
 	"encoding/pem"
 	"errors"
+	"io"
 	"io/ioutil"
 	"math/big"
 	"testing"
@@ -15,6 +23,9 @@ import (
 	"github.com/micromdm/scep/v2/cryptoutil"
 	"github.com/micromdm/scep/v2/depot"
 	"github.com/micromdm/scep/v2/scep"
+
+	"github.com/go-kit/kit/log"
+	"go.mozilla.org/pkcs7"
 )
 
 func testParsePKIMessage(t *testing.T, data []byte) *scep.PKIMessage {
@@ -89,6 +100,74 @@ func TestDecryptPKIEnvelopeCert(t *testing.T) {
 	// }
 }
 
+// TestGoldenVectors parses captured messages of other SCEP implementations
+// and checks the attributes decoded from them. New captures are added to
+// testdata with a row here.
+func TestGoldenVectors(t *testing.T) {
+	ca2 := decodePEMCert(t, loadTestFile(t, "testdata/testca2/ca2.pem"))
+	for _, test := range []struct {
+		file          string
+		opts          []scep.Option
+		messageType   scep.MessageType
+		transactionID scep.TransactionID
+		pkiStatus     scep.PKIStatus
+		signer        string
+	}{
+		{
+			file:          "testdata/PKCSReq.der",
+			messageType:   scep.PKCSReq,
+			transactionID: "A13090761A30F66664F85D37433D2065E1112BA1",
+			signer:        "CN=MDM SCEP SIGNER,C=US",
+		},
+		{
+			file:          "testdata/CertRep.der",
+			messageType:   scep.CertRep,
+			transactionID: "A13090761A30F66664F85D37433D2065E1112BA1",
+			pkiStatus:     scep.SUCCESS,
+			signer:        "OU=CA,O=etcd-ca,C=USA",
+		},
+		{
+			// jscep-style CertRep without the certificate of its signer
+			file:        "testdata/testca2/CertRep_NoCertificatesForSigners.der",
+			opts:        []scep.Option{scep.WithCACerts([]*x509.Certificate{ca2})},
+			messageType: scep.CertRep,
+			pkiStatus:   scep.SUCCESS,
+		},
+	} {
+		t.Run(test.file, func(t *testing.T) {
+			msg, err := scep.ParsePKIMessage(loadTestFile(t, test.file), test.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.MessageType != test.messageType {
+				t.Errorf("have messageType %s, want %s", msg.MessageType, test.messageType)
+			}
+			if test.transactionID != "" && msg.TransactionID != test.transactionID {
+				t.Errorf("have transactionID %s, want %s", msg.TransactionID, test.transactionID)
+			}
+			if msg.CertRepMessage != nil && msg.PKIStatus != test.pkiStatus {
+				t.Errorf("have pkiStatus %s, want %s", msg.PKIStatus, test.pkiStatus)
+			}
+			if test.signer != "" && msg.SignerCert.Subject.String() != test.signer {
+				t.Errorf("have signer %s, want %s", msg.SignerCert.Subject, test.signer)
+			}
+		})
+	}
+}
+
+func TestMessageTypeString(t *testing.T) {
+	for msgType, want := range map[scep.MessageType]string{
+		scep.PKCSReq:  "PKCSReq (19)",
+		scep.CertPoll: "CertPoll (20)",
+		"99":          "unknown(99)",
+		"":            "unknown()",
+	} {
+		if have := msgType.String(); have != want {
+			t.Errorf("have %q, want %q", have, want)
+		}
+	}
+}
+
 func TestSignCSR(t *testing.T) {
 	pkcsReq := loadTestFile(t, "testdata/PKCSReq.der")
 	msg := testParsePKIMessage(t, pkcsReq)
@@ -129,6 +208,52 @@ func TestSignCSR(t *testing.T) {
 	testParsePKIMessage(t, certRep.Raw)
 }
 
+func TestOpenEnvelopeConcurrent(t *testing.T) {
+	msg := testParsePKIMessage(t, loadTestFile(t, "testdata/PKCSReq.der"))
+	cacert, cakey := loadCACredentials(t)
+	env, err := msg.OpenEnvelope(cacert, cakey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr := env.CSRReqMessage.CSR
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(4),
+		Subject:      csr.Subject,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, cacert, csr.PublicKey, cakey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			env, err := msg.OpenEnvelope(cacert, cakey)
+			if err == nil && !bytes.Equal(env.CSRReqMessage.RawDecrypted, csr.Raw) {
+				err = errors.New("opened another CSR")
+			}
+			if err == nil {
+				_, err = msg.Success(cacert, cakey, crt)
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if msg.CSRReqMessage != nil {
+		t.Error("OpenEnvelope and Success modified the message")
+	}
+}
+
 func TestNewCSRRequest(t *testing.T) {
 	for _, test := range []struct {
 		testName          string
@@ -204,6 +329,87 @@ func TestNewCSRRequest(t *testing.T) {
 	}
 }
 
+func TestReEnvelope(t *testing.T) {
+	key, err := newRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derBytes, err := newCSR(key, "john.doe@example.com", "US", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(derBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientcert, clientkey := loadClientCredentials(t)
+	racert, rakey := createCaCertWithKeyUsage(t, x509.KeyUsageKeyEncipherment|x509.KeyUsageDigitalSignature)
+	cacert, cakey := loadCACredentials(t)
+
+	// the device enrolls with the RA
+	pkcsreq, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{racert},
+		SignerCert:  clientcert,
+		SignerKey:   clientkey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := testParsePKIMessage(t, pkcsreq.Raw)
+	if err := msg.DecryptPKIEnvelope(racert, rakey); err != nil {
+		t.Fatal(err)
+	}
+
+	// the RA forwards the CSR to the CA
+	fwd, err := scep.ReEnvelope(msg, &scep.PKIMessage{
+		Recipients: []*x509.Certificate{cacert},
+		SignerCert: racert,
+		SignerKey:  rakey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := testParsePKIMessage(t, fwd.Raw)
+	if err := upstream.DecryptPKIEnvelope(cacert, cakey); err != nil {
+		t.Fatal(err)
+	}
+	if upstream.MessageType != scep.PKCSReq || upstream.TransactionID != msg.TransactionID {
+		t.Errorf("have %s for transaction %s, want PKCSReq for %s", upstream.MessageType, upstream.TransactionID, msg.TransactionID)
+	}
+	if !upstream.SignerCert.Equal(racert) {
+		t.Errorf("forwarded request signed by %s, want the RA", upstream.SignerCert.Subject)
+	}
+	if !bytes.Equal(upstream.CSRReqMessage.RawDecrypted, derBytes) {
+		t.Error("forwarded CSR differs from the CSR of the device")
+	}
+
+	// the RA answers the device with the certificate issued by the CA
+	certRep, err := upstream.Success(cacert, cakey, clientcert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := testParsePKIMessage(t, certRep.Raw)
+	if err := rep.DecryptPKIEnvelope(racert, rakey); err != nil {
+		t.Fatal(err)
+	}
+	devRep, err := msg.Success(racert, rakey, rep.Certificates[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	devMsg := testParsePKIMessage(t, devRep.Raw)
+	if err := devMsg.DecryptPKIEnvelope(clientcert, clientkey); err != nil {
+		t.Fatal(err)
+	}
+	if devMsg.TransactionID != msg.TransactionID || !devMsg.Certificates[0].Equal(clientcert) {
+		t.Error("device did not receive the certificate issued by the CA")
+	}
+
+	if _, err := scep.ReEnvelope(pkcsreq, &scep.PKIMessage{SignerCert: racert, SignerKey: rakey}); err == nil {
+		t.Error("want an error re-enveloping a request which was not decrypted")
+	}
+}
+
 // create a new RSA private key
 func newRSAKey(bits int) (*rsa.PrivateKey, error) {
 	private, err := rsa.GenerateKey(rand.Reader, bits)
@@ -229,7 +435,7 @@ func newCSR(priv *rsa.PrivateKey, email, country, cname string) ([]byte, error)
 	return x509.CreateCertificateRequest(rand.Reader, template, priv)
 }
 
-func loadTestFile(t *testing.T, path string) []byte {
+func loadTestFile(t testing.TB, path string) []byte {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		t.Fatal(err)
@@ -260,7 +466,7 @@ func createCaCertWithKeyUsage(t *testing.T, keyUsage x509.KeyUsage) (*x509.Certi
 	return cert, key
 }
 
-func loadCACredentials(t *testing.T) (*x509.Certificate, *rsa.PrivateKey) {
+func loadCACredentials(t testing.TB) (*x509.Certificate, *rsa.PrivateKey) {
 	cert, err := loadCertFromFile("testdata/testca/ca.crt")
 	if err != nil {
 		t.Fatal(err)
@@ -272,7 +478,7 @@ func loadCACredentials(t *testing.T) (*x509.Certificate, *rsa.PrivateKey) {
 	return cert, key
 }
 
-func loadClientCredentials(t *testing.T) (*x509.Certificate, *rsa.PrivateKey) {
+func loadClientCredentials(t testing.TB) (*x509.Certificate, *rsa.PrivateKey) {
 	cert, err := loadCertFromFile("testdata/testclient/client.pem")
 	if err != nil {
 		t.Fatal(err)
@@ -349,3 +555,918 @@ func decodePEMCert(t *testing.T, data []byte) *x509.Certificate {
 	}
 	return cert
 }
+
+// Tests that the transaction ID matches the computed Subject Key Identifier
+// of a certificate lacking the SubjectKeyId extension for the same key.
+func TestNewCSRRequestTransactionIDWithoutSKI(t *testing.T) {
+	key, err := newRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derBytes, err := newCSR(key, "john.doe@example.com", "US", "ski-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(derBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ski-test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	crtBytes, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerCert, err := x509.ParseCertificate(crtBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signerCert.SubjectKeyId) != 0 {
+		t.Fatal("expected certificate without SubjectKeyId extension")
+	}
+	ski, err := cryptoutil.SubjectKeyID(signerCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cacert, cakey := loadCACredentials(t)
+	msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{cacert},
+		SignerCert:  signerCert,
+		SignerKey:   key,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := msg.TransactionID, scep.TransactionID(base64.StdEncoding.EncodeToString(ski)); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	parsed := testParsePKIMessage(t, msg.Raw)
+	if err := parsed.DecryptPKIEnvelope(cacert, cakey); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParsePKIMessageNotSignedData(t *testing.T) {
+	cacert, _ := loadCACredentials(t)
+	enveloped, err := pkcs7.Encrypt([]byte("not a scep message"), []*x509.Certificate{cacert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+	}{
+		ContentType: pkcs7.OIDData,
+		Content:     asn1.RawValue{Tag: asn1.TagOctetString, Bytes: []byte("data")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		testName string
+		data     []byte
+	}{
+		{"EnvelopedData", enveloped},
+		{"Data", data},
+	} {
+		test := test
+		t.Run(test.testName, func(t *testing.T) {
+			t.Parallel()
+			_, err := scep.ParsePKIMessage(test.data)
+			if !errors.Is(err, scep.ErrNotSignedData) {
+				t.Errorf("have %v, want %v", err, scep.ErrNotSignedData)
+			}
+		})
+	}
+}
+
+func TestNewCSRRequestWeakEncryptionWarning(t *testing.T) {
+	key, err := newRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derBytes, err := newCSR(key, "john.doe@example.com", "US", "des-warning")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(derBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientcert, clientkey := loadClientCredentials(t)
+	cacert, _ := loadCACredentials(t)
+
+	// ContentEncryptionAlgorithm is a package global, so this test must not
+	// run in parallel with other encrypting tests.
+	defer func(alg int) { pkcs7.ContentEncryptionAlgorithm = alg }(pkcs7.ContentEncryptionAlgorithm)
+
+	for _, test := range []struct {
+		name     string
+		alg      int
+		wantWarn bool
+	}{
+		{"DES-CBC", pkcs7.EncryptionAlgorithmDESCBC, true},
+		{"AES-128-CBC", pkcs7.EncryptionAlgorithmAES128CBC, false},
+		{"AES-256-CBC", pkcs7.EncryptionAlgorithmAES256CBC, false},
+	} {
+		pkcs7.ContentEncryptionAlgorithm = test.alg
+		var warned bool
+		logger := log.LoggerFunc(func(keyvals ...interface{}) error {
+			for _, v := range keyvals {
+				if v == scep.LevelWarn {
+					warned = true
+				}
+			}
+			return nil
+		})
+		_, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+			MessageType: scep.PKCSReq,
+			Recipients:  []*x509.Certificate{cacert},
+			SignerCert:  clientcert,
+			SignerKey:   clientkey,
+		}, scep.WithLogger(logger))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if warned != test.wantWarn {
+			t.Errorf("%s: have warning %v, want %v", test.name, warned, test.wantWarn)
+		}
+	}
+}
+
+func TestGetCertRequest(t *testing.T) {
+	clientcert, clientkey := loadClientCredentials(t)
+	cacert, cakey := loadCACredentials(t)
+	ias := scep.NewIssuerAndSerial(clientcert)
+
+	req, err := scep.NewGetCertRequest(ias, &scep.PKIMessage{
+		Recipients: []*x509.Certificate{cacert},
+		SignerCert: clientcert,
+		SignerKey:  clientkey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := testParsePKIMessage(t, req.Raw)
+	if have, want := msg.MessageType, scep.MessageType(scep.GetCert); have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+	if err := msg.DecryptPKIEnvelope(cacert, cakey); err != nil {
+		t.Fatal(err)
+	}
+	if !msg.GetCertMessage.Matches(clientcert) {
+		t.Errorf("decrypted IssuerAndSerial %v does not match certificate", msg.GetCertMessage.SerialNumber)
+	}
+
+	// the CA answers with the requested certificate
+	certRep, err := msg.Success(cacert, cakey, clientcert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := testParsePKIMessage(t, certRep.Raw)
+	if have, want := rep.PKIStatus, scep.PKIStatus(scep.SUCCESS); have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+	if have, want := rep.RecipientNonce, scep.RecipientNonce(req.SenderNonce); !bytes.Equal(have, want) {
+		t.Errorf("have recipientNonce %x, want %x", have, want)
+	}
+	if err := rep.DecryptPKIEnvelope(clientcert, clientkey); err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Certificates[0].Equal(clientcert) {
+		t.Error("CertRep does not contain the requested certificate")
+	}
+}
+
+func TestSuccessCertificateChain(t *testing.T) {
+	clientcert, clientkey := loadClientCredentials(t)
+	cacert, cakey := loadCACredentials(t)
+	intermediate, _ := createCaCertWithKeyUsage(t, x509.KeyUsageCertSign)
+
+	req, err := scep.NewGetCertRequest(scep.NewIssuerAndSerial(clientcert), &scep.PKIMessage{
+		Recipients: []*x509.Certificate{cacert},
+		SignerCert: clientcert,
+		SignerKey:  clientkey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := testParsePKIMessage(t, req.Raw)
+	if err := msg.DecryptPKIEnvelope(cacert, cakey); err != nil {
+		t.Fatal(err)
+	}
+	chain := []*x509.Certificate{intermediate}
+	certRep, err := msg.Success(cacert, cakey, clientcert, scep.WithCertificateChain(chain))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep := testParsePKIMessage(t, certRep.Raw)
+	if err := rep.DecryptPKIEnvelope(clientcert, clientkey); err != nil {
+		t.Fatal(err)
+	}
+	certs := rep.Certificates
+	if len(certs) != 2 || !certs[0].Equal(clientcert) || !certs[1].Equal(intermediate) {
+		t.Errorf("have %d certificates, want the issued certificate and its chain", len(certs))
+	}
+}
+
+func TestCertRepLeaf(t *testing.T) {
+	clientcert, _ := loadClientCredentials(t)
+	cacert, _ := loadCACredentials(t)
+	other, _ := createCaCertWithKeyUsage(t, x509.KeyUsageCertSign)
+
+	// CAs may send the chain before the issued certificate
+	rep := &scep.CertRepMessage{Certificates: []*x509.Certificate{cacert, clientcert}}
+	leaf, err := rep.Leaf(clientcert.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !leaf.Equal(clientcert) {
+		t.Errorf("have leaf %s, want %s", leaf.Subject, clientcert.Subject)
+	}
+	if _, err := rep.Leaf(other.PublicKey); err != scep.ErrNoMatchingCertificate {
+		t.Errorf("have error %v, want %v", err, scep.ErrNoMatchingCertificate)
+	}
+}
+
+func TestGetCRLRequest(t *testing.T) {
+	clientcert, clientkey := loadClientCredentials(t)
+	cacert, cakey := createCaCertWithKeyUsage(t, x509.KeyUsageCertSign|x509.KeyUsageCRLSign|x509.KeyUsageKeyEncipherment)
+
+	crlBytes, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+		RevokedCertificates: []pkix.RevokedCertificate{
+			{SerialNumber: big.NewInt(42), RevocationTime: time.Now()},
+		},
+	}, cacert, cakey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := scep.NewGetCRLRequest(scep.NewIssuerAndSerial(clientcert), &scep.PKIMessage{
+		Recipients: []*x509.Certificate{cacert},
+		SignerCert: clientcert,
+		SignerKey:  clientkey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := testParsePKIMessage(t, req.Raw)
+	if have, want := msg.MessageType, scep.MessageType(scep.GetCRL); have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+	if err := msg.DecryptPKIEnvelope(cacert, cakey); err != nil {
+		t.Fatal(err)
+	}
+	if !msg.GetCRLMessage.Matches(clientcert) {
+		t.Errorf("decrypted IssuerAndSerial %v does not match certificate", msg.GetCRLMessage.SerialNumber)
+	}
+
+	certRep, err := msg.SuccessCRL(cacert, cakey, crlBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := testParsePKIMessage(t, certRep.Raw)
+	if have, want := rep.PKIStatus, scep.PKIStatus(scep.SUCCESS); have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+	if err := rep.DecryptPKIEnvelope(clientcert, clientkey); err != nil {
+		t.Fatal(err)
+	}
+	if rep.CRLRepMessage == nil {
+		t.Fatal("CertRep does not contain a CRL")
+	}
+	revoked := rep.CRL.TBSCertList.RevokedCertificates
+	if len(revoked) != 1 || revoked[0].SerialNumber.Cmp(big.NewInt(42)) != 0 {
+		t.Errorf("unexpected revoked certificates %v", revoked)
+	}
+	if err := cacert.CheckCRLSignature(rep.CRL); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCertPollPending(t *testing.T) {
+	key, err := newRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derBytes, err := newCSR(key, "john.doe@example.com", "US", "pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(derBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientcert, clientkey := loadClientCredentials(t)
+	cacert, cakey := loadCACredentials(t)
+	tmpl := &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{cacert},
+		SignerCert:  clientcert,
+		SignerKey:   clientkey,
+	}
+	pkcsreq, err := scep.NewCSRRequest(csr, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the CA defers the request
+	msg := testParsePKIMessage(t, pkcsreq.Raw)
+	pending, err := msg.Pending(cacert, cakey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := testParsePKIMessage(t, pending.Raw)
+	if have, want := rep.PKIStatus, scep.PKIStatus(scep.PENDING); have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+	if have, want := rep.TransactionID, pkcsreq.TransactionID; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	// the client polls within the same transaction
+	tmpl.TransactionID = pkcsreq.TransactionID
+	poll, err := scep.NewCertPollRequest(scep.NewIssuerAndSubject(cacert, csr), tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg = testParsePKIMessage(t, poll.Raw)
+	if have, want := msg.MessageType, scep.MessageType(scep.CertPoll); have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+	if have, want := msg.TransactionID, pkcsreq.TransactionID; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if err := msg.DecryptPKIEnvelope(cacert, cakey); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := msg.CertPollMessage.Subject.FullBytes, csr.RawSubject; !bytes.Equal(have, want) {
+		t.Errorf("have subject %x, want %x", have, want)
+	}
+	if have, want := msg.CertPollMessage.Issuer.FullBytes, cacert.RawSubject; !bytes.Equal(have, want) {
+		t.Errorf("have issuer %x, want %x", have, want)
+	}
+}
+
+func TestECDSASignerAndRecipient(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derBytes, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "ecdsa"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(derBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ecdsa"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyAgreement,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selfSigned, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cacert, cakey := loadCACredentials(t)
+	pkcsreq, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{cacert},
+		SignerCert:  selfSigned,
+		SignerKey:   key,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the CA verifies the ECDSA signature and answers to the EC certificate
+	msg := testParsePKIMessage(t, pkcsreq.Raw)
+	if err := msg.DecryptPKIEnvelope(cacert, cakey); err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(2)
+	crtBytes, err := x509.CreateCertificate(rand.Reader, tmpl, cacert, msg.CSRReqMessage.CSR.PublicKey, cakey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(crtBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	success, err := msg.Success(cacert, cakey, crt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client decrypts the ECDH key agreement envelope
+	rep := testParsePKIMessage(t, success.Raw)
+	if err := rep.DecryptPKIEnvelope(selfSigned, key); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := rep.CertRepMessage.Certificates[0].Raw, crt.Raw; !bytes.Equal(have, want) {
+		t.Error("decrypted certificate does not match issued certificate")
+	}
+}
+
+func TestDigestAlgorithm(t *testing.T) {
+	key, err := newRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derBytes, err := newCSR(key, "john.doe@example.com", "US", "digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(derBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientcert, clientkey := loadClientCredentials(t)
+	cacert, cakey := loadCACredentials(t)
+	tmpl := &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{cacert},
+		SignerCert:  clientcert,
+		SignerKey:   clientkey,
+	}
+
+	// the default SHA-1 signature is rejected by a SHA-256 minimum
+	sha1Req, err := scep.NewCSRRequest(csr, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scep.ParsePKIMessage(sha1Req.Raw, scep.WithDigestAlgorithm(crypto.SHA256)); err == nil {
+		t.Error("expected SHA-1 signed message to be rejected")
+	}
+
+	req, err := scep.NewCSRRequest(csr, tmpl, scep.WithDigestAlgorithm(crypto.SHA256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDigestAlgorithm(t, req.Raw, pkcs7.OIDDigestAlgorithmSHA256)
+	msg, err := scep.ParsePKIMessage(req.Raw, scep.WithDigestAlgorithm(crypto.SHA256))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replies default to the digest of the request
+	pending, err := msg.Pending(cacert, cakey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDigestAlgorithm(t, pending.Raw, pkcs7.OIDDigestAlgorithmSHA256)
+
+	failed, err := msg.Fail(cacert, cakey, scep.BadRequest, scep.WithDigestAlgorithm(crypto.SHA512))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDigestAlgorithm(t, failed.Raw, pkcs7.OIDDigestAlgorithmSHA512)
+	if _, err := scep.ParsePKIMessage(failed.Raw, scep.WithDigestAlgorithm(crypto.SHA384)); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := scep.NewCSRRequest(csr, tmpl, scep.WithDigestAlgorithm(crypto.MD5)); err == nil {
+		t.Error("expected error for unsupported digest algorithm")
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	caps := scep.ParseCapabilities([]byte("Renewal\r\nsha-256\nAES\n\nX-Vendor\n"))
+	if want := "Renewal\nsha-256\nAES\nX-Vendor"; string(caps.Marshal()) != want {
+		t.Errorf("have %q, want %q", caps.Marshal(), want)
+	}
+	if !caps.Has(scep.CapSHA256) || !caps.Has("x-vendor") || caps.Has(scep.CapSHA512) {
+		t.Errorf("unexpected Has results for %v", caps)
+	}
+
+	for _, test := range []struct {
+		caps   string
+		digest crypto.Hash
+		alg    scep.EncryptionAlgorithm
+		post   bool
+	}{
+		{"", crypto.SHA1, scep.DESCBC, false},
+		{"DES3\nSHA-1", crypto.SHA1, scep.DES3CBC, false},
+		{"POSTPKIOperation\nAES\nSHA-256\nSHA-512", crypto.SHA512, scep.AES128CBC, true},
+		{"SCEPStandard", crypto.SHA256, scep.AES128CBC, true},
+	} {
+		caps := scep.ParseCapabilities([]byte(test.caps))
+		if have := caps.DigestAlgorithm(); have != test.digest {
+			t.Errorf("%q: have digest %s, want %s", test.caps, have, test.digest)
+		}
+		if have := caps.EncryptionAlgorithm(); have != test.alg {
+			t.Errorf("%q: have encryption %s, want %s", test.caps, have, test.alg)
+		}
+		if have := caps.POSTPKIOperation(); have != test.post {
+			t.Errorf("%q: have POSTPKIOperation %v, want %v", test.caps, have, test.post)
+		}
+	}
+}
+
+func checkDigestAlgorithm(t *testing.T, data []byte, want asn1.ObjectIdentifier) {
+	t.Helper()
+	p7, err := pkcs7.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := p7.Signers[0].DigestAlgorithm.Algorithm; !have.Equal(want) {
+		t.Errorf("have digest %s, want %s", have, want)
+	}
+}
+
+// opaqueKey hides the concrete key type, like a key held by an HSM.
+type opaqueKey struct {
+	key *rsa.PrivateKey
+}
+
+func (k opaqueKey) Public() crypto.PublicKey { return k.key.Public() }
+
+func (k opaqueKey) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return k.key.Sign(rand, digest, opts)
+}
+
+func (k opaqueKey) Decrypt(rand io.Reader, ciphertext []byte, opts crypto.DecrypterOpts) ([]byte, error) {
+	return k.key.Decrypt(rand, ciphertext, opts)
+}
+
+func TestOpaqueSignerKeys(t *testing.T) {
+	key, err := newRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derBytes, err := newCSR(key, "john.doe@example.com", "US", "hsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(derBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientcert, clientkey := loadClientCredentials(t)
+	cacert, cakey := loadCACredentials(t)
+	pkcsreq, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{cacert},
+		SignerCert:  clientcert,
+		SignerKey:   opaqueKey{clientkey},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := testParsePKIMessage(t, pkcsreq.Raw)
+	if err := msg.DecryptPKIEnvelope(cacert, opaqueKey{cakey}); err != nil {
+		t.Fatal(err)
+	}
+	failed, err := msg.Fail(cacert, opaqueKey{cakey}, scep.BadRequest, scep.WithDigestAlgorithm(crypto.SHA256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := testParsePKIMessage(t, failed.Raw)
+	if have, want := rep.PKIStatus, scep.PKIStatus(scep.FAILURE); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
+
+func TestSignerValidation(t *testing.T) {
+	cacert, cakey := loadCACredentials(t)
+	key, err := newRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := newCSR(key, "john.doe@example.com", "US", "com.apple.scep.2379B935-294B-4AF1-A213-9BD44A2C6688")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCert := func(key *rsa.PrivateKey, parent *x509.Certificate, parentKey *rsa.PrivateKey, notAfter time.Time) *x509.Certificate {
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: "signer"},
+			NotBefore:    time.Now().Add(-2 * time.Hour),
+			NotAfter:     notAfter,
+		}
+		if parent == nil {
+			parent, parentKey = tmpl, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	otherKey, err := newRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := time.Now().Add(time.Hour)
+
+	for _, test := range []struct {
+		name    string
+		msgType scep.MessageType
+		signer  *x509.Certificate
+		key     *rsa.PrivateKey
+		wantErr bool
+	}{
+		{"self-signed PKCSReq", scep.PKCSReq, newCert(key, nil, nil, valid), key, false},
+		{"expired PKCSReq", scep.PKCSReq, newCert(key, nil, nil, time.Now().Add(-time.Hour)), key, true},
+		{"self-signed PKCSReq for other key", scep.PKCSReq, newCert(otherKey, nil, nil, valid), otherKey, true},
+		{"issued PKCSReq", scep.PKCSReq, newCert(otherKey, cacert, cakey, valid), otherKey, false},
+		{"issued RenewalReq", scep.RenewalReq, newCert(otherKey, cacert, cakey, valid), otherKey, false},
+		{"self-signed RenewalReq", scep.RenewalReq, newCert(key, nil, nil, valid), key, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+				MessageType: test.msgType,
+				Recipients:  []*x509.Certificate{cacert},
+				SignerCert:  test.signer,
+				SignerKey:   test.key,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := scep.ParsePKIMessage(req.Raw, scep.WithSignerValidation([]*x509.Certificate{cacert}))
+			if err == nil {
+				err = msg.DecryptPKIEnvelope(cacert, cakey)
+			}
+			if have := err != nil; have != test.wantErr {
+				t.Errorf("have error %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestFailInfoText(t *testing.T) {
+	msg := testParsePKIMessage(t, loadTestFile(t, "testdata/PKCSReq.der"))
+	cacert, cakey := loadCACredentials(t)
+	for _, text := range []string{"", "device not enrolled in MDM – contact IT"} {
+		failed, err := msg.Fail(cacert, cakey, scep.BadRequest, scep.WithFailInfoText(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rep := testParsePKIMessage(t, failed.Raw)
+		if have, want := rep.FailInfoText, text; have != want {
+			t.Errorf("have failInfoText %q, want %q", have, want)
+		}
+	}
+	if have, want := scep.FailInfo("5").String(), "unknown(5)"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
+
+func TestFailWith(t *testing.T) {
+	msg := testParsePKIMessage(t, loadTestFile(t, "testdata/PKCSReq.der"))
+	cacert, cakey := loadCACredentials(t)
+
+	// the returned CertRep carries the requested failInfo
+	failed, err := msg.Fail(cacert, cakey, scep.BadCertID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := failed.FailInfo, scep.FailInfo(scep.BadCertID); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	oid := asn1.ObjectIdentifier{1, 2, 3, 4}
+	failed, err = msg.FailWith(cacert, cakey, scep.FailureOptions{
+		FailInfo:        scep.BadTime,
+		FailInfoText:    "clock skew",
+		ExtraAttributes: []pkcs7.Attribute{{Type: oid, Value: "extra"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := testParsePKIMessage(t, failed.Raw)
+	if have, want := rep.FailInfo, scep.FailInfo(scep.BadTime); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if have, want := rep.FailInfoText, "clock skew"; have != want {
+		t.Errorf("have failInfoText %q, want %q", have, want)
+	}
+	p7, err := pkcs7.Parse(failed.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var extra string
+	if err := p7.UnmarshalSignedAttribute(oid, &extra); err != nil || extra != "extra" {
+		t.Errorf("have extra attribute %q, err %v", extra, err)
+	}
+}
+
+func TestExtraSignedAttributes(t *testing.T) {
+	clientcert, clientkey := loadClientCredentials(t)
+	cacert, cakey := loadCACredentials(t)
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 99, 1}
+	attrs := scep.WithExtraSignedAttributes([]pkcs7.Attribute{{Type: oid, Value: "device-42"}})
+	checkAttr := func(t *testing.T, data []byte) {
+		t.Helper()
+		p7, err := pkcs7.Parse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var value string
+		if err := p7.UnmarshalSignedAttribute(oid, &value); err != nil || value != "device-42" {
+			t.Errorf("have attribute %q, err %v", value, err)
+		}
+	}
+
+	req, err := scep.NewGetCertRequest(scep.NewIssuerAndSerial(clientcert), &scep.PKIMessage{
+		Recipients: []*x509.Certificate{cacert},
+		SignerCert: clientcert,
+		SignerKey:  clientkey,
+	}, attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAttr(t, req.Raw)
+
+	msg := testParsePKIMessage(t, req.Raw)
+	if err := msg.DecryptPKIEnvelope(cacert, cakey); err != nil {
+		t.Fatal(err)
+	}
+	success, err := msg.Success(cacert, cakey, clientcert, attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAttr(t, success.Raw)
+	failed, err := msg.Fail(cacert, cakey, scep.BadCertID, attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkAttr(t, failed.Raw)
+}
+
+type traceKey struct{}
+
+// contextSigner records the trace ID of the contexts it signs with.
+type contextSigner struct {
+	crypto.Signer
+	traces []interface{}
+}
+
+func (s *contextSigner) SignContext(ctx context.Context, rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.traces = append(s.traces, ctx.Value(traceKey{}))
+	return s.Signer.Sign(rand, digest, opts)
+}
+
+func TestContextVariants(t *testing.T) {
+	data := loadTestFile(t, "testdata/PKCSReq.der")
+	cacert, cakey := loadCACredentials(t)
+	clientcert, clientkey := loadClientCredentials(t)
+	msg := testParsePKIMessage(t, data)
+	if err := msg.DecryptPKIEnvelope(cacert, cakey); err != nil {
+		t.Fatal(err)
+	}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tmpl := &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{cacert},
+		SignerCert:  clientcert,
+		SignerKey:   clientkey,
+	}
+	for name, call := range map[string]func() error{
+		"ParsePKIMessageContext": func() error {
+			_, err := scep.ParsePKIMessageContext(canceled, data)
+			return err
+		},
+		"DecryptPKIEnvelopeContext": func() error {
+			return testParsePKIMessage(t, data).DecryptPKIEnvelopeContext(canceled, cacert, cakey)
+		},
+		"SuccessContext": func() error {
+			_, err := msg.SuccessContext(canceled, cacert, cakey, clientcert)
+			return err
+		},
+		"FailContext": func() error {
+			_, err := msg.FailContext(canceled, cacert, cakey, scep.BadRequest)
+			return err
+		},
+		"NewCSRRequestContext": func() error {
+			_, err := scep.NewCSRRequestContext(canceled, msg.CSRReqMessage.CSR, tmpl)
+			return err
+		},
+	} {
+		if err := call(); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s: have error %v, want %v", name, err, context.Canceled)
+		}
+	}
+
+	signer := &contextSigner{Signer: cakey}
+	ctx := context.WithValue(context.Background(), traceKey{}, "trace-1")
+	success, err := msg.SuccessContext(ctx, cacert, signer, clientcert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testParsePKIMessage(t, success.Raw)
+	if len(signer.traces) != 1 || signer.traces[0] != "trace-1" {
+		t.Errorf("have signer contexts with traces %v, want [trace-1]", signer.traces)
+	}
+}
+
+func TestRFC8894Strict(t *testing.T) {
+	cacert, cakey := loadCACredentials(t)
+	clientcert, clientkey := loadClientCredentials(t)
+	legacy := testParsePKIMessage(t, loadTestFile(t, "testdata/PKCSReq.der"))
+	if err := legacy.DecryptPKIEnvelope(cacert, cakey); err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{cacert},
+		SignerCert:  clientcert,
+		SignerKey:   clientkey,
+	}
+
+	// created messages default to SHA-256 and AES
+	req, err := scep.NewCSRRequest(legacy.CSRReqMessage.CSR, tmpl, scep.WithRFC8894Strict())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := scep.ParsePKIMessage(req.Raw, scep.WithRFC8894Strict())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.DecryptPKIEnvelope(cacert, cakey); err != nil {
+		t.Fatal(err)
+	}
+	rep, err := msg.Success(cacert, cakey, clientcert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scep.ParsePKIMessage(rep.Raw, scep.WithRFC8894Strict()); err != nil {
+		t.Fatal(err)
+	}
+
+	var complianceErr *scep.ComplianceError
+	_, err = scep.NewCSRRequest(legacy.CSRReqMessage.CSR, tmpl, scep.WithRFC8894Strict(),
+		scep.WithDigestAlgorithm(crypto.SHA1))
+	if !errors.As(err, &complianceErr) || complianceErr.Violations[0].Rule != scep.RuleDigestAlgorithm {
+		t.Errorf("SHA-1 request: have error %v, want %s violation", err, scep.RuleDigestAlgorithm)
+	}
+	_, err = scep.NewCSRRequest(legacy.CSRReqMessage.CSR, tmpl, scep.WithRFC8894Strict(),
+		scep.WithEncryptionAlgorithm(scep.DES3CBC))
+	if !errors.As(err, &complianceErr) || complianceErr.Violations[0].Rule != scep.RuleContentEncryption {
+		t.Errorf("DES3 request: have error %v, want %s violation", err, scep.RuleContentEncryption)
+	}
+
+	// an UpdateReq signed with SHA-1
+	weak, err := scep.NewCSRRequest(legacy.CSRReqMessage.CSR, &scep.PKIMessage{
+		MessageType: scep.UpdateReq,
+		Recipients:  []*x509.Certificate{cacert},
+		SignerCert:  clientcert,
+		SignerKey:   clientkey,
+	}, scep.WithDigestAlgorithm(crypto.SHA1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = scep.ParsePKIMessage(weak.Raw, scep.WithRFC8894Strict())
+	if !errors.As(err, &complianceErr) || len(complianceErr.Violations) != 2 ||
+		complianceErr.Violations[0].Rule != scep.RuleDigestAlgorithm || complianceErr.Violations[1].Rule != scep.RuleMessageType {
+		t.Errorf("SHA-1 UpdateReq: have error %v, want %s and %s violations", err, scep.RuleDigestAlgorithm, scep.RuleMessageType)
+	}
+
+	des, err := scep.NewCSRRequest(legacy.CSRReqMessage.CSR, tmpl, scep.WithEncryptionAlgorithm(scep.DESCBC),
+		scep.WithDigestAlgorithm(crypto.SHA256))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = scep.ParsePKIMessage(des.Raw, scep.WithRFC8894Strict()); err != nil {
+		t.Fatal(err)
+	}
+	err = msg.DecryptPKIEnvelope(cacert, cakey)
+	if !errors.As(err, &complianceErr) || complianceErr.Violations[0].Rule != scep.RuleContentEncryption {
+		t.Errorf("DES pkiEnvelope: have error %v, want %s violation", err, scep.RuleContentEncryption)
+	}
+}
@@ -0,0 +1,232 @@
+package scep
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"sort"
+	"time"
+
+	"github.com/micromdm/scep/v2/cryptoutil"
+	"github.com/micromdm/scep/v2/tracing"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/pkcs7"
+)
+
+// signedData builds a PKCS#7 SignedData with a single signer. Unlike
+// pkcs7.SignedData it signs with any crypto.Signer, so the signing key may
+// be held by an HSM or KMS.
+type signedData struct {
+	ctx     context.Context
+	tracer  tracing.Tracer
+	content []byte
+	digest  crypto.Hash
+	certs   []*x509.Certificate
+	signer  *signerInfo
+	fips    bool // signer key must be FIPS-approved
+}
+
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     IssuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+}
+
+type attribute struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue `asn1:"set"`
+}
+
+// AddCertificate adds cert to the certificates of the SignedData.
+func (sd *signedData) AddCertificate(cert *x509.Certificate) {
+	sd.certs = append(sd.certs, cert)
+}
+
+// AddSigner signs the content and the signed attributes of config with
+// signer and adds cert after any certificates added so far.
+func (sd *signedData) AddSigner(cert *x509.Certificate, signer crypto.Signer, config pkcs7.SignerInfoConfig) error {
+	digestOID, err := digestOID(sd.digest)
+	if err != nil {
+		return err
+	}
+	if sd.fips {
+		if err := CheckFIPSKey(signer.Public()); err != nil {
+			return err
+		}
+	}
+	sigOID, err := signatureOID(signer.Public(), sd.digest)
+	if err != nil {
+		return err
+	}
+
+	h := sd.digest.New()
+	h.Write(sd.content)
+	attrs := []pkcs7.Attribute{
+		{Type: pkcs7.OIDAttributeContentType, Value: pkcs7.OIDData},
+		{Type: pkcs7.OIDAttributeMessageDigest, Value: h.Sum(nil)},
+		{Type: pkcs7.OIDAttributeSigningTime, Value: time.Now().UTC()},
+	}
+	attrs = append(attrs, config.ExtraSignedAttributes...)
+	signedAttrs, err := marshalAttributes(attrs)
+	if err != nil {
+		return err
+	}
+
+	// the signature covers the DER encoding of the attributes as a SET OF
+	h = sd.digest.New()
+	h.Write(signedAttrs)
+	ctx, span := startSpan(sd.ctx, sd.tracer, "scep.Sign")
+	signature, err := cryptoutil.SignContext(ctx, signer, rand.Reader, h.Sum(nil), sd.digest)
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+	if err != nil {
+		if ctxErr := sd.ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return errors.Wrap(err, "scep: signing PKIMessage")
+	}
+
+	// encoded as [0] IMPLICIT in the SignerInfo, now that the SET OF
+	// encoding is signed
+	signedAttrs[0] = derTagContext0
+	implicitAttrs := asn1.RawValue{FullBytes: signedAttrs}
+
+	sd.signer = &signerInfo{
+		Version:                   1,
+		IssuerAndSerialNumber:     NewIssuerAndSerial(cert),
+		DigestAlgorithm:           pkix.AlgorithmIdentifier{Algorithm: digestOID},
+		AuthenticatedAttributes:   implicitAttrs,
+		DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: sigOID},
+		EncryptedDigest:           signature,
+	}
+	sd.certs = append(sd.certs, cert)
+	return nil
+}
+
+// Finish returns the DER encoded SignedData ContentInfo.
+func (sd *signedData) Finish() ([]byte, error) {
+	if sd.signer == nil {
+		return nil, errors.New("scep: SignedData has no signer")
+	}
+	digestOID, err := digestOID(sd.digest)
+	if err != nil {
+		return nil, err
+	}
+	algs, err := asn1.Marshal([]pkix.AlgorithmIdentifier{{Algorithm: digestOID}})
+	if err != nil {
+		return nil, err
+	}
+	// DigestAlgorithmIdentifiers is a SET OF
+	algs[0] = derTagSet
+	signer, err := asn1.Marshal(*sd.signer)
+	if err != nil {
+		return nil, err
+	}
+	var certsLen int
+	for _, cert := range sd.certs {
+		certsLen += len(cert.Raw)
+	}
+
+	// the SignedData is written into a single buffer, innermost lengths
+	// first
+	contentLen := derLen(len(sd.content))
+	innerLen := len(derVersion1) + len(algs) +
+		contentInfoLen(derOIDData, contentLen) +
+		derLen(certsLen) + // certificates [0] IMPLICIT CertificateSet
+		derLen(len(signer))
+	b := make([]byte, 0, contentInfoLen(derOIDSignedData, derLen(innerLen)))
+	b = appendContentInfo(b, derOIDSignedData, derLen(innerLen))
+	b = appendDERHeader(b, derTagSequence, innerLen)
+	b = append(b, derVersion1...)
+	b = append(b, algs...)
+	b = appendContentInfo(b, derOIDData, contentLen)
+	b = appendDER(b, derTagOctetString, sd.content)
+	b = appendDERHeader(b, derTagContext0, certsLen)
+	for _, cert := range sd.certs {
+		b = append(b, cert.Raw...)
+	}
+	b = appendDER(b, derTagSet, signer)
+	return b, nil
+}
+
+// marshalAttributes returns the DER encoded SET OF attrs, sorted as
+// required for DER.
+func marshalAttributes(attrs []pkcs7.Attribute) ([]byte, error) {
+	// the attributes are encoded into one buffer, then copied sorted
+	buf := make([]byte, 0, 64*len(attrs))
+	ends := make([]int, len(attrs))
+	for i, attr := range attrs {
+		oid, err := appendOID(nil, attr.Type)
+		if err != nil {
+			return nil, err
+		}
+		value, err := marshalAttributeValue(attr.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf = appendDERHeader(buf, derTagSequence, len(oid)+derLen(len(value)))
+		buf = append(buf, oid...)
+		buf = appendDER(buf, derTagSet, value)
+		ends[i] = len(buf)
+	}
+	encoded := make([][]byte, len(attrs))
+	for i, end := range ends {
+		start := 0
+		if i > 0 {
+			start = ends[i-1]
+		}
+		encoded[i] = buf[start:end]
+	}
+	sort.Slice(encoded, func(i, j int) bool {
+		return bytes.Compare(encoded[i], encoded[j]) < 0
+	})
+	out := appendDERHeader(make([]byte, 0, derLen(len(buf))), derTagSet, len(buf))
+	for _, attr := range encoded {
+		out = append(out, attr...)
+	}
+	return out, nil
+}
+
+// signatureOID returns the SignerInfo signature algorithm for a key of type
+// pub with digest h.
+func signatureOID(pub crypto.PublicKey, h crypto.Hash) (asn1.ObjectIdentifier, error) {
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		switch h {
+		case crypto.SHA1:
+			return pkcs7.OIDEncryptionAlgorithmRSASHA1, nil
+		case crypto.SHA256:
+			return pkcs7.OIDEncryptionAlgorithmRSASHA256, nil
+		case crypto.SHA384:
+			return pkcs7.OIDEncryptionAlgorithmRSASHA384, nil
+		case crypto.SHA512:
+			return pkcs7.OIDEncryptionAlgorithmRSASHA512, nil
+		}
+	case *ecdsa.PublicKey:
+		switch h {
+		case crypto.SHA1:
+			return pkcs7.OIDDigestAlgorithmECDSASHA1, nil
+		case crypto.SHA256:
+			return pkcs7.OIDDigestAlgorithmECDSASHA256, nil
+		case crypto.SHA384:
+			return pkcs7.OIDDigestAlgorithmECDSASHA384, nil
+		case crypto.SHA512:
+			return pkcs7.OIDDigestAlgorithmECDSASHA512, nil
+		}
+	default:
+		return nil, errors.Errorf("scep: unsupported signer public key type %T", pub)
+	}
+	return nil, errors.Errorf("scep: unsupported digest algorithm %s", h)
+}
@@ -0,0 +1,81 @@
+package scep
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WithSignerValidation makes ParsePKIMessage validate the signer certificate
+// of requests instead of only the signature. The certificate must be valid
+// now and
+//
+//   - for RenewalReq and UpdateReq be issued by one of issuers,
+//   - for PKCSReq be self-signed with the public key of the CSR, or issued
+//     by one of issuers as sent by clients renewing with a PKCSReq.
+//
+// The CSR public key is checked by DecryptPKIEnvelope.
+func WithSignerValidation(issuers []*x509.Certificate) Option {
+	return func(c *config) {
+		c.signerIssuers = issuers
+		c.validateSigner = true
+	}
+}
+
+// validateSigner checks the signer certificate of the request msg, see
+// WithSignerValidation.
+func (msg *PKIMessage) validateSigner(issuers []*x509.Certificate) error {
+	signer := msg.SignerCert
+	if signer == nil {
+		return errors.New("scep: no signer certificate")
+	}
+	now := time.Now()
+	if now.Before(signer.NotBefore) || now.After(signer.NotAfter) {
+		return errors.Errorf("scep: signer certificate is not valid at %s", now.UTC().Format(time.RFC3339))
+	}
+	switch msg.MessageType {
+	case PKCSReq:
+		if isSelfSigned(signer) || issuedBy(signer, issuers) {
+			return nil
+		}
+		return errors.New("scep: PKCSReq signer certificate is neither self-signed nor issued by the CA")
+	case RenewalReq, UpdateReq:
+		if issuedBy(signer, issuers) {
+			return nil
+		}
+		return errors.Errorf("scep: %s signer certificate is not issued by the CA", msg.MessageType)
+	}
+	return nil
+}
+
+// checkSignerKey checks that a self-signed signer certificate is for the
+// public key of the CSR.
+func (msg *PKIMessage) checkSignerKey(csr *x509.CertificateRequest) error {
+	if !msg.validateSignerKey || !isSelfSigned(msg.SignerCert) {
+		return nil
+	}
+	key, ok := msg.SignerCert.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !key.Equal(csr.PublicKey) {
+		return errors.New("scep: self-signed signer certificate does not match the CSR public key")
+	}
+	return nil
+}
+
+// isSelfSigned reports whether cert is signed by its own key. Unlike
+// CheckSignatureFrom it does not require cert to be a CA certificate.
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
+
+func issuedBy(cert *x509.Certificate, issuers []*x509.Certificate) bool {
+	for _, issuer := range issuers {
+		if cert.CheckSignatureFrom(issuer) == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,43 @@
+//go:build go1.21
+// +build go1.21
+
+package scep
+
+import (
+	"context"
+	"log/slog"
+)
+
+type slogLogger struct {
+	next *slog.Logger
+}
+
+// NewSlogLogger returns a Logger logging to next. The "msg" value is the
+// message of the records and the level is mapped to the slog level.
+func NewSlogLogger(next *slog.Logger) Logger {
+	return slogLogger{next: next}
+}
+
+func (l slogLogger) Log(keyvals ...interface{}) error {
+	lvl := slog.LevelInfo
+	var msg string
+	args := make([]interface{}, 0, len(keyvals))
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		switch k, v := keyvals[i], keyvals[i+1]; {
+		case k == LevelKey && v == LevelDebug:
+			lvl = slog.LevelDebug
+		case k == LevelKey && v == LevelWarn:
+			lvl = slog.LevelWarn
+		case k == "msg" && msg == "":
+			if s, ok := v.(string); ok {
+				msg = s
+				continue
+			}
+			args = append(args, k, v)
+		default:
+			args = append(args, k, v)
+		}
+	}
+	l.next.Log(context.Background(), lvl, msg, args...)
+	return nil
+}
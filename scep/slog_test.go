@@ -0,0 +1,31 @@
+//go:build go1.21
+// +build go1.21
+
+package scep_test
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+func TestNewSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	handler := slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	logger := scep.NewSlogLogger(slog.New(handler))
+	logger.Log(scep.LevelKey, scep.LevelDebug, "msg", "filtered")
+	logger.Log(scep.LevelKey, scep.LevelWarn, "msg", "logged", "transaction_id", "abc")
+	if have, want := strings.TrimSpace(buf.String()), "level=WARN msg=logged transaction_id=abc"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
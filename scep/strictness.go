@@ -0,0 +1,39 @@
+package scep
+
+import "crypto/x509"
+
+// Strictness selects how messages deviating from RFC 8894 are handled.
+type Strictness int
+
+const (
+	// Strict rejects messages deviating from RFC 8894. It is the default.
+	Strict Strictness = iota
+
+	// Lenient tolerates the quirks of Microsoft NDES, as used with Intune:
+	// CertRep messages without a recipientNonce, pkiEnvelopes with
+	// indefinite length BER encoding and GetCACert responses without RA
+	// certificates, whose CA certificates are then used as recipients.
+	Lenient
+)
+
+// WithStrictness sets the handling of messages deviating from RFC 8894.
+func WithStrictness(s Strictness) Option {
+	return func(c *config) {
+		c.strictness = s
+	}
+}
+
+// caRecipients returns the CA certificates of a GetCACert response
+// without RA certificates, or all certs if none is a CA.
+func caRecipients(certs []*x509.Certificate) []*x509.Certificate {
+	var cas []*x509.Certificate
+	for _, cert := range certs {
+		if cert.IsCA {
+			cas = append(cas, cert)
+		}
+	}
+	if len(cas) == 0 {
+		return certs
+	}
+	return cas
+}
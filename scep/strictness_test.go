@@ -0,0 +1,47 @@
+package scep
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"go.mozilla.org/pkcs7"
+)
+
+func TestLenientCertRepWithoutRecipientNonce(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := newEnvelopeTestCert(t, key)
+	sd, err := (&config{}).newSignedData(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{
+		ExtraSignedAttributes: []pkcs7.Attribute{
+			{Type: oidSCEPtransactionID, Value: TransactionID("ndes")},
+			{Type: oidSCEPpkiStatus, Value: FAILURE},
+			{Type: oidSCEPfailInfo, Value: BadRequest},
+			{Type: oidSCEPmessageType, Value: CertRep},
+			{Type: oidSCEPsenderNonce, Value: SenderNonce("nonce")},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := sd.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ParsePKIMessage(data); err == nil {
+		t.Error("expected error parsing CertRep without recipientNonce")
+	}
+	msg, err := ParsePKIMessage(data, WithStrictness(Lenient))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := msg.FailInfo, FailInfo(BadRequest); have != want {
+		t.Errorf("have failInfo %s, want %s", have, want)
+	}
+}
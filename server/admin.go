@@ -0,0 +1,592 @@
+package scepserver
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/micromdm/scep/v2/depot"
+	"github.com/micromdm/scep/v2/scep"
+
+	kitlog "github.com/go-kit/kit/log"
+)
+
+// AdminPathPrefix is the path below which the admin API is served.
+const AdminPathPrefix = "/admin/"
+
+// Approver decides on the transactions held PENDING, like ManualApproval.
+type Approver interface {
+	Approve(id scep.TransactionID) (*x509.Certificate, error)
+	Reject(id scep.TransactionID, reason string) error
+}
+
+// AdminOption configures the handler of NewAdminHandler.
+type AdminOption func(*adminHandler)
+
+// WithAdminLogger logs the decisions and failed requests to logger.
+func WithAdminLogger(logger kitlog.Logger) AdminOption {
+	return func(h *adminHandler) {
+		h.logger = logger
+	}
+}
+
+// WithAdminCA reports the status of the CA certificates certs.
+func WithAdminCA(certs ...*x509.Certificate) AdminOption {
+	return func(h *adminHandler) {
+		h.caCerts = append(h.caCerts, certs...)
+	}
+}
+
+// WithAdminDepot lists, searches and revokes the certificates of d, as far
+// as it implements depot.CertLister, depot.RevocationLister and
+// depot.Revoker.
+func WithAdminDepot(d depot.Depot) AdminOption {
+	return func(h *adminHandler) {
+		h.certs, _ = d.(depot.CertLister)
+		h.revoked, _ = d.(depot.RevocationLister)
+		h.revoker, _ = d.(depot.Revoker)
+	}
+}
+
+// WithAdminEventPublisher notifies p of the certificates revoked, and of
+// the pending requests approved or rejected, with the admin API. It may be
+// given several times.
+func WithAdminEventPublisher(p EventPublisher) AdminOption {
+	return func(h *adminHandler) {
+		h.publishers = append(h.publishers, p)
+	}
+}
+
+// WithAdminExpiry reports the certificates found expiring by the last scan
+// of m.
+func WithAdminExpiry(m *ExpiryMonitor) AdminOption {
+	return func(h *adminHandler) {
+		h.expiry = m
+	}
+}
+
+// ChallengeMinter mints a one-time challenge password, bound to the
+// subject common name cn if it is not empty.
+type ChallengeMinter func(cn string) (string, error)
+
+// WithAdminChallenges mints challenge passwords with mint.
+func WithAdminChallenges(mint ChallengeMinter) AdminOption {
+	return func(h *adminHandler) {
+		h.mint = mint
+	}
+}
+
+type adminHandler struct {
+	store    depot.TransactionStore
+	approver Approver
+	apiKey   string
+	logger   kitlog.Logger
+
+	caCerts []*x509.Certificate
+	certs   depot.CertLister
+	revoked depot.RevocationLister
+	revoker depot.Revoker
+	mint    ChallengeMinter
+
+	publishers []EventPublisher
+	expiry     *ExpiryMonitor
+}
+
+// NewAdminHandler returns an http.Handler serving the admin API below
+// AdminPathPrefix for the transactions of store decided by approver:
+//
+//	GET  transactions?status=pending     list the transactions, optionally by status
+//	GET  transactions/{id}               show a transaction
+//	POST transactions/{id}/approve       approve a pending transaction
+//	POST transactions/{id}/reject        reject it with the reason form value
+//	GET  certificates?q=device           list the issued certificates, optionally matching q
+//	GET  certificates/expiring           list the certificates nearing expiry without renewal
+//	POST certificates/{serial}/revoke    revoke a certificate with the CRLReason form value
+//	POST challenge                       mint a challenge, optionally for the cn form value
+//	GET  ca                              show the status of the CA
+//
+// The {id} is the path escaped transactionID and the {serial} is hex
+// encoded. store and approver may be nil if requests are not held PENDING.
+// The certificates are those of the depot of WithAdminDepot, or else the
+// ones issued on approval. Requests must have the "Authorization: Bearer
+// <apiKey>" header. Responses are JSON, see AdminTransaction,
+// AdminCertificate, ExpiringCertificate and AdminCA.
+func NewAdminHandler(store depot.TransactionStore, approver Approver, apiKey string, opts ...AdminOption) http.Handler {
+	h := &adminHandler{
+		store:    store,
+		approver: approver,
+		apiKey:   apiKey,
+		logger:   kitlog.NewNopLogger(),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// AdminTransaction is a transaction as returned by the admin API.
+type AdminTransaction struct {
+	ID          scep.TransactionID      `json:"id"`
+	MessageType string                  `json:"message_type"`
+	Status      depot.TransactionStatus `json:"status"`
+
+	// Subject and SANs requested in the CSR.
+	Subject        string   `json:"subject"`
+	DNSNames       []string `json:"dns_names,omitempty"`
+	EmailAddresses []string `json:"email_addresses,omitempty"`
+	IPAddresses    []string `json:"ip_addresses,omitempty"`
+	URIs           []string `json:"uris,omitempty"`
+
+	// Challenge reports whether the request had a challengePassword.
+	Challenge bool `json:"challenge"`
+	// Signer is the subject of the signer certificate of the request.
+	Signer string `json:"signer,omitempty"`
+
+	// Serial is the hex encoded serial number of the issued certificate.
+	Serial string `json:"serial,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// AdminCertificate is an issued certificate as returned by the admin API.
+type AdminCertificate struct {
+	Serial    string    `json:"serial"`
+	Subject   string    `json:"subject"`
+	DNSNames  []string  `json:"dns_names,omitempty"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+
+	// TransactionID and IssuedAt are set for certificates issued on
+	// approval.
+	TransactionID scep.TransactionID `json:"transaction_id,omitempty"`
+	IssuedAt      *time.Time         `json:"issued_at,omitempty"`
+
+	// RevokedAt and Reason are set for revoked certificates. Reason is
+	// an RFC 5280 CRLReason.
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	Reason    int        `json:"reason,omitempty"`
+
+	// Certificate is PEM encoded.
+	Certificate string `json:"certificate"`
+}
+
+// AdminCA is the status of the CA as returned by the admin API.
+type AdminCA struct {
+	Certificates []AdminCertificate `json:"certificates"`
+	// Pending, Issued and Revoked count the pending transactions, the
+	// issued certificates and the revoked, unexpired certificates, or are
+	// -1 if unknown.
+	Pending int `json:"pending"`
+	Issued  int `json:"issued"`
+	Revoked int `json:"revoked"`
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if h.apiKey == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.apiKey)) != 1 {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.EscapedPath(), AdminPathPrefix)
+	switch {
+	case path == "ca":
+		if allowMethod(w, r, http.MethodGet) {
+			h.ca(w)
+		}
+	case path == "challenge" && h.mint != nil:
+		if allowMethod(w, r, http.MethodPost) {
+			h.challenge(w, r)
+		}
+	case path == "certificates":
+		if allowMethod(w, r, http.MethodGet) {
+			h.listCertificates(w, r)
+		}
+	case path == "certificates/expiring" && h.expiry != nil:
+		if allowMethod(w, r, http.MethodGet) {
+			writeJSON(w, h.expiry.Expiring())
+		}
+	case strings.HasPrefix(path, "certificates/") && h.revoker != nil:
+		h.revoke(w, r, strings.TrimPrefix(path, "certificates/"))
+	case h.store == nil:
+		http.NotFound(w, r)
+	case path == "transactions":
+		if allowMethod(w, r, http.MethodGet) {
+			h.listTransactions(w, r)
+		}
+	case strings.HasPrefix(path, "transactions/"):
+		parts := strings.Split(strings.TrimPrefix(path, "transactions/"), "/")
+		id, err := url.PathUnescape(parts[0])
+		if err != nil || id == "" || len(parts) > 2 {
+			http.NotFound(w, r)
+			return
+		}
+		h.transaction(w, r, scep.TransactionID(id), parts[1:])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *adminHandler) listTransactions(w http.ResponseWriter, r *http.Request) {
+	txs, err := h.store.Transactions(depot.TransactionStatus(r.FormValue("status")))
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+	views := []AdminTransaction{}
+	for _, t := range txs {
+		view, err := newAdminTransaction(t)
+		if err != nil {
+			h.fail(w, err)
+			return
+		}
+		views = append(views, view)
+	}
+	writeJSON(w, views)
+}
+
+func (h *adminHandler) listCertificates(w http.ResponseWriter, r *http.Request) {
+	certs, err := h.certificates()
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+	q := strings.ToLower(r.FormValue("q"))
+	matches := []AdminCertificate{}
+	for _, c := range certs {
+		if q == "" || c.matches(q) {
+			matches = append(matches, c)
+		}
+	}
+	writeJSON(w, matches)
+}
+
+// certificates returns the issued certificates, newest first.
+func (h *adminHandler) certificates() ([]AdminCertificate, error) {
+	var txs []*depot.Transaction
+	if h.store != nil {
+		var err error
+		if txs, err = h.store.Transactions(depot.TransactionIssued); err != nil {
+			return nil, err
+		}
+	}
+	var revoked []depot.Revocation
+	if h.revoked != nil {
+		var err error
+		if revoked, err = h.revoked.Revoked(); err != nil {
+			return nil, err
+		}
+	}
+
+	var crts []*x509.Certificate
+	approved := make(map[string]*depot.Transaction)
+	for _, t := range txs {
+		crt, err := x509.ParseCertificate(t.Certificate)
+		if err != nil {
+			return nil, err
+		}
+		approved[string(crt.Raw)] = t
+		crts = append(crts, crt)
+	}
+	if h.certs != nil {
+		var err error
+		if crts, err = h.certs.Certs(); err != nil {
+			return nil, err
+		}
+	}
+
+	certs := make([]AdminCertificate, 0, len(crts))
+	for _, crt := range crts {
+		c := newAdminCertificate(crt)
+		if t, ok := approved[string(crt.Raw)]; ok {
+			c.TransactionID = t.ID
+			issued := t.UpdatedAt
+			c.IssuedAt = &issued
+		}
+		for _, rev := range revoked {
+			if rev.SerialNumber.Cmp(crt.SerialNumber) == 0 {
+				revokedAt := rev.RevokedAt
+				c.RevokedAt, c.Reason = &revokedAt, rev.Reason
+			}
+		}
+		certs = append(certs, c)
+	}
+	sort.SliceStable(certs, func(i, j int) bool {
+		return certs[i].NotBefore.After(certs[j].NotBefore)
+	})
+	return certs, nil
+}
+
+// revoke revokes the certificate with the hex encoded serial.
+func (h *adminHandler) revoke(w http.ResponseWriter, r *http.Request, path string) {
+	parts := strings.Split(path, "/")
+	serial, ok := new(big.Int).SetString(parts[0], 16)
+	if !ok || len(parts) != 2 || parts[1] != "revoke" {
+		http.NotFound(w, r)
+		return
+	}
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	reason := 0
+	if v := r.FormValue("reason"); v != "" {
+		var err error
+		if reason, err = strconv.Atoi(v); err != nil || reason < 0 || reason > 10 {
+			http.Error(w, "invalid CRLReason", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := h.revoker.Revoke(serial, reason); err != nil {
+		h.fail(w, err)
+		return
+	}
+	h.logger.Log("msg", "revoked certificate", "serial", fmt.Sprintf("%X", serial), "reason", reason)
+	e := Event{Type: EventRevoked, Time: time.Now().UTC(), Serial: fmt.Sprintf("%X", serial), Reason: reason}
+	certs, err := h.certificates()
+	if err != nil {
+		publishEvent(h.publishers, h.logger, e)
+		h.fail(w, err)
+		return
+	}
+	for _, c := range certs {
+		if c.Serial == e.Serial {
+			notAfter := c.NotAfter.UTC()
+			e.Subject, e.NotAfter, e.TransactionID = c.Subject, &notAfter, c.TransactionID
+			publishEvent(h.publishers, h.logger, e)
+			writeJSON(w, c)
+			return
+		}
+	}
+	publishEvent(h.publishers, h.logger, e)
+	writeJSON(w, AdminCertificate{Serial: fmt.Sprintf("%X", serial)})
+}
+
+// challenge mints a challenge for the optional cn form value.
+func (h *adminHandler) challenge(w http.ResponseWriter, r *http.Request) {
+	challenge, err := h.mint(r.FormValue("cn"))
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+	writeJSON(w, struct {
+		Challenge string `json:"challenge"`
+	}{challenge})
+}
+
+// ca writes the AdminCA status.
+func (h *adminHandler) ca(w http.ResponseWriter) {
+	status := AdminCA{Certificates: []AdminCertificate{}, Pending: -1, Issued: -1, Revoked: -1}
+	for _, crt := range h.caCerts {
+		status.Certificates = append(status.Certificates, newAdminCertificate(crt))
+	}
+	if h.store != nil {
+		pending, err := h.store.Transactions(depot.TransactionPending)
+		if err != nil {
+			h.fail(w, err)
+			return
+		}
+		status.Pending = len(pending)
+	}
+	if h.certs != nil || h.store != nil {
+		certs, err := h.certificates()
+		if err != nil {
+			h.fail(w, err)
+			return
+		}
+		status.Issued = len(certs)
+	}
+	if h.revoked != nil {
+		revoked, err := h.revoked.Revoked()
+		if err != nil {
+			h.fail(w, err)
+			return
+		}
+		status.Revoked = len(revoked)
+	}
+	writeJSON(w, status)
+}
+
+// transaction serves the transaction id, or the decision action on it.
+func (h *adminHandler) transaction(w http.ResponseWriter, r *http.Request, id scep.TransactionID, action []string) {
+	if len(action) == 0 {
+		if allowMethod(w, r, http.MethodGet) {
+			h.writeTransaction(w, id)
+		}
+		return
+	}
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var err error
+	switch action[0] {
+	case "approve":
+		var crt *x509.Certificate
+		crt, err = h.approver.Approve(id)
+		if err == nil {
+			h.logger.Log("msg", "approved request", "transaction_id", id, "serial", fmt.Sprintf("%X", crt.SerialNumber))
+			h.publishDecision(id, crt)
+		}
+	case "reject":
+		reason := r.FormValue("reason")
+		err = h.approver.Reject(id, reason)
+		if err == nil {
+			h.logger.Log("msg", "rejected request", "transaction_id", id, "reason", reason)
+			h.publishDecision(id, nil)
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+	h.writeTransaction(w, id)
+}
+
+// publishDecision notifies the event publishers of the approval of the
+// pending transaction id issuing crt, or of its rejection if crt is nil.
+func (h *adminHandler) publishDecision(id scep.TransactionID, crt *x509.Certificate) {
+	if len(h.publishers) == 0 {
+		return
+	}
+	t, err := h.store.Transaction(id)
+	if err != nil {
+		h.logger.Log("msg", "failed to publish event", "transaction_id", id, "err", err)
+		return
+	}
+	m := &scep.CSRReqMessage{ChallengeMetadata: t.ChallengeMetadata}
+	m.CSR, _ = x509.ParseCertificateRequest(t.CSR)
+	e := newEvent(EventIssued, id, m, crt)
+	if crt == nil {
+		e = failedEvent(id, m, rejection(t))
+	}
+	publishEvent(h.publishers, h.logger, e)
+}
+
+func (h *adminHandler) writeTransaction(w http.ResponseWriter, id scep.TransactionID) {
+	t, err := h.store.Transaction(id)
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+	view, err := newAdminTransaction(t)
+	if err != nil {
+		h.fail(w, err)
+		return
+	}
+	writeJSON(w, view)
+}
+
+// fail answers with the status for err: 404 for an unknown transaction or
+// certificate, 409 for a decision on a decided transaction, 400 for a
+// FailInfoError of the signer and 500 otherwise.
+func (h *adminHandler) fail(w http.ResponseWriter, err error) {
+	h.logger.Log("msg", "admin request failed", "err", err)
+	var fiErr *FailInfoError
+	switch {
+	case errors.Is(err, depot.ErrTransactionNotFound), errors.Is(err, depot.ErrCertNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrNotPending):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.As(err, &fiErr):
+		text := fiErr.Text
+		if text == "" {
+			text = fiErr.Error()
+		}
+		http.Error(w, text, http.StatusBadRequest)
+	default:
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// newAdminTransaction returns the AdminTransaction of t.
+func newAdminTransaction(t *depot.Transaction) (AdminTransaction, error) {
+	view := AdminTransaction{
+		ID:          t.ID,
+		MessageType: t.MessageType.String(),
+		Status:      t.Status,
+		Challenge:   t.Challenge,
+		Reason:      t.Reason,
+		CreatedAt:   t.CreatedAt,
+		UpdatedAt:   t.UpdatedAt,
+	}
+	csr, err := x509.ParseCertificateRequest(t.CSR)
+	if err != nil {
+		return view, err
+	}
+	view.Subject = csr.Subject.String()
+	view.DNSNames = csr.DNSNames
+	view.EmailAddresses = csr.EmailAddresses
+	for _, ip := range csr.IPAddresses {
+		view.IPAddresses = append(view.IPAddresses, ip.String())
+	}
+	for _, uri := range csr.URIs {
+		view.URIs = append(view.URIs, uri.String())
+	}
+	if t.SignerCert != nil {
+		crt, err := x509.ParseCertificate(t.SignerCert)
+		if err != nil {
+			return view, err
+		}
+		view.Signer = crt.Subject.String()
+	}
+	if t.Certificate != nil {
+		crt, err := x509.ParseCertificate(t.Certificate)
+		if err != nil {
+			return view, err
+		}
+		view.Serial = fmt.Sprintf("%X", crt.SerialNumber)
+	}
+	return view, nil
+}
+
+// newAdminCertificate returns the AdminCertificate of crt.
+func newAdminCertificate(crt *x509.Certificate) AdminCertificate {
+	return AdminCertificate{
+		Serial:      fmt.Sprintf("%X", crt.SerialNumber),
+		Subject:     crt.Subject.String(),
+		DNSNames:    crt.DNSNames,
+		NotBefore:   crt.NotBefore,
+		NotAfter:    crt.NotAfter,
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})),
+	}
+}
+
+// matches reports whether the lower case query q is part of the serial,
+// subject or a DNS name of c.
+func (c AdminCertificate) matches(q string) bool {
+	for _, s := range append([]string{c.Serial, c.Subject}, c.DNSNames...) {
+		if strings.Contains(strings.ToLower(s), q) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowMethod reports whether r uses method and answers it with 405
+// otherwise.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
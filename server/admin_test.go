@@ -0,0 +1,240 @@
+package scepserver_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/depot"
+	"github.com/micromdm/scep/v2/scep"
+	scepserver "github.com/micromdm/scep/v2/server"
+)
+
+func TestAdminHandler(t *testing.T) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caDER, err := depot.NewCACert(depot.WithCommonName("admin CA")).SelfSign(rand.Reader, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var serial int64
+	issue := scepserver.CSRSignerFunc(func(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+		serial++
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      m.CSR.Subject,
+			DNSNames:     m.CSR.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+		}, ca, m.CSR.PublicKey, caKey)
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParseCertificate(der)
+	})
+	store := depot.NewTransactionStore()
+	approval := scepserver.NewManualApproval(store, issue)
+
+	admin := httptest.NewServer(scepserver.NewAdminHandler(store, approval, "secret"))
+	defer admin.Close()
+	est := httptest.NewServer(scepserver.NewESTHandler([]*x509.Certificate{ca}, approval))
+	defer est.Close()
+
+	request := func(method, path, apiKey string, form url.Values, status int, v interface{}) {
+		t.Helper()
+		adminRequest(t, admin.URL, method, path, apiKey, form, status, v)
+	}
+	newCSR := func(cn string) []byte {
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject:  pkix.Name{CommonName: cn},
+			DNSNames: []string{cn + ".example.com"},
+		}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return csr
+	}
+
+	request("GET", "transactions", "wrong", nil, http.StatusUnauthorized, nil)
+
+	// EST enrollments are held until approved
+	approved, rejected := newCSR("approved"), newCSR("rejected")
+	estRequest(t, est.Client(), "POST", est.URL+"/.well-known/est/simpleenroll", approved, "", http.StatusAccepted)
+	estRequest(t, est.Client(), "POST", est.URL+"/.well-known/est/simpleenroll", rejected, "", http.StatusAccepted)
+
+	var pending []scepserver.AdminTransaction
+	request("GET", "transactions?status=pending", "secret", nil, http.StatusOK, &pending)
+	if len(pending) != 2 {
+		t.Fatalf("have %d pending transactions, want 2", len(pending))
+	}
+	if have := pending[0]; have.Subject != "CN=approved" || len(have.DNSNames) != 1 || have.DNSNames[0] != "approved.example.com" {
+		t.Errorf("have pending transaction %+v, want the approved CSR", have)
+	}
+
+	var tx scepserver.AdminTransaction
+	request("POST", "transactions/"+url.PathEscape(string(pending[0].ID))+"/approve", "secret", nil, http.StatusOK, &tx)
+	if tx.Status != depot.TransactionIssued || tx.Serial != "1" {
+		t.Errorf("have approved transaction %+v, want serial 1 issued", tx)
+	}
+	request("POST", "transactions/"+url.PathEscape(string(pending[0].ID))+"/approve", "secret", nil, http.StatusConflict, nil)
+	request("POST", "transactions/"+url.PathEscape(string(pending[1].ID))+"/reject", "secret",
+		url.Values{"reason": {"unknown device"}}, http.StatusOK, &tx)
+	if tx.Status != depot.TransactionRejected || tx.Reason != "unknown device" {
+		t.Errorf("have rejected transaction %+v, want the reason", tx)
+	}
+	request("GET", "transactions/"+url.PathEscape("unknown"), "secret", nil, http.StatusNotFound, nil)
+	request("GET", "transactions/"+url.PathEscape(string(pending[0].ID))+"/approve", "secret", nil, http.StatusMethodNotAllowed, nil)
+
+	// the retried enrollments get the outcome
+	certs := estRequest(t, est.Client(), "POST", est.URL+"/.well-known/est/simpleenroll", approved, "", http.StatusOK)
+	if len(certs) != 1 || certs[0].SerialNumber.Int64() != 1 {
+		t.Fatal("simpleenroll did not return the approved certificate")
+	}
+	estRequest(t, est.Client(), "POST", est.URL+"/.well-known/est/simpleenroll", rejected, "", http.StatusBadRequest)
+
+	var issued []scepserver.AdminCertificate
+	request("GET", "certificates", "secret", nil, http.StatusOK, &issued)
+	if len(issued) != 1 || issued[0].Serial != "1" || issued[0].Subject != "CN=approved" {
+		t.Errorf("have issued certificates %+v, want the approved one", issued)
+	}
+}
+
+func TestAdminHandlerDepot(t *testing.T) {
+	boltDepot := createDB(0666, nil)
+	key, err := boltDepot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := boltDepot.CreateOrLoadCA(key, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := depot.NewSigner(boltDepot)
+	for _, cn := range []string{"laptop-1", "phone-1"} {
+		csrKey, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: cn}}, csrKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := signer.SignCSR(&scep.CSRReqMessage{CSR: csr}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expiry, err := scepserver.NewExpiryMonitor(boltDepot, 10*365*24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := expiry.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan scepserver.Event, 1)
+	var minted []string
+	mint := func(cn string) (string, error) {
+		minted = append(minted, cn)
+		return "challenge-" + cn, nil
+	}
+	admin := httptest.NewServer(scepserver.NewAdminHandler(nil, nil, "secret",
+		scepserver.WithAdminCA(caCert),
+		scepserver.WithAdminDepot(boltDepot),
+		scepserver.WithAdminChallenges(mint),
+		scepserver.WithAdminExpiry(expiry),
+		scepserver.WithAdminEventPublisher(scepserver.EventPublisherFunc(func(_ context.Context, e scepserver.Event) error {
+			events <- e
+			return nil
+		})),
+	))
+	defer admin.Close()
+
+	request := func(method, path string, form url.Values, status int, v interface{}) {
+		t.Helper()
+		adminRequest(t, admin.URL, method, path, "secret", form, status, v)
+	}
+
+	var certs []scepserver.AdminCertificate
+	request("GET", "certificates?q=LAPTOP", nil, http.StatusOK, &certs)
+	if len(certs) != 1 || certs[0].Subject != "CN=laptop-1" {
+		t.Fatalf("have certificates %+v, want laptop-1", certs)
+	}
+	var expiring []scepserver.ExpiringCertificate
+	request("GET", "certificates/expiring", nil, http.StatusOK, &expiring)
+	if len(expiring) != 2 {
+		t.Errorf("have expiring certificates %+v, want laptop-1 and phone-1", expiring)
+	}
+	var revoked scepserver.AdminCertificate
+	request("POST", "certificates/"+certs[0].Serial+"/revoke", url.Values{"reason": {"1"}}, http.StatusOK, &revoked)
+	if revoked.RevokedAt == nil || revoked.Reason != 1 {
+		t.Errorf("have revoked certificate %+v, want reason 1", revoked)
+	}
+	if e := <-events; e.Type != scepserver.EventRevoked || e.Serial != certs[0].Serial || e.Subject != "CN=laptop-1" || e.Reason != 1 {
+		t.Errorf("have event %+v, want laptop-1 revoked with reason 1", e)
+	}
+	request("POST", "certificates/FFFF/revoke", nil, http.StatusNotFound, nil)
+
+	var status scepserver.AdminCA
+	request("GET", "ca", nil, http.StatusOK, &status)
+	if len(status.Certificates) != 1 || status.Certificates[0].Subject != caCert.Subject.String() {
+		t.Errorf("have CA certificates %+v, want the CA", status.Certificates)
+	}
+	if status.Pending != -1 || status.Issued != 2 || status.Revoked != 1 {
+		t.Errorf("have status %+v, want 2 issued and 1 revoked", status)
+	}
+
+	var challenge struct{ Challenge string }
+	request("POST", "challenge", url.Values{"cn": {"laptop-2"}}, http.StatusOK, &challenge)
+	if challenge.Challenge != "challenge-laptop-2" || len(minted) != 1 {
+		t.Errorf("have challenge %q, want one for laptop-2", challenge.Challenge)
+	}
+	request("GET", "transactions", nil, http.StatusNotFound, nil)
+}
+
+// adminRequest sends an admin API request with the form values and decodes
+// the JSON response into v if it is not nil.
+func adminRequest(t *testing.T, baseURL, method, path, apiKey string, form url.Values, status int, v interface{}) {
+	t.Helper()
+	req, err := http.NewRequest(method, baseURL+scepserver.AdminPathPrefix+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s: have status %d, want %d", method, path, resp.StatusCode, status)
+	}
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
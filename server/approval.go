@@ -0,0 +1,296 @@
+package scepserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/micromdm/scep/v2/depot"
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// ErrPending is returned by a CSRSigner to hold a request for a later
+// decision. The service answers it with a PENDING CertRep; the client then
+// polls with CertPoll, answered from the TransactionStore of the service,
+// see WithTransactionStore.
+var ErrPending = errors.New("request pending")
+
+// ErrNotPending is returned by ManualApproval for a decision on a
+// transaction which was already approved or rejected.
+var ErrNotPending = errors.New("transaction not pending")
+
+// DefaultTransactionTTL is how long a decided transaction answers the
+// requests resent for it by default, see WithTransactionTTL.
+const DefaultTransactionTTL = 24 * time.Hour
+
+// TransactionOption configures how ManualApproval and IdempotentMiddleware
+// answer resent requests from their stored transactions.
+type TransactionOption func(*transactionPolicy)
+
+// WithTransactionTTL sets how long after the decision on a transaction it
+// answers the requests resent for it, DefaultTransactionTTL by default.
+// Later requests are handled as new requests.
+func WithTransactionTTL(ttl time.Duration) TransactionOption {
+	return func(p *transactionPolicy) {
+		p.ttl = ttl
+	}
+}
+
+// WithTransactionRevocations handles requests resent for a transaction
+// whose certificate is revoked in l as new requests.
+func WithTransactionRevocations(l depot.RevocationLister) TransactionOption {
+	return func(p *transactionPolicy) {
+		p.revocations = l
+	}
+}
+
+// transactionPolicy decides which requests a stored transaction answers.
+// The transactionID of a request is derived from its key, so it is shared
+// by every request for the key: a transaction only answers the very
+// request it was created for, while it is pending and, once decided, for
+// the TTL if its certificate has neither expired nor been revoked.
+type transactionPolicy struct {
+	ttl         time.Duration
+	revocations depot.RevocationLister
+
+	// replaced in tests
+	now func() time.Time
+}
+
+func newTransactionPolicy(opts []TransactionOption) *transactionPolicy {
+	p := &transactionPolicy{ttl: DefaultTransactionTTL, now: time.Now}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// ManualApproval is a CSRSigner which holds enrollment requests PENDING in
+// a depot.TransactionStore until an operator approves them with Approve or
+// rejects them with Reject.
+type ManualApproval struct {
+	store  depot.TransactionStore
+	next   CSRSigner
+	policy *transactionPolicy
+
+	// mu serializes the decisions and new requests so a transaction is
+	// signed at most once, and not replaced while decided, by this process.
+	mu sync.Mutex
+}
+
+// NewManualApproval returns a ManualApproval storing the requests in store
+// and signing the approved ones with next. Checks which must happen when
+// the request is received, e.g. of the challenge password, belong in
+// middleware wrapping the ManualApproval.
+func NewManualApproval(store depot.TransactionStore, next CSRSigner, opts ...TransactionOption) *ManualApproval {
+	return &ManualApproval{store: store, next: next, policy: newTransactionPolicy(opts)}
+}
+
+// SignCSR stores a new request as pending and returns ErrPending. A resent
+// request is answered with the state of its transaction: ErrPending, the
+// issued certificate, or a FailInfoError with the reason of the rejection.
+// Another request for the same key replaces the transaction, so a decision
+// only applies to the request it was made on.
+func (a *ManualApproval) SignCSR(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+	if m.TransactionID == "" {
+		err := errors.New("request has no transactionID")
+		return nil, &FailInfoError{FailInfo: scep.BadRequest, Err: err}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	t, err := a.store.Transaction(m.TransactionID)
+	if errors.Is(err, depot.ErrTransactionNotFound) {
+		return nil, a.hold(m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	crt, ok, err := a.policy.resent(m, t)
+	if !ok {
+		return nil, a.hold(m)
+	}
+	return crt, err
+}
+
+// requestDigest returns the RequestDigest of the transaction of m.
+func requestDigest(m *scep.CSRReqMessage) []byte {
+	digest := sha256.Sum256(m.CSR.Raw)
+	return digest[:]
+}
+
+// resent answers the request m from its stored transaction t with the
+// issued certificate, the reason of the rejection or ErrPending, marking m
+// as Replayed for decided transactions. It reports false if t does not
+// answer m, which is then a new request.
+func (p *transactionPolicy) resent(m *scep.CSRReqMessage, t *depot.Transaction) (*x509.Certificate, bool, error) {
+	if !p.live(t) {
+		return nil, false, nil
+	}
+	csr, err := x509.ParseCertificateRequest(t.CSR)
+	if err != nil {
+		return nil, true, err
+	}
+	if !bytes.Equal(csr.RawSubjectPublicKeyInfo, m.CSR.RawSubjectPublicKeyInfo) {
+		err := fmt.Errorf("transactionID %s used for another key", m.TransactionID)
+		return nil, true, &FailInfoError{FailInfo: scep.BadRequest, Err: err}
+	}
+	if !bytes.Equal(t.RequestDigest, requestDigest(m)) {
+		return nil, false, nil
+	}
+	switch t.Status {
+	case depot.TransactionIssued:
+		m.Replayed = true
+		crt, err := x509.ParseCertificate(t.Certificate)
+		return crt, true, err
+	case depot.TransactionRejected:
+		m.Replayed = true
+		return nil, true, rejection(t)
+	}
+	return nil, true, ErrPending
+}
+
+// live reports whether t still answers the requests resent for it.
+func (p *transactionPolicy) live(t *depot.Transaction) bool {
+	now := p.now()
+	switch t.Status {
+	case depot.TransactionPending:
+		return true
+	case depot.TransactionRejected:
+		return now.Sub(t.UpdatedAt) < p.ttl
+	case depot.TransactionIssued:
+		if now.Sub(t.UpdatedAt) >= p.ttl {
+			return false
+		}
+		crt, err := x509.ParseCertificate(t.Certificate)
+		if err != nil || now.After(crt.NotAfter) {
+			return false
+		}
+		if p.revocations == nil {
+			return true
+		}
+		revoked, err := p.revocations.Revoked()
+		if err != nil {
+			// signing again is safer than handing out a revoked certificate
+			return false
+		}
+		for _, r := range revoked {
+			if r.SerialNumber.Cmp(crt.SerialNumber) == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (a *ManualApproval) hold(m *scep.CSRReqMessage) error {
+	t, err := newTransaction(m, depot.TransactionPending)
+	if err != nil {
+		return err
+	}
+	if err := a.store.SaveTransaction(t); err != nil {
+		return err
+	}
+	return ErrPending
+}
+
+// newTransaction returns the transaction of the request m with status.
+func newTransaction(m *scep.CSRReqMessage, status depot.TransactionStatus) (*depot.Transaction, error) {
+	csr, err := m.SanitizedCSR()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	t := &depot.Transaction{
+		ID:                m.TransactionID,
+		MessageType:       m.MessageType,
+		Status:            status,
+		CSR:               csr,
+		RequestDigest:     requestDigest(m),
+		Challenge:         m.ChallengePassword != "",
+		ChallengeMetadata: m.ChallengeMetadata,
+		CreatedAt:         now,
+		UpdatedAt:         now,
+	}
+	if m.SignerCert != nil {
+		t.SignerCert = m.SignerCert.Raw
+	}
+	return t, nil
+}
+
+// Approve signs the CSR of the pending transaction id with the next
+// CSRSigner and stores the issued certificate for the CertPoll of the
+// client. A transaction whose signing fails stays pending.
+func (a *ManualApproval) Approve(id scep.TransactionID) (*x509.Certificate, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	t, err := a.pending(id)
+	if err != nil {
+		return nil, err
+	}
+	m := &scep.CSRReqMessage{
+		RawDecrypted:      t.CSR,
+		TransactionID:     t.ID,
+		MessageType:       t.MessageType,
+		ChallengeMetadata: t.ChallengeMetadata,
+	}
+	if m.CSR, err = x509.ParseCertificateRequest(t.CSR); err != nil {
+		return nil, err
+	}
+	if t.SignerCert != nil {
+		if m.SignerCert, err = x509.ParseCertificate(t.SignerCert); err != nil {
+			return nil, err
+		}
+	}
+	crt, err := a.next.SignCSR(m)
+	if err == nil && crt == nil {
+		err = errors.New("no signed certificate")
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.Status = depot.TransactionIssued
+	t.Certificate = crt.Raw
+	t.UpdatedAt = time.Now().UTC()
+	return crt, a.store.SaveTransaction(t)
+}
+
+// Reject rejects the pending transaction id. The reason is sent to the
+// client as the failInfoText of the FAILURE answering its CertPoll.
+func (a *ManualApproval) Reject(id scep.TransactionID, reason string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	t, err := a.pending(id)
+	if err != nil {
+		return err
+	}
+	t.Status = depot.TransactionRejected
+	t.Reason = reason
+	t.UpdatedAt = time.Now().UTC()
+	return a.store.SaveTransaction(t)
+}
+
+// pending returns the transaction id if it is still pending.
+func (a *ManualApproval) pending(id scep.TransactionID) (*depot.Transaction, error) {
+	t, err := a.store.Transaction(id)
+	if err != nil {
+		return nil, err
+	}
+	if t.Status != depot.TransactionPending {
+		return nil, fmt.Errorf("%w: %s is %s", ErrNotPending, id, t.Status)
+	}
+	return t, nil
+}
+
+// rejection returns the FailInfoError for the rejected transaction t.
+func rejection(t *depot.Transaction) error {
+	return &FailInfoError{
+		FailInfo: scep.BadRequest,
+		Text:     t.Reason,
+		Err:      fmt.Errorf("transaction %s rejected: %s", t.ID, t.Reason),
+	}
+}
@@ -0,0 +1,156 @@
+package scepserver_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"testing"
+
+	scepdepot "github.com/micromdm/scep/v2/depot"
+	"github.com/micromdm/scep/v2/scep"
+	scepserver "github.com/micromdm/scep/v2/server"
+)
+
+func TestManualApproval(t *testing.T) {
+	boltDepot := createDB(0666, nil)
+	key, err := boltDepot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := boltDepot.CreateOrLoadCA(key, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	approval := scepserver.NewManualApproval(boltDepot, scepdepot.NewSigner(boltDepot))
+	newService := func() scepserver.Service {
+		svc, err := scepserver.NewService(caCert, key, approval, scepserver.WithTransactionStore(boltDepot))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return svc
+	}
+	svc := newService()
+
+	newKeyRequest := func(cn string, selfKey *rsa.PrivateKey) (*scep.PKIMessage, *x509.CertificateRequest, *x509.Certificate, *rsa.PrivateKey) {
+		csrBytes, err := newCSR(selfKey, "ou", "loc", "province", "country", cn, "org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		csr, err := x509.ParseCertificateRequest(csrBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signerCert, err := selfSign(selfKey, csr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+			MessageType: scep.PKCSReq,
+			Recipients:  []*x509.Certificate{caCert},
+			SignerKey:   selfKey,
+			SignerCert:  signerCert,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg, csr, signerCert, selfKey
+	}
+	newRequest := func(cn string) (*scep.PKIMessage, *x509.CertificateRequest, *x509.Certificate, *rsa.PrivateKey) {
+		selfKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return newKeyRequest(cn, selfKey)
+	}
+	send := func(svc scepserver.Service, data []byte, want scep.PKIStatus) *scep.PKIMessage {
+		t.Helper()
+		respBytes, err := svc.PKIOperation(context.Background(), data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		respMsg, err := scep.ParsePKIMessage(respBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := respMsg.PKIStatus; have != want {
+			t.Fatalf("have %s, want %s", have, want)
+		}
+		return respMsg
+	}
+	poll := func(msg *scep.PKIMessage, csr *x509.CertificateRequest, signerCert *x509.Certificate, signerKey *rsa.PrivateKey) []byte {
+		req, err := scep.NewCertPollRequest(scep.NewIssuerAndSubject(caCert, csr), &scep.PKIMessage{
+			TransactionID: msg.TransactionID,
+			Recipients:    []*x509.Certificate{caCert},
+			SignerKey:     signerKey,
+			SignerCert:    signerCert,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req.Raw
+	}
+
+	msg, csr, signerCert, selfKey := newRequest("approved")
+	send(svc, msg.Raw, scep.PENDING)
+	send(svc, poll(msg, csr, signerCert, selfKey), scep.PENDING)
+	pending, err := boltDepot.Transactions(scepdepot.TransactionPending)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].ID != msg.TransactionID {
+		t.Fatalf("have pending transactions %v, want %s", pending, msg.TransactionID)
+	}
+
+	// only the requester may poll
+	_, _, otherCert, otherKey := newRequest("other")
+	respMsg := send(svc, poll(msg, csr, otherCert, otherKey), scep.FAILURE)
+	if have, want := respMsg.FailInfo, scep.FailInfo(scep.BadMessageCheck); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	issued, err := approval.Approve(msg.TransactionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := approval.Approve(msg.TransactionID); err == nil {
+		t.Error("approved a transaction twice")
+	}
+	// the outcome is polled from the store after a restart
+	svc = newService()
+	respMsg = send(svc, poll(msg, csr, signerCert, selfKey), scep.SUCCESS)
+	if err := respMsg.DecryptPKIEnvelope(signerCert, selfKey); err != nil {
+		t.Fatal(err)
+	}
+	if !respMsg.Certificates[0].Equal(issued) {
+		t.Error("CertPoll returned a different certificate")
+	}
+	// the resent request is answered with the certificate, while another
+	// request for the same key is held again
+	send(svc, msg.Raw, scep.SUCCESS)
+	again, _, _, _ := newKeyRequest("approved-again", selfKey)
+	if again.TransactionID != msg.TransactionID {
+		t.Fatal("requests for the same key have different transactionIDs")
+	}
+	send(svc, again.Raw, scep.PENDING)
+
+	msg, csr, signerCert, selfKey = newRequest("rejected")
+	send(svc, msg.Raw, scep.PENDING)
+	if err := approval.Reject(msg.TransactionID, "unknown device"); err != nil {
+		t.Fatal(err)
+	}
+	respMsg = send(svc, poll(msg, csr, signerCert, selfKey), scep.FAILURE)
+	if have, want := respMsg.FailInfoText, "unknown device"; have != want {
+		t.Errorf("have failInfoText %q, want %q", have, want)
+	}
+	// the rejection does not block the key
+	send(svc, msg.Raw, scep.FAILURE)
+	again, _, _, _ = newKeyRequest("rejected-again", selfKey)
+	send(svc, again.Raw, scep.PENDING)
+
+	unknown, csr, signerCert, selfKey := newRequest("unknown")
+	respMsg = send(svc, poll(unknown, csr, signerCert, selfKey), scep.FAILURE)
+	if have, want := respMsg.FailInfo, scep.FailInfo(scep.BadCertID); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
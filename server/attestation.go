@@ -0,0 +1,53 @@
+package scepserver
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// AttestationVerifier verifies the TPM attestation of a CSR, e.g. with
+// github.com/google/go-attestation: that the AK certificates chain to a
+// trusted TPM vendor or attestation CA, that Signature is a valid AK
+// signature of CertifyInfo, that CertifyInfo certifies the name of
+// KeyPublic and that KeyPublic is the public key of the CSR.
+type AttestationVerifier interface {
+	VerifyAttestation(m *scep.CSRReqMessage, a *scep.TPMAttestation) error
+}
+
+// AttestationVerifierFunc is an adapter to use a function as an
+// AttestationVerifier.
+type AttestationVerifierFunc func(*scep.CSRReqMessage, *scep.TPMAttestation) error
+
+// VerifyAttestation calls f(m, a)
+func (f AttestationVerifierFunc) VerifyAttestation(m *scep.CSRReqMessage, a *scep.TPMAttestation) error {
+	return f(m, a)
+}
+
+// AttestationMiddleware wraps next in a CSRSigner that verifies the TPM
+// attestation of CSRs with verifier. If required is true, CSRs without an
+// attestation are rejected as well, so that only keys residing in a TPM
+// are certified. Rejected CSRs are reported with the badRequest failInfo.
+func AttestationMiddleware(verifier AttestationVerifier, required bool, next CSRSigner) CSRSignerFunc {
+	return func(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+		a, err := scep.ParseTPMAttestation(m.CSR)
+		switch {
+		case errors.Is(err, scep.ErrNoAttestation) && !required:
+			return next.SignCSR(m)
+		case err != nil:
+			return nil, &FailInfoError{
+				FailInfo: scep.BadRequest,
+				Err:      fmt.Errorf("TPM attestation: %w", err),
+			}
+		}
+		if err := verifier.VerifyAttestation(m, a); err != nil {
+			return nil, &FailInfoError{
+				FailInfo: scep.BadRequest,
+				Err:      fmt.Errorf("TPM attestation: %w", err),
+			}
+		}
+		return next.SignCSR(m)
+	}
+}
@@ -0,0 +1,75 @@
+package scepserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"testing"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+func TestAttestationMiddleware(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newCSR := func(att *scep.TPMAttestation) *x509.CertificateRequest {
+		tmpl := &x509.CertificateRequest{Subject: pkix.Name{CommonName: "attested"}}
+		if att != nil {
+			ext, err := att.Extension()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tmpl.ExtraExtensions = []pkix.Extension{ext}
+		}
+		der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return csr
+	}
+	verifier := AttestationVerifierFunc(func(_ *scep.CSRReqMessage, a *scep.TPMAttestation) error {
+		if !bytes.Equal(a.Signature, []byte("valid")) {
+			return errors.New("invalid AK signature")
+		}
+		return nil
+	})
+	valid := newCSR(&scep.TPMAttestation{CertifyInfo: []byte("attest"), Signature: []byte("valid")})
+	invalid := newCSR(&scep.TPMAttestation{CertifyInfo: []byte("attest"), Signature: []byte("forged")})
+	none := newCSR(nil)
+
+	for _, test := range []struct {
+		testName string
+		csr      *x509.CertificateRequest
+		required bool
+		wantErr  bool
+	}{
+		{"valid", valid, true, false},
+		{"invalid", invalid, false, true},
+		{"missing", none, false, false},
+		{"missing but required", none, true, true},
+	} {
+		t.Run(test.testName, func(t *testing.T) {
+			signer := AttestationMiddleware(verifier, test.required, NopCSRSigner())
+			_, err := signer.SignCSR(&scep.CSRReqMessage{CSR: test.csr})
+			if !test.wantErr {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var failErr *FailInfoError
+			if !errors.As(err, &failErr) || failErr.FailInfo != scep.BadRequest {
+				t.Errorf("have %v, want a badRequest FailInfoError", err)
+			}
+		})
+	}
+}
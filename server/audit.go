@@ -0,0 +1,134 @@
+package scepserver
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// ErrInvalidChallenge is returned by CSRSigners rejecting the
+// challengePassword of a request.
+var ErrInvalidChallenge = errors.New("invalid challenge")
+
+// ChallengeOutcome describes the challengePassword of an audited request.
+type ChallengeOutcome string
+
+const (
+	// ChallengeNone means the CSR had no challengePassword.
+	ChallengeNone ChallengeOutcome = "none"
+	// ChallengeAccepted means a certificate was issued for a CSR with a
+	// challengePassword.
+	ChallengeAccepted ChallengeOutcome = "accepted"
+	// ChallengeRejected means the request was rejected with
+	// ErrInvalidChallenge.
+	ChallengeRejected ChallengeOutcome = "rejected"
+	// ChallengeUnverified means the request was rejected for another
+	// reason before or after its challengePassword was checked.
+	ChallengeUnverified ChallengeOutcome = "unverified"
+)
+
+// AuditEvent records the decision on an enrollment request.
+type AuditEvent struct {
+	Time          time.Time          `json:"time"`
+	TransactionID scep.TransactionID `json:"transaction_id"`
+	MessageType   string             `json:"message_type"`
+
+	// Subject and SANs requested in the CSR.
+	Subject        string   `json:"subject,omitempty"`
+	DNSNames       []string `json:"dns_names,omitempty"`
+	EmailAddresses []string `json:"email_addresses,omitempty"`
+	IPAddresses    []string `json:"ip_addresses,omitempty"`
+	URIs           []string `json:"uris,omitempty"`
+
+	Challenge ChallengeOutcome `json:"challenge"`
+
+	// Serial is the hex encoded serial number of the issued certificate.
+	Serial string `json:"serial,omitempty"`
+
+	// FailInfo and Error are set if the request was rejected.
+	FailInfo string `json:"fail_info,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Failed reports whether the request of e was rejected.
+func (e AuditEvent) Failed() bool {
+	return e.FailInfo != ""
+}
+
+// AuditLogger records enrollment decisions for compliance purposes,
+// independent of the debug logger of the service. Errors are logged to the
+// debug logger and do not affect the response.
+type AuditLogger interface {
+	Audit(ctx context.Context, e AuditEvent) error
+}
+
+// AuditLoggerFunc is an adapter for AuditLogger.
+type AuditLoggerFunc func(context.Context, AuditEvent) error
+
+// Audit calls f(ctx, e).
+func (f AuditLoggerFunc) Audit(ctx context.Context, e AuditEvent) error {
+	return f(ctx, e)
+}
+
+type jsonAuditLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONAuditLogger returns an AuditLogger writing each event as a line
+// of JSON to w.
+func NewJSONAuditLogger(w io.Writer) AuditLogger {
+	return &jsonAuditLogger{enc: json.NewEncoder(w)}
+}
+
+func (l *jsonAuditLogger) Audit(_ context.Context, e AuditEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enc.Encode(e)
+}
+
+// newAuditEvent returns the AuditEvent for the decision on the enrollment
+// request msg: crt was issued, or the request was rejected with err.
+func newAuditEvent(msg *scep.PKIMessage, crt *x509.Certificate, err error) AuditEvent {
+	e := AuditEvent{
+		Time:          time.Now().UTC(),
+		TransactionID: msg.TransactionID,
+		MessageType:   msg.MessageType.String(),
+		Challenge:     ChallengeNone,
+	}
+	if m := msg.CSRReqMessage; m != nil && m.CSR != nil {
+		e.Subject = m.CSR.Subject.String()
+		e.DNSNames = m.CSR.DNSNames
+		e.EmailAddresses = m.CSR.EmailAddresses
+		for _, ip := range m.CSR.IPAddresses {
+			e.IPAddresses = append(e.IPAddresses, ip.String())
+		}
+		for _, uri := range m.CSR.URIs {
+			e.URIs = append(e.URIs, uri.String())
+		}
+		if m.ChallengePassword != "" {
+			e.Challenge = ChallengeUnverified
+		}
+	}
+	switch {
+	case errors.Is(err, ErrInvalidChallenge):
+		e.Challenge = ChallengeRejected
+	case err == nil && e.Challenge == ChallengeUnverified:
+		e.Challenge = ChallengeAccepted
+	}
+	if err != nil {
+		e.FailInfo = failureOptions(err).FailInfo.String()
+		e.Error = err.Error()
+	}
+	if crt != nil {
+		e.Serial = fmt.Sprintf("%X", crt.SerialNumber)
+	}
+	return e
+}
@@ -0,0 +1,31 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package scepserver
+
+import (
+	"context"
+	"encoding/json"
+	"log/syslog"
+)
+
+type syslogAuditLogger struct {
+	w *syslog.Writer
+}
+
+// NewSyslogAuditLogger returns an AuditLogger sending each event as JSON to
+// w, with the warning severity for rejected requests and info otherwise.
+func NewSyslogAuditLogger(w *syslog.Writer) AuditLogger {
+	return &syslogAuditLogger{w: w}
+}
+
+func (l *syslogAuditLogger) Audit(_ context.Context, e AuditEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if e.Failed() {
+		return l.w.Warning(string(data))
+	}
+	return l.w.Info(string(data))
+}
@@ -0,0 +1,69 @@
+package scepserver
+
+import (
+	"crypto/x509"
+	"errors"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// CACertResponse is the answer to a GetCACert request, see
+// NewCACertResponse.
+type CACertResponse struct {
+	// Data is the body: a DER certificate for a single certificate, a
+	// degenerate PKCS#7 SignedData of the certificates otherwise.
+	Data []byte
+
+	// ContentType is application/x-x509-ca-cert for a single certificate
+	// and application/x-x509-ca-ra-cert for several.
+	ContentType string
+
+	// CertNum is the number of certificates in Data.
+	CertNum int
+}
+
+// NewCACertResponse builds the GetCACert response publishing the CA
+// certificate ca and certs, e.g. the RA signing and RA encryption
+// certificates of an RA and intermediate CA certificates. Certificates
+// given more than once are published once.
+func NewCACertResponse(ca *x509.Certificate, certs ...*x509.Certificate) (*CACertResponse, error) {
+	if ca == nil {
+		return nil, errors.New("missing CA certificate")
+	}
+	all := []*x509.Certificate{ca}
+certs:
+	for _, crt := range certs {
+		for _, added := range all {
+			if crt.Equal(added) {
+				continue certs
+			}
+		}
+		all = append(all, crt)
+	}
+	if len(all) == 1 {
+		return &CACertResponse{Data: ca.Raw, ContentType: leafHeader, CertNum: 1}, nil
+	}
+	data, err := scep.DegenerateCertificates(all)
+	if err != nil {
+		return nil, err
+	}
+	return &CACertResponse{Data: data, ContentType: certChainHeader, CertNum: len(all)}, nil
+}
+
+// WithCAIdent answers GetCACert requests whose message parameter is ident
+// with the service certificate and certs, instead of the certificates of
+// WithAddlCA and WithCertificateChain. It lets one RA publish the CAs
+// behind it under the CA identifiers clients are configured with. Other
+// messages, including an empty one, get the default response.
+func WithCAIdent(ident string, certs ...*x509.Certificate) ServiceOption {
+	return func(s *service) error {
+		if ident == "" {
+			return errors.New("empty CA identifier")
+		}
+		if s.caIdents == nil {
+			s.caIdents = make(map[string][]*x509.Certificate)
+		}
+		s.caIdents[ident] = append(s.caIdents[ident], certs...)
+		return nil
+	}
+}
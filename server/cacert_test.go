@@ -0,0 +1,82 @@
+package scepserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+func TestNewCACertResponse(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Now().Add(time.Hour)
+	ca := newRenewalTestCert(t, key, nil, nil, notAfter)
+	raSigning := newRenewalTestCert(t, key, ca, key, notAfter)
+	raEncryption := newRenewalTestCert(t, key, ca, key, notAfter)
+
+	resp, err := NewCACertResponse(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ContentType != "application/x-x509-ca-cert" || resp.CertNum != 1 || string(resp.Data) != string(ca.Raw) {
+		t.Errorf("have %s with %d certificates, want the DER CA certificate", resp.ContentType, resp.CertNum)
+	}
+
+	resp, err = NewCACertResponse(ca, raSigning, raEncryption, ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ContentType != "application/x-x509-ca-ra-cert" || resp.CertNum != 3 {
+		t.Errorf("have %s with %d certificates, want a chain of 3", resp.ContentType, resp.CertNum)
+	}
+	certs, err := scep.CACerts(resp.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 3 || !certs[0].Equal(ca) || !certs[1].Equal(raSigning) || !certs[2].Equal(raEncryption) {
+		t.Errorf("have %d certificates, want the CA and RA certificates", len(certs))
+	}
+
+	if _, err := NewCACertResponse(nil); err == nil {
+		t.Error("expected an error without CA certificate")
+	}
+}
+
+func TestGetCACertIdent(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAfter := time.Now().Add(time.Hour)
+	ra := newRenewalTestCert(t, key, nil, nil, notAfter)
+	ca1 := newRenewalTestCert(t, key, nil, nil, notAfter)
+	ca2 := newRenewalTestCert(t, key, nil, nil, notAfter)
+	svc, err := NewService(ra, key, nil, WithAddlCA(ca1), WithCAIdent("ca-2", ca2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for message, want := range map[string]string{"": ca1.Subject.CommonName, "other": ca1.Subject.CommonName, "ca-2": ca2.Subject.CommonName} {
+		data, num, err := svc.GetCACert(context.Background(), message)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs, err := scep.CACerts(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if num != 2 || len(certs) != 2 || certs[1].Subject.CommonName != want {
+			t.Errorf("message %q: have %d certificates, want the RA and CA %s", message, num, want)
+		}
+	}
+
+	if _, err := NewService(ra, key, nil, WithCAIdent("")); err == nil {
+		t.Error("expected an error for an empty CA identifier")
+	}
+}
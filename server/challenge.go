@@ -0,0 +1,52 @@
+package scepserver
+
+import (
+	"crypto/subtle"
+	"crypto/x509"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// ChallengeValidator validates the challengePassword of a CSR against a
+// source of challenges: a static secret, a directory like Active
+// Directory, an HTTP endpoint or a script. Implementations for the
+// external sources are in the subpackages of challenge.
+type ChallengeValidator interface {
+	// ValidateChallenge reports whether challenge is valid for csr. An
+	// error means the source could not be asked, not that the challenge
+	// is invalid.
+	ValidateChallenge(challenge string, csr *x509.CertificateRequest) (bool, error)
+}
+
+// ChallengeValidatorFunc is an adapter to use a function as a
+// ChallengeValidator.
+type ChallengeValidatorFunc func(challenge string, csr *x509.CertificateRequest) (bool, error)
+
+// ValidateChallenge calls f(challenge, csr).
+func (f ChallengeValidatorFunc) ValidateChallenge(challenge string, csr *x509.CertificateRequest) (bool, error) {
+	return f(challenge, csr)
+}
+
+// StaticChallenge returns a ChallengeValidator accepting only secret. An
+// empty secret accepts no challenge.
+func StaticChallenge(secret string) ChallengeValidator {
+	secretBytes := []byte(secret)
+	return ChallengeValidatorFunc(func(challenge string, _ *x509.CertificateRequest) (bool, error) {
+		return len(secretBytes) > 0 && subtle.ConstantTimeCompare(secretBytes, []byte(challenge)) == 1, nil
+	})
+}
+
+// ChallengeValidatorMiddleware wraps next in a CSRSigner that rejects
+// requests whose challenge v does not accept with ErrInvalidChallenge.
+func ChallengeValidatorMiddleware(v ChallengeValidator, next CSRSigner) CSRSignerFunc {
+	return func(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+		valid, err := v.ValidateChallenge(m.ChallengePassword, m.CSR)
+		if err != nil {
+			return nil, err
+		}
+		if !valid {
+			return nil, ErrInvalidChallenge
+		}
+		return next.SignCSR(m)
+	}
+}
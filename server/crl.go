@@ -0,0 +1,73 @@
+package scepserver
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"net/http"
+
+	"github.com/micromdm/scep/v2/depot"
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// CRLGetter returns the DER encoded CRL covering the certificate identified
+// by an IssuerAndSerial of a GetCRL request. Returning a *FailInfoError
+// sets the failInfo of the CertRep FAILURE.
+type CRLGetter interface {
+	GetCRL(scep.IssuerAndSerial) ([]byte, error)
+}
+
+// CRLGetterFunc is an adapter for CRLGetter.
+type CRLGetterFunc func(scep.IssuerAndSerial) ([]byte, error)
+
+// GetCRL calls f(ias).
+func (f CRLGetterFunc) GetCRL(ias scep.IssuerAndSerial) ([]byte, error) {
+	return f(ias)
+}
+
+// StaticCRL returns a CRLGetter which answers with crl for certificates
+// issued by ca and with badCertID for any other issuer.
+func StaticCRL(ca *x509.Certificate, crl []byte) CRLGetterFunc {
+	return func(ias scep.IssuerAndSerial) ([]byte, error) {
+		if !bytes.Equal(ias.Issuer.FullBytes, ca.RawSubject) {
+			err := errors.New("certificate not issued by this CA")
+			return nil, &FailInfoError{FailInfo: scep.BadCertID, Err: err}
+		}
+		return crl, nil
+	}
+}
+
+// DepotCRL returns a CRLGetter which answers with the current CRL stored in
+// crls for certificates issued by ca and with badCertID for any other issuer.
+func DepotCRL(ca *x509.Certificate, crls depot.CRLGetter) CRLGetterFunc {
+	return func(ias scep.IssuerAndSerial) ([]byte, error) {
+		if !bytes.Equal(ias.Issuer.FullBytes, ca.RawSubject) {
+			err := errors.New("certificate not issued by this CA")
+			return nil, &FailInfoError{FailInfo: scep.BadCertID, Err: err}
+		}
+		return crls.CRL()
+	}
+}
+
+// NewCRLHandler returns an http.Handler serving the current DER encoded CRL
+// of crls, e.g. at a CRL distribution point of the issued certificates.
+func NewCRLHandler(crls depot.CRLGetter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		crl, err := crls.CRL()
+		if errors.Is(err, depot.ErrCRLNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pkix-crl")
+		w.Write(crl)
+	})
+}
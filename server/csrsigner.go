@@ -1,9 +1,12 @@
 package scepserver
 
 import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
 	"crypto/subtle"
 	"crypto/x509"
-	"errors"
+	"fmt"
 
 	"github.com/micromdm/scep/v2/scep"
 )
@@ -37,7 +40,127 @@ func ChallengeMiddleware(challenge string, next CSRSigner) CSRSignerFunc {
 	return func(m *scep.CSRReqMessage) (*x509.Certificate, error) {
 		// TODO: compare challenge only for PKCSReq?
 		if subtle.ConstantTimeCompare(challengeBytes, []byte(m.ChallengePassword)) != 1 {
-			return nil, errors.New("invalid challenge")
+			return nil, ErrInvalidChallenge
+		}
+		return next.SignCSR(m)
+	}
+}
+
+// FailInfoError is returned by a CSRSigner to choose the failInfo of the
+// CertRep FAILURE message sent back to the client. Other errors are reported
+// as badRequest. Text is sent as failInfoText; Err is only logged.
+type FailInfoError struct {
+	FailInfo scep.FailInfo
+	Text     string
+	Err      error
+}
+
+func (e *FailInfoError) Error() string {
+	return fmt.Sprintf("%s: %v", e.FailInfo, e.Err)
+}
+
+func (e *FailInfoError) Unwrap() error { return e.Err }
+
+// insecure CSR signature algorithms rejected when no explicit list is given.
+var insecureSignatureAlgorithms = []x509.SignatureAlgorithm{
+	x509.UnknownSignatureAlgorithm,
+	x509.MD2WithRSA,
+	x509.MD5WithRSA,
+}
+
+// SignatureAlgorithmMiddleware wraps next in a CSRSigner that requires the
+// CSR to be self-signed with one of the allowed signature algorithms.
+// If allowed is empty, any algorithm except MD2 or MD5 based ones is accepted.
+// Rejected CSRs are reported with the badAlg failInfo.
+func SignatureAlgorithmMiddleware(allowed []x509.SignatureAlgorithm, next CSRSigner) CSRSignerFunc {
+	return func(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+		alg := m.CSR.SignatureAlgorithm
+		if !acceptableSignatureAlgorithm(alg, allowed) {
+			return nil, &FailInfoError{
+				FailInfo: scep.BadAlg,
+				Err:      fmt.Errorf("CSR signature algorithm %s not allowed", alg),
+			}
+		}
+		if err := m.CSR.CheckSignature(); err != nil {
+			return nil, &FailInfoError{
+				FailInfo: scep.BadMessageCheck,
+				Err:      fmt.Errorf("CSR signature: %w", err),
+			}
+		}
+		return next.SignCSR(m)
+	}
+}
+
+func acceptableSignatureAlgorithm(alg x509.SignatureAlgorithm, allowed []x509.SignatureAlgorithm) bool {
+	if len(allowed) == 0 {
+		for _, insecure := range insecureSignatureAlgorithms {
+			if alg == insecure {
+				return false
+			}
+		}
+		return true
+	}
+	for _, a := range allowed {
+		if alg == a {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyPolicy sets the minimum strength of the CSR public keys checked by
+// PublicKeyMiddleware. Zero values do not constrain the keys.
+type KeyPolicy struct {
+	// MinRSAKeySize is the minimum size of RSA keys in bits.
+	MinRSAKeySize int
+	// MinRSAExponent is the minimum public exponent of RSA keys. Even
+	// exponents are always rejected.
+	MinRSAExponent int
+	// ECDSACurves allow-lists the curves of ECDSA keys, e.g. "P-256".
+	ECDSACurves []string
+}
+
+// DefaultKeyPolicy requires RSA keys of at least 2048 bits with an exponent
+// of at least 65537 and ECDSA keys on the NIST P-256, P-384 or P-521 curves.
+var DefaultKeyPolicy = KeyPolicy{
+	MinRSAKeySize:  2048,
+	MinRSAExponent: 65537,
+	ECDSACurves:    []string{"P-256", "P-384", "P-521"},
+}
+
+// Check returns an error describing the violation if pub does not satisfy
+// the policy.
+func (p KeyPolicy) Check(pub interface{}) error {
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		if size := pub.N.BitLen(); size < p.MinRSAKeySize {
+			return fmt.Errorf("RSA key size %d below minimum %d", size, p.MinRSAKeySize)
+		}
+		if pub.E%2 == 0 || pub.E < p.MinRSAExponent {
+			return fmt.Errorf("RSA public exponent %d not allowed", pub.E)
+		}
+	case *ecdsa.PublicKey:
+		if curve := pub.Curve.Params().Name; len(p.ECDSACurves) > 0 && !contains(p.ECDSACurves, curve) {
+			return fmt.Errorf("ECDSA curve %s not allowed", curve)
+		}
+	case ed25519.PublicKey:
+	default:
+		return fmt.Errorf("unsupported key type %T", pub)
+	}
+	return nil
+}
+
+// PublicKeyMiddleware wraps next in a CSRSigner that requires the public
+// key of the CSR to satisfy policy, e.g. DefaultKeyPolicy. Rejected CSRs are
+// reported with the badRequest failInfo and the violation as failInfoText.
+func PublicKeyMiddleware(policy KeyPolicy, next CSRSigner) CSRSignerFunc {
+	return func(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+		if err := policy.Check(m.CSR.PublicKey); err != nil {
+			return nil, &FailInfoError{
+				FailInfo: scep.BadRequest,
+				Text:     err.Error(),
+				Err:      fmt.Errorf("public key policy: %w", err),
+			}
 		}
 		return next.SignCSR(m)
 	}
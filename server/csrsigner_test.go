@@ -1,6 +1,16 @@
 package scepserver
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
 	"testing"
 
 	"github.com/micromdm/scep/v2/scep"
@@ -24,3 +34,165 @@ func TestChallengeMiddleware(t *testing.T) {
 		t.Error("invalid challenge should generate an error")
 	}
 }
+
+func TestChallengeValidatorMiddleware(t *testing.T) {
+	errSource := errors.New("source unavailable")
+	for _, test := range []struct {
+		name      string
+		v         ChallengeValidator
+		challenge string
+		wantErr   error
+	}{
+		{"static", StaticChallenge("RIGHT"), "RIGHT", nil},
+		{"static wrong", StaticChallenge("RIGHT"), "WRONG", ErrInvalidChallenge},
+		{"static empty secret", StaticChallenge(""), "", ErrInvalidChallenge},
+		{"source error", ChallengeValidatorFunc(func(string, *x509.CertificateRequest) (bool, error) {
+			return true, errSource
+		}), "RIGHT", errSource},
+	} {
+		signer := ChallengeValidatorMiddleware(test.v, NopCSRSigner())
+		_, err := signer.SignCSR(&scep.CSRReqMessage{ChallengePassword: test.challenge})
+		if err != test.wantErr {
+			t.Errorf("%s: have error %v, want %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestSignatureAlgorithmMiddleware(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		testName string
+		sigAlg   x509.SignatureAlgorithm
+		allowed  []x509.SignatureAlgorithm
+		wantInfo scep.FailInfo
+	}{
+		{"SHA-256 with defaults", x509.SHA256WithRSA, nil, ""},
+		{"MD5 with defaults", x509.MD5WithRSA, nil, scep.BadAlg},
+		{"SHA-256 allowed", x509.SHA256WithRSA, []x509.SignatureAlgorithm{x509.SHA256WithRSA}, ""},
+		{"SHA-256 not allowed", x509.SHA256WithRSA, []x509.SignatureAlgorithm{x509.SHA512WithRSA}, scep.BadAlg},
+	} {
+		test := test
+		t.Run(test.testName, func(t *testing.T) {
+			t.Parallel()
+			csr := newTestCSR(t, key, test.sigAlg)
+			if have, want := csr.SignatureAlgorithm, test.sigAlg; have != want {
+				t.Fatalf("have %s, want %s", have, want)
+			}
+			signer := SignatureAlgorithmMiddleware(test.allowed, NopCSRSigner())
+			_, err := signer.SignCSR(&scep.CSRReqMessage{CSR: csr})
+			if test.wantInfo == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var fiErr *FailInfoError
+			if !errors.As(err, &fiErr) {
+				t.Fatalf("expected FailInfoError, got %v", err)
+			}
+			if have, want := fiErr.FailInfo, test.wantInfo; have != want {
+				t.Errorf("have %s, want %s", have, want)
+			}
+		})
+	}
+}
+
+func TestPublicKeyMiddleware(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smallKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p224Key, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		testName string
+		pub      interface{}
+		wantText string
+	}{
+		{"RSA 2048", &rsaKey.PublicKey, ""},
+		{"RSA 1024", &smallKey.PublicKey, "RSA key size 1024 below minimum 2048"},
+		{"RSA exponent 3", &rsa.PublicKey{N: rsaKey.N, E: 3}, "RSA public exponent 3 not allowed"},
+		{"P-256", &p256Key.PublicKey, ""},
+		{"P-224", &p224Key.PublicKey, "ECDSA curve P-224 not allowed"},
+	} {
+		test := test
+		t.Run(test.testName, func(t *testing.T) {
+			t.Parallel()
+			signer := PublicKeyMiddleware(DefaultKeyPolicy, NopCSRSigner())
+			_, err := signer.SignCSR(&scep.CSRReqMessage{CSR: &x509.CertificateRequest{PublicKey: test.pub}})
+			if test.wantText == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var fiErr *FailInfoError
+			if !errors.As(err, &fiErr) {
+				t.Fatalf("expected FailInfoError, got %v", err)
+			}
+			if fiErr.FailInfo != scep.BadRequest || fiErr.Text != test.wantText {
+				t.Errorf("have %s %q, want badRequest %q", fiErr.FailInfo, fiErr.Text, test.wantText)
+			}
+		})
+	}
+}
+
+// newTestCSR creates a CSR signed with sigAlg. MD5WithRSA is no longer
+// supported by the standard library so the signature is computed by hand.
+func newTestCSR(t *testing.T, key *rsa.PrivateKey, sigAlg x509.SignatureAlgorithm) *x509.CertificateRequest {
+	tmpl := &x509.CertificateRequest{Subject: pkix.Name{CommonName: "sigalg"}}
+	if sigAlg != x509.MD5WithRSA {
+		tmpl.SignatureAlgorithm = sigAlg
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, tmpl, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sigAlg == x509.MD5WithRSA {
+		der = resignCSRWithMD5(t, der, key)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func resignCSRWithMD5(t *testing.T, der []byte, key *rsa.PrivateKey) []byte {
+	var req struct {
+		TBSCSR             asn1.RawValue
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		SignatureValue     asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(der, &req); err != nil {
+		t.Fatal(err)
+	}
+	digest := md5.Sum(req.TBSCSR.FullBytes)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.MD5, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SignatureAlgorithm = pkix.AlgorithmIdentifier{
+		Algorithm:  asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 4},
+		Parameters: asn1.NullRawValue,
+	}
+	req.SignatureValue = asn1.BitString{Bytes: sig, BitLength: len(sig) * 8}
+	out, err := asn1.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
@@ -0,0 +1,4 @@
+// package scepserver implements the server side of the SCEP HTTP binding
+// (RFC 8894 section 4): GetCACaps, GetCACert, GetNextCACert and GET or POST
+// PKIOperation. Certificate issuance is delegated to a CSRSigner.
+package scepserver
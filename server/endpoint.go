@@ -1,13 +1,14 @@
 package scepserver
 
 import (
-	"bytes"
 	"context"
 	"net/url"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/micromdm/scep/v2/scep"
+
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/log"
 	httptransport "github.com/go-kit/kit/transport/http"
@@ -45,16 +46,17 @@ func (e *Endpoints) GetCACaps(ctx context.Context) ([]byte, error) {
 	return resp.Data, resp.Err
 }
 
+// Supports reports whether the server advertises the GetCACaps keyword
+// cap, fetching the capabilities on first use.
 func (e *Endpoints) Supports(cap string) bool {
 	e.mtx.RLock()
-	defer e.mtx.RUnlock()
+	caps := e.capabilities
+	e.mtx.RUnlock()
 
-	if len(e.capabilities) == 0 {
-		e.mtx.RUnlock()
-		e.GetCACaps(context.Background())
-		e.mtx.RLock()
+	if len(caps) == 0 {
+		caps, _ = e.GetCACaps(context.Background())
 	}
-	return bytes.Contains(e.capabilities, []byte(cap))
+	return scep.ParseCapabilities(caps).Has(scep.Capability(cap))
 }
 
 func (e *Endpoints) GetCACert(ctx context.Context, message string) ([]byte, int, error) {
@@ -69,7 +71,7 @@ func (e *Endpoints) GetCACert(ctx context.Context, message string) ([]byte, int,
 
 func (e *Endpoints) PKIOperation(ctx context.Context, msg []byte) ([]byte, error) {
 	var ee endpoint.Endpoint
-	if e.Supports("POSTPKIOperation") || e.Supports("SCEPStandard") {
+	if e.Supports(string(scep.CapPOSTPKIOperation)) || e.Supports(string(scep.CapSCEPStandard)) {
 		ee = e.PostEndpoint
 	} else {
 		ee = e.GetEndpoint
@@ -85,7 +87,7 @@ func (e *Endpoints) PKIOperation(ctx context.Context, msg []byte) ([]byte, error
 }
 
 func (e *Endpoints) GetNextCACert(ctx context.Context) ([]byte, error) {
-	var request SCEPRequest
+	request := SCEPRequest{Operation: getNextCACert}
 	response, err := e.GetEndpoint(ctx, request)
 	if err != nil {
 		return nil, err
@@ -104,8 +106,9 @@ func MakeServerEndpoints(svc Service) *Endpoints {
 
 // MakeClientEndpoints returns an Endpoints struct where each endpoint invokes
 // the corresponding method on the remote instance, via a transport/http.Client.
-// Useful in a SCEP client.
-func MakeClientEndpoints(instance string) (*Endpoints, error) {
+// Useful in a SCEP client. options are passed to the go-kit clients, e.g.
+// httptransport.SetClient with a custom TLS configuration.
+func MakeClientEndpoints(instance string, options ...httptransport.ClientOption) (*Endpoints, error) {
 	if !strings.HasPrefix(instance, "http") {
 		instance = "http://" + instance
 	}
@@ -114,8 +117,6 @@ func MakeClientEndpoints(instance string) (*Endpoints, error) {
 		return nil, err
 	}
 
-	options := []httptransport.ClientOption{}
-
 	return &Endpoints{
 		GetEndpoint: httptransport.NewClient(
 			"GET",
@@ -137,11 +138,13 @@ func MakeSCEPEndpoint(svc Service) endpoint.Endpoint {
 		req := request.(SCEPRequest)
 		resp := SCEPResponse{operation: req.Operation}
 		switch req.Operation {
-		case "GetCACaps":
+		case getCACaps:
 			resp.Data, resp.Err = svc.GetCACaps(ctx)
-		case "GetCACert":
+		case getCACert:
 			resp.Data, resp.CACertNum, resp.Err = svc.GetCACert(ctx, string(req.Message))
-		case "PKIOperation":
+		case getNextCACert:
+			resp.Data, resp.Err = svc.GetNextCACert(ctx)
+		case pkiOperation:
 			resp.Data, resp.Err = svc.PKIOperation(ctx, req.Message)
 		default:
 			return nil, errors.New("operation not implemented")
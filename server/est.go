@@ -0,0 +1,193 @@
+package scepserver
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/micromdm/scep/v2/cryptoutil"
+	"github.com/micromdm/scep/v2/cryptoutil/x509util"
+	"github.com/micromdm/scep/v2/scep"
+
+	kitlog "github.com/go-kit/kit/log"
+)
+
+// ESTPathPrefix is the path below which the EST operations are served.
+const ESTPathPrefix = "/.well-known/est/"
+
+// maximum size of an EST request body
+const maxESTRequestSize = 64 << 10
+
+// seconds after which clients retry an enrollment held PENDING
+const estRetryAfter = "60"
+
+// ESTOption configures the handler of NewESTHandler.
+type ESTOption func(*estHandler)
+
+// WithESTLogger logs the failed EST requests to logger.
+func WithESTLogger(logger kitlog.Logger) ESTOption {
+	return func(h *estHandler) {
+		h.logger = logger
+	}
+}
+
+type estHandler struct {
+	caCerts []*x509.Certificate
+	signer  CSRSigner
+	logger  kitlog.Logger
+}
+
+// NewESTHandler returns an http.Handler serving the cacerts, simpleenroll
+// and simplereenroll operations of EST (RFC 7030) below ESTPathPrefix.
+// CSRs are signed by signer, which should be the CSRSigner of the SCEP
+// service so its middlewares apply to both protocols. caCerts are returned
+// by cacerts.
+//
+// The challengePassword of a simpleenroll CSR, or else the password of the
+// HTTP Basic authentication, is passed to signer as the challenge password.
+// A simplereenroll is passed as a RenewalReq signed by the TLS client
+// certificate, which must have been verified by the TLS server, e.g. with
+// tls.VerifyClientCertIfGiven, and have the subject of the CSR. Requests
+// held with ErrPending, e.g. by a ManualApproval, are answered with 202
+// Accepted and a Retry-After header; the transactionID is derived from the
+// CSR key so the retried request finds its transaction.
+func NewESTHandler(caCerts []*x509.Certificate, signer CSRSigner, opts ...ESTOption) http.Handler {
+	h := &estHandler{
+		caCerts: caCerts,
+		signer:  signer,
+		logger:  kitlog.NewNopLogger(),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+func (h *estHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case ESTPathPrefix + "cacerts":
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		h.writeCerts(w, h.caCerts)
+	case ESTPathPrefix + "simpleenroll":
+		h.enroll(w, r, scep.PKCSReq)
+	case ESTPathPrefix + "simplereenroll":
+		h.enroll(w, r, scep.RenewalReq)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *estHandler) enroll(w http.ResponseWriter, r *http.Request, msgType scep.MessageType) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	der, csr, err := readESTCSR(r)
+	if err != nil {
+		h.fail(w, msgType, http.StatusBadRequest, err)
+		return
+	}
+	// like SCEP clients, identify the transaction by the CSR key so a
+	// retried enrollment finds its pending request
+	keyID, err := cryptoutil.GenerateSubjectKeyID(csr.PublicKey)
+	if err != nil {
+		h.fail(w, msgType, http.StatusBadRequest, err)
+		return
+	}
+	m := &scep.CSRReqMessage{
+		RawDecrypted:  der,
+		CSR:           csr,
+		TransactionID: scep.TransactionID(base64.StdEncoding.EncodeToString(keyID)),
+		MessageType:   msgType,
+	}
+	m.ChallengePassword, err = x509util.ParseChallengePassword(der)
+	if err != nil {
+		h.fail(w, msgType, http.StatusBadRequest, err)
+		return
+	}
+	if _, pass, ok := r.BasicAuth(); ok && m.ChallengePassword == "" {
+		m.ChallengePassword = pass
+	}
+	if msgType == scep.RenewalReq {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			h.fail(w, msgType, http.StatusUnauthorized, errors.New("simplereenroll without a verified TLS client certificate"))
+			return
+		}
+		m.SignerCert = r.TLS.VerifiedChains[0][0]
+		if !bytes.Equal(m.SignerCert.RawSubject, csr.RawSubject) {
+			h.fail(w, msgType, http.StatusBadRequest, errors.New("simplereenroll CSR subject differs from the client certificate"))
+			return
+		}
+	}
+	crt, err := h.signer.SignCSR(m)
+	if errors.Is(err, ErrPending) {
+		w.Header().Set("Retry-After", estRetryAfter)
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if errors.Is(err, ErrInvalidChallenge) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="EST"`)
+		h.fail(w, msgType, http.StatusUnauthorized, err)
+		return
+	}
+	if err != nil {
+		h.fail(w, msgType, http.StatusBadRequest, err)
+		return
+	}
+	h.writeCerts(w, []*x509.Certificate{crt})
+}
+
+// fail answers with status and the failInfoText of a FailInfoError in err.
+func (h *estHandler) fail(w http.ResponseWriter, msgType scep.MessageType, status int, err error) {
+	h.logger.Log("msg", "EST request failed", "message_type", msgType, "err", err)
+	text := http.StatusText(status)
+	var fiErr *FailInfoError
+	if errors.As(err, &fiErr) && fiErr.Text != "" {
+		text = fiErr.Text
+	}
+	http.Error(w, text, status)
+}
+
+// writeCerts writes certs as the base64 encoded degenerate PKCS#7 of an EST
+// certs-only response.
+func (h *estHandler) writeCerts(w http.ResponseWriter, certs []*x509.Certificate) {
+	p7, err := scep.NewDegenerateP7(certs)
+	if err != nil {
+		h.logger.Log("msg", "encode EST response", "err", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkcs7-mime; smime-type=certs-only")
+	w.Header().Set("Content-Transfer-Encoding", "base64")
+	w.Write([]byte(base64.StdEncoding.EncodeToString(p7.Raw)))
+}
+
+// readESTCSR reads the base64 encoded PKCS#10 CSR of an EST request body.
+func readESTCSR(r *http.Request) ([]byte, *x509.CertificateRequest, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, maxESTRequestSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	// the base64 body may be split in lines
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(body)), ""))
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, nil, err
+	}
+	return der, csr, nil
+}
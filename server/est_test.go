@@ -0,0 +1,139 @@
+package scepserver_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/depot"
+	"github.com/micromdm/scep/v2/scep"
+	scepserver "github.com/micromdm/scep/v2/server"
+)
+
+func TestESTHandler(t *testing.T) {
+	caKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caDER, err := depot.NewCACert(depot.WithCommonName("EST CA")).SelfSign(rand.Reader, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var serial int64
+	var lastType scep.MessageType
+	issue := scepserver.CSRSignerFunc(func(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+		serial++
+		lastType = m.MessageType
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      m.CSR.Subject,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca, m.CSR.PublicKey, caKey)
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParseCertificate(der)
+	})
+	signer := scepserver.RenewalMiddleware(ca, scepserver.ChallengeMiddleware("secret", issue), issue)
+
+	server := httptest.NewUnstartedServer(scepserver.NewESTHandler([]*x509.Certificate{ca}, signer))
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	server.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: pool}
+	server.StartTLS()
+	defer server.Close()
+
+	certs := estRequest(t, server.Client(), "GET", server.URL+"/.well-known/est/cacerts", nil, "", http.StatusOK)
+	if len(certs) != 1 || !certs[0].Equal(ca) {
+		t.Fatal("cacerts did not return the CA certificate")
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "est device"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	estRequest(t, server.Client(), "POST", server.URL+"/.well-known/est/simpleenroll", csr, "wrong", http.StatusUnauthorized)
+	certs = estRequest(t, server.Client(), "POST", server.URL+"/.well-known/est/simpleenroll", csr, "secret", http.StatusOK)
+	if len(certs) != 1 || certs[0].Subject.CommonName != "est device" {
+		t.Fatal("simpleenroll did not return the issued certificate")
+	}
+	if lastType != scep.PKCSReq {
+		t.Errorf("simpleenroll signed as %s, want PKCSReq", lastType)
+	}
+
+	// reenrollment authenticates with the current certificate
+	estRequest(t, server.Client(), "POST", server.URL+"/.well-known/est/simplereenroll", csr, "", http.StatusUnauthorized)
+	transport := server.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{{
+		Certificate: [][]byte{certs[0].Raw},
+		PrivateKey:  key,
+	}}
+	client := &http.Client{Transport: transport}
+	certs = estRequest(t, client, "POST", server.URL+"/.well-known/est/simplereenroll", csr, "", http.StatusOK)
+	if len(certs) != 1 || certs[0].SerialNumber.Int64() != 2 {
+		t.Fatal("simplereenroll did not return a new certificate")
+	}
+	if lastType != scep.RenewalReq {
+		t.Errorf("simplereenroll signed as %s, want RenewalReq", lastType)
+	}
+}
+
+// estRequest sends an EST request with the base64 encoded csr and returns
+// the certificates of the response.
+func estRequest(t *testing.T, client *http.Client, method, url string, csr []byte, password string, status int) []*x509.Certificate {
+	t.Helper()
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(base64.StdEncoding.EncodeToString(csr)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/pkcs10")
+	if password != "" {
+		req.SetBasicAuth("device", password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != status {
+		t.Fatalf("%s: have status %d, want %d: %s", url, resp.StatusCode, status, body)
+	}
+	if status != http.StatusOK {
+		return nil
+	}
+	der, err := base64.StdEncoding.DecodeString(string(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p7, err := scep.ParseDegenerateP7(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p7.Certificates
+}
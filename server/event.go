@@ -0,0 +1,188 @@
+package scepserver
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// EventType is the type of an issuance Event.
+type EventType string
+
+const (
+	// EventIssued means a certificate was issued, by a PKIOperation or on
+	// approval of a pending request.
+	EventIssued EventType = "issued"
+	// EventFailed means an enrollment request was rejected.
+	EventFailed EventType = "failed"
+	// EventRevoked means a certificate was revoked with the admin API.
+	EventRevoked EventType = "revoked"
+)
+
+// DeviceIDMetadataKey is the key of the challenge metadata naming the
+// device of an Event, see challenge.WithMetadata.
+const DeviceIDMetadataKey = "device_id"
+
+// Event notifies systems like MDMs and CMDBs of the issuance, rejection or
+// revocation of a certificate.
+type Event struct {
+	Type          EventType          `json:"type"`
+	Time          time.Time          `json:"time"`
+	TransactionID scep.TransactionID `json:"transaction_id,omitempty"`
+
+	// Serial is the hex encoded serial number of the certificate. It is
+	// empty for failed requests.
+	Serial string `json:"serial,omitempty"`
+	// Subject is the subject of the certificate, or the one requested in
+	// the CSR of a failed request.
+	Subject  string     `json:"subject,omitempty"`
+	NotAfter *time.Time `json:"not_after,omitempty"`
+
+	// DeviceID is the DeviceIDMetadataKey value of Metadata, the
+	// metadata of the challenge of the request.
+	DeviceID string            `json:"device_id,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// FailInfo and Error are set for failed requests.
+	FailInfo string `json:"fail_info,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	// Reason is the RFC 5280 CRLReason of a revoked certificate.
+	Reason int `json:"reason,omitempty"`
+}
+
+// EventPublisher notifies other systems of Events. Publish is called while
+// handling the request, so publishers that may be slow, like webhooks,
+// should be wrapped with NewEventQueue. Publish must be safe for concurrent
+// use. Errors are logged and do not affect the response.
+type EventPublisher interface {
+	Publish(ctx context.Context, e Event) error
+}
+
+// EventPublisherFunc is an adapter for EventPublisher.
+type EventPublisherFunc func(context.Context, Event) error
+
+// Publish calls f(ctx, e).
+func (f EventPublisherFunc) Publish(ctx context.Context, e Event) error {
+	return f(ctx, e)
+}
+
+// newEvent returns the Event of type t for crt, issued or revoked, or for
+// the rejected request m if crt is nil.
+func newEvent(t EventType, id scep.TransactionID, m *scep.CSRReqMessage, crt *x509.Certificate) Event {
+	e := Event{Type: t, Time: time.Now().UTC(), TransactionID: id}
+	if m != nil {
+		if m.CSR != nil {
+			e.Subject = m.CSR.Subject.String()
+		}
+		e.Metadata = m.ChallengeMetadata
+		e.DeviceID = m.ChallengeMetadata[DeviceIDMetadataKey]
+	}
+	if crt != nil {
+		notAfter := crt.NotAfter.UTC()
+		e.Serial = fmt.Sprintf("%X", crt.SerialNumber)
+		e.Subject = crt.Subject.String()
+		e.NotAfter = &notAfter
+	}
+	return e
+}
+
+// failedEvent returns the EventFailed of the request m rejected with err.
+func failedEvent(id scep.TransactionID, m *scep.CSRReqMessage, err error) Event {
+	e := newEvent(EventFailed, id, m, nil)
+	e.FailInfo = failureOptions(err).FailInfo.String()
+	e.Error = err.Error()
+	return e
+}
+
+// publishEvent publishes e with each of publishers, logging their errors
+// to logger.
+func publishEvent(publishers []EventPublisher, logger log.Logger, e Event) {
+	for _, p := range publishers {
+		if err := p.Publish(context.Background(), e); err != nil {
+			logger.Log("msg", "failed to publish event", "type", e.Type, "serial", e.Serial, "err", err)
+		}
+	}
+}
+
+// ErrEventQueueFull is returned by EventQueue.Publish if the queue is full
+// or closed and the event was dropped.
+var ErrEventQueueFull = errors.New("event queue full")
+
+// EventQueue is an EventPublisher publishing Events in the background, in
+// order, with one goroutine. At most size Events wait to be published;
+// further Events are dropped, so a slow or unreachable publisher can
+// neither delay responses nor exhaust memory.
+type EventQueue struct {
+	publishers []EventPublisher
+	logger     log.Logger
+	events     chan Event
+	done       chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewEventQueue returns an EventQueue of size Events publishing with each
+// of publishers and logging their errors to logger. Close must be called
+// to publish the queued Events on shutdown.
+func NewEventQueue(size int, logger log.Logger, publishers ...EventPublisher) *EventQueue {
+	q := &EventQueue{
+		publishers: publishers,
+		logger:     logger,
+		events:     make(chan Event, size),
+		done:       make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+func (q *EventQueue) run() {
+	defer close(q.done)
+	for e := range q.events {
+		publishEvent(q.publishers, q.logger, e)
+	}
+}
+
+// Publish queues e without waiting for it to be published.
+func (q *EventQueue) Publish(_ context.Context, e Event) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrEventQueueFull
+	}
+	select {
+	case q.events <- e:
+		return nil
+	default:
+		return ErrEventQueueFull
+	}
+}
+
+// Close stops queueing Events and returns once the queued ones are
+// published.
+func (q *EventQueue) Close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.events)
+	}
+	q.mu.Unlock()
+	<-q.done
+}
+
+// WithEventPublisher notifies p of the certificates issued and the requests
+// rejected by PKIOperation. It may be given several times.
+func WithEventPublisher(p EventPublisher) ServiceOption {
+	return func(s *service) error {
+		s.publishers = append(s.publishers, p)
+		return nil
+	}
+}
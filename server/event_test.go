@@ -0,0 +1,45 @@
+package scepserver_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+
+	scepserver "github.com/micromdm/scep/v2/server"
+)
+
+func TestEventQueue(t *testing.T) {
+	release := make(chan struct{})
+	var published []string
+	q := scepserver.NewEventQueue(2, log.NewNopLogger(), scepserver.EventPublisherFunc(func(_ context.Context, e scepserver.Event) error {
+		<-release
+		published = append(published, e.Serial)
+		return nil
+	}))
+
+	// the first event blocks the publisher, two wait in the queue
+	var dropped int
+	for _, serial := range []string{"1", "2", "3", "4", "5"} {
+		err := q.Publish(context.Background(), scepserver.Event{Type: scepserver.EventIssued, Serial: serial})
+		if errors.Is(err, scepserver.ErrEventQueueFull) {
+			dropped++
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dropped < 2 {
+		t.Errorf("dropped %d events, want at least 2", dropped)
+	}
+	close(release)
+
+	// Close publishes the queued events
+	q.Close()
+	if len(published) != 5-dropped || published[0] != "1" {
+		t.Errorf("published %v, want the %d queued events in order", published, 5-dropped)
+	}
+	if err := q.Publish(context.Background(), scepserver.Event{}); err == nil {
+		t.Error("published after Close")
+	}
+}
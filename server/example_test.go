@@ -0,0 +1,60 @@
+package scepserver_test
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+	scepserver "github.com/micromdm/scep/v2/server"
+
+	"github.com/go-kit/kit/log"
+)
+
+func Example() {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Example SCEP CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	ca, _ := x509.ParseCertificate(der)
+
+	// issue a one year certificate for every CSR with the right challenge
+	var signer scepserver.CSRSigner = scepserver.CSRSignerFunc(func(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+		serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+		if err != nil {
+			return nil, err
+		}
+		crt := &x509.Certificate{
+			SerialNumber: serial,
+			Subject:      m.CSR.Subject,
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().AddDate(1, 0, 0),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, crt, ca, m.CSR.PublicKey, key)
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParseCertificate(der)
+	})
+	signer = scepserver.ChallengeMiddleware("secret", signer)
+
+	logger := log.NewNopLogger()
+	svc, _ := scepserver.NewService(ca, key, signer, scepserver.WithLogger(logger))
+	handler := scepserver.MakeHTTPHandler(scepserver.MakeServerEndpoints(svc), svc, logger)
+
+	http.Handle("/scep", handler)
+	// http.ListenAndServe(":8080", nil)
+}
@@ -0,0 +1,209 @@
+package scepserver
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+
+	"github.com/micromdm/scep/v2/depot"
+	"github.com/micromdm/scep/v2/metrics"
+)
+
+// EventExpiring is the reminder of an ExpiryMonitor that a certificate
+// nears expiry without having been renewed.
+const EventExpiring EventType = "expiring"
+
+// ExpiringCertificate is a certificate found by an ExpiryMonitor.
+type ExpiringCertificate struct {
+	Serial   string    `json:"serial"`
+	Subject  string    `json:"subject"`
+	DNSNames []string  `json:"dns_names,omitempty"`
+	NotAfter time.Time `json:"not_after"`
+}
+
+// ExpiryMonitor scans the certificates of a depot for the ones nearing
+// expiry, so fleets notice devices which stopped renewing. A certificate
+// is expiring if it is not revoked, expires within the window and no
+// certificate with the same subject expires after it.
+type ExpiryMonitor struct {
+	certs   depot.CertLister
+	revoked depot.RevocationLister
+	window  time.Duration
+
+	interval   time.Duration
+	publishers []EventPublisher
+	metrics    metrics.ExpiryMetrics
+	logger     log.Logger
+
+	mu       sync.Mutex
+	expiring []ExpiringCertificate
+	reminded map[string]bool
+
+	// replaced in tests
+	now func() time.Time
+}
+
+// ExpiryOption configures an ExpiryMonitor.
+type ExpiryOption func(*ExpiryMonitor)
+
+// WithExpiryInterval sets how often Run scans the depot, an hour by
+// default.
+func WithExpiryInterval(d time.Duration) ExpiryOption {
+	return func(m *ExpiryMonitor) {
+		m.interval = d
+	}
+}
+
+// WithExpiryPublisher reminds p of each expiring certificate with an
+// EventExpiring, once per certificate. It may be given several times.
+func WithExpiryPublisher(p EventPublisher) ExpiryOption {
+	return func(m *ExpiryMonitor) {
+		m.publishers = append(m.publishers, p)
+	}
+}
+
+// WithExpiryMetrics records the number of expiring certificates of every
+// scan with em.
+func WithExpiryMetrics(em metrics.ExpiryMetrics) ExpiryOption {
+	return func(m *ExpiryMonitor) {
+		m.metrics = em
+	}
+}
+
+// WithExpiryLogger sets the logger of the ExpiryMonitor.
+func WithExpiryLogger(logger log.Logger) ExpiryOption {
+	return func(m *ExpiryMonitor) {
+		m.logger = logger
+	}
+}
+
+// NewExpiryMonitor creates an ExpiryMonitor for the certificates of d
+// expiring within window. d must implement depot.CertLister; revoked
+// certificates are skipped if it implements depot.RevocationLister.
+func NewExpiryMonitor(d depot.Depot, window time.Duration, opts ...ExpiryOption) (*ExpiryMonitor, error) {
+	certs, ok := d.(depot.CertLister)
+	if !ok {
+		return nil, errors.New("expiry monitoring requires a depot listing its certificates")
+	}
+	if window <= 0 {
+		return nil, errors.New("expiry window must be positive")
+	}
+	m := &ExpiryMonitor{
+		certs:    certs,
+		window:   window,
+		interval: time.Hour,
+		logger:   log.NewNopLogger(),
+		reminded: make(map[string]bool),
+		now:      time.Now,
+	}
+	m.revoked, _ = d.(depot.RevocationLister)
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m, nil
+}
+
+// Run scans the depot every interval until ctx is done. Failed scans are
+// logged and retried at the next interval.
+func (m *ExpiryMonitor) Run(ctx context.Context) error {
+	for {
+		if _, err := m.Scan(); err != nil {
+			m.logger.Log("msg", "expiry scan failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(m.interval):
+		}
+	}
+}
+
+// Scan scans the depot now and returns the expiring certificates, soonest
+// first. The certificates expiring for the first time are reminded of with
+// the publishers.
+func (m *ExpiryMonitor) Scan() ([]ExpiringCertificate, error) {
+	certs, err := m.certs.Certs()
+	if err != nil {
+		return nil, fmt.Errorf("list certificates: %w", err)
+	}
+	revoked := make(map[string]bool)
+	if m.revoked != nil {
+		revocations, err := m.revoked.Revoked()
+		if err != nil {
+			return nil, fmt.Errorf("list revocations: %w", err)
+		}
+		for _, r := range revocations {
+			revoked[r.SerialNumber.String()] = true
+		}
+	}
+
+	// the last expiry of each subject, renewed certificates expire earlier
+	latest := make(map[string]*x509.Certificate)
+	for _, crt := range certs {
+		if revoked[crt.SerialNumber.String()] {
+			continue
+		}
+		subject := crt.Subject.String()
+		if l, ok := latest[subject]; !ok || crt.NotAfter.After(l.NotAfter) {
+			latest[subject] = crt
+		}
+	}
+	now := m.now()
+	expiring := []ExpiringCertificate{}
+	for subject, crt := range latest {
+		if crt.NotAfter.Before(now) || crt.NotAfter.After(now.Add(m.window)) {
+			continue
+		}
+		expiring = append(expiring, ExpiringCertificate{
+			Serial:   fmt.Sprintf("%X", crt.SerialNumber),
+			Subject:  subject,
+			DNSNames: crt.DNSNames,
+			NotAfter: crt.NotAfter.UTC(),
+		})
+	}
+	sort.Slice(expiring, func(i, j int) bool {
+		return expiring[i].NotAfter.Before(expiring[j].NotAfter)
+	})
+
+	var reminders []Event
+	m.mu.Lock()
+	m.expiring = expiring
+	reminded := make(map[string]bool, len(expiring))
+	for _, c := range expiring {
+		if !m.reminded[c.Serial] {
+			notAfter := c.NotAfter
+			reminders = append(reminders, Event{
+				Type:     EventExpiring,
+				Time:     now.UTC(),
+				Serial:   c.Serial,
+				Subject:  c.Subject,
+				NotAfter: &notAfter,
+			})
+		}
+		reminded[c.Serial] = true
+	}
+	m.reminded = reminded
+	m.mu.Unlock()
+
+	for _, e := range reminders {
+		publishEvent(m.publishers, m.logger, e)
+	}
+	if m.metrics != nil {
+		m.metrics.CertificatesExpiring(len(expiring))
+	}
+	return expiring, nil
+}
+
+// Expiring returns the expiring certificates of the last scan, soonest
+// first.
+func (m *ExpiryMonitor) Expiring() []ExpiringCertificate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]ExpiringCertificate{}, m.expiring...)
+}
@@ -0,0 +1,107 @@
+package scepserver_test
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/depot"
+	scepserver "github.com/micromdm/scep/v2/server"
+)
+
+// listingDepot is a depot listing certs and revoked.
+type listingDepot struct {
+	depot.Depot
+	certs   []*x509.Certificate
+	revoked []depot.Revocation
+}
+
+func (d *listingDepot) Certs() ([]*x509.Certificate, error)  { return d.certs, nil }
+func (d *listingDepot) Revoked() ([]depot.Revocation, error) { return d.revoked, nil }
+
+type expiryGauge int
+
+func (g *expiryGauge) CertificatesExpiring(n int) { *g = expiryGauge(n) }
+
+func TestExpiryMonitor(t *testing.T) {
+	now := time.Now()
+	cert := func(serial int64, cn string, notAfter time.Duration) *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: cn},
+			NotAfter:     now.Add(notAfter),
+		}
+	}
+	day := 24 * time.Hour
+	d := &listingDepot{
+		certs: []*x509.Certificate{
+			cert(1, "laptop-1", 2*day),
+			cert(2, "laptop-2", 2*day),
+			cert(3, "laptop-2", 300*day), // renewed
+			cert(4, "phone-1", day),      // revoked
+			cert(5, "phone-2", 100*day),
+			cert(6, "phone-3", -day), // expired
+			cert(7, "phone-4", 10*day),
+		},
+		revoked: []depot.Revocation{{SerialNumber: big.NewInt(4)}},
+	}
+	events := make(chan scepserver.Event, 10)
+	var gauge expiryGauge
+	m, err := scepserver.NewExpiryMonitor(d, 30*day,
+		scepserver.WithExpiryMetrics(&gauge),
+		scepserver.WithExpiryPublisher(scepserver.EventPublisherFunc(func(_ context.Context, e scepserver.Event) error {
+			events <- e
+			return nil
+		})),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiring, err := m.Scan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expiring) != 2 || expiring[0].Serial != "1" || expiring[1].Serial != "7" || expiring[0].Subject != "CN=laptop-1" {
+		t.Errorf("have expiring certificates %+v, want serials 1 and 7", expiring)
+	}
+	if gauge != 2 {
+		t.Errorf("have gauge %d, want 2", gauge)
+	}
+	if have := m.Expiring(); len(have) != 2 {
+		t.Errorf("have %d certificates of the last scan, want 2", len(have))
+	}
+
+	// certificates are reminded of once
+	d.certs = append(d.certs, cert(8, "laptop-3", 5*day))
+	if _, err := m.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	reminded := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		select {
+		case e := <-events:
+			if e.Type != scepserver.EventExpiring || e.NotAfter == nil {
+				t.Errorf("unexpected event %+v", e)
+			}
+			reminded[e.Serial] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("missing reminder")
+		}
+	}
+	if !reminded["1"] || !reminded["7"] || !reminded["8"] {
+		t.Errorf("have reminders of %v, want 1, 7 and 8", reminded)
+	}
+	select {
+	case e := <-events:
+		t.Errorf("unexpected second reminder %+v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err := scepserver.NewExpiryMonitor(struct{ depot.Depot }{}, day); err == nil {
+		t.Error("expected an error for a depot not listing certificates")
+	}
+}
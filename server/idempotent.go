@@ -0,0 +1,48 @@
+package scepserver
+
+import (
+	"crypto/x509"
+	"errors"
+
+	"github.com/micromdm/scep/v2/depot"
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// IdempotentMiddleware wraps next in a CSRSigner which stores the
+// certificates signed by next as issued transactions in store. A request
+// resent by a client with the transactionID and CSR of a stored
+// transaction is answered with its certificate instead of signing a second
+// one, for DefaultTransactionTTL or the TTL of WithTransactionTTL and
+// unless the certificate expired or was revoked. Such requests are marked
+// Replayed, so the service does not report the issuance again. Other
+// requests for the same key, e.g. renewals, are signed by next.
+// Transactions held PENDING by a ManualApproval in store are answered like
+// the ManualApproval does.
+//
+// The middleware must wrap the challenge checks, as the challenge of a
+// resent request may already have been used.
+func IdempotentMiddleware(store depot.TransactionStore, next CSRSigner, opts ...TransactionOption) CSRSignerFunc {
+	policy := newTransactionPolicy(opts)
+	return func(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+		if m.TransactionID == "" {
+			return next.SignCSR(m)
+		}
+		t, err := store.Transaction(m.TransactionID)
+		if err == nil {
+			if crt, ok, err := policy.resent(m, t); ok {
+				return crt, err
+			}
+		} else if !errors.Is(err, depot.ErrTransactionNotFound) {
+			return nil, err
+		}
+		crt, err := next.SignCSR(m)
+		if err != nil || crt == nil {
+			return crt, err
+		}
+		if t, err = newTransaction(m, depot.TransactionIssued); err != nil {
+			return nil, err
+		}
+		t.Certificate = crt.Raw
+		return crt, store.SaveTransaction(t)
+	}
+}
@@ -0,0 +1,168 @@
+package scepserver
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/depot"
+	"github.com/micromdm/scep/v2/scep"
+)
+
+func TestIdempotentMiddleware(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newMessage := func(id scep.TransactionID, key *rsa.PrivateKey) *scep.CSRReqMessage {
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "device"}}, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &scep.CSRReqMessage{RawDecrypted: der, CSR: csr, TransactionID: id, MessageType: scep.PKCSReq}
+	}
+
+	var signed int64
+	next := CSRSignerFunc(func(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+		if m.ChallengePassword == "used" {
+			return nil, ErrInvalidChallenge
+		}
+		signed++
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(signed),
+			NotBefore:    time.Now(),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, m.CSR.PublicKey, key)
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParseCertificate(der)
+	})
+	store := depot.NewTransactionStore()
+	signer := IdempotentMiddleware(store, next)
+
+	first, err := signer.SignCSR(newMessage("tx-1", key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the retry is answered with the first certificate, even though its
+	// challenge was used by the first request
+	retry := newMessage("tx-1", key)
+	retry.ChallengePassword = "used"
+	crt, err := signer.SignCSR(retry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !crt.Equal(first) || signed != 1 {
+		t.Errorf("retry signed certificate %s, want %s", crt.SerialNumber, first.SerialNumber)
+	}
+	if !retry.Replayed {
+		t.Error("retry not marked as replayed")
+	}
+	if tx, err := store.Transaction("tx-1"); err != nil || tx.Status != depot.TransactionIssued {
+		t.Errorf("have transaction %v, err %v, want issued", tx, err)
+	}
+
+	var fiErr *FailInfoError
+	if _, err := signer.SignCSR(newMessage("tx-1", otherKey)); !errors.As(err, &fiErr) || fiErr.FailInfo != scep.BadRequest {
+		t.Errorf("want badRequest for another key, have %v", err)
+	}
+
+	// failures are not stored
+	failed := newMessage("tx-2", key)
+	failed.ChallengePassword = "used"
+	if _, err := signer.SignCSR(failed); !errors.Is(err, ErrInvalidChallenge) {
+		t.Fatalf("want ErrInvalidChallenge, have %v", err)
+	}
+	if _, err := signer.SignCSR(newMessage("tx-2", key)); err != nil || signed != 2 {
+		t.Errorf("have %d signed, err %v, want 2", signed, err)
+	}
+}
+
+type revocationList []depot.Revocation
+
+func (l *revocationList) Revoked() ([]depot.Revocation, error) { return *l, nil }
+
+func TestIdempotentMiddlewareRenewal(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "device"}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newMessage := func(typ scep.MessageType) *scep.CSRReqMessage {
+		return &scep.CSRReqMessage{RawDecrypted: der, CSR: csr, TransactionID: "tx-1", MessageType: typ}
+	}
+
+	var signed int64
+	validity := -time.Minute
+	next := CSRSignerFunc(func(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+		signed++
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(signed),
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(validity),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, m.CSR.PublicKey, key)
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParseCertificate(der)
+	})
+	revoked := &revocationList{}
+	signer := IdempotentMiddleware(depot.NewTransactionStore(), next, WithTransactionRevocations(revoked))
+
+	if _, err := signer.SignCSR(newMessage(scep.PKCSReq)); err != nil {
+		t.Fatal(err)
+	}
+	// the certificate expired, so the renewal with the same key and CSR is
+	// signed again
+	validity = time.Hour
+	renewed, err := signer.SignCSR(newMessage(scep.RenewalReq))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed != 2 || renewed.SerialNumber.Int64() != 2 {
+		t.Fatalf("have %d signed, want the renewal signed", signed)
+	}
+	if crt, err := signer.SignCSR(newMessage(scep.RenewalReq)); err != nil || !crt.Equal(renewed) {
+		t.Errorf("resent renewal not answered with its certificate, err %v", err)
+	}
+
+	// revoked certificates are not handed out again
+	*revoked = append(*revoked, depot.Revocation{SerialNumber: renewed.SerialNumber})
+	if _, err := signer.SignCSR(newMessage(scep.RenewalReq)); err != nil || signed != 3 {
+		t.Errorf("have %d signed, err %v, want the request of a revoked certificate signed again", signed, err)
+	}
+
+	// transactions expire after the TTL
+	signer = IdempotentMiddleware(depot.NewTransactionStore(), next, WithTransactionTTL(0))
+	for i := 0; i < 2; i++ {
+		if _, err := signer.SignCSR(newMessage(scep.PKCSReq)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if signed != 5 {
+		t.Errorf("have %d signed, want the request signed again after the TTL", signed)
+	}
+}
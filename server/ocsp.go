@@ -0,0 +1,192 @@
+package scepserver
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/micromdm/scep/v2/depot"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspHashes are the hashes of the CertIDs the OCSPResponder answers.
+var ocspHashes = []crypto.Hash{crypto.SHA1, crypto.SHA256, crypto.SHA384, crypto.SHA512}
+
+// OCSPResponder is an http.Handler answering RFC 6960 OCSP requests for
+// certificates issued by a CA with the revocation state of a depot.
+// Requests are accepted as POST bodies or base64 encoded in the path of
+// GET requests, which must have the mount prefix stripped, e.g. with
+// http.StripPrefix. Requests and responses are handled by
+// golang.org/x/crypto/ocsp, which answers the first certificate of a
+// request and does not echo nonces.
+type OCSPResponder struct {
+	ca       *x509.Certificate
+	key      crypto.Signer
+	revoked  depot.RevocationLister
+	certs    depot.CertGetter
+	validity time.Duration
+
+	nameHash map[crypto.Hash][]byte
+	keyHash  map[crypto.Hash][]byte
+}
+
+// OCSPOption configures an OCSPResponder.
+type OCSPOption func(*OCSPResponder)
+
+// WithOCSPCertGetter answers unknown instead of good for certificates which
+// were not issued according to certs.
+func WithOCSPCertGetter(certs depot.CertGetter) OCSPOption {
+	return func(r *OCSPResponder) {
+		r.certs = certs
+	}
+}
+
+// WithOCSPValidity sets the time until the nextUpdate of the responses.
+// The default is one hour.
+func WithOCSPValidity(validity time.Duration) OCSPOption {
+	return func(r *OCSPResponder) {
+		r.validity = validity
+	}
+}
+
+// NewOCSPResponder creates an OCSPResponder for certificates issued by ca,
+// signing the responses with its key. Certificates listed by revoked are
+// reported as revoked.
+func NewOCSPResponder(ca *x509.Certificate, key crypto.Signer, revoked depot.RevocationLister, opts ...OCSPOption) (*OCSPResponder, error) {
+	r := &OCSPResponder{
+		ca:       ca,
+		key:      key,
+		revoked:  revoked,
+		validity: time.Hour,
+		nameHash: make(map[crypto.Hash][]byte),
+		keyHash:  make(map[crypto.Hash][]byte),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	switch key.Public().(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported OCSP signing key %T", key.Public())
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(ca.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, err
+	}
+	for _, hash := range ocspHashes {
+		if !hash.Available() {
+			continue
+		}
+		h := hash.New()
+		h.Write(ca.RawSubject)
+		r.nameHash[hash] = h.Sum(nil)
+		h = hash.New()
+		h.Write(spki.PublicKey.RightAlign())
+		r.keyHash[hash] = h.Sum(nil)
+	}
+	return r, nil
+}
+
+func (r *OCSPResponder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var (
+		der []byte
+		err error
+	)
+	switch req.Method {
+	case http.MethodGet:
+		der, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(req.URL.Path, "/"))
+	case http.MethodPost:
+		der, err = ioutil.ReadAll(io.LimitReader(req.Body, maxPayloadSize))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	resp, err := r.Respond(der)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(resp)
+}
+
+// Respond returns the DER encoded OCSP response to the DER encoded OCSP
+// request der. Malformed requests and depot errors are answered with the
+// malformedRequest and internalError response status.
+func (r *OCSPResponder) Respond(der []byte) ([]byte, error) {
+	req, err := ocsp.ParseRequest(der)
+	if err != nil {
+		return ocsp.MalformedRequestErrorResponse, nil
+	}
+	resp, err := r.respond(req)
+	if err != nil {
+		return ocsp.InternalErrorErrorResponse, nil
+	}
+	return resp, nil
+}
+
+func (r *OCSPResponder) respond(req *ocsp.Request) ([]byte, error) {
+	status, err := r.status(req)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	status.SerialNumber = req.SerialNumber
+	status.IssuerHash = req.HashAlgorithm
+	status.ThisUpdate = now
+	status.NextUpdate = now.Add(r.validity)
+	return ocsp.CreateResponse(r.ca, r.ca, status, r.key)
+}
+
+// status returns the certificate status of the certificate of req.
+func (r *OCSPResponder) status(req *ocsp.Request) (ocsp.Response, error) {
+	if req.SerialNumber == nil ||
+		!bytes.Equal(req.IssuerNameHash, r.nameHash[req.HashAlgorithm]) ||
+		!bytes.Equal(req.IssuerKeyHash, r.keyHash[req.HashAlgorithm]) {
+		return ocsp.Response{Status: ocsp.Unknown}, nil
+	}
+	revocations, err := r.revoked.Revoked()
+	if err != nil {
+		return ocsp.Response{}, err
+	}
+	for _, rev := range revocations {
+		if rev.SerialNumber.Cmp(req.SerialNumber) == 0 {
+			return ocsp.Response{
+				Status:           ocsp.Revoked,
+				RevokedAt:        rev.RevokedAt,
+				RevocationReason: rev.Reason,
+			}, nil
+		}
+	}
+	if r.certs != nil {
+		_, err := r.certs.GetCert(req.SerialNumber)
+		if errors.Is(err, depot.ErrCertNotFound) {
+			return ocsp.Response{Status: ocsp.Unknown}, nil
+		}
+		if err != nil {
+			return ocsp.Response{}, err
+		}
+	}
+	return ocsp.Response{Status: ocsp.Good}, nil
+}
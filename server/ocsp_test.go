@@ -0,0 +1,146 @@
+package scepserver
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/depot"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+type ocspTestDepot struct {
+	revoked []depot.Revocation
+	issued  map[string]bool
+}
+
+func (d *ocspTestDepot) Revoked() ([]depot.Revocation, error) {
+	return d.revoked, nil
+}
+
+func (d *ocspTestDepot) GetCert(serial *big.Int) (*x509.Certificate, error) {
+	if !d.issued[serial.String()] {
+		return nil, depot.ErrCertNotFound
+	}
+	return &x509.Certificate{SerialNumber: serial}, nil
+}
+
+func newOCSPRequest(t *testing.T, ca *x509.Certificate, hash crypto.Hash, serial int64) []byte {
+	t.Helper()
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(ca.RawSubjectPublicKeyInfo, &spki); err != nil {
+		t.Fatal(err)
+	}
+	h := hash.New()
+	h.Write(ca.RawSubject)
+	nameHash := h.Sum(nil)
+	h = hash.New()
+	h.Write(spki.PublicKey.RightAlign())
+	req := &ocsp.Request{
+		HashAlgorithm:  hash,
+		IssuerNameHash: nameHash,
+		IssuerKeyHash:  h.Sum(nil),
+		SerialNumber:   big.NewInt(serial),
+	}
+	der, err := req.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestOCSPResponder(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caDER, err := depot.NewCACert().SelfSign(rand.Reader, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedAt := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	d := &ocspTestDepot{
+		revoked: []depot.Revocation{{SerialNumber: big.NewInt(3), RevokedAt: revokedAt, Reason: 1}},
+		issued:  map[string]bool{"2": true, "3": true},
+	}
+	responder, err := NewOCSPResponder(ca, key, d, WithOCSPCertGetter(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.StripPrefix("/ocsp", responder))
+	defer server.Close()
+
+	for _, test := range []struct {
+		method string
+		hash   crypto.Hash
+		serial int64
+		status int
+	}{
+		{"GET", crypto.SHA1, 2, ocsp.Good},
+		{"POST", crypto.SHA1, 3, ocsp.Revoked},
+		{"POST", crypto.SHA256, 4, ocsp.Unknown},
+		{"GET", crypto.SHA256, 2, ocsp.Good},
+	} {
+		req := newOCSPRequest(t, ca, test.hash, test.serial)
+		var resp *http.Response
+		if test.method == "GET" {
+			resp, err = http.Get(server.URL + "/ocsp/" + base64.StdEncoding.EncodeToString(req))
+		} else {
+			resp, err = http.Post(server.URL+"/ocsp", "application/ocsp-request", bytes.NewReader(req))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, want := resp.Header.Get("Content-Type"), "application/ocsp-response"; have != want {
+			t.Errorf("have Content-Type %q, want %q", have, want)
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// ParseResponse verifies the signature of the CA
+		parsed, err := ocsp.ParseResponse(body, ca)
+		if err != nil {
+			t.Fatalf("serial %d: %v", test.serial, err)
+		}
+		if parsed.Status != test.status || parsed.SerialNumber.Int64() != test.serial || parsed.IssuerHash != test.hash {
+			t.Errorf("serial %d: have status %d for serial %d with %v, want %d", test.serial, parsed.Status, parsed.SerialNumber, parsed.IssuerHash, test.status)
+		}
+		if parsed.NextUpdate.Sub(parsed.ThisUpdate) != time.Hour {
+			t.Errorf("serial %d: have validity %v, want 1h", test.serial, parsed.NextUpdate.Sub(parsed.ThisUpdate))
+		}
+		if test.status == ocsp.Revoked && (!parsed.RevokedAt.Equal(revokedAt) || parsed.RevocationReason != 1) {
+			t.Errorf("have revocation at %v with reason %d, want %v with reason 1", parsed.RevokedAt, parsed.RevocationReason, revokedAt)
+		}
+	}
+
+	resp, err := responder.Respond([]byte("not a request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var respErr ocsp.ResponseError
+	if _, err := ocsp.ParseResponse(resp, ca); !errors.As(err, &respErr) || respErr.Status != ocsp.Malformed {
+		t.Errorf("have error %v, want a malformed request response", err)
+	}
+}
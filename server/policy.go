@@ -0,0 +1,330 @@
+package scepserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/micromdm/scep/v2/cryptoutil/x509util"
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// SigningPolicy decides whether the CSR of a request may be signed.
+type SigningPolicy interface {
+	// Evaluate returns an error describing the violation if the CSR of m
+	// must not be signed.
+	Evaluate(m *scep.CSRReqMessage) error
+}
+
+// SigningPolicyFunc is an adapter to use a function as a SigningPolicy.
+type SigningPolicyFunc func(*scep.CSRReqMessage) error
+
+// Evaluate calls f(m)
+func (f SigningPolicyFunc) Evaluate(m *scep.CSRReqMessage) error {
+	return f(m)
+}
+
+// CertificatePolicy is implemented by SigningPolicies which also constrain
+// the signed certificate, e.g. its validity.
+type CertificatePolicy interface {
+	EvaluateCertificate(crt *x509.Certificate) error
+}
+
+// PolicyMiddleware wraps next in a CSRSigner that only signs CSRs allowed
+// by policy. Rejected CSRs are reported with the badRequest failInfo. If
+// policy is a CertificatePolicy the certificate signed by next is checked
+// as well; note that next may already have stored a rejected certificate.
+func PolicyMiddleware(policy SigningPolicy, next CSRSigner) CSRSignerFunc {
+	return func(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+		if err := policy.Evaluate(m); err != nil {
+			return nil, &FailInfoError{
+				FailInfo: scep.BadRequest,
+				Err:      fmt.Errorf("signing policy: %w", err),
+			}
+		}
+		crt, err := next.SignCSR(m)
+		if err != nil || crt == nil {
+			return crt, err
+		}
+		if cp, ok := policy.(CertificatePolicy); ok {
+			if err := cp.EvaluateCertificate(crt); err != nil {
+				return nil, &FailInfoError{
+					FailInfo: scep.BadRequest,
+					Err:      fmt.Errorf("signing policy: %w", err),
+				}
+			}
+		}
+		return crt, nil
+	}
+}
+
+// PolicyConfig is the declarative form of a Policy, e.g. loaded from JSON
+// with LoadPolicy. Omitted fields do not constrain the requests; an empty
+// allow-list, [] in JSON, refuses all SANs of its type.
+type PolicyConfig struct {
+	// SubjectPatterns are regular expressions of which one must match the
+	// CSR subject, formatted like "CN=device,O=Example".
+	SubjectPatterns []string `json:"subject_patterns,omitempty"`
+	// DNSNames allow-lists the DNS SANs. A leading "*." matches any
+	// subdomain.
+	DNSNames []string `json:"dns_names,omitempty"`
+	// EmailAddresses allow-lists the email SANs. An entry starting with
+	// "@" matches any address of the domain.
+	EmailAddresses []string `json:"email_addresses,omitempty"`
+	// IPRanges allow-lists the IP SANs in CIDR notation.
+	IPRanges []string `json:"ip_ranges,omitempty"`
+	// URIPrefixes allow-lists the URI SANs by prefix.
+	URIPrefixes []string `json:"uri_prefixes,omitempty"`
+	// MaxValidity is the maximum validity of the signed certificates, a
+	// time.ParseDuration string like "8760h".
+	MaxValidity string `json:"max_validity,omitempty"`
+	// KeyAlgorithms allow-lists the CSR key algorithms: "RSA", "ECDSA" or
+	// "Ed25519".
+	KeyAlgorithms []string `json:"key_algorithms,omitempty"`
+	// MinRSAKeySize is the minimum size of RSA keys in bits.
+	MinRSAKeySize int `json:"min_rsa_key_size,omitempty"`
+	// ECDSACurves allow-lists the curves of ECDSA keys, e.g. "P-256".
+	ECDSACurves []string `json:"ecdsa_curves,omitempty"`
+	// ExtKeyUsages allow-lists the extended key usages requested in the
+	// CSR by their RFC 5280 names, e.g. "clientAuth" or "smartcardLogon",
+	// or OIDs, e.g. "1.3.6.1.5.5.7.3.2".
+	ExtKeyUsages []string `json:"ext_key_usages,omitempty"`
+}
+
+// Policy is a SigningPolicy and CertificatePolicy compiled from a
+// PolicyConfig.
+type Policy struct {
+	subjects       []*regexp.Regexp
+	dnsNames       []string
+	emailAddresses []string
+	ipRanges       []*net.IPNet
+	uriPrefixes    []string
+	maxValidity    time.Duration
+	keyAlgorithms  []string
+	minRSAKeySize  int
+	ecdsaCurves    []string
+	extKeyUsages   []asn1.ObjectIdentifier
+}
+
+// NewPolicy compiles cfg.
+func NewPolicy(cfg PolicyConfig) (*Policy, error) {
+	p := &Policy{
+		dnsNames:       cfg.DNSNames,
+		emailAddresses: cfg.EmailAddresses,
+		uriPrefixes:    cfg.URIPrefixes,
+		minRSAKeySize:  cfg.MinRSAKeySize,
+		ecdsaCurves:    cfg.ECDSACurves,
+	}
+	for _, pattern := range cfg.SubjectPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("subject pattern %q: %w", pattern, err)
+		}
+		p.subjects = append(p.subjects, re)
+	}
+	if cfg.IPRanges != nil {
+		p.ipRanges = []*net.IPNet{}
+	}
+	for _, cidr := range cfg.IPRanges {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("IP range %q: %w", cidr, err)
+		}
+		p.ipRanges = append(p.ipRanges, ipNet)
+	}
+	if cfg.MaxValidity != "" {
+		d, err := time.ParseDuration(cfg.MaxValidity)
+		if err != nil {
+			return nil, fmt.Errorf("max validity: %w", err)
+		}
+		p.maxValidity = d
+	}
+	for _, alg := range cfg.KeyAlgorithms {
+		switch alg {
+		case "RSA", "ECDSA", "Ed25519":
+		default:
+			return nil, fmt.Errorf("unknown key algorithm %q", alg)
+		}
+		p.keyAlgorithms = append(p.keyAlgorithms, alg)
+	}
+	if cfg.ExtKeyUsages != nil {
+		p.extKeyUsages = []asn1.ObjectIdentifier{}
+	}
+	for _, name := range cfg.ExtKeyUsages {
+		oid, err := x509util.ParseExtKeyUsageOID(name)
+		if err != nil {
+			return nil, err
+		}
+		p.extKeyUsages = append(p.extKeyUsages, oid)
+	}
+	return p, nil
+}
+
+// LoadPolicy reads a JSON encoded PolicyConfig from r and compiles it.
+// Unknown fields are rejected so that misspelled constraints are not
+// silently ignored.
+func LoadPolicy(r io.Reader) (*Policy, error) {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var cfg PolicyConfig
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("decode signing policy: %w", err)
+	}
+	return NewPolicy(cfg)
+}
+
+// Evaluate implements SigningPolicy.
+func (p *Policy) Evaluate(m *scep.CSRReqMessage) error {
+	csr := m.CSR
+	if csr == nil {
+		return errors.New("no CSR")
+	}
+	if len(p.subjects) > 0 && !matchesAny(p.subjects, csr.Subject.String()) {
+		return fmt.Errorf("subject %q not allowed", csr.Subject)
+	}
+	for _, name := range csr.DNSNames {
+		if p.dnsNames != nil && !allowedDNSName(p.dnsNames, name) {
+			return fmt.Errorf("DNS name %q not allowed", name)
+		}
+	}
+	for _, email := range csr.EmailAddresses {
+		if p.emailAddresses != nil && !allowedEmail(p.emailAddresses, email) {
+			return fmt.Errorf("email address %q not allowed", email)
+		}
+	}
+	for _, ip := range csr.IPAddresses {
+		if p.ipRanges != nil && !allowedIP(p.ipRanges, ip) {
+			return fmt.Errorf("IP address %s not allowed", ip)
+		}
+	}
+	for _, uri := range csr.URIs {
+		if p.uriPrefixes != nil && !hasAnyPrefix(p.uriPrefixes, uri.String()) {
+			return fmt.Errorf("URI %q not allowed", uri)
+		}
+	}
+	if p.extKeyUsages != nil {
+		oids, err := x509util.RequestedExtKeyUsage(csr)
+		if err != nil {
+			return err
+		}
+		for _, oid := range oids {
+			if !containsOID(p.extKeyUsages, oid) {
+				return fmt.Errorf("extended key usage %s not allowed", oid)
+			}
+		}
+	}
+	return p.evaluateKey(csr.PublicKey)
+}
+
+func (p *Policy) evaluateKey(pub interface{}) error {
+	keyPolicy := KeyPolicy{MinRSAKeySize: p.minRSAKeySize, ECDSACurves: p.ecdsaCurves}
+	if err := keyPolicy.Check(pub); err != nil {
+		return err
+	}
+	var alg string
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		alg = "RSA"
+	case *ecdsa.PublicKey:
+		alg = "ECDSA"
+	case ed25519.PublicKey:
+		alg = "Ed25519"
+	}
+	if len(p.keyAlgorithms) > 0 && !contains(p.keyAlgorithms, alg) {
+		return fmt.Errorf("key algorithm %s not allowed", alg)
+	}
+	return nil
+}
+
+// EvaluateCertificate implements CertificatePolicy.
+func (p *Policy) EvaluateCertificate(crt *x509.Certificate) error {
+	if validity := crt.NotAfter.Sub(crt.NotBefore); p.maxValidity > 0 && validity > p.maxValidity {
+		return fmt.Errorf("validity %s exceeds maximum %s", validity, p.maxValidity)
+	}
+	return nil
+}
+
+func matchesAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+func allowedDNSName(allowed []string, name string) bool {
+	name = strings.ToLower(name)
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if strings.HasPrefix(a, "*.") {
+			if strings.HasSuffix(name, a[1:]) && len(name) > len(a)-1 {
+				return true
+			}
+		} else if name == a {
+			return true
+		}
+	}
+	return false
+}
+
+func allowedEmail(allowed []string, email string) bool {
+	email = strings.ToLower(email)
+	for _, a := range allowed {
+		a = strings.ToLower(a)
+		if strings.HasPrefix(a, "@") {
+			if strings.HasSuffix(email, a) {
+				return true
+			}
+		} else if email == a {
+			return true
+		}
+	}
+	return false
+}
+
+func allowedIP(ranges []*net.IPNet, ip net.IP) bool {
+	for _, r := range ranges {
+		if r.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAnyPrefix(prefixes []string, s string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsOID(list []asn1.ObjectIdentifier, oid asn1.ObjectIdentifier) bool {
+	for _, l := range list {
+		if l.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
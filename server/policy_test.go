@@ -0,0 +1,129 @@
+package scepserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+const testPolicy = `{
+	"subject_patterns": ["^CN=[a-z0-9-]+,O=Example$"],
+	"dns_names": ["*.example.com"],
+	"email_addresses": ["@example.com"],
+	"ip_ranges": [],
+	"uri_prefixes": ["urn:device:"],
+	"max_validity": "8760h",
+	"key_algorithms": ["RSA", "ECDSA"],
+	"min_rsa_key_size": 2048,
+	"ecdsa_curves": ["P-256"],
+	"ext_key_usages": ["clientAuth", "1.3.6.1.4.1.311.20.2.2"]
+}`
+
+func TestPolicy(t *testing.T) {
+	policy, err := LoadPolicy(strings.NewReader(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smallKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject := pkix.Name{CommonName: "device-1", Organization: []string{"Example"}}
+	uri, _ := url.Parse("urn:device:1")
+	otherURI, _ := url.Parse("https://example.com")
+	eku := func(oids ...asn1.ObjectIdentifier) []pkix.Extension {
+		value, err := asn1.Marshal(oids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []pkix.Extension{{Id: asn1.ObjectIdentifier{2, 5, 29, 37}, Value: value}}
+	}
+	clientAuth := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 2}
+	serverAuth := asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 3, 1}
+	smartcardLogon := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 2}
+
+	for _, test := range []struct {
+		testName string
+		csr      x509.CertificateRequest
+		allowed  bool
+	}{
+		{"allowed", x509.CertificateRequest{
+			Subject:        subject,
+			DNSNames:       []string{"device-1.example.com"},
+			EmailAddresses: []string{"admin@example.com"},
+			URIs:           []*url.URL{uri},
+			PublicKey:      &rsaKey.PublicKey,
+		}, true},
+		{"subject", x509.CertificateRequest{Subject: pkix.Name{CommonName: "device-1"}, PublicKey: &rsaKey.PublicKey}, false},
+		{"DNS name", x509.CertificateRequest{Subject: subject, DNSNames: []string{"example.com"}, PublicKey: &rsaKey.PublicKey}, false},
+		{"email", x509.CertificateRequest{Subject: subject, EmailAddresses: []string{"a@example.org"}, PublicKey: &rsaKey.PublicKey}, false},
+		{"empty IP allow-list", x509.CertificateRequest{Subject: subject, IPAddresses: []net.IP{net.IPv4(192, 0, 2, 1)}, PublicKey: &rsaKey.PublicKey}, false},
+		{"URI", x509.CertificateRequest{Subject: subject, URIs: []*url.URL{otherURI}, PublicKey: &rsaKey.PublicKey}, false},
+		{"RSA key size", x509.CertificateRequest{Subject: subject, PublicKey: &smallKey.PublicKey}, false},
+		{"ECDSA curve", x509.CertificateRequest{Subject: subject, PublicKey: &p384Key.PublicKey}, false},
+		{"extended key usages", x509.CertificateRequest{Subject: subject, Extensions: eku(clientAuth, smartcardLogon), PublicKey: &rsaKey.PublicKey}, true},
+		{"extended key usage", x509.CertificateRequest{Subject: subject, Extensions: eku(clientAuth, serverAuth), PublicKey: &rsaKey.PublicKey}, false},
+	} {
+		test := test
+		t.Run(test.testName, func(t *testing.T) {
+			t.Parallel()
+			err := policy.Evaluate(&scep.CSRReqMessage{CSR: &test.csr})
+			if have, want := err == nil, test.allowed; have != want {
+				t.Errorf("have allowed %v, want %v: %v", have, want, err)
+			}
+		})
+	}
+}
+
+func TestPolicyMiddleware(t *testing.T) {
+	policy, err := NewPolicy(PolicyConfig{MaxValidity: "24h", KeyAlgorithms: []string{"ECDSA"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	validity := 48 * time.Hour
+	signer := PolicyMiddleware(policy, CSRSignerFunc(func(*scep.CSRReqMessage) (*x509.Certificate, error) {
+		now := time.Now()
+		return &x509.Certificate{NotBefore: now, NotAfter: now.Add(validity)}, nil
+	}))
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &scep.CSRReqMessage{CSR: &x509.CertificateRequest{PublicKey: &key.PublicKey}}
+
+	var fiErr *FailInfoError
+	if _, err := signer.SignCSR(m); !errors.As(err, &fiErr) || fiErr.FailInfo != scep.BadRequest {
+		t.Errorf("want badRequest for a certificate exceeding the max validity, have %v", err)
+	}
+	validity = time.Hour
+	if crt, err := signer.SignCSR(m); err != nil || crt == nil {
+		t.Errorf("certificate within the policy rejected: %v", err)
+	}
+
+	if _, err := NewPolicy(PolicyConfig{KeyAlgorithms: []string{"DSA"}}); err == nil {
+		t.Error("unknown key algorithm accepted")
+	}
+	if _, err := LoadPolicy(strings.NewReader(`{"max_validty": "1h"}`)); err == nil {
+		t.Error("unknown policy field accepted")
+	}
+}
@@ -0,0 +1,218 @@
+package scepserver
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxChallengeBackoff caps the exponential backoff after repeated
+// challenge failures.
+const maxChallengeBackoff = time.Hour
+
+// RateLimiter limits PKIOperation requests by key, the client IP or the
+// transactionID of a request, and slows down challenge guessing by backing
+// off exponentially after consecutive challenge failures.
+type RateLimiter interface {
+	// Allow records a request for key. It returns zero if the request is
+	// allowed and the time to wait before retrying otherwise.
+	Allow(key string) (time.Duration, error)
+	// ChallengeFailed records a rejected challenge password for key.
+	ChallengeFailed(key string) error
+	// ChallengeSucceeded resets the challenge failures of key.
+	ChallengeSucceeded(key string) error
+}
+
+type rateLimitEntry struct {
+	key          string
+	windowStart  time.Time
+	requests     int
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+type memRateLimiter struct {
+	limit   int
+	window  time.Duration
+	backoff time.Duration
+	size    int
+
+	mu    sync.Mutex
+	kinds map[string]*rateLimitLRU
+	now   func() time.Time
+}
+
+// rateLimitLRU holds the entries of one kind of key, most recently used
+// first.
+type rateLimitLRU struct {
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// NewRateLimiter returns a RateLimiter allowing limit requests per key in
+// every window, 0 for no limit. After a challenge failure requests of the
+// key are refused for backoff, doubling with every further failure up to
+// an hour. Keys are tracked by kind, the prefix up to the first colon like
+// "ip:" and "tx:", with at most size keys of each kind, 0 for no bound.
+// When full the least recently used key of the kind is forgotten, so keys
+// chosen by clients, like transactionIDs, never push out the state of
+// client IPs. Replicated servers need a shared RateLimiter instead.
+func NewRateLimiter(limit int, window, backoff time.Duration, size int) RateLimiter {
+	return &memRateLimiter{
+		limit:   limit,
+		window:  window,
+		backoff: backoff,
+		size:    size,
+		kinds:   make(map[string]*rateLimitLRU),
+		now:     time.Now,
+	}
+}
+
+func (l *memRateLimiter) Allow(key string) (time.Duration, error) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := l.entry(key, now)
+	if now.Before(e.blockedUntil) {
+		return e.blockedUntil.Sub(now), nil
+	}
+	if now.Sub(e.windowStart) >= l.window {
+		e.windowStart, e.requests = now, 0
+	}
+	if l.limit > 0 && e.requests >= l.limit {
+		return e.windowStart.Add(l.window).Sub(now), nil
+	}
+	e.requests++
+	return 0, nil
+}
+
+func (l *memRateLimiter) ChallengeFailed(key string) error {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e := l.entry(key, now)
+	e.failures++
+	e.lastFailure = now
+	backoff := maxChallengeBackoff
+	if e.failures < 32 {
+		if b := l.backoff << uint(e.failures-1); b > 0 && b < maxChallengeBackoff {
+			backoff = b
+		}
+	}
+	e.blockedUntil = now.Add(backoff)
+	return nil
+}
+
+func (l *memRateLimiter) ChallengeSucceeded(key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lru, ok := l.kinds[keyKind(key)]; ok {
+		if elem, ok := lru.entries[key]; ok {
+			e := elem.Value.(*rateLimitEntry)
+			e.failures = 0
+			e.blockedUntil = time.Time{}
+		}
+	}
+	return nil
+}
+
+// keyKind returns the prefix of key up to its first colon.
+func keyKind(key string) string {
+	if i := strings.IndexByte(key, ':'); i >= 0 {
+		return key[:i]
+	}
+	return ""
+}
+
+// expired reports whether the window, backoff and failures of e have all
+// expired, so forgetting it changes nothing.
+func (l *memRateLimiter) expired(e *rateLimitEntry, now time.Time) bool {
+	return now.Sub(e.windowStart) >= l.window && now.After(e.blockedUntil) &&
+		now.Sub(e.lastFailure) >= maxChallengeBackoff
+}
+
+// entry returns the entry of key, creating it if needed, and marks it most
+// recently used. The least recently used entries of its kind are forgotten
+// once expired, or if the kind is full.
+func (l *memRateLimiter) entry(key string, now time.Time) *rateLimitEntry {
+	kind := keyKind(key)
+	lru, ok := l.kinds[kind]
+	if !ok {
+		lru = &rateLimitLRU{order: list.New(), entries: make(map[string]*list.Element)}
+		l.kinds[kind] = lru
+	}
+	for back := lru.order.Back(); back != nil; back = lru.order.Back() {
+		e := back.Value.(*rateLimitEntry)
+		if e.key == key || !l.expired(e, now) {
+			break
+		}
+		lru.order.Remove(back)
+		delete(lru.entries, e.key)
+	}
+	if elem, ok := lru.entries[key]; ok {
+		lru.order.MoveToFront(elem)
+		return elem.Value.(*rateLimitEntry)
+	}
+	if l.size > 0 && lru.order.Len() >= l.size {
+		back := lru.order.Back()
+		lru.order.Remove(back)
+		delete(lru.entries, back.Value.(*rateLimitEntry).key)
+	}
+	e := &rateLimitEntry{key: key, windowStart: now}
+	lru.entries[key] = lru.order.PushFront(e)
+	return e
+}
+
+// RateLimitError is returned by PKIOperation for requests refused by the
+// RateLimiter. The HTTP transport answers it with 429 Too Many Requests.
+type RateLimitError struct {
+	// RetryAfter is the time the client must wait before retrying.
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited, retry after %s", e.RetryAfter)
+}
+
+// StatusCode implements the go-kit StatusCoder.
+func (e *RateLimitError) StatusCode() int { return http.StatusTooManyRequests }
+
+// Headers implements the go-kit Headerer, setting Retry-After.
+func (e *RateLimitError) Headers() http.Header {
+	secs := int((e.RetryAfter + time.Second - 1) / time.Second)
+	return http.Header{"Retry-After": []string{strconv.Itoa(secs)}}
+}
+
+type clientIPKey struct{}
+
+// ContextWithClientIP returns a copy of ctx carrying the IP address of the
+// client, used by the RateLimiter of the service. MakeHTTPHandler sets it
+// from the remote address of the request; behind a reverse proxy the
+// remote address must be rewritten to the client address by a trusted
+// middleware.
+func ContextWithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// ClientIP returns the client IP address set with ContextWithClientIP.
+func ClientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
+
+// populateClientIP is a go-kit RequestFunc adding the remote IP address of
+// r to ctx.
+func populateClientIP(ctx context.Context, r *http.Request) context.Context {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return ContextWithClientIP(ctx, host)
+}
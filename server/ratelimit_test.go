@@ -0,0 +1,93 @@
+package scepserver
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := NewRateLimiter(2, time.Minute, time.Second, 2).(*memRateLimiter)
+	l.now = func() time.Time { return now }
+	allow := func(key string) time.Duration {
+		t.Helper()
+		wait, err := l.Allow(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wait
+	}
+
+	if allow("ip:a") != 0 || allow("ip:a") != 0 {
+		t.Fatal("requests within the limit refused")
+	}
+	if wait := allow("ip:a"); wait != time.Minute {
+		t.Errorf("want to wait a minute, have %s", wait)
+	}
+	if allow("ip:b") != 0 {
+		t.Error("request of another key refused")
+	}
+	now = now.Add(time.Minute)
+	if allow("ip:a") != 0 {
+		t.Error("request of a new window refused")
+	}
+
+	// the backoff doubles with every failure until a success
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		l.ChallengeFailed("tx:1")
+		if wait := allow("tx:1"); wait != want {
+			t.Errorf("want backoff %s, have %s", want, wait)
+		}
+	}
+	l.ChallengeSucceeded("tx:1")
+	if allow("tx:1") != 0 {
+		t.Error("request refused after a successful challenge")
+	}
+
+	l = NewRateLimiter(0, time.Minute, time.Hour, 0).(*memRateLimiter)
+	l.now = func() time.Time { return now }
+	for i := 0; i < 40; i++ {
+		l.ChallengeFailed("ip:a")
+	}
+	if wait, _ := l.Allow("ip:a"); wait != maxChallengeBackoff {
+		t.Errorf("want backoff capped at %s, have %s", maxChallengeBackoff, wait)
+	}
+}
+
+func TestRateLimiterEviction(t *testing.T) {
+	now := time.Now()
+	l := NewRateLimiter(0, time.Minute, time.Minute, 3).(*memRateLimiter)
+	l.now = func() time.Time { return now }
+
+	// flooding fresh transactionIDs does not forget the backoff of an IP
+	l.ChallengeFailed("ip:a")
+	for i := 0; i < 100; i++ {
+		l.Allow(fmt.Sprintf("tx:%d", i))
+	}
+	if wait, _ := l.Allow("ip:a"); wait != time.Minute {
+		t.Errorf("have wait %s after a transactionID flood, want the backoff", wait)
+	}
+	if n := len(l.kinds["tx"].entries); n != 3 {
+		t.Errorf("have %d transactionIDs tracked, want 3", n)
+	}
+
+	// the least recently used IP is forgotten when full
+	l.Allow("ip:b")
+	l.Allow("ip:c")
+	l.Allow("ip:a")
+	l.Allow("ip:d")
+	if _, ok := l.kinds["ip"].entries["ip:b"]; ok {
+		t.Error("least recently used IP not forgotten")
+	}
+	if _, ok := l.kinds["ip"].entries["ip:a"]; !ok {
+		t.Error("recently used IP forgotten")
+	}
+
+	// expired entries are forgotten on later requests
+	now = now.Add(2 * maxChallengeBackoff)
+	l.Allow("ip:e")
+	if n := len(l.kinds["ip"].entries); n != 1 {
+		t.Errorf("have %d IPs tracked after expiry, want 1", n)
+	}
+}
@@ -0,0 +1,78 @@
+package scepserver
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/micromdm/scep/v2/depot"
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// RenewalOption configures RenewalMiddleware.
+type RenewalOption func(*renewalValidator)
+
+// WithIssuedCerts requires the certificate being renewed to be stored in
+// certs, e.g. the depot which issued it.
+func WithIssuedCerts(certs depot.CertGetter) RenewalOption {
+	return func(v *renewalValidator) {
+		v.certs = certs
+	}
+}
+
+type renewalValidator struct {
+	ca    *x509.Certificate
+	certs depot.CertGetter
+}
+
+// RenewalMiddleware returns a CSRSigner which passes enrollment requests to
+// enroll and renewal requests, as reported by scep.CSRReqMessage.IsRenewal,
+// to renew. Using separate signers lets servers apply a different policy to
+// renewals, e.g. skip the challenge password check.
+//
+// Before calling renew the signer certificate of the request is validated:
+// it must be unexpired and issued by ca. Invalid renewals are reported with
+// the badCertId failInfo.
+func RenewalMiddleware(ca *x509.Certificate, enroll, renew CSRSigner, opts ...RenewalOption) CSRSignerFunc {
+	v := &renewalValidator{ca: ca}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return func(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+		if !m.IsRenewal() {
+			return enroll.SignCSR(m)
+		}
+		if err := v.validate(m.SignerCert); err != nil {
+			return nil, &FailInfoError{FailInfo: scep.BadCertID, Err: err}
+		}
+		return renew.SignCSR(m)
+	}
+}
+
+func (v *renewalValidator) validate(crt *x509.Certificate) error {
+	if crt == nil {
+		return errors.New("renewal request has no signer certificate")
+	}
+	if !bytes.Equal(crt.RawIssuer, v.ca.RawSubject) {
+		return errors.New("renewal signer certificate not issued by CA")
+	}
+	if err := crt.CheckSignatureFrom(v.ca); err != nil {
+		return fmt.Errorf("renewal signer certificate not issued by CA: %w", err)
+	}
+	if now := time.Now(); now.Before(crt.NotBefore) || now.After(crt.NotAfter) {
+		return errors.New("renewal signer certificate expired or not yet valid")
+	}
+	if v.certs == nil {
+		return nil
+	}
+	issued, err := v.certs.GetCert(crt.SerialNumber)
+	if err != nil {
+		return fmt.Errorf("renewal signer certificate: %w", err)
+	}
+	if !bytes.Equal(issued.Raw, crt.Raw) {
+		return errors.New("renewal signer certificate does not match issued certificate")
+	}
+	return nil
+}
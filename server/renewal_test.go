@@ -0,0 +1,119 @@
+package scepserver
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/depot"
+	"github.com/micromdm/scep/v2/scep"
+)
+
+type certGetterFunc func(*big.Int) (*x509.Certificate, error)
+
+func (f certGetterFunc) GetCert(serial *big.Int) (*x509.Certificate, error) { return f(serial) }
+
+func TestRenewalMiddleware(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := newRenewalTestCert(t, key, nil, nil, time.Now().Add(time.Hour))
+	issued := newRenewalTestCert(t, key, ca, key, time.Now().Add(time.Hour))
+	expired := newRenewalTestCert(t, key, ca, key, time.Now().Add(-time.Minute))
+	selfSigned := newRenewalTestCert(t, key, nil, nil, time.Now().Add(time.Hour))
+	notStored := certGetterFunc(func(*big.Int) (*x509.Certificate, error) {
+		return nil, depot.ErrCertNotFound
+	})
+	stored := certGetterFunc(func(*big.Int) (*x509.Certificate, error) {
+		return issued, nil
+	})
+
+	for _, test := range []struct {
+		testName string
+		msgType  scep.MessageType
+		signer   *x509.Certificate
+		opts     []RenewalOption
+		want     string
+		wantInfo scep.FailInfo
+	}{
+		{"enrollment", scep.PKCSReq, selfSigned, nil, "enroll", ""},
+		{"PKCSReq renewal", scep.PKCSReq, issued, nil, "renew", ""},
+		{"RenewalReq", scep.RenewalReq, issued, nil, "renew", ""},
+		{"RenewalReq self-signed", scep.RenewalReq, selfSigned, nil, "", scep.BadCertID},
+		{"expired", scep.PKCSReq, expired, nil, "", scep.BadCertID},
+		{"issued and stored", scep.PKCSReq, issued, []RenewalOption{WithIssuedCerts(stored)}, "renew", ""},
+		{"issued but not stored", scep.PKCSReq, issued, []RenewalOption{WithIssuedCerts(notStored)}, "", scep.BadCertID},
+	} {
+		test := test
+		t.Run(test.testName, func(t *testing.T) {
+			t.Parallel()
+			var called string
+			record := func(name string) CSRSignerFunc {
+				return func(*scep.CSRReqMessage) (*x509.Certificate, error) {
+					called = name
+					return nil, nil
+				}
+			}
+			signer := RenewalMiddleware(ca, record("enroll"), record("renew"), test.opts...)
+			_, err := signer.SignCSR(&scep.CSRReqMessage{
+				MessageType: test.msgType,
+				SignerCert:  test.signer,
+			})
+			if test.wantInfo == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if called != test.want {
+					t.Errorf("have %q called, want %q", called, test.want)
+				}
+				return
+			}
+			var fiErr *FailInfoError
+			if !errors.As(err, &fiErr) {
+				t.Fatalf("expected FailInfoError, got %v", err)
+			}
+			if have, want := fiErr.FailInfo, test.wantInfo; have != want {
+				t.Errorf("have %s, want %s", have, want)
+			}
+			if called != "" {
+				t.Errorf("%q called for invalid renewal", called)
+			}
+		})
+	}
+}
+
+// newRenewalTestCert creates a certificate for key signed by parent, or a
+// self-signed one if parent is nil.
+func newRenewalTestCert(t *testing.T, key *rsa.PrivateKey, parent *x509.Certificate, parentKey *rsa.PrivateKey, notAfter time.Time) *x509.Certificate {
+	t.Helper()
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: serial.String()},
+		NotBefore:             time.Now().Add(-2 * time.Hour),
+		NotAfter:              notAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crt
+}
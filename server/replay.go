@@ -0,0 +1,54 @@
+package scepserver
+
+import (
+	"sync"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+// ReplayCache remembers the transactionID and senderNonce pairs of
+// enrollment requests so that replayed PKCSReq, RenewalReq and UpdateReq
+// messages can be rejected.
+type ReplayCache interface {
+	// Seen records the pair and reports whether it was recorded before.
+	Seen(tID scep.TransactionID, nonce scep.SenderNonce) (bool, error)
+}
+
+type memReplayCache struct {
+	ttl  time.Duration
+	size int
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+// NewReplayCache returns a ReplayCache remembering pairs in memory for ttl.
+// At most size pairs are kept; when full the pair expiring first is
+// forgotten. Replicated servers need a shared ReplayCache instead.
+func NewReplayCache(ttl time.Duration, size int) ReplayCache {
+	return &memReplayCache{ttl: ttl, size: size, seen: make(map[string]time.Time)}
+}
+
+func (c *memReplayCache) Seen(tID scep.TransactionID, nonce scep.SenderNonce) (bool, error) {
+	key := string(tID) + "\x00" + string(nonce)
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var oldest string
+	for k, exp := range c.seen {
+		if now.After(exp) {
+			delete(c.seen, k)
+		} else if oldest == "" || exp.Before(c.seen[oldest]) {
+			oldest = k
+		}
+	}
+	if _, ok := c.seen[key]; ok {
+		return true, nil
+	}
+	if c.size > 0 && len(c.seen) >= c.size {
+		delete(c.seen, oldest)
+	}
+	c.seen[key] = now.Add(c.ttl)
+	return false, nil
+}
@@ -0,0 +1,39 @@
+package scepserver
+
+import (
+	"testing"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+)
+
+func TestReplayCache(t *testing.T) {
+	cache := NewReplayCache(time.Hour, 2)
+	seen := func(tID, nonce string) bool {
+		t.Helper()
+		ok, err := cache.Seen(scep.TransactionID(tID), scep.SenderNonce(nonce))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	if seen("t1", "n1") || seen("t1", "n2") {
+		t.Error("new pairs reported as seen")
+	}
+	if !seen("t1", "n1") {
+		t.Error("replayed pair not reported as seen")
+	}
+	// the oldest pair is forgotten once the cache is full
+	if seen("t2", "n1") {
+		t.Error("new pair reported as seen")
+	}
+	if seen("t1", "n1") {
+		t.Error("evicted pair reported as seen")
+	}
+
+	expired := NewReplayCache(-time.Minute, 0)
+	expired.Seen("t1", scep.SenderNonce("n1"))
+	if ok, _ := expired.Seen("t1", scep.SenderNonce("n1")); ok {
+		t.Error("expired pair reported as seen")
+	}
+}
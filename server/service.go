@@ -1,12 +1,19 @@
 package scepserver
 
 import (
+	"bytes"
 	"context"
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
 	"errors"
+	"fmt"
+	"time"
 
+	"github.com/micromdm/scep/v2/depot"
+	"github.com/micromdm/scep/v2/metrics"
 	"github.com/micromdm/scep/v2/scep"
+	"github.com/micromdm/scep/v2/scep/kitlog"
+	"github.com/micromdm/scep/v2/tracing"
 
 	"github.com/go-kit/kit/log"
 )
@@ -36,66 +43,500 @@ type Service interface {
 type service struct {
 	// The service certificate and key for SCEP exchanges. These are
 	// quite likely the same as the CA keypair but may be its own SCEP
-	// specific keypair in the case of e.g. RA (proxy) operation.
+	// specific keypair in the case of e.g. RA (proxy) operation. The key
+	// may be held by an HSM; decrypting RSA key transport pkiEnvelopes
+	// additionally requires it to implement crypto.Decrypter.
 	crt *x509.Certificate
-	key *rsa.PrivateKey
+	key crypto.Signer
+
+	// Optional RA encryption certificate and key decrypting the
+	// pkiEnvelope of requests instead of crt and key, see
+	// WithRAEncryption.
+	encCrt *x509.Certificate
+	encKey crypto.PrivateKey
 
 	// Optional additional CA certificates for e.g. RA (proxy) use.
 	// Only used in this service when responding to GetCACert.
 	addlCa []*x509.Certificate
 
+	// Optional intermediate CA certificates of the issued certificates,
+	// sent with them in CertRep and returned with GetCACert.
+	chain []*x509.Certificate
+
+	// Optional certificates returned with GetCACert by CA identifier,
+	// see WithCAIdent.
+	caIdents map[string][]*x509.Certificate
+
 	// The (chainable) CSR signing function. Intended to handle all
 	// SCEP request functionality such as CSR & challenge checking, CA
 	// issuance, RA proxying, etc.
 	signer CSRSigner
 
+	// Optional store of issued certificates used to answer GetCert.
+	certGetter depot.CertGetter
+
+	// Optional store of the transactions held PENDING, used to answer
+	// CertPoll.
+	transactions depot.TransactionStore
+
+	// Optional source of CRLs used to answer GetCRL.
+	crlGetter CRLGetter
+
+	// Capabilities advertised in answer to GetCACaps.
+	caps scep.Capabilities
+
+	// Validate the signer certificates of requests, see
+	// scep.WithSignerValidation.
+	validateSigner bool
+
+	// Optional range of the nonce sizes of requests, see
+	// scep.WithNonceSizeRange.
+	nonceMin, nonceMax int
+
+	// Require RSA-OAEP key transport, see scep.WithRequireOAEP.
+	requireOAEP bool
+
+	// Key transport of replies, see WithKeyEncryptionScheme.
+	keyEnc scep.KeyEncryptionAlgorithm
+
+	// Restrict messages to FIPS-approved algorithms, see WithFIPS.
+	fips bool
+
+	// Optional cache of request nonces used to reject replayed enrollment
+	// requests.
+	replay ReplayCache
+
+	// Optional limiter of the PKIOperation requests by client IP and
+	// transactionID.
+	rateLimiter RateLimiter
+
+	// Optional next CA certificates answering GetNextCACert during a CA
+	// rollover.
+	nextCA []*x509.Certificate
+
+	// Optional audit logger recording enrollment decisions.
+	auditLogger AuditLogger
+
+	// Optional publishers notified of issued certificates and rejected
+	// requests.
+	publishers []EventPublisher
+
+	metrics metrics.Metrics
+	tracer  tracing.Tracer
+
 	/// info logging is implemented in the service middleware layer.
 	debugLogger log.Logger
 }
 
+// DefaultCapabilities are advertised by services created without
+// WithCapabilities.
+var DefaultCapabilities = scep.Capabilities{
+	scep.CapRenewal,
+	scep.CapSHA1,
+	scep.CapSHA256,
+	scep.CapAES,
+	scep.CapDES3,
+	scep.CapSCEPStandard,
+	scep.CapPOSTPKIOperation,
+}
+
 func (svc *service) GetCACaps(ctx context.Context) ([]byte, error) {
-	defaultCaps := []byte("Renewal\nSHA-1\nSHA-256\nAES\nDES3\nSCEPStandard\nPOSTPKIOperation")
-	return defaultCaps, nil
+	caps := svc.caps
+	if svc.fips {
+		caps = fipsCapabilities(caps)
+	}
+	if len(svc.nextCA) > 0 && !caps.Has(scep.CapGetNextCACert) {
+		caps = append(scep.Capabilities{scep.CapGetNextCACert}, caps...)
+	}
+	return caps.Marshal(), nil
 }
 
-func (svc *service) GetCACert(ctx context.Context, _ string) ([]byte, int, error) {
-	if svc.crt == nil {
-		return nil, 0, errors.New("missing CA certificate")
+func (svc *service) GetCACert(ctx context.Context, message string) ([]byte, int, error) {
+	certs, ok := svc.caIdents[message]
+	if !ok {
+		certs = append(append([]*x509.Certificate{}, svc.addlCa...), svc.chain...)
 	}
-	if len(svc.addlCa) < 1 {
-		return svc.crt.Raw, 1, nil
+	if svc.encCrt != nil {
+		certs = append([]*x509.Certificate{svc.encCrt}, certs...)
+	}
+	resp, err := NewCACertResponse(svc.crt, certs...)
+	if err != nil {
+		return nil, 0, err
 	}
-	certs := []*x509.Certificate{svc.crt}
-	certs = append(certs, svc.addlCa...)
-	data, err := scep.DegenerateCertificates(certs)
-	return data, len(svc.addlCa) + 1, err
+	return resp.Data, resp.CertNum, nil
 }
 
 func (svc *service) PKIOperation(ctx context.Context, data []byte) ([]byte, error) {
-	msg, err := scep.ParsePKIMessage(data, scep.WithLogger(svc.debugLogger))
+	ctx, span := svc.tracer.Start(ctx, "scepserver.PKIOperation")
+	defer span.End()
+	resp, err := svc.pkiOperation(ctx, span, data)
+	if err != nil {
+		span.RecordError(err)
+	}
+	return resp, err
+}
+
+// pkiOperation answers the PKIOperation request data, setting the
+// attributes of the parsed message on span.
+func (svc *service) pkiOperation(ctx context.Context, span tracing.Span, data []byte) ([]byte, error) {
+	parseOpts := []scep.Option{scep.WithLogger(kitlog.New(svc.debugLogger)), scep.WithTracer(svc.tracer)}
+	if svc.validateSigner {
+		issuers := append([]*x509.Certificate{svc.crt}, svc.addlCa...)
+		parseOpts = append(parseOpts, scep.WithSignerValidation(append(issuers, svc.chain...)))
+	}
+	if svc.nonceMin != 0 || svc.nonceMax != 0 {
+		parseOpts = append(parseOpts, scep.WithNonceSizeRange(svc.nonceMin, svc.nonceMax))
+	}
+	if svc.requireOAEP {
+		parseOpts = append(parseOpts, scep.WithRequireOAEP())
+	}
+	if svc.keyEnc != 0 {
+		parseOpts = append(parseOpts, scep.WithKeyEncryptionAlgorithm(svc.keyEnc))
+	}
+	if svc.fips {
+		parseOpts = append(parseOpts, scep.WithFIPS())
+	}
+	ipKey := ""
+	if ip := ClientIP(ctx); ip != "" {
+		ipKey = "ip:" + ip
+	}
+	if err := svc.rateLimit(ipKey); err != nil {
+		return nil, err
+	}
+	msg, err := scep.ParsePKIMessageContext(ctx, data, parseOpts...)
+	if err != nil {
+		return nil, err
+	}
+	svc.metrics.MessageParsed(msg.MessageType)
+	span.SetAttributes(
+		tracing.String(tracing.TransactionIDKey, string(msg.TransactionID)),
+		tracing.String(tracing.MessageTypeKey, msg.MessageType.String()),
+	)
+	txKey := "tx:" + string(msg.TransactionID)
+	if err := svc.rateLimit(txKey); err != nil {
+		return nil, err
+	}
+	replayed, err := svc.replayed(msg)
 	if err != nil {
 		return nil, err
 	}
-	if err := msg.DecryptPKIEnvelope(svc.crt, svc.key); err != nil {
+	if replayed {
+		svc.debugLogger.Log("msg", "rejected replayed request", "transaction_id", msg.TransactionID)
+		err := errors.New("replayed request")
+		svc.audit(ctx, msg, nil, err)
+		svc.publish(msg, nil, err)
+		return svc.fail(ctx, msg, err)
+	}
+	if msg.MessageType == scep.CertRep {
+		return nil, badRequestError{fmt.Errorf("%w: %s sent to the CA", scep.ErrUnsupportedMessageType, msg.MessageType)}
+	}
+	if err := svc.decrypt(ctx, msg); err != nil {
+		if errors.Is(err, scep.ErrVerify) {
+			// the request was decrypted, but is not signed for its CSR
+			svc.debugLogger.Log("msg", "failed to verify request", "err", err)
+			svc.audit(ctx, msg, nil, err)
+			svc.publish(msg, nil, err)
+			return svc.fail(ctx, msg, err)
+		}
+		svc.metrics.DecryptFailed()
 		return nil, err
 	}
 
+	switch msg.MessageType {
+	case scep.GetCert:
+		return svc.getCert(ctx, msg)
+	case scep.GetCRL:
+		return svc.getCRL(ctx, msg)
+	case scep.CertPoll:
+		return svc.certPoll(ctx, msg)
+	}
+
+	_, signSpan := svc.tracer.Start(ctx, "scepserver.SignCSR")
+	start := time.Now()
 	crt, err := svc.signer.SignCSR(msg.CSRReqMessage)
+	svc.metrics.SignDuration(time.Since(start))
+	if err != nil {
+		signSpan.RecordError(err)
+	}
+	signSpan.End()
 	if err == nil && crt == nil {
 		err = errors.New("no signed certificate")
 	}
+	if err := svc.challengeResult(err, ipKey, txKey); err != nil {
+		return nil, err
+	}
+	if errors.Is(err, ErrPending) {
+		svc.debugLogger.Log("msg", "request pending", "transaction_id", msg.TransactionID)
+		return svc.pending(ctx, msg)
+	}
+	// the decision on a resent request was reported when it was made
+	resent := msg.CSRReqMessage.Replayed
+	if err != nil {
+		svc.debugLogger.Log("msg", "failed to sign CSR", "err", err, "resent", resent)
+		if !resent {
+			svc.audit(ctx, msg, nil, err)
+			svc.publish(msg, nil, err)
+		}
+		return svc.fail(ctx, msg, err)
+	}
+	certRep, err := msg.SuccessContext(ctx, svc.crt, svc.key, crt, scep.WithCertificateChain(svc.chain))
+	if err != nil {
+		return nil, err
+	}
+	if resent {
+		svc.debugLogger.Log("msg", "answered resent request", "transaction_id", msg.TransactionID)
+		return certRep.Raw, nil
+	}
+	svc.audit(ctx, msg, crt, nil)
+	svc.publish(msg, crt, nil)
+	svc.metrics.CertIssued()
+	return certRep.Raw, nil
+}
+
+// decrypt decrypts the pkiEnvelope of msg with the RA encryption keypair,
+// if any, and the service keypair. Clients not telling the RA certificates
+// apart may have encrypted to the signing certificate.
+func (svc *service) decrypt(ctx context.Context, msg *scep.PKIMessage) error {
+	if svc.encCrt != nil {
+		err := msg.DecryptPKIEnvelopeContext(ctx, svc.encCrt, svc.encKey)
+		if err == nil || !errors.Is(err, scep.ErrDecrypt) {
+			return err
+		}
+		svc.debugLogger.Log("msg", "request not encrypted to the RA encryption certificate", "err", err)
+	}
+	return msg.DecryptPKIEnvelopeContext(ctx, svc.crt, svc.key)
+}
+
+// rateLimit returns a RateLimitError if the RateLimiter refuses a request
+// of key. Empty keys are not limited.
+func (svc *service) rateLimit(key string) error {
+	if svc.rateLimiter == nil || key == "" {
+		return nil
+	}
+	wait, err := svc.rateLimiter.Allow(key)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		svc.debugLogger.Log("msg", "rate limited request", "key", key, "retry_after", wait)
+		return &RateLimitError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// challengeResult records the outcome of the challenge password check
+// with the RateLimiter: signErr is ErrInvalidChallenge for a rejected
+// challenge and nil for a signed CSR. Other errors leave the challenge
+// outcome unknown.
+func (svc *service) challengeResult(signErr error, keys ...string) error {
+	failed := errors.Is(signErr, ErrInvalidChallenge)
+	if svc.rateLimiter == nil || (signErr != nil && !failed) {
+		return nil
+	}
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		var err error
+		if failed {
+			err = svc.rateLimiter.ChallengeFailed(key)
+		} else {
+			err = svc.rateLimiter.ChallengeSucceeded(key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replayed reports whether msg is an enrollment request whose
+// transactionID and senderNonce were seen before.
+func (svc *service) replayed(msg *scep.PKIMessage) (bool, error) {
+	if svc.replay == nil {
+		return false, nil
+	}
+	switch msg.MessageType {
+	case scep.PKCSReq, scep.RenewalReq, scep.UpdateReq:
+		return svc.replay.Seen(msg.TransactionID, msg.SenderNonce)
+	}
+	return false, nil
+}
+
+// getCert answers a GetCert request with the certificate from the depot.
+func (svc *service) getCert(ctx context.Context, msg *scep.PKIMessage) ([]byte, error) {
+	var crt *x509.Certificate
+	err := errors.New("GetCert not supported")
+	if svc.certGetter != nil {
+		crt, err = svc.certGetter.GetCert(msg.GetCertMessage.SerialNumber)
+	}
+	if err == nil && !msg.GetCertMessage.Matches(crt) {
+		err = depot.ErrCertNotFound
+	}
+	if err == depot.ErrCertNotFound {
+		err = &FailInfoError{FailInfo: scep.BadCertID, Err: err}
+	}
+	if err != nil {
+		svc.debugLogger.Log("msg", "failed to get certificate", "err", err)
+		return svc.fail(ctx, msg, err)
+	}
+
+	certRep, err := msg.SuccessContext(ctx, svc.crt, svc.key, crt, scep.WithCertificateChain(svc.chain))
+	if err != nil {
+		return nil, err
+	}
+	return certRep.Raw, nil
+}
+
+// getCRL answers a GetCRL request with the CRL from the CRLGetter.
+func (svc *service) getCRL(ctx context.Context, msg *scep.PKIMessage) ([]byte, error) {
+	var crl []byte
+	err := errors.New("GetCRL not supported")
+	if svc.crlGetter != nil {
+		crl, err = svc.crlGetter.GetCRL(msg.GetCRLMessage.IssuerAndSerial)
+	}
+	if err != nil {
+		svc.debugLogger.Log("msg", "failed to get CRL", "err", err)
+		return svc.fail(ctx, msg, err)
+	}
+
+	certRep, err := msg.SuccessCRL(svc.crt, svc.key, crl, scep.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return certRep.Raw, nil
+}
+
+// certPoll answers a CertPoll request with the state of its transaction
+// in the TransactionStore. Only the signer of the original request, or the
+// owner of its CSR key, may poll.
+func (svc *service) certPoll(ctx context.Context, msg *scep.PKIMessage) ([]byte, error) {
+	var t *depot.Transaction
+	err := errors.New("no pending request")
+	if svc.transactions != nil {
+		t, err = svc.transactions.Transaction(msg.TransactionID)
+	}
+	if err == nil {
+		err = checkPoll(msg, t)
+	}
+	if errors.Is(err, depot.ErrTransactionNotFound) {
+		err = &FailInfoError{FailInfo: scep.BadCertID, Err: err}
+	}
+	if err == nil && t.Status == depot.TransactionRejected {
+		err = rejection(t)
+	}
+	if err != nil {
+		svc.debugLogger.Log("msg", "failed to poll request", "err", err)
+		return svc.fail(ctx, msg, err)
+	}
+	if t.Status == depot.TransactionPending {
+		return svc.pending(ctx, msg)
+	}
+
+	crt, err := x509.ParseCertificate(t.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	certRep, err := msg.SuccessContext(ctx, svc.crt, svc.key, crt, scep.WithCertificateChain(svc.chain))
+	if err != nil {
+		return nil, err
+	}
+	return certRep.Raw, nil
+}
+
+// checkPoll returns an error unless the CertPoll msg is for the subject of
+// transaction t and signed by the signer or CSR key of its request.
+func checkPoll(msg *scep.PKIMessage, t *depot.Transaction) error {
+	csr, err := x509.ParseCertificateRequest(t.CSR)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(msg.CertPollMessage.Subject.FullBytes, csr.RawSubject) {
+		return &FailInfoError{FailInfo: scep.BadCertID, Err: errors.New("CertPoll subject does not match the request")}
+	}
+	signer := msg.SignerCert.RawSubjectPublicKeyInfo
+	if bytes.Equal(signer, csr.RawSubjectPublicKeyInfo) {
+		return nil
+	}
+	if t.SignerCert != nil {
+		crt, err := x509.ParseCertificate(t.SignerCert)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(signer, crt.RawSubjectPublicKeyInfo) {
+			return nil
+		}
+	}
+	return &FailInfoError{FailInfo: scep.BadMessageCheck, Err: errors.New("CertPoll not signed by the requester")}
+}
+
+// pending returns a CertRep PENDING for msg.
+func (svc *service) pending(ctx context.Context, msg *scep.PKIMessage) ([]byte, error) {
+	certRep, err := msg.Pending(svc.crt, svc.key, scep.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return certRep.Raw, nil
+}
+
+// fail returns a CertRep FAILURE for msg, see failureOptions.
+func (svc *service) fail(ctx context.Context, msg *scep.PKIMessage, err error) ([]byte, error) {
+	fo := failureOptions(err)
+	svc.metrics.Failure(fo.FailInfo)
+	certRep, err := msg.FailWithContext(ctx, svc.crt, svc.key, fo)
 	if err != nil {
-		svc.debugLogger.Log("msg", "failed to sign CSR", "err", err)
-		certRep, err := msg.Fail(svc.crt, svc.key, scep.BadRequest)
-		return certRep.Raw, err
+		return nil, err
+	}
+	return certRep.Raw, nil
+}
+
+// failureOptions returns the FAILURE for err. The failInfo and
+// failInfoText are taken from a FailInfoError in err; the failInfo
+// defaults to badMessageCheck for scep.ErrVerify and to badRequest
+// otherwise.
+func failureOptions(err error) scep.FailureOptions {
+	fo := scep.FailureOptions{FailInfo: scep.BadRequest}
+	if errors.Is(err, scep.ErrVerify) {
+		fo.FailInfo = scep.BadMessageCheck
+	}
+	var fiErr *FailInfoError
+	if errors.As(err, &fiErr) {
+		fo.FailInfo = fiErr.FailInfo
+		fo.FailInfoText = fiErr.Text
+	}
+	return fo
+}
+
+// audit records the decision on the enrollment request msg with the audit
+// logger, if any.
+func (svc *service) audit(ctx context.Context, msg *scep.PKIMessage, crt *x509.Certificate, err error) {
+	if svc.auditLogger == nil {
+		return
+	}
+	if err := svc.auditLogger.Audit(ctx, newAuditEvent(msg, crt, err)); err != nil {
+		svc.debugLogger.Log("msg", "failed to write audit event", "err", err)
 	}
+}
 
-	certRep, err := msg.Success(svc.crt, svc.key, crt)
-	return certRep.Raw, err
+// publish notifies the event publishers, if any, of the decision on the
+// enrollment request msg: crt was issued, or the request was rejected with
+// err.
+func (svc *service) publish(msg *scep.PKIMessage, crt *x509.Certificate, err error) {
+	if len(svc.publishers) == 0 {
+		return
+	}
+	e := newEvent(EventIssued, msg.TransactionID, msg.CSRReqMessage, crt)
+	if err != nil {
+		e = failedEvent(msg.TransactionID, msg.CSRReqMessage, err)
+	}
+	publishEvent(svc.publishers, svc.debugLogger, e)
 }
 
 func (svc *service) GetNextCACert(ctx context.Context) ([]byte, error) {
-	panic("not implemented")
+	if len(svc.nextCA) < 1 {
+		return nil, errors.New("no next CA certificate")
+	}
+	return scep.NextCACert(svc.crt, svc.key, svc.nextCA)
 }
 
 // ServiceOption is a server configuration option
@@ -110,6 +551,32 @@ func WithLogger(logger log.Logger) ServiceOption {
 	}
 }
 
+// WithAuditLogger records the decisions on enrollment requests with
+// logger.
+func WithAuditLogger(logger AuditLogger) ServiceOption {
+	return func(s *service) error {
+		s.auditLogger = logger
+		return nil
+	}
+}
+
+// WithMetrics records metrics of the PKIOperation requests with m.
+func WithMetrics(m metrics.Metrics) ServiceOption {
+	return func(s *service) error {
+		s.metrics = m
+		return nil
+	}
+}
+
+// WithTracer traces the PKIOperation requests with spans of t, including
+// the parsing, decryption and signing of the messages.
+func WithTracer(t tracing.Tracer) ServiceOption {
+	return func(s *service) error {
+		s.tracer = t
+		return nil
+	}
+}
+
 // WithAddlCA appends an additional certificate to the slice of CA certs
 func WithAddlCA(ca *x509.Certificate) ServiceOption {
 	return func(s *service) error {
@@ -118,12 +585,185 @@ func WithAddlCA(ca *x509.Certificate) ServiceOption {
 	}
 }
 
+// WithRAEncryption separates the RA keypairs as NDES does: the pkiEnvelope
+// of requests is decrypted with key, the private key of crt, while CertRep
+// messages are signed with the service certificate and key. crt is
+// published with GetCACert and should have only the keyEncipherment key
+// usage, and the service certificate only digitalSignature, for clients
+// to encrypt to crt. Requests encrypted to the service certificate are
+// still accepted.
+func WithRAEncryption(crt *x509.Certificate, key crypto.PrivateKey) ServiceOption {
+	return func(s *service) error {
+		priv, ok := key.(interface{ Public() crypto.PublicKey })
+		if !ok {
+			return errors.New("RA encryption key has no public key")
+		}
+		if pub, ok := priv.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(crt.PublicKey) {
+			return errors.New("RA encryption key does not match its certificate")
+		}
+		s.encCrt, s.encKey = crt, key
+		return nil
+	}
+}
+
+// WithCertificateChain sets the intermediate CA certificates of the issued
+// certificates. They are sent after the issued certificate in CertRep
+// responses and returned with the CA certificate in answer to GetCACert.
+func WithCertificateChain(chain ...*x509.Certificate) ServiceOption {
+	return func(s *service) error {
+		s.chain = append(s.chain, chain...)
+		return nil
+	}
+}
+
+// WithCertGetter enables GetCert requests, answered with certificates
+// looked up in getter.
+func WithCertGetter(getter depot.CertGetter) ServiceOption {
+	return func(s *service) error {
+		s.certGetter = getter
+		return nil
+	}
+}
+
+// WithCapabilities sets the capabilities advertised in answer to GetCACaps,
+// e.g. DefaultCapabilities with scep.CapSHA512 appended.
+func WithCapabilities(caps scep.Capabilities) ServiceOption {
+	return func(s *service) error {
+		s.caps = caps
+		return nil
+	}
+}
+
+// WithSignerValidation rejects requests whose signer certificate is
+// expired, or is neither self-signed for the CSR key nor issued by the CA
+// certificates of the service, see scep.WithSignerValidation.
+func WithSignerValidation() ServiceOption {
+	return func(s *service) error {
+		s.validateSigner = true
+		return nil
+	}
+}
+
+// WithNonceSizeRange rejects requests whose senderNonce is shorter than
+// min or longer than max bytes, see scep.WithNonceSizeRange.
+func WithNonceSizeRange(min, max int) ServiceOption {
+	return func(s *service) error {
+		if min < 0 || (max != 0 && max < min) {
+			return fmt.Errorf("invalid nonce size range %d to %d", min, max)
+		}
+		s.nonceMin, s.nonceMax = min, max
+		return nil
+	}
+}
+
+// WithRequireOAEP rejects requests whose pkiEnvelope key is encrypted to
+// the service with RSAES-PKCS1-v1_5 instead of RSAES-OAEP, and encrypts the
+// replies with RSAES-OAEP, see scep.WithRequireOAEP.
+func WithRequireOAEP() ServiceOption {
+	return func(s *service) error {
+		s.requireOAEP = true
+		return nil
+	}
+}
+
+// WithKeyEncryptionScheme encrypts the content encryption key of replies to
+// RSA requesters with scheme. With scep.RSAOAEP requests must use
+// RSAES-OAEP too, like with WithRequireOAEP. By default replies use
+// RSAES-OAEP if the request did, and RSAES-PKCS1-v1_5 otherwise.
+func WithKeyEncryptionScheme(scheme scep.KeyEncryptionAlgorithm) ServiceOption {
+	return func(s *service) error {
+		switch scheme {
+		case scep.RSAOAEP:
+			s.requireOAEP = true
+		case scep.RSAPKCS1v15:
+		default:
+			return fmt.Errorf("unsupported key encryption scheme %s", scheme)
+		}
+		s.keyEnc = scheme
+		return nil
+	}
+}
+
+// WithFIPS restricts requests and replies to FIPS-approved algorithms, see
+// scep.WithFIPS, and stops advertising the SHA-1 and DES3 capabilities.
+// NewService fails if the keys of the service are not approved. FIPS mode
+// is always on if scep.FIPSMode reports true.
+func WithFIPS() ServiceOption {
+	return func(s *service) error {
+		s.fips = true
+		return nil
+	}
+}
+
+// fipsCapabilities returns caps without the capabilities of algorithms
+// that are not FIPS-approved.
+func fipsCapabilities(caps scep.Capabilities) scep.Capabilities {
+	approved := make(scep.Capabilities, 0, len(caps))
+	for _, c := range caps {
+		if c != scep.CapSHA1 && c != scep.CapDES3 {
+			approved = append(approved, c)
+		}
+	}
+	return approved
+}
+
+// WithReplayCache rejects enrollment requests whose transactionID and
+// senderNonce pair was seen before with a badRequest FAILURE.
+func WithReplayCache(cache ReplayCache) ServiceOption {
+	return func(s *service) error {
+		s.replay = cache
+		return nil
+	}
+}
+
+// WithRateLimiter refuses PKIOperation requests limited by l, by client
+// IP, see ContextWithClientIP, and by transactionID, with a RateLimitError.
+// Rejected challenge passwords are reported to l to back off repeated
+// guesses.
+func WithRateLimiter(l RateLimiter) ServiceOption {
+	return func(s *service) error {
+		s.rateLimiter = l
+		return nil
+	}
+}
+
+// WithNextCA enables GetNextCACert requests for a CA rollover, answered
+// with certs signed by the service keypair, usually the current CA. The
+// GetNextCACert capability is advertised in addition to the configured
+// capabilities.
+func WithNextCA(certs ...*x509.Certificate) ServiceOption {
+	return func(s *service) error {
+		s.nextCA = append(s.nextCA, certs...)
+		return nil
+	}
+}
+
+// WithTransactionStore answers CertPoll requests with the state of the
+// transactions in store, e.g. the store of a ManualApproval.
+func WithTransactionStore(store depot.TransactionStore) ServiceOption {
+	return func(s *service) error {
+		s.transactions = store
+		return nil
+	}
+}
+
+// WithCRLGetter enables GetCRL requests, answered with CRLs from getter.
+func WithCRLGetter(getter CRLGetter) ServiceOption {
+	return func(s *service) error {
+		s.crlGetter = getter
+		return nil
+	}
+}
+
 // NewService creates a new scep service
-func NewService(crt *x509.Certificate, key *rsa.PrivateKey, signer CSRSigner, opts ...ServiceOption) (Service, error) {
+func NewService(crt *x509.Certificate, key crypto.Signer, signer CSRSigner, opts ...ServiceOption) (Service, error) {
 	s := &service{
 		crt:         crt,
 		key:         key,
 		signer:      signer,
+		caps:        DefaultCapabilities,
+		metrics:     metrics.Nop(),
+		tracer:      tracing.Nop(),
 		debugLogger: log.NewNopLogger(),
 	}
 	for _, opt := range opts {
@@ -131,5 +771,26 @@ func NewService(crt *x509.Certificate, key *rsa.PrivateKey, signer CSRSigner, op
 			return nil, err
 		}
 	}
+	if scep.FIPSMode() {
+		s.fips = true
+	}
+	if s.fips {
+		if err := s.checkFIPS(); err != nil {
+			return nil, err
+		}
+	}
 	return s, nil
 }
+
+// checkFIPS returns an error if a key of the service is not FIPS-approved.
+func (svc *service) checkFIPS() error {
+	if err := scep.CheckFIPSKey(svc.key.Public()); err != nil {
+		return fmt.Errorf("CA key: %w", err)
+	}
+	if svc.encCrt != nil {
+		if err := scep.CheckFIPSKey(svc.encCrt.PublicKey); err != nil {
+			return fmt.Errorf("RA encryption key: %w", err)
+		}
+	}
+	return nil
+}
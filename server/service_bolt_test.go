@@ -7,18 +7,26 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/big"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	challengestore "github.com/micromdm/scep/v2/challenge/bolt"
+	"github.com/micromdm/scep/v2/cryptoutil/x509util"
 	scepdepot "github.com/micromdm/scep/v2/depot"
 	boltdepot "github.com/micromdm/scep/v2/depot/bolt"
+	"github.com/micromdm/scep/v2/metrics/prometheus"
 	"github.com/micromdm/scep/v2/scep"
 	scepserver "github.com/micromdm/scep/v2/server"
+	"github.com/micromdm/scep/v2/tracing"
 
 	"github.com/boltdb/bolt"
 )
@@ -39,14 +47,14 @@ func TestCaCert(t *testing.T) {
 	depot := scepdepot.Depot(boltDepot)
 
 	// load CA & key again
-	certs, key, err := depot.CA([]byte{})
+	certs, caKey, err := depot.CA([]byte{})
 	if err != nil {
 		t.Fatal(err)
 	}
 	caCert := certs[0]
 
 	// SCEP service
-	svc, err := scepserver.NewService(caCert, key, scepdepot.NewSigner(depot))
+	svc, err := scepserver.NewService(caCert, caKey, scepdepot.NewSigner(depot))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -118,7 +126,7 @@ func TestCaCert(t *testing.T) {
 		}
 
 		// verify issued certificate is from the CA
-		respCert := respMsg.CertRepMessage.Certificate
+		respCert := respMsg.CertRepMessage.Certificates[0]
 		opts := x509.VerifyOptions{
 			Roots:     roots,
 			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
@@ -230,3 +238,1128 @@ func selfSign(priv *rsa.PrivateKey, csr *x509.CertificateRequest) (*x509.Certifi
 	}
 	return x509.ParseCertificate(derBytes)
 }
+
+func TestPKIOperationFailInfo(t *testing.T) {
+	boltDepot := createDB(0666, nil)
+	key, err := boltDepot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := boltDepot.CreateOrLoadCA(key, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := scepserver.CSRSignerFunc(func(*scep.CSRReqMessage) (*x509.Certificate, error) {
+		return nil, &scepserver.FailInfoError{FailInfo: scep.BadAlg, Text: "use SHA-256", Err: errors.New("rejected")}
+	})
+	svc, err := scepserver.NewService(caCert, key, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selfKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := newCSR(selfKey, "ou", "loc", "province", "country", "cname", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerCert, err := selfSign(selfKey, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerKey:   selfKey,
+		SignerCert:  signerCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	respBytes, err := svc.PKIOperation(context.Background(), msg.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	respMsg, err := scep.ParsePKIMessage(respBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := respMsg.PKIStatus, scep.PKIStatus(scep.FAILURE); have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+	if have, want := respMsg.FailInfo, scep.BadAlg; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if have, want := respMsg.FailInfoText, "use SHA-256"; have != want {
+		t.Errorf("have failInfoText %q, want %q", have, want)
+	}
+}
+
+func TestPKIOperationErrors(t *testing.T) {
+	boltDepot := createDB(0666, nil)
+	key, err := boltDepot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := boltDepot.CreateOrLoadCA(key, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := scepserver.CSRSignerFunc(func(*scep.CSRReqMessage) (*x509.Certificate, error) {
+		return nil, errors.New("not signed")
+	})
+	svc, err := scepserver.NewService(caCert, key, signer, scepserver.WithSignerValidation())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selfKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := newCSR(selfKey, "ou", "loc", "province", "country", "cname", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a self-signed certificate of another key than the CSR's
+	otherCSRBytes, err := newCSR(otherKey, "ou", "loc", "province", "country", "other", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCSR, err := x509.ParseCertificateRequest(otherCSRBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCert, err := selfSign(otherKey, otherCSR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerKey:   otherKey,
+		SignerCert:  otherCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	respBytes, err := svc.PKIOperation(context.Background(), msg.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	respMsg, err := scep.ParsePKIMessage(respBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := respMsg.FailInfo, scep.FailInfo(scep.BadMessageCheck); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	// a CertRep is not a request
+	parsed, err := scep.ParsePKIMessage(msg.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certRep, err := parsed.Fail(otherCert, otherKey, scep.BadRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.PKIOperation(context.Background(), certRep.Raw); !errors.Is(err, scep.ErrUnsupportedMessageType) {
+		t.Errorf("have %v, want %v", err, scep.ErrUnsupportedMessageType)
+	}
+}
+
+func TestPKIOperationRAEncryption(t *testing.T) {
+	boltDepot := createDB(0666, nil)
+	caKey, err := boltDepot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := boltDepot.CreateOrLoadCA(caKey, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRA := func(cn string, usage x509.KeyUsage) (*x509.Certificate, *rsa.PrivateKey) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     usage,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		crt, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return crt, key
+	}
+	signCert, signKey := newRA("RA signing", x509.KeyUsageDigitalSignature)
+	encCert, encKey := newRA("RA encryption", x509.KeyUsageKeyEncipherment)
+
+	signer := scepserver.CSRSignerFunc(func(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      m.CSR.Subject,
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, m.CSR.PublicKey, caKey)
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParseCertificate(der)
+	})
+	if _, err := scepserver.NewService(signCert, signKey, signer, scepserver.WithRAEncryption(encCert, signKey)); err == nil {
+		t.Error("expected an error for an RA encryption key of another certificate")
+	}
+	svc, err := scepserver.NewService(signCert, signKey, signer,
+		scepserver.WithRAEncryption(encCert, encKey),
+		scepserver.WithAddlCA(caCert),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caCerts, _, err := svc.GetCACert(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := scep.CACerts(caCerts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles := scep.ClassifyCACerts(certs)
+	if !roles.CA.Equal(caCert) || !roles.RASigning.Equal(signCert) || !roles.RAEncryption.Equal(encCert) {
+		t.Fatalf("have CA %v, RA signing %v, RA encryption %v", roles.CA.Subject, roles.RASigning.Subject, roles.RAEncryption.Subject)
+	}
+
+	selfKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := newCSR(selfKey, "ou", "loc", "province", "country", "cname", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selfCert, err := selfSign(selfKey, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// requests encrypted to either RA certificate are answered
+	for _, recipient := range []*x509.Certificate{roles.RAEncryption, signCert} {
+		msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+			MessageType: scep.PKCSReq,
+			Recipients:  []*x509.Certificate{recipient},
+			SignerKey:   selfKey,
+			SignerCert:  selfCert,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		respBytes, err := svc.PKIOperation(context.Background(), msg.Raw)
+		if err != nil {
+			t.Fatalf("encrypted to %s: %v", recipient.Subject.CommonName, err)
+		}
+		rep, err := scep.ParsePKIMessage(respBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !rep.SignerCert.Equal(signCert) {
+			t.Errorf("CertRep signed by %s, want the RA signing certificate", rep.SignerCert.Subject)
+		}
+		if err := rep.DecryptPKIEnvelope(selfCert, selfKey); err != nil {
+			t.Fatal(err)
+		}
+		if err := rep.CertRepMessage.Certificates[0].CheckSignatureFrom(caCert); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPKIOperationGetCert(t *testing.T) {
+	boltDepot := createDB(0666, nil)
+	key, err := boltDepot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := boltDepot.CreateOrLoadCA(key, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := scepserver.NewService(caCert, key, scepdepot.NewSigner(boltDepot),
+		scepserver.WithCertGetter(boltDepot))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selfKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := newCSR(selfKey, "ou", "loc", "province", "country", "cname", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerCert, err := selfSign(selfKey, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerKey:   selfKey,
+		SignerCert:  signerCert,
+	}
+
+	// enrol a certificate which can be fetched later
+	ctx := context.Background()
+	msg, err := scep.NewCSRRequest(csr, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	respBytes, err := svc.PKIOperation(ctx, msg.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	respMsg, err := scep.ParsePKIMessage(respBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := respMsg.DecryptPKIEnvelope(signerCert, selfKey); err != nil {
+		t.Fatal(err)
+	}
+	issued := respMsg.Certificates[0]
+
+	unknown := scep.NewIssuerAndSerial(issued)
+	unknown.SerialNumber = big.NewInt(1000)
+	for _, test := range []struct {
+		name     string
+		ias      scep.IssuerAndSerial
+		status   scep.PKIStatus
+		failInfo scep.FailInfo
+	}{
+		{"issued", scep.NewIssuerAndSerial(issued), scep.SUCCESS, ""},
+		{"unknown serial", unknown, scep.FAILURE, scep.BadCertID},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := scep.NewGetCertRequest(test.ias, tmpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			respBytes, err := svc.PKIOperation(ctx, req.Raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			respMsg, err := scep.ParsePKIMessage(respBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have, want := respMsg.PKIStatus, test.status; have != want {
+				t.Fatalf("have %s, want %s", have, want)
+			}
+			if test.status == scep.FAILURE {
+				if have, want := respMsg.FailInfo, test.failInfo; have != want {
+					t.Errorf("have %s, want %s", have, want)
+				}
+				return
+			}
+			if err := respMsg.DecryptPKIEnvelope(signerCert, selfKey); err != nil {
+				t.Fatal(err)
+			}
+			if !respMsg.Certificates[0].Equal(issued) {
+				t.Error("GetCert returned a different certificate")
+			}
+		})
+	}
+}
+
+func TestPKIOperationGetCRL(t *testing.T) {
+	boltDepot := createDB(0666, nil)
+	key, err := boltDepot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := boltDepot.CreateOrLoadCA(key, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now(),
+		NextUpdate: time.Now().Add(time.Hour),
+	}, caCert, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := scepserver.NewService(caCert, key, scepdepot.NewSigner(boltDepot),
+		scepserver.WithCRLGetter(scepserver.StaticCRL(caCert, crl)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selfKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := newCSR(selfKey, "ou", "loc", "province", "country", "cname", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerCert, err := selfSign(selfKey, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &scep.PKIMessage{
+		Recipients: []*x509.Certificate{caCert},
+		SignerKey:  selfKey,
+		SignerCert: signerCert,
+	}
+
+	for _, test := range []struct {
+		name   string
+		ias    scep.IssuerAndSerial
+		status scep.PKIStatus
+	}{
+		{"issued by CA", scep.IssuerAndSerial{Issuer: asn1.RawValue{FullBytes: caCert.RawSubject}, SerialNumber: big.NewInt(5)}, scep.SUCCESS},
+		{"other issuer", scep.NewIssuerAndSerial(signerCert), scep.FAILURE},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := scep.NewGetCRLRequest(test.ias, tmpl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			respBytes, err := svc.PKIOperation(context.Background(), req.Raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			respMsg, err := scep.ParsePKIMessage(respBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if have, want := respMsg.PKIStatus, test.status; have != want {
+				t.Fatalf("have %s, want %s", have, want)
+			}
+			if test.status == scep.FAILURE {
+				if have, want := respMsg.FailInfo, scep.FailInfo(scep.BadCertID); have != want {
+					t.Errorf("have %s, want %s", have, want)
+				}
+				return
+			}
+			if err := respMsg.DecryptPKIEnvelope(signerCert, selfKey); err != nil {
+				t.Fatal(err)
+			}
+			if err := caCert.CheckCRLSignature(respMsg.CRL); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestPKIOperationReplay(t *testing.T) {
+	boltDepot := createDB(0666, nil)
+	key, err := boltDepot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := boltDepot.CreateOrLoadCA(key, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := scepserver.NewService(caCert, key, scepdepot.NewSigner(boltDepot),
+		scepserver.WithReplayCache(scepserver.NewReplayCache(time.Hour, 100)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selfKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := newCSR(selfKey, "ou", "loc", "province", "country", "cname", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerCert, err := selfSign(selfKey, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerKey:   selfKey,
+		SignerCert:  signerCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same message is only answered once
+	for _, want := range []scep.PKIStatus{scep.SUCCESS, scep.FAILURE} {
+		respBytes, err := svc.PKIOperation(context.Background(), msg.Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		respMsg, err := scep.ParsePKIMessage(respBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := respMsg.PKIStatus; have != want {
+			t.Errorf("have %s, want %s", have, want)
+		}
+	}
+}
+
+func TestPKIOperationMetrics(t *testing.T) {
+	boltDepot := createDB(0666, nil)
+	key, err := boltDepot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := boltDepot.CreateOrLoadCA(key, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := prometheus.New("scep")
+	svc, err := scepserver.NewService(caCert, key, scepdepot.NewSigner(boltDepot),
+		scepserver.WithReplayCache(scepserver.NewReplayCache(time.Hour, 100)),
+		scepserver.WithMetrics(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selfKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := newCSR(selfKey, "ou", "loc", "province", "country", "cname", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerCert, err := selfSign(selfKey, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerKey:   selfKey,
+		SignerCert:  signerCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the replayed request is rejected
+	for i := 0; i < 2; i++ {
+		if _, err := svc.PKIOperation(context.Background(), msg.Raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`scep_messages_parsed_total{message_type="PKCSReq"} 2`,
+		"scep_certificates_issued_total 1",
+		`scep_failures_total{fail_info="badRequest"} 1`,
+		"scep_sign_duration_seconds_count 1",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing line %q in\n%s", line, buf.String())
+		}
+	}
+}
+
+func TestPKIOperationAudit(t *testing.T) {
+	boltDepot := createDB(0666, nil)
+	key, err := boltDepot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := boltDepot.CreateOrLoadCA(key, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	signer := scepserver.ChallengeMiddleware("secret", scepdepot.NewSigner(boltDepot))
+	svc, err := scepserver.NewService(caCert, key, signer,
+		scepserver.WithAuditLogger(scepserver.NewJSONAuditLogger(&buf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		challenge string
+		want      scepserver.ChallengeOutcome
+		failInfo  string
+	}{
+		{"secret", scepserver.ChallengeAccepted, ""},
+		{"wrong", scepserver.ChallengeRejected, scep.FailInfo(scep.BadRequest).String()},
+	} {
+		t.Run(test.challenge, func(t *testing.T) {
+			buf.Reset()
+			selfKey, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				t.Fatal(err)
+			}
+			csrBytes, err := x509util.CreateCertificateRequest(rand.Reader, &x509util.CertificateRequest{
+				CertificateRequest: x509.CertificateRequest{
+					Subject:  pkix.Name{CommonName: "audit"},
+					DNSNames: []string{"audit.example.com"},
+				},
+				ChallengePassword: test.challenge,
+			}, selfKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			csr, err := x509.ParseCertificateRequest(csrBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signerCert, err := selfSign(selfKey, csr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+				MessageType: scep.PKCSReq,
+				Recipients:  []*x509.Certificate{caCert},
+				SignerKey:   selfKey,
+				SignerCert:  signerCert,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := svc.PKIOperation(context.Background(), msg.Raw); err != nil {
+				t.Fatal(err)
+			}
+
+			var event scepserver.AuditEvent
+			if err := json.Unmarshal(buf.Bytes(), &event); err != nil {
+				t.Fatal(err)
+			}
+			if have, want := event.TransactionID, msg.TransactionID; have != want {
+				t.Errorf("have transaction ID %q, want %q", have, want)
+			}
+			if have, want := event.Subject, "CN=audit"; have != want {
+				t.Errorf("have subject %q, want %q", have, want)
+			}
+			if len(event.DNSNames) != 1 || event.DNSNames[0] != "audit.example.com" {
+				t.Errorf("have DNS names %v, want [audit.example.com]", event.DNSNames)
+			}
+			if have, want := event.Challenge, test.want; have != want {
+				t.Errorf("have challenge %q, want %q", have, want)
+			}
+			if have, want := event.FailInfo, test.failInfo; have != want {
+				t.Errorf("have failInfo %q, want %q", have, want)
+			}
+			if have, want := event.Serial != "", test.failInfo == ""; have != want {
+				t.Errorf("have serial %q, want serial %v", event.Serial, want)
+			}
+		})
+	}
+}
+
+func TestPKIOperationEvents(t *testing.T) {
+	boltDepot := createDB(0666, nil)
+	key, err := boltDepot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := boltDepot.CreateOrLoadCA(key, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan scepserver.Event, 1)
+	depotSigner := scepdepot.NewSigner(boltDepot)
+	signer := scepserver.ChallengeMiddleware("secret", scepserver.CSRSignerFunc(func(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+		m.ChallengeMetadata = map[string]string{scepserver.DeviceIDMetadataKey: "C02XYZ"}
+		return depotSigner.SignCSR(m)
+	}))
+	svc, err := scepserver.NewService(caCert, key, signer,
+		scepserver.WithEventPublisher(scepserver.EventPublisherFunc(func(_ context.Context, e scepserver.Event) error {
+			events <- e
+			return nil
+		})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		challenge string
+		want      scepserver.EventType
+	}{
+		{"secret", scepserver.EventIssued},
+		{"wrong", scepserver.EventFailed},
+	} {
+		t.Run(test.challenge, func(t *testing.T) {
+			selfKey, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				t.Fatal(err)
+			}
+			csrBytes, err := x509util.CreateCertificateRequest(rand.Reader, &x509util.CertificateRequest{
+				CertificateRequest: x509.CertificateRequest{Subject: pkix.Name{CommonName: "event"}},
+				ChallengePassword:  test.challenge,
+			}, selfKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			csr, err := x509.ParseCertificateRequest(csrBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signerCert, err := selfSign(selfKey, csr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+				MessageType: scep.PKCSReq,
+				Recipients:  []*x509.Certificate{caCert},
+				SignerKey:   selfKey,
+				SignerCert:  signerCert,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := svc.PKIOperation(context.Background(), msg.Raw); err != nil {
+				t.Fatal(err)
+			}
+
+			var e scepserver.Event
+			select {
+			case e = <-events:
+			case <-time.After(5 * time.Second):
+				t.Fatal("no event published")
+			}
+			if have, want := e.Type, test.want; have != want {
+				t.Errorf("have event type %q, want %q", have, want)
+			}
+			if have, want := e.TransactionID, msg.TransactionID; have != want {
+				t.Errorf("have transaction ID %q, want %q", have, want)
+			}
+			if have, want := e.Subject, "CN=event"; have != want {
+				t.Errorf("have subject %q, want %q", have, want)
+			}
+			issued := test.want == scepserver.EventIssued
+			if (e.Serial != "") != issued || (e.NotAfter != nil) != issued || (e.DeviceID == "C02XYZ") != issued {
+				t.Errorf("unexpected serial %q, expiry %v or device ID %q", e.Serial, e.NotAfter, e.DeviceID)
+			}
+			if (e.FailInfo == "") != issued {
+				t.Errorf("unexpected failInfo %q", e.FailInfo)
+			}
+		})
+	}
+}
+
+func TestPKIOperationResentEvents(t *testing.T) {
+	boltDepot := createDB(0666, nil)
+	key, err := boltDepot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := boltDepot.CreateOrLoadCA(key, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan scepserver.Event, 2)
+	signer := scepserver.IdempotentMiddleware(scepdepot.NewTransactionStore(),
+		scepserver.ChallengeMiddleware("secret", scepdepot.NewSigner(boltDepot)))
+	svc, err := scepserver.NewService(caCert, key, signer,
+		scepserver.WithEventPublisher(scepserver.EventPublisherFunc(func(_ context.Context, e scepserver.Event) error {
+			events <- e
+			return nil
+		})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selfKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := x509util.CreateCertificateRequest(rand.Reader, &x509util.CertificateRequest{
+		CertificateRequest: x509.CertificateRequest{Subject: pkix.Name{CommonName: "resent"}},
+		ChallengePassword:  "secret",
+	}, selfKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerCert, err := selfSign(selfKey, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerKey:   selfKey,
+		SignerCert:  signerCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := svc.PKIOperation(context.Background(), msg.Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certRep, err := scep.ParsePKIMessage(resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if certRep.PKIStatus != scep.SUCCESS {
+			t.Fatalf("request %d: have status %s, want SUCCESS", i, certRep.PKIStatus)
+		}
+	}
+	// the resent request is answered without reporting a second issuance
+	if len(events) != 1 {
+		t.Errorf("have %d events, want one issued event", len(events))
+	}
+}
+
+func TestPKIOperationChallengeBackoff(t *testing.T) {
+	boltDepot := createDB(0666, nil)
+	key, err := boltDepot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := boltDepot.CreateOrLoadCA(key, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := scepserver.ChallengeMiddleware("secret", scepdepot.NewSigner(boltDepot))
+	svc, err := scepserver.NewService(caCert, key, signer,
+		scepserver.WithRateLimiter(scepserver.NewRateLimiter(0, time.Minute, time.Hour, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	newRequest := func(challenge string) []byte {
+		t.Helper()
+		selfKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csrBytes, err := x509util.CreateCertificateRequest(rand.Reader, &x509util.CertificateRequest{
+			CertificateRequest: x509.CertificateRequest{Subject: pkix.Name{CommonName: "backoff"}},
+			ChallengePassword:  challenge,
+		}, selfKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		csr, err := x509.ParseCertificateRequest(csrBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signerCert, err := selfSign(selfKey, csr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+			MessageType: scep.PKCSReq,
+			Recipients:  []*x509.Certificate{caCert},
+			SignerKey:   selfKey,
+			SignerCert:  signerCert,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg.Raw
+	}
+
+	ctx := scepserver.ContextWithClientIP(context.Background(), "192.0.2.1")
+	if _, err := svc.PKIOperation(ctx, newRequest("wrong")); err != nil {
+		t.Fatal(err)
+	}
+	// the client IP backs off after the rejected challenge, even with the
+	// right one in a new transaction
+	_, err = svc.PKIOperation(ctx, newRequest("secret"))
+	var rlErr *scepserver.RateLimitError
+	if !errors.As(err, &rlErr) {
+		t.Fatalf("want RateLimitError, have %v", err)
+	}
+	if rlErr.RetryAfter <= 0 || rlErr.RetryAfter > time.Hour {
+		t.Errorf("unexpected RetryAfter %s", rlErr.RetryAfter)
+	}
+
+	other := scepserver.ContextWithClientIP(context.Background(), "192.0.2.2")
+	if _, err := svc.PKIOperation(other, newRequest("secret")); err != nil {
+		t.Errorf("request of another client IP refused: %v", err)
+	}
+}
+
+type spanKey struct{}
+
+// recordedSpan is a span of recordingTracer.
+type recordedSpan struct {
+	name   string
+	parent string
+	attrs  map[string]string
+}
+
+func (s *recordedSpan) SetAttributes(attrs ...tracing.Attribute) {
+	for _, a := range attrs {
+		s.attrs[a.Key] = a.Value
+	}
+}
+
+func (s *recordedSpan) RecordError(error) {}
+func (s *recordedSpan) End()              {}
+
+// recordingTracer records the started spans and their parent.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []*recordedSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string, attrs ...tracing.Attribute) (context.Context, tracing.Span) {
+	span := &recordedSpan{name: name, attrs: make(map[string]string)}
+	if parent, ok := ctx.Value(spanKey{}).(*recordedSpan); ok {
+		span.parent = parent.name
+	}
+	span.SetAttributes(attrs...)
+	t.mu.Lock()
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func TestPKIOperationTracing(t *testing.T) {
+	boltDepot := createDB(0666, nil)
+	key, err := boltDepot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := boltDepot.CreateOrLoadCA(key, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := new(recordingTracer)
+	svc, err := scepserver.NewService(caCert, key, scepdepot.NewSigner(boltDepot), scepserver.WithTracer(tracer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selfKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := newCSR(selfKey, "ou", "loc", "province", "country", "cname", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerCert, err := selfSign(selfKey, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerKey:   selfKey,
+		SignerCert:  signerCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.PKIOperation(context.Background(), msg.Raw); err != nil {
+		t.Fatal(err)
+	}
+
+	var have []string
+	for _, span := range tracer.spans {
+		have = append(have, span.parent+" > "+span.name)
+		if span.name == "scep.Success" && span.attrs[tracing.TransactionIDKey] != string(msg.TransactionID) {
+			t.Errorf("have %s attribute %q, want %q", tracing.TransactionIDKey, span.attrs[tracing.TransactionIDKey], msg.TransactionID)
+		}
+	}
+	want := []string{
+		" > scepserver.PKIOperation",
+		"scepserver.PKIOperation > scep.ParsePKIMessage",
+		"scepserver.PKIOperation > scep.DecryptPKIEnvelope",
+		"scepserver.PKIOperation > scepserver.SignCSR",
+		"scepserver.PKIOperation > scep.Success",
+		"scep.Success > scep.Sign",
+	}
+	if strings.Join(have, "\n") != strings.Join(want, "\n") {
+		t.Errorf("have spans\n%s\nwant\n%s", strings.Join(have, "\n"), strings.Join(want, "\n"))
+	}
+	if have, want := tracer.spans[0].attrs[tracing.MessageTypeKey], scep.MessageType(scep.PKCSReq).String(); have != want {
+		t.Errorf("have %s attribute %q, want %q", tracing.MessageTypeKey, have, want)
+	}
+}
+
+func TestPKIOperationKeyEncryptionScheme(t *testing.T) {
+	boltDepot := createDB(0666, nil)
+	key, err := boltDepot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := boltDepot.CreateOrLoadCA(key, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := scepserver.CSRSignerFunc(func(m *scep.CSRReqMessage) (*x509.Certificate, error) {
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      m.CSR.Subject,
+			NotBefore:    time.Now().Add(-time.Minute),
+			NotAfter:     time.Now().Add(time.Hour),
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, m.CSR.PublicKey, key)
+		if err != nil {
+			return nil, err
+		}
+		return x509.ParseCertificate(der)
+	})
+	if _, err := scepserver.NewService(caCert, key, signer, scepserver.WithKeyEncryptionScheme(scep.KeyEncryptionAlgorithm(42))); err == nil {
+		t.Error("expected an error for an unknown key encryption scheme")
+	}
+	svc, err := scepserver.NewService(caCert, key, signer, scepserver.WithKeyEncryptionScheme(scep.RSAOAEP))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selfKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := newCSR(selfKey, "ou", "loc", "province", "country", "cname", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selfCert, err := selfSign(selfKey, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerKey:   selfKey,
+		SignerCert:  selfCert,
+	}
+
+	// RSAES-PKCS1-v1_5 requests are not answered with a certificate
+	msg, err := scep.NewCSRRequest(csr, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if respBytes, err := svc.PKIOperation(context.Background(), msg.Raw); err == nil {
+		rep, err := scep.ParsePKIMessage(respBytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.PKIStatus == scep.SUCCESS {
+			t.Error("answered an RSAES-PKCS1-v1_5 request with SUCCESS")
+		}
+	}
+
+	msg, err = scep.NewCSRRequest(csr, tmpl, scep.WithKeyEncryptionAlgorithm(scep.RSAOAEP))
+	if err != nil {
+		t.Fatal(err)
+	}
+	respBytes, err := svc.PKIOperation(context.Background(), msg.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, err := scep.ParsePKIMessage(respBytes, scep.WithRequireOAEP())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.PKIStatus != scep.SUCCESS {
+		t.Fatalf("have %s, want SUCCESS", rep.FailInfo)
+	}
+	if err := rep.DecryptPKIEnvelope(selfCert, selfKey); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFIPS(t *testing.T) {
+	if scep.FIPSMode() {
+		t.Skip("FIPS mode is enforced for the process")
+	}
+	boltDepot := createDB(0666, nil)
+	key, err := boltDepot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := boltDepot.CreateOrLoadCA(key, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer := scepserver.CSRSignerFunc(func(*scep.CSRReqMessage) (*x509.Certificate, error) {
+		return nil, errors.New("not signed")
+	})
+	weakKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := scepserver.NewService(caCert, weakKey, signer, scepserver.WithFIPS()); !errors.Is(err, scep.ErrNotFIPSApproved) {
+		t.Errorf("have %v, want scep.ErrNotFIPSApproved", err)
+	}
+	svc, err := scepserver.NewService(caCert, key, signer, scepserver.WithFIPS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := svc.GetCACaps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	caps := scep.ParseCapabilities(data)
+	if caps.Has(scep.CapSHA1) || caps.Has(scep.CapDES3) || !caps.Has(scep.CapAES) {
+		t.Errorf("advertised %q", data)
+	}
+}
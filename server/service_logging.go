@@ -53,3 +53,15 @@ func (mw *loggingService) PKIOperation(ctx context.Context, data []byte) (certRe
 	certRep, err = mw.Service.PKIOperation(ctx, data)
 	return
 }
+
+func (mw *loggingService) GetNextCACert(ctx context.Context) (cert []byte, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "GetNextCACert",
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	cert, err = mw.Service.GetNextCACert(ctx)
+	return
+}
@@ -3,41 +3,58 @@ package scepserver
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"net/url"
 
 	kitlog "github.com/go-kit/kit/log"
 	kithttp "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
 	"github.com/groob/finalizer/logutil"
+	"github.com/micromdm/scep/v2/scep"
 	"github.com/pkg/errors"
 )
 
+// MakeHTTPHandler returns an http.Handler serving the SCEP operations of e
+// at the /scep path.
 func MakeHTTPHandler(e *Endpoints, svc Service, logger kitlog.Logger) http.Handler {
+	r := mux.NewRouter()
+	handleSCEP(r, "/scep", e, logger)
+	return r
+}
+
+// MakeProfileHTTPHandler returns an http.Handler serving the SCEP
+// operations of the enrollment profiles, e.g. with their own signer,
+// policy and challenge, at /scep/<name> by the names of profiles, which
+// must be valid path segments. Other paths are not found.
+func MakeProfileHTTPHandler(profiles map[string]*Endpoints, logger kitlog.Logger) http.Handler {
+	r := mux.NewRouter()
+	for name, e := range profiles {
+		handleSCEP(r, "/scep/"+name, e, kitlog.With(logger, "profile", name))
+	}
+	return r
+}
+
+// handleSCEP routes the SCEP operations at path to e.
+func handleSCEP(r *mux.Router, path string, e *Endpoints, logger kitlog.Logger) {
 	opts := []kithttp.ServerOption{
+		kithttp.ServerBefore(populateClientIP),
 		kithttp.ServerErrorLogger(logger),
 		kithttp.ServerFinalizer(logutil.NewHTTPLogger(logger).LoggingFinalizer),
 	}
-
-	r := mux.NewRouter()
-	r.Methods("GET").Path("/scep").Handler(kithttp.NewServer(
+	r.Methods("GET").Path(path).Handler(kithttp.NewServer(
 		e.GetEndpoint,
 		decodeSCEPRequest,
 		encodeSCEPResponse,
 		opts...,
 	))
-	r.Methods("POST").Path("/scep").Handler(kithttp.NewServer(
+	r.Methods("POST").Path(path).Handler(kithttp.NewServer(
 		e.PostEndpoint,
 		decodeSCEPRequest,
 		encodeSCEPResponse,
 		opts...,
 	))
-
-	return r
 }
 
 // EncodeSCEPRequest encodes a SCEP HTTP Request. Used by the client.
@@ -50,7 +67,7 @@ func EncodeSCEPRequest(ctx context.Context, r *http.Request, request interface{}
 		if len(req.Message) > 0 {
 			var msg string
 			if req.Operation == "PKIOperation" {
-				msg = base64.URLEncoding.EncodeToString(req.Message)
+				msg = scep.EncodeBase64(req.Message)
 			} else {
 				msg = string(req.Message)
 			}
@@ -78,16 +95,33 @@ func EncodeSCEPRequest(ctx context.Context, r *http.Request, request interface{}
 
 const maxPayloadSize = 2 << 20
 
+// badRequestError is a malformed client request. The go-kit error encoder
+// responds with its StatusCode.
+type badRequestError struct {
+	err error
+}
+
+func (e badRequestError) Error() string   { return e.err.Error() }
+func (e badRequestError) StatusCode() int { return http.StatusBadRequest }
+func (e badRequestError) Unwrap() error   { return e.err }
+
 func decodeSCEPRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	op := r.URL.Query().Get("operation")
+	switch op {
+	case getCACaps, getCACert, getNextCACert, pkiOperation:
+	default:
+		return nil, badRequestError{fmt.Errorf("scep: unsupported operation %q", op)}
+	}
+
 	msg, err := message(r)
 	if err != nil {
-		return nil, err
+		return nil, badRequestError{err}
 	}
-	defer r.Body.Close()
 
 	request := SCEPRequest{
 		Message:   msg,
-		Operation: r.URL.Query().Get("operation"),
+		Operation: op,
 	}
 
 	return request, nil
@@ -103,15 +137,14 @@ func message(r *http.Request) ([]byte, error) {
 			msg = q.Get("message")
 		}
 		op := q.Get("operation")
-		if op == "PKIOperation" {
-			msg2, err := url.PathUnescape(msg)
-			if err != nil {
-				return nil, err
-			}
-			return base64.StdEncoding.DecodeString(msg2)
+		if op == pkiOperation {
+			return scep.DecodeBase64(msg)
 		}
 		return []byte(msg), nil
 	case "POST":
+		if r.URL.Query().Get("operation") == pkiOperation {
+			return scep.ReadPKIMessage(r.Body, maxPayloadSize)
+		}
 		return ioutil.ReadAll(io.LimitReader(r.Body, maxPayloadSize))
 	default:
 		return nil, errors.New("method not supported")
@@ -122,7 +155,18 @@ func message(r *http.Request) ([]byte, error) {
 func encodeSCEPResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	resp := response.(SCEPResponse)
 	if resp.Err != nil {
-		http.Error(w, resp.Err.Error(), http.StatusInternalServerError)
+		code := http.StatusInternalServerError
+		if h, ok := resp.Err.(kithttp.Headerer); ok {
+			for k, vs := range h.Headers() {
+				for _, v := range vs {
+					w.Header().Add(k, v)
+				}
+			}
+		}
+		if sc, ok := resp.Err.(kithttp.StatusCoder); ok {
+			code = sc.StatusCode()
+		}
+		http.Error(w, resp.Err.Error(), code)
 		return nil
 	}
 	w.Header().Set("Content-Type", contentHeader(resp.operation, resp.CACertNum))
@@ -139,15 +183,23 @@ func DecodeSCEPResponse(ctx context.Context, r *http.Response) (interface{}, err
 			string(body),
 		)
 	}
-	data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxPayloadSize))
+	defer r.Body.Close()
+	header := r.Header.Get("Content-Type")
+	var (
+		data []byte
+		err  error
+	)
+	if header == pkiOpHeader {
+		data, err = scep.ReadPKIMessage(r.Body, maxPayloadSize)
+	} else {
+		data, err = ioutil.ReadAll(io.LimitReader(r.Body, maxPayloadSize))
+	}
 	if err != nil {
 		return nil, err
 	}
-	defer r.Body.Close()
 	resp := SCEPResponse{
 		Data: data,
 	}
-	header := r.Header.Get("Content-Type")
 	if header == certChainHeader {
 		// we only set it to two to indicate a cert chain.
 		// the actual number of certs will be in the payload.
@@ -159,17 +211,20 @@ func DecodeSCEPResponse(ctx context.Context, r *http.Response) (interface{}, err
 const (
 	certChainHeader = "application/x-x509-ca-ra-cert"
 	leafHeader      = "application/x-x509-ca-cert"
+	nextCAHeader    = "application/x-x509-next-ca-cert"
 	pkiOpHeader     = "application/x-pki-message"
 )
 
 func contentHeader(op string, certNum int) string {
 	switch op {
-	case "GetCACert":
+	case getCACert:
 		if certNum > 1 {
 			return certChainHeader
 		}
 		return leafHeader
-	case "PKIOperation":
+	case getNextCACert:
+		return nextCAHeader
+	case pkiOperation:
 		return pkiOpHeader
 	default:
 		return "text/plain"
@@ -3,6 +3,8 @@ package scepserver_test
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/base64"
 	"io/ioutil"
@@ -11,12 +13,15 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/micromdm/scep/v2/depot"
 	filedepot "github.com/micromdm/scep/v2/depot/file"
+	"github.com/micromdm/scep/v2/scep"
 	scepserver "github.com/micromdm/scep/v2/server"
 
 	kitlog "github.com/go-kit/kit/log"
+	"go.mozilla.org/pkcs7"
 )
 
 func TestCACaps(t *testing.T) {
@@ -32,6 +37,76 @@ func TestCACaps(t *testing.T) {
 	}
 }
 
+func TestWithCapabilities(t *testing.T) {
+	caps := scep.Capabilities{scep.CapPOSTPKIOperation, scep.CapSHA512}
+	server, _, teardown := newServer(t, scepserver.WithCapabilities(caps))
+	defer teardown()
+	resp, err := http.Get(server.URL + "/scep?operation=GetCACaps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := string(body), string(caps.Marshal()); have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
+
+func TestGetNextCACert(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := depot.NewCACert(depot.WithCommonName("next CA")).SelfSign(rand.Reader, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, svc, teardown := newServer(t, scepserver.WithNextCA(next))
+	defer teardown()
+
+	caps, err := svc.GetCACaps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !scep.ParseCapabilities(caps).Has(scep.CapGetNextCACert) {
+		t.Errorf("GetNextCACert not advertised in %q", caps)
+	}
+
+	resp, err := http.Get(server.URL + "/scep?operation=GetNextCACert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if have, want := resp.Header.Get("Content-Type"), "application/x-x509-next-ca-cert"; have != want {
+		t.Errorf("have Content-Type %q, want %q", have, want)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p7, err := pkcs7.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p7.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	certs, err := scep.CACerts(p7.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || !certs[0].Equal(next) {
+		t.Error("response does not contain the next CA certificate")
+	}
+}
+
 func TestEncodePKCSReq_Request(t *testing.T) {
 	pkcsreq := loadTestFile(t, "../scep/testdata/PKCSReq.der")
 	msg := scepserver.SCEPRequest{
@@ -100,6 +175,27 @@ func TestPKIOperation(t *testing.T) {
 	}
 }
 
+func TestPKIOperationRateLimited(t *testing.T) {
+	limiter := scepserver.NewRateLimiter(1, time.Hour, 0, 0)
+	server, _, teardown := newServer(t, scepserver.WithRateLimiter(limiter))
+	defer teardown()
+	pkcsreq := loadTestFile(t, "../scep/testdata/PKCSReq.der")
+	url := server.URL + "/scep?operation=PKIOperation"
+	for _, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		resp, err := http.Post(url, "", bytes.NewReader(pkcsreq))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatal("expected", want, "got", resp.StatusCode)
+		}
+		if want == http.StatusTooManyRequests && resp.Header.Get("Retry-After") != "3600" {
+			t.Errorf("unexpected Retry-After %q", resp.Header.Get("Retry-After"))
+		}
+	}
+}
+
 func TestPKIOperationGET(t *testing.T) {
 	server, _, teardown := newServer(t)
 	defer teardown()
@@ -135,7 +231,7 @@ func newServer(t *testing.T, opts ...scepserver.ServiceOption) (*httptest.Server
 	crt, key, err := depot.CA([]byte{})
 	var svc scepserver.Service // scep service
 	{
-		svc, err = scepserver.NewService(crt[0], key, scepserver.NopCSRSigner())
+		svc, err = scepserver.NewService(crt[0], key, scepserver.NopCSRSigner(), opts...)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -171,3 +267,181 @@ func loadTestFile(t *testing.T, path string) []byte {
 	}
 	return data
 }
+
+// recordingService is a Service backend that records the operation it was
+// invoked for and echoes a fixed payload.
+type recordingService struct {
+	called  string
+	message []byte
+}
+
+func (s *recordingService) GetCACaps(ctx context.Context) ([]byte, error) {
+	s.called = "GetCACaps"
+	return []byte("POSTPKIOperation"), nil
+}
+
+func (s *recordingService) GetCACert(ctx context.Context, message string) ([]byte, int, error) {
+	s.called, s.message = "GetCACert", []byte(message)
+	return []byte("cacert"), 1, nil
+}
+
+func (s *recordingService) PKIOperation(ctx context.Context, msg []byte) ([]byte, error) {
+	s.called, s.message = "PKIOperation", msg
+	return []byte("certrep"), nil
+}
+
+func (s *recordingService) GetNextCACert(ctx context.Context) ([]byte, error) {
+	s.called = "GetNextCACert"
+	return []byte("nextca"), nil
+}
+
+func TestHandlerDispatch(t *testing.T) {
+	svc := &recordingService{}
+	handler := scepserver.MakeHTTPHandler(scepserver.MakeServerEndpoints(svc), svc, kitlog.NewNopLogger())
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	pkimsg := []byte{0x30, 0x03, 0x02, 0x01, 0x01}
+	// base64 encoded with '+' and '/'
+	plusmsg := []byte{0x30, 0x07, 0x04, 0x05, 0, 0, 0xfb, 0xef, 0xbf}
+	tests := []struct {
+		name        string
+		method      string
+		query       string
+		body        []byte
+		wantOp      string
+		wantMessage []byte
+		wantType    string
+	}{
+		{"GetCACaps", "GET", "operation=GetCACaps", nil, "GetCACaps", nil, "text/plain"},
+		{"GetCACert", "GET", "operation=GetCACert&message=ca-ident", nil, "GetCACert", []byte("ca-ident"), "application/x-x509-ca-cert"},
+		{"GetNextCACert", "GET", "operation=GetNextCACert", nil, "GetNextCACert", nil, "application/x-x509-next-ca-cert"},
+		{"PKIOperationPOST", "POST", "operation=PKIOperation", pkimsg, "PKIOperation", pkimsg, "application/x-pki-message"},
+		{"PKIOperationGET", "GET", "operation=PKIOperation&message=" + base64.StdEncoding.EncodeToString(pkimsg), nil, "PKIOperation", pkimsg, "application/x-pki-message"},
+		{"PKIOperationGETEscaped", "GET", "operation=PKIOperation&message=" + scep.EncodeGETMessage(plusmsg), nil, "PKIOperation", plusmsg, "application/x-pki-message"},
+		{"PKIOperationGETUnescaped", "GET", "operation=PKIOperation&message=" + base64.StdEncoding.EncodeToString(plusmsg), nil, "PKIOperation", plusmsg, "application/x-pki-message"},
+		{"PKIOperationGETURLSafe", "GET", "operation=PKIOperation&message=" + base64.RawURLEncoding.EncodeToString(plusmsg), nil, "PKIOperation", plusmsg, "application/x-pki-message"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*svc = recordingService{}
+			req, err := http.NewRequest(tt.method, server.URL+"/scep?"+tt.query, bytes.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatal("expected", http.StatusOK, "got", resp.StatusCode)
+			}
+			if have, want := svc.called, tt.wantOp; have != want {
+				t.Errorf("have %s, want %s", have, want)
+			}
+			if have, want := svc.message, tt.wantMessage; !bytes.Equal(have, want) {
+				t.Errorf("have message %q, want %q", have, want)
+			}
+			if have, want := resp.Header.Get("Content-Type"), tt.wantType; have != want {
+				t.Errorf("have Content-Type %s, want %s", have, want)
+			}
+		})
+	}
+}
+
+func TestProfileHTTPHandler(t *testing.T) {
+	wifi, vpn := &recordingService{}, &recordingService{}
+	handler := scepserver.MakeProfileHTTPHandler(map[string]*scepserver.Endpoints{
+		"wifi": scepserver.MakeServerEndpoints(wifi),
+		"vpn":  scepserver.MakeServerEndpoints(vpn),
+	}, kitlog.NewNopLogger())
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, tt := range []struct {
+		path   string
+		status int
+	}{
+		{"/scep/vpn", http.StatusOK},
+		{"/scep/other", http.StatusNotFound},
+		{"/scep", http.StatusNotFound},
+	} {
+		resp, err := http.Get(server.URL + tt.path + "?operation=GetCACaps")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: have status %d, want %d", tt.path, resp.StatusCode, tt.status)
+		}
+	}
+	if wifi.called != "" || vpn.called != "GetCACaps" {
+		t.Errorf("have wifi %q and vpn %q called, want only vpn", wifi.called, vpn.called)
+	}
+}
+
+func TestHandlerBadRequest(t *testing.T) {
+	svc := &recordingService{}
+	handler := scepserver.MakeHTTPHandler(scepserver.MakeServerEndpoints(svc), svc, kitlog.NewNopLogger())
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, query := range []string{
+		"",
+		"operation=GetCRL",
+		"operation=PKIOperation&message=not-base64!",
+	} {
+		resp, err := http.Get(server.URL + "/scep?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%q: expected %d, got %d", query, http.StatusBadRequest, resp.StatusCode)
+		}
+		if svc.called != "" {
+			t.Errorf("%q: unexpected call to %s", query, svc.called)
+		}
+	}
+}
+
+type staticCRLs []byte
+
+func (c staticCRLs) CRL() ([]byte, error) {
+	if c == nil {
+		return nil, depot.ErrCRLNotFound
+	}
+	return c, nil
+}
+
+func TestCRLHandler(t *testing.T) {
+	crl := []byte("crl")
+	for _, tt := range []struct {
+		name     string
+		method   string
+		crls     staticCRLs
+		wantCode int
+	}{
+		{"GET", "GET", crl, http.StatusOK},
+		{"POST", "POST", crl, http.StatusMethodNotAllowed},
+		{"no CRL", "GET", nil, http.StatusNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			scepserver.NewCRLHandler(tt.crls).ServeHTTP(rr, httptest.NewRequest(tt.method, "/crl", nil))
+			if have, want := rr.Code, tt.wantCode; have != want {
+				t.Fatalf("have %d, want %d", have, want)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			if have, want := rr.Header().Get("Content-Type"), "application/pkix-crl"; have != want {
+				t.Errorf("have Content-Type %q, want %q", have, want)
+			}
+			if !bytes.Equal(rr.Body.Bytes(), crl) {
+				t.Errorf("have body %q, want %q", rr.Body.Bytes(), crl)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+// Package tracing defines the tracing spans of SCEP transactions used by
+// the scep, server and client packages. The interfaces mirror the
+// OpenTelemetry trace API, so an OpenTelemetry trace.Tracer is adapted by
+// converting the attributes to attribute.String key values. Spans started
+// from the context of a parent span are its children, which traces an
+// enrollment across the RA, the CA and a remote signer such as a KMS.
+package tracing
+
+import "context"
+
+// Attribute keys of the SCEP spans.
+const (
+	TransactionIDKey = "scep.transaction_id"
+	MessageTypeKey   = "scep.message_type"
+)
+
+// Attribute is a key value pair describing a span.
+type Attribute struct {
+	Key   string
+	Value string
+}
+
+// String returns the Attribute for key and value.
+func String(key, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Tracer starts spans. Implementations must be safe for concurrent use.
+type Tracer interface {
+	// Start starts the span name as a child of the span in ctx, if any,
+	// and returns a context carrying the new span.
+	Start(ctx context.Context, name string, attrs ...Attribute) (context.Context, Span)
+}
+
+// Span is an operation of a SCEP transaction.
+type Span interface {
+	SetAttributes(attrs ...Attribute)
+	RecordError(err error)
+	End()
+}
+
+type nop struct{}
+
+// Nop returns a Tracer whose spans record nothing.
+func Nop() Tracer { return nop{} }
+
+func (nop) Start(ctx context.Context, _ string, _ ...Attribute) (context.Context, Span) {
+	return ctx, nop{}
+}
+
+func (nop) SetAttributes(...Attribute) {}
+func (nop) RecordError(error)          {}
+func (nop) End()                       {}
@@ -0,0 +1,178 @@
+"use strict";
+
+// The admin API is served next to the dashboard.
+const API = "../admin/";
+
+const $ = (id) => document.getElementById(id);
+
+function apiKey() {
+  return sessionStorage.getItem("scep-admin-api-key");
+}
+
+async function api(method, path, form) {
+  const opts = { method, headers: { Authorization: "Bearer " + apiKey() } };
+  if (form) {
+    opts.body = new URLSearchParams(form);
+  }
+  const resp = await fetch(API + path, opts);
+  if (resp.status === 401) {
+    signOut();
+    throw new Error("invalid API key");
+  }
+  if (!resp.ok) {
+    throw new Error((await resp.text()).trim() || resp.statusText);
+  }
+  return resp.json();
+}
+
+function showError(err) {
+  $("error").textContent = err ? err.message : "";
+  $("error").hidden = !err;
+}
+
+function cell(row, text, className) {
+  const td = row.insertCell();
+  td.textContent = text;
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function button(parent, label, onclick) {
+  const b = document.createElement("button");
+  b.textContent = label;
+  b.addEventListener("click", () => onclick().catch(showError));
+  parent.appendChild(b);
+}
+
+function date(s) {
+  return new Date(s).toLocaleString();
+}
+
+function sans(t) {
+  return [].concat(t.dns_names || [], t.email_addresses || [], t.ip_addresses || [], t.uris || []).join(", ");
+}
+
+async function loadCA() {
+  const status = await api("GET", "ca");
+  const body = $("ca-certs");
+  body.replaceChildren();
+  for (const c of status.certificates) {
+    const row = body.insertRow();
+    const days = Math.floor((new Date(c.not_after) - Date.now()) / 86400000);
+    cell(row, c.subject);
+    cell(row, c.serial);
+    cell(row, date(c.not_after));
+    cell(row, days, days < 30 ? "expired" : "");
+  }
+  const counts = [];
+  if (status.pending >= 0) counts.push(status.pending + " pending");
+  if (status.issued >= 0) counts.push(status.issued + " issued");
+  if (status.revoked >= 0) counts.push(status.revoked + " revoked");
+  $("ca-counts").textContent = counts.join(", ");
+  $("approvals").hidden = status.pending < 0;
+}
+
+async function loadPending() {
+  if ($("approvals").hidden) {
+    return;
+  }
+  const txs = await api("GET", "transactions?status=pending");
+  const body = $("pending");
+  body.replaceChildren();
+  for (const t of txs) {
+    const row = body.insertRow();
+    cell(row, date(t.created_at));
+    cell(row, t.message_type);
+    cell(row, t.subject);
+    cell(row, sans(t));
+    cell(row, t.challenge ? "yes" : "no");
+    const actions = cell(row, "", "actions");
+    const id = encodeURIComponent(t.id);
+    button(actions, "Approve", async () => {
+      await api("POST", "transactions/" + id + "/approve");
+      await refresh();
+    });
+    button(actions, "Reject", async () => {
+      const reason = prompt("Reason sent to the device", "");
+      if (reason === null) {
+        return;
+      }
+      await api("POST", "transactions/" + id + "/reject", { reason });
+      await refresh();
+    });
+  }
+}
+
+async function loadCertificates() {
+  const certs = await api("GET", "certificates?q=" + encodeURIComponent($("query").value));
+  const body = $("certificates");
+  body.replaceChildren();
+  for (const c of certs) {
+    const row = body.insertRow();
+    cell(row, c.serial);
+    cell(row, c.subject);
+    cell(row, date(c.not_after));
+    const expired = new Date(c.not_after) < Date.now();
+    if (c.revoked_at) {
+      cell(row, "revoked " + date(c.revoked_at), "revoked");
+    } else {
+      cell(row, expired ? "expired" : "valid", expired ? "expired" : "");
+    }
+    const actions = cell(row, "", "actions");
+    if (!c.revoked_at && !expired) {
+      button(actions, "Revoke", async () => {
+        if (!confirm("Revoke " + c.subject + " (" + c.serial + ")?")) {
+          return;
+        }
+        await api("POST", "certificates/" + c.serial + "/revoke");
+        await refresh();
+      });
+    }
+  }
+}
+
+async function refresh() {
+  showError(null);
+  await loadCA();
+  await loadPending();
+  await loadCertificates();
+}
+
+function signOut() {
+  sessionStorage.removeItem("scep-admin-api-key");
+  $("dashboard").hidden = true;
+  $("logout").hidden = true;
+  $("login").hidden = false;
+}
+
+function signIn() {
+  $("login").hidden = true;
+  $("dashboard").hidden = false;
+  $("logout").hidden = false;
+  refresh().catch(showError);
+}
+
+document.addEventListener("DOMContentLoaded", () => {
+  $("login").addEventListener("submit", (e) => {
+    e.preventDefault();
+    sessionStorage.setItem("scep-admin-api-key", $("api-key").value);
+    $("api-key").value = "";
+    signIn();
+  });
+  $("logout").addEventListener("click", signOut);
+  $("search").addEventListener("submit", (e) => {
+    e.preventDefault();
+    loadCertificates().catch(showError);
+  });
+  $("challenge").addEventListener("submit", (e) => {
+    e.preventDefault();
+    api("POST", "challenge", { cn: $("challenge-cn").value })
+      .then((resp) => { $("challenge-value").textContent = resp.challenge; })
+      .catch(showError);
+  });
+  if (apiKey()) {
+    signIn();
+  }
+});
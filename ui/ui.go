@@ -0,0 +1,39 @@
+// Package ui embeds a web dashboard for the admin API of the SCEP server:
+// pending approvals, certificate search and revocation, challenge
+// generation and CA status. The dashboard is static; it calls the admin API
+// at ../admin/ relative to its own path with the API key entered by the
+// operator, which is kept in the session storage of the browser.
+package ui
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed static
+var static embed.FS
+
+// PathPrefix is the path below which scepserver mounts the dashboard, next
+// to the admin API at scepserver.AdminPathPrefix.
+const PathPrefix = "/ui/"
+
+// Handler returns an http.Handler serving the dashboard files. Mount it
+// with the prefix stripped, e.g.
+//
+//	mux.Handle(ui.PathPrefix, http.StripPrefix(ui.PathPrefix, ui.Handler()))
+func Handler() http.Handler {
+	files, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.FileServer(http.FS(files))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the dashboard only loads its own scripts and is never framed
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; frame-ancestors 'none'")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Cache-Control", "no-cache")
+		fileServer.ServeHTTP(w, r)
+	})
+}
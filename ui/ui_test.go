@@ -0,0 +1,34 @@
+package ui
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	srv := httptest.NewServer(http.StripPrefix(PathPrefix, Handler()))
+	defer srv.Close()
+
+	for path, contentType := range map[string]string{
+		PathPrefix:               "text/html",
+		PathPrefix + "app.js":    "javascript",
+		PathPrefix + "style.css": "text/css",
+	} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: have status %d, want %d", path, resp.StatusCode, http.StatusOK)
+		}
+		if have := resp.Header.Get("Content-Type"); !strings.Contains(have, contentType) {
+			t.Errorf("%s: have Content-Type %q, want %s", path, have, contentType)
+		}
+		if resp.Header.Get("Content-Security-Policy") == "" {
+			t.Errorf("%s: no Content-Security-Policy", path)
+		}
+	}
+}